@@ -0,0 +1,66 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/HotelsDotCom/kube-graffiti/pkg/audit"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestInitAuditLeavesActiveWriterNilWhenDisabled checks that, with auditing disabled (the default),
+// initAudit does not start a Writer - so RecordDecision keeps discarding every record.
+func TestInitAuditLeavesActiveWriterNilWhenDisabled(t *testing.T) {
+	viper.Set("audit.enabled", false)
+	defer viper.Set("audit.enabled", false)
+
+	audit.ActiveWriter = nil
+	defer func() { audit.ActiveWriter = nil }()
+
+	require.NoError(t, initAudit())
+	assert.Nil(t, audit.ActiveWriter)
+}
+
+// TestInitAuditStartsAWriterWhenEnabled checks that enabling auditing starts a Writer against the
+// configured directory and sets it as the ActiveWriter the rest of the program records decisions to.
+func TestInitAuditStartsAWriterWhenEnabled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cmd-audit-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	viper.Set("audit.enabled", true)
+	viper.Set("audit.directory", dir)
+	viper.Set("audit.detail", "decision-only")
+	defer func() {
+		viper.Set("audit.enabled", false)
+		viper.Set("audit.directory", "")
+		viper.Set("audit.detail", "")
+	}()
+
+	audit.ActiveWriter = nil
+	defer func() {
+		if audit.ActiveWriter != nil {
+			audit.ActiveWriter.Close()
+		}
+		audit.ActiveWriter = nil
+	}()
+
+	require.NoError(t, initAudit())
+	require.NotNil(t, audit.ActiveWriter)
+}
@@ -22,11 +22,18 @@ import (
 	"strings"
 	"time"
 
+	"github.com/HotelsDotCom/kube-graffiti/pkg/audit"
 	"github.com/HotelsDotCom/kube-graffiti/pkg/config"
 	"github.com/HotelsDotCom/kube-graffiti/pkg/existing"
 	"github.com/HotelsDotCom/kube-graffiti/pkg/graffiti"
 	"github.com/HotelsDotCom/kube-graffiti/pkg/healthcheck"
+	"github.com/HotelsDotCom/kube-graffiti/pkg/httpresponse"
 	"github.com/HotelsDotCom/kube-graffiti/pkg/log"
+	"github.com/HotelsDotCom/kube-graffiti/pkg/metrics"
+	"github.com/HotelsDotCom/kube-graffiti/pkg/rbac"
+	"github.com/HotelsDotCom/kube-graffiti/pkg/statusz"
+	"github.com/HotelsDotCom/kube-graffiti/pkg/tracing"
+	"github.com/HotelsDotCom/kube-graffiti/pkg/version"
 	"github.com/HotelsDotCom/kube-graffiti/pkg/webhook"
 	"github.com/mitchellh/mapstructure"
 	"github.com/spf13/cobra"
@@ -52,6 +59,18 @@ var (
 		PreRun:  initRootCmd,
 		Run:     runRootCmd,
 	}
+
+	// ExistingSweepComplete reports whether the initial existing-objects sweep has finished. It starts
+	// false so the readiness endpoint (see runRootCmd's SetReadinessFunc) holds the pod not-ready while
+	// a check-existing sweep is in flight, letting rollout/traffic ordering depend on graffiti having
+	// reconciled existing objects first. initExistingCheck flips it true as soon as there is nothing
+	// left to wait for - either because check-existing is disabled, or because the sweep has returned.
+	ExistingSweepComplete = false
+
+	// applyRulesAgainstExistingObjects is a package var, rather than a direct call to
+	// existing.ApplyRulesAgainstExistingObjects, so that tests can inject a fake sweep and control when
+	// it completes - see scheduleDiscoveryCacheRefresh in pkg/existing for the same pattern.
+	applyRulesAgainstExistingObjects = existing.ApplyRulesAgainstExistingObjects
 )
 
 // init defines command-line and environment arguments
@@ -97,22 +116,114 @@ func runRootCmd(_ *cobra.Command, _ []string) {
 	mylog = log.ComponentLogger(componentName, "runRootCmd")
 	mylog.Info().Str("log-level", viper.GetString("log-level")).Msg("This is the log level")
 
+	graffiti.AdmissionSkipAnnotationKey = viper.GetString("admission-skip-annotation")
+	existing.ExistingSkipAnnotationKey = viper.GetString("existing-skip-annotation")
+	graffiti.DefaultMaxPatchOperations = viper.GetInt("max-patch-operations")
+	graffiti.DefaultMaxPatchBytes = viper.GetInt("max-patch-bytes")
+	existing.DiscoveryCacheDir = viper.GetString("discovery.cache-dir")
+	existing.ExtraCACertPaths = viper.GetStringSlice("extra-ca-cert-paths")
+	existing.UnknownTargetPolicy = viper.GetString("validation.unknown-target-policy")
+	existing.DiscoveryCacheTTL = viper.GetDuration("discovery.cache-ttl")
+	existing.MissingNamespacePolicy = viper.GetString("treat-missing-namespace-as")
+	existing.ReportPath = viper.GetString("existing-report-path")
+	existing.ReportNamespaceCardinalityCap = viper.GetInt("existing-report-namespace-cap")
+	existing.ValidatePatchResult = viper.GetBool("existing.validate-patch-result")
+	existing.SSAConflictFallback = viper.GetBool("existing.ssa-conflict-fallback")
+	existing.CoalescePatches = viper.GetBool("existing.coalesce-patches")
+	existing.DryRun = viper.GetBool("existing.dry-run")
+	existing.DryRunReportPath = viper.GetString("existing-dry-run-report-path")
+	existing.HealthBackoffErrorThreshold = viper.GetInt("existing.health-backoff-error-threshold")
+	existing.HealthBackoffWindow = viper.GetDuration("existing.health-backoff-window")
+	existing.HealthBackoffBase = viper.GetDuration("existing.health-backoff-base")
+	existing.HealthBackoffMax = viper.GetDuration("existing.health-backoff-max")
+	webhook.AutoReregisterOnMismatch = viper.GetBool("auto-reregister-on-mismatch")
+	webhook.PathConsistencyCheckInterval = viper.GetDuration("path-consistency-check-interval")
+	webhook.StrictMode = viper.GetBool("webhook.strict-mode")
+	webhook.FaultInjectionEnvironment = config.Environment
+	webhook.FaultInjectionUnsafe = viper.GetBool("fault-injection-unsafe")
+	httpresponse.VerboseErrors = viper.GetBool("verbose-http-errors")
+	httpresponse.ExtraHeaders = viper.GetStringMapString("extra-response-headers")
+	graffiti.ProtectedNamespaces = append(viper.GetStringSlice("protected-namespaces"), config.Server.Namespace)
+	graffiti.TemplateTimeout = viper.GetDuration("template-timeout")
+	graffiti.PerRuleTimeout = viper.GetDuration("per-rule-timeout")
+	graffiti.TemplateMaxOutputBytes = viper.GetInt("template-max-output-bytes")
+	graffiti.TemplateMaxNodes = viper.GetInt("template-max-nodes")
+	graffiti.MaxFieldMapDepth = viper.GetInt("max-field-map-depth")
+	graffiti.QuarantineLabelKey = viper.GetString("quarantine-label-key")
+	graffiti.QuarantineReasonAnnotationKey = viper.GetString("quarantine-reason-annotation-key")
+	graffiti.SuppressAllowedResultMessage = viper.GetBool("suppress-allowed-result-message")
+	metrics.MaxLabelCardinality = viper.GetInt("metric-label-cardinality-cap")
+	log.RedactFields = viper.GetStringSlice("log.redact-fields")
+	tracing.Enabled = viper.GetBool("tracing.enabled")
+	if exporter, ok := tracing.NewOTLPHTTPExporter(); ok {
+		tracing.CurrentExporter = exporter
+	}
+
 	mylog.Info().Msg("configuration read ok")
 	mylog.Debug().Msg("validating config")
 	if err := config.ValidateConfig(); err != nil {
+		statusz.RecordConfigLoad(err)
 		mylog.Fatal().Err(err).Msg("failed to validate config")
 	}
+	statusz.RecordConfigLoad(nil)
+
+	if err := initAudit(); err != nil {
+		mylog.Fatal().Err(err).Msg("failed to start audit writer")
+	}
 
 	mylog.Debug().Msg("getting kubernetes client")
 	kubeClient, restConfig := getKubeClients()
+
+	filteredRules, err := filterRulesForKubeVersion(config.Rules, kubeClient)
+	if err != nil {
+		mylog.Fatal().Err(err).Msg("failed to filter rules against the cluster's kubernetes version")
+	}
+	config.Rules = filteredRules
+
+	if err := checkRBAC(config, kubeClient); err != nil {
+		mylog.Fatal().Err(err).Msg("rbac check failed")
+	}
+
 	// Setup and start the health-checker
 	healthChecker := healthcheck.NewHealthChecker(healthcheck.NewCutDownNamespaceClient(kubeClient), viper.GetInt("health-checker.port"), viper.GetString("health-checker.path"))
+	healthChecker.SetFailureGrace(viper.GetInt("health-checker.failure-threshold"), viper.GetDuration("health-checker.failure-window"))
+	healthChecker.ExposedPaths = viper.GetStringSlice("health-checker.exposed-paths")
+	healthChecker.SetReadinessFunc(func() bool { return webhook.Ready && ExistingSweepComplete })
+	healthChecker.RegisterStatusHandler("/existing/status", existing.ServeHealthStatus)
+	healthChecker.RegisterStatusHandler("/existing/coverage", existing.ServeCoverageReport)
+	healthChecker.RegisterStatusHandler("/webhook/faults", webhook.ServeFaultsAdmin)
+	healthChecker.RegisterStatusHandler("/statusz", statusz.Handler)
+	statusz.RegisterComponent("webhook", func() (bool, string) {
+		if webhook.Ready {
+			return true, ""
+		}
+		return false, "webhook path-consistency check reported a mismatch, see the logs"
+	})
+	statusz.RegisterComponent("existing-check", func() (bool, string) {
+		if status := existing.CurrentHealthStatus(); status.Paused {
+			return false, fmt.Sprintf("paused since %s waiting for the apiserver to recover", status.Since)
+		}
+		return true, ""
+	})
+	statusz.RegisterComponent("existing-sweep", func() (bool, string) {
+		if ExistingSweepComplete {
+			return true, ""
+		}
+		return false, "initial existing-objects sweep is still in progress"
+	})
 	healthChecker.StartHealthChecker()
 
+	if len(config.Faults) > 0 {
+		if err := webhook.ConfigureFaults(config.Faults); err != nil {
+			mylog.Fatal().Err(err).Msg("failed to configure fault injection")
+		}
+	}
+
 	// Setup and start the mutating webhook server
 	if err := initWebhookServer(config, kubeClient); err != nil {
 		mylog.Fatal().Err(err).Msg("webhook server failed to start")
 	}
+	setStatuszRules()
 
 	if err := initExistingCheck(config, restConfig); err != nil {
 		mylog.Fatal().Err(err).Msg("failed to check existing namespaces")
@@ -125,6 +236,55 @@ func runRootCmd(_ *cobra.Command, _ []string) {
 	os.Exit(0)
 }
 
+// filterRulesForKubeVersion discovers k's live kubernetes version and drops any rule whose
+// min-kube-version/max-kube-version excludes it, so that checkRBAC, the webhook server and the existing
+// check all only ever see rules that will actually run on this cluster.
+func filterRulesForKubeVersion(rules []config.Rule, k *kubernetes.Clientset) ([]config.Rule, error) {
+	serverVersion, err := k.Discovery().ServerVersion()
+	if err != nil {
+		return nil, fmt.Errorf("failed to discover the cluster's kubernetes version: %v", err)
+	}
+	return config.FilterRulesForKubeVersion(rules, serverVersion)
+}
+
+// checkRBAC derives the permissions the configured rules need and verifies them against the
+// current credentials before anything is started, so that misconfigured RBAC is reported once at
+// startup instead of as a stream of Forbidden errors later. "rbac-check" controls how a missing
+// permission is handled: "strict" fails startup, "warn" logs and continues, "off" skips the check
+// entirely.
+func checkRBAC(c config.Configuration, k *kubernetes.Clientset) error {
+	mylog := log.ComponentLogger(componentName, "checkRBAC")
+
+	mode := viper.GetString("rbac-check")
+	if mode == "off" {
+		mylog.Debug().Msg("rbac check disabled")
+		return nil
+	}
+
+	reqs := rbac.DerivePermissions(c.Rules)
+	reqs, err := rbac.ExpandWildcards(reqs, k.Discovery())
+	if err != nil {
+		return fmt.Errorf("failed to expand wildcard rbac requirements: %v", err)
+	}
+
+	missing, err := rbac.CheckPermissions(k.AuthorizationV1().SelfSubjectAccessReviews(), reqs)
+	if err != nil {
+		return fmt.Errorf("failed to check rbac permissions: %v", err)
+	}
+	if len(missing) == 0 {
+		mylog.Info().Msg("rbac check passed, all configured rules have the permissions they need")
+		return nil
+	}
+
+	for _, m := range missing {
+		mylog.Warn().Str("group", m.Permission.Group).Str("resource", m.Permission.Resource).Str("verb", m.Permission.Verb).Strs("rules", m.Rules).Msg("missing rbac permission required by a configured rule")
+	}
+	if mode == "strict" {
+		return fmt.Errorf("%d rbac permission(s) required by the configuration are missing", len(missing))
+	}
+	return nil
+}
+
 // getKubeClients returns client-go clientset and a dynamic client
 func getKubeClients() (*kubernetes.Clientset, *rest.Config) {
 	mylog := log.ComponentLogger(componentName, "getKubeClients")
@@ -134,6 +294,11 @@ func getKubeClients() (*kubernetes.Clientset, *rest.Config) {
 	if err != nil {
 		panic(err.Error())
 	}
+	config.UserAgent = version.UserAgent()
+
+	if err := existing.AppendExtraCACerts(config); err != nil {
+		mylog.Fatal().Err(err).Msg("failed to load extra ca certs")
+	}
 
 	// creates the clientset
 	mylog.Debug().Msg("creating kubernetes api clientset")
@@ -163,15 +328,26 @@ func initWebhookServer(c config.Configuration, k *kubernetes.Clientset) error {
 		ca, k,
 		viper.GetInt("server.port"),
 	)
+	server.Canary = webhook.CanaryConfig{
+		Window:    viper.GetDuration("server.canary-window"),
+		MaxErrors: viper.GetInt("server.canary-max-errors"),
+	}
 
 	// add each of the graffiti rules into the mux
 	mylog.Info().Int("count", len(c.Rules)).Msg("loading graffiti rules")
 	for _, rule := range c.Rules {
 		mylog.Info().Str("rule-name", rule.Registration.Name).Msg("adding graffiti rule")
+		mylog.Info().Msg(rule.Summary())
+		var selfNamespaceSelector string
+		if rule.Registration.NamespaceSelectorAppliesToNamespaces == webhook.NamespaceSelectorAppliesToNamespacesSelf {
+			selfNamespaceSelector = rule.Registration.NamespaceSelector
+		}
 		server.AddGraffitiRule(graffiti.Rule{
-			Name:     rule.Registration.Name,
-			Matchers: rule.Matchers,
-			Payload:  rule.Payload,
+			Name:                  rule.Registration.Name,
+			Matchers:              rule.Matchers,
+			Payload:               rule.Payload,
+			EvaluateOn:            rule.EvaluateOn,
+			SelfNamespaceSelector: selfNamespaceSelector,
 		})
 	}
 
@@ -182,36 +358,115 @@ func initWebhookServer(c config.Configuration, k *kubernetes.Clientset) error {
 	time.Sleep(2 * time.Second)
 
 	// register all rules with the kubernetes apiserver
+	configClient := k.AdmissionregistrationV1beta1().MutatingWebhookConfigurations()
+	registrations := make(map[string]webhook.Registration, len(c.Rules))
 	for _, rule := range c.Rules {
-		mylog.Info().Str("name", rule.Registration.Name).Msg("registering rule with api server")
-		err = server.RegisterHook(rule.Registration, k)
+		registration := rule.Registration
+		targets, expanded, err := webhook.ExpandTargets(registration.Targets, k.Discovery())
 		if err != nil {
-			mylog.Error().Err(err).Str("name", rule.Registration.Name).Msg("failed to register rule with apiserver")
+			mylog.Error().Err(err).Str("name", registration.Name).Msg("failed to expand glob patterns in registration targets")
 			return err
 		}
+		if expanded {
+			mylog.Warn().Str("name", registration.Name).Msg("registration targets contained glob patterns, expanded against current discovery - a matching CRD created later will need this rule re-registered before it is targetted")
+			registration.Targets = targets
+		}
+
+		mylog.Info().Str("name", registration.Name).Msg("registering rule with api server")
+		if err := server.RegisterHook(registration, configClient); err != nil {
+			mylog.Error().Err(err).Str("name", registration.Name).Msg("failed to register rule with apiserver")
+			return err
+		}
+		registrations[registration.Name] = registration
+	}
+
+	// verify the registered webhook configurations and the handler's mounted rules agree on paths,
+	// both now and periodically for the life of the process.
+	if mismatches, err := server.ReconcilePaths(configClient, registrations); err != nil {
+		mylog.Error().Err(err).Msg("failed to check webhook path consistency")
+	} else if len(mismatches) > 0 {
+		mylog.Warn().Int("count", len(mismatches)).Msg("webhook path consistency check found mismatches at startup")
 	}
+	server.StartPathConsistencyChecker(configClient, registrations, make(chan struct{}))
+	server.StartCABundleRefresher(caPath, configClient, registrations, make(chan struct{}))
 
 	return nil
 }
 
+// setStatuszRules copies webhook.CurrentRegistrations, the source of truth RegisterHook maintains as
+// it registers each rule, into statusz's own rule list, for display on the /statusz status page.
+func setStatuszRules() {
+	registrations := webhook.CurrentRegistrations()
+	rules := make([]statusz.RuleStatus, 0, len(registrations))
+	for _, r := range registrations {
+		rules = append(rules, statusz.RuleStatus{Name: r.Name, Path: r.Path, Registered: r.Registered, LastError: r.LastError, RegisteredAt: r.RegisteredAt})
+	}
+	statusz.SetRules(rules)
+}
+
 func initExistingCheck(config config.Configuration, r *rest.Config) error {
 	mylog := log.ComponentLogger(componentName, "initExistingCheck")
 
 	var err error
 	if !viper.IsSet("check-existing") || viper.GetString("check-existing") != "true" {
 		mylog.Info().Msg("checking of existing objects is disabled")
+		ExistingSweepComplete = true
 		return nil
 	}
+	if config.ConflictResolution != "" {
+		existing.ConflictResolution = config.ConflictResolution
+	}
+	existing.SetCoverageRules(config.Rules)
 	if err = existing.InitKubeClients(r); err != nil {
 		return err
 	}
-	existing.ApplyRulesAgainstExistingObjects(config.Rules)
+	if err := existing.ValidateTargetsAgainstDiscovery(config.Rules); err != nil {
+		return err
+	}
+	runExistingSweep(config.Rules)
 
 	mylog.Info().Msg("check of existing objects completed successfully")
 
 	return nil
 }
 
+// runExistingSweep runs the existing-objects sweep and marks ExistingSweepComplete true once it
+// returns, regardless of how it finishes. It is split out from initExistingCheck purely so that tests
+// can drive the sweep-and-flip-readiness behaviour directly, without also needing a real kubernetes
+// client to get past InitKubeClients/ValidateTargetsAgainstDiscovery first.
+func runExistingSweep(rules []config.Rule) {
+	applyRulesAgainstExistingObjects(rules)
+	ExistingSweepComplete = true
+}
+
+// initAudit starts the audit.Writer that the webhook handler and existing-objects sweep record every
+// rule decision to, if auditing is enabled. It is a no-op, leaving audit.ActiveWriter nil so
+// audit.RecordDecision keeps discarding records, when it isn't.
+func initAudit() error {
+	mylog := log.ComponentLogger(componentName, "initAudit")
+
+	if !viper.GetBool("audit.enabled") {
+		mylog.Info().Msg("auditing is disabled")
+		return nil
+	}
+
+	w, err := audit.NewWriter(audit.Config{
+		Directory:     viper.GetString("audit.directory"),
+		Detail:        audit.Detail(viper.GetString("audit.detail")),
+		MaxSizeBytes:  viper.GetInt64("audit.max-size-bytes"),
+		MaxAge:        viper.GetDuration("audit.max-age"),
+		MaxBackups:    viper.GetInt("audit.max-backups"),
+		Compress:      viper.GetBool("audit.compress"),
+		MaxTotalBytes: viper.GetInt64("audit.max-total-bytes"),
+	})
+	if err != nil {
+		return err
+	}
+	audit.ActiveWriter = w
+	mylog.Info().Str("directory", viper.GetString("audit.directory")).Msg("auditing enabled")
+	return nil
+}
+
 // LoadConfig is reponsible for loading the viper configuration file.
 func loadConfig(file string) (config.Configuration, error) {
 	setDefaults()
@@ -225,8 +480,13 @@ func loadConfig(file string) (config.Configuration, error) {
 	}
 
 	if err := viper.ReadInConfig(); err != nil {
-		fmt.Println("Can't read config:", err)
-		os.Exit(1)
+		if resolved := viper.ConfigFileUsed(); resolved != "" {
+			err = retryConfigFileWithoutBOM(viper.GetViper(), resolved, err)
+		}
+		if err != nil {
+			fmt.Println("Can't read config:", err)
+			os.Exit(1)
+		}
 	}
 
 	return unmarshalFromViperStrict()
@@ -238,10 +498,61 @@ func setDefaults() {
 	viper.SetDefault("server.port", 8443)
 	viper.SetDefault("health-checker.port", 8080)
 	viper.SetDefault("health-checker.path", "/healthz")
+	viper.SetDefault("health-checker.failure-threshold", 1)
+	viper.SetDefault("health-checker.failure-window", 0)
 	viper.SetDefault("server.company-domain", "acme.com")
 	viper.SetDefault("server.ca-cert-path", "/ca-cert")
 	viper.SetDefault("server.cert-path", "/server-cert")
 	viper.SetDefault("server.cert-path", "/server-key")
+	viper.SetDefault("server.canary-window", 0)
+	viper.SetDefault("server.canary-max-errors", 0)
+	viper.SetDefault("admission-skip-annotation", graffiti.AdmissionSkipAnnotationKey)
+	viper.SetDefault("existing-skip-annotation", existing.ExistingSkipAnnotationKey)
+	viper.SetDefault("rbac-check", "warn")
+	viper.SetDefault("max-patch-operations", graffiti.DefaultMaxPatchOperations)
+	viper.SetDefault("discovery.cache-dir", existing.DiscoveryCacheDir)
+	viper.SetDefault("extra-ca-cert-paths", existing.ExtraCACertPaths)
+	viper.SetDefault("validation.unknown-target-policy", existing.UnknownTargetPolicy)
+	viper.SetDefault("discovery.cache-ttl", existing.DiscoveryCacheTTL)
+	viper.SetDefault("treat-missing-namespace-as", existing.MissingNamespacePolicy)
+	viper.SetDefault("existing-report-path", existing.ReportPath)
+	viper.SetDefault("existing-report-namespace-cap", existing.ReportNamespaceCardinalityCap)
+	viper.SetDefault("existing.validate-patch-result", existing.ValidatePatchResult)
+	viper.SetDefault("existing.ssa-conflict-fallback", existing.SSAConflictFallback)
+	viper.SetDefault("existing.coalesce-patches", existing.CoalescePatches)
+	viper.SetDefault("existing.dry-run", existing.DryRun)
+	viper.SetDefault("existing-dry-run-report-path", existing.DryRunReportPath)
+	viper.SetDefault("existing.health-backoff-error-threshold", existing.HealthBackoffErrorThreshold)
+	viper.SetDefault("existing.health-backoff-window", existing.HealthBackoffWindow)
+	viper.SetDefault("existing.health-backoff-base", existing.HealthBackoffBase)
+	viper.SetDefault("existing.health-backoff-max", existing.HealthBackoffMax)
+	viper.SetDefault("max-patch-bytes", graffiti.DefaultMaxPatchBytes)
+	viper.SetDefault("auto-reregister-on-mismatch", webhook.AutoReregisterOnMismatch)
+	viper.SetDefault("path-consistency-check-interval", webhook.PathConsistencyCheckInterval)
+	viper.SetDefault("webhook.strict-mode", webhook.StrictMode)
+	viper.SetDefault("fault-injection-unsafe", webhook.FaultInjectionUnsafe)
+	viper.SetDefault("verbose-http-errors", httpresponse.VerboseErrors)
+	viper.SetDefault("extra-response-headers", httpresponse.ExtraHeaders)
+	viper.SetDefault("protected-namespaces", graffiti.ProtectedNamespaces)
+	viper.SetDefault("template-timeout", graffiti.TemplateTimeout)
+	viper.SetDefault("per-rule-timeout", graffiti.PerRuleTimeout)
+	viper.SetDefault("template-max-output-bytes", graffiti.TemplateMaxOutputBytes)
+	viper.SetDefault("template-max-nodes", graffiti.TemplateMaxNodes)
+	viper.SetDefault("max-field-map-depth", graffiti.MaxFieldMapDepth)
+	viper.SetDefault("quarantine-label-key", graffiti.QuarantineLabelKey)
+	viper.SetDefault("quarantine-reason-annotation-key", graffiti.QuarantineReasonAnnotationKey)
+	viper.SetDefault("suppress-allowed-result-message", graffiti.SuppressAllowedResultMessage)
+	viper.SetDefault("metric-label-cardinality-cap", metrics.MaxLabelCardinality)
+	viper.SetDefault("log.redact-fields", log.RedactFields)
+	viper.SetDefault("tracing.enabled", tracing.Enabled)
+	viper.SetDefault("audit.enabled", false)
+	viper.SetDefault("audit.directory", "/var/log/kube-graffiti/audit")
+	viper.SetDefault("audit.detail", string(audit.DetailFull))
+	viper.SetDefault("audit.max-size-bytes", int64(0))
+	viper.SetDefault("audit.max-age", time.Duration(0))
+	viper.SetDefault("audit.max-backups", 0)
+	viper.SetDefault("audit.compress", false)
+	viper.SetDefault("audit.max-total-bytes", int64(0))
 }
 
 func unmarshalFromViperStrict() (config.Configuration, error) {
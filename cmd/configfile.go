@@ -0,0 +1,54 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"bytes"
+	"io/ioutil"
+
+	"github.com/HotelsDotCom/kube-graffiti/pkg/log"
+	"github.com/spf13/viper"
+)
+
+// utf8BOM is the three-byte UTF-8 encoding of U+FEFF, which some editors - notably on Windows -
+// prepend to files they save. None of our config formats expect it, and left in place it makes
+// yaml/json parsing fail on the very first character with a cryptic error.
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// stripUTF8BOM removes a leading UTF-8 byte-order mark from data, reporting whether one was present.
+func stripUTF8BOM(data []byte) (stripped []byte, hadBOM bool) {
+	if bytes.HasPrefix(data, utf8BOM) {
+		return data[len(utf8BOM):], true
+	}
+	return data, false
+}
+
+// retryConfigFileWithoutBOM re-reads path and retries v's config parse after stripping a leading
+// UTF-8 BOM, if one is present - the most likely cause of a parse failure at the very start of a
+// config file saved by a Windows editor. If path has no BOM, readErr is returned unchanged so a
+// genuine parse error is never masked. v must already have had SetConfigFile(path) called on it, so
+// that it keeps deriving the config format from path's extension.
+func retryConfigFileWithoutBOM(v *viper.Viper, path string, readErr error) error {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return readErr
+	}
+	stripped, hadBOM := stripUTF8BOM(raw)
+	if !hadBOM {
+		return readErr
+	}
+	mylog := log.ComponentLogger(componentName, "retryConfigFileWithoutBOM")
+	mylog.Warn().Str("path", path).Msg("config file started with a UTF-8 byte-order mark, stripping it and retrying")
+	return v.ReadConfig(bytes.NewReader(stripped))
+}
@@ -0,0 +1,84 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStripUTF8BOMRemovesALeadingBOM(t *testing.T) {
+	withBOM := append(append([]byte{}, utf8BOM...), []byte("log-level: debug\n")...)
+	stripped, hadBOM := stripUTF8BOM(withBOM)
+	assert.True(t, hadBOM)
+	assert.Equal(t, "log-level: debug\n", string(stripped))
+}
+
+func TestStripUTF8BOMLeavesContentWithoutABOMUntouched(t *testing.T) {
+	plain := []byte("log-level: debug\n")
+	stripped, hadBOM := stripUTF8BOM(plain)
+	assert.False(t, hadBOM)
+	assert.Equal(t, plain, stripped)
+}
+
+// TestRetryConfigFileWithoutBOMRecoversAConfigFileSavedWithOne uses a JSON-typed config file, since
+// go-yaml (unlike encoding/json) already tolerates a leading BOM on its own - JSON is where a BOM
+// actually trips up parsing and this retry path earns its keep.
+func TestRetryConfigFileWithoutBOMRecoversAConfigFileSavedWithOne(t *testing.T) {
+	f, err := ioutil.TempFile("", "config-with-bom-*.json")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.Write(append(append([]byte{}, utf8BOM...), []byte(`{"log-level": "debug"}`)...))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	v := viper.New()
+	v.SetConfigFile(f.Name())
+	readErr := v.ReadInConfig()
+	require.Error(t, readErr, "a raw BOM should trip up viper's json parser")
+
+	err = retryConfigFileWithoutBOM(v, f.Name(), readErr)
+	require.NoError(t, err)
+	assert.Equal(t, "debug", v.GetString("log-level"))
+}
+
+func TestRetryConfigFileWithoutBOMLeavesAGenuineParseErrorUnchanged(t *testing.T) {
+	f, err := ioutil.TempFile("", "config-bad-yaml-*.yaml")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString("not: valid: yaml: at: all:\n  - [")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	v := viper.New()
+	v.SetConfigFile(f.Name())
+	readErr := v.ReadInConfig()
+	require.Error(t, readErr)
+
+	err = retryConfigFileWithoutBOM(v, f.Name(), readErr)
+	assert.Equal(t, readErr, err, "a config file with no BOM should surface its original parse error unchanged")
+}
+
+func TestRetryConfigFileWithoutBOMPassesThroughAReadFailure(t *testing.T) {
+	v := viper.New()
+	originalErr := errors.New("original read error")
+	err := retryConfigFileWithoutBOM(v, "/no/such/file.yaml", originalErr)
+	assert.Equal(t, originalErr, err)
+}
@@ -0,0 +1,130 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/HotelsDotCom/kube-graffiti/pkg/existing"
+	"github.com/spf13/cobra"
+	"k8s.io/client-go/rest"
+)
+
+var coverageConfigPath string
+var coverageDiscoveryCacheDir string
+var coverageFailOnUncovered []string
+
+var coverageCmd = &cobra.Command{
+	Use:   "coverage",
+	Short: "Report which discovered resources are reachable by no rule, or by more than one rule",
+	Long: `coverage joins every rule's targets in --config against discovered api groups/resources and
+writes the resulting report, as JSON, to stdout: resources reachable by no rule (uncovered), by
+exactly one rule (singly-covered) and by more than one rule (multiply-covered). Discovery comes from
+a live cluster by default, using the same in-cluster credentials as the main command, or from a
+--discovery-cache directory written by a running kube-graffiti instance's discovery.cache-dir, for
+use without cluster access (e.g. in CI). --fail-on-uncovered takes a comma-separated list of
+group/resource pairs (e.g. "apps/deployments,/pods") and makes coverage exit non-zero if any of them
+is still uncovered, so a CI pipeline can gate on specific resources staying covered.`,
+	RunE: runCoverageCmd,
+}
+
+func init() {
+	coverageCmd.Flags().StringVar(&coverageConfigPath, "config", "", "path to a kube-graffiti rules configuration file (required)")
+	coverageCmd.Flags().StringVar(&coverageDiscoveryCacheDir, "discovery-cache", "", "read discovery results from this directory instead of querying a live cluster")
+	coverageCmd.Flags().StringSliceVar(&coverageFailOnUncovered, "fail-on-uncovered", nil, `comma-separated group/resource pairs (e.g. "apps/deployments,/pods") that must not be uncovered`)
+	rootCmd.AddCommand(coverageCmd)
+}
+
+func runCoverageCmd(_ *cobra.Command, _ []string) error {
+	return runCoverage(os.Stdout)
+}
+
+// runCoverage is the testable core of runCoverageCmd: it takes an explicit writer instead of reaching
+// for os.Stdout, so tests can capture the report.
+func runCoverage(w io.Writer) error {
+	if coverageConfigPath == "" {
+		return fmt.Errorf("--config is required")
+	}
+	cfg, _, err := readConfigFile(coverageConfigPath)
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %v", err)
+	}
+	if err := cfg.ValidateConfig(); err != nil {
+		return fmt.Errorf("configuration is invalid: %v", err)
+	}
+
+	existing.SetCoverageRules(cfg.Rules)
+	if coverageDiscoveryCacheDir != "" {
+		if err := existing.LoadDiscoveryFromCache(coverageDiscoveryCacheDir); err != nil {
+			return fmt.Errorf("failed to load discovery cache: %v", err)
+		}
+	} else {
+		restConfig, err := rest.InClusterConfig()
+		if err != nil {
+			return fmt.Errorf("failed to build an in-cluster kubernetes config (use --discovery-cache to run without cluster access): %v", err)
+		}
+		if err := existing.DiscoverFromCluster(restConfig); err != nil {
+			return fmt.Errorf("failed to discover kubernetes apis and resources: %v", err)
+		}
+	}
+
+	report := existing.CurrentCoverageReport()
+	raw, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal coverage report: %v", err)
+	}
+	fmt.Fprintln(w, string(raw))
+
+	return checkFailOnUncovered(report, coverageFailOnUncovered)
+}
+
+// checkFailOnUncovered checks every "group/resource" pair in failOn against report.Uncovered, and
+// returns an error naming any that are still uncovered, so that a CI pipeline can gate on specific
+// resources staying covered by at least one rule.
+func checkFailOnUncovered(report existing.CoverageReport, failOn []string) error {
+	if len(failOn) == 0 {
+		return nil
+	}
+
+	uncovered := make(map[string]bool, len(report.Uncovered))
+	for _, r := range report.Uncovered {
+		group, _ := splitGroupVersionString(r.GroupVersion)
+		uncovered[group+"/"+r.Resource] = true
+	}
+
+	var stillUncovered []string
+	for _, pair := range failOn {
+		if uncovered[pair] {
+			stillUncovered = append(stillUncovered, pair)
+		}
+	}
+	if len(stillUncovered) > 0 {
+		return fmt.Errorf("the following resources are uncovered by any rule: %s", strings.Join(stillUncovered, ", "))
+	}
+	return nil
+}
+
+// splitGroupVersionString splits a "group/version" string, treating a bare "version" (the core group)
+// as having an empty group, matching how kubernetes itself names the core api group.
+func splitGroupVersionString(s string) (group, version string) {
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) == 2 {
+		return parts[0], parts[1]
+	}
+	return "", parts[0]
+}
@@ -0,0 +1,145 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const coverageTestConfigYAML = `---
+config-version: 2
+log-level: info
+server:
+  namespace: test-namespace
+  service: graffiti-service
+rules:
+- registration:
+    name: label-team-a-deployments
+    targets:
+    - api-groups: ["apps"]
+      api-versions: ["v1"]
+      resources: ["deployments"]
+  matchers:
+    match-all: true
+  payload:
+    additions:
+      labels:
+        painted: "true"
+- registration:
+    name: annotate-all-pods
+    targets:
+    - api-groups: [""]
+      api-versions: ["v1"]
+      resources: ["pods"]
+  matchers:
+    match-all: true
+  payload:
+    additions:
+      annotations:
+        swept: "true"
+`
+
+const coverageTestDiscoveryCache = `{
+  "stored-at": "2026-01-01T00:00:00Z",
+  "groups": {
+    "": { "name": "", "preferredVersion": { "groupVersion": "v1", "version": "v1" } },
+    "apps": { "name": "apps", "preferredVersion": { "groupVersion": "apps/v1", "version": "v1" } }
+  },
+  "resources": {
+    "v1": [
+      { "name": "namespaces" },
+      { "name": "pods" }
+    ],
+    "apps/v1": [
+      { "name": "deployments" },
+      { "name": "deployments/scale" }
+    ]
+  }
+}`
+
+// setUpCoverageTestFixtures writes a config file and a discovery cache directory holding canned
+// discovery results, and points the coverage command's flags at both, returning a func that restores
+// the flags and removes the temporary files.
+func setUpCoverageTestFixtures(t *testing.T) func() {
+	configFile, err := ioutil.TempFile("", "coverage-test-config-*.yaml")
+	require.NoError(t, err)
+	_, err = configFile.WriteString(coverageTestConfigYAML)
+	require.NoError(t, err)
+	require.NoError(t, configFile.Close())
+
+	cacheDir, err := ioutil.TempDir("", "coverage-test-cache-*")
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(cacheDir, "discovery-cache.json"), []byte(coverageTestDiscoveryCache), 0644))
+
+	oldConfigPath := coverageConfigPath
+	oldCacheDir := coverageDiscoveryCacheDir
+	oldFailOnUncovered := coverageFailOnUncovered
+	coverageConfigPath = configFile.Name()
+	coverageDiscoveryCacheDir = cacheDir
+	coverageFailOnUncovered = nil
+
+	return func() {
+		os.Remove(configFile.Name())
+		os.RemoveAll(cacheDir)
+		coverageConfigPath = oldConfigPath
+		coverageDiscoveryCacheDir = oldCacheDir
+		coverageFailOnUncovered = oldFailOnUncovered
+	}
+}
+
+func TestCoverageCommandReportsUncoveredSinglyAndMultiplyCoveredResources(t *testing.T) {
+	defer setUpCoverageTestFixtures(t)()
+
+	var out bytes.Buffer
+	require.NoError(t, runCoverage(&out))
+
+	require.JSONEq(t, `{
+		"uncovered": [
+			{ "group-version": "apps/v1", "resource": "deployments/scale" },
+			{ "group-version": "v1", "resource": "namespaces" }
+		],
+		"singly-covered": [
+			{ "group-version": "apps/v1", "resource": "deployments", "rules": ["label-team-a-deployments"] },
+			{ "group-version": "v1", "resource": "pods", "rules": ["annotate-all-pods"] }
+		],
+		"multiply-covered": null
+	}`, out.String())
+}
+
+func TestCoverageCommandRequiresConfigFlag(t *testing.T) {
+	defer setUpCoverageTestFixtures(t)()
+	coverageConfigPath = ""
+
+	require.Error(t, runCoverage(&bytes.Buffer{}))
+}
+
+func TestCoverageCommandFailOnUncoveredFailsWhenResourceIsUncovered(t *testing.T) {
+	defer setUpCoverageTestFixtures(t)()
+	coverageFailOnUncovered = []string{"/namespaces"}
+
+	require.Error(t, runCoverage(&bytes.Buffer{}))
+}
+
+func TestCoverageCommandFailOnUncoveredPassesWhenResourceIsCovered(t *testing.T) {
+	defer setUpCoverageTestFixtures(t)()
+	coverageFailOnUncovered = []string{"apps/deployments"}
+
+	require.NoError(t, runCoverage(&bytes.Buffer{}))
+}
@@ -0,0 +1,65 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/HotelsDotCom/kube-graffiti/pkg/config"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestExistingSweepCompleteReflectsWhetherRunExistingSweepHasFinished checks that ExistingSweepComplete -
+// the flag the readiness endpoint gates on - stays false for as long as the injected sweep function is
+// still running, and flips true as soon as it returns.
+func TestExistingSweepCompleteReflectsWhetherRunExistingSweepHasFinished(t *testing.T) {
+	origApply := applyRulesAgainstExistingObjects
+	defer func() { applyRulesAgainstExistingObjects = origApply }()
+
+	release := make(chan struct{})
+	applyRulesAgainstExistingObjects = func(rules []config.Rule) { <-release }
+
+	ExistingSweepComplete = false
+	defer func() { ExistingSweepComplete = false }()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		runExistingSweep(nil)
+	}()
+
+	assert.False(t, ExistingSweepComplete, "the sweep has not been allowed to finish yet, so we should still report not-ready")
+
+	close(release)
+	wg.Wait()
+
+	assert.True(t, ExistingSweepComplete, "the sweep has finished, so readiness should no longer be held back")
+}
+
+// TestInitExistingCheckMarksTheSweepCompleteImmediatelyWhenDisabled checks that, with check-existing
+// disabled, there is no sweep to wait for and readiness is never held back by it.
+func TestInitExistingCheckMarksTheSweepCompleteImmediatelyWhenDisabled(t *testing.T) {
+	viper.Set("check-existing", false)
+	defer viper.Set("check-existing", false)
+
+	ExistingSweepComplete = false
+	defer func() { ExistingSweepComplete = false }()
+
+	err := initExistingCheck(config.Configuration{}, nil)
+	assert.NoError(t, err)
+	assert.True(t, ExistingSweepComplete, "with check-existing disabled there is no sweep to wait for")
+}
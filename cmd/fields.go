@@ -0,0 +1,57 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+
+	"github.com/HotelsDotCom/kube-graffiti/pkg/graffiti"
+	"github.com/spf13/cobra"
+)
+
+var fieldsCmd = &cobra.Command{
+	Use:   "fields <file>",
+	Short: "Print the flattened field map of a kubernetes object",
+	Long:  `Reads a kubernetes object from a JSON or YAML file and prints the dotted field map that graffiti's field-selectors are matched against, to help with authoring rules.`,
+	Args:  cobra.ExactArgs(1),
+	RunE:  runFieldsCmd,
+}
+
+func init() {
+	rootCmd.AddCommand(fieldsCmd)
+}
+
+func runFieldsCmd(_ *cobra.Command, args []string) error {
+	raw, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", args[0], err)
+	}
+
+	fm, err := graffiti.MakeFieldMapFromRawObject(raw)
+	if err != nil {
+		return fmt.Errorf("failed to build field map: %v", err)
+	}
+
+	keys := make([]string, 0, len(fm))
+	for k := range fm {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Printf("%s=%s\n", k, fm[k])
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFieldsCommandReadsAndPrintsFieldMap(t *testing.T) {
+	f, err := ioutil.TempFile("", "fields-test-*.json")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(`{"metadata":{"name":"test-pod","namespace":"default"}}`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	err = runFieldsCmd(fieldsCmd, []string{f.Name()})
+	require.NoError(t, err)
+}
+
+func TestFieldsCommandErrorsOnMissingFile(t *testing.T) {
+	err := runFieldsCmd(fieldsCmd, []string{"/no/such/file.json"})
+	require.Error(t, err)
+}
@@ -0,0 +1,126 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/HotelsDotCom/kube-graffiti/pkg/config"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	yaml "gopkg.in/yaml.v2"
+)
+
+var migrateLegacyConfigPath string
+var migrateOutputPath string
+
+var migrateLegacyCmd = &cobra.Command{
+	Use:   "migrate-legacy",
+	Short: "Convert a legacy istio-namespace-webhook style configuration into a rules-based kube-graffiti config",
+	Long: `migrate-legacy accepts the old istio-namespace-webhook flag surface - labels, annotations,
+blacklist, namespace/service/port and certificate paths - either as flags/environment or as an
+old-style config file passed via --legacy-config, and writes the equivalent rules-based
+Configuration as YAML to stdout or, with --output, to a file. The generated configuration is
+validated with ValidateConfig before it is written.`,
+	RunE: runMigrateLegacyCmd,
+}
+
+func init() {
+	migrateLegacyCmd.Flags().StringVar(&migrateLegacyConfigPath, "legacy-config", "", "path to an old istio-namespace-webhook style config file to convert (if unset, the flags/environment below are used instead)")
+	migrateLegacyCmd.Flags().StringToString("labels", map[string]string{}, "[GRAFFITI_LABELS] labels to add to every namespace")
+	migrateLegacyCmd.Flags().StringToString("annotations", map[string]string{}, "[GRAFFITI_ANNOTATIONS] annotations to add to every namespace")
+	migrateLegacyCmd.Flags().StringSlice("blacklist", []string{}, "[GRAFFITI_BLACKLIST] namespace names to exclude from labelling")
+	migrateLegacyCmd.Flags().String("namespace", "", "[GRAFFITI_NAMESPACE] namespace that the webhook service runs in")
+	migrateLegacyCmd.Flags().String("service", "", "[GRAFFITI_SERVICE] name of the webhook service")
+	migrateLegacyCmd.Flags().Int("port", 443, "[GRAFFITI_PORT] port that the webhook service listens on")
+	migrateLegacyCmd.Flags().String("ca-cert-path", "", "[GRAFFITI_CA_CERT_PATH] path to the webhook's ca certificate")
+	migrateLegacyCmd.Flags().String("cert-path", "", "[GRAFFITI_CERT_PATH] path to the webhook's server certificate")
+	migrateLegacyCmd.Flags().String("key-path", "", "[GRAFFITI_KEY_PATH] path to the webhook's server key")
+	migrateLegacyCmd.Flags().StringVar(&migrateOutputPath, "output", "", "file to write the converted configuration to (default stdout)")
+	rootCmd.AddCommand(migrateLegacyCmd)
+}
+
+func runMigrateLegacyCmd(cmd *cobra.Command, _ []string) error {
+	legacy, err := loadLegacyConfig(cmd)
+	if err != nil {
+		return fmt.Errorf("failed to load legacy configuration: %v", err)
+	}
+
+	converted, err := config.ConvertLegacyConfig(legacy)
+	if err != nil {
+		return fmt.Errorf("failed to convert legacy configuration: %v", err)
+	}
+
+	if err := converted.ValidateConfig(); err != nil {
+		return fmt.Errorf("converted configuration is invalid: %v", err)
+	}
+
+	out, err := yaml.Marshal(converted)
+	if err != nil {
+		return fmt.Errorf("failed to marshal converted configuration: %v", err)
+	}
+
+	if migrateOutputPath == "" {
+		fmt.Println(string(out))
+		return nil
+	}
+	return ioutil.WriteFile(migrateOutputPath, out, 0644)
+}
+
+// loadLegacyConfig reads a LegacyConfig either from --legacy-config or, if that isn't set, from
+// the command's own flags/environment (bound via a dedicated viper instance so this doesn't
+// disturb the main command's global viper bindings).
+func loadLegacyConfig(cmd *cobra.Command) (config.LegacyConfig, error) {
+	var legacy config.LegacyConfig
+
+	if migrateLegacyConfigPath != "" {
+		v := viper.New()
+		v.SetConfigFile(migrateLegacyConfigPath)
+		if err := v.ReadInConfig(); err != nil {
+			if retryErr := retryConfigFileWithoutBOM(v, migrateLegacyConfigPath, err); retryErr != nil {
+				return legacy, fmt.Errorf("could not read legacy config file: %v", retryErr)
+			}
+		}
+		if err := v.Unmarshal(&legacy); err != nil {
+			return legacy, fmt.Errorf("could not unmarshal legacy config file: %v", err)
+		}
+		return legacy, nil
+	}
+
+	v := viper.New()
+	if err := v.BindPFlags(cmd.Flags()); err != nil {
+		return legacy, fmt.Errorf("could not bind flags: %v", err)
+	}
+	v.SetEnvPrefix("GRAFFITI")
+	v.AutomaticEnv()
+
+	// viper doesn't understand pflag's stringToString value type, so the label/annotation maps are
+	// read directly from the flag set instead of going through viper.
+	var err error
+	if legacy.Labels, err = cmd.Flags().GetStringToString("labels"); err != nil {
+		return legacy, fmt.Errorf("could not read labels flag: %v", err)
+	}
+	if legacy.Annotations, err = cmd.Flags().GetStringToString("annotations"); err != nil {
+		return legacy, fmt.Errorf("could not read annotations flag: %v", err)
+	}
+	legacy.Blacklist = v.GetStringSlice("blacklist")
+	legacy.Namespace = v.GetString("namespace")
+	legacy.Service = v.GetString("service")
+	legacy.Port = v.GetInt("port")
+	legacy.CACertPath = v.GetString("ca-cert-path")
+	legacy.CertPath = v.GetString("cert-path")
+	legacy.KeyPath = v.GetString("key-path")
+	return legacy, nil
+}
@@ -0,0 +1,161 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/HotelsDotCom/kube-graffiti/pkg/config"
+	"github.com/HotelsDotCom/kube-graffiti/pkg/graffiti"
+	"github.com/HotelsDotCom/kube-graffiti/pkg/log"
+	"github.com/HotelsDotCom/kube-graffiti/pkg/mutatestream"
+	"github.com/HotelsDotCom/kube-graffiti/pkg/webhook"
+	"github.com/spf13/cobra"
+)
+
+var mutateStreamConfigPath string
+var mutateStreamRuleNames []string
+var mutateStreamEmit string
+var mutateStreamMissingNamespace string
+var mutateStreamAddLabel map[string]string
+var mutateStreamMatchLabel []string
+
+var mutateStreamCmd = &cobra.Command{
+	Use:   "mutate-stream",
+	Short: "Run graffiti rules against a stream of kubernetes objects read from stdin, without touching a cluster",
+	Long: `mutate-stream reads a List, NDJSON, or multi-document YAML stream of kubernetes objects from
+stdin - e.g. the output of "kubectl get -o json" - runs each object through the rules in --config
+(optionally narrowed to --rules) exactly as the existing-object sweep would, and writes either the
+resulting RFC6902 patches or the mutated objects to stdout as NDJSON. There is no cluster to query, so
+namespace-selector evaluation is driven by namespace objects seen earlier in the same stream; an
+object whose namespace hasn't appeared there yet follows --missing-namespace. The exit code is
+non-zero if any object failed to process.
+
+For a quick one-off mutation, --add-label/--match-label build a single ad-hoc rule instead of
+--config, e.g. "--add-label team=x --match-label env=prod" paints every matching object with
+team=x without writing a rules file.`,
+	RunE: runMutateStreamCmd,
+}
+
+func init() {
+	mutateStreamCmd.Flags().StringVar(&mutateStreamConfigPath, "config", "", "path to a kube-graffiti rules configuration file")
+	mutateStreamCmd.Flags().StringSliceVar(&mutateStreamRuleNames, "rules", nil, "names of rules to run (default: every rule in --config)")
+	mutateStreamCmd.Flags().StringVar(&mutateStreamEmit, "emit", string(mutatestream.EmitPatches), `what to write to stdout per object: "patches" or "objects"`)
+	mutateStreamCmd.Flags().StringVar(&mutateStreamMissingNamespace, "missing-namespace", string(mutatestream.MissingNamespaceError), `how to treat a namespace-selector lookup for a namespace not yet seen in the stream: "allow", "skip" or "error"`)
+	mutateStreamCmd.Flags().StringToStringVar(&mutateStreamAddLabel, "add-label", nil, "k=v label(s) to add, building a one-off rule instead of reading --config")
+	mutateStreamCmd.Flags().StringSliceVar(&mutateStreamMatchLabel, "match-label", nil, "label selector(s) the one-off rule built by --add-label must match")
+	rootCmd.AddCommand(mutateStreamCmd)
+}
+
+func runMutateStreamCmd(_ *cobra.Command, _ []string) error {
+	return runMutateStream(os.Stdin, os.Stdout)
+}
+
+// runMutateStream is the testable core of runMutateStreamCmd: it takes an explicit reader/writer
+// instead of reaching for os.Stdin/os.Stdout, so tests can pipe in fixtures and capture the output.
+func runMutateStream(r io.Reader, w io.Writer) error {
+	var rules []config.Rule
+	switch {
+	case mutateStreamConfigPath != "":
+		cfg, _, err := readConfigFile(mutateStreamConfigPath)
+		if err != nil {
+			return fmt.Errorf("failed to load configuration: %v", err)
+		}
+		if err := cfg.ValidateConfig(); err != nil {
+			return fmt.Errorf("configuration is invalid: %v", err)
+		}
+		if rules, err = selectRules(cfg.Rules, mutateStreamRuleNames); err != nil {
+			return err
+		}
+	case len(mutateStreamAddLabel) > 0 || len(mutateStreamMatchLabel) > 0:
+		rule, err := buildInlineRule(mutateStreamAddLabel, mutateStreamMatchLabel)
+		if err != nil {
+			return err
+		}
+		rules = []config.Rule{rule}
+	default:
+		return fmt.Errorf("--config is required, or build a one-off rule with --add-label/--match-label")
+	}
+
+	emit := mutatestream.Emit(mutateStreamEmit)
+	if emit != mutatestream.EmitPatches && emit != mutatestream.EmitObjects {
+		return fmt.Errorf(`invalid --emit %q: must be "patches" or "objects"`, mutateStreamEmit)
+	}
+	missing := mutatestream.MissingNamespacePolicy(mutateStreamMissingNamespace)
+	switch missing {
+	case mutatestream.MissingNamespaceAllow, mutatestream.MissingNamespaceSkip, mutatestream.MissingNamespaceError:
+	default:
+		return fmt.Errorf(`invalid --missing-namespace %q: must be "allow", "skip" or "error"`, mutateStreamMissingNamespace)
+	}
+
+	errorCount, err := mutatestream.Run(r, w, mutatestream.Options{
+		Rules:            rules,
+		Emit:             emit,
+		MissingNamespace: missing,
+	})
+	if err != nil {
+		return err
+	}
+	if errorCount > 0 {
+		return fmt.Errorf("%d object(s) failed to process, see the logs for details", errorCount)
+	}
+	return nil
+}
+
+// selectRules narrows all down to just the named rules, in the order named, or returns all
+// unmodified if names is empty.
+func selectRules(all []config.Rule, names []string) ([]config.Rule, error) {
+	if len(names) == 0 {
+		return all, nil
+	}
+	byName := make(map[string]config.Rule, len(all))
+	for _, r := range all {
+		byName[r.Registration.Name] = r
+	}
+	selected := make([]config.Rule, 0, len(names))
+	for _, n := range names {
+		r, ok := byName[n]
+		if !ok {
+			return nil, fmt.Errorf("no rule named %q found in configuration", n)
+		}
+		selected = append(selected, r)
+	}
+	return selected, nil
+}
+
+// buildInlineRule constructs a single ad-hoc rule from --add-label/--match-label, for a quick one-off
+// mutation without writing a config file. It's validated exactly as a rule loaded from a config file
+// would be, so a typo in a selector is reported the same way.
+func buildInlineRule(addLabels map[string]string, matchLabels []string) (config.Rule, error) {
+	rule := config.Rule{
+		Registration: webhook.Registration{
+			Name:    "inline-rule",
+			Targets: []webhook.Target{{APIGroups: []string{"*"}, APIVersions: []string{"*"}, Resources: []string{"*"}}},
+		},
+		Matchers: graffiti.Matchers{LabelSelectors: matchLabels},
+		Payload:  graffiti.Payload{Additions: graffiti.Additions{Labels: addLabels}},
+	}
+	if err := rule.Registration.Validate(); err != nil {
+		return rule, fmt.Errorf("inline rule is invalid: %v", err)
+	}
+
+	mylog := log.ComponentLogger(componentName, "buildInlineRule")
+	gr := graffiti.Rule{Name: rule.Registration.Name, Matchers: rule.Matchers, Payload: rule.Payload}
+	if err := gr.Validate(mylog); err != nil {
+		return rule, fmt.Errorf("inline rule is invalid: %v", err)
+	}
+	return rule, nil
+}
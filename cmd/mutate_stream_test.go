@@ -0,0 +1,175 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/HotelsDotCom/kube-graffiti/pkg/graffiti"
+	"github.com/HotelsDotCom/kube-graffiti/pkg/mutatestream"
+	"github.com/stretchr/testify/require"
+)
+
+const mutateStreamTestConfigYAML = `---
+config-version: 2
+log-level: info
+server:
+  namespace: test-namespace
+  service: graffiti-service
+rules:
+- registration:
+    name: label-team-a-deployments
+    namespace-selector: "team = a"
+    targets:
+    - api-groups: ["apps"]
+      api-versions: ["v1"]
+      resources: ["deployments"]
+  matchers:
+    match-all: true
+  payload:
+    additions:
+      labels:
+        painted: "true"
+- registration:
+    name: annotate-all-pods
+    targets:
+    - api-groups: [""]
+      api-versions: ["v1"]
+      resources: ["pods"]
+  matchers:
+    match-all: true
+  payload:
+    additions:
+      annotations:
+        swept: "true"
+`
+
+const mutateStreamTestInput = `{"kind":"List","apiVersion":"v1","items":[
+{"apiVersion":"v1","kind":"Namespace","metadata":{"name":"team-a","labels":{"team":"a"}}},
+{"apiVersion":"apps/v1","kind":"Deployment","metadata":{"name":"web","namespace":"team-a"}},
+{"apiVersion":"apps/v1","kind":"Deployment","metadata":{"name":"web","namespace":"team-b"}},
+{"apiVersion":"v1","kind":"Pod","metadata":{"name":"my-pod","namespace":"team-b"}}
+]}`
+
+func setUpMutateStreamTestConfig(t *testing.T) func() {
+	old := graffiti.RequireExplicitMatchAll
+	graffiti.RequireExplicitMatchAll = true
+
+	in, err := ioutil.TempFile("", "mutate-stream-test-*.yaml")
+	require.NoError(t, err)
+	_, err = in.WriteString(mutateStreamTestConfigYAML)
+	require.NoError(t, err)
+	require.NoError(t, in.Close())
+
+	oldConfigPath := mutateStreamConfigPath
+	oldRuleNames := mutateStreamRuleNames
+	oldEmit := mutateStreamEmit
+	oldMissingNamespace := mutateStreamMissingNamespace
+	oldAddLabel := mutateStreamAddLabel
+	oldMatchLabel := mutateStreamMatchLabel
+	mutateStreamConfigPath = in.Name()
+	mutateStreamRuleNames = nil
+	mutateStreamMissingNamespace = string(mutatestream.MissingNamespaceSkip)
+	mutateStreamAddLabel = nil
+	mutateStreamMatchLabel = nil
+
+	return func() {
+		os.Remove(in.Name())
+		graffiti.RequireExplicitMatchAll = old
+		mutateStreamConfigPath = oldConfigPath
+		mutateStreamRuleNames = oldRuleNames
+		mutateStreamEmit = oldEmit
+		mutateStreamMissingNamespace = oldMissingNamespace
+		mutateStreamAddLabel = oldAddLabel
+		mutateStreamMatchLabel = oldMatchLabel
+	}
+}
+
+func TestMutateStreamCommandEmitsMutatedObjects(t *testing.T) {
+	defer setUpMutateStreamTestConfig(t)()
+	mutateStreamEmit = string(mutatestream.EmitObjects)
+
+	var out bytes.Buffer
+	require.NoError(t, runMutateStream(strings.NewReader(mutateStreamTestInput), &out))
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 4)
+	require.JSONEq(t, `{"apiVersion":"v1","kind":"Namespace","metadata":{"name":"team-a","labels":{"team":"a"}}}`, lines[0])
+	require.JSONEq(t, `{"apiVersion":"apps/v1","kind":"Deployment","metadata":{"name":"web","namespace":"team-a","labels":{"painted":"true"}}}`, lines[1])
+	require.JSONEq(t, `{"apiVersion":"apps/v1","kind":"Deployment","metadata":{"name":"web","namespace":"team-b"}}`, lines[2])
+	require.JSONEq(t, `{"apiVersion":"v1","kind":"Pod","metadata":{"name":"my-pod","namespace":"team-b","annotations":{"swept":"true"}}}`, lines[3])
+}
+
+func TestMutateStreamCommandEmitsPatchesAnnotatedWithTargetCoordinates(t *testing.T) {
+	defer setUpMutateStreamTestConfig(t)()
+	mutateStreamEmit = string(mutatestream.EmitPatches)
+
+	var out bytes.Buffer
+	require.NoError(t, runMutateStream(strings.NewReader(mutateStreamTestInput), &out))
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 4)
+	require.JSONEq(t, `{"apiVersion":"v1","kind":"Namespace","namespace":"","name":"team-a","patch":[]}`, lines[0])
+	require.JSONEq(t, `{"apiVersion":"apps/v1","kind":"Deployment","namespace":"team-a","name":"web","patch":[{"op":"add","path":"/metadata/labels","value":{"painted":"true"}}]}`, lines[1])
+	require.JSONEq(t, `{"apiVersion":"apps/v1","kind":"Deployment","namespace":"team-b","name":"web","patch":[]}`, lines[2])
+	require.JSONEq(t, `{"apiVersion":"v1","kind":"Pod","namespace":"team-b","name":"my-pod","patch":[{"op":"add","path":"/metadata/annotations","value":{"swept":"true"}}]}`, lines[3])
+}
+
+func TestMutateStreamCommandRequiresConfigFlag(t *testing.T) {
+	defer setUpMutateStreamTestConfig(t)()
+	mutateStreamConfigPath = ""
+
+	require.Error(t, runMutateStream(strings.NewReader(mutateStreamTestInput), &bytes.Buffer{}))
+}
+
+func TestMutateStreamCommandRejectsUnknownRuleName(t *testing.T) {
+	defer setUpMutateStreamTestConfig(t)()
+	mutateStreamRuleNames = []string{"no-such-rule"}
+
+	require.Error(t, runMutateStream(strings.NewReader(mutateStreamTestInput), &bytes.Buffer{}))
+}
+
+func TestMutateStreamCommandBuildsAndRunsAnInlineRuleFromAddLabelAndMatchLabelFlags(t *testing.T) {
+	defer setUpMutateStreamTestConfig(t)()
+	mutateStreamConfigPath = ""
+	mutateStreamAddLabel = map[string]string{"team": "x"}
+	mutateStreamMatchLabel = []string{"env=prod"}
+	mutateStreamEmit = string(mutatestream.EmitObjects)
+
+	input := `{"kind":"List","apiVersion":"v1","items":[
+{"apiVersion":"v1","kind":"Namespace","metadata":{"name":"prod-a","labels":{"env":"prod"}}},
+{"apiVersion":"v1","kind":"Namespace","metadata":{"name":"staging-a","labels":{"env":"staging"}}}
+]}`
+
+	var out bytes.Buffer
+	require.NoError(t, runMutateStream(strings.NewReader(input), &out))
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 2)
+	require.JSONEq(t, `{"apiVersion":"v1","kind":"Namespace","metadata":{"name":"prod-a","labels":{"env":"prod","team":"x"}}}`, lines[0], "the matching object should be painted")
+	require.JSONEq(t, `{"apiVersion":"v1","kind":"Namespace","metadata":{"name":"staging-a","labels":{"env":"staging"}}}`, lines[1], "the non-matching object should be left alone")
+}
+
+func TestMutateStreamCommandRejectsAnInvalidInlineRule(t *testing.T) {
+	defer setUpMutateStreamTestConfig(t)()
+	mutateStreamConfigPath = ""
+	mutateStreamAddLabel = map[string]string{"team": "x"}
+	mutateStreamMatchLabel = []string{"env in prod"}
+
+	require.Error(t, runMutateStream(strings.NewReader(mutateStreamTestInput), &bytes.Buffer{}))
+}
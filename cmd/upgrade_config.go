@@ -0,0 +1,116 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/HotelsDotCom/kube-graffiti/pkg/config"
+	"github.com/pmezard/go-difflib/difflib"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	yaml "gopkg.in/yaml.v2"
+)
+
+var upgradeConfigOutputPath string
+
+var upgradeConfigCmd = &cobra.Command{
+	Use:   "upgrade-config <file>",
+	Short: "Rewrite a configuration file from its current config-version to the next one",
+	Long: `upgrade-config reads a configuration file, applies the mechanical transformations needed to
+move it from its declared config-version (or config.OldestSupportedConfigVersion if unset) to the
+next config-version, prints a diff of what changed, and writes the upgraded configuration to stdout
+or, with --output, to a file. The upgraded configuration is validated with ValidateConfig before it
+is written. Run it repeatedly to step through several versions.`,
+	Args: cobra.ExactArgs(1),
+	RunE: runUpgradeConfigCmd,
+}
+
+func init() {
+	upgradeConfigCmd.Flags().StringVar(&upgradeConfigOutputPath, "output", "", "file to write the upgraded configuration to (default stdout)")
+	rootCmd.AddCommand(upgradeConfigCmd)
+}
+
+func runUpgradeConfigCmd(_ *cobra.Command, args []string) error {
+	original, originalYAML, err := readConfigFile(args[0])
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %v", err)
+	}
+
+	from, warning, err := config.ResolveConfigVersion(original.ConfigVersion)
+	if err != nil {
+		return err
+	}
+	if warning != "" {
+		fmt.Println(warning)
+	}
+
+	upgraded, err := config.UpgradeConfig(original, from)
+	if err != nil {
+		return fmt.Errorf("failed to upgrade configuration: %v", err)
+	}
+
+	if err := upgraded.ValidateConfig(); err != nil {
+		return fmt.Errorf("upgraded configuration is invalid: %v", err)
+	}
+
+	upgradedYAML, err := yaml.Marshal(upgraded)
+	if err != nil {
+		return fmt.Errorf("failed to marshal upgraded configuration: %v", err)
+	}
+
+	diff, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(string(originalYAML)),
+		B:        difflib.SplitLines(string(upgradedYAML)),
+		FromFile: fmt.Sprintf("config-version %d", from),
+		ToFile:   fmt.Sprintf("config-version %d", from+1),
+		Context:  3,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to generate diff: %v", err)
+	}
+	fmt.Print(diff)
+
+	if upgradeConfigOutputPath == "" {
+		fmt.Println(string(upgradedYAML))
+		return nil
+	}
+	return ioutil.WriteFile(upgradeConfigOutputPath, upgradedYAML, 0644)
+}
+
+// readConfigFile reads a configuration file with its own viper instance, so that this doesn't
+// disturb the main command's global viper bindings, and returns both the unmarshalled Configuration
+// and its raw bytes for diffing against the upgraded output.
+func readConfigFile(path string) (config.Configuration, []byte, error) {
+	var c config.Configuration
+
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return c, nil, fmt.Errorf("could not read config file: %v", err)
+	}
+	raw, _ = stripUTF8BOM(raw)
+
+	v := viper.New()
+	v.SetConfigFile(path)
+	if err := v.ReadInConfig(); err != nil {
+		if retryErr := retryConfigFileWithoutBOM(v, path, err); retryErr != nil {
+			return c, nil, fmt.Errorf("could not parse config file: %v", retryErr)
+		}
+	}
+	if err := v.Unmarshal(&c); err != nil {
+		return c, nil, fmt.Errorf("could not unmarshal config file: %v", err)
+	}
+	return c, raw, nil
+}
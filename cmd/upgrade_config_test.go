@@ -0,0 +1,84 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/HotelsDotCom/kube-graffiti/pkg/graffiti"
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/stretchr/testify/require"
+)
+
+const upgradeConfigTestYAML = `---
+config-version: 1
+log-level: info
+server:
+  namespace: test-namespace
+  service: graffiti-service
+rules:
+- registration:
+    name: my-rule
+  payload:
+    additions:
+      labels:
+        painted: "true"
+`
+
+func TestUpgradeConfigCommandWritesAnUpgradedFile(t *testing.T) {
+	old := graffiti.RequireExplicitMatchAll
+	defer func() { graffiti.RequireExplicitMatchAll = old }()
+
+	in, err := ioutil.TempFile("", "upgrade-config-test-*.yaml")
+	require.NoError(t, err)
+	defer os.Remove(in.Name())
+	_, err = in.WriteString(upgradeConfigTestYAML)
+	require.NoError(t, err)
+	require.NoError(t, in.Close())
+
+	out, err := ioutil.TempFile("", "upgrade-config-test-out-*.yaml")
+	require.NoError(t, err)
+	defer os.Remove(out.Name())
+	require.NoError(t, out.Close())
+
+	oldOutput := upgradeConfigOutputPath
+	upgradeConfigOutputPath = out.Name()
+	defer func() { upgradeConfigOutputPath = oldOutput }()
+
+	require.NoError(t, runUpgradeConfigCmd(upgradeConfigCmd, []string{in.Name()}))
+
+	upgradedBytes, err := ioutil.ReadFile(out.Name())
+	require.NoError(t, err)
+
+	var upgraded struct {
+		ConfigVersion int `yaml:"config-version"`
+		Rules         []struct {
+			Matchers struct {
+				MatchAll bool `yaml:"match-all"`
+			} `yaml:"matchers"`
+		} `yaml:"rules"`
+	}
+	require.NoError(t, yaml.Unmarshal(upgradedBytes, &upgraded))
+	require.Equal(t, 2, upgraded.ConfigVersion)
+	require.Len(t, upgraded.Rules, 1)
+	require.True(t, upgraded.Rules[0].Matchers.MatchAll, "the rule had no selectors under config-version 1, so upgrading should make its match-all explicit")
+}
+
+func TestUpgradeConfigCommandErrorsOnMissingFile(t *testing.T) {
+	err := runUpgradeConfigCmd(upgradeConfigCmd, []string{"/no/such/file.yaml"})
+	require.Error(t, err)
+}
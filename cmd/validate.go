@@ -0,0 +1,78 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var validateConfigPath string
+
+var validateCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "Validate a configuration file and run its rules' embedded test cases",
+	Long: `validate loads --config, applies the same checks the main command runs at startup, then runs
+every rule's embedded tests (see config.Rule.Tests) against that rule's own Mutate, printing one
+pass/fail line per test case. It exits non-zero if the configuration itself is invalid or any test
+case fails, so a CI pipeline can gate on a rule actually doing what its author intended.`,
+	RunE: runValidateCmd,
+}
+
+func init() {
+	validateCmd.Flags().StringVar(&validateConfigPath, "config", "", "path to a kube-graffiti rules configuration file (required)")
+	rootCmd.AddCommand(validateCmd)
+}
+
+func runValidateCmd(_ *cobra.Command, _ []string) error {
+	return runValidate(os.Stdout)
+}
+
+// runValidate is the testable core of runValidateCmd: it takes an explicit writer instead of reaching
+// for os.Stdout, so tests can capture the report.
+func runValidate(w io.Writer) error {
+	if validateConfigPath == "" {
+		return fmt.Errorf("--config is required")
+	}
+	cfg, _, err := readConfigFile(validateConfigPath)
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %v", err)
+	}
+	if err := cfg.ValidateConfig(); err != nil {
+		return fmt.Errorf("configuration is invalid: %v", err)
+	}
+
+	results := cfg.RunTests(context.Background())
+	failed := 0
+	for _, r := range results {
+		status := "PASS"
+		if !r.Passed {
+			status = "FAIL"
+			failed++
+		}
+		if r.Message != "" {
+			fmt.Fprintf(w, "%s: %s/%s: %s\n", status, r.Rule, r.Test, r.Message)
+		} else {
+			fmt.Fprintf(w, "%s: %s/%s\n", status, r.Rule, r.Test)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d rule test case(s) failed", failed, len(results))
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const validateTestConfigYAML = `---
+config-version: 2
+log-level: info
+server:
+  namespace: test-namespace
+  service: graffiti-service
+rules:
+- registration:
+    name: label-team-a-deployments
+    targets:
+    - api-groups: ["apps"]
+      api-versions: ["v1"]
+      resources: ["deployments"]
+  matchers:
+    match-all: true
+  payload:
+    additions:
+      labels:
+        painted: "true"
+  tests:
+  - name: matches-any-deployment
+    expect-match: true
+    expect-patch: '[ { "op": "add", "path": "/metadata/labels", "value": { "painted": "true" }} ]'
+    input:
+      kind: Deployment
+      apiVersion: apps/v1
+      metadata:
+        name: my-deployment
+  - name: wrongly-expects-no-match
+    expect-match: false
+    input:
+      kind: Deployment
+      apiVersion: apps/v1
+      metadata:
+        name: another-deployment
+`
+
+// setUpValidateTestFixture writes a config file and points the validate command's flag at it,
+// returning a func that restores the flag and removes the temporary file.
+func setUpValidateTestFixture(t *testing.T) func() {
+	configFile, err := ioutil.TempFile("", "validate-test-config-*.yaml")
+	require.NoError(t, err)
+	_, err = configFile.WriteString(validateTestConfigYAML)
+	require.NoError(t, err)
+	require.NoError(t, configFile.Close())
+
+	oldConfigPath := validateConfigPath
+	validateConfigPath = configFile.Name()
+
+	return func() {
+		os.Remove(configFile.Name())
+		validateConfigPath = oldConfigPath
+	}
+}
+
+func TestValidateCommandReportsAPassingAndAFailingEmbeddedTestCase(t *testing.T) {
+	defer setUpValidateTestFixture(t)()
+
+	var out bytes.Buffer
+	err := runValidate(&out)
+	require.Error(t, err, "a rule with a failing test case should fail validation")
+
+	assert.Contains(t, out.String(), "PASS: label-team-a-deployments/matches-any-deployment")
+	assert.Contains(t, out.String(), "FAIL: label-team-a-deployments/wrongly-expects-no-match")
+}
+
+func TestValidateCommandRequiresConfigFlag(t *testing.T) {
+	defer setUpValidateTestFixture(t)()
+	validateConfigPath = ""
+
+	require.Error(t, runValidate(&bytes.Buffer{}))
+}
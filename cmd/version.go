@@ -0,0 +1,52 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/HotelsDotCom/kube-graffiti/pkg/version"
+	"github.com/spf13/cobra"
+)
+
+var versionOutput string
+
+var versionCmd = &cobra.Command{
+	Use:   "version",
+	Short: "Print the kube-graffiti version",
+	Long:  `Print the version, commit and build date that were injected into this binary at build time.`,
+	RunE:  runVersionCmd,
+}
+
+func init() {
+	versionCmd.Flags().StringVar(&versionOutput, "output", "text", "output format, one of text or json")
+	rootCmd.AddCommand(versionCmd)
+}
+
+func runVersionCmd(_ *cobra.Command, _ []string) error {
+	info := version.Get()
+	switch versionOutput {
+	case "json":
+		j, err := info.JSON()
+		if err != nil {
+			return fmt.Errorf("failed to marshal version info: %v", err)
+		}
+		fmt.Println(j)
+	case "text":
+		fmt.Println(info.String())
+	default:
+		return fmt.Errorf("unknown output format %q, must be one of text or json", versionOutput)
+	}
+	return nil
+}
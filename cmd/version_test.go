@@ -0,0 +1,55 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/HotelsDotCom/kube-graffiti/pkg/version"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVersionCommandPrintsInjectedValues(t *testing.T) {
+	oldVersion, oldCommit, oldDate := version.Version, version.Commit, version.Date
+	defer func() { version.Version, version.Commit, version.Date = oldVersion, oldCommit, oldDate }()
+	version.Version, version.Commit, version.Date = "1.2.3", "abc1234", "2026-08-08T00:00:00Z"
+
+	versionOutput = "text"
+	err := runVersionCmd(versionCmd, nil)
+	require.NoError(t, err)
+}
+
+func TestVersionCommandJSONOutputParses(t *testing.T) {
+	oldVersion, oldCommit, oldDate := version.Version, version.Commit, version.Date
+	defer func() { version.Version, version.Commit, version.Date = oldVersion, oldCommit, oldDate }()
+	version.Version, version.Commit, version.Date = "1.2.3", "abc1234", "2026-08-08T00:00:00Z"
+
+	versionOutput = "json"
+	j, err := version.Get().JSON()
+	require.NoError(t, err)
+
+	var parsed version.Info
+	err = json.Unmarshal([]byte(j), &parsed)
+	require.NoError(t, err)
+	assert.Equal(t, "1.2.3", parsed.Version)
+}
+
+func TestVersionCommandRejectsUnknownOutputFormat(t *testing.T) {
+	versionOutput = "xml"
+	defer func() { versionOutput = "text" }()
+	err := runVersionCmd(versionCmd, nil)
+	assert.Error(t, err)
+}
@@ -0,0 +1,367 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package audit persists a record of every rule decision to a rotating JSONL log directory, for
+// operators who need a durable trail of what kube-graffiti changed (or blocked) beyond what the
+// structured request logs already carry. A Writer's Record method only ever enqueues - opening files,
+// rotating them, compressing rotated files and enforcing the retention/total-size caps all happen in
+// the Writer's own goroutine, so a slow or full disk can never add latency to the admission path it is
+// recording decisions from.
+package audit
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/HotelsDotCom/kube-graffiti/pkg/log"
+	"github.com/rs/zerolog"
+	"golang.org/x/text/unicode/norm"
+)
+
+const componentName = "audit"
+
+// SchemaVersion is the current audit Record schema's version, stamped onto every record so that a
+// downstream parser can detect and handle a future schema change rather than silently misreading it.
+const SchemaVersion = 1
+
+// Decision is the outcome a Record describes a rule as having reached against one object.
+type Decision string
+
+const (
+	DecisionAllowed Decision = "allowed"
+	DecisionPatched Decision = "patched"
+	DecisionBlocked Decision = "blocked"
+)
+
+// Detail controls how much of a matched rule's patch a Record carries: the full patch body,
+// just a digest of it, or neither - only the decision itself.
+type Detail string
+
+const (
+	DetailFull         Detail = "full"
+	DetailPatchDigest  Detail = "patch-digest"
+	DetailDecisionOnly Detail = "decision-only"
+)
+
+// Record is a single audit-log entry describing one rule's decision against one object.
+type Record struct {
+	SchemaVersion int       `json:"schema_version"`
+	Time          time.Time `json:"time"`
+	Rule          string    `json:"rule"`
+	Kind          string    `json:"kind"`
+	Name          string    `json:"name"`
+	Namespace     string    `json:"namespace,omitempty"`
+	Operation     string    `json:"operation,omitempty"`
+	Decision      Decision  `json:"decision"`
+	Patch         string    `json:"patch,omitempty"`
+	PatchDigest   string    `json:"patch_digest,omitempty"`
+}
+
+// Config controls where a Writer persists records, how much of each it keeps, and its rotation and
+// retention behaviour. A zero value for MaxSizeBytes, MaxAge, MaxBackups or MaxTotalBytes disables that
+// particular limit.
+type Config struct {
+	Directory     string
+	Detail        Detail
+	MaxSizeBytes  int64
+	MaxAge        time.Duration
+	MaxBackups    int
+	Compress      bool
+	MaxTotalBytes int64
+}
+
+// recordQueueSize bounds how many records a Writer will buffer while its goroutine is busy rotating or
+// blocked on a slow disk, before Record starts dropping records rather than letting the admission path
+// that called it block.
+const recordQueueSize = 1000
+
+// Writer asynchronously persists Records as newline-delimited JSON, rotating the active file once it
+// exceeds Config.MaxSizeBytes or Config.MaxAge, optionally gzip-compressing rotated files, and deleting
+// the oldest rotated files first once Config.MaxBackups or Config.MaxTotalBytes is exceeded.
+type Writer struct {
+	cfg     Config
+	records chan Record
+	done    chan struct{}
+	mylog   zerolog.Logger
+
+	file     *os.File
+	fileSize int64
+	openedAt time.Time
+}
+
+// NewWriter creates the audit directory if it doesn't already exist and starts a Writer's background
+// goroutine, returning immediately - records are only opened, written and rotated as Record enqueues them.
+func NewWriter(cfg Config) (*Writer, error) {
+	if err := os.MkdirAll(cfg.Directory, 0755); err != nil {
+		return nil, fmt.Errorf("could not create audit directory: %v", err)
+	}
+	w := &Writer{
+		cfg:     cfg,
+		records: make(chan Record, recordQueueSize),
+		done:    make(chan struct{}),
+		mylog:   log.ComponentLogger(componentName, "Writer"),
+	}
+	go w.run()
+	return w, nil
+}
+
+// Record enqueues rec to be persisted by the writer goroutine. If the queue is full - the writer
+// goroutine can't keep up, or is blocked on a slow disk - the record is dropped and a warning logged,
+// rather than blocking the caller.
+func (w *Writer) Record(rec Record) {
+	select {
+	case w.records <- rec:
+	default:
+		w.mylog.Warn().Str("rule", rec.Rule).Msg("audit record dropped, writer queue is full")
+	}
+}
+
+// Close stops accepting new records and blocks until every already-enqueued record has been written.
+func (w *Writer) Close() error {
+	close(w.records)
+	<-w.done
+	if w.file == nil {
+		return nil
+	}
+	return w.file.Close()
+}
+
+// ActiveWriter is the audit sink that RecordDecision persists to. cmd/command.go sets it once, after
+// constructing a Writer from the loaded configuration's audit settings, if auditing is enabled; it is
+// nil (the default) when auditing is disabled, which RecordDecision treats as a no-op. It is a package
+// var, rather than threading a *Writer through every call site that might produce a Record, because
+// those call sites - the webhook handler and the existing-objects sweep - live in separate packages
+// that only ever need to record a decision, never to configure or manage the sink itself.
+var ActiveWriter *Writer
+
+// RecordDecision persists rec to ActiveWriter if auditing is enabled, and is a no-op otherwise - so a
+// caller can record every decision unconditionally without first checking whether there's anywhere to
+// send it.
+func RecordDecision(rec Record) {
+	if ActiveWriter == nil {
+		return
+	}
+	ActiveWriter.Record(rec)
+}
+
+func (w *Writer) run() {
+	defer close(w.done)
+	for rec := range w.records {
+		w.writeRecord(rec)
+	}
+}
+
+func (w *Writer) writeRecord(rec Record) {
+	rec = applyDetail(rec, w.cfg.Detail)
+	rec.SchemaVersion = SchemaVersion
+	if rec.Time.IsZero() {
+		rec.Time = time.Now().UTC()
+	}
+
+	line, err := json.Marshal(rec)
+	if err != nil {
+		w.mylog.Error().Err(err).Msg("could not marshal audit record")
+		return
+	}
+	line = append(line, '\n')
+
+	if w.file == nil {
+		if err := w.openActiveFile(); err != nil {
+			w.mylog.Error().Err(err).Msg("could not open audit log file")
+			return
+		}
+	}
+	if err := w.rotateIfNeeded(len(line)); err != nil {
+		w.mylog.Error().Err(err).Msg("could not rotate audit log file")
+		return
+	}
+
+	n, err := w.file.Write(line)
+	if err != nil {
+		w.mylog.Error().Err(err).Msg("could not write audit record")
+		return
+	}
+	w.fileSize += int64(n)
+
+	w.enforceRetention()
+}
+
+// applyDetail strips Patch/PatchDigest from rec according to detail: DetailFull (or an unset Detail)
+// leaves rec untouched, DetailPatchDigest replaces Patch with its sha256 digest, and DetailDecisionOnly
+// drops both.
+func applyDetail(rec Record, detail Detail) Record {
+	switch detail {
+	case DetailPatchDigest:
+		if rec.Patch != "" {
+			rec.PatchDigest = digest(rec.Patch)
+		}
+		rec.Patch = ""
+	case DetailDecisionOnly:
+		rec.Patch = ""
+		rec.PatchDigest = ""
+	}
+	return rec
+}
+
+// digest computes a stable fingerprint of patch. Annotation and label values flow into a patch as
+// free-form UTF-8 and can reach kube-graffiti in different, visually-identical normalization forms -
+// e.g. an accented character composed as a single code point (NFC) on one replica's config but as a
+// base letter plus a combining mark (NFD) on another's - which would otherwise hash differently despite
+// representing the same text. patch is therefore normalized to NFC, the one documented normalization
+// step, before hashing, so that two replicas recording the same logical decision always produce the
+// same digest.
+func digest(patch string) string {
+	sum := sha256.Sum256([]byte(norm.NFC.String(patch)))
+	return hex.EncodeToString(sum[:])
+}
+
+func (w *Writer) activePath() string {
+	return filepath.Join(w.cfg.Directory, "audit.log")
+}
+
+func (w *Writer) openActiveFile() error {
+	f, err := os.OpenFile(w.activePath(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.file = f
+	w.fileSize = fi.Size()
+	w.openedAt = time.Now().UTC()
+	return nil
+}
+
+// rotateIfNeeded rotates the active file, if it exists and is non-empty, when appending nextWriteBytes
+// more to it would exceed Config.MaxSizeBytes, or it has been open longer than Config.MaxAge.
+func (w *Writer) rotateIfNeeded(nextWriteBytes int) error {
+	if w.fileSize == 0 {
+		return nil
+	}
+	sizeExceeded := w.cfg.MaxSizeBytes > 0 && w.fileSize+int64(nextWriteBytes) > w.cfg.MaxSizeBytes
+	ageExceeded := w.cfg.MaxAge > 0 && time.Since(w.openedAt) > w.cfg.MaxAge
+	if !sizeExceeded && !ageExceeded {
+		return nil
+	}
+	return w.rotate()
+}
+
+// rotate closes the active file, renames it to a timestamped backup name, optionally gzips the backup,
+// and opens a fresh active file in its place.
+func (w *Writer) rotate() error {
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	w.file = nil
+
+	rotated := filepath.Join(w.cfg.Directory, fmt.Sprintf("audit-%s.log", time.Now().UTC().Format("20060102T150405.000000000")))
+	if err := os.Rename(w.activePath(), rotated); err != nil {
+		return err
+	}
+	if w.cfg.Compress {
+		if err := gzipFile(rotated); err != nil {
+			return fmt.Errorf("could not compress rotated audit log file: %v", err)
+		}
+	}
+	return w.openActiveFile()
+}
+
+// gzipFile compresses path into path+".gz" and removes the uncompressed original.
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(path + ".gz")
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	gw := gzip.NewWriter(out)
+	if _, err := io.Copy(gw, in); err != nil {
+		gw.Close()
+		return err
+	}
+	if err := gw.Close(); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// enforceRetention deletes the oldest rotated files - never the active file - first to bring the
+// rotated-file count within Config.MaxBackups, then again as needed to bring the audit directory's
+// total size within Config.MaxTotalBytes.
+func (w *Writer) enforceRetention() {
+	backups, err := w.listBackups()
+	if err != nil {
+		w.mylog.Error().Err(err).Msg("could not list rotated audit log files")
+		return
+	}
+
+	if w.cfg.MaxBackups > 0 {
+		for len(backups) > w.cfg.MaxBackups {
+			backups = w.removeOldest(backups)
+		}
+	}
+
+	if w.cfg.MaxTotalBytes > 0 {
+		total := w.fileSize
+		sizes := make(map[string]int64, len(backups))
+		for _, b := range backups {
+			if fi, err := os.Stat(b); err == nil {
+				sizes[b] = fi.Size()
+				total += fi.Size()
+			}
+		}
+		for total > w.cfg.MaxTotalBytes && len(backups) > 0 {
+			oldest := backups[0]
+			backups = w.removeOldest(backups)
+			total -= sizes[oldest]
+		}
+	}
+}
+
+// removeOldest deletes backups[0] - the oldest rotated file, since listBackups returns them in
+// ascending timestamp order - and returns the remaining backups.
+func (w *Writer) removeOldest(backups []string) []string {
+	oldest := backups[0]
+	if err := os.Remove(oldest); err != nil {
+		w.mylog.Error().Err(err).Str("file", oldest).Msg("could not remove rotated audit log file")
+	}
+	return backups[1:]
+}
+
+// listBackups returns every rotated audit log file in the audit directory - compressed or not - sorted
+// oldest first, which the "audit-<timestamp>.log[.gz]" naming rotate gives them sorts lexically into.
+func (w *Writer) listBackups() ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(w.cfg.Directory, "audit-*.log*"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(matches)
+	return matches, nil
+}
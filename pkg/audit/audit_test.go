@@ -0,0 +1,207 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package audit
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/text/unicode/norm"
+)
+
+func readRecords(t *testing.T, path string) []Record {
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	var records []Record
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec Record
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &rec))
+		records = append(records, rec)
+	}
+	require.NoError(t, scanner.Err())
+	return records
+}
+
+func TestDetailFullRecordsTheWholePatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	w, err := NewWriter(Config{Directory: dir, Detail: DetailFull})
+	require.NoError(t, err)
+	w.Record(Record{Rule: "add-a-label", Kind: "Pod", Name: "test-pod", Decision: DecisionPatched, Patch: `[{"op":"add","path":"/metadata/labels/painted","value":"true"}]`})
+	require.NoError(t, w.Close())
+
+	records := readRecords(t, filepath.Join(dir, "audit.log"))
+	require.Len(t, records, 1)
+	assert.Equal(t, SchemaVersion, records[0].SchemaVersion)
+	assert.Equal(t, `[{"op":"add","path":"/metadata/labels/painted","value":"true"}]`, records[0].Patch)
+	assert.Empty(t, records[0].PatchDigest)
+}
+
+func TestDetailPatchDigestRecordsOnlyADigestOfThePatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	w, err := NewWriter(Config{Directory: dir, Detail: DetailPatchDigest})
+	require.NoError(t, err)
+	w.Record(Record{Rule: "add-a-label", Kind: "Pod", Name: "test-pod", Decision: DecisionPatched, Patch: `[{"op":"add","path":"/metadata/labels/painted","value":"true"}]`})
+	require.NoError(t, w.Close())
+
+	records := readRecords(t, filepath.Join(dir, "audit.log"))
+	require.Len(t, records, 1)
+	assert.Empty(t, records[0].Patch, "the full patch body must not be recorded at patch-digest detail")
+	assert.Equal(t, digest(`[{"op":"add","path":"/metadata/labels/painted","value":"true"}]`), records[0].PatchDigest)
+}
+
+func TestDetailDecisionOnlyRecordsNeitherPatchNorDigest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	w, err := NewWriter(Config{Directory: dir, Detail: DetailDecisionOnly})
+	require.NoError(t, err)
+	w.Record(Record{Rule: "add-a-label", Kind: "Pod", Name: "test-pod", Decision: DecisionPatched, Patch: `[{"op":"add","path":"/metadata/labels/painted","value":"true"}]`})
+	require.NoError(t, w.Close())
+
+	records := readRecords(t, filepath.Join(dir, "audit.log"))
+	require.Len(t, records, 1)
+	assert.Empty(t, records[0].Patch)
+	assert.Empty(t, records[0].PatchDigest)
+	assert.Equal(t, DecisionPatched, records[0].Decision)
+}
+
+// TestDigestIsStableAcrossUnicodeNormalizationForms confirms that two patches which differ only in
+// which Unicode normalization form the same accented character is encoded in - NFC's single composed
+// code point versus NFD's base letter plus combining acute accent - hash identically, so that two
+// replicas recording what is visually the same decision don't disagree on its digest.
+func TestDigestIsStableAcrossUnicodeNormalizationForms(t *testing.T) {
+	nfc := `[{"op":"add","path":"/metadata/annotations/message","value":"café"}]`
+	nfd := norm.NFD.String(nfc)
+	require.NotEqual(t, nfc, nfd, "the test fixture should actually exercise two different normalization forms")
+
+	assert.Equal(t, digest(nfc), digest(nfd), "the digest should be the same regardless of the input's normalization form")
+}
+
+// TestDigestPreservesCJKAndEmojiContent confirms a digest over a patch containing CJK characters and an
+// emoji is deterministic and doesn't error or silently drop the non-ASCII content.
+func TestDigestPreservesCJKAndEmojiContent(t *testing.T) {
+	patch := `[{"op":"add","path":"/metadata/annotations/message","value":"日本語 😀"}]`
+	assert.Equal(t, digest(patch), digest(patch))
+	assert.NotEmpty(t, digest(patch))
+}
+
+func TestWriterRotatesTheActiveFileOnceItExceedsMaxSizeBytes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	w, err := NewWriter(Config{Directory: dir, Detail: DetailDecisionOnly, MaxSizeBytes: 150})
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		w.Record(Record{Rule: "add-a-label", Kind: "Pod", Name: "test-pod", Decision: DecisionAllowed})
+	}
+	require.NoError(t, w.Close())
+
+	matches, err := filepath.Glob(filepath.Join(dir, "audit-*.log"))
+	require.NoError(t, err)
+	assert.NotEmpty(t, matches, "writing past max-size-bytes should have rotated at least one backup file")
+
+	active := readRecords(t, filepath.Join(dir, "audit.log"))
+	assert.NotEmpty(t, active, "the active file should still be receiving the latest records after rotation")
+}
+
+func TestRotatedFilesAreGzippedWhenCompressIsEnabled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	w, err := NewWriter(Config{Directory: dir, Detail: DetailDecisionOnly, MaxSizeBytes: 150, Compress: true})
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		w.Record(Record{Rule: "add-a-label", Kind: "Pod", Name: "test-pod", Decision: DecisionAllowed})
+	}
+	require.NoError(t, w.Close())
+
+	gzipped, err := filepath.Glob(filepath.Join(dir, "audit-*.log.gz"))
+	require.NoError(t, err)
+	require.NotEmpty(t, gzipped, "rotated files should be named with a .gz suffix when compress is enabled")
+
+	plain, err := filepath.Glob(filepath.Join(dir, "audit-*.log"))
+	require.NoError(t, err)
+	assert.Empty(t, plain, "the uncompressed rotated file should have been removed once gzipped")
+
+	f, err := os.Open(gzipped[0])
+	require.NoError(t, err)
+	defer f.Close()
+	gr, err := gzip.NewReader(f)
+	require.NoError(t, err, "the rotated file should be valid gzip content")
+	gr.Close()
+}
+
+func TestRecordDecisionIsANoOpWithNoActiveWriter(t *testing.T) {
+	ActiveWriter = nil
+	RecordDecision(Record{Rule: "add-a-label", Kind: "Pod", Name: "test-pod", Decision: DecisionAllowed})
+}
+
+func TestRecordDecisionPersistsToTheActiveWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	w, err := NewWriter(Config{Directory: dir, Detail: DetailDecisionOnly})
+	require.NoError(t, err)
+	ActiveWriter = w
+	defer func() { ActiveWriter = nil }()
+
+	RecordDecision(Record{Rule: "add-a-label", Kind: "Pod", Name: "test-pod", Decision: DecisionPatched})
+	require.NoError(t, w.Close())
+
+	records := readRecords(t, filepath.Join(dir, "audit.log"))
+	require.Len(t, records, 1)
+	assert.Equal(t, "add-a-label", records[0].Rule)
+	assert.Equal(t, DecisionPatched, records[0].Decision)
+}
+
+func TestWriterEvictsOldestBackupsToStayWithinMaxTotalBytes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	w, err := NewWriter(Config{Directory: dir, Detail: DetailDecisionOnly, MaxSizeBytes: 150, MaxTotalBytes: 300})
+	require.NoError(t, err)
+	for i := 0; i < 40; i++ {
+		w.Record(Record{Rule: "add-a-label", Kind: "Pod", Name: "test-pod", Decision: DecisionAllowed})
+	}
+	require.NoError(t, w.Close())
+
+	var total int64
+	entries, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	for _, e := range entries {
+		total += e.Size()
+	}
+	assert.True(t, total <= 300, "the audit directory's total size should never exceed max-total-bytes once enforced")
+}
@@ -0,0 +1,109 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"fmt"
+
+	"github.com/HotelsDotCom/kube-graffiti/pkg/graffiti"
+)
+
+// OldestSupportedConfigVersion is the config-version assumed for a configuration that doesn't set
+// config-version at all, so that files written before config-version existed keep working unchanged.
+const OldestSupportedConfigVersion = 1
+
+// LatestConfigVersion is the newest config-version this binary understands. Configuration.ConfigVersion
+// values above this are a hard error, since this binary has no behaviour shims for them yet.
+const LatestConfigVersion = 2
+
+// Behaviour gathers every config-version-gated behaviour shim into one place, so that the affected
+// code paths consult a single resolved struct rather than each re-deriving "am I on the old or new
+// semantics" from a raw version number.
+type Behaviour struct {
+	// ImplicitMatchAll preserves config-version 1's behaviour of a rule with no selectors matching
+	// every object. From config-version 2 onwards a rule must set matchers.match-all: true to get the
+	// same effect, so that a rule accidentally left without any selectors fails validation instead of
+	// silently matching everything.
+	ImplicitMatchAll bool
+}
+
+// BehaviourForVersion returns the Behaviour shims that apply to a resolved config-version.
+func BehaviourForVersion(version int) Behaviour {
+	return Behaviour{
+		ImplicitMatchAll: version < 2,
+	}
+}
+
+// ResolveConfigVersion validates a configuration's declared config-version and returns the version
+// that should actually be used to select behaviour. A configured value of 0 means config-version
+// wasn't set at all: it resolves to OldestSupportedConfigVersion with a warning, since that's the
+// version every config file written before this field existed implicitly declares. A configured
+// value above LatestConfigVersion is a hard error - this binary predates that schema version and
+// can't apply its behaviour shims - telling the user to upgrade kube-graffiti rather than their config.
+func ResolveConfigVersion(configured int) (version int, warning string, err error) {
+	if configured == 0 {
+		return OldestSupportedConfigVersion, fmt.Sprintf("config-version is not set, assuming the oldest supported version (%d) - set config-version explicitly to silence this warning", OldestSupportedConfigVersion), nil
+	}
+	if configured > LatestConfigVersion {
+		return 0, "", fmt.Errorf("config-version %d is newer than the highest version this binary supports (%d) - please upgrade kube-graffiti", configured, LatestConfigVersion)
+	}
+	if configured < OldestSupportedConfigVersion {
+		return 0, "", fmt.Errorf("config-version %d is lower than the oldest version this binary supports (%d)", configured, OldestSupportedConfigVersion)
+	}
+	return configured, "", nil
+}
+
+// ApplyBehaviour pushes b out to the package-level behaviour switches that the affected code paths
+// actually consult. It is the single place that wires Behaviour's fields to their real effect.
+func ApplyBehaviour(b Behaviour) {
+	graffiti.RequireExplicitMatchAll = !b.ImplicitMatchAll
+}
+
+// UpgradeConfig mechanically rewrites c from config-version "from" to config-version from+1,
+// applying exactly the transformations needed to keep c's existing behaviour unchanged under the new
+// version's rules. It only upgrades one version at a time; upgrading across several versions means
+// calling it repeatedly, re-validating in between.
+func UpgradeConfig(c Configuration, from int) (Configuration, error) {
+	switch from {
+	case 1:
+		return upgradeV1ToV2(c), nil
+	default:
+		return Configuration{}, fmt.Errorf("don't know how to upgrade a config-version %d configuration", from)
+	}
+}
+
+// upgradeV1ToV2 inserts an explicit "match-all: true" into every rule whose matchers would have
+// relied on config-version 1's implicit match-all, since config-version 2 requires that to be
+// explicit. Every other rule - one that already has a selector or match-expression - is unaffected.
+func upgradeV1ToV2(c Configuration) Configuration {
+	upgraded := c
+	upgraded.ConfigVersion = 2
+	upgraded.Rules = make([]Rule, len(c.Rules))
+	for i, rule := range c.Rules {
+		upgraded.Rules[i] = rule
+		if reliesOnImplicitMatchAll(rule.Matchers) {
+			upgraded.Rules[i].Matchers.MatchAll = true
+		}
+	}
+	return upgraded
+}
+
+// reliesOnImplicitMatchAll reports whether m has no selectors of its own, and so would only ever
+// match an object because of config-version 1's implicit match-all fallback.
+func reliesOnImplicitMatchAll(m graffiti.Matchers) bool {
+	if m.MatchExpression != "" || m.MatchAll {
+		return false
+	}
+	return len(m.LabelSelectors) == 0 && len(m.FieldSelectors) == 0 && len(m.VersionSelectors) == 0
+}
@@ -0,0 +1,99 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"testing"
+
+	"github.com/HotelsDotCom/kube-graffiti/pkg/graffiti"
+	"github.com/HotelsDotCom/kube-graffiti/pkg/webhook"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveConfigVersionDefaultsToOldestSupportedWithAWarning(t *testing.T) {
+	version, warning, err := ResolveConfigVersion(0)
+	require.NoError(t, err)
+	assert.Equal(t, OldestSupportedConfigVersion, version)
+	assert.NotEmpty(t, warning, "an unset config-version should produce a warning")
+}
+
+func TestResolveConfigVersionAcceptsEverySupportedVersion(t *testing.T) {
+	for v := OldestSupportedConfigVersion; v <= LatestConfigVersion; v++ {
+		version, warning, err := ResolveConfigVersion(v)
+		require.NoError(t, err)
+		assert.Equal(t, v, version)
+		assert.Empty(t, warning)
+	}
+}
+
+func TestResolveConfigVersionRejectsAVersionNewerThanThisBinarySupports(t *testing.T) {
+	_, _, err := ResolveConfigVersion(LatestConfigVersion + 1)
+	assert.Error(t, err)
+}
+
+func TestBehaviourForVersionKeepsImplicitMatchAllOnlyOnVersion1(t *testing.T) {
+	assert.True(t, BehaviourForVersion(1).ImplicitMatchAll)
+	assert.False(t, BehaviourForVersion(2).ImplicitMatchAll)
+}
+
+func TestApplyBehaviourSetsTheGraffitiPackageVar(t *testing.T) {
+	old := graffiti.RequireExplicitMatchAll
+	defer func() { graffiti.RequireExplicitMatchAll = old }()
+
+	ApplyBehaviour(Behaviour{ImplicitMatchAll: true})
+	assert.False(t, graffiti.RequireExplicitMatchAll)
+
+	ApplyBehaviour(Behaviour{ImplicitMatchAll: false})
+	assert.True(t, graffiti.RequireExplicitMatchAll)
+}
+
+func TestUpgradeConfigBumpsTheConfigVersion(t *testing.T) {
+	c := Configuration{ConfigVersion: 1}
+	upgraded, err := UpgradeConfig(c, 1)
+	require.NoError(t, err)
+	assert.Equal(t, 2, upgraded.ConfigVersion)
+}
+
+func TestUpgradeConfigInsertsMatchAllForARuleThatReliedOnItImplicitly(t *testing.T) {
+	c := Configuration{
+		ConfigVersion: 1,
+		Rules: []Rule{
+			{Registration: webhook.Registration{Name: "implicit-match-all-rule"}},
+		},
+	}
+	upgraded, err := UpgradeConfig(c, 1)
+	require.NoError(t, err)
+	assert.True(t, upgraded.Rules[0].Matchers.MatchAll, "a rule with no selectors should get an explicit match-all after upgrading")
+}
+
+func TestUpgradeConfigLeavesARuleWithASelectorUntouched(t *testing.T) {
+	c := Configuration{
+		ConfigVersion: 1,
+		Rules: []Rule{
+			{
+				Registration: webhook.Registration{Name: "has-a-selector"},
+				Matchers:     graffiti.Matchers{LabelSelectors: []string{"author=david"}},
+			},
+		},
+	}
+	upgraded, err := UpgradeConfig(c, 1)
+	require.NoError(t, err)
+	assert.False(t, upgraded.Rules[0].Matchers.MatchAll, "a rule that already has a selector of its own shouldn't need match-all")
+}
+
+func TestUpgradeConfigRejectsAnUnknownFromVersion(t *testing.T) {
+	_, err := UpgradeConfig(Configuration{}, 99)
+	assert.Error(t, err)
+}
@@ -16,6 +16,7 @@ package config
 import (
 	"errors"
 	"fmt"
+	"strings"
 
 	"github.com/HotelsDotCom/kube-graffiti/pkg/graffiti"
 	"github.com/HotelsDotCom/kube-graffiti/pkg/healthcheck"
@@ -31,12 +32,51 @@ const (
 
 // Configuration models the structre of our configuration values loaded through viper.
 type Configuration struct {
-	_             string                    `mapstructure:"config" yaml:"config"`
+	_ string `mapstructure:"config" yaml:"config"`
+	// ConfigVersion declares which schema/semantics version of this configuration the file was
+	// written against, so that a kube-graffiti upgrade which changes default behaviour doesn't change
+	// it out from under an unchanged config file. 0 means unset; see ResolveConfigVersion.
+	ConfigVersion int                       `mapstructure:"config-version" yaml:"config-version,omitempty"`
 	LogLevel      string                    `mapstructure:"log-level" yaml:"log-level"`
 	CheckExisting bool                      `mapstructure:"check-existing" yaml:"check-existing,omitempty"`
 	HealthChecker healthcheck.HealthChecker `mapstructure:"health-checker" yaml:"health-checker,omitempty"`
 	Server        Server                    `mapstructure:"server" yaml:"server"`
 	Rules         []Rule                    `mapstructure:"rules" yaml:"rules"`
+	// Environment names the deployment this configuration targets, e.g. "staging" or "production". It
+	// currently only gates webhook.ConfigureFaults - a Faults list is refused unless Environment is
+	// "staging" or webhook.FaultInjectionUnsafe is set - so chaos testing can't be armed by a config
+	// file accidentally pointed at a real cluster.
+	Environment string `mapstructure:"environment" yaml:"environment,omitempty"`
+	// Faults configures chaos-testing fault injection for validating failure-policy behaviour in
+	// staging. See webhook.Fault and webhook.ConfigureFaults.
+	Faults []webhook.Fault `mapstructure:"faults" yaml:"faults,omitempty"`
+	// DefaultNamespaceSelector is AND-combined into every rule's Registration.NamespaceSelector unless
+	// the rule sets Registration.SkipDefaultNamespaceSelector, so that e.g. excluding system namespaces
+	// can be declared once rather than repeated on every rule. A rule with no namespace-selector of its
+	// own simply inherits this one; a rule that already has one gets both requirements ANDed together.
+	// See applyDefaultNamespaceSelector, which performs the merge at config load time, before any rule
+	// is validated, registered as a webhook or checked against existing objects.
+	DefaultNamespaceSelector string `mapstructure:"default-namespace-selector" yaml:"default-namespace-selector,omitempty"`
+	// MaxRules is a soft limit on how many webhooks this configuration may end up registering -
+	// hundreds of separate MutatingWebhookConfiguration entries each cost the apiserver a round trip
+	// per matching request, so a configuration that grows past a sensible limit should consolidate
+	// rules rather than keep adding more. A rule registered with
+	// NamespaceSelectorAppliesToNamespacesSelf counts as two webhooks, matching RegisterHook's own
+	// split. 0 (the default) leaves the count unchecked. See validateRuleLimit.
+	MaxRules int `mapstructure:"max-rules" yaml:"max-rules,omitempty"`
+	// StrictRuleLimit turns exceeding MaxRules into a validation error instead of just a logged
+	// warning. It has no effect when MaxRules is unset.
+	StrictRuleLimit bool `mapstructure:"strict-rule-limit" yaml:"strict-rule-limit,omitempty"`
+	// ConflictResolution chooses how two rules that both match the same object and both add the same
+	// label/annotation key with different values are reconciled - "first-wins" (the default, and the
+	// only behaviour available before this setting existed) lets the earliest-declared matching rule's
+	// value stand; "priority" instead lets the matching rule with the highest Rule.Priority win,
+	// earliest-declared breaking a tie; "error-at-validation" refuses to load a configuration containing
+	// any two rules whose literal label/annotation additions statically conflict, rather than leaving
+	// the outcome to be decided at runtime. It currently only governs the existing/consolidated sweep's
+	// patch-merging (see existing.ConflictResolution) - live admission requests are still resolved by
+	// whichever rule the apiserver happens to call last. See validateConflictResolution.
+	ConflictResolution string `mapstructure:"conflict-resolution" yaml:"conflict-resolution,omitempty"`
 }
 
 // Server contains all the settings for the webhook https server and access from the kubernetes api.
@@ -55,6 +95,48 @@ type Rule struct {
 	Registration webhook.Registration `mapstructure:"registration" yaml:"registration"`
 	Matchers     graffiti.Matchers    `mapstructure:"matchers" yaml:"matchers,omitempty"`
 	Payload      graffiti.Payload     `mapstructure:"payload" yaml:"payload"`
+	// EvaluateOn carries graffiti.Rule.EvaluateOn through from configuration - see its doc comment for
+	// what it controls.
+	EvaluateOn []string `mapstructure:"evaluate-on" yaml:"evaluate-on,omitempty"`
+	// Budget carries graffiti.Rule.Budget through from configuration - see its doc comment for what it
+	// controls.
+	Budget graffiti.Budget `mapstructure:"budget" yaml:"budget,omitempty"`
+	// MinKubeVersion and MaxKubeVersion restrict this rule to clusters whose discovered server version
+	// falls within ["major.minor", "major.minor"] inclusive, e.g. a rule working around a bug fixed in
+	// 1.25 sets min-kube-version: "1.25". Either bound may be left unset; a rule with neither is never
+	// restricted. See FilterRulesForKubeVersion, which resolves the cluster's live version via discovery
+	// at startup and drops any rule outside its configured range before it is ever registered.
+	MinKubeVersion string `mapstructure:"min-kube-version" yaml:"min-kube-version,omitempty"`
+	MaxKubeVersion string `mapstructure:"max-kube-version" yaml:"max-kube-version,omitempty"`
+	// RelatedObjects restricts the existing sweep to primary objects related to some secondary object -
+	// see its doc comment for what it controls. It has no effect on live admission.
+	RelatedObjects RelatedObjects `mapstructure:"related-objects" yaml:"related-objects,omitempty"`
+	// Tests are self-checks a rule's author can embed alongside its configuration - see RuleTest's doc
+	// comment. They have no effect on admission or the existing sweep; only the validate subcommand
+	// runs them, via RunTests.
+	Tests []RuleTest `mapstructure:"tests" yaml:"tests,omitempty"`
+	// Priority only has an effect when Configuration.ConflictResolution is "priority": the matching
+	// rule with the highest Priority wins a conflicting label/annotation addition over a matching rule
+	// with a lower one, regardless of declaration order. Rules not setting it default to 0, so an
+	// unprioritised rule only wins against another unprioritised rule by declaration order.
+	Priority int `mapstructure:"priority" yaml:"priority,omitempty"`
+}
+
+// Summary returns a concise, one-line, human-readable description of r - its name, registered
+// targets, matchers and payload action - for logging at startup so an operator can sanity-check the
+// loaded configuration at a glance without reading the whole rule back out as YAML.
+func (r Rule) Summary() string {
+	return fmt.Sprintf("%s: targets=%s matchers=[%s] payload=[%s]", r.Registration.Name, targetsSummary(r.Registration.Targets), r.Matchers.Summary(), r.Payload.ActionSummary())
+}
+
+// targetsSummary renders a registration's targets as "group/version/resource" entries, e.g.
+// "apps/v1/deployments".
+func targetsSummary(targets []webhook.Target) string {
+	var parts []string
+	for _, t := range targets {
+		parts = append(parts, fmt.Sprintf("%s/%s/%s", t.APIGroups, t.APIVersions, t.Resources))
+	}
+	return strings.Join(parts, ", ")
 }
 
 // ValidateConfig is responsible for throwing errors when the configuration is bad.
@@ -62,19 +144,58 @@ func (c Configuration) ValidateConfig() error {
 	mylog := log.ComponentLogger(componentName, "ValidateConfig")
 	mylog.Debug().Msg("validating configuration")
 
+	version, warning, err := ResolveConfigVersion(c.ConfigVersion)
+	if err != nil {
+		mylog.Error().Err(err).Int("config-version", c.ConfigVersion).Msg("configuration declares an unsupported config-version")
+		return err
+	}
+	if warning != "" {
+		mylog.Warn().Msg(warning)
+	}
+	ApplyBehaviour(BehaviourForVersion(version))
+
 	if err := c.validateLogArgs(); err != nil {
 		return err
 	}
 	if err := c.validateWebhookArgs(); err != nil {
 		return err
 	}
+	c.applyDefaultNamespaceSelector()
+
 	if err := c.validateRules(); err != nil {
 		return err
 	}
+	if err := c.validateRuleLimit(); err != nil {
+		return err
+	}
+	if err := c.validateConflictResolution(); err != nil {
+		return err
+	}
 
 	return nil
 }
 
+// applyDefaultNamespaceSelector AND-combines DefaultNamespaceSelector into every rule's
+// Registration.NamespaceSelector, unless the rule sets SkipDefaultNamespaceSelector - see
+// DefaultNamespaceSelector's doc comment. It mutates c.Rules in place, via index, so the merge is
+// visible to every caller sharing the same Rules backing array, not just this validation pass. It is
+// a no-op when DefaultNamespaceSelector isn't set.
+func (c Configuration) applyDefaultNamespaceSelector() {
+	if c.DefaultNamespaceSelector == "" {
+		return
+	}
+	for i, rule := range c.Rules {
+		if rule.Registration.SkipDefaultNamespaceSelector {
+			continue
+		}
+		if rule.Registration.NamespaceSelector == "" {
+			c.Rules[i].Registration.NamespaceSelector = c.DefaultNamespaceSelector
+		} else {
+			c.Rules[i].Registration.NamespaceSelector = rule.Registration.NamespaceSelector + "," + c.DefaultNamespaceSelector
+		}
+	}
+}
+
 // validateLogArgs check that a requested log-level is defined/allowed.
 func (c Configuration) validateLogArgs() error {
 	mylog := log.ComponentLogger(componentName, "validateLogArgs")
@@ -118,10 +239,29 @@ func (c Configuration) validateRules() error {
 		}
 		existingRuleNames[rule.Registration.Name] = true
 
+		if err := rule.Registration.Validate(); err != nil {
+			mylog.Error().Str("rule", rule.Registration.Name).Err(err).Msg("rule has an invalid registration")
+			return err
+		}
+		if err := validateClampTargets(rule); err != nil {
+			mylog.Error().Str("rule", rule.Registration.Name).Err(err).Msg("rule has an invalid clamp target")
+			return err
+		}
+		if err := validateKubeVersionBounds(rule); err != nil {
+			mylog.Error().Str("rule", rule.Registration.Name).Err(err).Msg("rule has an invalid min/max-kube-version")
+			return err
+		}
+		if err := rule.RelatedObjects.validate(rule.Registration.Name); err != nil {
+			mylog.Error().Str("rule", rule.Registration.Name).Err(err).Msg("rule has an invalid related-objects")
+			return err
+		}
+
 		gr := graffiti.Rule{
-			Name:     rule.Registration.Name,
-			Matchers: rule.Matchers,
-			Payload:  rule.Payload,
+			Name:       rule.Registration.Name,
+			Matchers:   rule.Matchers,
+			Payload:    rule.Payload,
+			EvaluateOn: rule.EvaluateOn,
+			Budget:     rule.Budget,
 		}
 		if err := gr.Validate(mylog); err != nil {
 			return err
@@ -129,3 +269,98 @@ func (c Configuration) validateRules() error {
 	}
 	return nil
 }
+
+// validateRuleLimit checks the number of webhooks this configuration will register against MaxRules -
+// see its doc comment for why this matters - warning or failing validation depending on
+// StrictRuleLimit. It is a no-op when MaxRules is unset.
+func (c Configuration) validateRuleLimit() error {
+	if c.MaxRules <= 0 {
+		return nil
+	}
+	mylog := log.ComponentLogger(componentName, "validateRuleLimit")
+
+	webhookCount := 0
+	for _, rule := range c.Rules {
+		webhookCount++
+		if rule.Registration.NamespaceSelectorAppliesToNamespaces == webhook.NamespaceSelectorAppliesToNamespacesSelf {
+			webhookCount++
+		}
+	}
+	if webhookCount <= c.MaxRules {
+		return nil
+	}
+
+	msg := fmt.Sprintf("configuration registers %d webhook(s) across %d rule(s), exceeding the configured max-rules of %d - consider consolidating rules to reduce apiserver load", webhookCount, len(c.Rules), c.MaxRules)
+	if c.StrictRuleLimit {
+		mylog.Error().Msg(msg)
+		return errors.New(msg)
+	}
+	mylog.Warn().Msg(msg)
+	return nil
+}
+
+// validateConflictResolution checks that ConflictResolution, if set, names one of the supported
+// strategies, and - only for "error-at-validation" - statically detects any two rules whose literal
+// label/annotation additions would conflict, per conflictingAddition. "first-wins" and "priority"
+// are left to be resolved at runtime (see existing.ConflictResolution), since which rules actually
+// match a given object can't be known until then.
+func (c Configuration) validateConflictResolution() error {
+	switch c.ConflictResolution {
+	case "", "first-wins", "priority":
+		return nil
+	case "error-at-validation":
+	default:
+		return fmt.Errorf("conflict-resolution %q must be one of \"first-wins\", \"priority\" or \"error-at-validation\"", c.ConflictResolution)
+	}
+
+	mylog := log.ComponentLogger(componentName, "validateConflictResolution")
+	for i := 0; i < len(c.Rules); i++ {
+		for j := i + 1; j < len(c.Rules); j++ {
+			a, b := c.Rules[i], c.Rules[j]
+			if key, valueA, valueB, conflicts := conflictingAddition(a.Payload.Additions, b.Payload.Additions); conflicts {
+				mylog.Error().Str("rule", a.Registration.Name).Str("other-rule", b.Registration.Name).Str("key", key).Msg("two rules statically conflict over the same label/annotation key")
+				return fmt.Errorf("rule %q and rule %q both add %q but with different values (%q vs %q) - conflict-resolution is \"error-at-validation\"", a.Registration.Name, b.Registration.Name, key, valueA, valueB)
+			}
+		}
+	}
+	return nil
+}
+
+// conflictingAddition reports the first label or annotation key that a and b both add with a
+// different literal value, if any. It only catches statically-detectable conflicts - a key added by
+// one rule and one templated via additions computed at mutation time (e.g. StampCreatedBy) is never
+// flagged, since there's nothing to compare yet at validation time.
+func conflictingAddition(a, b graffiti.Additions) (key, valueA, valueB string, conflicts bool) {
+	for k, va := range a.Labels {
+		if vb, ok := b.Labels[k]; ok && va != vb {
+			return k, va, vb, true
+		}
+	}
+	for k, va := range a.Annotations {
+		if vb, ok := b.Annotations[k]; ok && va != vb {
+			return k, va, vb, true
+		}
+	}
+	return "", "", "", false
+}
+
+// validateClampTargets checks that a clamp payload is only ever registered against something that
+// actually has a replicas field at the configured path: either a scale subresource, which always
+// does, or a path that itself ends in "/replicas" on a whole object. graffiti.Payload can't do this
+// check itself, since it has no visibility into the rule's registered targets.
+func validateClampTargets(rule Rule) error {
+	if rule.Payload.Clamp.Path == "" {
+		return nil
+	}
+	if strings.HasSuffix(rule.Payload.Clamp.Path, "/replicas") {
+		return nil
+	}
+	for _, t := range rule.Registration.Targets {
+		for _, r := range t.Resources {
+			if strings.HasSuffix(strings.ToLower(r), "/scale") {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("rule %s is invalid - a clamp payload must target a scale subresource, or use a path ending in \"/replicas\"", rule.Registration.Name)
+}
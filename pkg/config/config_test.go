@@ -17,6 +17,7 @@ import (
 	"testing"
 
 	"github.com/HotelsDotCom/kube-graffiti/pkg/graffiti"
+	"github.com/HotelsDotCom/kube-graffiti/pkg/webhook"
 	yaml "gopkg.in/yaml.v2"
 
 	"github.com/stretchr/testify/assert"
@@ -194,3 +195,204 @@ rules:
 	err = config.ValidateConfig()
 	assert.EqualError(t, err, "rule my-rule is invalid - found duplicate rules with the same name, they must be unique", "two rules with the same name should cause a validation error")
 }
+
+func TestConfigWithAnUnsupportedFutureConfigVersionFailsValidation(t *testing.T) {
+	var config Configuration
+	err := yaml.Unmarshal([]byte(testConfig), &config)
+	require.NoError(t, err, "the test configuration should unmarshal")
+
+	config.ConfigVersion = LatestConfigVersion + 1
+	err = config.ValidateConfig()
+	assert.Error(t, err, "a config-version newer than this binary supports should fail validation")
+}
+
+func TestConfigVersion1RuleWithNoSelectorsStillMatchesEverything(t *testing.T) {
+	old := graffiti.RequireExplicitMatchAll
+	defer func() { graffiti.RequireExplicitMatchAll = old }()
+
+	var config Configuration
+	err := yaml.Unmarshal([]byte(testConfig), &config)
+	require.NoError(t, err, "the test configuration should unmarshal")
+
+	config.ConfigVersion = 1
+	config.Rules[0].Matchers = graffiti.Matchers{}
+	assert.NoError(t, config.ValidateConfig(), "config-version 1 should still allow a rule with no selectors")
+}
+
+func TestConfigVersion2RuleWithNoSelectorsAndNoMatchAllFailsValidation(t *testing.T) {
+	old := graffiti.RequireExplicitMatchAll
+	defer func() { graffiti.RequireExplicitMatchAll = old }()
+
+	var config Configuration
+	err := yaml.Unmarshal([]byte(testConfig), &config)
+	require.NoError(t, err, "the test configuration should unmarshal")
+
+	config.ConfigVersion = 2
+	config.Rules[0].Matchers = graffiti.Matchers{}
+	assert.Error(t, config.ValidateConfig(), "config-version 2 should require match-all to be explicit")
+}
+
+func TestRuleWithAnInvalidBudgetScopeFailsValidation(t *testing.T) {
+	var config Configuration
+	err := yaml.Unmarshal([]byte(testConfig), &config)
+	require.NoError(t, err, "the test configuration should unmarshal")
+
+	config.Rules[0].Budget = graffiti.Budget{Scope: "pod", MaxMutations: 10}
+	assert.Error(t, config.ValidateConfig(), "an unrecognised budget scope should fail validation")
+}
+
+func TestRuleWithAValidBudgetPassesValidation(t *testing.T) {
+	var config Configuration
+	err := yaml.Unmarshal([]byte(testConfig), &config)
+	require.NoError(t, err, "the test configuration should unmarshal")
+
+	config.Rules[0].Budget = graffiti.Budget{Scope: graffiti.BudgetScopeNamespace, MaxMutations: 200, Window: "10m", OnExceeded: graffiti.BudgetOnExceededSkip}
+	assert.NoError(t, config.ValidateConfig())
+}
+
+// TestRuleSummaryIncludesTargetsMatchersAndAdditions confirms that Summary() describes a rule's
+// registered targets, matchers and payload additions in one human-readable line, for the startup
+// summary logged by initWebhookServer.
+func TestRuleSummaryIncludesTargetsMatchersAndAdditions(t *testing.T) {
+	var config Configuration
+	err := yaml.Unmarshal([]byte(testConfig), &config)
+	require.NoError(t, err, "the test configuration should unmarshal")
+
+	summary := config.Rules[0].Summary()
+	assert.Equal(t, `label-namespaces-called-dave: targets=[]/[v1]/[namespaces] matchers=[labels=[name = dave dave = true]] payload=[add labels=[result]]`, summary)
+}
+
+func TestDefaultNamespaceSelectorIsInheritedByARuleWithoutItsOwnSelector(t *testing.T) {
+	var config Configuration
+	require.NoError(t, yaml.Unmarshal([]byte(testConfig), &config), "the test configuration should unmarshal")
+	config.DefaultNamespaceSelector = "environment notin (kube-system)"
+
+	require.NoError(t, config.ValidateConfig())
+	assert.Equal(t, "environment notin (kube-system)", config.Rules[0].Registration.NamespaceSelector)
+	assert.Equal(t, "environment notin (kube-system)", config.Rules[1].Registration.NamespaceSelector)
+}
+
+func TestDefaultNamespaceSelectorIsANDCombinedWithARulesOwnSelector(t *testing.T) {
+	var config Configuration
+	require.NoError(t, yaml.Unmarshal([]byte(testConfig), &config), "the test configuration should unmarshal")
+	config.DefaultNamespaceSelector = "environment notin (kube-system)"
+	config.Rules[0].Registration.NamespaceSelector = "team=payments"
+
+	require.NoError(t, config.ValidateConfig())
+	assert.Equal(t, "team=payments,environment notin (kube-system)", config.Rules[0].Registration.NamespaceSelector, "a rule's own selector and the default should both have to match")
+}
+
+func TestSkipDefaultNamespaceSelectorOptsARuleOut(t *testing.T) {
+	var config Configuration
+	require.NoError(t, yaml.Unmarshal([]byte(testConfig), &config), "the test configuration should unmarshal")
+	config.DefaultNamespaceSelector = "environment notin (kube-system)"
+	config.Rules[0].Registration.SkipDefaultNamespaceSelector = true
+
+	require.NoError(t, config.ValidateConfig())
+	assert.Equal(t, "", config.Rules[0].Registration.NamespaceSelector, "this rule opted out, so it should be left completely unaffected by the default")
+	assert.Equal(t, "environment notin (kube-system)", config.Rules[1].Registration.NamespaceSelector)
+}
+
+func TestAnInvalidDefaultNamespaceSelectorFailsValidation(t *testing.T) {
+	var config Configuration
+	require.NoError(t, yaml.Unmarshal([]byte(testConfig), &config), "the test configuration should unmarshal")
+	config.DefaultNamespaceSelector = "this is not a valid selector$$"
+
+	assert.Error(t, config.ValidateConfig(), "a default-namespace-selector that doesn't parse should fail validation just as a rule's own namespace-selector would")
+}
+
+func TestExceedingMaxRulesOnlyWarnsByDefault(t *testing.T) {
+	var config Configuration
+	require.NoError(t, yaml.Unmarshal([]byte(testConfig), &config), "the test configuration should unmarshal")
+	config.MaxRules = 1
+
+	assert.NoError(t, config.ValidateConfig(), "exceeding max-rules should not fail validation unless strict-rule-limit is set")
+}
+
+func TestExceedingMaxRulesFailsValidationInStrictMode(t *testing.T) {
+	var config Configuration
+	require.NoError(t, yaml.Unmarshal([]byte(testConfig), &config), "the test configuration should unmarshal")
+	config.MaxRules = 1
+	config.StrictRuleLimit = true
+
+	assert.Error(t, config.ValidateConfig(), "exceeding max-rules with strict-rule-limit set should fail validation")
+}
+
+func TestStayingWithinMaxRulesPassesValidationEvenInStrictMode(t *testing.T) {
+	var config Configuration
+	require.NoError(t, yaml.Unmarshal([]byte(testConfig), &config), "the test configuration should unmarshal")
+	config.MaxRules = len(config.Rules)
+	config.StrictRuleLimit = true
+
+	assert.NoError(t, config.ValidateConfig())
+}
+
+func TestASelfModeRuleCountsAsTwoWebhooksAgainstMaxRules(t *testing.T) {
+	var config Configuration
+	require.NoError(t, yaml.Unmarshal([]byte(testConfig), &config), "the test configuration should unmarshal")
+	config.Rules[0].Registration.NamespaceSelectorAppliesToNamespaces = webhook.NamespaceSelectorAppliesToNamespacesSelf
+	config.MaxRules = len(config.Rules)
+	config.StrictRuleLimit = true
+
+	assert.Error(t, config.ValidateConfig(), "a self-mode rule registers an extra namespaces webhook, so it should push the count over max-rules")
+}
+
+func TestAnUnknownConflictResolutionFailsValidation(t *testing.T) {
+	var config Configuration
+	require.NoError(t, yaml.Unmarshal([]byte(testConfig), &config), "the test configuration should unmarshal")
+	config.ConflictResolution = "last-wins"
+
+	assert.Error(t, config.ValidateConfig(), "an unrecognised conflict-resolution should fail validation")
+}
+
+func TestFirstWinsAndPriorityConflictResolutionAreNotCheckedAtValidationTime(t *testing.T) {
+	var config Configuration
+	require.NoError(t, yaml.Unmarshal([]byte(testConfig), &config), "the test configuration should unmarshal")
+	config.Rules[0].Payload.Additions.Labels = map[string]string{"result": "a"}
+	config.Rules[1].Payload.Additions.Labels = map[string]string{"result": "b"}
+
+	config.ConflictResolution = "first-wins"
+	assert.NoError(t, config.ValidateConfig(), "first-wins should leave conflicting additions to be resolved at runtime")
+
+	config.ConflictResolution = "priority"
+	assert.NoError(t, config.ValidateConfig(), "priority should leave conflicting additions to be resolved at runtime")
+}
+
+func TestErrorAtValidationConflictResolutionCatchesConflictingLabelAdditions(t *testing.T) {
+	var config Configuration
+	require.NoError(t, yaml.Unmarshal([]byte(testConfig), &config), "the test configuration should unmarshal")
+	config.Rules[0].Payload.Additions.Labels = map[string]string{"result": "a"}
+	config.Rules[1].Payload.Additions.Labels = map[string]string{"result": "b"}
+	config.ConflictResolution = "error-at-validation"
+
+	assert.Error(t, config.ValidateConfig(), "two rules adding the same label with different values should fail validation")
+}
+
+func TestErrorAtValidationConflictResolutionIgnoresAgreeingAdditions(t *testing.T) {
+	var config Configuration
+	require.NoError(t, yaml.Unmarshal([]byte(testConfig), &config), "the test configuration should unmarshal")
+	config.Rules[0].Payload.Additions.Labels = map[string]string{"result": "a"}
+	config.Rules[1].Payload.Additions.Labels = map[string]string{"result": "a"}
+	config.ConflictResolution = "error-at-validation"
+
+	assert.NoError(t, config.ValidateConfig(), "two rules adding the same label with the same value don't conflict")
+}
+
+func TestConflictingAdditionDetectsAConflictingAnnotation(t *testing.T) {
+	a := graffiti.Additions{Annotations: map[string]string{"graffiti": "woz_'ere_2018"}}
+	b := graffiti.Additions{Annotations: map[string]string{"graffiti": "someone_else_woz_'ere"}}
+
+	key, valueA, valueB, conflicts := conflictingAddition(a, b)
+	assert.True(t, conflicts)
+	assert.Equal(t, "graffiti", key)
+	assert.Equal(t, "woz_'ere_2018", valueA)
+	assert.Equal(t, "someone_else_woz_'ere", valueB)
+}
+
+func TestConflictingAdditionIgnoresDisjointKeys(t *testing.T) {
+	a := graffiti.Additions{Labels: map[string]string{"result": "this_is_indeed_daveish"}}
+	b := graffiti.Additions{Annotations: map[string]string{"graffiti": "woz_'ere_2018"}}
+
+	_, _, _, conflicts := conflictingAddition(a, b)
+	assert.False(t, conflicts)
+}
@@ -0,0 +1,138 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/HotelsDotCom/kube-graffiti/pkg/log"
+	"k8s.io/apimachinery/pkg/version"
+)
+
+// kubeVersion is a parsed major.minor Kubernetes version. Rule.MinKubeVersion/MaxKubeVersion only ever
+// compare major.minor - a rule is never expected to care about the patch release.
+type kubeVersion struct {
+	major, minor int
+}
+
+// leadingDigits picks out the leading run of digits of a version component, so that a discovery minor
+// version carrying a trailing qualifier - e.g. EKS reporting minor "25+" - still parses.
+var leadingDigits = regexp.MustCompile(`^\d+`)
+
+// parseKubeVersion parses a "major.minor" string, such as a rule's MinKubeVersion/MaxKubeVersion.
+func parseKubeVersion(s string) (kubeVersion, error) {
+	var v kubeVersion
+	if _, err := fmt.Sscanf(s, "%d.%d", &v.major, &v.minor); err != nil {
+		return kubeVersion{}, fmt.Errorf("invalid kube version %q: must be in the form \"major.minor\", e.g. \"1.25\"", s)
+	}
+	return v, nil
+}
+
+// serverKubeVersion turns a discovery client's *version.Info into a kubeVersion.
+func serverKubeVersion(info *version.Info) (kubeVersion, error) {
+	major, err := strconv.Atoi(leadingDigits.FindString(info.Major))
+	if err != nil {
+		return kubeVersion{}, fmt.Errorf("could not parse server major version %q", info.Major)
+	}
+	minor, err := strconv.Atoi(leadingDigits.FindString(info.Minor))
+	if err != nil {
+		return kubeVersion{}, fmt.Errorf("could not parse server minor version %q", info.Minor)
+	}
+	return kubeVersion{major: major, minor: minor}, nil
+}
+
+// before reports whether v is strictly older than other.
+func (v kubeVersion) before(other kubeVersion) bool {
+	if v.major != other.major {
+		return v.major < other.major
+	}
+	return v.minor < other.minor
+}
+
+// after reports whether v is strictly newer than other.
+func (v kubeVersion) after(other kubeVersion) bool {
+	return other.before(v)
+}
+
+// validateKubeVersionBounds checks that a configured MinKubeVersion/MaxKubeVersion, if set, parses as a
+// "major.minor" version - the same check FilterRulesForKubeVersion would otherwise only discover once a
+// live cluster's discovered version is compared against it.
+func validateKubeVersionBounds(rule Rule) error {
+	if rule.MinKubeVersion != "" {
+		if _, err := parseKubeVersion(rule.MinKubeVersion); err != nil {
+			return fmt.Errorf("rule %s is invalid - %v", rule.Registration.Name, err)
+		}
+	}
+	if rule.MaxKubeVersion != "" {
+		if _, err := parseKubeVersion(rule.MaxKubeVersion); err != nil {
+			return fmt.Errorf("rule %s is invalid - %v", rule.Registration.Name, err)
+		}
+	}
+	return nil
+}
+
+// inKubeVersionRange reports whether server satisfies rule's MinKubeVersion/MaxKubeVersion constraints,
+// returning a human-readable reason when it doesn't. Bounds were already validated at config load time
+// by validateKubeVersionBounds, so a parse failure here can't happen in practice.
+func (r Rule) inKubeVersionRange(server kubeVersion) (ok bool, reason string) {
+	if r.MinKubeVersion != "" {
+		min, err := parseKubeVersion(r.MinKubeVersion)
+		if err != nil {
+			return false, err.Error()
+		}
+		if server.before(min) {
+			return false, fmt.Sprintf("cluster version %d.%d is below this rule's min-kube-version %q", server.major, server.minor, r.MinKubeVersion)
+		}
+	}
+	if r.MaxKubeVersion != "" {
+		max, err := parseKubeVersion(r.MaxKubeVersion)
+		if err != nil {
+			return false, err.Error()
+		}
+		if server.after(max) {
+			return false, fmt.Sprintf("cluster version %d.%d is above this rule's max-kube-version %q", server.major, server.minor, r.MaxKubeVersion)
+		}
+	}
+	return true, ""
+}
+
+// FilterRulesForKubeVersion returns the subset of rules whose MinKubeVersion/MaxKubeVersion constraints
+// are satisfied by serverVersion - the live cluster's discovered version - logging the reason for each
+// rule it drops. A rule with neither bound configured is never filtered out. Call this once at startup,
+// before any rule is registered with the apiserver or checked against RBAC, so a rule disabled for this
+// cluster's version never requests permissions or a webhook registration it will never use.
+func FilterRulesForKubeVersion(rules []Rule, serverVersion *version.Info) ([]Rule, error) {
+	mylog := log.ComponentLogger(componentName, "FilterRulesForKubeVersion")
+
+	server, err := serverKubeVersion(serverVersion)
+	if err != nil {
+		return nil, fmt.Errorf("could not resolve the cluster's kubernetes version: %v", err)
+	}
+
+	var enabled []Rule
+	for _, rule := range rules {
+		if rule.MinKubeVersion == "" && rule.MaxKubeVersion == "" {
+			enabled = append(enabled, rule)
+			continue
+		}
+		if ok, reason := rule.inKubeVersionRange(server); !ok {
+			mylog.Warn().Str("rule", rule.Registration.Name).Str("cluster-version", fmt.Sprintf("%d.%d", server.major, server.minor)).Msg("disabling rule: " + reason)
+			continue
+		}
+		enabled = append(enabled, rule)
+	}
+	return enabled, nil
+}
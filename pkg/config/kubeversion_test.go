@@ -0,0 +1,78 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"testing"
+
+	"github.com/HotelsDotCom/kube-graffiti/pkg/webhook"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/version"
+)
+
+func TestRuleConstrainedToMinKubeVersionIsDisabledOnAnOlderCluster(t *testing.T) {
+	rules := []Rule{{Registration: webhook.Registration{Name: "needs-1.25"}, MinKubeVersion: "1.25"}}
+
+	enabled, err := FilterRulesForKubeVersion(rules, &version.Info{Major: "1", Minor: "24"})
+	require.NoError(t, err)
+	assert.Empty(t, enabled, "a rule requiring 1.25 should be disabled on a 1.24 cluster")
+}
+
+func TestRuleConstrainedToMinKubeVersionIsEnabledOnThatVersion(t *testing.T) {
+	rules := []Rule{{Registration: webhook.Registration{Name: "needs-1.25"}, MinKubeVersion: "1.25"}}
+
+	enabled, err := FilterRulesForKubeVersion(rules, &version.Info{Major: "1", Minor: "25"})
+	require.NoError(t, err)
+	assert.Len(t, enabled, 1, "a rule requiring 1.25 should be enabled on a 1.25 cluster")
+}
+
+func TestRuleWithAMaxKubeVersionIsDisabledAboveThatVersion(t *testing.T) {
+	rules := []Rule{{Registration: webhook.Registration{Name: "old-bug-workaround"}, MaxKubeVersion: "1.24"}}
+
+	enabled, err := FilterRulesForKubeVersion(rules, &version.Info{Major: "1", Minor: "25"})
+	require.NoError(t, err)
+	assert.Empty(t, enabled, "a rule limited to <=1.24 should be disabled on a 1.25 cluster")
+}
+
+func TestRuleWithNeitherBoundIsNeverFiltered(t *testing.T) {
+	rules := []Rule{{Registration: webhook.Registration{Name: "unrestricted"}}}
+
+	enabled, err := FilterRulesForKubeVersion(rules, &version.Info{Major: "1", Minor: "10"})
+	require.NoError(t, err)
+	assert.Len(t, enabled, 1)
+}
+
+func TestFilterRulesForKubeVersionToleratesANonNumericMinorVersionSuffix(t *testing.T) {
+	rules := []Rule{{Registration: webhook.Registration{Name: "needs-1.25"}, MinKubeVersion: "1.25"}}
+
+	enabled, err := FilterRulesForKubeVersion(rules, &version.Info{Major: "1", Minor: "25+"})
+	require.NoError(t, err, "a minor version carrying a trailing qualifier, as reported by some managed clusters, should still parse")
+	assert.Len(t, enabled, 1)
+}
+
+func TestValidateKubeVersionBoundsRejectsAMalformedMinKubeVersion(t *testing.T) {
+	rule := Rule{Registration: webhook.Registration{Name: "bad-bound"}, MinKubeVersion: "not-a-version"}
+	assert.Error(t, validateKubeVersionBounds(rule))
+}
+
+func TestValidateKubeVersionBoundsRejectsAMalformedMaxKubeVersion(t *testing.T) {
+	rule := Rule{Registration: webhook.Registration{Name: "bad-bound"}, MaxKubeVersion: "v1.25"}
+	assert.Error(t, validateKubeVersionBounds(rule))
+}
+
+func TestValidateKubeVersionBoundsAllowsAnUnsetRule(t *testing.T) {
+	rule := Rule{Registration: webhook.Registration{Name: "unrestricted"}}
+	assert.NoError(t, validateKubeVersionBounds(rule))
+}
@@ -0,0 +1,106 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/HotelsDotCom/kube-graffiti/pkg/graffiti"
+	"github.com/HotelsDotCom/kube-graffiti/pkg/webhook"
+	utilvalidation "k8s.io/apimachinery/pkg/util/validation"
+)
+
+// migratedRuleName is the registration name given to the single rule produced by ConvertLegacyConfig.
+const migratedRuleName = "migrated-namespace-labeller"
+
+// LegacyConfig models the flag/config surface of kube-graffiti's predecessor, the
+// istio-namespace-webhook tool, which only ever labelled/annotated namespaces. ConvertLegacyConfig
+// turns one of these into an equivalent rules-based Configuration.
+type LegacyConfig struct {
+	Labels      map[string]string `mapstructure:"labels" yaml:"labels,omitempty"`
+	Annotations map[string]string `mapstructure:"annotations" yaml:"annotations,omitempty"`
+	Blacklist   []string          `mapstructure:"blacklist" yaml:"blacklist,omitempty"`
+	Namespace   string            `mapstructure:"namespace" yaml:"namespace"`
+	Service     string            `mapstructure:"service" yaml:"service"`
+	Port        int               `mapstructure:"port" yaml:"port"`
+	CACertPath  string            `mapstructure:"ca-cert-path" yaml:"ca-cert-path"`
+	CertPath    string            `mapstructure:"cert-path" yaml:"cert-path"`
+	KeyPath     string            `mapstructure:"key-path" yaml:"key-path"`
+}
+
+// ConvertLegacyConfig builds a rules-based Configuration equivalent to l: a single rule targets
+// namespaces, adding l.Labels/l.Annotations, and l.Blacklist is converted into a field-selector
+// that excludes each blacklisted namespace by name. The old tool's server settings map directly
+// onto Configuration.Server.
+func ConvertLegacyConfig(l LegacyConfig) (Configuration, error) {
+	fieldSelectors, err := blacklistToFieldSelectors(l.Blacklist)
+	if err != nil {
+		return Configuration{}, fmt.Errorf("could not convert blacklist: %v", err)
+	}
+
+	return Configuration{
+		LogLevel: "info",
+		Server: Server{
+			WebhookPort:    l.Port,
+			Namespace:      l.Namespace,
+			Service:        l.Service,
+			CACertPath:     l.CACertPath,
+			ServerCertPath: l.CertPath,
+			ServerKeyPath:  l.KeyPath,
+		},
+		Rules: []Rule{
+			{
+				Registration: webhook.Registration{
+					Name: migratedRuleName,
+					Targets: []webhook.Target{
+						{APIGroups: []string{""}, APIVersions: []string{"v1"}, Resources: []string{"namespaces"}},
+					},
+					FailurePolicy: "Ignore",
+				},
+				Matchers: graffiti.Matchers{
+					FieldSelectors: fieldSelectors,
+				},
+				Payload: graffiti.Payload{
+					Additions: graffiti.Additions{
+						Labels:      l.Labels,
+						Annotations: l.Annotations,
+					},
+				},
+			},
+		},
+	}, nil
+}
+
+// blacklistToFieldSelectors converts a list of blacklisted namespace names into a single
+// comma-separated field-selector of the form "metadata.name!=a,metadata.name!=b" that excludes
+// all of them. The old blacklist was a plain list of exact namespace names: it never supported
+// wildcards, so an entry containing one is rejected rather than silently mismatched.
+func blacklistToFieldSelectors(blacklist []string) ([]string, error) {
+	if len(blacklist) == 0 {
+		return nil, nil
+	}
+
+	var clauses []string
+	for _, name := range blacklist {
+		if strings.ContainsAny(name, "*?") {
+			return nil, fmt.Errorf("blacklist entry %q looks like a wildcard pattern, which the legacy blacklist never supported and this conversion cannot express as a field-selector - migrate it by hand using matchers.namespace-name-pattern", name)
+		}
+		if errs := utilvalidation.IsDNS1123Label(name); len(errs) > 0 {
+			return nil, fmt.Errorf("blacklist entry %q is not a valid namespace name: %s", name, strings.Join(errs, "; "))
+		}
+		clauses = append(clauses, fmt.Sprintf("metadata.name!=%s", name))
+	}
+	return []string{strings.Join(clauses, ",")}, nil
+}
@@ -0,0 +1,123 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	yaml "gopkg.in/yaml.v2"
+)
+
+var expectedMigratedConfig = `log-level: info
+server:
+  port: 443
+  company-domain: ""
+  namespace: graffiti
+  service: graffiti-service
+  ca-cert-path: /my-ca-path
+  cert-path: /my-cert-path
+  key-path: /my-key-path
+rules:
+- registration:
+    name: migrated-namespace-labeller
+    targets:
+    - api-groups:
+      - ""
+      api-versions:
+      - v1
+      resources:
+      - namespaces
+    failure-policy: Ignore
+  matchers:
+    field-selectors:
+    - metadata.name!=default,metadata.name!=kube-system
+  payload:
+    additions:
+      annotations:
+        owner: platform-team
+      labels:
+        team: platform
+`
+
+func TestConvertLegacyConfigMatchesGoldenYAML(t *testing.T) {
+	legacy := LegacyConfig{
+		Labels:      map[string]string{"team": "platform"},
+		Annotations: map[string]string{"owner": "platform-team"},
+		Blacklist:   []string{"default", "kube-system"},
+		Namespace:   "graffiti",
+		Service:     "graffiti-service",
+		Port:        443,
+		CACertPath:  "/my-ca-path",
+		CertPath:    "/my-cert-path",
+		KeyPath:     "/my-key-path",
+	}
+
+	converted, err := ConvertLegacyConfig(legacy)
+	require.NoError(t, err, "a legacy config with no blacklist wildcards should convert cleanly")
+	require.NoError(t, converted.ValidateConfig(), "the converted configuration should be valid")
+
+	out, err := yaml.Marshal(converted)
+	require.NoError(t, err)
+	assert.Equal(t, expectedMigratedConfig, string(out))
+}
+
+func TestConvertLegacyConfigWithoutBlacklistHasNoFieldSelectors(t *testing.T) {
+	legacy := LegacyConfig{
+		Labels:    map[string]string{"team": "platform"},
+		Namespace: "graffiti",
+		Service:   "graffiti-service",
+	}
+
+	converted, err := ConvertLegacyConfig(legacy)
+	require.NoError(t, err)
+	require.NoError(t, converted.ValidateConfig())
+	assert.Empty(t, converted.Rules[0].Matchers.FieldSelectors, "an empty blacklist should not produce any field selectors")
+}
+
+func TestConvertLegacyConfigRejectsWildcardBlacklistEntry(t *testing.T) {
+	legacy := LegacyConfig{
+		Namespace: "graffiti",
+		Service:   "graffiti-service",
+		Blacklist: []string{"kube-*"},
+	}
+
+	_, err := ConvertLegacyConfig(legacy)
+	assert.Error(t, err, "the legacy blacklist never supported wildcards so this conversion cannot honour one")
+}
+
+func TestConvertLegacyConfigRejectsInvalidBlacklistNamespaceName(t *testing.T) {
+	legacy := LegacyConfig{
+		Namespace: "graffiti",
+		Service:   "graffiti-service",
+		Blacklist: []string{"Not_A_Valid_Namespace"},
+	}
+
+	_, err := ConvertLegacyConfig(legacy)
+	assert.Error(t, err, "a blacklist entry that isn't a valid namespace name should be rejected")
+}
+
+func TestBlacklistToFieldSelectorsCombinesMultipleEntriesWithAND(t *testing.T) {
+	selectors, err := blacklistToFieldSelectors([]string{"default", "kube-system", "kube-public"})
+	require.NoError(t, err)
+	require.Len(t, selectors, 1)
+	assert.Equal(t, "metadata.name!=default,metadata.name!=kube-system,metadata.name!=kube-public", selectors[0])
+}
+
+func TestBlacklistToFieldSelectorsEmptyBlacklist(t *testing.T) {
+	selectors, err := blacklistToFieldSelectors(nil)
+	assert.NoError(t, err)
+	assert.Nil(t, selectors)
+}
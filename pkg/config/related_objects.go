@@ -0,0 +1,53 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import "fmt"
+
+// RelatedObjects, when set, restricts the existing sweep (see pkg/existing) to primary objects that
+// have at least one secondary object of a different resource type, in the same namespace, sharing
+// Label's value with them - e.g. only Services that have a same-namespace Pod carrying the same "app"
+// label, for relationship-based targeting that a namespace/label selector on the primary resource
+// alone can't express. It is only consulted by the existing sweep; live admission requests are
+// unaffected by it, since checking a relationship would mean an extra List call per admission request.
+type RelatedObjects struct {
+	// APIGroup, APIVersion and Resource identify the secondary resource to query, e.g. "", "v1", "pods".
+	APIGroup   string `mapstructure:"api-group" yaml:"api-group,omitempty"`
+	APIVersion string `mapstructure:"api-version" yaml:"api-version"`
+	Resource   string `mapstructure:"resource" yaml:"resource"`
+	// Label is the label key whose value must match between the primary object and at least one
+	// secondary object for the primary to be considered related.
+	Label string `mapstructure:"label" yaml:"label"`
+}
+
+// Configured reports whether r was set at all; the zero value disables related-objects filtering.
+func (r RelatedObjects) Configured() bool {
+	return r.Resource != ""
+}
+
+// validate checks that a configured RelatedObjects names both the secondary resource and the shared
+// label in full - a partially filled-in RelatedObjects almost always indicates a typo in the rule's
+// configuration, rather than an intentionally narrower relationship.
+func (r RelatedObjects) validate(ruleName string) error {
+	if !r.Configured() {
+		return nil
+	}
+	if r.APIVersion == "" {
+		return fmt.Errorf("rule %s is invalid - related-objects must specify an api-version", ruleName)
+	}
+	if r.Label == "" {
+		return fmt.Errorf("rule %s is invalid - related-objects must specify a label", ruleName)
+	}
+	return nil
+}
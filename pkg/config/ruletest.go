@@ -0,0 +1,129 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/HotelsDotCom/kube-graffiti/pkg/graffiti"
+)
+
+// RuleTest is a single self-check a rule's author can embed in its configuration: Input is run
+// through the rule's own Mutate, and the result is compared against ExpectMatch and, if set,
+// ExpectPatch. It has no effect on admission or the existing-objects sweep - only the validate
+// subcommand's RunTests executes these, so a rule can carry its own regression tests alongside the
+// configuration that defines it.
+type RuleTest struct {
+	// Name identifies this test case in the validate subcommand's output.
+	Name string `mapstructure:"name" yaml:"name,omitempty"`
+	// Input is the object to run the rule against, decoded the same loose way any other nested
+	// configuration value is.
+	Input map[string]interface{} `mapstructure:"input" yaml:"input"`
+	// ExpectMatch is what the rule's matchers should decide for Input.
+	ExpectMatch bool `mapstructure:"expect-match" yaml:"expect-match,omitempty"`
+	// ExpectPatch, if set, is the literal JSON patch kube-graffiti should produce for Input, e.g.
+	// `[{"op":"add","path":"/metadata/labels","value":{"team":"payments"}}]`. Left blank, only
+	// ExpectMatch is checked.
+	ExpectPatch string `mapstructure:"expect-patch" yaml:"expect-patch,omitempty"`
+}
+
+// RuleTestResult is the outcome of running one RuleTest against its rule.
+type RuleTestResult struct {
+	Rule    string
+	Test    string
+	Passed  bool
+	Message string
+}
+
+// RunTests runs every rule's embedded Tests against that rule's own Mutate, returning one
+// RuleTestResult per test case in rule/test order. A test case that errors out of Mutate is reported
+// as a failing result rather than aborting the run, so one broken rule doesn't stop every other
+// rule's tests from being reported.
+func (c Configuration) RunTests(ctx context.Context) []RuleTestResult {
+	var results []RuleTestResult
+	for _, rule := range c.Rules {
+		if len(rule.Tests) == 0 {
+			continue
+		}
+		gr := graffiti.Rule{
+			Name:       rule.Registration.Name,
+			Matchers:   rule.Matchers,
+			Payload:    rule.Payload,
+			EvaluateOn: rule.EvaluateOn,
+			Budget:     rule.Budget,
+		}
+		for _, test := range rule.Tests {
+			results = append(results, runRuleTest(ctx, gr, test))
+		}
+	}
+	return results
+}
+
+// runRuleTest runs a single test case against gr and reports whether it passed.
+func runRuleTest(ctx context.Context, gr graffiti.Rule, test RuleTest) RuleTestResult {
+	result := RuleTestResult{Rule: gr.Name, Test: test.Name}
+
+	input, err := json.Marshal(normalizeYAMLValue(test.Input))
+	if err != nil {
+		result.Message = fmt.Sprintf("failed to marshal test input: %v", err)
+		return result
+	}
+
+	patch, matched, err := gr.MutateExisting(ctx, input)
+	if err != nil {
+		result.Message = fmt.Sprintf("mutate returned an error: %v", err)
+		return result
+	}
+	if matched != test.ExpectMatch {
+		result.Message = fmt.Sprintf("expected match=%t, got match=%t", test.ExpectMatch, matched)
+		return result
+	}
+	if test.ExpectPatch != "" && string(patch) != test.ExpectPatch {
+		result.Message = fmt.Sprintf("expected patch %s, got %s", test.ExpectPatch, string(patch))
+		return result
+	}
+
+	result.Passed = true
+	return result
+}
+
+// normalizeYAMLValue recursively rewrites any map[interface{}]interface{} in v into
+// map[string]interface{} - the shape YAML unmarshalling (via viper/mapstructure) produces for a nested
+// map but that encoding/json refuses to marshal - leaving every other value untouched.
+func normalizeYAMLValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		normalized := make(map[string]interface{}, len(v))
+		for k, val := range v {
+			normalized[k] = normalizeYAMLValue(val)
+		}
+		return normalized
+	case map[interface{}]interface{}:
+		normalized := make(map[string]interface{}, len(v))
+		for k, val := range v {
+			normalized[fmt.Sprintf("%v", k)] = normalizeYAMLValue(val)
+		}
+		return normalized
+	case []interface{}:
+		normalized := make([]interface{}, len(v))
+		for i, val := range v {
+			normalized[i] = normalizeYAMLValue(val)
+		}
+		return normalized
+	default:
+		return v
+	}
+}
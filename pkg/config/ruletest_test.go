@@ -0,0 +1,73 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"context"
+	"testing"
+
+	"github.com/HotelsDotCom/kube-graffiti/pkg/graffiti"
+	"github.com/HotelsDotCom/kube-graffiti/pkg/webhook"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func paintDeploymentsRule() Rule {
+	return Rule{
+		Registration: webhook.Registration{Name: "paint-deployments"},
+		Matchers:     graffiti.Matchers{MatchAll: true},
+		Payload:      graffiti.Payload{Additions: graffiti.Additions{Labels: map[string]string{"painted": "true"}}},
+		Tests: []RuleTest{
+			{
+				Name:        "a-passing-case",
+				ExpectMatch: true,
+				ExpectPatch: `[ { "op": "add", "path": "/metadata/labels", "value": { "painted": "true" }} ]`,
+				Input: map[string]interface{}{
+					"kind":       "Deployment",
+					"apiVersion": "apps/v1",
+					"metadata":   map[string]interface{}{"name": "my-deployment"},
+				},
+			},
+			{
+				Name:        "a-failing-case",
+				ExpectMatch: false,
+				Input: map[string]interface{}{
+					"kind":       "Deployment",
+					"apiVersion": "apps/v1",
+					"metadata":   map[string]interface{}{"name": "another-deployment"},
+				},
+			},
+		},
+	}
+}
+
+func TestRunTestsReportsAPassingAndAFailingCaseCorrectly(t *testing.T) {
+	config := Configuration{Rules: []Rule{paintDeploymentsRule()}}
+
+	results := config.RunTests(context.Background())
+	require.Len(t, results, 2)
+
+	assert.Equal(t, RuleTestResult{Rule: "paint-deployments", Test: "a-passing-case", Passed: true}, results[0])
+
+	assert.False(t, results[1].Passed)
+	assert.Contains(t, results[1].Message, "expected match=false, got match=true")
+}
+
+func TestRunTestsSkipsRulesWithNoEmbeddedTests(t *testing.T) {
+	rule := paintDeploymentsRule()
+	rule.Tests = nil
+	config := Configuration{Rules: []Rule{rule}}
+
+	assert.Empty(t, config.RunTests(context.Background()))
+}
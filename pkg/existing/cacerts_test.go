@@ -0,0 +1,112 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package existing
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/rest"
+)
+
+// writeTestCACert writes a freshly generated self-signed CA certificate, PEM-encoded, to a file named
+// name under dir, and returns its path and PEM bytes.
+func writeTestCACert(t *testing.T, dir, name, commonName string) (path string, pemBytes []byte) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Unix(0, 0),
+		NotAfter:              time.Unix(0, 0).Add(100 * 365 * 24 * time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	pemBytes = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	path = filepath.Join(dir, name)
+	require.NoError(t, ioutil.WriteFile(path, pemBytes, 0644))
+	return path, pemBytes
+}
+
+func TestAppendExtraCACertsIsANoOpWhenNoneAreConfigured(t *testing.T) {
+	ExtraCACertPaths = nil
+	cfg := &rest.Config{}
+	require.NoError(t, AppendExtraCACerts(cfg))
+	assert.Nil(t, cfg.TLSClientConfig.CAData)
+}
+
+func TestAppendExtraCACertsAddsTheExtraCAToTheRestConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "extra-ca-cert-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path, extraPEM := writeTestCACert(t, dir, "extra-ca.pem", "corporate-proxy-ca")
+	ExtraCACertPaths = []string{path}
+	defer func() { ExtraCACertPaths = nil }()
+
+	cfg := &rest.Config{}
+	require.NoError(t, AppendExtraCACerts(cfg))
+	assert.Contains(t, string(cfg.TLSClientConfig.CAData), string(extraPEM), "the rest config's TLS client config should include the extra CA")
+}
+
+func TestAppendExtraCACertsKeepsTheClustersOwnCAFromCAFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "extra-ca-cert-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	clusterCAPath, clusterPEM := writeTestCACert(t, dir, "cluster-ca.pem", "cluster-ca")
+	_, extraPEM := writeTestCACert(t, dir, "extra-ca.pem", "corporate-proxy-ca")
+	extraPath := filepath.Join(dir, "extra-ca.pem")
+	ExtraCACertPaths = []string{extraPath}
+	defer func() { ExtraCACertPaths = nil }()
+
+	cfg := &rest.Config{}
+	cfg.TLSClientConfig.CAFile = clusterCAPath
+	require.NoError(t, AppendExtraCACerts(cfg))
+	assert.Contains(t, string(cfg.TLSClientConfig.CAData), string(clusterPEM), "the cluster's own CA should still be trusted")
+	assert.Contains(t, string(cfg.TLSClientConfig.CAData), string(extraPEM), "the extra CA should be trusted alongside it")
+	assert.Empty(t, cfg.TLSClientConfig.CAFile, "CAFile should be folded into CAData rather than left set, to avoid client-go ignoring CAData")
+}
+
+func TestAppendExtraCACertsRejectsAPathThatIsNotAValidPEMCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "extra-ca-cert-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "not-a-cert.pem")
+	require.NoError(t, ioutil.WriteFile(path, []byte("not a certificate"), 0644))
+	ExtraCACertPaths = []string{path}
+	defer func() { ExtraCACertPaths = nil }()
+
+	cfg := &rest.Config{}
+	err = AppendExtraCACerts(cfg)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "does not contain a valid PEM certificate")
+}
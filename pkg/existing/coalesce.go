@@ -0,0 +1,307 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package existing
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+
+	"github.com/HotelsDotCom/kube-graffiti/pkg/config"
+	"github.com/HotelsDotCom/kube-graffiti/pkg/graffiti"
+	"github.com/HotelsDotCom/kube-graffiti/pkg/log"
+	"github.com/HotelsDotCom/kube-graffiti/pkg/webhook"
+	"github.com/rs/zerolog"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// ConflictResolution mirrors config.Configuration.ConflictResolution for the coalesced sweep - see
+// its doc comment for what each value means. "first-wins", the default, needs no extra handling here:
+// mergePatches already resolves conflicts by declaration order. "priority" additionally reorders a
+// single object's matching rules by config.Rule.Priority before merging, so the highest-priority
+// matching rule wins instead. "error-at-validation" has nothing left to do at this point - a
+// configuration that would conflict here is refused by config.Configuration.ValidateConfig before the
+// sweep ever starts.
+var ConflictResolution = "first-wins"
+
+// CoalescePatches, when true, makes ApplyRulesAgainstExistingObjects evaluate every rule that
+// targets a resource against each of its objects before patching it, merging any matching rules'
+// additions/deletions into a single JSON patch and issuing one apiserver Patch call per object
+// instead of one per matching rule. This avoids the repeated Patch calls - and the resulting
+// resourceVersion churn - that several rules matching the same object would otherwise cause. It is
+// off by default, since it changes the sweep's traversal from one List pass per rule to one List
+// pass per resource type across every rule that targets it.
+var CoalescePatches = false
+
+// resourceKey identifies a single apiserver resource type - a group/version and a resource name -
+// that a coalesced sweep lists once on behalf of every rule targeting it.
+type resourceKey struct {
+	gv       string
+	resource string
+}
+
+// applyRulesCoalesced groups rules by the resource types their targets resolve to against current
+// discovery and, for each resource type, lists its objects once and evaluates every rule that
+// targets it against each object via applyCoalescedRulesToObject. Rules are grouped and evaluated in
+// the order they appear in rules, which is also the priority order a merged patch's conflicts are
+// resolved by - see mergePatches.
+func applyRulesCoalesced(rules []config.Rule, stop <-chan struct{}) {
+	mylog := log.ComponentLogger(componentName, "applyRulesCoalesced")
+
+	grouped := make(map[resourceKey][]*config.Rule)
+	var order []resourceKey
+	for i := range rules {
+		rule := &rules[i]
+		for _, target := range rule.Registration.Targets {
+			for _, key := range matchingResourceKeys(target) {
+				if _, ok := grouped[key]; !ok {
+					order = append(order, key)
+				}
+				grouped[key] = append(grouped[key], rule)
+			}
+		}
+	}
+
+	for _, key := range order {
+		listAndApplyCoalescedRules(key, grouped[key], stop, mylog)
+	}
+}
+
+// matchingResourceKeys returns every discovered resource type that target's api-groups/api-versions/
+// resources match, mirroring the same group/version/resource matching
+// applyToTargetttedAPIGroupsAndVersions and applyToAllResourcesInAGroupVersion use for an individual
+// rule's sweep.
+func matchingResourceKeys(target webhook.Target) []resourceKey {
+	var keys []resourceKey
+	for _, g := range discoveredAPIGroups {
+		if !isTargetted(g.Name, target.APIGroups) {
+			continue
+		}
+		gv := g.PreferredVersion
+		if !isTargetted(gv.Version, target.APIVersions) {
+			continue
+		}
+		for _, resource := range matchingResourceNames(target, gv.GroupVersion) {
+			keys = append(keys, resourceKey{gv: gv.GroupVersion, resource: resource})
+		}
+	}
+	return keys
+}
+
+// matchingResourceNames returns the names of the discovered resources in group-version gv that
+// target's Resources entries match, handling the "*"/"*/*" wildcards exactly as
+// applyToAllResourcesInAGroupVersion does.
+func matchingResourceNames(target webhook.Target, gv string) []string {
+	var names []string
+	if len(target.Resources) == 1 && (target.Resources[0] == "*" || target.Resources[0] == "*/*") {
+		includeSubresources := target.Resources[0] == "*/*"
+		for _, r := range discoveredResources[gv] {
+			if _, sub := splitSlashedResourceString(r.Name); sub != "" && !includeSubresources {
+				continue
+			}
+			names = append(names, r.Name)
+		}
+		return names
+	}
+
+	var resourceTargets []string
+	for _, r := range target.Resources {
+		x, _ := splitSlashedResourceString(r)
+		if x == "*" {
+			continue
+		}
+		resourceTargets = append(resourceTargets, x)
+	}
+	for _, r := range discoveredResources[gv] {
+		if isTargetted(r.Name, resourceTargets) {
+			names = append(names, r.Name)
+		}
+	}
+	return names
+}
+
+// listAndApplyCoalescedRules lists every object of key's resource type, in pages, applying rules to
+// each via applyCoalescedRulesToObject. Unlike applyToAllResourcesOfType, a single resource type
+// here may be targeted by rules with different failure-policies, so a page that exhausts its retries
+// is always just logged and the sweep for this resource type abandoned, the same as failure-policy
+// "Allow" would do - a coalesced sweep never fails the whole run.
+func listAndApplyCoalescedRules(key resourceKey, rules []*config.Rule, stop <-chan struct{}, mylog zerolog.Logger) {
+	rlog := mylog.With().Str("group-version", key.gv).Str("resource", key.resource).Logger()
+	rlog.Debug().Msg("listing resources for coalesced rule evaluation")
+
+	g, v := splitGroupVersionString(key.gv)
+	ri := dynamicClient.Resource(schema.GroupVersionResource{Group: g, Version: v, Resource: key.resource})
+
+	limit := int64(itemLimit)
+	cont := ""
+	for {
+		list, newLimit, err := listPageWithRetry(ri, limit, cont, stop, rlog)
+		limit = newLimit
+		if err != nil {
+			rlog.Error().Err(err).Msg("exhausted retries listing resources, remaining pages were not processed")
+			return
+		}
+		if list == nil {
+			rlog.Debug().Msg("no resources found")
+			return
+		}
+		rlog.Debug().Int("number-resources", len(list.Items)).Msg("processing batch of resources")
+		for _, item := range list.Items {
+			applyCoalescedRulesToObject(rules, key.gv, key.resource, item)
+		}
+
+		meta := list.Object["metadata"].(map[string]interface{})
+		next, ok := meta["continue"]
+		if !ok || next.(string) == "" {
+			return
+		}
+		cont = next.(string)
+	}
+}
+
+// applyCoalescedRulesToObject evaluates every rule in rules - already in priority order, highest
+// first - against a single object. Rules whose payload can't be merged structurally (see
+// Payload.CanCoalesce) are patched individually, exactly as applyToObject would patch them; every
+// other matching rule's patch is instead merged with mergePatches and applied as a single Patch
+// call, with conflicts between rules resolved in favour of the higher-priority (earlier-declared)
+// rule.
+func applyCoalescedRulesToObject(rules []*config.Rule, gv, resource string, object unstructured.Unstructured) {
+	mylog := log.ComponentLogger(componentName, "applyCoalescedRulesToObject")
+	kind := object.GetKind()
+	name := object.GetName()
+	namespace := object.GetNamespace()
+
+	raw, err := json.Marshal(object.Object)
+	if err != nil {
+		mylog.Error().Err(err).Str("kind", kind).Str("name", name).Str("namespace", namespace).Msg("could not marshal object")
+		return
+	}
+	mylog.Debug().Str("object", string(log.RedactObject(raw))).Str("kind", kind).Str("name", name).Str("namespace", namespace).Msg("evaluating existing object against coalesced rules")
+
+	var mergeableRules []*config.Rule
+	var mergeablePatches [][]byte
+	for _, rule := range rules {
+		rlog := mylog.With().Str("rule", rule.Registration.Name).Str("group-version", gv).Str("kind", kind).Str("name", name).Str("namespace", namespace).Logger()
+		currentReport.recordExamined(rule.Registration.Name, namespace, kind)
+
+		if !ruleAppliesToObject(rule, object, rlog) {
+			continue
+		}
+
+		gr := graffiti.Rule{Name: rule.Registration.Name, Matchers: rule.Matchers, Payload: rule.Payload, EvaluateOn: rule.EvaluateOn, Budget: rule.Budget}
+		patch, err := gr.Mutate(context.Background(), raw)
+		if err != nil {
+			rlog.Error().Err(err).Msg("could not mutate object")
+			currentReport.recordErrored(rule.Registration.Name, namespace, kind, name, err.Error())
+			continue
+		}
+		if patch == nil {
+			rlog.Debug().Msg("mutate did not create a patch")
+			continue
+		}
+		currentReport.recordMatched(rule.Registration.Name, namespace, kind)
+
+		if DryRun {
+			diff, err := computeObjectDiff(rule.Registration.Name, namespace, kind, name, object, patch)
+			if err != nil {
+				rlog.Error().Err(err).Msg("dry-run: could not compute planned diff for object")
+				currentReport.recordErrored(rule.Registration.Name, namespace, kind, name, err.Error())
+				continue
+			}
+			currentDryRunReport.record(diff)
+			continue
+		}
+
+		if !rule.Payload.CanCoalesce() {
+			rlog.Debug().Msg("rule's payload can't be merged into a combined patch, patching it on its own")
+			if err := patchObject(gv, resource, kind, name, namespace, patch, []string{rule.Registration.Name}, rlog); err != nil {
+				queueForRetry(err, gv, resource, kind, name, namespace, patch, []string{rule.Registration.Name}, rlog)
+			}
+			continue
+		}
+
+		mergeableRules = append(mergeableRules, rule)
+		mergeablePatches = append(mergeablePatches, patch)
+	}
+
+	if len(mergeablePatches) == 0 {
+		return
+	}
+
+	if ConflictResolution == "priority" && len(mergeableRules) > 1 {
+		sortRulesAndPatchesByPriority(mergeableRules, mergeablePatches)
+	}
+
+	ruleNames := make([]string, len(mergeableRules))
+	for i, rule := range mergeableRules {
+		ruleNames[i] = rule.Registration.Name
+	}
+	rlog := mylog.With().Strs("rules", ruleNames).Str("group-version", gv).Str("kind", kind).Str("name", name).Str("namespace", namespace).Logger()
+
+	if len(mergeablePatches) == 1 {
+		if err := patchObject(gv, resource, kind, name, namespace, mergeablePatches[0], ruleNames, rlog); err != nil {
+			queueForRetry(err, gv, resource, kind, name, namespace, mergeablePatches[0], ruleNames, rlog)
+		}
+		return
+	}
+
+	merged, err := mergePatches(mergeablePatches)
+	if err != nil {
+		rlog.Error().Err(err).Msg("could not merge patches from multiple matching rules")
+		for _, ruleName := range ruleNames {
+			currentReport.recordErrored(ruleName, namespace, kind, name, err.Error())
+		}
+		return
+	}
+
+	rlog.Info().Str("patch", string(merged)).Msg("merged patches from multiple matching rules into a single patch")
+	if err := patchObject(gv, resource, kind, name, namespace, merged, ruleNames, rlog); err != nil {
+		queueForRetry(err, gv, resource, kind, name, namespace, merged, ruleNames, rlog)
+	}
+}
+
+// sortRulesAndPatchesByPriority reorders rules and their corresponding patches, in lockstep, into
+// descending config.Rule.Priority order, with a tie broken by each rule's existing relative position
+// (its declaration order). mergePatches already treats its input as highest-priority-first, so calling
+// this first is what makes ConflictResolution "priority" actually take effect.
+func sortRulesAndPatchesByPriority(rules []*config.Rule, patches [][]byte) {
+	order := make([]int, len(rules))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return rules[order[i]].Priority > rules[order[j]].Priority
+	})
+
+	sortedRules := make([]*config.Rule, len(rules))
+	sortedPatches := make([][]byte, len(patches))
+	for i, idx := range order {
+		sortedRules[i] = rules[idx]
+		sortedPatches[i] = patches[idx]
+	}
+	copy(rules, sortedRules)
+	copy(patches, sortedPatches)
+}
+
+// mergePatches combines patches - in priority order, highest priority (the earliest-declared
+// matching rule) first - into a single patch, the same first-declared-rule-wins precedence
+// ApplyRules already gives admission rules. It delegates to webhook.CombineJSONPatches, which the
+// admission path uses for the identical problem of several rules sharing one object: blindly
+// concatenating operations and relying on the apiserver applying them in order would silently let a
+// later rule's whole-map label/annotation patch overwrite an earlier rule's, rather than merging the
+// two rules' keys together.
+func mergePatches(patches [][]byte) ([]byte, error) {
+	return webhook.CombineJSONPatches(patches)
+}
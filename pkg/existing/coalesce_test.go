@@ -0,0 +1,160 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package existing
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/HotelsDotCom/kube-graffiti/pkg/config"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	yaml "gopkg.in/yaml.v2"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// TestCoalescePatchesMergesTwoMatchingRulesIntoOnePatch checks that, with CoalescePatches enabled, two
+// rules that both target namespaces and both match the same namespace result in exactly one Patch call
+// against the apiserver, rather than the one-patch-per-rule behaviour ApplyRuleAgainstExistingObjects
+// normally gives - and that the single merged patch carries both rules' label additions, rather than
+// one silently overwriting the other once applied.
+func TestCoalescePatchesMergesTwoMatchingRulesIntoOnePatch(t *testing.T) {
+	var rulesYaml = `---
+- registration:
+    name: add-added-label
+    targets:
+    - api-groups:
+      - ""
+      api-versions:
+      - "*"
+      resources:
+      - namespaces
+    failure-policy: Ignore
+  matchers:
+    label-selectors:
+    - "fruit=apple"
+  payload:
+    additions:
+      labels:
+        added: 'by-graffiti'
+- registration:
+    name: add-painted-label
+    targets:
+    - api-groups:
+      - ""
+      api-versions:
+      - "*"
+      resources:
+      - namespaces
+    failure-policy: Ignore
+  matchers:
+    label-selectors:
+    - "fruit=apple"
+  payload:
+    additions:
+      labels:
+        painted: 'true'
+`
+	var rules []config.Rule
+	err := yaml.Unmarshal([]byte(rulesYaml), &rules)
+	require.NoError(t, err, "yaml unmarshalling of rules should not fail")
+
+	discoveryClient = defaultTestDiscoveryClient(t)
+	err = discoverAPIsAndResources()
+	require.NoError(t, err, "we should not get an error loading in canned resource groups and resources")
+
+	nsCache = defaultTestNamespaceCache(t)
+
+	ulns := new(unstructured.UnstructuredList)
+	err = json.Unmarshal([]byte(unstructuredNamespaceListJSON), ulns)
+	require.NoError(t, err, "we should be able to unmarshal our canned namespace list into an UnstructuedList")
+
+	nri := mockDynamicNamespaceableResourceInterface{}
+	patchCarriesBothRulesLabels := mock.MatchedBy(func(patch []byte) bool {
+		var ops []map[string]interface{}
+		if err := json.Unmarshal(patch, &ops); err != nil || len(ops) != 1 {
+			return false
+		}
+		labels, ok := ops[0]["value"].(map[string]interface{})
+		return ok && labels["added"] == "by-graffiti" && labels["painted"] == "true"
+	})
+	nri.mockDynamicResourceInterface.On("List", mock.AnythingOfType("v1.ListOptions")).Return(ulns, nil)
+	nri.mockDynamicResourceInterface.On("Patch", "test-namespace", types.JSONPatchType, patchCarriesBothRulesLabels, mock.AnythingOfType("[]string")).Return(nil, nil)
+	dc := mockDynamicInterface{}
+	dc.On("Resource", schema.GroupVersionResource{Group: "", Version: "v1", Resource: "namespaces"}).Return(&nri)
+	dynamicClient = &dc
+
+	oldCoalesce := CoalescePatches
+	CoalescePatches = true
+	defer func() { CoalescePatches = oldCoalesce }()
+
+	ApplyRulesAgainstExistingObjects(rules)
+
+	nri.mockDynamicResourceInterface.AssertNumberOfCalls(t, "Patch", 1)
+	dc.AssertExpectations(t)
+}
+
+// TestMergePatchesGivesTheHigherPriorityRuleThePrecedenceOnConflict checks that, when two rules'
+// whole-map label additions - the shape createPatchOperand actually produces - share a key with
+// different values, the earlier-declared (higher-priority) rule's value wins, while a key only one of
+// them sets still survives into the merged patch rather than being dropped along with its rule's
+// whole map.
+func TestMergePatchesGivesTheHigherPriorityRuleThePrecedenceOnConflict(t *testing.T) {
+	highPriority := []byte(`[{"op":"add","path":"/metadata/labels","value":{"painted":"high-priority","added":"by-graffiti"}}]`)
+	lowPriority := []byte(`[{"op":"add","path":"/metadata/labels","value":{"painted":"low-priority"}}]`)
+
+	merged, err := mergePatches([][]byte{highPriority, lowPriority})
+	require.NoError(t, err)
+
+	var ops []map[string]interface{}
+	require.NoError(t, json.Unmarshal(merged, &ops))
+	require.Len(t, ops, 1, "both rules' patches target the same path, so they should merge into a single operation")
+	labels, ok := ops[0]["value"].(map[string]interface{})
+	require.True(t, ok)
+	require.Equal(t, "high-priority", labels["painted"], "the higher-priority rule's value should win the conflicting key")
+	require.Equal(t, "by-graffiti", labels["added"], "the higher-priority rule's non-conflicting key should still be present")
+}
+
+// TestSortRulesAndPatchesByPriorityReordersByDescendingPriority checks that, with ConflictResolution
+// "priority", the rule with the highest config.Rule.Priority is moved to the front - which, per
+// TestMergePatchesGivesTheHigherPriorityRuleThePrecedenceOnConflict, is what makes it win a conflicting
+// addition once the reordered patches are merged.
+func TestSortRulesAndPatchesByPriorityReordersByDescendingPriority(t *testing.T) {
+	declaredFirst := &config.Rule{Priority: 0}
+	declaredSecond := &config.Rule{Priority: 10}
+	rules := []*config.Rule{declaredFirst, declaredSecond}
+	patches := [][]byte{[]byte(`"declared-first"`), []byte(`"declared-second"`)}
+
+	sortRulesAndPatchesByPriority(rules, patches)
+
+	require.Equal(t, []*config.Rule{declaredSecond, declaredFirst}, rules, "the higher-priority rule should be moved to the front")
+	require.Equal(t, [][]byte{[]byte(`"declared-second"`), []byte(`"declared-first"`)}, patches, "a rule's patch has to move with it")
+}
+
+// TestSortRulesAndPatchesByPriorityBreaksTiesByDeclarationOrder checks that two rules with equal
+// priority - including the common case of both being unset, defaulting to 0 - keep their original,
+// declared order rather than being shuffled.
+func TestSortRulesAndPatchesByPriorityBreaksTiesByDeclarationOrder(t *testing.T) {
+	declaredFirst := &config.Rule{Priority: 5}
+	declaredSecond := &config.Rule{Priority: 5}
+	rules := []*config.Rule{declaredFirst, declaredSecond}
+	patches := [][]byte{[]byte(`"declared-first"`), []byte(`"declared-second"`)}
+
+	sortRulesAndPatchesByPriority(rules, patches)
+
+	require.Equal(t, []*config.Rule{declaredFirst, declaredSecond}, rules, "equal-priority rules should keep their declared order")
+	require.Equal(t, [][]byte{[]byte(`"declared-first"`), []byte(`"declared-second"`)}, patches)
+}
@@ -0,0 +1,228 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package existing
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/HotelsDotCom/kube-graffiti/pkg/config"
+	"github.com/HotelsDotCom/kube-graffiti/pkg/httpresponse"
+	"github.com/HotelsDotCom/kube-graffiti/pkg/log"
+	"github.com/HotelsDotCom/kube-graffiti/pkg/webhook"
+)
+
+// CoverageResource names one discovered group/version/resource and, for the covered sections of a
+// CoverageReport, the names of every rule whose targets reach it. Rules is always sorted and
+// deduplicated, so the report is deterministic regardless of rule or target ordering.
+type CoverageResource struct {
+	GroupVersion string   `json:"group-version"`
+	Resource     string   `json:"resource"`
+	Rules        []string `json:"rules,omitempty"`
+}
+
+// CoverageReport splits every discovered group/version/resource into three sections, by how many
+// configured rules would apply a graffiti rule to it: Uncovered resources are reachable by no rule
+// at all and are probably an oversight; SinglyCovered resources are reached by exactly one rule, the
+// expected case; MultiplyCovered resources are reached by more than one rule, which is sometimes
+// intentional (e.g. two independent labelling rules) but worth a human glancing at. All three slices
+// are sorted by group-version then resource name.
+type CoverageReport struct {
+	Uncovered       []CoverageResource `json:"uncovered"`
+	SinglyCovered   []CoverageResource `json:"singly-covered"`
+	MultiplyCovered []CoverageResource `json:"multiply-covered"`
+}
+
+// AnalyzeCoverage joins every rule's targets against the discovered api groups/resources, producing
+// a CoverageReport. Coverage is about resource *types*, not individual objects, so a rule's
+// namespace-scoping (Matchers.Namespaces/NamespaceNamePattern) plays no part in it: a rule that only
+// ever matches objects in some namespaces still makes the resource type it targets "covered", since
+// the existing-objects sweep would still list and evaluate it.
+func AnalyzeCoverage(rules []config.Rule) CoverageReport {
+	rulesByResource := make(map[string][]string)
+	for _, rule := range rules {
+		for _, target := range rule.Registration.Targets {
+			for _, key := range targettedResourceKeys(target) {
+				rulesByResource[key] = appendRuleName(rulesByResource[key], rule.Registration.Name)
+			}
+		}
+	}
+
+	var keys []string
+	for gv, resources := range discoveredResources {
+		for _, r := range resources {
+			keys = append(keys, coverageKey(gv, r.Name))
+		}
+	}
+	sort.Strings(keys)
+
+	var report CoverageReport
+	for _, key := range keys {
+		gv, resource := splitCoverageKey(key)
+		cr := CoverageResource{GroupVersion: gv, Resource: resource, Rules: rulesByResource[key]}
+		switch len(cr.Rules) {
+		case 0:
+			report.Uncovered = append(report.Uncovered, cr)
+		case 1:
+			report.SinglyCovered = append(report.SinglyCovered, cr)
+		default:
+			report.MultiplyCovered = append(report.MultiplyCovered, cr)
+		}
+	}
+	return report
+}
+
+// targettedResourceKeys expands a single target against discoveredAPIGroups/discoveredResources into
+// the coverage keys it reaches, following exactly the same matching rules as
+// applyToTargetttedAPIGroupsAndVersions/applyToAllResourcesInAGroupVersion - including only a group's
+// preferred version, and excluding subresources from a bare "*" resources wildcard - but collecting
+// the result instead of acting on it.
+func targettedResourceKeys(target webhook.Target) []string {
+	var keys []string
+	for _, g := range discoveredAPIGroups {
+		if !isTargetted(g.Name, target.APIGroups) {
+			continue
+		}
+		if !isTargetted(g.PreferredVersion.Version, target.APIVersions) {
+			continue
+		}
+		gv := g.PreferredVersion.GroupVersion
+
+		if len(target.Resources) == 1 && (target.Resources[0] == "*" || target.Resources[0] == "*/*") {
+			includeSubresources := target.Resources[0] == "*/*"
+			for _, r := range discoveredResources[gv] {
+				if _, sub := splitSlashedResourceString(r.Name); sub != "" && !includeSubresources {
+					continue
+				}
+				keys = append(keys, coverageKey(gv, r.Name))
+			}
+			continue
+		}
+
+		var resourceTargets []string
+		for _, r := range target.Resources {
+			x, _ := splitSlashedResourceString(r)
+			if x == "*" {
+				continue
+			}
+			resourceTargets = append(resourceTargets, x)
+		}
+		for _, r := range discoveredResources[gv] {
+			if isTargetted(r.Name, resourceTargets) {
+				keys = append(keys, coverageKey(gv, r.Name))
+			}
+		}
+	}
+	return keys
+}
+
+func coverageKey(gv, resource string) string {
+	return gv + ":" + resource
+}
+
+func splitCoverageKey(key string) (gv, resource string) {
+	parts := strings.SplitN(key, ":", 2)
+	return parts[0], parts[1]
+}
+
+// appendRuleName adds name to names if it isn't already present, keeping names sorted.
+func appendRuleName(names []string, name string) []string {
+	for _, n := range names {
+		if n == name {
+			return names
+		}
+	}
+	names = append(names, name)
+	sort.Strings(names)
+	return names
+}
+
+// UnknownTargetPolicy controls what ValidateTargetsAgainstDiscovery does when it finds a rule whose
+// target reaches no discovered resource: "warn" (the default) logs each one and continues, "error"
+// also returns an aggregate error listing every rule/target pair found, so that startup can be failed
+// instead.
+var UnknownTargetPolicy = "warn"
+
+// ValidateTargetsAgainstDiscovery checks every rule's targets against discoveredAPIGroups/
+// discoveredResources, the same way AnalyzeCoverage does, and reports any target that reaches no
+// discovered resource at all - almost always a typo in an api-group/api-version/resource, or a target
+// written for a resource that this cluster doesn't have. It must be called after discovery has been
+// populated, e.g. by InitKubeClients/DiscoverFromCluster/LoadDiscoveryFromCache. Every unknown target
+// is logged as a warning regardless of UnknownTargetPolicy; under "error" it additionally returns an
+// error so that the caller can fail startup.
+func ValidateTargetsAgainstDiscovery(rules []config.Rule) error {
+	mylog := log.ComponentLogger(componentName, "ValidateTargetsAgainstDiscovery")
+
+	var unknown []string
+	for _, rule := range rules {
+		for _, target := range rule.Registration.Targets {
+			if len(targettedResourceKeys(target)) > 0 {
+				continue
+			}
+			mylog.Warn().Str("rule", rule.Registration.Name).Strs("api-groups", target.APIGroups).Strs("api-versions", target.APIVersions).Strs("resources", target.Resources).Msg("rule targets a resource that was not found in discovery")
+			unknown = append(unknown, fmt.Sprintf("%s: %v/%v/%v", rule.Registration.Name, target.APIGroups, target.APIVersions, target.Resources))
+		}
+	}
+	if len(unknown) == 0 || UnknownTargetPolicy != "error" {
+		return nil
+	}
+	return fmt.Errorf("%d rule target(s) were not found in discovery: %s", len(unknown), strings.Join(unknown, "; "))
+}
+
+var (
+	coverageMu     sync.Mutex
+	coverageRules  []config.Rule
+	coverageReport CoverageReport
+)
+
+// SetCoverageRules records the rules that subsequent discovery refreshes analyze coverage against.
+// Call it before InitKubeClients/DiscoverFromCluster/LoadDiscoveryFromCache so that the first
+// discovery sweep produces a report.
+func SetCoverageRules(rules []config.Rule) {
+	coverageMu.Lock()
+	coverageRules = rules
+	coverageMu.Unlock()
+}
+
+// recomputeCoverageReport re-runs AnalyzeCoverage against the rules set by SetCoverageRules. It is
+// called whenever discovery changes - an initial sweep, a cache hit, or a background cache refresh -
+// so that CurrentCoverageReport/ServeCoverageReport never serve a report computed against stale
+// discovery results.
+func recomputeCoverageReport() {
+	coverageMu.Lock()
+	rules := coverageRules
+	coverageMu.Unlock()
+
+	report := AnalyzeCoverage(rules)
+
+	coverageMu.Lock()
+	coverageReport = report
+	coverageMu.Unlock()
+}
+
+// CurrentCoverageReport returns the most recently computed rule coverage report.
+func CurrentCoverageReport() CoverageReport {
+	coverageMu.Lock()
+	defer coverageMu.Unlock()
+	return coverageReport
+}
+
+// ServeCoverageReport writes CurrentCoverageReport as JSON, for registering against an
+// operator-facing status endpoint such as /existing/coverage on the health-checker http server.
+func ServeCoverageReport(w http.ResponseWriter, r *http.Request) {
+	httpresponse.WriteJSON(w, http.StatusOK, CurrentCoverageReport())
+}
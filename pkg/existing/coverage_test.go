@@ -0,0 +1,136 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package existing
+
+import (
+	"testing"
+
+	"github.com/HotelsDotCom/kube-graffiti/pkg/config"
+	"github.com/HotelsDotCom/kube-graffiti/pkg/webhook"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ruleTargetting builds a minimal config.Rule with a single target, for use in AnalyzeCoverage tests.
+func ruleTargetting(name string, apiGroups, apiVersions, resources []string) config.Rule {
+	return config.Rule{
+		Registration: webhook.Registration{
+			Name: name,
+			Targets: []webhook.Target{
+				{APIGroups: apiGroups, APIVersions: apiVersions, Resources: resources},
+			},
+		},
+	}
+}
+
+func setUpCoverageTestDiscovery(t *testing.T) {
+	dc := defaultTestDiscoveryClient(t)
+	discoveryClient = dc
+	discoveredAPIGroups = make(map[string]metav1.APIGroup)
+	discoveredResources = make(map[string][]metav1.APIResource)
+	require.NoError(t, discoverAPIsAndResources())
+}
+
+func TestAnalyzeCoverageReportsUncoveredSinglyAndMultiplyCoveredResources(t *testing.T) {
+	setUpCoverageTestDiscovery(t)
+
+	rules := []config.Rule{
+		ruleTargetting("label-deployments", []string{"apps"}, []string{"v1"}, []string{"deployments"}),
+		ruleTargetting("also-label-deployments", []string{"apps"}, []string{"v1"}, []string{"deployments"}),
+	}
+
+	report := AnalyzeCoverage(rules)
+
+	assert.Equal(t, []CoverageResource{
+		{GroupVersion: "apps/v1", Resource: "deployments/scale"},
+		{GroupVersion: "apps/v1", Resource: "deployments/status"},
+		{GroupVersion: "v1", Resource: "namespaces"},
+		{GroupVersion: "v1", Resource: "namespaces/finalize"},
+		{GroupVersion: "v1", Resource: "namespaces/status"},
+	}, report.Uncovered)
+	assert.Empty(t, report.SinglyCovered)
+	assert.Equal(t, []CoverageResource{
+		{GroupVersion: "apps/v1", Resource: "deployments", Rules: []string{"also-label-deployments", "label-deployments"}},
+	}, report.MultiplyCovered)
+}
+
+func TestAnalyzeCoverageWildcardTargetCoversEveryMainResourceButNotSubresources(t *testing.T) {
+	setUpCoverageTestDiscovery(t)
+
+	rules := []config.Rule{
+		ruleTargetting("sweep-everything", []string{"*"}, []string{"*"}, []string{"*"}),
+	}
+
+	report := AnalyzeCoverage(rules)
+
+	assert.Equal(t, []CoverageResource{
+		{GroupVersion: "apps/v1", Resource: "deployments/scale"},
+		{GroupVersion: "apps/v1", Resource: "deployments/status"},
+		{GroupVersion: "v1", Resource: "namespaces/finalize"},
+		{GroupVersion: "v1", Resource: "namespaces/status"},
+	}, report.Uncovered)
+	assert.Equal(t, []CoverageResource{
+		{GroupVersion: "apps/v1", Resource: "deployments", Rules: []string{"sweep-everything"}},
+		{GroupVersion: "v1", Resource: "namespaces", Rules: []string{"sweep-everything"}},
+	}, report.SinglyCovered)
+	assert.Empty(t, report.MultiplyCovered)
+}
+
+func TestAnalyzeCoverageWithNoRulesMarksEveryResourceUncovered(t *testing.T) {
+	setUpCoverageTestDiscovery(t)
+
+	report := AnalyzeCoverage(nil)
+
+	assert.Len(t, report.Uncovered, 6)
+	assert.Empty(t, report.SinglyCovered)
+	assert.Empty(t, report.MultiplyCovered)
+}
+
+func TestValidateTargetsAgainstDiscoveryPassesWhenEveryTargetIsKnown(t *testing.T) {
+	setUpCoverageTestDiscovery(t)
+	UnknownTargetPolicy = "error"
+	defer func() { UnknownTargetPolicy = "warn" }()
+
+	rules := []config.Rule{
+		ruleTargetting("label-deployments", []string{"apps"}, []string{"v1"}, []string{"deployments"}),
+	}
+
+	assert.NoError(t, ValidateTargetsAgainstDiscovery(rules))
+}
+
+func TestValidateTargetsAgainstDiscoveryWarnsButDoesNotFailUnderTheWarnPolicy(t *testing.T) {
+	setUpCoverageTestDiscovery(t)
+	UnknownTargetPolicy = "warn"
+
+	rules := []config.Rule{
+		ruleTargetting("label-widgets", []string{"made-up"}, []string{"v1"}, []string{"widgets"}),
+	}
+
+	assert.NoError(t, ValidateTargetsAgainstDiscovery(rules))
+}
+
+func TestValidateTargetsAgainstDiscoveryFailsUnderTheErrorPolicy(t *testing.T) {
+	setUpCoverageTestDiscovery(t)
+	UnknownTargetPolicy = "error"
+	defer func() { UnknownTargetPolicy = "warn" }()
+
+	rules := []config.Rule{
+		ruleTargetting("label-widgets", []string{"made-up"}, []string{"v1"}, []string{"widgets"}),
+	}
+
+	err := ValidateTargetsAgainstDiscovery(rules)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "label-widgets")
+}
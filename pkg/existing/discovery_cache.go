@@ -0,0 +1,124 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package existing
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rs/zerolog"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// discoveryCacheFileName is the name of the cache file written under discoveryCacheDir.
+const discoveryCacheFileName = "discovery-cache.json"
+
+var (
+	// DiscoveryCacheDir, when non-empty, enables an on-disk cache of api group/resource discovery
+	// results so that a pod restart on a cluster with many CRDs doesn't have to wait on a full
+	// discovery sweep before starting the existing-objects check. Empty disables caching. It is set
+	// from the discovery.cache-dir config key.
+	DiscoveryCacheDir = ""
+	// DiscoveryCacheTTL is how long a cache file is trusted before discoverAPIsAndResources falls
+	// back to querying the apiserver directly. It is set from the discovery.cache-ttl config key.
+	DiscoveryCacheTTL = 10 * time.Minute
+)
+
+// discoveryCacheFile is the on-disk representation of a cached discovery result.
+type discoveryCacheFile struct {
+	StoredAt  time.Time                       `json:"stored-at"`
+	Groups    map[string]metav1.APIGroup      `json:"groups"`
+	Resources map[string][]metav1.APIResource `json:"resources"`
+}
+
+// loadDiscoveryCache attempts to populate discoveredAPIGroups/discoveredResources from the cache
+// file under dir, provided one exists, parses and is no older than ttl. It reports whether the
+// cache was used; any miss (no file, corrupt file, expired file) is logged and falls through to
+// the caller querying the apiserver as normal.
+func loadDiscoveryCache(dir string, ttl time.Duration, mylog zerolog.Logger) bool {
+	path := filepath.Join(dir, discoveryCacheFileName)
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		mylog.Debug().Err(err).Str("path", path).Msg("no discovery cache file found")
+		return false
+	}
+
+	var cache discoveryCacheFile
+	if err := json.Unmarshal(raw, &cache); err != nil {
+		mylog.Warn().Err(err).Str("path", path).Msg("discovery cache file is corrupt, ignoring it")
+		return false
+	}
+
+	if time.Since(cache.StoredAt) > ttl {
+		mylog.Debug().Str("path", path).Time("stored-at", cache.StoredAt).Msg("discovery cache file has expired")
+		return false
+	}
+
+	discoveredAPIGroups = cache.Groups
+	discoveredResources = cache.Resources
+	return true
+}
+
+// LoadDiscoveryFromCache populates discoveredAPIGroups/discoveredResources by reading a discovery
+// cache file previously written by writeDiscoveryCache (e.g. by a running kube-graffiti instance
+// sharing the same --discovery.cache-dir), ignoring DiscoveryCacheTTL since a coverage check run
+// offline has no live apiserver to fall back to. It is the entry point the coverage subcommand uses
+// when run without cluster access.
+func LoadDiscoveryFromCache(dir string) error {
+	path := filepath.Join(dir, discoveryCacheFileName)
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("could not read discovery cache file: %v", err)
+	}
+
+	var cache discoveryCacheFile
+	if err := json.Unmarshal(raw, &cache); err != nil {
+		return fmt.Errorf("could not parse discovery cache file: %v", err)
+	}
+
+	discoveredAPIGroups = cache.Groups
+	discoveredResources = cache.Resources
+	recomputeCoverageReport()
+	return nil
+}
+
+// writeDiscoveryCache serializes the current discoveredAPIGroups/discoveredResources to a cache
+// file under dir. Failures are logged rather than returned since a cache write failure shouldn't
+// stop graffiti from using the discovery results it already has in memory.
+func writeDiscoveryCache(dir string, mylog zerolog.Logger) {
+	cache := discoveryCacheFile{
+		StoredAt:  time.Now(),
+		Groups:    discoveredAPIGroups,
+		Resources: discoveredResources,
+	}
+	raw, err := json.Marshal(cache)
+	if err != nil {
+		mylog.Warn().Err(err).Msg("could not marshal discovery cache")
+		return
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		mylog.Warn().Err(err).Str("dir", dir).Msg("could not create discovery cache directory")
+		return
+	}
+
+	path := filepath.Join(dir, discoveryCacheFileName)
+	if err := ioutil.WriteFile(path, raw, 0644); err != nil {
+		mylog.Warn().Err(err).Str("path", path).Msg("could not write discovery cache file")
+	}
+}
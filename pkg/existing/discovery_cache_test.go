@@ -0,0 +1,165 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package existing
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// withCleanDiscoveryState snapshots discoveredAPIGroups/discoveredResources and restores them once
+// the test finishes, so a test exercising the cache doesn't leak entries into the global maps that
+// other discovery tests in this package assert exact counts against.
+func withCleanDiscoveryState(t *testing.T) {
+	origGroups, origResources := discoveredAPIGroups, discoveredResources
+	discoveredAPIGroups = map[string]metav1.APIGroup{}
+	discoveredResources = map[string][]metav1.APIResource{}
+	t.Cleanup(func() { discoveredAPIGroups, discoveredResources = origGroups, origResources })
+}
+
+func writeTestDiscoveryCacheFile(t *testing.T, dir string, storedAt time.Time) {
+	cache := discoveryCacheFile{
+		StoredAt:  storedAt,
+		Groups:    map[string]metav1.APIGroup{"apps": {Name: "apps"}},
+		Resources: map[string][]metav1.APIResource{"apps/v1": {{Name: "deployments"}}},
+	}
+	raw, err := json.Marshal(cache)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, discoveryCacheFileName), raw, 0644))
+}
+
+func TestDiscoverAPIsAndResourcesUsesAValidCacheInsteadOfTheDiscoveryClient(t *testing.T) {
+	withCleanDiscoveryState(t)
+	dir, err := ioutil.TempDir("", "discovery-cache-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	writeTestDiscoveryCacheFile(t, dir, time.Now())
+
+	origDir, origTTL := DiscoveryCacheDir, DiscoveryCacheTTL
+	DiscoveryCacheDir, DiscoveryCacheTTL = dir, 10*time.Minute
+	defer func() { DiscoveryCacheDir, DiscoveryCacheTTL = origDir, origTTL }()
+
+	// stub out the background refresh so it can't race with later tests that swap discoveryClient/t
+	origSchedule := scheduleDiscoveryCacheRefresh
+	scheduleDiscoveryCacheRefresh = func(zerolog.Logger) {}
+	defer func() { scheduleDiscoveryCacheRefresh = origSchedule }()
+
+	dc := &mockDiscoveryClient{}
+	discoveryClient = dc
+
+	err = discoverAPIsAndResources()
+	require.NoError(t, err)
+
+	dc.AssertNotCalled(t, "ServerGroups")
+	dc.AssertNotCalled(t, "ServerResources")
+	require.Contains(t, discoveredAPIGroups, "apps")
+	require.Contains(t, discoveredResources, "apps/v1")
+}
+
+func TestDiscoverAPIsAndResourcesSchedulesABackgroundRefreshOnACacheHit(t *testing.T) {
+	withCleanDiscoveryState(t)
+	dir, err := ioutil.TempDir("", "discovery-cache-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	writeTestDiscoveryCacheFile(t, dir, time.Now())
+
+	origDir, origTTL := DiscoveryCacheDir, DiscoveryCacheTTL
+	DiscoveryCacheDir, DiscoveryCacheTTL = dir, 10*time.Minute
+	defer func() { DiscoveryCacheDir, DiscoveryCacheTTL = origDir, origTTL }()
+
+	origSchedule := scheduleDiscoveryCacheRefresh
+	var scheduled bool
+	scheduleDiscoveryCacheRefresh = func(zerolog.Logger) { scheduled = true }
+	defer func() { scheduleDiscoveryCacheRefresh = origSchedule }()
+
+	discoveryClient = &mockDiscoveryClient{}
+
+	require.NoError(t, discoverAPIsAndResources())
+	require.True(t, scheduled, "a cache hit should schedule a background refresh")
+}
+
+func TestDiscoverAPIsAndResourcesFallsBackToTheDiscoveryClientWhenNoCacheFileExists(t *testing.T) {
+	withCleanDiscoveryState(t)
+	dir, err := ioutil.TempDir("", "discovery-cache-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	origDir, origTTL := DiscoveryCacheDir, DiscoveryCacheTTL
+	DiscoveryCacheDir, DiscoveryCacheTTL = dir, 10*time.Minute
+	defer func() { DiscoveryCacheDir, DiscoveryCacheTTL = origDir, origTTL }()
+
+	dc := defaultTestDiscoveryClient(t).(*mockDiscoveryClient)
+	discoveryClient = dc
+
+	err = discoverAPIsAndResources()
+	require.NoError(t, err)
+	dc.AssertCalled(t, "ServerGroups")
+
+	// writeDiscoveryCache is asynchronous-free on a cache miss, so the file should now exist.
+	_, statErr := os.Stat(filepath.Join(dir, discoveryCacheFileName))
+	require.NoError(t, statErr)
+}
+
+func TestDiscoverAPIsAndResourcesFallsBackToTheDiscoveryClientWhenCacheHasExpired(t *testing.T) {
+	withCleanDiscoveryState(t)
+	dir, err := ioutil.TempDir("", "discovery-cache-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	writeTestDiscoveryCacheFile(t, dir, time.Now().Add(-time.Hour))
+
+	origDir, origTTL := DiscoveryCacheDir, DiscoveryCacheTTL
+	DiscoveryCacheDir, DiscoveryCacheTTL = dir, 10*time.Minute
+	defer func() { DiscoveryCacheDir, DiscoveryCacheTTL = origDir, origTTL }()
+
+	dc := defaultTestDiscoveryClient(t).(*mockDiscoveryClient)
+	discoveryClient = dc
+
+	err = discoverAPIsAndResources()
+	require.NoError(t, err)
+	dc.AssertCalled(t, "ServerGroups")
+}
+
+func TestLoadDiscoveryCacheReturnsFalseWhenNoFileExists(t *testing.T) {
+	dir, err := ioutil.TempDir("", "discovery-cache-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	require.False(t, loadDiscoveryCache(dir, time.Minute, log.Logger))
+}
+
+func TestWriteThenLoadDiscoveryCacheRoundTrips(t *testing.T) {
+	withCleanDiscoveryState(t)
+	dir, err := ioutil.TempDir("", "discovery-cache-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	discoveredAPIGroups = map[string]metav1.APIGroup{"batch": {Name: "batch"}}
+	discoveredResources = map[string][]metav1.APIResource{"batch/v1": {{Name: "jobs"}}}
+	writeDiscoveryCache(dir, log.Logger)
+
+	discoveredAPIGroups = map[string]metav1.APIGroup{}
+	discoveredResources = map[string][]metav1.APIResource{}
+	require.True(t, loadDiscoveryCache(dir, time.Minute, log.Logger))
+	require.Contains(t, discoveredAPIGroups, "batch")
+	require.Contains(t, discoveredResources, "batch/v1")
+}
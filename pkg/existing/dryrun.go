@@ -0,0 +1,146 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package existing
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+
+	"github.com/cameront/go-jsonpatch"
+	"github.com/rs/zerolog"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// DryRun, when true, makes applyToObject compute and accumulate what a rule's patch would change
+// about each matching object into currentDryRunReport, instead of actually patching anything - see
+// DryRunReportPath. It is orthogonal to CoalescePatches: a coalesced sweep records each matching
+// rule's own patch the same way, before any merging, so the diff report lists one entry per
+// rule/object pair regardless of how the run is patching for real.
+var DryRun = false
+
+// DryRunReportPath, when set (via the existing-dry-run-report-path configuration key), writes the
+// accumulated dry-run diff report as JSON to this path once the run completes, so it can be attached
+// to a PR and reviewed before DryRun is turned off and the rules are let loose on the cluster.
+var DryRunReportPath = ""
+
+// objectDiff is one rule's planned change to one object - the labels/annotations keys it would add
+// or change, and the ones it would remove. Namespace is omitted for cluster-scoped objects.
+type objectDiff struct {
+	Rule      string   `json:"rule"`
+	Namespace string   `json:"namespace,omitempty"`
+	Kind      string   `json:"kind"`
+	Name      string   `json:"name"`
+	Added     []string `json:"added,omitempty"`
+	Removed   []string `json:"removed,omitempty"`
+}
+
+// currentDryRunReport accumulates the diffs of the running ApplyRulesAgainstExistingObjects call, for
+// the JSON report written once it completes - see runReport's currentReport for the equivalent
+// non-dry-run accumulator, and why it needs no locking of its own.
+var currentDryRunReport = newDryRunReport()
+
+type dryRunReport struct {
+	diffs []objectDiff
+}
+
+func newDryRunReport() *dryRunReport {
+	return &dryRunReport{}
+}
+
+// record appends diff to the report, but only when it actually touches a label or annotation key -
+// a rule that matched but whose patch leaves labels and annotations untouched (a finalizer-only
+// addition, say) is not worth a line in a labels/annotations diff report.
+func (r *dryRunReport) record(diff objectDiff) {
+	if len(diff.Added) == 0 && len(diff.Removed) == 0 {
+		return
+	}
+	r.diffs = append(r.diffs, diff)
+}
+
+// publish writes the accumulated diffs as JSON to DryRunReportPath, sorted by rule/namespace/kind/name
+// so that two identical runs produce byte-identical reports.
+func (r *dryRunReport) publish(mylog zerolog.Logger) {
+	sort.Slice(r.diffs, func(i, j int) bool {
+		a, b := r.diffs[i], r.diffs[j]
+		if a.Rule != b.Rule {
+			return a.Rule < b.Rule
+		}
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		return a.Name < b.Name
+	})
+
+	mylog.Info().Int("objects", len(r.diffs)).Msg("dry-run: finished accumulating planned changes")
+	if DryRunReportPath == "" {
+		return
+	}
+	b, err := json.MarshalIndent(r.diffs, "", "  ")
+	if err != nil {
+		mylog.Error().Err(err).Msg("failed to marshal dry-run diff report to json")
+		return
+	}
+	if err := ioutil.WriteFile(DryRunReportPath, b, 0644); err != nil {
+		mylog.Error().Err(err).Str("path", DryRunReportPath).Msg("failed to write dry-run diff report")
+	}
+}
+
+// diffKeys compares before and after, returning the keys that are new or changed and the keys that
+// are missing from after, both sorted for deterministic output.
+func diffKeys(before, after map[string]string) (added, removed []string) {
+	for k, v := range after {
+		if bv, ok := before[k]; !ok || bv != v {
+			added = append(added, k)
+		}
+	}
+	for k := range before {
+		if _, ok := after[k]; !ok {
+			removed = append(removed, k)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
+}
+
+// computeObjectDiff applies patch to a deep copy of object, using the same jsonpatch implementation
+// validatePatchResult does, and reduces the result down to the labels/annotations keys that changed -
+// the shape the dry-run report lists per object.
+func computeObjectDiff(rule, namespace, kind, name string, object unstructured.Unstructured, patch []byte) (objectDiff, error) {
+	parsed, err := jsonpatch.FromString(string(patch))
+	if err != nil {
+		return objectDiff{}, fmt.Errorf("could not parse computed patch: %v", err)
+	}
+	copied := object.DeepCopy()
+	if err := parsed.Apply(&copied.Object); err != nil {
+		return objectDiff{}, fmt.Errorf("could not apply computed patch to a copy of the object: %v", err)
+	}
+
+	labelsAdded, labelsRemoved := diffKeys(object.GetLabels(), copied.GetLabels())
+	annotationsAdded, annotationsRemoved := diffKeys(object.GetAnnotations(), copied.GetAnnotations())
+
+	return objectDiff{
+		Rule:      rule,
+		Namespace: namespace,
+		Kind:      kind,
+		Name:      name,
+		Added:     append(labelsAdded, annotationsAdded...),
+		Removed:   append(labelsRemoved, annotationsRemoved...),
+	}, nil
+}
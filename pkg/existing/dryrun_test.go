@@ -0,0 +1,75 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package existing
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestDiffKeysReportsAddedChangedAndRemovedKeys(t *testing.T) {
+	before := map[string]string{"fruit": "apple", "stale": "yes"}
+	after := map[string]string{"fruit": "pear", "new": "label"}
+
+	added, removed := diffKeys(before, after)
+	assert.Equal(t, []string{"fruit", "new"}, added, "a changed value and a brand new key both count as added")
+	assert.Equal(t, []string{"stale"}, removed)
+}
+
+func TestDiffKeysReportsNothingWhenUnchanged(t *testing.T) {
+	m := map[string]string{"fruit": "apple"}
+	added, removed := diffKeys(m, m)
+	assert.Empty(t, added)
+	assert.Empty(t, removed)
+}
+
+func TestComputeObjectDiffListsPlannedLabelAndAnnotationChanges(t *testing.T) {
+	var resourceObject unstructured.Unstructured
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"apiVersion": "v1",
+		"kind": "Namespace",
+		"metadata": {
+			"name": "test-namespace",
+			"labels": {"fruit": "apple"},
+			"annotations": {"old": "gone"}
+		}
+	}`), &resourceObject.Object))
+
+	patch := []byte(`[
+		{"op": "replace", "path": "/metadata/labels", "value": {"fruit": "apple", "added": "by-graffiti"}},
+		{"op": "replace", "path": "/metadata/annotations", "value": {}}
+	]`)
+
+	diff, err := computeObjectDiff("add-a-label", "", "Namespace", "test-namespace", resourceObject, patch)
+	require.NoError(t, err)
+	assert.Equal(t, "add-a-label", diff.Rule)
+	assert.Equal(t, "Namespace", diff.Kind)
+	assert.Equal(t, "test-namespace", diff.Name)
+	assert.Equal(t, []string{"added"}, diff.Added)
+	assert.Equal(t, []string{"old"}, diff.Removed)
+}
+
+func TestDryRunReportOmitsObjectsWithNoLabelOrAnnotationChange(t *testing.T) {
+	r := newDryRunReport()
+	r.record(objectDiff{Rule: "no-op-rule", Kind: "Pod", Name: "untouched"})
+	assert.Empty(t, r.diffs, "a diff with neither added nor removed keys is not worth a line in the report")
+
+	r.record(objectDiff{Rule: "add-a-label", Kind: "Pod", Name: "changed", Added: []string{"added"}})
+	require.Len(t, r.diffs, 1)
+	assert.Equal(t, "changed", r.diffs[0].Name)
+}
@@ -15,14 +15,22 @@ limitations under the License.
 package existing
 
 import (
+	"context"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"strings"
+	"time"
 
+	"github.com/HotelsDotCom/kube-graffiti/pkg/audit"
 	"github.com/HotelsDotCom/kube-graffiti/pkg/config"
 	"github.com/HotelsDotCom/kube-graffiti/pkg/graffiti"
 	"github.com/HotelsDotCom/kube-graffiti/pkg/log"
 	"github.com/HotelsDotCom/kube-graffiti/pkg/webhook"
+	jsonpatch "github.com/cameront/go-jsonpatch"
+	"github.com/rs/zerolog"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime/schema"
@@ -36,8 +44,43 @@ const (
 	componentName = "existing"
 	// itemLimit is used to constrain the number of items returned in a kubernetes List call.
 	itemLimit = 100
+	// minItemLimit is the floor that a List page size is allowed to shrink to as it adapts downward
+	// after repeated timeouts.
+	minItemLimit = 10
+	// listMaxAttempts bounds how many times a single List page is retried before it is given up on.
+	listMaxAttempts = 5
 )
 
+var (
+	// listBackoffBase is the initial backoff between List retries; it doubles on each subsequent
+	// retry, up to listBackoffMax, unless the apiserver suggests a longer delay itself (e.g. via a
+	// 429's Retry-After). Variables, rather than constants, so that tests can shrink them.
+	listBackoffBase = 500 * time.Millisecond
+	listBackoffMax  = 30 * time.Second
+)
+
+// ExistingSkipAnnotationKey is the object annotation, honored only in applyToObject, which opts an
+// object out of the existing sweep while leaving it mutable at admission. It defaults to the
+// well known kube-graffiti annotation but may be overridden by configuration.
+var ExistingSkipAnnotationKey = "kube-graffiti.io/existing-skip"
+
+// ValidatePatchResult, when true, makes applyToObject apply a rule's computed patch to an in-memory
+// copy of the object and check the result still unmarshals to the object's own kind/apiVersion/name
+// before sending the real patch to the apiserver. A rule's json-patch can be well-formed and still
+// produce a structurally invalid object (e.g. it deletes metadata.name), which the apiserver would
+// otherwise reject per-object with no easy way to distinguish from any other patch failure; this lets
+// such a patch be skipped and logged up front instead. Off by default, since it costs an extra
+// marshal/apply/unmarshal per matched object.
+var ValidatePatchResult = false
+
+// SSAConflictFallback, when true, makes patchObject try a server-side apply of a rule's computed
+// patch first, and only fall back to the ordinary JSON patch if the apiserver rejects the apply with a
+// field-manager conflict - an object another controller's field manager owns the relevant fields of,
+// e.g. under a mutating rule migrated to server-side apply for the first time. Off by default, since a
+// conflict on the plain JSON patch path already surfaces as an error the way any other patch failure
+// does, and most rules never collide with another field manager.
+var SSAConflictFallback = false
+
 var (
 	// package level discovery client to share when looking up available kubernetes objects/versions/resources
 	discoveryClient     apiDiscoverer
@@ -53,6 +96,53 @@ type apiDiscoverer interface {
 	ServerResources() ([]*metav1.APIResourceList, error)
 }
 
+// ExtraCACertPaths names additional PEM-encoded CA certificate files that AppendExtraCACerts adds to
+// a kube client's rest.Config, on top of whatever CA it already trusts - useful in restricted
+// environments where the apiserver or an OIDC endpoint sits behind a corporate proxy that terminates
+// and re-signs TLS with its own CA. It defaults to empty, so a deployment not behind such a proxy is
+// unaffected.
+var ExtraCACertPaths []string
+
+// AppendExtraCACerts loads every PEM-encoded certificate named by ExtraCACertPaths, validates that it
+// parses, and appends it to cfg's TLSClientConfig.CAData, alongside whatever CA cfg is already
+// configured to trust - its existing CAData, or the content of its CAFile, which is read and folded
+// into CAData so that setting an extra CA never silently drops the cluster's own one. It is a no-op
+// when ExtraCACertPaths is empty.
+func AppendExtraCACerts(cfg *rest.Config) error {
+	if len(ExtraCACertPaths) == 0 {
+		return nil
+	}
+
+	caData := cfg.TLSClientConfig.CAData
+	if len(caData) == 0 && cfg.TLSClientConfig.CAFile != "" {
+		fileData, err := ioutil.ReadFile(cfg.TLSClientConfig.CAFile)
+		if err != nil {
+			return fmt.Errorf("could not read existing ca-file %q: %v", cfg.TLSClientConfig.CAFile, err)
+		}
+		caData = fileData
+	}
+
+	pool := x509.NewCertPool()
+	if len(caData) > 0 && !pool.AppendCertsFromPEM(caData) {
+		return fmt.Errorf("existing CA certificate data does not contain a valid PEM certificate")
+	}
+
+	for _, path := range ExtraCACertPaths {
+		extra, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("could not read extra ca cert %q: %v", path, err)
+		}
+		if !pool.AppendCertsFromPEM(extra) {
+			return fmt.Errorf("extra ca cert %q does not contain a valid PEM certificate", path)
+		}
+		caData = append(append(caData, '\n'), extra...)
+	}
+
+	cfg.TLSClientConfig.CAData = caData
+	cfg.TLSClientConfig.CAFile = ""
+	return nil
+}
+
 // InitKubeClients sets up the package for working with kubernetes api and discovers
 // and caches known api groups/versions and resource types
 func InitKubeClients(rest *rest.Config) error {
@@ -60,6 +150,10 @@ func InitKubeClients(rest *rest.Config) error {
 	mylog.Debug().Msg("setting up kubernetes discovery and dynamic clients")
 	var err error
 
+	if err := AppendExtraCACerts(rest); err != nil {
+		return fmt.Errorf("failed to load extra ca certs: %v", err)
+	}
+
 	discoveryClient, err = discovery.NewDiscoveryClientForConfig(rest)
 	if err != nil {
 		return fmt.Errorf("can't get a kubernetes discovery client: %v", err)
@@ -76,11 +170,54 @@ func InitKubeClients(rest *rest.Config) error {
 	return discoverAPIsAndResources()
 }
 
-// discoverAPIsAndResources loads information about known apis and resources
-// into our cache so we can use them without making lots of calls to kubernetes
+// discoverAPIsAndResources loads information about known apis and resources into our cache so we
+// can use them without making lots of calls to kubernetes. If discoveryCacheDir is set and holds a
+// cache file no older than discoveryCacheTTL, it is used instead of querying the apiserver, and a
+// fresh discovery sweep is kicked off in the background to refresh both the in-memory maps and the
+// cache file for next time.
 func discoverAPIsAndResources() error {
 	mylog := log.ComponentLogger(componentName, "discoverAPIsAndResources")
 
+	if DiscoveryCacheDir != "" && loadDiscoveryCache(DiscoveryCacheDir, DiscoveryCacheTTL, mylog) {
+		mylog.Info().Str("cache-dir", DiscoveryCacheDir).Msg("using cached kubernetes api discovery results")
+		recomputeCoverageReport()
+		scheduleDiscoveryCacheRefresh(mylog)
+		return nil
+	}
+
+	if err := fetchDiscovery(mylog); err != nil {
+		return err
+	}
+	recomputeCoverageReport()
+	if DiscoveryCacheDir != "" {
+		writeDiscoveryCache(DiscoveryCacheDir, mylog)
+	}
+	return nil
+}
+
+// DiscoverFromCluster populates discoveredAPIGroups/discoveredResources by querying a live
+// apiserver's discovery API directly, without setting up the dynamic and namespace clients that a
+// full existing-objects sweep needs via InitKubeClients. It is the entry point the coverage
+// subcommand uses to analyze live discovery results instead of a cached file.
+func DiscoverFromCluster(rest *rest.Config) error {
+	mylog := log.ComponentLogger(componentName, "DiscoverFromCluster")
+
+	var err error
+	discoveryClient, err = discovery.NewDiscoveryClientForConfig(rest)
+	if err != nil {
+		return fmt.Errorf("can't get a kubernetes discovery client: %v", err)
+	}
+	if err := fetchDiscovery(mylog); err != nil {
+		return err
+	}
+	recomputeCoverageReport()
+	return nil
+}
+
+// fetchDiscovery queries the apiserver directly for api groups and resources, populating
+// discoveredAPIGroups/discoveredResources. A failure to list groups is fatal to discovery; a
+// failure to list resources is logged and otherwise ignored, as it always has been.
+func fetchDiscovery(mylog zerolog.Logger) error {
 	mylog.Debug().Msg("discovering kubernetes api groups")
 	sg, err := discoveryClient.ServerGroups()
 	if err != nil {
@@ -103,7 +240,28 @@ func discoverAPIsAndResources() error {
 	return nil
 }
 
+// scheduleDiscoveryCacheRefresh kicks off refreshDiscoveryCache in the background after a cache hit.
+// It is a package var, rather than a direct "go refreshDiscoveryCache(mylog)" call, so that tests can
+// swap in a synchronous or no-op replacement and observe/control the refresh deterministically.
+var scheduleDiscoveryCacheRefresh = func(mylog zerolog.Logger) {
+	go refreshDiscoveryCache(mylog)
+}
+
+// refreshDiscoveryCache re-runs discovery against the apiserver and rewrites the cache file, so
+// that a cache-hit at startup doesn't leave graffiti running against indefinitely stale discovery
+// results. It runs in the background and only logs on failure.
+func refreshDiscoveryCache(mylog zerolog.Logger) {
+	if err := fetchDiscovery(mylog); err != nil {
+		mylog.Warn().Err(err).Msg("background discovery refresh failed, keeping cached results")
+		return
+	}
+	recomputeCoverageReport()
+	writeDiscoveryCache(DiscoveryCacheDir, mylog)
+}
+
 // ApplyRulesAgainstExistingObjects interates over the graffiti rules and targets, apply each rule to existing kubernetes objects.
+// Once the main sweep finishes, patches that failed for non-conflict reasons are retried - see
+// retryFailedPatches - before the run report is published.
 func ApplyRulesAgainstExistingObjects(rules []config.Rule) {
 	mylog := log.ComponentLogger(componentName, "ApplyRulesAgainstExistingObjects")
 
@@ -111,54 +269,65 @@ func ApplyRulesAgainstExistingObjects(rules []config.Rule) {
 	stop := make(chan struct{})
 	defer close(stop)
 	nsCache.StartNamespaceReflector(stop)
+	currentReport = newRunReport()
+	currentDryRunReport = newDryRunReport()
+	resetRetryQueue()
 	mylog.Info().Msg("checking existing objects against graffiti rules")
-	for _, rule := range rules {
-		ApplyRuleAgainstExistingObjects(rule)
+	if CoalescePatches {
+		applyRulesCoalesced(rules, stop)
+	} else {
+		for _, rule := range rules {
+			ApplyRuleAgainstExistingObjects(rule, stop)
+		}
+	}
+	retryFailedPatches(mylog)
+	currentReport.publish(mylog)
+	if DryRun {
+		currentDryRunReport.publish(mylog)
 	}
 }
 
-// ApplyRuleAgainstExistingObjects checks a single graffiti rule against existing kubernetes objects
-func ApplyRuleAgainstExistingObjects(rule config.Rule) {
+// ApplyRuleAgainstExistingObjects checks a single graffiti rule against existing kubernetes objects.
+// stop is checked whenever the run is paused waiting for the apiserver to recover (see
+// pauseForAPIHealth), so that shutdown isn't held up behind an apiserver outage.
+func ApplyRuleAgainstExistingObjects(rule config.Rule, stop <-chan struct{}) {
 	mylog := log.ComponentLogger(componentName, "ApplyRuleAgainstExistingObjects")
 	mylog.Debug().Str("rule", rule.Registration.Name).Msg("applying rule to existing objects")
 	for _, target := range rule.Registration.Targets {
-		applyToTargetttedAPIGroupsAndVersions(&rule, target)
+		applyToTargetttedAPIGroupsAndVersions(&rule, target, stop)
 	}
 }
 
 // applyToTargetttedAPIGroupsAndVersions starts evaluating a target by getting a list of APIGroups which are listed.
 // If the target APIGroups is ["*"] then we will check through *all* discoverd apigroups.
-func applyToTargetttedAPIGroupsAndVersions(rule *config.Rule, target webhook.Target) {
+func applyToTargetttedAPIGroupsAndVersions(rule *config.Rule, target webhook.Target, stop <-chan struct{}) {
 	mylog := log.ComponentLogger(componentName, "applyToTargetttedAPIGroupsAndVersions")
 	rlog := mylog.With().Str("rule", rule.Registration.Name).Str("target-apigroups", strings.Join(target.APIGroups, ",")).Str("target-versions", strings.Join(target.APIVersions, ",")).Str("target-resources", strings.Join(target.Resources, ",")).Logger()
 	rlog.Debug().Msg("evaluating target")
 
-	// handle wildcard '*'
+	// match target.APIGroups (literal names, the wildcard '*', or glob patterns) against discovery.
 	var targetGroups []string
-	if len(target.APIGroups) == 1 && target.APIGroups[0] == "*" {
-		rlog.Debug().Msg("found target with APIGroup * wildcard")
-		// check *all* discovered groups
-		for _, g := range discoveredAPIGroups {
+	for _, g := range discoveredAPIGroups {
+		if isTargetted(g.Name, target.APIGroups) {
 			targetGroups = append(targetGroups, g.Name)
 		}
-	} else {
-		targetGroups = target.APIGroups
 	}
 
 	// check each group/version is targetted and check
 	for _, g := range targetGroups {
 		if isTargetted(discoveredAPIGroups[g].PreferredVersion.Version, target.APIVersions) {
-			applyToAllResourcesInAGroupVersion(rule, target, discoveredAPIGroups[g].PreferredVersion)
+			applyToAllResourcesInAGroupVersion(rule, target, discoveredAPIGroups[g].PreferredVersion, stop)
 		} else {
 			rlog.Warn().Str("group", g).Str("preffered-version", discoveredAPIGroups[g].PreferredVersion.Version).Msg("targetted APIVersions do not match either wildcard or the preferred api version - therefore we will not use this rule to update existing objects for this group")
 		}
 	}
 }
 
-// isTargetted checks that an element is present in a target list or matches a wildcard '*'
+// isTargetted checks that an element is present in a target list, matches the wildcard '*', or matches
+// one of the list's glob patterns (e.g. "*.company.com").
 func isTargetted(element string, targets []string) bool {
 	for _, target := range targets {
-		if target == "*" || element == target {
+		if webhook.MatchesPattern(element, target) {
 			return true
 		}
 	}
@@ -166,17 +335,23 @@ func isTargetted(element string, targets []string) bool {
 }
 
 // applyToAllResourcesInAGroupVersion checks all the resources in an group/version that are targetted.
-// If the target is ["*"] then all resources are checked, otherwise each discovered resource is
-// checked against the target list.
-func applyToAllResourcesInAGroupVersion(rule *config.Rule, target webhook.Target, gv metav1.GroupVersionForDiscovery) {
+// A target.Resources of ["*"] checks every main resource but skips subresources (e.g. "deployments/scale"),
+// while ["*/*"] checks main resources and their subresources, matching how the kubernetes apiserver
+// itself distinguishes the two wildcards. Otherwise each discovered resource is checked against the
+// target list.
+func applyToAllResourcesInAGroupVersion(rule *config.Rule, target webhook.Target, gv metav1.GroupVersionForDiscovery, stop <-chan struct{}) {
 	mylog := log.ComponentLogger(componentName, "applyToAllResourcesInAGroupVersion")
 	rlog := mylog.With().Str("rule", rule.Registration.Name).Str("group-version", gv.GroupVersion).Str("version", gv.Version).Logger()
 	rlog.Debug().Msg("evaluating group version")
 
 	if len(target.Resources) == 1 && (target.Resources[0] == "*" || target.Resources[0] == "*/*") {
-		rlog.Debug().Msg("found target with Resources * wildcard")
+		includeSubresources := target.Resources[0] == "*/*"
+		rlog.Debug().Bool("include-subresources", includeSubresources).Msg("found target with Resources wildcard")
 		for _, r := range discoveredResources[gv.GroupVersion] {
-			applyToAllResourcesOfType(rule, gv.GroupVersion, r)
+			if _, sub := splitSlashedResourceString(r.Name); sub != "" && !includeSubresources {
+				continue
+			}
+			_ = applyToAllResourcesOfType(rule, gv.GroupVersion, r, stop)
 		}
 		return
 	}
@@ -198,7 +373,7 @@ func applyToAllResourcesInAGroupVersion(rule *config.Rule, target webhook.Target
 		rlog.Debug().Str("resource", resource.Name).Msg("calling isTargetted on resource")
 		if isTargetted(resource.Name, resourceTargets) {
 			rlog.Debug().Str("resource", resource.Name).Msg("resorce is targetted")
-			applyToAllResourcesOfType(rule, gv.GroupVersion, resource)
+			_ = applyToAllResourcesOfType(rule, gv.GroupVersion, resource, stop)
 		} else {
 			rlog.Debug().Str("resource", resource.Name).Msg("resource is not targetted")
 		}
@@ -222,9 +397,15 @@ func splitGroupVersionString(s string) (group, version string) {
 }
 
 // applyToAllResourcesOfType checks all of the resources of particular group/version type.
-// It lists the resources in batches of itemLimit in order to preserve memory when there are
-// many kubernetes objects of the type in the cluster.
-func applyToAllResourcesOfType(rule *config.Rule, gv string, resource metav1.APIResource) {
+// It lists the resources in batches, starting at itemLimit, in order to preserve memory when there
+// are many kubernetes objects of the type in the cluster. If retries against the apiserver for a
+// page are exhausted, the resource is recorded as only partially processed - via recordPartialCoverage
+// - rather than the remaining pages being silently dropped. The returned error is non-nil only when
+// the rule's failure-policy is "Fail", so that callers who want to stop an existing-run on partial
+// coverage can do so; by default it's only logged, matching the errors logged elsewhere in this package.
+// stop is forwarded to listPageWithRetry, which checks it while the run is paused for apiserver
+// health.
+func applyToAllResourcesOfType(rule *config.Rule, gv string, resource metav1.APIResource, stop <-chan struct{}) error {
 	mylog := log.ComponentLogger(componentName, "applyToAllResourcesOfType")
 	rlog := mylog.With().Str("rule", rule.Registration.Name).Str("group-version", gv).Str("resource", resource.Name).Logger()
 	rlog.Debug().Msg("looking at resources of type")
@@ -238,42 +419,119 @@ func applyToAllResourcesOfType(rule *config.Rule, gv string, resource metav1.API
 	}
 	ri := dynamicClient.Resource(grv)
 
-	// get first list of items up to our limit
-	list, err := ri.List(metav1.ListOptions{Limit: itemLimit})
-	if err != nil {
-		rlog.Error().Err(err).Msg("failed to list resources")
-		return
-	}
-	if list == nil {
-		rlog.Debug().Msg("no resources found")
-		return
-	}
-	rlog.Debug().Int("number-resources", len(list.Items)).Msg("processing batch of resources")
-	for _, item := range list.Items {
-		_ = applyToObject(rule, gv, resource.Name, item)
-	}
-
-	// if we only got a partial list we need to continue until we have seen them all
-	meta := list.Object["metadata"].(map[string]interface{})
-	for cont, ok := meta["continue"]; ok; {
-		list, err = ri.List(metav1.ListOptions{Limit: itemLimit, Continue: cont.(string)})
+	limit := int64(itemLimit)
+	cont := ""
+	pagesCompleted := 0
+	for {
+		list, newLimit, err := listPageWithRetry(ri, limit, cont, stop, rlog)
+		limit = newLimit
 		if err != nil {
-			rlog.Error().Err(err).Msg("failed to list resources")
-			return
+			recordPartialCoverage(rule, gv, resource.Name, pagesCompleted, err)
+			rlog.Error().Err(err).Int("pages-completed", pagesCompleted).Msg("exhausted retries listing resources, remaining pages were not processed")
+			if strings.EqualFold(rule.Registration.FailurePolicy, "fail") {
+				return fmt.Errorf("exhausted retries listing %s after %d page(s): %v", resource.Name, pagesCompleted, err)
+			}
+			return nil
 		}
 		if list == nil {
 			rlog.Debug().Msg("no resources found")
-			return
+			return nil
 		}
 		rlog.Debug().Int("number-resources", len(list.Items)).Msg("processing batch of resources")
 		for _, item := range list.Items {
-			applyToObject(rule, gv, resource.Name, item)
+			_ = applyToObject(rule, gv, resource.Name, item)
+		}
+		pagesCompleted++
+
+		meta := list.Object["metadata"].(map[string]interface{})
+		next, ok := meta["continue"]
+		if !ok || next.(string) == "" {
+			return nil
 		}
-		meta = list.Object["metadata"].(map[string]interface{})
-		cont, ok = meta["continue"]
+		cont = next.(string)
 	}
 }
 
+// listPageWithRetry performs a single List call, retrying with exponential backoff (honouring a
+// 429's Retry-After header over our own backoff) up to listMaxAttempts times. Repeated server
+// timeouts halve the page size, down to a floor of minItemLimit, since oversized pages are the
+// usual cause; the returned limit should be passed into the call for the next page.
+//
+// Every transport-level/5xx error is also reported to recordAPIHealthError. Once enough of them
+// land within HealthBackoffWindow across every resource and rule in the run, that is taken as
+// evidence of an apiserver-wide problem rather than one specific to this resource, and the whole
+// run is paused - via pauseForAPIHealth - until a cheap discovery probe confirms the apiserver is
+// back. A pause does not count towards this call's own listMaxAttempts budget, since it isn't
+// evidence this resource is the problem; only errors seen outside of a pause are counted against
+// it. stop is forwarded to pauseForAPIHealth so a pause never delays shutdown.
+func listPageWithRetry(ri dynamic.ResourceInterface, limit int64, cont string, stop <-chan struct{}, rlog zerolog.Logger) (*unstructured.UnstructuredList, int64, error) {
+	backoff := listBackoffBase
+	attempt := 1
+	for {
+		list, err := ri.List(metav1.ListOptions{Limit: limit, Continue: cont})
+		if err == nil {
+			return list, limit, nil
+		}
+
+		if isTransportOrServerError(err) && recordAPIHealthError(time.Now()) {
+			rlog.Warn().Err(err).Msg("too many apiserver errors seen across the run, pausing until the apiserver recovers")
+			pauseForAPIHealth(stop, rlog)
+			select {
+			case <-stop:
+				return nil, limit, err
+			default:
+			}
+			continue
+		}
+
+		isTooManyRequests := apierrors.IsTooManyRequests(err)
+		isTimeout := apierrors.IsTimeout(err) || apierrors.IsServerTimeout(err)
+		if !isTooManyRequests && !isTimeout {
+			return nil, limit, err
+		}
+		if attempt >= listMaxAttempts {
+			return nil, limit, err
+		}
+
+		wait := backoff
+		if secs, ok := apierrors.SuggestsClientDelay(err); ok {
+			wait = time.Duration(secs) * time.Second
+		}
+		if isTimeout && limit > minItemLimit {
+			limit = limit / 2
+			if limit < minItemLimit {
+				limit = minItemLimit
+			}
+			rlog.Warn().Err(err).Int("attempt", attempt).Int64("reduced-limit", limit).Dur("wait", wait).Msg("list timed out, reducing page size and retrying")
+		} else {
+			rlog.Warn().Err(err).Int("attempt", attempt).Dur("wait", wait).Msg("list failed, retrying")
+		}
+
+		time.Sleep(wait)
+		backoff *= 2
+		if backoff > listBackoffMax {
+			backoff = listBackoffMax
+		}
+		attempt++
+	}
+}
+
+// partialCoverage records, per rule and resource, the number of pages successfully processed before
+// retries were exhausted on a later page. It is intended for tests and operator visibility into runs
+// which didn't cover every object of a type.
+var partialCoverage = make(map[string]int)
+
+func recordPartialCoverage(rule *config.Rule, gv, resource string, pagesCompleted int, err error) {
+	key := rule.Registration.Name + "/" + gv + "/" + resource
+	partialCoverage[key] = pagesCompleted
+}
+
+// currentReport accumulates the outcome of every object examined by the running
+// ApplyRulesAgainstExistingObjects call, for the summary it logs (and optionally writes as JSON to
+// ReportPath) once the run completes. It starts out non-nil so that applyToObject can also be
+// exercised directly, as the tests do, without first going through ApplyRulesAgainstExistingObjects.
+var currentReport = newRunReport()
+
 // applyToObject takes a single kubernete object and decides whether to graffiti it or not.
 func applyToObject(rule *config.Rule, gv, resource string, object unstructured.Unstructured) (patched bool) {
 	mylog := log.ComponentLogger(componentName, "applyToObject")
@@ -283,41 +541,183 @@ func applyToObject(rule *config.Rule, gv, resource string, object unstructured.U
 	rlog := mylog.With().Str("rule", rule.Registration.Name).Str("group-version", gv).Str("kind", kind).Str("name", name).Str("namespace", namespace).Logger()
 	rlog.Debug().Msg("checking object")
 
-	// match against optional rule namespace selector
-	if rule.Registration.NamespaceSelector != "" {
-		match, err := objectsNamespaceMatchesProvidedSelector(object.Object, rule.Registration.NamespaceSelector, nsCache)
-		if err != nil {
-			rlog.Error().Err(err).Msg("error checking object against namespace selector")
-		}
-		if !match {
-			rlog.Debug().Msg("object does not match namespace selector")
-			return false
-		}
+	currentReport.recordExamined(rule.Registration.Name, namespace, kind)
+
+	if !ruleAppliesToObject(rule, object, rlog) {
+		return false
 	}
 
 	rlog.Info().Msg("applying graffiti mutate rule to existing object")
 	gr := graffiti.Rule{
-		Name:     rule.Registration.Name,
-		Matchers: rule.Matchers,
-		Payload:  rule.Payload,
+		Name:       rule.Registration.Name,
+		Matchers:   rule.Matchers,
+		Payload:    rule.Payload,
+		EvaluateOn: rule.EvaluateOn,
+		Budget:     rule.Budget,
 	}
 	raw, err := json.Marshal(object.Object)
 	if err != nil {
 		rlog.Error().Err(err).Msg("could not marshal object")
+		currentReport.recordErrored(rule.Registration.Name, namespace, kind, name, err.Error())
 		return false
 	}
+	rlog.Debug().Str("object", string(log.RedactObject(raw))).Msg("evaluating existing object against rule")
 	// call the graffiti package to evaluation the graffiti rule...
-	patch, err := gr.Mutate(raw)
+	patch, matched, err := gr.MutateExisting(context.Background(), raw)
 	if err != nil {
 		rlog.Error().Err(err).Msg("could not mutate object")
+		currentReport.recordErrored(rule.Registration.Name, namespace, kind, name, err.Error())
 		return false
 	}
 	if patch == nil {
+		if !matched {
+			return attemptUnpaint(rule, gv, resource, object, rlog)
+		}
 		rlog.Info().Msg("mutate did not create a patch")
 		return false
 	}
+	// Mutate's (nil, nil) return conflates "didn't match" with "matched but produced no patch", so
+	// we can only honestly call an object "matched" once we know a patch came out of it.
+	currentReport.recordMatched(rule.Registration.Name, namespace, kind)
+
+	if ValidatePatchResult {
+		if err := validatePatchResult(object, patch); err != nil {
+			rlog.Error().Err(err).Str("patch", string(patch)).Msg("computed patch would produce an invalid object, skipping")
+			currentReport.recordErrored(rule.Registration.Name, namespace, kind, name, err.Error())
+			return false
+		}
+	}
 
 	rlog.Debug().Str("patch", string(patch)).Msg("mutate produced a patch")
+
+	if DryRun {
+		diff, err := computeObjectDiff(rule.Registration.Name, namespace, kind, name, object, patch)
+		if err != nil {
+			rlog.Error().Err(err).Msg("dry-run: could not compute planned diff for object")
+			currentReport.recordErrored(rule.Registration.Name, namespace, kind, name, err.Error())
+			return false
+		}
+		currentDryRunReport.record(diff)
+		rlog.Info().Strs("added", diff.Added).Strs("removed", diff.Removed).Msg("dry-run: recorded planned change, not patching")
+		return false
+	}
+
+	if err := patchObject(gv, resource, kind, name, namespace, patch, []string{rule.Registration.Name}, rlog); err != nil {
+		queueForRetry(err, gv, resource, kind, name, namespace, patch, []string{rule.Registration.Name}, rlog)
+		return false
+	}
+	return true
+}
+
+// ruleAppliesToObject runs the checks that decide whether a rule should be evaluated against object
+// at all, independently of what the rule's payload would do to it: the existing-skip annotation, the
+// rule's namespace selector, and the controller-owned cascading-skip guard. Every outcome is recorded
+// against currentReport so that applyToObject and the CoalescePatches sweep in coalesce.go, which both
+// call this before evaluating a rule's payload, report identically.
+func ruleAppliesToObject(rule *config.Rule, object unstructured.Unstructured, rlog zerolog.Logger) bool {
+	kind := object.GetKind()
+	namespace := object.GetNamespace()
+
+	if object.GetAnnotations()[ExistingSkipAnnotationKey] == "true" {
+		rlog.Debug().Str("annotation", ExistingSkipAnnotationKey).Msg("object opts out of the existing sweep, skipping")
+		currentReport.recordSkipped(rule.Registration.Name, namespace, kind, "annotation")
+		return false
+	}
+
+	if kind == "Namespace" && rule.Registration.NamespaceSelectorAppliesToNamespaces == webhook.NamespaceSelectorAppliesToNamespacesSkip {
+		rlog.Debug().Msg("rule excludes namespaces from its namespace-selector handling, skipping")
+		currentReport.recordSkipped(rule.Registration.Name, namespace, kind, "namespace-selector-skip")
+		return false
+	}
+
+	// match against optional rule namespace selector
+	if rule.Registration.NamespaceSelector != "" {
+		match, err := MatchesNamespaceSelector(object.Object, rule.Registration.NamespaceSelector, nsCache)
+		if err != nil {
+			rlog.Error().Err(err).Msg("error checking object against namespace selector")
+			currentReport.recordErrored(rule.Registration.Name, namespace, kind, object.GetName(), err.Error())
+			return false
+		}
+		if !match {
+			rlog.Debug().Msg("object does not match namespace selector")
+			currentReport.recordSkipped(rule.Registration.Name, namespace, kind, "namespace-selector")
+			return false
+		}
+	}
+
+	if skip, ownerKind := rule.Payload.ShouldSkipControllerOwned(kind, object.GetOwnerReferences(), true); skip {
+		rlog.Debug().Str("owner-kind", ownerKind).Msg("object is owned by a controller that would immediately revert this mutation, skipping")
+		currentReport.recordSkipped(rule.Registration.Name, namespace, kind, ownerKind)
+		return false
+	}
+
+	if rule.RelatedObjects.Configured() {
+		found, err := hasRelatedObject(rule.RelatedObjects, object, rlog)
+		if err != nil {
+			rlog.Error().Err(err).Msg("error checking object against related-objects")
+			currentReport.recordErrored(rule.Registration.Name, namespace, kind, object.GetName(), err.Error())
+			return false
+		}
+		if !found {
+			rlog.Debug().Msg("object has no matching related object, skipping")
+			currentReport.recordSkipped(rule.Registration.Name, namespace, kind, "related-objects")
+			return false
+		}
+	}
+
+	return true
+}
+
+// buildApplyPatchBody converts patch, a JSON Patch this package produced (add/replace/delete
+// operations on whole object-valued paths such as /metadata/labels), into the partial object body a
+// server-side apply PATCH call expects: one specifying only the fields kube-graffiti intends to own,
+// identified by apiVersion/kind/name/namespace the same as any other object. A delete operation is
+// represented by leaving the field out of the body entirely - which is how server-side apply expects
+// ownership of a field to be relinquished - rather than by sending an explicit null.
+func buildApplyPatchBody(apiVersion, kind, name, namespace string, patch []byte) ([]byte, error) {
+	parsed, err := jsonpatch.FromString(string(patch))
+	if err != nil {
+		return nil, fmt.Errorf("could not parse computed patch: %v", err)
+	}
+
+	body := map[string]interface{}{
+		"apiVersion": apiVersion,
+		"kind":       kind,
+	}
+	if err := unstructured.SetNestedField(body, name, "metadata", "name"); err != nil {
+		return nil, fmt.Errorf("could not set metadata.name on apply body: %v", err)
+	}
+	if namespace != "" {
+		if err := unstructured.SetNestedField(body, namespace, "metadata", "namespace"); err != nil {
+			return nil, fmt.Errorf("could not set metadata.namespace on apply body: %v", err)
+		}
+	}
+
+	for _, op := range parsed.Operations {
+		if op.Op == jsonpatch.Remove {
+			continue
+		}
+		segments := strings.Split(strings.TrimPrefix(op.Path, "/"), "/")
+		if err := unstructured.SetNestedField(body, op.Value, segments...); err != nil {
+			return nil, fmt.Errorf("could not set %q on apply body: %v", op.Path, err)
+		}
+	}
+
+	return json.Marshal(body)
+}
+
+// patchObject issues a single apiserver Patch call for patch against the object identified by
+// gv/resource/kind/name/namespace, recording the outcome - patched, or errored - against every name
+// in ruleNames. Used both for a single matching rule and, by the CoalescePatches sweep in
+// coalesce.go, for a patch merged from several matching rules. When SSAConflictFallback is set, it
+// first tries a server-side apply of the same change and only issues the ordinary JSON patch once
+// that apply is rejected for a field-manager conflict.
+func patchObject(gv, resource, kind, name, namespace string, patch []byte, ruleNames []string, rlog zerolog.Logger) error {
+	if DryRun {
+		rlog.Debug().Str("patch", string(patch)).Msg("dry-run: not issuing a real patch")
+		return nil
+	}
+
 	g, v := splitGroupVersionString(gv)
 	grv := schema.GroupVersionResource{
 		Group:    g,
@@ -325,18 +725,78 @@ func applyToObject(rule *config.Rule, gv, resource string, object unstructured.U
 		Resource: resource,
 	}
 	ri := dynamicClient.Resource(grv)
-	if namespace == "" {
-		rlog.Debug().Msg("patching cluster level object")
-		_, err = ri.Patch(name, types.JSONPatchType, patch, metav1.PatchOptions{FieldManager: "kube-graffiti"})
-	} else {
-		rlog.Debug().Msg("patching namespaced object")
-		nri := ri.Namespace(namespace)
-		_, err = nri.Patch(name, types.JSONPatchType, patch, metav1.PatchOptions{FieldManager: "kube-graffiti"})
+
+	doPatch := func(pt types.PatchType, body []byte) (*unstructured.Unstructured, error) {
+		if namespace == "" {
+			return ri.Patch(name, pt, body, metav1.PatchOptions{FieldManager: "kube-graffiti"})
+		}
+		return ri.Namespace(namespace).Patch(name, pt, body, metav1.PatchOptions{FieldManager: "kube-graffiti"})
 	}
+
+	if SSAConflictFallback {
+		applyBody, buildErr := buildApplyPatchBody(gv, kind, name, namespace, patch)
+		if buildErr != nil {
+			rlog.Warn().Err(buildErr).Msg("could not build a server-side apply body for this patch, falling back to a json patch straight away")
+		} else if _, err := doPatch(types.ApplyPatchType, applyBody); err == nil {
+			rlog.Info().Str("patch", string(applyBody)).Msg("successfully applied object via server-side apply")
+			for _, ruleName := range ruleNames {
+				currentReport.recordPatched(ruleName, namespace, kind)
+				audit.RecordDecision(audit.Record{Rule: ruleName, Kind: kind, Name: name, Namespace: namespace, Operation: "existing-sweep", Decision: audit.DecisionPatched, Patch: string(applyBody)})
+			}
+			return nil
+		} else if !apierrors.IsConflict(err) {
+			rlog.Error().Err(err).Msg("failed to server-side apply object")
+			for _, ruleName := range ruleNames {
+				currentReport.recordErrored(ruleName, namespace, kind, name, err.Error())
+			}
+			return err
+		} else {
+			rlog.Warn().Err(err).Msg("server-side apply hit a field-manager conflict, falling back to a json patch")
+		}
+	}
+
+	_, err := doPatch(types.JSONPatchType, patch)
 	if err != nil {
 		rlog.Error().Err(err).Msg("failed to patch object")
-		return false
+		for _, ruleName := range ruleNames {
+			currentReport.recordErrored(ruleName, namespace, kind, name, err.Error())
+		}
+		return err
 	}
 	rlog.Info().Str("patch", string(patch)).Msg("successfully patched object")
-	return true
+	for _, ruleName := range ruleNames {
+		currentReport.recordPatched(ruleName, namespace, kind)
+		audit.RecordDecision(audit.Record{Rule: ruleName, Kind: kind, Name: name, Namespace: namespace, Operation: "existing-sweep", Decision: audit.DecisionPatched, Patch: string(patch)})
+	}
+	return nil
+}
+
+// validatePatchResult applies patch to a deep copy of object, using the same jsonpatch
+// implementation the rest of this codebase already vendors, and checks that the result still
+// unmarshals into a valid unstructured object with the same kind, apiVersion and name - catching a
+// patch that is well-formed JSON Patch but would leave the object structurally broken.
+func validatePatchResult(object unstructured.Unstructured, patch []byte) error {
+	parsed, err := jsonpatch.FromString(string(patch))
+	if err != nil {
+		return fmt.Errorf("could not parse computed patch: %v", err)
+	}
+
+	copied := object.DeepCopy()
+	if err := parsed.Apply(&copied.Object); err != nil {
+		return fmt.Errorf("could not apply computed patch to a copy of the object: %v", err)
+	}
+
+	raw, err := json.Marshal(copied.Object)
+	if err != nil {
+		return fmt.Errorf("could not marshal the patched copy of the object: %v", err)
+	}
+	var result unstructured.Unstructured
+	if err := json.Unmarshal(raw, &result); err != nil {
+		return fmt.Errorf("patched object no longer unmarshals: %v", err)
+	}
+
+	if result.GetKind() != object.GetKind() || result.GetAPIVersion() != object.GetAPIVersion() || result.GetName() != object.GetName() {
+		return fmt.Errorf("patched object's kind/apiVersion/name no longer matches the original: got kind=%q apiVersion=%q name=%q, want kind=%q apiVersion=%q name=%q", result.GetKind(), result.GetAPIVersion(), result.GetName(), object.GetKind(), object.GetAPIVersion(), object.GetName())
+	}
+	return nil
 }
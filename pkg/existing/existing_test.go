@@ -18,12 +18,15 @@ import (
 	"errors"
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/HotelsDotCom/kube-graffiti/pkg/config"
+	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
 	yaml "gopkg.in/yaml.v2"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime/schema"
@@ -409,6 +412,91 @@ payload:
 	assert.Equal(t, true, result, "applyToObject should have patched the object")
 }
 
+func TestPatchObjectFallsBackToAJSONPatchWhenServerSideApplyConflicts(t *testing.T) {
+	SSAConflictFallback = true
+	defer func() { SSAConflictFallback = false }()
+
+	nri := mockDynamicNamespaceableResourceInterface{}
+	nri.mockDynamicResourceInterface.On("Patch", "test-namespace", types.ApplyPatchType, mock.AnythingOfType("[]uint8"), mock.AnythingOfType("[]string")).
+		Return(nil, apierrors.NewConflict(schema.GroupResource{Resource: "namespaces"}, "test-namespace", nil))
+	nri.mockDynamicResourceInterface.On("Patch", "test-namespace", types.JSONPatchType, mock.AnythingOfType("[]uint8"), mock.AnythingOfType("[]string")).Return(nil, nil)
+	dc := mockDynamicInterface{}
+	dc.On("Resource", schema.GroupVersionResource{Group: "", Version: "v1", Resource: "namespaces"}).Return(&nri)
+	dynamicClient = &dc
+
+	err := patchObject("v1", "namespaces", "Namespace", "test-namespace", "", []byte(`[ { "op": "add", "path": "/metadata/labels", "value": { "added": "by-graffiti" } } ]`), []string{"add-a-label"}, zerolog.Nop())
+	nri.AssertExpectations(t)
+	dc.AssertExpectations(t)
+	assert.NoError(t, err, "a field-manager conflict on the apply attempt should be swallowed by the json patch fallback")
+}
+
+func TestCheckRuleQuarantinesAnExistingViolatingObjectInsteadOfBlockingIt(t *testing.T) {
+	// create a rule which blocks, but is enforced as a quarantine, objects with label fruit=apple
+	var ruleYaml = `---
+registration:
+  name: quarantine-apples
+  targets:
+  - api-groups:
+    - ""
+    api-versions:
+    - v1
+    resources:
+    - namespaces
+  failure-policy: Ignore
+matchers:
+  label-selectors:
+  - "fruit=apple"
+payload:
+  block: true
+  enforcement: quarantine
+  quarantine-label-key: policy.company.com/quarantined
+  quarantine-reason-annotation-key: policy.company.com/quarantine-reason
+`
+	var rule config.Rule
+	err := yaml.Unmarshal([]byte(ruleYaml), &rule)
+	require.NoError(t, err, "yaml unmarshalling of rule should not fail")
+
+	var resourceJSON = `{
+		"apiVersion": "v1",
+		"kind": "Namespace",
+		"metadata": {
+			"creationTimestamp": "2018-09-10T09:34:31Z",
+			"labels": {
+				"fruit": "apple",
+				"colour": "green"
+			},
+			"name": "test-namespace",
+			"resourceVersion": "561",
+			"selfLink": "/api/v1/namespaces/test-namespace",
+			"uid": "b8337c4c-b4dc-11e8-990c-08002722bfc3"
+		},
+		"spec": {
+			"finalizers": [
+				"kubernetes"
+			]
+		},
+		"status": {
+			"phase": "Active"
+		}
+	}`
+	var resourceObject unstructured.Unstructured
+	err = json.Unmarshal([]byte(resourceJSON), &resourceObject.Object)
+	require.NoError(t, err, "json unmarshalling of namespace resource should not fail")
+
+	// the quarantine marking is applied as an ordinary JSON patch - exactly like any other mutating
+	// rule - rather than the "BLOCK" sentinel a deny-enforcement block never gets this far with.
+	nri := mockDynamicNamespaceableResourceInterface{}
+	nri.mockDynamicResourceInterface.On("Patch", "test-namespace", types.JSONPatchType, mock.AnythingOfType("[]uint8"), mock.AnythingOfType("[]string")).Return(nil, nil)
+	dc := mockDynamicInterface{}
+	dc.On("Resource", schema.GroupVersionResource{Group: "", Version: "v1", Resource: "namespaces"}).Return(&nri)
+	dynamicClient = &dc
+
+	result := applyToObject(&rule, "v1", "namespaces", resourceObject)
+	nri.AssertExpectations(t)
+	dc.AssertExpectations(t)
+	assert.Equal(t, true, result, "applyToObject should have patched the object with the quarantine marking")
+}
+
 func TestCheckRuleDoesNotMatchObject(t *testing.T) {
 	// create a rule which adds a label to a namespace with label fruit=banana
 	var ruleYaml = `---
@@ -1152,7 +1240,7 @@ var unstructuredDeployListJSON = `{
 
 func TestTraverseKubePatchingAllNamespacesWildcardsInRegistration(t *testing.T) {
 	// A.K.A - the BIG one! :)
-	// create a rule which adds a label to all namespace with label fruit=apple
+	// create a rule which adds a label to all namespace with label fruit=apple, including subresources
 	var rulesYaml = `---
 - registration:
     name: add-a-label
@@ -1162,7 +1250,7 @@ func TestTraverseKubePatchingAllNamespacesWildcardsInRegistration(t *testing.T)
       api-versions:
       - "*"
       resources:
-      - "*"
+      - "*/*"
     failure-policy: Ignore
   matchers:
     label-selectors:
@@ -1225,3 +1313,722 @@ func TestTraverseKubePatchingAllNamespacesWildcardsInRegistration(t *testing.T)
 	dnri.AssertExpectations(t)
 	dc.AssertExpectations(t)
 }
+
+// TestTraverseKubeWithPlainWildcardSkipsSubresources is the companion to the BIG one above: a bare "*"
+// in resources targets deployments but must not touch deployments/scale or deployments/status, unlike
+// "*/*" which targets every main resource and its subresources.
+func TestTraverseKubeWithPlainWildcardSkipsSubresources(t *testing.T) {
+	var rulesYaml = `---
+- registration:
+    name: add-a-label
+    targets:
+    - api-groups:
+      - "apps"
+      api-versions:
+      - "*"
+      resources:
+      - "*"
+    failure-policy: Ignore
+  matchers:
+    label-selectors:
+    - "fruit=apple"
+  payload:
+    additions:
+      labels:
+        added: 'by-graffiti'
+`
+	var rules []config.Rule
+	err := yaml.Unmarshal([]byte(rulesYaml), &rules)
+	require.NoError(t, err, "yaml unmarshalling of rules should not fail")
+
+	discoveryClient = defaultTestDiscoveryClient(t)
+	err = discoverAPIsAndResources()
+	require.NoError(t, err, "we should not get an error loading in canned resource groups and resources")
+
+	nsCache = defaultTestNamespaceCache(t)
+
+	dl := new(unstructured.UnstructuredList)
+	err = json.Unmarshal([]byte(unstructuredDeployListJSON), dl)
+	require.NoError(t, err, "we should be able to unmarshal our canned deployment list into an UnstructuedList")
+
+	dri := mockDynamicResourceInterface{}
+	dri.On("Patch", "nginx", types.JSONPatchType, mock.AnythingOfType("[]uint8"), mock.AnythingOfType("[]string")).Return(nil, nil)
+	dnri := mockDynamicNamespaceableResourceInterface{}
+	dnri.mockDynamicResourceInterface.On("List", mock.AnythingOfType("v1.ListOptions")).Return(dl, nil)
+	dnri.On("Namespace", "test-namespace").Return(&dri)
+
+	// only the main "deployments" resource should ever be asked for - no On() is set up for
+	// "deployments/scale" or "deployments/status", so calling either would fail the test.
+	dc := mockDynamicInterface{}
+	dc.On("Resource", schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}).Return(&dnri)
+	dynamicClient = &dc
+
+	ApplyRulesAgainstExistingObjects(rules)
+	dri.AssertExpectations(t)
+	dnri.AssertExpectations(t)
+	dc.AssertExpectations(t)
+}
+
+func TestApplyToObjectSkipsObjectsWithTheExistingSkipAnnotation(t *testing.T) {
+	old := ExistingSkipAnnotationKey
+	defer func() { ExistingSkipAnnotationKey = old }()
+
+	var ruleYaml = `---
+registration:
+  name: add-a-label
+  targets:
+  - api-groups:
+    - ""
+    api-versions:
+    - v1
+    resources:
+    - namespaces
+  failure-policy: Ignore
+matchers:
+  label-selectors:
+  - "fruit=apple"
+payload:
+  additions:
+    labels:
+      added: 'by-graffiti'
+`
+	var rule config.Rule
+	err := yaml.Unmarshal([]byte(ruleYaml), &rule)
+	require.NoError(t, err, "yaml unmarshalling of rule should not fail")
+
+	var resourceJSON = `{
+		"apiVersion": "v1",
+		"kind": "Namespace",
+		"metadata": {
+			"labels": {
+				"fruit": "apple"
+			},
+			"annotations": {
+				"kube-graffiti.io/existing-skip": "true"
+			},
+			"name": "test-namespace"
+		}
+	}`
+	var resourceObject unstructured.Unstructured
+	err = json.Unmarshal([]byte(resourceJSON), &resourceObject.Object)
+	require.NoError(t, err, "json unmarshalling of namespace resource should not fail")
+
+	// a dynamic client with no expectations set - if applyToObject tries to patch, the mock will fail the test
+	dc := mockDynamicInterface{}
+	dynamicClient = &dc
+
+	result := applyToObject(&rule, "v1", "namespaces", resourceObject)
+	dc.AssertExpectations(t)
+	assert.Equal(t, false, result, "applyToObject should skip objects carrying the existing-skip annotation")
+}
+
+func TestApplyToObjectSkipsNamespacesWhenNamespaceSelectorAppliesToNamespacesIsSkip(t *testing.T) {
+	var ruleYaml = `---
+registration:
+  name: add-a-label
+  targets:
+  - api-groups:
+    - ""
+    api-versions:
+    - v1
+    resources:
+    - namespaces
+  namespace-selector: "fruit=apple"
+  namespace-selector-applies-to-namespaces: skip
+  failure-policy: Ignore
+matchers:
+  match-all: true
+payload:
+  additions:
+    labels:
+      added: 'by-graffiti'
+`
+	var rule config.Rule
+	err := yaml.Unmarshal([]byte(ruleYaml), &rule)
+	require.NoError(t, err, "yaml unmarshalling of rule should not fail")
+
+	var resourceJSON = `{
+		"apiVersion": "v1",
+		"kind": "Namespace",
+		"metadata": {
+			"labels": {
+				"fruit": "apple"
+			},
+			"name": "test-namespace"
+		}
+	}`
+	var resourceObject unstructured.Unstructured
+	err = json.Unmarshal([]byte(resourceJSON), &resourceObject.Object)
+	require.NoError(t, err, "json unmarshalling of namespace resource should not fail")
+
+	// a dynamic client with no expectations set - if applyToObject tries to patch, the mock will fail the test
+	dc := mockDynamicInterface{}
+	dynamicClient = &dc
+
+	result := applyToObject(&rule, "v1", "namespaces", resourceObject)
+	dc.AssertExpectations(t)
+	assert.Equal(t, false, result, "skip mode should exclude namespaces from the rule entirely, regardless of whether the namespace-selector itself would have matched")
+}
+
+func TestApplyToObjectSkipsWhenPatchResultValidationFails(t *testing.T) {
+	old := ValidatePatchResult
+	ValidatePatchResult = true
+	defer func() { ValidatePatchResult = old }()
+
+	var ruleYaml = `---
+registration:
+  name: corrupt-the-object
+  targets:
+  - api-groups:
+    - ""
+    api-versions:
+    - v1
+    resources:
+    - namespaces
+  failure-policy: Ignore
+matchers:
+  label-selectors:
+  - "fruit=apple"
+payload:
+  json-patch: |
+    [ { "op": "remove", "path": "/metadata/name" } ]
+`
+	var rule config.Rule
+	err := yaml.Unmarshal([]byte(ruleYaml), &rule)
+	require.NoError(t, err, "yaml unmarshalling of rule should not fail")
+
+	var resourceJSON = `{
+		"apiVersion": "v1",
+		"kind": "Namespace",
+		"metadata": {
+			"labels": {
+				"fruit": "apple"
+			},
+			"name": "test-namespace"
+		}
+	}`
+	var resourceObject unstructured.Unstructured
+	err = json.Unmarshal([]byte(resourceJSON), &resourceObject.Object)
+	require.NoError(t, err, "json unmarshalling of namespace resource should not fail")
+
+	// a dynamic client with no expectations set - if applyToObject tries to patch, the mock will fail the test
+	dc := mockDynamicInterface{}
+	dynamicClient = &dc
+
+	result := applyToObject(&rule, "v1", "namespaces", resourceObject)
+	dc.AssertExpectations(t)
+	assert.Equal(t, false, result, "applyToObject should skip a patch that would remove the object's own name")
+}
+
+func TestApplyToObjectAppliesAValidPatchEvenWithValidationEnabled(t *testing.T) {
+	old := ValidatePatchResult
+	ValidatePatchResult = true
+	defer func() { ValidatePatchResult = old }()
+
+	var ruleYaml = `---
+registration:
+  name: add-a-label
+  targets:
+  - api-groups:
+    - ""
+    api-versions:
+    - v1
+    resources:
+    - namespaces
+  failure-policy: Ignore
+matchers:
+  label-selectors:
+  - "fruit=apple"
+payload:
+  additions:
+    labels:
+      added: 'by-graffiti'
+`
+	var rule config.Rule
+	err := yaml.Unmarshal([]byte(ruleYaml), &rule)
+	require.NoError(t, err, "yaml unmarshalling of rule should not fail")
+
+	var resourceJSON = `{
+		"apiVersion": "v1",
+		"kind": "Namespace",
+		"metadata": {
+			"labels": {
+				"fruit": "apple"
+			},
+			"name": "test-namespace"
+		}
+	}`
+	var resourceObject unstructured.Unstructured
+	err = json.Unmarshal([]byte(resourceJSON), &resourceObject.Object)
+	require.NoError(t, err, "json unmarshalling of namespace resource should not fail")
+
+	dnri := mockDynamicNamespaceableResourceInterface{}
+	dnri.mockDynamicResourceInterface.On("Patch", "test-namespace", types.JSONPatchType, mock.AnythingOfType("[]uint8"), mock.AnythingOfType("[]string")).Return(nil, nil)
+	dc := mockDynamicInterface{}
+	dc.On("Resource", schema.GroupVersionResource{Group: "", Version: "v1", Resource: "namespaces"}).Return(&dnri)
+	dynamicClient = &dc
+
+	result := applyToObject(&rule, "v1", "namespaces", resourceObject)
+	dnri.AssertExpectations(t)
+	dc.AssertExpectations(t)
+	assert.Equal(t, true, result, "a patch that keeps the object structurally valid should still be applied")
+}
+
+func TestApplyToObjectRecordsAPlannedDiffAndDoesNotPatchWhenDryRun(t *testing.T) {
+	old := DryRun
+	DryRun = true
+	currentDryRunReport = newDryRunReport()
+	defer func() { DryRun = old }()
+
+	var ruleYaml = `---
+registration:
+  name: add-a-label
+  targets:
+  - api-groups:
+    - ""
+    api-versions:
+    - v1
+    resources:
+    - namespaces
+  failure-policy: Ignore
+matchers:
+  label-selectors:
+  - "fruit=apple"
+payload:
+  additions:
+    labels:
+      added: 'by-graffiti'
+`
+	var rule config.Rule
+	err := yaml.Unmarshal([]byte(ruleYaml), &rule)
+	require.NoError(t, err, "yaml unmarshalling of rule should not fail")
+
+	var matchingJSON = `{
+		"apiVersion": "v1",
+		"kind": "Namespace",
+		"metadata": {
+			"labels": {
+				"fruit": "apple"
+			},
+			"name": "matching-namespace"
+		}
+	}`
+	var matchingObject unstructured.Unstructured
+	require.NoError(t, json.Unmarshal([]byte(matchingJSON), &matchingObject.Object))
+
+	var nonMatchingJSON = `{
+		"apiVersion": "v1",
+		"kind": "Namespace",
+		"metadata": {
+			"labels": {
+				"fruit": "pear"
+			},
+			"name": "non-matching-namespace"
+		}
+	}`
+	var nonMatchingObject unstructured.Unstructured
+	require.NoError(t, json.Unmarshal([]byte(nonMatchingJSON), &nonMatchingObject.Object))
+
+	// a dynamic client with no expectations set - dry-run must never call through to patch a real object.
+	dc := mockDynamicInterface{}
+	dynamicClient = &dc
+
+	result := applyToObject(&rule, "v1", "namespaces", matchingObject)
+	assert.Equal(t, false, result, "dry-run never reports an object as patched")
+	applyToObject(&rule, "v1", "namespaces", nonMatchingObject)
+	dc.AssertExpectations(t)
+
+	require.Len(t, currentDryRunReport.diffs, 1, "only the matching object should appear in the diff report")
+	assert.Equal(t, "matching-namespace", currentDryRunReport.diffs[0].Name)
+	assert.Equal(t, []string{"added"}, currentDryRunReport.diffs[0].Added)
+}
+
+func podRuleYaml() string {
+	return `---
+registration:
+  name: add-a-label
+  targets:
+  - api-groups:
+    - ""
+    api-versions:
+    - v1
+    resources:
+    - pods
+  failure-policy: Ignore
+matchers:
+  label-selectors:
+  - "fruit=apple"
+payload:
+  additions:
+    labels:
+      added: 'by-graffiti'
+`
+}
+
+func podJSONOwnedByReplicaSet() string {
+	return `{
+		"apiVersion": "v1",
+		"kind": "Pod",
+		"metadata": {
+			"labels": {
+				"fruit": "apple"
+			},
+			"name": "nginx-abc123",
+			"namespace": "test-namespace",
+			"ownerReferences": [
+				{
+					"apiVersion": "apps/v1",
+					"kind": "ReplicaSet",
+					"name": "nginx-65899c769f",
+					"controller": true,
+					"uid": "3d542468-b537-11e8-990c-08002722bfc3"
+				}
+			]
+		}
+	}`
+}
+
+func TestApplyToObjectSkipsAPodOwnedByAControllerThatWouldRevertTheMutation(t *testing.T) {
+	var rule config.Rule
+	err := yaml.Unmarshal([]byte(podRuleYaml()), &rule)
+	require.NoError(t, err, "yaml unmarshalling of rule should not fail")
+
+	var resourceObject unstructured.Unstructured
+	err = json.Unmarshal([]byte(podJSONOwnedByReplicaSet()), &resourceObject.Object)
+	require.NoError(t, err, "json unmarshalling of pod resource should not fail")
+
+	// a dynamic client with no expectations set - if applyToObject tries to patch, the mock will fail the test
+	dc := mockDynamicInterface{}
+	dynamicClient = &dc
+
+	result := applyToObject(&rule, "v1", "pods", resourceObject)
+	dc.AssertExpectations(t)
+	assert.Equal(t, false, result, "applyToObject should skip a pod owned by a controller that would revert the mutation")
+}
+
+func TestApplyToObjectPatchesABarePodWithNoControllerOwner(t *testing.T) {
+	var rule config.Rule
+	err := yaml.Unmarshal([]byte(podRuleYaml()), &rule)
+	require.NoError(t, err, "yaml unmarshalling of rule should not fail")
+
+	var podJSON = `{
+		"apiVersion": "v1",
+		"kind": "Pod",
+		"metadata": {
+			"labels": {
+				"fruit": "apple"
+			},
+			"name": "standalone-pod",
+			"namespace": "test-namespace"
+		}
+	}`
+	var resourceObject unstructured.Unstructured
+	err = json.Unmarshal([]byte(podJSON), &resourceObject.Object)
+	require.NoError(t, err, "json unmarshalling of pod resource should not fail")
+
+	ri := mockDynamicResourceInterface{}
+	ri.On("Patch", "standalone-pod", types.JSONPatchType, mock.AnythingOfType("[]uint8"), mock.AnythingOfType("[]string")).Return(nil, nil)
+	nri := mockDynamicNamespaceableResourceInterface{}
+	nri.On("Namespace", "test-namespace").Return(&ri)
+	dc := mockDynamicInterface{}
+	dc.On("Resource", schema.GroupVersionResource{Group: "", Version: "v1", Resource: "pods"}).Return(&nri)
+	dynamicClient = &dc
+
+	result := applyToObject(&rule, "v1", "pods", resourceObject)
+	dc.AssertExpectations(t)
+	nri.AssertExpectations(t)
+	assert.Equal(t, true, result, "a pod with no controller owner should be patched normally")
+}
+
+func TestApplyToObjectPatchesAControllerOwnedPodWhenMutateControllerOwnedIsSet(t *testing.T) {
+	var ruleYaml = `---
+registration:
+  name: add-a-label
+  targets:
+  - api-groups:
+    - ""
+    api-versions:
+    - v1
+    resources:
+    - pods
+  failure-policy: Ignore
+matchers:
+  label-selectors:
+  - "fruit=apple"
+payload:
+  mutate-controller-owned: true
+  additions:
+    labels:
+      added: 'by-graffiti'
+`
+	var rule config.Rule
+	err := yaml.Unmarshal([]byte(ruleYaml), &rule)
+	require.NoError(t, err, "yaml unmarshalling of rule should not fail")
+
+	var resourceObject unstructured.Unstructured
+	err = json.Unmarshal([]byte(podJSONOwnedByReplicaSet()), &resourceObject.Object)
+	require.NoError(t, err, "json unmarshalling of pod resource should not fail")
+
+	ri := mockDynamicResourceInterface{}
+	ri.On("Patch", "nginx-abc123", types.JSONPatchType, mock.AnythingOfType("[]uint8"), mock.AnythingOfType("[]string")).Return(nil, nil)
+	nri := mockDynamicNamespaceableResourceInterface{}
+	nri.On("Namespace", "test-namespace").Return(&ri)
+	dc := mockDynamicInterface{}
+	dc.On("Resource", schema.GroupVersionResource{Group: "", Version: "v1", Resource: "pods"}).Return(&nri)
+	dynamicClient = &dc
+
+	result := applyToObject(&rule, "v1", "pods", resourceObject)
+	dc.AssertExpectations(t)
+	nri.AssertExpectations(t)
+	assert.Equal(t, true, result, "mutate-controller-owned should override the default cascading skip")
+}
+
+// withFastRetries shrinks the retry backoff to keep these tests quick, restoring the real values afterwards.
+func withFastRetries(t *testing.T) {
+	origBase, origMax := listBackoffBase, listBackoffMax
+	listBackoffBase = time.Millisecond
+	listBackoffMax = time.Millisecond
+	t.Cleanup(func() {
+		listBackoffBase = origBase
+		listBackoffMax = origMax
+	})
+}
+
+// withoutAPIHealthBackoff clears any apiserver health error window left behind by a previous test
+// and raises HealthBackoffErrorThreshold out of reach, so that tests which aren't themselves
+// exercising the apiserver health backoff can't accidentally trip it and pause.
+func withoutAPIHealthBackoff(t *testing.T) {
+	origThreshold := HealthBackoffErrorThreshold
+	HealthBackoffErrorThreshold = 1000000
+	resetAPIHealthErrors()
+	t.Cleanup(func() {
+		HealthBackoffErrorThreshold = origThreshold
+		resetAPIHealthErrors()
+	})
+}
+
+// withFastAPIHealthBackoff shrinks the apiserver health backoff timings and lowers its error
+// threshold to keep tests of the health-backoff feature itself quick and deterministic, restoring
+// the real values and clearing the error window afterwards.
+func withFastAPIHealthBackoff(t *testing.T, threshold int) {
+	origThreshold, origWindow, origBase, origMax := HealthBackoffErrorThreshold, HealthBackoffWindow, HealthBackoffBase, HealthBackoffMax
+	HealthBackoffErrorThreshold = threshold
+	HealthBackoffWindow = time.Minute
+	HealthBackoffBase = time.Millisecond
+	HealthBackoffMax = time.Millisecond
+	resetAPIHealthErrors()
+	t.Cleanup(func() {
+		HealthBackoffErrorThreshold = origThreshold
+		HealthBackoffWindow = origWindow
+		HealthBackoffBase = origBase
+		HealthBackoffMax = origMax
+		resetAPIHealthErrors()
+	})
+}
+
+func TestListPageWithRetrySucceedsAfterTooManyRequests(t *testing.T) {
+	withFastRetries(t)
+	withoutAPIHealthBackoff(t)
+
+	ulns := &unstructured.UnstructuredList{Object: map[string]interface{}{"metadata": map[string]interface{}{}}}
+	rc := new(mockDynamicResourceInterface)
+	rc.On("List", metav1.ListOptions{Limit: 100}).Return((*unstructured.UnstructuredList)(nil), apierrors.NewTooManyRequests("slow down", 0)).Once()
+	rc.On("List", metav1.ListOptions{Limit: 100}).Return(ulns, nil).Once()
+
+	stop := make(chan struct{})
+	list, limit, err := listPageWithRetry(rc, 100, "", stop, zerolog.Nop())
+	require.NoError(t, err)
+	assert.Equal(t, int64(100), limit, "page size should be unchanged after a 429, only a timeout shrinks it")
+	assert.Equal(t, ulns, list)
+	rc.AssertExpectations(t)
+}
+
+func TestListPageWithRetryExhaustsAndReturnsError(t *testing.T) {
+	withFastRetries(t)
+	withoutAPIHealthBackoff(t)
+
+	rc := new(mockDynamicResourceInterface)
+	rc.On("List", mock.AnythingOfType("v1.ListOptions")).Return((*unstructured.UnstructuredList)(nil), apierrors.NewServerTimeout(schema.GroupResource{Resource: "deployments"}, "list", 0))
+
+	stop := make(chan struct{})
+	_, _, err := listPageWithRetry(rc, 100, "", stop, zerolog.Nop())
+	require.Error(t, err, "retries should be exhausted after listMaxAttempts failures")
+	rc.AssertNumberOfCalls(t, "List", listMaxAttempts)
+}
+
+func TestListPageWithRetryHalvesPageSizeOnRepeatedTimeouts(t *testing.T) {
+	withFastRetries(t)
+	withoutAPIHealthBackoff(t)
+
+	ulns := &unstructured.UnstructuredList{Object: map[string]interface{}{"metadata": map[string]interface{}{}}}
+	rc := new(mockDynamicResourceInterface)
+	rc.On("List", metav1.ListOptions{Limit: 100}).Return((*unstructured.UnstructuredList)(nil), apierrors.NewServerTimeout(schema.GroupResource{Resource: "deployments"}, "list", 0)).Once()
+	rc.On("List", metav1.ListOptions{Limit: 50}).Return(ulns, nil).Once()
+
+	stop := make(chan struct{})
+	list, limit, err := listPageWithRetry(rc, 100, "", stop, zerolog.Nop())
+	require.NoError(t, err)
+	assert.Equal(t, int64(50), limit, "the page size should have halved after a timeout")
+	assert.Equal(t, ulns, list)
+	rc.AssertExpectations(t)
+}
+
+func TestApplyToAllResourcesOfTypeRecordsPartialCoverageWhenRetriesExhausted(t *testing.T) {
+	withFastRetries(t)
+	withoutAPIHealthBackoff(t)
+
+	var ruleYaml = `---
+registration:
+  name: add-a-label
+  targets:
+  - api-groups:
+    - ""
+    resources:
+    - namespaces
+  failure-policy: Ignore
+matchers:
+  label-selectors:
+  - "fruit=apple"
+payload:
+  additions:
+    labels:
+      added: 'by-graffiti'
+`
+	var rule config.Rule
+	err := yaml.Unmarshal([]byte(ruleYaml), &rule)
+	require.NoError(t, err, "yaml unmarshalling of rule should not fail")
+
+	rc := new(mockDynamicNamespaceableResourceInterface)
+	rc.mockDynamicResourceInterface.On("List", mock.AnythingOfType("v1.ListOptions")).Return((*unstructured.UnstructuredList)(nil), apierrors.NewServerTimeout(schema.GroupResource{Resource: "namespaces"}, "list", 0))
+	dc := mockDynamicInterface{}
+	dc.On("Resource", schema.GroupVersionResource{Group: "", Version: "v1", Resource: "namespaces"}).Return(rc)
+	dynamicClient = &dc
+
+	delete(partialCoverage, "add-a-label/v1/namespaces")
+	stop := make(chan struct{})
+	runErr := applyToAllResourcesOfType(&rule, "v1", metav1.APIResource{Name: "namespaces"}, stop)
+	assert.NoError(t, runErr, "failure-policy Ignore should not fail the run")
+	assert.Contains(t, partialCoverage, "add-a-label/v1/namespaces", "the resource should be recorded as partially covered")
+	assert.Equal(t, 0, partialCoverage["add-a-label/v1/namespaces"], "no pages should have completed before retries were exhausted")
+}
+
+func TestIsTransportOrServerError(t *testing.T) {
+	assert.True(t, isTransportOrServerError(apierrors.NewTooManyRequests("slow down", 0)))
+	assert.True(t, isTransportOrServerError(apierrors.NewServerTimeout(schema.GroupResource{Resource: "namespaces"}, "list", 0)))
+	assert.True(t, isTransportOrServerError(apierrors.NewServiceUnavailable("down for maintenance")))
+	assert.True(t, isTransportOrServerError(apierrors.NewInternalError(errors.New("boom"))))
+	assert.False(t, isTransportOrServerError(apierrors.NewNotFound(schema.GroupResource{Resource: "namespaces"}, "missing")))
+	assert.False(t, isTransportOrServerError(nil))
+}
+
+// TestListPageWithRetryPausesAndResumesOnAnAPIHealthBurst simulates a burst of transport errors
+// dense enough to cross HealthBackoffErrorThreshold, and asserts that the run pauses, probes
+// discovery, and resumes once the probe succeeds - without the burst's own errors exhausting this
+// call's listMaxAttempts budget, since they're evidence of an apiserver-wide outage rather than a
+// problem specific to this resource.
+func TestListPageWithRetryPausesAndResumesOnAnAPIHealthBurst(t *testing.T) {
+	withFastRetries(t)
+	withFastAPIHealthBackoff(t, 3)
+
+	ulns := &unstructured.UnstructuredList{Object: map[string]interface{}{"metadata": map[string]interface{}{}}}
+	rc := new(mockDynamicResourceInterface)
+	tooMany := apierrors.NewTooManyRequests("slow down", 0)
+	rc.On("List", metav1.ListOptions{Limit: 100}).Return((*unstructured.UnstructuredList)(nil), tooMany).Times(3)
+	rc.On("List", metav1.ListOptions{Limit: 100}).Return(ulns, nil).Once()
+
+	dc := &mockDiscoveryClient{}
+	discoveryClient = dc
+	dc.On("ServerGroups").Return((*metav1.APIGroupList)(nil), errors.New("apiserver still unreachable")).Once()
+	dc.On("ServerGroups").Return(&metav1.APIGroupList{}, nil).Once()
+
+	stop := make(chan struct{})
+	list, limit, err := listPageWithRetry(rc, 100, "", stop, zerolog.Nop())
+	require.NoError(t, err)
+	assert.Equal(t, ulns, list)
+	assert.Equal(t, int64(100), limit)
+
+	rc.AssertExpectations(t)
+	dc.AssertExpectations(t)
+	assert.Equal(t, HealthStatus{}, CurrentHealthStatus(), "the run should no longer be paused once a probe has succeeded")
+}
+
+// TestListPageWithRetryAPIHealthBurstDoesNotTripPartialCoverage checks that a resource whose List
+// calls only fail during an apiserver-wide health pause is not recorded as partially covered - the
+// errors that caused the pause aren't evidence this particular resource is a problem.
+func TestListPageWithRetryAPIHealthBurstDoesNotTripPartialCoverage(t *testing.T) {
+	withFastRetries(t)
+	withFastAPIHealthBackoff(t, 2)
+
+	var ruleYaml = `---
+registration:
+  name: add-a-label
+  targets:
+  - api-groups:
+    - ""
+    resources:
+    - namespaces
+  failure-policy: Ignore
+matchers:
+  label-selectors:
+  - "fruit=apple"
+payload:
+  additions:
+    labels:
+      added: 'by-graffiti'
+`
+	var rule config.Rule
+	err := yaml.Unmarshal([]byte(ruleYaml), &rule)
+	require.NoError(t, err, "yaml unmarshalling of rule should not fail")
+
+	ulns := &unstructured.UnstructuredList{Object: map[string]interface{}{"metadata": map[string]interface{}{}}}
+	rc := new(mockDynamicNamespaceableResourceInterface)
+	timeout := apierrors.NewServerTimeout(schema.GroupResource{Resource: "namespaces"}, "list", 0)
+	rc.mockDynamicResourceInterface.On("List", mock.AnythingOfType("v1.ListOptions")).Return((*unstructured.UnstructuredList)(nil), timeout).Times(2)
+	rc.mockDynamicResourceInterface.On("List", mock.AnythingOfType("v1.ListOptions")).Return(ulns, nil).Once()
+	dc := mockDynamicInterface{}
+	dc.On("Resource", schema.GroupVersionResource{Group: "", Version: "v1", Resource: "namespaces"}).Return(rc)
+	dynamicClient = &dc
+
+	mdc := &mockDiscoveryClient{}
+	discoveryClient = mdc
+	mdc.On("ServerGroups").Return(&metav1.APIGroupList{}, nil).Once()
+
+	delete(partialCoverage, "add-a-label/v1/namespaces")
+	stop := make(chan struct{})
+	runErr := applyToAllResourcesOfType(&rule, "v1", metav1.APIResource{Name: "namespaces"}, stop)
+	assert.NoError(t, runErr)
+	assert.NotContains(t, partialCoverage, "add-a-label/v1/namespaces", "the resource should not be recorded as partially covered by errors that were actually an apiserver-wide outage")
+	rc.AssertExpectations(t)
+	mdc.AssertExpectations(t)
+}
+
+// TestPauseForAPIHealthReturnsPromptlyWhenStopped checks that a paused run does not hold up
+// shutdown - closing stop should return pauseForAPIHealth immediately rather than waiting out its
+// backoff.
+func TestPauseForAPIHealthReturnsPromptlyWhenStopped(t *testing.T) {
+	origBase, origMax := HealthBackoffBase, HealthBackoffMax
+	HealthBackoffBase = 10 * time.Second
+	HealthBackoffMax = 10 * time.Second
+	t.Cleanup(func() {
+		HealthBackoffBase = origBase
+		HealthBackoffMax = origMax
+		resetAPIHealthErrors()
+	})
+
+	stop := make(chan struct{})
+	close(stop)
+
+	done := make(chan struct{})
+	start := time.Now()
+	go func() {
+		pauseForAPIHealth(stop, zerolog.Nop())
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		assert.True(t, time.Since(start) < time.Second, "pauseForAPIHealth should return promptly once stop is closed")
+	case <-time.After(time.Second):
+		t.Fatal("pauseForAPIHealth did not return promptly when stop was closed")
+	}
+}
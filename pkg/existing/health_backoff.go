@@ -0,0 +1,164 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package existing
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/HotelsDotCom/kube-graffiti/pkg/httpresponse"
+	"github.com/rs/zerolog"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// HealthBackoffErrorThreshold is how many transport-level or 5xx errors, observed across every
+// resource and rule in the running existing-objects sweep, within HealthBackoffWindow, are taken
+// as evidence that the apiserver itself is unhealthy (e.g. mid rolling-upgrade) rather than a
+// one-off blip against a single resource. Crossing it pauses the whole run, via pauseForAPIHealth,
+// instead of letting every resource burn through its own retry budget against a server that isn't
+// going to answer any of them.
+var HealthBackoffErrorThreshold = 10
+
+// HealthBackoffWindow is the sliding window HealthBackoffErrorThreshold is measured over.
+var HealthBackoffWindow = 30 * time.Second
+
+// HealthBackoffBase is how long a paused run initially waits before its first health probe.
+// Each failed probe doubles the wait, up to HealthBackoffMax.
+var HealthBackoffBase = 5 * time.Second
+
+// HealthBackoffMax caps how long a paused run can end up waiting between health probes.
+var HealthBackoffMax = 2 * time.Minute
+
+// HealthStatus is the apiserver health backoff state exposed by ServeHealthStatus.
+type HealthStatus struct {
+	Paused      bool      `json:"paused"`
+	Since       time.Time `json:"since,omitempty"`
+	ProbeErrors int       `json:"probe-errors,omitempty"`
+}
+
+var (
+	healthMu     sync.Mutex
+	healthErrors []time.Time
+	health       HealthStatus
+)
+
+// CurrentHealthStatus reports whether the running existing-objects sweep is currently paused
+// waiting for the apiserver to recover.
+func CurrentHealthStatus() HealthStatus {
+	healthMu.Lock()
+	defer healthMu.Unlock()
+	return health
+}
+
+// ServeHealthStatus writes CurrentHealthStatus as JSON, for registering against an operator-facing
+// status endpoint such as /existing/status on the health-checker http server.
+func ServeHealthStatus(w http.ResponseWriter, r *http.Request) {
+	httpresponse.WriteJSON(w, http.StatusOK, CurrentHealthStatus())
+}
+
+// recordAPIHealthError notes a transport-level/5xx error observed while talking to the apiserver
+// and reports whether HealthBackoffErrorThreshold has now been crossed within HealthBackoffWindow -
+// in which case the caller should pause the whole run via pauseForAPIHealth rather than continuing
+// to retry the resource it was working on.
+func recordAPIHealthError(now time.Time) bool {
+	healthMu.Lock()
+	defer healthMu.Unlock()
+
+	cutoff := now.Add(-HealthBackoffWindow)
+	fresh := healthErrors[:0]
+	for _, t := range healthErrors {
+		if t.After(cutoff) {
+			fresh = append(fresh, t)
+		}
+	}
+	healthErrors = append(fresh, now)
+	return len(healthErrors) >= HealthBackoffErrorThreshold
+}
+
+// resetAPIHealthErrors clears the error window once the apiserver is confirmed healthy again, so
+// that a handful of isolated errors afterwards don't immediately re-trigger another pause.
+func resetAPIHealthErrors() {
+	healthMu.Lock()
+	defer healthMu.Unlock()
+	healthErrors = nil
+}
+
+// isTransportOrServerError reports whether err looks like a problem with the apiserver itself - a
+// dropped connection or a 429/5xx - rather than a problem specific to the request being made (e.g.
+// a 404 or a validation failure), which is what recordAPIHealthError's density check is meant to
+// catch.
+func isTransportOrServerError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if apierrors.IsTooManyRequests(err) || apierrors.IsTimeout(err) || apierrors.IsServerTimeout(err) || apierrors.IsServiceUnavailable(err) || apierrors.IsInternalError(err) {
+		return true
+	}
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// pauseForAPIHealth pauses the whole existing-objects run once recordAPIHealthError has reported
+// the apiserver is unhealthy. It waits HealthBackoffBase, then probes cheaply via the discovery
+// client's ServerGroups call - the same call discoverAPIsAndResources already relies on - doubling
+// the wait, up to HealthBackoffMax, after every failed probe, until one succeeds. It returns
+// immediately, without completing the pause, if stop is closed, so that shutdown is never held up
+// behind an apiserver outage.
+func pauseForAPIHealth(stop <-chan struct{}, rlog zerolog.Logger) {
+	healthMu.Lock()
+	health = HealthStatus{Paused: true, Since: time.Now()}
+	healthMu.Unlock()
+	defer func() {
+		healthMu.Lock()
+		health = HealthStatus{}
+		healthMu.Unlock()
+	}()
+
+	wait := HealthBackoffBase
+	probeErrors := 0
+	for {
+		rlog.Warn().Dur("pause", wait).Int("probe-errors", probeErrors).Msg("pausing the existing-objects run: the apiserver looks unhealthy")
+		select {
+		case <-time.After(wait):
+		case <-stop:
+			return
+		}
+
+		_, err := discoveryClient.ServerGroups()
+		if err == nil {
+			rlog.Info().Msg("apiserver health probe succeeded, resuming the existing-objects run")
+			resetAPIHealthErrors()
+			return
+		}
+
+		probeErrors++
+		healthMu.Lock()
+		health.ProbeErrors = probeErrors
+		healthMu.Unlock()
+		rlog.Warn().Err(err).Int("probe-errors", probeErrors).Msg("apiserver health probe failed, backing off further")
+
+		wait *= 2
+		if wait > HealthBackoffMax {
+			wait = HealthBackoffMax
+		}
+	}
+}
@@ -15,9 +15,12 @@ package existing
 
 import (
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/HotelsDotCom/kube-graffiti/pkg/log"
+	"github.com/HotelsDotCom/kube-graffiti/pkg/metrics"
+	"github.com/rs/zerolog"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
@@ -38,6 +41,55 @@ type namespaceCache struct {
 	store     cache.Indexer
 	reflector *cache.Reflector
 	getter    namespaceGetter
+	// fetchGroup deduplicates concurrent LookupNamespace fallback calls for the same namespace, so that
+	// e.g. bulk namespace creation doesn't send the apiserver dozens of identical Gets within the same
+	// 100ms. It is nil for a namespaceCache built directly as a struct literal (as the older tests in
+	// this package do), in which case LookupNamespace simply skips deduplication.
+	fetchGroup *namespaceFetchGroup
+}
+
+// namespaceFetchGroup shares one in-flight namespaceGetter.Get call between every concurrent caller
+// asking for the same namespace name, modelled on golang.org/x/sync/singleflight.Group - which isn't
+// vendored in this repository - but narrowed to the one call shape LookupNamespace needs.
+type namespaceFetchGroup struct {
+	mu    sync.Mutex
+	calls map[string]*namespaceFetchCall
+}
+
+// namespaceFetchCall is the in-flight (or, once call.wg is done, completed) result of a single Get for
+// one namespace name, shared by every caller that arrived while it was in flight.
+type namespaceFetchCall struct {
+	wg  sync.WaitGroup
+	ns  *corev1.Namespace
+	err error
+}
+
+func newNamespaceFetchGroup() *namespaceFetchGroup {
+	return &namespaceFetchGroup{calls: make(map[string]*namespaceFetchCall)}
+}
+
+// do runs fn for name, or - if a call for name is already in flight - waits for that call's result
+// instead of starting a second one. shared reports whether the caller was given another caller's result.
+func (g *namespaceFetchGroup) do(name string, fn func() (*corev1.Namespace, error)) (ns *corev1.Namespace, err error, shared bool) {
+	g.mu.Lock()
+	if call, ok := g.calls[name]; ok {
+		g.mu.Unlock()
+		call.wg.Wait()
+		return call.ns, call.err, true
+	}
+	call := &namespaceFetchCall{}
+	call.wg.Add(1)
+	g.calls[name] = call
+	g.mu.Unlock()
+
+	call.ns, call.err = fn()
+
+	g.mu.Lock()
+	delete(g.calls, name)
+	g.mu.Unlock()
+	call.wg.Done()
+
+	return call.ns, call.err, false
 }
 
 // namespaceListerWatcherGetter implements the cache.ListerWatcher interface.
@@ -86,9 +138,10 @@ func NewNamespaceCache(rest *rest.Config) (namespaceCache, error) {
 	store, reflector := cache.NewNamespaceKeyedIndexerAndReflector(lwg, ns, time.Duration(refreshPeriodSeconds*time.Second))
 
 	return namespaceCache{
-		store:     store,
-		reflector: reflector,
-		getter:    lwg,
+		store:      store,
+		reflector:  reflector,
+		getter:     lwg,
+		fetchGroup: newNamespaceFetchGroup(),
 	}, nil
 }
 
@@ -106,6 +159,7 @@ func (c namespaceCache) LookupNamespace(name string) (*corev1.Namespace, error)
 	if c.store == nil {
 		return &corev1.Namespace{}, fmt.Errorf("the store is nil - not initialized")
 	}
+	metrics.NamespaceCacheSize.Set(int64(len(c.store.ListKeys())))
 	ns, exists, err := c.store.GetByKey(name)
 	if err != nil {
 		mylog.Error().Err(err).Msg("error looking up namespace in cache")
@@ -113,8 +167,47 @@ func (c namespaceCache) LookupNamespace(name string) (*corev1.Namespace, error)
 	}
 	if !exists {
 		mylog.Warn().Msg("namespace not found in cache, falling back to api call")
-		return c.getter.Get(name, metav1.GetOptions{})
+		metrics.NamespaceCacheMisses.Observe(name, 1)
+		return c.fallbackGet(name, mylog)
 	}
 
+	metrics.NamespaceCacheHits.Observe(name, 1)
 	return ns.(*corev1.Namespace), nil
 }
+
+// fallbackGet fetches name directly from the apiserver, sharing a single in-flight call between every
+// concurrent caller asking for the same namespace (see namespaceFetchGroup) and, on success, inserting
+// the result into the store so that later lookups hit the cache even before the reflector catches up. A
+// failed Get is never inserted into the store - it isn't a result worth caching.
+func (c namespaceCache) fallbackGet(name string, mylog zerolog.Logger) (*corev1.Namespace, error) {
+	get := func() (*corev1.Namespace, error) {
+		metrics.NamespaceCacheFallbackCalls.Observe(name, 1)
+		return c.getter.Get(name, metav1.GetOptions{})
+	}
+
+	start := time.Now()
+	var ns *corev1.Namespace
+	var err error
+	var shared bool
+	if c.fetchGroup != nil {
+		ns, err, shared = c.fetchGroup.do(name, get)
+	} else {
+		ns, err = get()
+	}
+	metrics.NamespaceCacheFallbackLatencyMillis.Observe(name, time.Since(start).Milliseconds())
+	if shared {
+		metrics.NamespaceCacheSingleflightShared.Observe(name, 1)
+	}
+	if err != nil {
+		metrics.NamespaceCacheFallbackErrors.Observe(name, 1)
+		return ns, err
+	}
+
+	// Add upserts regardless of whether the reflector has already (or since) written its own copy, so
+	// this can never leave the store holding a namespace the reflector no longer thinks exists.
+	if err := c.store.Add(ns); err != nil {
+		mylog.Error().Err(err).Msg("failed to insert namespace fetched via fallback into the cache store")
+	}
+	metrics.NamespaceCacheSize.Set(int64(len(c.store.ListKeys())))
+	return ns, nil
+}
@@ -15,11 +15,13 @@ package existing
 
 import (
 	"errors"
+	"sync"
 	"testing"
 	"time"
 
 	"encoding/json"
 
+	"github.com/HotelsDotCom/kube-graffiti/pkg/metrics"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
@@ -290,6 +292,102 @@ func TestCacheMissFallsBackToGetter(t *testing.T) {
 	assert.Equal(t, "kube-system", ns.Name, "we should have got the kube-system namespace back")
 }
 
+func TestConcurrentCacheMissesForTheSameNamespaceShareOneGetAndAllSucceed(t *testing.T) {
+	receivedNS := new(corev1.Namespace)
+	err := json.Unmarshal([]byte(kubeSystem), receivedNS)
+	require.NoError(t, err)
+
+	lwg := new(mockNamespaceListerWatcherGetter)
+	lwg.On("Get", "kube-system", mock.AnythingOfType("v1.GetOptions")).
+		Run(func(mock.Arguments) { time.Sleep(50 * time.Millisecond) }).
+		Return(receivedNS, nil).
+		Once()
+
+	store := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{"namespace": cache.MetaNamespaceIndexFunc})
+	mycache := namespaceCache{
+		store:      store,
+		getter:     lwg,
+		fetchGroup: newNamespaceFetchGroup(),
+	}
+
+	const concurrentCallers = 10
+	var wg sync.WaitGroup
+	results := make([]*corev1.Namespace, concurrentCallers)
+	errs := make([]error, concurrentCallers)
+	for i := 0; i < concurrentCallers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = mycache.LookupNamespace("kube-system")
+		}(i)
+	}
+	wg.Wait()
+
+	lwg.AssertExpectations(t)
+	lwg.AssertNumberOfCalls(t, "Get", 1)
+	for i := 0; i < concurrentCallers; i++ {
+		assert.NoError(t, errs[i])
+		require.NotNil(t, results[i])
+		assert.Equal(t, "kube-system", results[i].Name)
+	}
+
+	cached, exists, err := store.GetByKey("kube-system")
+	require.NoError(t, err)
+	assert.True(t, exists, "the fallback result should have been inserted into the store")
+	assert.Equal(t, "kube-system", cached.(*corev1.Namespace).Name)
+}
+
+func TestCacheHitIncrementsTheHitCounter(t *testing.T) {
+	mycache := defaultTestNamespaceCache(t)
+	before := metrics.NamespaceCacheHits.Count("kube-system")
+
+	ns, err := mycache.LookupNamespace("kube-system")
+	assert.NoError(t, err)
+	assert.NotNil(t, ns)
+
+	assert.Equal(t, before+1, metrics.NamespaceCacheHits.Count("kube-system"))
+}
+
+func TestCacheMissIncrementsTheMissCounter(t *testing.T) {
+	receivedNS := new(corev1.Namespace)
+	err := json.Unmarshal([]byte(kubeSystem), receivedNS)
+	require.NoError(t, err)
+
+	lwg := new(mockNamespaceListerWatcherGetter)
+	lwg.On("Get", "kube-system", mock.AnythingOfType("v1.GetOptions")).Return(receivedNS, nil)
+
+	store := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{"namespace": cache.MetaNamespaceIndexFunc})
+	mycache := namespaceCache{
+		store:     store,
+		reflector: nil,
+		getter:    lwg,
+	}
+	before := metrics.NamespaceCacheMisses.Count("kube-system")
+
+	ns, err := mycache.LookupNamespace("kube-system")
+	assert.NoError(t, err)
+	assert.NotNil(t, ns)
+
+	assert.Equal(t, before+1, metrics.NamespaceCacheMisses.Count("kube-system"))
+}
+
+func TestFallbackGetErrorIncrementsTheFallbackErrorCounter(t *testing.T) {
+	lwg := new(mockNamespaceListerWatcherGetter)
+	lwg.On("Get", "elvis", mock.AnythingOfType("v1.GetOptions")).Return(&corev1.Namespace{}, errors.New("elvis is not here"))
+
+	store := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{"namespace": cache.MetaNamespaceIndexFunc})
+	mycache := namespaceCache{
+		store:  store,
+		getter: lwg,
+	}
+	before := metrics.NamespaceCacheFallbackErrors.Count("elvis")
+
+	_, err := mycache.LookupNamespace("elvis")
+	assert.Error(t, err)
+
+	assert.Equal(t, before+1, metrics.NamespaceCacheFallbackErrors.Count("elvis"))
+}
+
 func TestLookupOfNonExistentNamespace(t *testing.T) {
 	nl := new(corev1.NamespaceList)
 	err := json.Unmarshal([]byte(testNamespaceList), nl)
@@ -19,14 +19,38 @@ import (
 
 	"github.com/HotelsDotCom/kube-graffiti/pkg/graffiti"
 	"github.com/HotelsDotCom/kube-graffiti/pkg/log"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 )
 
-// objectsNamespaceMatchesProvidedSelector decides whether the object/object's namespace matches the namespace selector provided.
+// MissingNamespacePolicy controls how MatchesNamespaceSelector behaves when an
+// object's namespace can't be found by the namespace cache/getter - most commonly because the
+// namespace is mid-termination. "error" (the default) propagates the lookup error so the caller logs
+// it, which is appropriate for a namespace that is missing unexpectedly. "no-match" and "skip" both
+// treat the object as not matching the namespace selector without raising an error, so a sweep run
+// doesn't spam errors for namespaces that are simply being deleted; they differ only in their debug
+// log message, to help an operator tell the two configured intents apart when troubleshooting.
+var MissingNamespacePolicy = MissingNamespaceError
+
+const (
+	MissingNamespaceError   = "error"
+	MissingNamespaceNoMatch = "no-match"
+	MissingNamespaceSkip    = "skip"
+)
+
+// NamespaceLookup abstracts looking up a namespace by name, so that MatchesNamespaceSelector can be
+// driven either by the live namespaceCache, backed by a cluster, or by another source of namespaces
+// entirely, such as the mutate-stream command replaying namespace objects seen earlier in its input.
+type NamespaceLookup interface {
+	LookupNamespace(name string) (*corev1.Namespace, error)
+}
+
+// MatchesNamespaceSelector decides whether the object/object's namespace matches the namespace selector provided.
 // If the object is a namespace then it uses its own labels, otherwise the namespace is looked up and used.
 // Cluster scoped objects can not match a namespace selector.
 // Namespaces without labels can match a namespace selector with a negative match expression.
-func objectsNamespaceMatchesProvidedSelector(obj map[string]interface{}, selector string, nsc namespaceCache) (bool, error) {
-	mylog := log.ComponentLogger(componentName, "objectsNamespaceMatchesProvidedSelector")
+func MatchesNamespaceSelector(obj map[string]interface{}, selector string, nsc NamespaceLookup) (bool, error) {
+	mylog := log.ComponentLogger(componentName, "MatchesNamespaceSelector")
 	mlog := mylog.With().Str("selector", selector).Logger()
 	var labels map[string]string
 
@@ -56,6 +80,10 @@ func objectsNamespaceMatchesProvidedSelector(obj map[string]interface{}, selecto
 		// lookup namespace from the cache
 		ns, err := nsc.LookupNamespace(name)
 		if err != nil {
+			if apierrors.IsNotFound(err) && MissingNamespacePolicy != MissingNamespaceError {
+				mlog.Debug().Str("namespace", name).Str("treat-missing-namespace-as", MissingNamespacePolicy).Msg("object's namespace no longer exists, treating it as configured rather than erroring")
+				return false, nil
+			}
 			return false, err
 		}
 		labels = ns.Labels
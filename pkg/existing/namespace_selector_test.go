@@ -18,10 +18,26 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
 	yaml "gopkg.in/yaml.v2"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/cache"
 )
 
+// namespaceCacheWithMissingNamespace returns a namespaceCache whose store is a cache miss for every
+// key, so that a lookup always falls through to the getter, and whose getter returns a NotFound error.
+func namespaceCacheWithMissingNamespace(t *testing.T) namespaceCache {
+	lwg := new(mockNamespaceListerWatcherGetter)
+	lwg.On("Get", "test-namespace", mock.AnythingOfType("v1.GetOptions")).
+		Return((*corev1.Namespace)(nil), apierrors.NewNotFound(schema.GroupResource{Resource: "namespaces"}, "test-namespace"))
+
+	store := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{"namespace": cache.MetaNamespaceIndexFunc})
+	return namespaceCache{store: store, getter: lwg}
+}
+
 var (
 	jsonNamespace = `{
 		"apiVersion": "v1",
@@ -209,7 +225,7 @@ func TestNamespaceSelectorAgainstANamespaceMatchesItsLabelsTestSuccess(t *testin
 	err := json.Unmarshal([]byte(jsonNamespace), &ns)
 	require.NoError(t, err)
 
-	result, err := objectsNamespaceMatchesProvidedSelector(ns, "fruit = apple", namespaceCache{})
+	result, err := MatchesNamespaceSelector(ns, "fruit = apple", namespaceCache{})
 	assert.NoError(t, err, "it should be able to match again the fruit label in this namespace")
 	assert.Equal(t, true, result, "the match result should be true")
 }
@@ -219,7 +235,7 @@ func TestNamespaceSelectorAgainstANamespaceMatchesItsLabelsTestFail(t *testing.T
 	err := json.Unmarshal([]byte(jsonNamespace), &ns)
 	require.NoError(t, err)
 
-	result, err := objectsNamespaceMatchesProvidedSelector(ns, "fruit = banana", namespaceCache{})
+	result, err := MatchesNamespaceSelector(ns, "fruit = banana", namespaceCache{})
 	assert.NoError(t, err, "it should be able to match again the fruit label in this namespace")
 	assert.Equal(t, false, result, "the match result should be false")
 }
@@ -229,7 +245,7 @@ func TestNamespaceSelectorAgainstANamespaceInvalidSelector(t *testing.T) {
 	err := json.Unmarshal([]byte(jsonNamespace), &ns)
 	require.NoError(t, err)
 
-	result, err := objectsNamespaceMatchesProvidedSelector(ns, "this is not a correct label selector", namespaceCache{})
+	result, err := MatchesNamespaceSelector(ns, "this is not a correct label selector", namespaceCache{})
 	assert.Error(t, err, "we should get an error caused by the bad selector")
 	assert.Equal(t, false, result, "the match result should be false")
 }
@@ -237,7 +253,7 @@ func TestNamespaceSelectorAgainstANamespaceInvalidSelector(t *testing.T) {
 func TestNamespaceSelectorAgainstObjectWithoutMetadata(t *testing.T) {
 	ns := make(map[string]interface{})
 
-	result, err := objectsNamespaceMatchesProvidedSelector(ns, "fruit = apple", namespaceCache{})
+	result, err := MatchesNamespaceSelector(ns, "fruit = apple", namespaceCache{})
 	assert.Error(t, err, "we should get an error caused by the lack of metadata")
 	assert.Errorf(t, err, "object has no metadata", "we should get the right error message")
 	assert.Equal(t, false, result, "the match result should be false")
@@ -249,7 +265,7 @@ func TestLookupOfObjectWithoutKindIsHandled(t *testing.T) {
 	require.NoError(t, err)
 	delete(ns, "kind")
 
-	result, err := objectsNamespaceMatchesProvidedSelector(ns, "fruit = apple", namespaceCache{})
+	result, err := MatchesNamespaceSelector(ns, "fruit = apple", namespaceCache{})
 	assert.Error(t, err, "we should get an error caused by the lack of kind")
 	assert.Errorf(t, err, "this object seems to have no kind", "we should get the right error message")
 	assert.Equal(t, false, result, "the match result should be false")
@@ -299,7 +315,7 @@ func TestAClusterScopedObjectCanNotMatchANamespaceSelector(t *testing.T) {
 	err := json.Unmarshal([]byte(jsonClusterRole), &role)
 	require.NoError(t, err)
 
-	result, err := objectsNamespaceMatchesProvidedSelector(role, "fruit = apple", namespaceCache{})
+	result, err := MatchesNamespaceSelector(role, "fruit = apple", namespaceCache{})
 	assert.NoError(t, err, "we should not get an error when evaluating a cluster scoped object against a namespace selector")
 	assert.Equal(t, false, result, "the match result should be false, the object is not namespaced or a namespace so shouldn't match")
 }
@@ -313,7 +329,7 @@ func TestNamespaceSelectorAgainstAnObjectsNamespaceMatch(t *testing.T) {
 	mycache := defaultTestNamespaceCache(t)
 
 	// finally check our deploy - which will invoke the looking up of its namespace
-	result, err := objectsNamespaceMatchesProvidedSelector(deploy, "fruit=apple", mycache)
+	result, err := MatchesNamespaceSelector(deploy, "fruit=apple", mycache)
 	assert.NoError(t, err, "we should not get an error")
 	assert.Equal(t, true, result, "the match result should be true because the namespace test-namespace does match the selector")
 }
@@ -327,7 +343,46 @@ func TestNamespaceSelectorAgainstAnObjectsMiss(t *testing.T) {
 	mycache := defaultTestNamespaceCache(t)
 
 	// finally check our deploy - which will invoke the looking up of its namespace
-	result, err := objectsNamespaceMatchesProvidedSelector(deploy, "fruit=elvis", mycache)
+	result, err := MatchesNamespaceSelector(deploy, "fruit=elvis", mycache)
 	assert.NoError(t, err, "we should not get an error")
 	assert.Equal(t, false, result, "should be false, elvis does not match apple")
 }
+
+func TestMissingNamespacePolicyErrorPropagatesTheNotFoundError(t *testing.T) {
+	orig := MissingNamespacePolicy
+	MissingNamespacePolicy = MissingNamespaceError
+	defer func() { MissingNamespacePolicy = orig }()
+
+	var deploy map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(jsonDeploy), &deploy))
+
+	result, err := MatchesNamespaceSelector(deploy, "fruit=apple", namespaceCacheWithMissingNamespace(t))
+	assert.Error(t, err, "the default policy should propagate the namespace's NotFound error")
+	assert.Equal(t, false, result)
+}
+
+func TestMissingNamespacePolicyNoMatchSuppressesTheError(t *testing.T) {
+	orig := MissingNamespacePolicy
+	MissingNamespacePolicy = MissingNamespaceNoMatch
+	defer func() { MissingNamespacePolicy = orig }()
+
+	var deploy map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(jsonDeploy), &deploy))
+
+	result, err := MatchesNamespaceSelector(deploy, "fruit=apple", namespaceCacheWithMissingNamespace(t))
+	assert.NoError(t, err, "the no-match policy should treat a missing namespace as not matching, without an error")
+	assert.Equal(t, false, result)
+}
+
+func TestMissingNamespacePolicySkipSuppressesTheError(t *testing.T) {
+	orig := MissingNamespacePolicy
+	MissingNamespacePolicy = MissingNamespaceSkip
+	defer func() { MissingNamespacePolicy = orig }()
+
+	var deploy map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(jsonDeploy), &deploy))
+
+	result, err := MatchesNamespaceSelector(deploy, "fruit=apple", namespaceCacheWithMissingNamespace(t))
+	assert.NoError(t, err, "the skip policy should treat a missing namespace as not matching, without an error")
+	assert.Equal(t, false, result)
+}
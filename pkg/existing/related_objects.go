@@ -0,0 +1,55 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package existing
+
+import (
+	"fmt"
+
+	"github.com/HotelsDotCom/kube-graffiti/pkg/config"
+	"github.com/rs/zerolog"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// hasRelatedObject reports whether there is at least one object of related's secondary resource type,
+// in the same namespace as object (or cluster-wide, if object is cluster-scoped), sharing object's
+// value for related.Label - e.g. whether a Service has a same-namespace Pod carrying the same "app"
+// label. This performs a fresh List call, scoped server-side by the shared label value, every time it
+// is asked: a rule with related-objects configured issues one extra List per matched primary object,
+// not just once per sweep, so it should be reserved for a handful of rules doing genuinely relational
+// targeting rather than used as a general-purpose filter across a large resource.
+func hasRelatedObject(related config.RelatedObjects, object unstructured.Unstructured, rlog zerolog.Logger) (bool, error) {
+	value, ok := object.GetLabels()[related.Label]
+	if !ok {
+		rlog.Debug().Str("label", related.Label).Msg("object does not carry the related-objects label, treating as unrelated")
+		return false, nil
+	}
+
+	grv := schema.GroupVersionResource{Group: related.APIGroup, Version: related.APIVersion, Resource: related.Resource}
+	ri := dynamicClient.Resource(grv)
+	lo := metav1.ListOptions{LabelSelector: fmt.Sprintf("%s=%s", related.Label, value), Limit: 1}
+
+	var list *unstructured.UnstructuredList
+	var err error
+	if object.GetNamespace() != "" {
+		list, err = ri.Namespace(object.GetNamespace()).List(lo)
+	} else {
+		list, err = ri.List(lo)
+	}
+	if err != nil {
+		return false, fmt.Errorf("could not list related %s objects: %v", related.Resource, err)
+	}
+	return len(list.Items) > 0, nil
+}
@@ -0,0 +1,158 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package existing
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/HotelsDotCom/kube-graffiti/pkg/config"
+	"github.com/HotelsDotCom/kube-graffiti/pkg/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	yaml "gopkg.in/yaml.v2"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+var relatedObjectsConfig = config.RelatedObjects{APIGroup: "", APIVersion: "v1", Resource: "pods", Label: "app"}
+
+func testPrimaryService(t *testing.T) unstructured.Unstructured {
+	var serviceJSON = `{
+		"apiVersion": "v1",
+		"kind": "Service",
+		"metadata": {
+			"name": "frontend",
+			"namespace": "test-namespace",
+			"labels": {
+				"app": "frontend"
+			}
+		}
+	}`
+	var object unstructured.Unstructured
+	require.NoError(t, json.Unmarshal([]byte(serviceJSON), &object.Object))
+	return object
+}
+
+func TestHasRelatedObjectReturnsTrueWhenAMatchingSecondaryObjectExists(t *testing.T) {
+	pods := new(unstructured.UnstructuredList)
+	require.NoError(t, json.Unmarshal([]byte(`{"apiVersion":"v1","kind":"PodList","items":[{"apiVersion":"v1","kind":"Pod","metadata":{"name":"frontend-abc123"}}]}`), pods))
+
+	pri := mockDynamicResourceInterface{}
+	pri.On("List", mock.AnythingOfType("v1.ListOptions")).Return(pods, nil)
+	pnri := mockDynamicNamespaceableResourceInterface{}
+	pnri.On("Namespace", "test-namespace").Return(&pri)
+
+	dc := mockDynamicInterface{}
+	dc.On("Resource", schema.GroupVersionResource{Group: "", Version: "v1", Resource: "pods"}).Return(&pnri)
+	dynamicClient = &dc
+
+	found, err := hasRelatedObject(relatedObjectsConfig, testPrimaryService(t), log.ComponentLogger(componentName, "test"))
+	assert.NoError(t, err)
+	assert.True(t, found)
+	dc.AssertExpectations(t)
+	pri.AssertExpectations(t)
+}
+
+func TestHasRelatedObjectReturnsFalseWhenNoSecondaryObjectMatches(t *testing.T) {
+	pods := new(unstructured.UnstructuredList)
+	require.NoError(t, json.Unmarshal([]byte(`{"apiVersion":"v1","kind":"PodList","items":[]}`), pods))
+
+	pri := mockDynamicResourceInterface{}
+	pri.On("List", mock.AnythingOfType("v1.ListOptions")).Return(pods, nil)
+	pnri := mockDynamicNamespaceableResourceInterface{}
+	pnri.On("Namespace", "test-namespace").Return(&pri)
+
+	dc := mockDynamicInterface{}
+	dc.On("Resource", schema.GroupVersionResource{Group: "", Version: "v1", Resource: "pods"}).Return(&pnri)
+	dynamicClient = &dc
+
+	found, err := hasRelatedObject(relatedObjectsConfig, testPrimaryService(t), log.ComponentLogger(componentName, "test"))
+	assert.NoError(t, err)
+	assert.False(t, found)
+}
+
+func TestHasRelatedObjectReturnsFalseWithoutQueryingWhenThePrimaryObjectLacksTheLabel(t *testing.T) {
+	object := testPrimaryService(t)
+	object.SetLabels(nil)
+
+	// a dynamic client with no expectations set - if hasRelatedObject queries it, the mock will fail the test
+	dc := mockDynamicInterface{}
+	dynamicClient = &dc
+
+	found, err := hasRelatedObject(relatedObjectsConfig, object, log.ComponentLogger(componentName, "test"))
+	assert.NoError(t, err)
+	assert.False(t, found)
+	dc.AssertExpectations(t)
+}
+
+func TestHasRelatedObjectReturnsAnErrorWhenTheSecondaryListFails(t *testing.T) {
+	pri := mockDynamicResourceInterface{}
+	pri.On("List", mock.AnythingOfType("v1.ListOptions")).Return(new(unstructured.UnstructuredList), errors.New("boom"))
+	pnri := mockDynamicNamespaceableResourceInterface{}
+	pnri.On("Namespace", "test-namespace").Return(&pri)
+
+	dc := mockDynamicInterface{}
+	dc.On("Resource", schema.GroupVersionResource{Group: "", Version: "v1", Resource: "pods"}).Return(&pnri)
+	dynamicClient = &dc
+
+	_, err := hasRelatedObject(relatedObjectsConfig, testPrimaryService(t), log.ComponentLogger(componentName, "test"))
+	assert.Error(t, err)
+}
+
+func TestApplyToObjectSkipsAPrimaryObjectWithNoRelatedSecondaryObject(t *testing.T) {
+	var ruleYaml = `---
+registration:
+  name: add-a-label
+  targets:
+  - api-groups:
+    - ""
+    api-versions:
+    - v1
+    resources:
+    - services
+  failure-policy: Ignore
+related-objects:
+  api-version: v1
+  resource: pods
+  label: app
+matchers:
+  match-all: true
+payload:
+  additions:
+    labels:
+      added: 'by-graffiti'
+`
+	var rule config.Rule
+	require.NoError(t, yaml.Unmarshal([]byte(ruleYaml), &rule))
+
+	pods := new(unstructured.UnstructuredList)
+	require.NoError(t, json.Unmarshal([]byte(`{"apiVersion":"v1","kind":"PodList","items":[]}`), pods))
+
+	pri := mockDynamicResourceInterface{}
+	pri.On("List", mock.AnythingOfType("v1.ListOptions")).Return(pods, nil)
+	pnri := mockDynamicNamespaceableResourceInterface{}
+	pnri.On("Namespace", "test-namespace").Return(&pri)
+
+	// a dynamic client only expecting the related-objects lookup - if applyToObject tries to patch, the mock will fail the test
+	dc := mockDynamicInterface{}
+	dc.On("Resource", schema.GroupVersionResource{Group: "", Version: "v1", Resource: "pods"}).Return(&pnri)
+	dynamicClient = &dc
+
+	result := applyToObject(&rule, "v1", "services", testPrimaryService(t))
+	dc.AssertExpectations(t)
+	assert.Equal(t, false, result, "applyToObject should skip primary objects that have no matching related object")
+}
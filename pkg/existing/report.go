@@ -0,0 +1,352 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package existing
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// ReportPath, when set (via the existing-report-path configuration key), additionally writes the JSON
+// variant of the run report to this file, so it can be attached to a ticket alongside the text version
+// that is always logged at Info.
+var ReportPath = ""
+
+// RunStatus is a point-in-time snapshot of the most recently completed existing-objects sweep,
+// exposed by CurrentRunStatus for an operator-facing status page. Ran is false until the first
+// ApplyRulesAgainstExistingObjects run has published its report.
+type RunStatus struct {
+	Ran             bool      `json:"ran"`
+	At              time.Time `json:"at,omitempty"`
+	Patched         int64     `json:"patched"`
+	Errored         int64     `json:"errored"`
+	TruncatedErrors int       `json:"truncated-errors,omitempty"`
+}
+
+var (
+	lastRunMu sync.Mutex
+	lastRun   RunStatus
+)
+
+// CurrentRunStatus reports the outcome of the most recently completed existing-objects sweep, for
+// registering against an operator-facing status endpoint.
+func CurrentRunStatus() RunStatus {
+	lastRunMu.Lock()
+	defer lastRunMu.Unlock()
+	return lastRun
+}
+
+// ReportNamespaceCardinalityCap bounds how many distinct namespaces are broken out per rule in the run
+// report before the remainder are folded into the overflowNamespace bucket, so that a cluster with
+// thousands of namespaces doesn't turn the report itself into a memory problem.
+var ReportNamespaceCardinalityCap = 50
+
+// ReportMaxErroredObjects bounds how many individual errored objects the run report lists by name and
+// reason; once the cap is reached, further errors still count towards the aggregate error totals but are
+// no longer listed individually.
+var ReportMaxErroredObjects = 100
+
+// overflowNamespace is the bucket that namespaces beyond ReportNamespaceCardinalityCap are folded into.
+const overflowNamespace = "<other>"
+
+// objectCounts tallies the outcomes recorded against every object examined for one rule/namespace/kind
+// combination during a run.
+type objectCounts struct {
+	Examined int64 `json:"examined"`
+	Matched  int64 `json:"matched"`
+	Patched  int64 `json:"patched"`
+	Skipped  int64 `json:"skipped"`
+	Errored  int64 `json:"errored"`
+}
+
+// erroredObject records enough about one failed object to go and find it again, without keeping a copy
+// of the object itself.
+type erroredObject struct {
+	Rule      string `json:"rule"`
+	Namespace string `json:"namespace"`
+	Kind      string `json:"kind"`
+	Name      string `json:"name"`
+	Reason    string `json:"reason"`
+}
+
+// runReport accumulates the outcome of every object examined during one ApplyRulesAgainstExistingObjects
+// run, so that a single human- and machine-readable summary can be produced at the end of it - the
+// artifact management wants attached to the ticket that triggered the run. ApplyRulesAgainstExistingObjects
+// runs its rules sequentially rather than concurrently, so - like the pre-existing partialCoverage var -
+// this needs no locking of its own.
+type runReport struct {
+	// counts[rule][namespace][kind] - namespace is capped at ReportNamespaceCardinalityCap distinct
+	// values per rule, with the overflow folded into overflowNamespace.
+	counts map[string]map[string]map[string]*objectCounts
+	// namespacesSeen tracks, per rule, which namespaces have already been broken out, so the cap can be
+	// enforced without namespace keys continuing to grow once it's reached.
+	namespacesSeen  map[string]map[string]bool
+	errors          []erroredObject
+	truncatedErrors int
+	// skipReasons[rule][reason] counts why objects were skipped, e.g. "annotation", "namespace-selector",
+	// or an owning controller's Kind such as "Deployment", so an operator can tell at a glance whether a
+	// low patched count is down to selectors or to the controller-owned cascading skip.
+	skipReasons map[string]map[string]int64
+}
+
+func newRunReport() *runReport {
+	return &runReport{
+		counts:         make(map[string]map[string]map[string]*objectCounts),
+		namespacesSeen: make(map[string]map[string]bool),
+		skipReasons:    make(map[string]map[string]int64),
+	}
+}
+
+// bucket returns the namespace key that rule's objects should be recorded against, applying the
+// cardinality cap.
+func (r *runReport) bucket(rule, namespace string) string {
+	if r.namespacesSeen[rule] == nil {
+		r.namespacesSeen[rule] = make(map[string]bool)
+	}
+	if r.namespacesSeen[rule][namespace] {
+		return namespace
+	}
+	if len(r.namespacesSeen[rule]) >= ReportNamespaceCardinalityCap {
+		return overflowNamespace
+	}
+	r.namespacesSeen[rule][namespace] = true
+	return namespace
+}
+
+func (r *runReport) counter(rule, namespace, kind string) *objectCounts {
+	ns := r.bucket(rule, namespace)
+	if r.counts[rule] == nil {
+		r.counts[rule] = make(map[string]map[string]*objectCounts)
+	}
+	if r.counts[rule][ns] == nil {
+		r.counts[rule][ns] = make(map[string]*objectCounts)
+	}
+	if r.counts[rule][ns][kind] == nil {
+		r.counts[rule][ns][kind] = &objectCounts{}
+	}
+	return r.counts[rule][ns][kind]
+}
+
+func (r *runReport) recordExamined(rule, namespace, kind string) {
+	r.counter(rule, namespace, kind).Examined++
+}
+func (r *runReport) recordSkipped(rule, namespace, kind, reason string) {
+	r.counter(rule, namespace, kind).Skipped++
+	if r.skipReasons[rule] == nil {
+		r.skipReasons[rule] = make(map[string]int64)
+	}
+	r.skipReasons[rule][reason]++
+}
+func (r *runReport) recordMatched(rule, namespace, kind string) {
+	r.counter(rule, namespace, kind).Matched++
+}
+func (r *runReport) recordPatched(rule, namespace, kind string) {
+	r.counter(rule, namespace, kind).Patched++
+}
+
+func (r *runReport) recordErrored(rule, namespace, kind, name, reason string) {
+	r.counter(rule, namespace, kind).Errored++
+	if len(r.errors) >= ReportMaxErroredObjects {
+		r.truncatedErrors++
+		return
+	}
+	r.errors = append(r.errors, erroredObject{Rule: rule, Namespace: namespace, Kind: kind, Name: name, Reason: reason})
+}
+
+// ruleNamespaceKindCounts is one row of the flattened, report's per-rule/namespace/kind breakdown.
+type ruleNamespaceKindCounts struct {
+	Rule      string `json:"rule"`
+	Namespace string `json:"namespace"`
+	Kind      string `json:"kind"`
+	objectCounts
+}
+
+// namespaceTotal is one row of the top-namespaces-by-change-count table.
+type namespaceTotal struct {
+	Namespace string `json:"namespace"`
+	Patched   int64  `json:"patched"`
+}
+
+// ruleReasonCount is one row of the skip-reasons table, counting how many objects a rule skipped for a
+// given reason.
+type ruleReasonCount struct {
+	Rule   string `json:"rule"`
+	Reason string `json:"reason"`
+	Count  int64  `json:"count"`
+}
+
+// reportSummary is a fully flattened, deterministically ordered snapshot of a runReport, ready to be
+// rendered as JSON or as a text table. Ordering every slice here, rather than leaving map iteration order
+// in the output, is what makes two identical runs produce byte-identical reports.
+type reportSummary struct {
+	Breakdown       []ruleNamespaceKindCounts `json:"breakdown"`
+	TopNamespaces   []namespaceTotal          `json:"top_namespaces"`
+	SkipReasons     []ruleReasonCount         `json:"skip_reasons,omitempty"`
+	Errors          []erroredObject           `json:"errors"`
+	TruncatedErrors int                       `json:"truncated_errors,omitempty"`
+}
+
+// summary flattens and sorts the report into a reportSummary.
+func (r *runReport) summary() reportSummary {
+	var breakdown []ruleNamespaceKindCounts
+	namespaceTotals := make(map[string]int64)
+	for rule, byNamespace := range r.counts {
+		for namespace, byKind := range byNamespace {
+			for kind, c := range byKind {
+				breakdown = append(breakdown, ruleNamespaceKindCounts{Rule: rule, Namespace: namespace, Kind: kind, objectCounts: *c})
+				namespaceTotals[namespace] += c.Patched
+			}
+		}
+	}
+	sort.Slice(breakdown, func(i, j int) bool {
+		if breakdown[i].Rule != breakdown[j].Rule {
+			return breakdown[i].Rule < breakdown[j].Rule
+		}
+		if breakdown[i].Namespace != breakdown[j].Namespace {
+			return breakdown[i].Namespace < breakdown[j].Namespace
+		}
+		return breakdown[i].Kind < breakdown[j].Kind
+	})
+
+	var top []namespaceTotal
+	for ns, patched := range namespaceTotals {
+		top = append(top, namespaceTotal{Namespace: ns, Patched: patched})
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Patched != top[j].Patched {
+			return top[i].Patched > top[j].Patched
+		}
+		return top[i].Namespace < top[j].Namespace
+	})
+	if len(top) > 10 {
+		top = top[:10]
+	}
+
+	errs := append([]erroredObject(nil), r.errors...)
+	sort.Slice(errs, func(i, j int) bool {
+		if errs[i].Rule != errs[j].Rule {
+			return errs[i].Rule < errs[j].Rule
+		}
+		if errs[i].Namespace != errs[j].Namespace {
+			return errs[i].Namespace < errs[j].Namespace
+		}
+		return errs[i].Name < errs[j].Name
+	})
+
+	var skipReasons []ruleReasonCount
+	for rule, byReason := range r.skipReasons {
+		for reason, count := range byReason {
+			skipReasons = append(skipReasons, ruleReasonCount{Rule: rule, Reason: reason, Count: count})
+		}
+	}
+	sort.Slice(skipReasons, func(i, j int) bool {
+		if skipReasons[i].Rule != skipReasons[j].Rule {
+			return skipReasons[i].Rule < skipReasons[j].Rule
+		}
+		return skipReasons[i].Reason < skipReasons[j].Reason
+	})
+
+	return reportSummary{Breakdown: breakdown, TopNamespaces: top, SkipReasons: skipReasons, Errors: errs, TruncatedErrors: r.truncatedErrors}
+}
+
+// toJSON renders summary as deterministic, indented JSON - encoding/json already sorts map keys, and
+// summary() has already sorted every slice, so two identical runs marshal to identical bytes.
+func (s reportSummary) toJSON() (string, error) {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// toText renders summary as a human-readable table suitable for pasting straight into a ticket.
+func (s reportSummary) toText() string {
+	var b strings.Builder
+	w := tabwriter.NewWriter(&b, 0, 4, 2, ' ', 0)
+
+	fmt.Fprintln(w, "RULE\tNAMESPACE\tKIND\tEXAMINED\tMATCHED\tPATCHED\tSKIPPED\tERRORED")
+	for _, row := range s.Breakdown {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%d\t%d\t%d\n", row.Rule, row.Namespace, row.Kind, row.Examined, row.Matched, row.Patched, row.Skipped, row.Errored)
+	}
+	w.Flush()
+
+	b.WriteString("\nTOP NAMESPACES BY CHANGE COUNT\n")
+	w = tabwriter.NewWriter(&b, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAMESPACE\tPATCHED")
+	for _, t := range s.TopNamespaces {
+		fmt.Fprintf(w, "%s\t%d\n", t.Namespace, t.Patched)
+	}
+	w.Flush()
+
+	if len(s.SkipReasons) > 0 {
+		b.WriteString("\nSKIP REASONS\n")
+		w = tabwriter.NewWriter(&b, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "RULE\tREASON\tCOUNT")
+		for _, sr := range s.SkipReasons {
+			fmt.Fprintf(w, "%s\t%s\t%d\n", sr.Rule, sr.Reason, sr.Count)
+		}
+		w.Flush()
+	}
+
+	if len(s.Errors) > 0 || s.TruncatedErrors > 0 {
+		b.WriteString("\nERRORED OBJECTS\n")
+		w = tabwriter.NewWriter(&b, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "RULE\tNAMESPACE\tKIND\tNAME\tREASON")
+		for _, e := range s.Errors {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", e.Rule, e.Namespace, e.Kind, e.Name, e.Reason)
+		}
+		w.Flush()
+		if s.TruncatedErrors > 0 {
+			fmt.Fprintf(&b, "... and %d more errored object(s) not shown\n", s.TruncatedErrors)
+		}
+	}
+
+	return b.String()
+}
+
+// publish logs the text report at Info as a single multi-line block and, when ReportPath is set, writes
+// the JSON variant to that file. There is no GraffitiRun custom resource or run-status ConfigMap in this
+// codebase to publish the JSON variant to yet - once one lands, this is the place to add it.
+func (r *runReport) publish(mylog zerolog.Logger) {
+	summary := r.summary()
+	mylog.Info().Msg("existing-objects run report:\n" + summary.toText())
+
+	status := RunStatus{Ran: true, At: time.Now(), TruncatedErrors: summary.TruncatedErrors, Errored: int64(len(summary.Errors)) + int64(summary.TruncatedErrors)}
+	for _, row := range summary.Breakdown {
+		status.Patched += row.Patched
+	}
+	lastRunMu.Lock()
+	lastRun = status
+	lastRunMu.Unlock()
+
+	if ReportPath == "" {
+		return
+	}
+	j, err := summary.toJSON()
+	if err != nil {
+		mylog.Error().Err(err).Msg("failed to marshal existing-objects run report to json")
+		return
+	}
+	if err := ioutil.WriteFile(ReportPath, []byte(j), 0644); err != nil {
+		mylog.Error().Err(err).Str("path", ReportPath).Msg("failed to write existing-objects run report")
+	}
+}
@@ -0,0 +1,159 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package existing
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func feedSyntheticDecisions(r *runReport) {
+	r.recordExamined("add-owner", "team-a", "Deployment")
+	r.recordMatched("add-owner", "team-a", "Deployment")
+	r.recordPatched("add-owner", "team-a", "Deployment")
+
+	r.recordExamined("add-owner", "team-a", "Deployment")
+	r.recordSkipped("add-owner", "team-a", "Deployment", "annotation")
+
+	r.recordExamined("add-owner", "team-b", "Deployment")
+	r.recordMatched("add-owner", "team-b", "Deployment")
+	r.recordPatched("add-owner", "team-b", "Deployment")
+	r.recordPatched("add-owner", "team-b", "Deployment")
+
+	r.recordExamined("add-owner", "team-c", "ConfigMap")
+	r.recordErrored("add-owner", "team-c", "ConfigMap", "bad-map", "apiserver returned 500")
+}
+
+func TestRunReportSummaryAggregatesAndOrdersDeterministically(t *testing.T) {
+	r := newRunReport()
+	feedSyntheticDecisions(r)
+
+	summary := r.summary()
+	require.Len(t, summary.Breakdown, 3)
+	assert.Equal(t, "team-a", summary.Breakdown[0].Namespace)
+	assert.Equal(t, int64(2), summary.Breakdown[0].Examined)
+	assert.Equal(t, int64(1), summary.Breakdown[0].Patched)
+	assert.Equal(t, int64(1), summary.Breakdown[0].Skipped)
+	assert.Equal(t, "team-b", summary.Breakdown[1].Namespace)
+	assert.Equal(t, int64(2), summary.Breakdown[1].Patched)
+	assert.Equal(t, "team-c", summary.Breakdown[2].Namespace)
+	assert.Equal(t, int64(1), summary.Breakdown[2].Errored)
+
+	require.Len(t, summary.TopNamespaces, 3)
+	assert.Equal(t, "team-b", summary.TopNamespaces[0].Namespace, "team-b patched the most objects, so should sort first")
+	assert.Equal(t, int64(2), summary.TopNamespaces[0].Patched)
+
+	require.Len(t, summary.Errors, 1)
+	assert.Equal(t, "bad-map", summary.Errors[0].Name)
+	assert.Equal(t, "apiserver returned 500", summary.Errors[0].Reason)
+}
+
+func TestRunReportTextIncludesEveryTableOnceThereIsData(t *testing.T) {
+	r := newRunReport()
+	feedSyntheticDecisions(r)
+
+	text := r.summary().toText()
+	assert.Contains(t, text, "RULE")
+	assert.Contains(t, text, "team-a")
+	assert.Contains(t, text, "TOP NAMESPACES BY CHANGE COUNT")
+	assert.Contains(t, text, "ERRORED OBJECTS")
+	assert.Contains(t, text, "bad-map")
+}
+
+func TestRunReportTextOmitsErroredObjectsTableWhenThereAreNoErrors(t *testing.T) {
+	r := newRunReport()
+	r.recordExamined("add-owner", "team-a", "Deployment")
+	r.recordMatched("add-owner", "team-a", "Deployment")
+	r.recordPatched("add-owner", "team-a", "Deployment")
+
+	text := r.summary().toText()
+	assert.NotContains(t, text, "ERRORED OBJECTS")
+}
+
+func TestRunReportJSONRoundTripsTheSummary(t *testing.T) {
+	r := newRunReport()
+	feedSyntheticDecisions(r)
+
+	j, err := r.summary().toJSON()
+	require.NoError(t, err)
+
+	var decoded reportSummary
+	require.NoError(t, json.Unmarshal([]byte(j), &decoded))
+	assert.Equal(t, r.summary(), decoded)
+}
+
+func TestRunReportCapsDistinctNamespacesPerRule(t *testing.T) {
+	defer func() { ReportNamespaceCardinalityCap = 50 }()
+	ReportNamespaceCardinalityCap = 2
+
+	r := newRunReport()
+	r.recordExamined("add-owner", "team-a", "Deployment")
+	r.recordExamined("add-owner", "team-b", "Deployment")
+	r.recordExamined("add-owner", "team-c", "Deployment")
+	r.recordExamined("add-owner", "team-d", "Deployment")
+
+	summary := r.summary()
+	var namespaces []string
+	for _, row := range summary.Breakdown {
+		namespaces = append(namespaces, row.Namespace)
+	}
+	assert.ElementsMatch(t, []string{"team-a", "team-b", overflowNamespace}, namespaces)
+
+	for _, row := range summary.Breakdown {
+		if row.Namespace == overflowNamespace {
+			assert.Equal(t, int64(2), row.Examined, "both namespaces beyond the cap should have been folded together")
+		}
+	}
+}
+
+func TestRunReportSummaryCountsSkipsByReason(t *testing.T) {
+	r := newRunReport()
+	r.recordExamined("add-owner", "team-a", "Pod")
+	r.recordSkipped("add-owner", "team-a", "Pod", "ReplicaSet")
+	r.recordExamined("add-owner", "team-a", "Pod")
+	r.recordSkipped("add-owner", "team-a", "Pod", "ReplicaSet")
+	r.recordExamined("add-owner", "team-b", "Deployment")
+	r.recordSkipped("add-owner", "team-b", "Deployment", "annotation")
+
+	summary := r.summary()
+	require.Len(t, summary.SkipReasons, 2)
+	assert.Equal(t, "add-owner", summary.SkipReasons[0].Rule)
+	assert.Equal(t, "ReplicaSet", summary.SkipReasons[0].Reason)
+	assert.Equal(t, int64(2), summary.SkipReasons[0].Count)
+	assert.Equal(t, "annotation", summary.SkipReasons[1].Reason)
+	assert.Equal(t, int64(1), summary.SkipReasons[1].Count)
+
+	text := summary.toText()
+	assert.Contains(t, text, "SKIP REASONS")
+	assert.Contains(t, text, "ReplicaSet")
+}
+
+func TestRunReportTruncatesErroredObjectListButKeepsCounting(t *testing.T) {
+	defer func() { ReportMaxErroredObjects = 100 }()
+	ReportMaxErroredObjects = 2
+
+	r := newRunReport()
+	for i := 0; i < 5; i++ {
+		r.recordErrored("add-owner", "team-a", "ConfigMap", "object", "boom")
+	}
+
+	summary := r.summary()
+	require.Len(t, summary.Errors, 2)
+	assert.Equal(t, 3, summary.TruncatedErrors)
+	require.Len(t, summary.Breakdown, 1)
+	assert.Equal(t, int64(5), summary.Breakdown[0].Errored, "every errored object should still count towards the aggregate total")
+}
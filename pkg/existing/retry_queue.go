@@ -0,0 +1,131 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package existing
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// RetryQueueMaxSize bounds how many patches that failed during the main sweep are held onto for the
+// retry pass at the end of it. Once full, further failures are still recorded against the run report
+// as normal, they just aren't retried - so that a systemic failure affecting most of a large cluster
+// doesn't grow the queue unboundedly.
+var RetryQueueMaxSize = 1000
+
+// RetryMaxAttempts bounds how many additional times the retry pass attempts a single queued patch
+// before giving up on it.
+var RetryMaxAttempts = 3
+
+// RetryBackoffBase is how long the retry pass waits before its first additional attempt at a queued
+// patch; each subsequent attempt for that patch doubles the wait, up to RetryBackoffMax. Variables,
+// rather than constants, so that tests can shrink them.
+var (
+	RetryBackoffBase = 1 * time.Second
+	RetryBackoffMax  = 30 * time.Second
+)
+
+// pendingRetry is a single failed patch collected during the main sweep for the retry pass that runs
+// once it finishes.
+type pendingRetry struct {
+	gv        string
+	resource  string
+	kind      string
+	name      string
+	namespace string
+	patch     []byte
+	ruleNames []string
+}
+
+var (
+	retryQueueMu sync.Mutex
+	retryQueue   []pendingRetry
+)
+
+// resetRetryQueue discards anything left queued from a previous run, the same way currentReport is
+// replaced at the start of ApplyRulesAgainstExistingObjects.
+func resetRetryQueue() {
+	retryQueueMu.Lock()
+	defer retryQueueMu.Unlock()
+	retryQueue = nil
+}
+
+// queueForRetry offers a patch that just failed up for a retry once the main sweep finishes, unless
+// err looks like a conflict - the object has since moved on, so blindly retrying the same patch would
+// most likely just conflict again - or the queue has already reached RetryQueueMaxSize.
+func queueForRetry(err error, gv, resource, kind, name, namespace string, patch []byte, ruleNames []string, rlog zerolog.Logger) {
+	if apierrors.IsConflict(err) {
+		rlog.Debug().Msg("patch failed with a conflict, not queueing it for retry")
+		return
+	}
+
+	retryQueueMu.Lock()
+	defer retryQueueMu.Unlock()
+	if len(retryQueue) >= RetryQueueMaxSize {
+		rlog.Warn().Int("retry-queue-max-size", RetryQueueMaxSize).Msg("retry queue is full, this failed patch will not be retried")
+		return
+	}
+	retryQueue = append(retryQueue, pendingRetry{
+		gv:        gv,
+		resource:  resource,
+		kind:      kind,
+		name:      name,
+		namespace: namespace,
+		patch:     append([]byte(nil), patch...),
+		ruleNames: append([]string(nil), ruleNames...),
+	})
+}
+
+// retryFailedPatches runs once the main sweep has finished, retrying every patch queueForRetry
+// collected along the way. Each is retried up to RetryMaxAttempts times, backing off between
+// attempts, before being given up on. A retry that eventually succeeds is additionally recorded as
+// patched against the run report, on top of the errored outcome it was already recorded with when it
+// first failed during the main sweep.
+func retryFailedPatches(mylog zerolog.Logger) {
+	retryQueueMu.Lock()
+	queue := retryQueue
+	retryQueue = nil
+	retryQueueMu.Unlock()
+
+	if len(queue) == 0 {
+		return
+	}
+	mylog.Info().Int("queued", len(queue)).Msg("retrying patches that failed during the main sweep")
+
+	for _, item := range queue {
+		rlog := mylog.With().Str("group-version", item.gv).Str("kind", item.kind).Str("name", item.name).Str("namespace", item.namespace).Strs("rules", item.ruleNames).Logger()
+		retryOne(item, rlog)
+	}
+}
+
+// retryOne retries a single queued patch up to RetryMaxAttempts times, doubling the wait between
+// attempts starting at RetryBackoffBase, up to RetryBackoffMax.
+func retryOne(item pendingRetry, rlog zerolog.Logger) {
+	backoff := RetryBackoffBase
+	for attempt := 1; attempt <= RetryMaxAttempts; attempt++ {
+		time.Sleep(backoff)
+		if err := patchObject(item.gv, item.resource, item.kind, item.name, item.namespace, item.patch, item.ruleNames, rlog); err == nil {
+			rlog.Info().Int("attempt", attempt).Msg("retry succeeded")
+			return
+		}
+		backoff *= 2
+		if backoff > RetryBackoffMax {
+			backoff = RetryBackoffMax
+		}
+	}
+	rlog.Warn().Int("attempts", RetryMaxAttempts).Msg("exhausted retries for this patch, giving up")
+}
@@ -0,0 +1,140 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package existing
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/HotelsDotCom/kube-graffiti/pkg/config"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	yaml "gopkg.in/yaml.v2"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// withFastRetryQueue shrinks the retry-pass backoff timings, restoring the real values afterwards.
+func withFastRetryQueue(t *testing.T) {
+	origBase, origMax := RetryBackoffBase, RetryBackoffMax
+	RetryBackoffBase = time.Millisecond
+	RetryBackoffMax = time.Millisecond
+	t.Cleanup(func() {
+		RetryBackoffBase = origBase
+		RetryBackoffMax = origMax
+		resetRetryQueue()
+	})
+}
+
+func TestQueueForRetryDropsConflicts(t *testing.T) {
+	defer resetRetryQueue()
+	resetRetryQueue()
+
+	queueForRetry(apierrors.NewConflict(schema.GroupResource{Resource: "pods"}, "my-pod", nil), "v1", "pods", "Pod", "my-pod", "default", []byte("[]"), []string{"add-a-label"}, zerolog.Nop())
+
+	retryQueueMu.Lock()
+	defer retryQueueMu.Unlock()
+	assert.Empty(t, retryQueue, "a patch that failed with a conflict should not be queued for retry")
+}
+
+func TestQueueForRetryStopsGrowingPastRetryQueueMaxSize(t *testing.T) {
+	defer resetRetryQueue()
+	defer func() { RetryQueueMaxSize = 1000 }()
+	resetRetryQueue()
+	RetryQueueMaxSize = 2
+
+	for i := 0; i < 5; i++ {
+		queueForRetry(apierrors.NewServiceUnavailable("down"), "v1", "pods", "Pod", "my-pod", "default", []byte("[]"), []string{"add-a-label"}, zerolog.Nop())
+	}
+
+	retryQueueMu.Lock()
+	defer retryQueueMu.Unlock()
+	assert.Len(t, retryQueue, 2)
+}
+
+func TestRetryFailedPatchesPatchesAnObjectThatFailedOnceDuringTheMainSweep(t *testing.T) {
+	withFastRetryQueue(t)
+	defer resetRetryQueue()
+	resetRetryQueue()
+
+	var rule config.Rule
+	require.NoError(t, yaml.Unmarshal([]byte(podRuleYaml()), &rule))
+
+	var podJSON = `{
+		"apiVersion": "v1",
+		"kind": "Pod",
+		"metadata": {
+			"labels": {
+				"fruit": "apple"
+			},
+			"name": "standalone-pod",
+			"namespace": "test-namespace"
+		}
+	}`
+	var resourceObject unstructured.Unstructured
+	require.NoError(t, json.Unmarshal([]byte(podJSON), &resourceObject.Object))
+
+	ri := mockDynamicResourceInterface{}
+	ri.On("Patch", "standalone-pod", types.JSONPatchType, mock.AnythingOfType("[]uint8"), mock.AnythingOfType("[]string")).Return(nil, apierrors.NewServiceUnavailable("apiserver restarting")).Once()
+	ri.On("Patch", "standalone-pod", types.JSONPatchType, mock.AnythingOfType("[]uint8"), mock.AnythingOfType("[]string")).Return(nil, nil).Once()
+	nri := mockDynamicNamespaceableResourceInterface{}
+	nri.On("Namespace", "test-namespace").Return(&ri)
+	dc := mockDynamicInterface{}
+	dc.On("Resource", schema.GroupVersionResource{Group: "", Version: "v1", Resource: "pods"}).Return(&nri)
+	dynamicClient = &dc
+
+	// the main sweep's attempt fails and queues the patch for retry...
+	result := applyToObject(&rule, "v1", "pods", resourceObject)
+	assert.False(t, result, "applyToObject should report the object as not patched yet, since the first attempt failed")
+
+	retryQueueMu.Lock()
+	queued := len(retryQueue)
+	retryQueueMu.Unlock()
+	require.Equal(t, 1, queued, "the failed patch should have been queued for retry")
+
+	// ...and the retry pass succeeds against the same mocked client.
+	retryFailedPatches(zerolog.Nop())
+
+	dc.AssertExpectations(t)
+	nri.AssertExpectations(t)
+	ri.AssertExpectations(t)
+	ri.AssertNumberOfCalls(t, "Patch", 2)
+}
+
+func TestRetryFailedPatchesGivesUpAfterRetryMaxAttempts(t *testing.T) {
+	withFastRetryQueue(t)
+	defer resetRetryQueue()
+	defer func() { RetryMaxAttempts = 3 }()
+	resetRetryQueue()
+	RetryMaxAttempts = 2
+
+	ri := mockDynamicResourceInterface{}
+	ri.On("Patch", "standalone-pod", types.JSONPatchType, mock.AnythingOfType("[]uint8"), mock.AnythingOfType("[]string")).Return(nil, apierrors.NewServiceUnavailable("apiserver restarting"))
+	nri := mockDynamicNamespaceableResourceInterface{}
+	nri.On("Namespace", "test-namespace").Return(&ri)
+	dc := mockDynamicInterface{}
+	dc.On("Resource", schema.GroupVersionResource{Group: "", Version: "v1", Resource: "pods"}).Return(&nri)
+	dynamicClient = &dc
+
+	queueForRetry(apierrors.NewServiceUnavailable("apiserver restarting"), "v1", "pods", "Pod", "standalone-pod", "test-namespace", []byte(`[{"op":"add","path":"/metadata/labels/added","value":"by-graffiti"}]`), []string{"add-a-label"}, zerolog.Nop())
+
+	retryFailedPatches(zerolog.Nop())
+
+	ri.AssertNumberOfCalls(t, "Patch", RetryMaxAttempts)
+}
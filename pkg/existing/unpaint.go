@@ -0,0 +1,87 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package existing
+
+import (
+	"strings"
+
+	"github.com/HotelsDotCom/kube-graffiti/pkg/config"
+	"github.com/HotelsDotCom/kube-graffiti/pkg/graffiti"
+	"github.com/rs/zerolog"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// attemptUnpaint reverses a rule's earlier additions once the rule no longer matches an object it
+// had previously painted: if Additions.RecordAppliedKeys had stamped object with the keys this rule
+// added, under graffiti.AppliedLabelKeysAnnotationKey/AppliedAnnotationKeysAnnotationKey, this removes
+// exactly those keys, plus the two tracking annotations themselves. It is a no-op for a rule that
+// doesn't record applied keys, or for an object this rule never painted in the first place.
+func attemptUnpaint(rule *config.Rule, gv, resource string, object unstructured.Unstructured, rlog zerolog.Logger) bool {
+	if !rule.Payload.Additions.RecordAppliedKeys {
+		return false
+	}
+	kind := object.GetKind()
+	name := object.GetName()
+	namespace := object.GetNamespace()
+
+	annotations := object.GetAnnotations()
+	labelKeysAnnotation := graffiti.AppliedLabelKeysAnnotationKey(rule.Registration.Name)
+	annotationKeysAnnotation := graffiti.AppliedAnnotationKeysAnnotationKey(rule.Registration.Name)
+	labelKeysRecorded, recordedLabels := annotations[labelKeysAnnotation]
+	annotationKeysRecorded, recordedAnnotations := annotations[annotationKeysAnnotation]
+	if !recordedLabels && !recordedAnnotations {
+		rlog.Debug().Msg("rule no longer matches but object carries no applied-keys record for it, nothing to unpaint")
+		return false
+	}
+
+	rlog.Info().Str("labels", labelKeysRecorded).Str("annotations", annotationKeysRecorded).Msg("rule no longer matches an object it had previously painted, removing the keys it added")
+
+	patch, err := graffiti.Unpaint(object.GetLabels(), annotations, rule.Registration.Name, splitCommaList(labelKeysRecorded), splitCommaList(annotationKeysRecorded))
+	if err != nil {
+		rlog.Error().Err(err).Msg("could not compute unpaint patch")
+		currentReport.recordErrored(rule.Registration.Name, namespace, kind, name, err.Error())
+		return false
+	}
+	if patch == nil {
+		rlog.Debug().Msg("unpaint produced no patch, object already carries none of the recorded keys")
+		return false
+	}
+
+	if DryRun {
+		diff, err := computeObjectDiff(rule.Registration.Name, namespace, kind, name, object, patch)
+		if err != nil {
+			rlog.Error().Err(err).Msg("dry-run: could not compute planned unpaint diff for object")
+			currentReport.recordErrored(rule.Registration.Name, namespace, kind, name, err.Error())
+			return false
+		}
+		currentDryRunReport.record(diff)
+		rlog.Info().Strs("removed", diff.Removed).Msg("dry-run: recorded planned unpaint, not patching")
+		return false
+	}
+
+	if err := patchObject(gv, resource, kind, name, namespace, patch, []string{rule.Registration.Name}, rlog); err != nil {
+		queueForRetry(err, gv, resource, kind, name, namespace, patch, []string{rule.Registration.Name}, rlog)
+		return false
+	}
+	return true
+}
+
+// splitCommaList splits a comma-joined list of keys as recorded by Additions.RecordAppliedKeys,
+// returning nil for an empty string rather than a single-element slice containing it.
+func splitCommaList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
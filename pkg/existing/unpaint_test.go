@@ -0,0 +1,109 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package existing
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/HotelsDotCom/kube-graffiti/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	yaml "gopkg.in/yaml.v2"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+var recordAppliedKeysRuleYaml = `---
+registration:
+  name: add-a-label
+  targets:
+  - api-groups:
+    - ""
+    api-versions:
+    - v1
+    resources:
+    - namespaces
+  failure-policy: Ignore
+matchers:
+  label-selectors:
+  - "fruit=apple"
+payload:
+  additions:
+    labels:
+      added: 'by-graffiti'
+    record-applied-keys: true
+`
+
+func TestApplyToObjectUnpaintsAnObjectThatNoLongerMatchesARuleItHadPreviouslyPainted(t *testing.T) {
+	var rule config.Rule
+	require.NoError(t, yaml.Unmarshal([]byte(recordAppliedKeysRuleYaml), &rule))
+
+	var resourceJSON = `{
+		"apiVersion": "v1",
+		"kind": "Namespace",
+		"metadata": {
+			"name": "test-namespace",
+			"labels": {
+				"fruit": "banana",
+				"added": "by-graffiti"
+			},
+			"annotations": {
+				"kube-graffiti.io/applied-keys-add-a-label-labels": "added",
+				"kube-graffiti.io/applied-keys-add-a-label-annotations": ""
+			}
+		}
+	}`
+	var resourceObject unstructured.Unstructured
+	require.NoError(t, json.Unmarshal([]byte(resourceJSON), &resourceObject.Object))
+
+	dnri := mockDynamicNamespaceableResourceInterface{}
+	dnri.mockDynamicResourceInterface.On("Patch", "test-namespace", types.JSONPatchType, mock.AnythingOfType("[]uint8"), mock.AnythingOfType("[]string")).Return(nil, nil)
+	dc := mockDynamicInterface{}
+	dc.On("Resource", schema.GroupVersionResource{Group: "", Version: "v1", Resource: "namespaces"}).Return(&dnri)
+	dynamicClient = &dc
+
+	result := applyToObject(&rule, "v1", "namespaces", resourceObject)
+	dnri.AssertExpectations(t)
+	dc.AssertExpectations(t)
+	assert.Equal(t, true, result, "an object that no longer matches a rule it was previously painted by should have its keys removed")
+}
+
+func TestApplyToObjectDoesNotUnpaintAnObjectTheRuleNeverPainted(t *testing.T) {
+	var rule config.Rule
+	require.NoError(t, yaml.Unmarshal([]byte(recordAppliedKeysRuleYaml), &rule))
+
+	var resourceJSON = `{
+		"apiVersion": "v1",
+		"kind": "Namespace",
+		"metadata": {
+			"name": "test-namespace",
+			"labels": {
+				"fruit": "banana"
+			}
+		}
+	}`
+	var resourceObject unstructured.Unstructured
+	require.NoError(t, json.Unmarshal([]byte(resourceJSON), &resourceObject.Object))
+
+	// a dynamic client with no Patch expectation set - if applyToObject tries to patch, the mock will fail the test
+	dc := mockDynamicInterface{}
+	dynamicClient = &dc
+
+	result := applyToObject(&rule, "v1", "namespaces", resourceObject)
+	dc.AssertExpectations(t)
+	assert.Equal(t, false, result, "an object this rule never painted should not be patched just because the rule no longer matches it")
+}
@@ -0,0 +1,158 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package graffiti
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Budget scopes - see Budget.Scope.
+const (
+	BudgetScopeRule      = "rule"
+	BudgetScopeNamespace = "namespace"
+	BudgetScopeKind      = "kind"
+)
+
+// Budget on-exceeded behaviours - see Budget.OnExceeded.
+const (
+	BudgetOnExceededPause = "pause"
+	BudgetOnExceededSkip  = "skip"
+	BudgetOnExceededWarn  = "warn"
+)
+
+// defaultBudgetWindow is used when a configured Budget doesn't set Window.
+const defaultBudgetWindow = time.Minute
+
+// Budget caps how many mutations a rule may make within a time window, to bound the blast radius of
+// a mis-targeted rule - e.g. an additions rule with a bad selector relabelling an entire production
+// namespace in seconds. Scope controls what the cap is shared across: "rule" (the default) counts
+// every mutation the rule makes anywhere, "namespace" counts separately per namespace of the object
+// being mutated, and "kind" counts separately per object kind. The zero value disables budgeting
+// entirely, so existing rules are unaffected unless they opt in.
+//
+// The count is an approximate sliding window: rather than ageing out individual mutations one at a
+// time, it resets to zero Window after the first mutation counted within it - cheap to track and
+// good enough to cap a runaway rule, at the cost of occasionally allowing a short burst just above
+// MaxMutations right as a window rolls over. State is kept in-process only (see budgetTracker) and
+// is lost on restart - a restarting pod starts every rule's budget back at zero.
+type Budget struct {
+	Scope        string `mapstructure:"scope" yaml:"scope,omitempty"`
+	MaxMutations int    `mapstructure:"max-mutations" yaml:"max-mutations,omitempty"`
+	Window       string `mapstructure:"window" yaml:"window,omitempty"`
+	OnExceeded   string `mapstructure:"on-exceeded" yaml:"on-exceeded,omitempty"`
+}
+
+// enabled reports whether b actually configures a budget - the zero value is a no-op.
+func (b Budget) enabled() bool {
+	return b.MaxMutations > 0
+}
+
+// windowDuration parses b.Window, falling back to defaultBudgetWindow when it's unset.
+func (b Budget) windowDuration() (time.Duration, error) {
+	if b.Window == "" {
+		return defaultBudgetWindow, nil
+	}
+	return time.ParseDuration(b.Window)
+}
+
+// onExceeded returns b.OnExceeded, falling back to the safest default, BudgetOnExceededPause, when
+// it's unset.
+func (b Budget) onExceeded() string {
+	if b.OnExceeded == "" {
+		return BudgetOnExceededPause
+	}
+	return b.OnExceeded
+}
+
+// validate checks that b's fields, if set, hold one of their recognised values.
+func (b Budget) validate() error {
+	if !b.enabled() {
+		return nil
+	}
+	switch b.Scope {
+	case "", BudgetScopeRule, BudgetScopeNamespace, BudgetScopeKind:
+	default:
+		return fmt.Errorf("budget scope %q is not one of %q, %q or %q", b.Scope, BudgetScopeRule, BudgetScopeNamespace, BudgetScopeKind)
+	}
+	switch b.OnExceeded {
+	case "", BudgetOnExceededPause, BudgetOnExceededSkip, BudgetOnExceededWarn:
+	default:
+		return fmt.Errorf("budget on-exceeded %q is not one of %q, %q or %q", b.OnExceeded, BudgetOnExceededPause, BudgetOnExceededSkip, BudgetOnExceededWarn)
+	}
+	if _, err := b.windowDuration(); err != nil {
+		return fmt.Errorf("budget window %q is invalid: %v", b.Window, err)
+	}
+	return nil
+}
+
+// scopeKey returns the key a mutation against metaObject should be counted under, given b.Scope.
+func (b Budget) scopeKey(ruleName string, mo metaObject) string {
+	switch b.Scope {
+	case BudgetScopeNamespace:
+		return fmt.Sprintf("%s|namespace|%s", ruleName, mo.Meta.Namespace)
+	case BudgetScopeKind:
+		return fmt.Sprintf("%s|kind|%s", ruleName, mo.Kind)
+	default:
+		return fmt.Sprintf("%s|rule", ruleName)
+	}
+}
+
+// BudgetExceededError is returned by Rule.mutate, and surfaces through Mutate and MutateAdmission,
+// when a Budget has capped how many mutations its rule may make within the current window. Mode is
+// the configuring Budget's OnExceeded value ("pause" or "skip"), which MutateAdmission uses to render
+// a distinct admission message; the existing-objects sweep leaves the object untouched, as it does a
+// matching rule with nothing to change (so no unpaint either), and naturally retries the object on a
+// later run once the window has moved on.
+type BudgetExceededError struct {
+	Rule string
+	Mode string
+}
+
+func (e *BudgetExceededError) Error() string {
+	return fmt.Sprintf("rule %q mutation budget exceeded, on-exceeded is %q", e.Rule, e.Mode)
+}
+
+// budgetWindow is one rule+scope's mutation count and the deadline it resets at.
+type budgetWindow struct {
+	count    int
+	deadline time.Time
+}
+
+// budgetTracker counts mutations per scope key across a sliding window of time, shared by every
+// graffiti.Rule value for a given rule name - Rule is constructed fresh at each admission request and
+// each existing-objects sweep, so its counts can't live on the Rule value itself. It follows the same
+// package-level, mutex-guarded map shape as metrics.Histogram.
+type budgetTracker struct {
+	mu      sync.Mutex
+	windows map[string]*budgetWindow
+}
+
+var globalBudgetTracker = &budgetTracker{windows: make(map[string]*budgetWindow)}
+
+// countAndCheck records one mutation against key and reports whether doing so took the count over
+// max within the current window, starting a fresh window if the previous one has expired.
+func (t *budgetTracker) countAndCheck(key string, max int, window time.Duration, now time.Time) (exceeded bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	w, ok := t.windows[key]
+	if !ok || now.After(w.deadline) {
+		w = &budgetWindow{deadline: now.Add(window)}
+		t.windows[key] = w
+	}
+	w.count++
+	return w.count > max
+}
@@ -0,0 +1,82 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package graffiti
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBudgetTrackerExceedsAfterMaxMutationsWithinTheWindow(t *testing.T) {
+	tracker := &budgetTracker{windows: make(map[string]*budgetWindow)}
+	now := time.Unix(0, 0)
+
+	assert.False(t, tracker.countAndCheck("rule-a", 2, time.Minute, now))
+	assert.False(t, tracker.countAndCheck("rule-a", 2, time.Minute, now))
+	assert.True(t, tracker.countAndCheck("rule-a", 2, time.Minute, now), "the third mutation within the window should exceed a budget of 2")
+}
+
+func TestBudgetTrackerResetsOnceTheWindowExpires(t *testing.T) {
+	tracker := &budgetTracker{windows: make(map[string]*budgetWindow)}
+	now := time.Unix(0, 0)
+
+	assert.False(t, tracker.countAndCheck("rule-a", 1, time.Minute, now))
+	assert.True(t, tracker.countAndCheck("rule-a", 1, time.Minute, now.Add(30*time.Second)), "still within the same window, so the budget should remain exceeded")
+	assert.False(t, tracker.countAndCheck("rule-a", 1, time.Minute, now.Add(61*time.Second)), "the window has rolled over, so the budget should have reset")
+}
+
+func TestBudgetTrackerCountsDistinctKeysSeparately(t *testing.T) {
+	tracker := &budgetTracker{windows: make(map[string]*budgetWindow)}
+	now := time.Unix(0, 0)
+
+	assert.False(t, tracker.countAndCheck("rule-a|namespace|team-a", 1, time.Minute, now))
+	assert.False(t, tracker.countAndCheck("rule-a|namespace|team-b", 1, time.Minute, now), "a different scope key should have its own, unexceeded, budget")
+}
+
+func TestBudgetScopeKeySeparatesByScope(t *testing.T) {
+	mo := metaObject{Kind: "Pod"}
+	mo.Meta.Namespace = "team-a"
+
+	assert.Equal(t, "my-rule|rule", Budget{Scope: BudgetScopeRule}.scopeKey("my-rule", mo))
+	assert.Equal(t, "my-rule|namespace|team-a", Budget{Scope: BudgetScopeNamespace}.scopeKey("my-rule", mo))
+	assert.Equal(t, "my-rule|kind|Pod", Budget{Scope: BudgetScopeKind}.scopeKey("my-rule", mo))
+	assert.Equal(t, "my-rule|rule", Budget{}.scopeKey("my-rule", mo), "an unset scope should default to rule")
+}
+
+func TestBudgetValidateRejectsAnUnrecognisedScope(t *testing.T) {
+	b := Budget{MaxMutations: 10, Scope: "pod"}
+	require.Error(t, b.validate())
+}
+
+func TestBudgetValidateRejectsAnUnrecognisedOnExceeded(t *testing.T) {
+	b := Budget{MaxMutations: 10, OnExceeded: "deny"}
+	require.Error(t, b.validate())
+}
+
+func TestBudgetValidateRejectsAnUnparseableWindow(t *testing.T) {
+	b := Budget{MaxMutations: 10, Window: "ten minutes"}
+	require.Error(t, b.validate())
+}
+
+func TestBudgetValidateAllowsTheZeroValue(t *testing.T) {
+	require.NoError(t, Budget{}.validate(), "a rule with no budget configured at all should validate cleanly")
+}
+
+func TestBudgetOnExceededDefaultsToPause(t *testing.T) {
+	assert.Equal(t, BudgetOnExceededPause, Budget{}.onExceeded())
+	assert.Equal(t, BudgetOnExceededWarn, Budget{OnExceeded: BudgetOnExceededWarn}.onExceeded())
+}
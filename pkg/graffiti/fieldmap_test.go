@@ -0,0 +1,161 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package graffiti
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestMakeFieldMapFromRawObjectAcrossKinds is a table-driven check that MakeFieldMapFromRawObject
+// flattens real-world object kinds the way rule authors expect, so field selectors written against
+// these kinds behave the same in tests as they do in the admission path.
+func TestMakeFieldMapFromRawObjectAcrossKinds(t *testing.T) {
+	tests := []struct {
+		name   string
+		object string
+		want   map[string]string
+	}{
+		{
+			name: "namespace",
+			object: `{
+				"kind":"Namespace",
+				"metadata":{"name":"prod-billing","labels":{"team":"billing"}},
+				"status":{"phase":"Active"}
+			}`,
+			want: map[string]string{
+				"metadata.name":        "prod-billing",
+				"metadata.labels.team": "billing",
+				"status.phase":         "Active",
+			},
+		},
+		{
+			name: "deployment",
+			object: `{
+				"kind":"Deployment",
+				"metadata":{"name":"api","namespace":"prod-billing"},
+				"spec":{"replicas":3,"template":{"spec":{"containers":[{"name":"api","image":"api:1.2.3"}]}}}
+			}`,
+			want: map[string]string{
+				"metadata.name":                         "api",
+				"metadata.namespace":                    "prod-billing",
+				"spec.replicas":                         "3",
+				"spec.template.spec.containers.0.name":  "api",
+				"spec.template.spec.containers.0.image": "api:1.2.3",
+			},
+		},
+		{
+			name: "pod",
+			object: `{
+				"kind":"Pod",
+				"metadata":{"name":"api-abc123","namespace":"prod-billing","labels":{"app":"api"}},
+				"spec":{"serviceAccountName":"api","containers":[{"name":"api"}]}
+			}`,
+			want: map[string]string{
+				"metadata.name":           "api-abc123",
+				"metadata.labels.app":     "api",
+				"spec.serviceAccountName": "api",
+				"spec.containers.0.name":  "api",
+			},
+		},
+		{
+			name: "clusterrole",
+			object: `{
+				"kind":"ClusterRole",
+				"metadata":{"name":"view-secrets"},
+				"rules":[{"apiGroups":[""],"resources":["secrets"],"verbs":["get","list"]}]
+			}`,
+			want: map[string]string{
+				"metadata.name":       "view-secrets",
+				"rules.0.apiGroups.0": "",
+				"rules.0.resources.0": "secrets",
+				"rules.0.verbs.0":     "get",
+				"rules.0.verbs.1":     "list",
+			},
+		},
+		{
+			name: "crd-instance",
+			object: `{
+				"apiVersion":"example.com/v1",
+				"kind":"Widget",
+				"metadata":{"name":"my-widget","namespace":"prod-billing"},
+				"spec":{"size":"large","colour":"red"}
+			}`,
+			want: map[string]string{
+				"apiVersion":    "example.com/v1",
+				"kind":          "Widget",
+				"metadata.name": "my-widget",
+				"spec.size":     "large",
+				"spec.colour":   "red",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fm, err := MakeFieldMapFromRawObject([]byte(tt.object))
+			require.NoError(t, err)
+			for k, v := range tt.want {
+				assert.Equal(t, v, fm[k], "field %s", k)
+			}
+		})
+	}
+}
+
+// deeplyNestedObject builds an object nested levels deep where every level carries both a "marker"
+// scalar sibling (so tests can tell how deep flattening actually reached) and a "level" key to
+// descend into: {"marker":"depth-1","level":{"marker":"depth-2","level":{...}}}.
+func deeplyNestedObject(levels int) []byte {
+	var inner interface{} = map[string]interface{}{"marker": fmt.Sprintf("depth-%d", levels)}
+	for i := levels - 1; i >= 1; i-- {
+		inner = map[string]interface{}{"marker": fmt.Sprintf("depth-%d", i), "level": inner}
+	}
+	raw, err := json.Marshal(inner)
+	if err != nil {
+		panic(err)
+	}
+	return raw
+}
+
+func TestMakeFieldMapFromRawObjectStopsDescendingBeyondMaxFieldMapDepth(t *testing.T) {
+	old := MaxFieldMapDepth
+	defer func() { MaxFieldMapDepth = old }()
+	MaxFieldMapDepth = 5
+
+	fm, err := MakeFieldMapFromRawObject(deeplyNestedObject(20))
+	require.NoError(t, err, "flattening a too-deep object must not error, it should simply stop descending")
+
+	assert.Equal(t, "depth-1", fm["marker"], "a field within the depth limit should still be flattened")
+
+	// a field at exactly MaxFieldMapDepth is still within the limit and should be flattened...
+	var atLimitKey string
+	for i := 1; i < MaxFieldMapDepth; i++ {
+		if atLimitKey == "" {
+			atLimitKey = "level"
+		} else {
+			atLimitKey += ".level"
+		}
+	}
+	atLimitKey += ".marker"
+	assert.Equal(t, fmt.Sprintf("depth-%d", MaxFieldMapDepth), fm[atLimitKey], "a field exactly at max-field-map-depth should still be flattened")
+
+	// ...but one level deeper than that must not be.
+	tooDeepKey := atLimitKey[:len(atLimitKey)-len(".marker")] + ".level.marker"
+	_, tooDeepPresent := fm[tooDeepKey]
+	assert.False(t, tooDeepPresent, "fields beyond max-field-map-depth must not be flattened")
+}
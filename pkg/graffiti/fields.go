@@ -23,30 +23,83 @@ import (
 	"github.com/HotelsDotCom/kube-graffiti/pkg/log"
 )
 
-// makeFieldMap converts a raw json object into a compatible field map
-func makeFieldMapFromRawObject(raw []byte) (map[string]string, error) {
-	mylog := log.ComponentLogger(componentName, "makeFieldMapFromRawObject")
-	fieldMap := make(map[string]string)
-	var jsonObject map[string]interface{}
+// MaxFieldMapDepth bounds how many levels of nesting MakeFieldMapFromRawObject will descend into
+// while flattening an object. A pathologically deep CRD instance - whether malicious or just a bug
+// in someone's operator - could otherwise make flattening slow or risk a stack overflow. Fields
+// beyond this depth simply aren't available to field selectors; MakeFieldMapFromRawObject still
+// succeeds and returns everything shallower than the limit.
+var MaxFieldMapDepth = 50
+
+// decodeHook, when non-nil, is called each time decodeRawObject actually decodes raw JSON bytes into a
+// generic map. It exists purely so tests can verify that a single raw object flowing through mutate is
+// decoded once, rather than once per consumer (field map, metaObject, ...) - see rawObjectParseCount in
+// graffiti_test.go.
+var decodeHook func()
 
+// decodeRawObject decodes raw into a generic map, preserving numbers as json.Number the way
+// MakeFieldMapFromRawObject always has. It is the single place raw admission/existing-object JSON gets
+// parsed, so that mutate can derive both the field map and metaObject from one decode instead of
+// re-parsing the same bytes for each.
+func decodeRawObject(raw []byte) (map[string]interface{}, error) {
 	if len(raw) == 0 {
-		mylog.Error().Msg("object is empty, can't convert to fields")
-		return fieldMap, fmt.Errorf("no fields found")
+		return nil, fmt.Errorf("no fields found")
 	}
+	if decodeHook != nil {
+		decodeHook()
+	}
+	var jsonObject map[string]interface{}
 	d := json.NewDecoder(bytes.NewReader(raw))
 	d.UseNumber()
-	err := d.Decode(&jsonObject)
+	if err := d.Decode(&jsonObject); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal object: %v", err)
+	}
+	return jsonObject, nil
+}
+
+// MakeFieldMapFromRawObject flattens a raw kubernetes object into the dotted field map that
+// field-selectors are matched against, e.g. "metadata.labels.author" or "spec.replicas". It is
+// exported so that rule authors can inspect which field names and values are available to them
+// (e.g. via the 'kube-graffiti fields' command) and so that external tests can assert their field
+// selectors actually match real object JSON:
+//
+//	fm, err := graffiti.MakeFieldMapFromRawObject(podJSON)
+//	...
+//	assert.Equal(t, "my-pod", fm["metadata.name"])
+func MakeFieldMapFromRawObject(raw []byte) (map[string]string, error) {
+	mylog := log.ComponentLogger(componentName, "MakeFieldMapFromRawObject")
+	fieldMap := make(map[string]string)
+
+	jsonObject, err := decodeRawObject(raw)
 	if err != nil {
-		return fieldMap, fmt.Errorf("failed to unmarshal object: %v", err)
+		if len(raw) == 0 {
+			mylog.Error().Msg("object is empty, can't convert to fields")
+		}
+		return fieldMap, err
 	}
+	return fieldMapFromParsedObject(jsonObject), nil
+}
+
+// fieldMapFromParsedObject flattens an already-decoded object - see decodeRawObject - into the dotted
+// field map MakeFieldMapFromRawObject returns, without re-parsing any JSON.
+func fieldMapFromParsedObject(jsonObject map[string]interface{}) map[string]string {
+	mylog := log.ComponentLogger(componentName, "MakeFieldMapFromRawObject")
+	fieldMap := make(map[string]string)
+
+	var depthExceeded bool
 	for k, v := range jsonObject {
-		addFieldRecursive(fieldMap, "", k, v)
+		addFieldRecursive(fieldMap, "", k, v, 1, &depthExceeded)
+	}
+	if depthExceeded {
+		mylog.Warn().Int("max-field-map-depth", MaxFieldMapDepth).Msg("object nesting exceeded max-field-map-depth, fields beyond that depth were not flattened")
 	}
 
-	return fieldMap, nil
+	return fieldMap
 }
 
-func addFieldRecursive(fm map[string]string, prefix, k string, v interface{}) {
+// addFieldRecursive flattens v into fm under prefix+k. depth counts the nesting level v is found at,
+// starting at 1 for a top-level field; once depth exceeds MaxFieldMapDepth it stops descending into
+// slices/maps and sets *depthExceeded so the caller can log a single warning per object.
+func addFieldRecursive(fm map[string]string, prefix, k string, v interface{}, depth int, depthExceeded *bool) {
 	mylog := log.ComponentLogger(componentName, "addFieldRecursive")
 
 	if reflect.ValueOf(k).Kind() != reflect.String {
@@ -54,6 +107,12 @@ func addFieldRecursive(fm map[string]string, prefix, k string, v interface{}) {
 		return
 	}
 
+	if depth > MaxFieldMapDepth {
+		mylog.Debug().Str("key", prefix+k).Int("depth", depth).Msg("max-field-map-depth reached, not flattening this field")
+		*depthExceeded = true
+		return
+	}
+
 	if reflect.TypeOf(v) == nil {
 		mylog.Debug().Str("key", prefix+k).Str("value", "").Msg("adding empty value to fieldmap")
 		fm[prefix+k] = ""
@@ -75,15 +134,17 @@ func addFieldRecursive(fm map[string]string, prefix, k string, v interface{}) {
 		mylog.Debug().Str("key", prefix+k).Bool("value", v.(bool)).Msg("adding bool to fieldmap")
 		fm[prefix+k] = strconv.FormatBool(v.(bool))
 		return
-	case reflect.Slice:
-		mylog.Debug().Str("key", prefix+k).Msg("adding slice to fieldmap")
-		for i, val := range v.([]interface{}) {
-			addFieldRecursive(fm, prefix+k+".", strconv.Itoa(i), val)
-		}
-	case reflect.Map:
-		mylog.Debug().Str("key", k).Msg("adding map to fieldmap")
-		for x, y := range v.(map[string]interface{}) {
-			addFieldRecursive(fm, prefix+k+".", x, y)
+	case reflect.Slice, reflect.Map:
+		if reflect.ValueOf(v).Kind() == reflect.Slice {
+			mylog.Debug().Str("key", prefix+k).Msg("adding slice to fieldmap")
+			for i, val := range v.([]interface{}) {
+				addFieldRecursive(fm, prefix+k+".", strconv.Itoa(i), val, depth+1, depthExceeded)
+			}
+		} else {
+			mylog.Debug().Str("key", k).Msg("adding map to fieldmap")
+			for x, y := range v.(map[string]interface{}) {
+				addFieldRecursive(fm, prefix+k+".", x, y, depth+1, depthExceeded)
+			}
 		}
 	default:
 		mylog.Warn().Str("key", prefix+k).Str("kind", reflect.ValueOf(v).Kind().String()).Msg("can't flatten this kind into a field map")
@@ -21,7 +21,7 @@ import (
 )
 
 func TestEmptyObject(t *testing.T) {
-	_, err := makeFieldMapFromRawObject([]byte{})
+	_, err := MakeFieldMapFromRawObject([]byte{})
 	require.Error(t, err)
 	assert.Equal(t, "no fields found", err.Error())
 
@@ -29,7 +29,7 @@ func TestEmptyObject(t *testing.T) {
 
 func TestTopLevelObjectMustBeAMap(t *testing.T) {
 	validJSON := `[ "apple", "orange", "banana" ]`
-	_, err := makeFieldMapFromRawObject([]byte(validJSON))
+	_, err := MakeFieldMapFromRawObject([]byte(validJSON))
 	assert.Error(t, err)
 	assert.Equal(t, "failed to unmarshal object: json: cannot unmarshal array into Go value of type map[string]interface {}", err.Error())
 }
@@ -39,32 +39,32 @@ func TestBaseTypesAsStrings(t *testing.T) {
 
 	// strings
 	testJSON := `{ "test": "dave" }`
-	fm, err := makeFieldMapFromRawObject([]byte(testJSON))
+	fm, err := MakeFieldMapFromRawObject([]byte(testJSON))
 	require.NoError(t, err)
 	assert.Equal(t, "dave", fm["test"])
 
 	// ints
 	testJSON = `{ "test": 100 }`
-	fm, err = makeFieldMapFromRawObject([]byte(testJSON))
+	fm, err = MakeFieldMapFromRawObject([]byte(testJSON))
 	require.NoError(t, err)
 	assert.Equal(t, "100", fm["test"])
 
 	// floats
 	testJSON = `{ "test": 63.333392 }`
-	fm, err = makeFieldMapFromRawObject([]byte(testJSON))
+	fm, err = MakeFieldMapFromRawObject([]byte(testJSON))
 	require.NoError(t, err)
 	assert.Equal(t, "63.333392", fm["test"])
 
 	// bools
 	testJSON = `{ "test": true }`
-	fm, err = makeFieldMapFromRawObject([]byte(testJSON))
+	fm, err = MakeFieldMapFromRawObject([]byte(testJSON))
 	require.NoError(t, err)
 	assert.Equal(t, "true", fm["test"])
 }
 
 func TestSlicesAreReferencedByIndex(t *testing.T) {
 	testJSON := `{ "test": [ "dave", 100, 63.49, true ] }`
-	fm, err := makeFieldMapFromRawObject([]byte(testJSON))
+	fm, err := MakeFieldMapFromRawObject([]byte(testJSON))
 	require.NoError(t, err)
 
 	assert.Equal(t, "dave", fm["test.0"])
@@ -75,7 +75,7 @@ func TestSlicesAreReferencedByIndex(t *testing.T) {
 
 func TestMapsAreReferencedByKey(t *testing.T) {
 	testJSON := `{ "test": { "band": "Queen", "singer": "Freddie Mercury", "status": "legend" }}`
-	fm, err := makeFieldMapFromRawObject([]byte(testJSON))
+	fm, err := MakeFieldMapFromRawObject([]byte(testJSON))
 	require.NoError(t, err)
 
 	assert.Equal(t, "Queen", fm["test.band"])
@@ -83,6 +83,18 @@ func TestMapsAreReferencedByKey(t *testing.T) {
 	assert.Equal(t, "legend", fm["test.status"])
 }
 
+func TestSingleValuedScalarSpecFieldsAreAddressable(t *testing.T) {
+	// spec.storageClassName (PersistentVolumeClaim) and spec.ingressClassName (Ingress) are both
+	// plain scalar fields directly under spec - no special-casing is needed, the generic recursion
+	// in addFieldRecursive already reaches them like any other nested string field.
+	testJSON := `{ "spec": { "storageClassName": "fast", "ingressClassName": "nginx" } }`
+	fm, err := MakeFieldMapFromRawObject([]byte(testJSON))
+	require.NoError(t, err)
+
+	assert.Equal(t, "fast", fm["spec.storageClassName"])
+	assert.Equal(t, "nginx", fm["spec.ingressClassName"])
+}
+
 func TestComplexObject(t *testing.T) {
 	var testJSON = `{
 		"metadata":{
@@ -103,7 +115,7 @@ func TestComplexObject(t *testing.T) {
 		}
 	 }`
 
-	fm, err := makeFieldMapFromRawObject([]byte(testJSON))
+	fm, err := MakeFieldMapFromRawObject([]byte(testJSON))
 	require.NoError(t, err)
 
 	assert.Equal(t, "test-namespace", fm["metadata.name"])
@@ -17,19 +17,107 @@ package graffiti
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/HotelsDotCom/kube-graffiti/pkg/log"
+	"github.com/HotelsDotCom/kube-graffiti/pkg/metrics"
+	"github.com/HotelsDotCom/kube-graffiti/pkg/tracing"
 	"github.com/rs/zerolog"
 	admission "k8s.io/api/admission/v1beta1"
+	authv1 "k8s.io/api/authentication/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
 )
 
 const (
 	componentName = "grafitti"
 )
 
+// AdmissionSkipAnnotationKey is the object annotation, honored only in MutateAdmission, which opts
+// an object out of admission mutation while leaving it eligible for the existing sweep. It defaults
+// to the well known kube-graffiti annotation but may be overridden by configuration.
+var AdmissionSkipAnnotationKey = "kube-graffiti.io/admission-skip"
+
+// CreatedByAnnotationKey is the object annotation that a payload's Additions.StampCreatedBy stamps
+// with the submitting user's name during admission. Existing sweeps have no submitting user to test
+// against, so rules that want to match on an object's original creator rely on this annotation
+// having already been stamped by an earlier admission request. It defaults to the well known
+// kube-graffiti annotation but may be overridden by configuration.
+var CreatedByAnnotationKey = "kube-graffiti.io/created-by"
+
+// OriginalValueAnnotationPrefix prefixes the annotation key that a payload's
+// Additions.BackupOriginalValues uses to record a label or annotation's value just before an addition
+// overwrites it, e.g. overwriting an "author" label backs its old value up under the annotation
+// "kube-graffiti.io/original-author". It defaults to the well known kube-graffiti prefix but may be
+// overridden by configuration.
+var OriginalValueAnnotationPrefix = "kube-graffiti.io/original-"
+
+// AppliedKeysAnnotationPrefix prefixes the pair of annotations that a payload's
+// Additions.RecordAppliedKeys stamps with the comma-separated label/annotation keys a rule added to
+// an object, e.g. a rule named "team-label" stamps "kube-graffiti.io/applied-keys-team-label-labels"
+// and "kube-graffiti.io/applied-keys-team-label-annotations". See AppliedLabelKeysAnnotationKey/
+// AppliedAnnotationKeysAnnotationKey, which build the full key for a given rule name. It defaults to
+// the well known kube-graffiti prefix but may be overridden by configuration.
+var AppliedKeysAnnotationPrefix = "kube-graffiti.io/applied-keys-"
+
+// AppliedLabelKeysAnnotationKey and AppliedAnnotationKeysAnnotationKey return the annotation keys
+// that Additions.RecordAppliedKeys stamps for ruleName, and that Unpaint reads back to find out which
+// keys to remove. See AppliedKeysAnnotationPrefix.
+func AppliedLabelKeysAnnotationKey(ruleName string) string {
+	return AppliedKeysAnnotationPrefix + ruleName + "-labels"
+}
+
+func AppliedAnnotationKeysAnnotationKey(ruleName string) string {
+	return AppliedKeysAnnotationPrefix + ruleName + "-annotations"
+}
+
+// SpecHashAnnotationPrefix prefixes the annotation that a payload's Additions.SpecHash stamps with a
+// stable hash of the object's configured field paths, keyed per rule name so that multiple rules
+// hashing different field paths on the same object don't collide. See SpecHashAnnotationKey, which
+// builds the full key for a given rule name, and Matchers.SpecChanged, which reads it back to detect
+// drift since the hash was last stamped.
+var SpecHashAnnotationPrefix = "kube-graffiti.io/spec-hash-"
+
+// SpecHashAnnotationKey returns the annotation key that Additions.SpecHash stamps for ruleName, and
+// that Matchers.SpecChanged reads back to detect drift. See SpecHashAnnotationPrefix.
+func SpecHashAnnotationKey(ruleName string) string {
+	return SpecHashAnnotationPrefix + ruleName
+}
+
+// ProtectedNamespaces lists namespaces that a block rule's payload is never allowed to block,
+// regardless of which rule matched, so that a broadly-targeted block rule can't accidentally lock
+// kube-system or kube-graffiti's own namespace out of admission. It defaults to "kube-system"; the
+// main command also appends the namespace kube-graffiti itself is deployed into.
+var ProtectedNamespaces = []string{"kube-system"}
+
+// QuarantineLabelKey and QuarantineReasonAnnotationKey are the label/annotation keys that a block
+// payload with enforcement: quarantine stamps onto a matched object instead of denying the request:
+// the label carries the name of the rule that quarantined the object, so a separate controller can
+// select on it, and the annotation carries the same message enforcement: deny would have rejected the
+// request with. Both default to empty - a rule must configure them, globally or on the payload itself,
+// before it may use enforcement: quarantine, so that quarantining can never silently no-op.
+var (
+	QuarantineLabelKey            = ""
+	QuarantineReasonAnnotationKey = ""
+)
+
+// isProtectedNamespace reports whether namespace is one that a block rule is never allowed to block.
+func isProtectedNamespace(namespace string) bool {
+	for _, n := range ProtectedNamespaces {
+		if n == namespace {
+			return true
+		}
+	}
+	return false
+}
+
 // BooleanOperator defines the logical boolean operator applied to label and field selector results.
 // It is AND by default, i.e. both label selector and field selector must match to
 type BooleanOperator int
@@ -46,11 +134,110 @@ type Rule struct {
 	Name     string   `yaml:"name,omitempty"`
 	Matchers Matchers `yaml:"matchers,omitempty"`
 	Payload  Payload  `yaml:"payload,omitempty"`
+	// SelfNamespaceSelector, when set, is checked against a Namespace object's own labels before
+	// Matchers is evaluated, and only ever affects objects of kind "Namespace" - every other kind
+	// matches regardless. It lets webhook.Registration's "self" namespace-selector-applies-to-namespaces
+	// mode enforce a registration's NamespaceSelector deterministically in-process once the apiserver's
+	// namespace-selector has been dropped from that registration's namespaces target.
+	SelfNamespaceSelector string `yaml:"self-namespace-selector,omitempty"`
+	// EvaluateOn lists which operations this rule is evaluated for: "CREATE", "UPDATE", and the
+	// pseudo-operation "EXISTING" that the existing-objects sweep's Mutate evaluates under, since it has
+	// no real admission operation of its own. A CREATE or UPDATE admission request whose operation isn't
+	// listed is short-circuited by MutateAdmission to allowed-with-no-patch without evaluating Matchers
+	// or Payload at all - useful for a rule, such as one stamping provenance, that only ever makes sense
+	// on an object's own CREATE. Left empty, every operation is evaluated, including EXISTING; EXISTING
+	// is excluded only once EvaluateOn is set explicitly and doesn't list it. See validateEvaluateOn for
+	// how this relates to admissionOperations, the operations a webhook registration always subscribes
+	// to today.
+	EvaluateOn []string `yaml:"evaluate-on,omitempty"`
+	// Budget caps how many objects this rule may mutate within a time window - see Budget.
+	Budget Budget `yaml:"budget,omitempty"`
+}
+
+// OperationExisting is the pseudo-operation EvaluateOn is matched against for objects processed by the
+// existing-objects sweep (Rule.Mutate), which has no real CREATE/UPDATE admission operation of its own.
+const OperationExisting = "EXISTING"
+
+// evaluatesOn reports whether operation - an admission request's "CREATE"/"UPDATE", or the
+// pseudo-operation OperationExisting - should be evaluated for r. An unset EvaluateOn evaluates every
+// operation; an explicit one only evaluates the operations it lists.
+func (r Rule) evaluatesOn(operation string) bool {
+	if len(r.EvaluateOn) == 0 {
+		return true
+	}
+	for _, op := range r.EvaluateOn {
+		if strings.EqualFold(op, operation) {
+			return true
+		}
+	}
+	return false
+}
+
+// admissionOperations are the operations every webhook registration subscribes to today (see
+// webhook.buildWebhook) - kube-graffiti does not yet support configuring this per registration, so
+// validateEvaluateOn is checked against this fixed set rather than anything read from a Registration.
+var admissionOperations = []string{"CREATE", "UPDATE"}
+
+// validateEvaluateOn checks that every entry in r.EvaluateOn is a recognised operation, and that the
+// set relates sensibly to admissionOperations. Excluding one of admissionOperations still lets the
+// apiserver call this rule's webhook for it - MutateAdmission just immediately skips it - which is
+// wasteful but not wrong, so it's only a warning; excluding all of admissionOperations means the rule
+// would never be evaluated on admission at all, which is always a mistake, so it's rejected outright.
+func (r Rule) validateEvaluateOn(rulelog zerolog.Logger) error {
+	if len(r.EvaluateOn) == 0 {
+		return nil
+	}
+
+	var matchedAdmissionOps []string
+	for _, op := range r.EvaluateOn {
+		switch {
+		case strings.EqualFold(op, OperationExisting):
+		case matchesAny(op, admissionOperations):
+			matchedAdmissionOps = append(matchedAdmissionOps, op)
+		default:
+			return fmt.Errorf("evaluate-on entry %q is not one of CREATE, UPDATE or EXISTING", op)
+		}
+	}
+
+	if len(matchedAdmissionOps) == 0 {
+		return fmt.Errorf("evaluate-on %v shares no operation with the registered admission operations %v - this rule would never be evaluated on admission", r.EvaluateOn, admissionOperations)
+	}
+	if len(matchedAdmissionOps) < len(admissionOperations) {
+		rulelog.Warn().Strs("evaluate-on", r.EvaluateOn).Strs("registered-operations", admissionOperations).Msg("evaluate-on excludes a registered admission operation - the apiserver will still call this rule's webhook for it, only for it to be skipped, wasting the call")
+	}
+	return nil
 }
 
-// metaObject is used only for pulling out object metadata
+// matchesAny reports whether s case-insensitively equals any of candidates.
+func matchesAny(s string, candidates []string) bool {
+	for _, c := range candidates {
+		if strings.EqualFold(s, c) {
+			return true
+		}
+	}
+	return false
+}
+
+// metaObject is used for pulling out object metadata, plus the narrow slice of a Pod's spec that the
+// scheduling-gate/node-selector addition helpers need. Unmarshalling into Spec is harmless for
+// non-Pod kinds - there's simply nothing for it to match in their JSON.
 type metaObject struct {
+	Kind string            `json:"kind"`
 	Meta metav1.ObjectMeta `json:"metadata"`
+	Spec podSpec           `json:"spec"`
+}
+
+// existingFinalizers returns an object's current finalizers and the JSON Pointer path they live at.
+// Almost every kind carries its finalizers at metadata.finalizers, but a Namespace can instead carry
+// them at spec.finalizers - see podSpec.Finalizers. metadata.finalizers wins when both are present.
+func (m metaObject) existingFinalizers() ([]string, string) {
+	if len(m.Meta.Finalizers) > 0 {
+		return m.Meta.Finalizers, "/metadata/finalizers"
+	}
+	if m.Kind == "Namespace" && len(m.Spec.Finalizers) > 0 {
+		return m.Spec.Finalizers, "/spec/finalizers"
+	}
+	return nil, "/metadata/finalizers"
 }
 
 // Validate - validates the matchers and payload of a graffiti rule
@@ -61,32 +248,202 @@ func (r Rule) Validate(rulelog zerolog.Logger) (err error) {
 	if err = r.Payload.validate(); err != nil {
 		return fmt.Errorf("rule '%s' failed validation: %v", r.Name, err)
 	}
+	if err = r.validateQuarantineSelfReference(); err != nil {
+		return fmt.Errorf("rule '%s' failed validation: %v", r.Name, err)
+	}
+	if err = r.validateEvaluateOn(rulelog); err != nil {
+		return fmt.Errorf("rule '%s' failed validation: %v", r.Name, err)
+	}
+	if err = r.Budget.validate(); err != nil {
+		return fmt.Errorf("rule '%s' failed validation: %v", r.Name, err)
+	}
+	return nil
+}
+
+// validateQuarantineSelfReference ensures that a block rule enforced as a quarantine doesn't select on
+// the very label/annotation it marks matched objects with: if it did, marking an object would change
+// whether the rule matches it, letting the object retrigger the rule on its very next evaluation.
+func (r Rule) validateQuarantineSelfReference() error {
+	if !r.Payload.Block || !strings.EqualFold(r.Payload.Enforcement, "quarantine") {
+		return nil
+	}
+	labelKey := r.Payload.quarantineLabelKey()
+	annotationKey := r.Payload.quarantineReasonAnnotationKey()
+
+	for _, selector := range r.Matchers.LabelSelectors {
+		reqs, err := labels.ParseToRequirements(selector)
+		if err != nil {
+			return err
+		}
+		for _, req := range reqs {
+			if req.Key() == labelKey {
+				return fmt.Errorf("label-selector %q references the rule's own quarantine-label-key %q, which would let marking an object retrigger the rule", selector, labelKey)
+			}
+		}
+	}
+
+	for _, selector := range r.Matchers.FieldSelectors {
+		realSelector, err := fields.ParseSelector(selector)
+		if err != nil {
+			return err
+		}
+		for _, req := range realSelector.Requirements() {
+			if req.Field == "metadata.labels."+labelKey || req.Field == "metadata.annotations."+annotationKey {
+				return fmt.Errorf("field-selector %q references the rule's own quarantine marker, which would let marking an object retrigger the rule", selector)
+			}
+		}
+	}
+
 	return nil
 }
 
 // MutateAdmission takes an admission request and generates an admission response based on the response from Mutate.
 // It implements the graffitiMutator interface and so can be added to the webhook handler's tagmap
-func (r Rule) MutateAdmission(req *admission.AdmissionRequest) *admission.AdmissionResponse {
+func (r Rule) MutateAdmission(ctx context.Context, req *admission.AdmissionRequest) *admission.AdmissionResponse {
+	_, span := tracing.StartSpan(ctx, "MutateAdmission")
+	span.SetAttribute("rule", r.Name)
+	defer span.End()
+
 	mylog := log.ComponentLogger(componentName, "MutateAdmission")
 	mylog = mylog.With().Str("rule", r.Name).Str("kind", req.Kind.String()).Str("name", req.Name).Str("namespace", req.Namespace).Logger()
 
+	if !r.Matchers.matchesAPIVersion(req.Kind.Version) {
+		mylog.Debug().Str("api-version", req.Kind.Version).Msg("rule's api-version-selectors do not include this request's api-version, skipping")
+		span.SetAttribute("matched", "false")
+		return patchResult(nil, r.Name, protectedNamespace(req))
+	}
+
+	if !r.Matchers.matchesOriginalKind(req.Kind.Kind) {
+		mylog.Debug().Str("original-kind", req.Kind.Kind).Msg("rule's original-kind-selectors do not include this request's kind, skipping")
+		span.SetAttribute("matched", "false")
+		return patchResult(nil, r.Name, protectedNamespace(req))
+	}
+
+	if !r.Matchers.applicableToKind(req.Kind.Kind) {
+		mylog.Debug().Str("kind", req.Kind.Kind).Msg("rule's matchers could never match this request's kind, skipping without flattening the object")
+		span.SetAttribute("matched", "false")
+		return patchResult(nil, r.Name, protectedNamespace(req))
+	}
+
+	if !r.evaluatesOn(string(req.Operation)) {
+		mylog.Debug().Str("operation", string(req.Operation)).Strs("evaluate-on", r.EvaluateOn).Msg("rule's evaluate-on does not include this request's operation, skipping")
+		metrics.OperationsSkipped.Observe(r.Name, 1)
+		span.SetAttribute("matched", "false")
+		return patchResult(nil, r.Name, protectedNamespace(req))
+	}
+
+	if req.SubResource != "" && r.Payload.Clamp.Path == "" {
+		mylog.Debug().Str("subresource", req.SubResource).Msg("request is for a subresource that doesn't carry the object's full metadata, skipping")
+		span.SetAttribute("matched", "false")
+		return patchResult(nil, r.Name, protectedNamespace(req))
+	}
+
 	object, err := extractObject(req)
 	if err != nil {
 		admissionResponseError(fmt.Errorf("failed to extract object from admission request: %v", err))
 	}
 
-	patch, err := r.Mutate(object)
+	if items, ok := listItems(req.Kind.Kind, object); ok {
+		patch, blocked, blockedItem, err := r.mutateListAdmission(req, items, mylog)
+		if err != nil {
+			span.SetAttribute("matched", "false")
+			return admissionResponseError(fmt.Errorf("failed to mutate list admission request: %v", err))
+		}
+		if blocked {
+			span.SetAttribute("matched", "true")
+			return blockListResult(r.Name, blockedItem)
+		}
+		span.SetAttribute("matched", strconv.FormatBool(patch != nil))
+		span.SetAttribute("patch.bytes", strconv.Itoa(len(patch)))
+		return patchResult(patch, r.Name, protectedNamespace(req))
+	}
+
+	if hasSkipAnnotation(object, AdmissionSkipAnnotationKey) {
+		mylog.Debug().Str("annotation", AdmissionSkipAnnotationKey).Msg("object opts out of admission mutation, skipping")
+		span.SetAttribute("matched", "false")
+		return patchResult(nil, r.Name, protectedNamespace(req))
+	}
+
+	if skip, ownerKind := r.Payload.ShouldSkipControllerOwned(req.Kind.Kind, ownerReferences(object), false); skip {
+		mylog.Debug().Str("owner-kind", ownerKind).Msg("object is owned by a controller that would immediately revert this mutation, skipping")
+		span.SetAttribute("matched", "false")
+		return patchResult(nil, r.Name, protectedNamespace(req))
+	}
+
+	patch, matched, err := r.mutateWithTimeout(object, &req.UserInfo, string(req.Operation), req.Kind.Kind)
+	var timeoutErr *RuleTimeoutError
+	if errors.As(err, &timeoutErr) {
+		mylog.Warn().Dur("per-rule-timeout", PerRuleTimeout).Msg("rule's mutation exceeded its per-rule-timeout, skipping this object")
+		metrics.RuleTimeouts.Observe(r.Name, 1)
+		span.SetAttribute("matched", "false")
+		return ruleTimeoutResult(timeoutErr)
+	}
+	var budgetErr *BudgetExceededError
+	if errors.As(err, &budgetErr) {
+		span.SetAttribute("matched", "true")
+		return budgetExceededResult(budgetErr)
+	}
 	if err != nil {
+		span.SetAttribute("matched", "false")
 		return admissionResponseError(fmt.Errorf("failed to mutate object: %v", err))
 	}
 
-	return patchResult(patch, r.Name)
+	span.SetAttribute("matched", strconv.FormatBool(matched))
+	span.SetAttribute("patch.bytes", strconv.Itoa(len(patch)))
+	if matched && patch == nil {
+		mylog.Debug().Msg("rule matched but produced no patch - the object already has everything it needs")
+		metrics.MatchedNoChangeNeeded.Observe(r.Name, 1)
+		return noChangeResult()
+	}
+	return patchResult(patch, r.Name, protectedNamespace(req))
+}
+
+// noChangeResult is returned instead of patchResult(nil, ...) when a rule matched an object but its
+// payload left nothing to change - e.g. the additions it would make are already present - so the
+// admission response message says so, rather than the misleading "rule didn't match".
+func noChangeResult() *admission.AdmissionResponse {
+	return &admission.AdmissionResponse{
+		Allowed: true,
+		Result: &metav1.Status{
+			Message: "rule matched, no change needed",
+		},
+	}
+}
+
+// protectedNamespace returns the namespace a block payload must not be allowed to block for req, i.e.
+// req.Namespace, or req.Name itself when the request is for a Namespace object.
+func protectedNamespace(req *admission.AdmissionRequest) string {
+	if req.Namespace != "" {
+		return req.Namespace
+	}
+	if req.Kind.Kind == "Namespace" {
+		return req.Name
+	}
+	return ""
+}
+
+// hasSkipAnnotation reports whether a raw object carries the given annotation set to "true".
+func hasSkipAnnotation(object []byte, key string) bool {
+	var mo metaObject
+	if err := json.Unmarshal(object, &mo); err != nil {
+		return false
+	}
+	return mo.Meta.Annotations[key] == "true"
+}
+
+// ownerReferences returns the owner references of a raw object, or nil if they can't be read.
+func ownerReferences(object []byte) []metav1.OwnerReference {
+	var mo metaObject
+	if err := json.Unmarshal(object, &mo); err != nil {
+		return nil
+	}
+	return mo.Meta.OwnerReferences
 }
 
 func extractObject(req *admission.AdmissionRequest) (result []byte, err error) {
 	// make sure that name and namespace fields are populated in the metadata object
 	object := make(map[string]interface{})
-	if err = json.Unmarshal(req.Object.Raw, &object); err != nil {
+	if err = unmarshalPreservingNumbers(req.Object.Raw, &object); err != nil {
 		return result, err
 	}
 	if req.Name != "" {
@@ -98,23 +455,53 @@ func extractObject(req *admission.AdmissionRequest) (result []byte, err error) {
 	return json.Marshal(object)
 }
 
-func patchResult(patch []byte, name string) *admission.AdmissionResponse {
+// SuppressAllowedResultMessage, when true, makes patchResult omit the informational Result.Message it
+// would otherwise set on an Allowed admission response ("rule didn't match", "object painted by
+// kube-graffiti"), to reduce apiserver log noise from operators that log every admission response's
+// message verbosely. It has no effect on a block's Result.Message, which carries the actual reason the
+// request was denied and is never just informational.
+var SuppressAllowedResultMessage = false
+
+// allowedResultMessage returns message, or "" when SuppressAllowedResultMessage is set - the single
+// place patchResult's Allowed branches decide whether their informational message is worth keeping.
+func allowedResultMessage(message string) string {
+	if SuppressAllowedResultMessage {
+		return ""
+	}
+	return message
+}
+
+func patchResult(patch []byte, name, namespace string) *admission.AdmissionResponse {
 	if patch == nil {
 		return &admission.AdmissionResponse{
 			Allowed: true,
 			Result: &metav1.Status{
-				Message: "rule didn't match",
+				Message: allowedResultMessage("rule didn't match"),
 			},
 		}
 	}
 
 	// handle a rule which blocks instead of patching...
-	if bytes.Equal(patch, []byte("BLOCK")) {
+	if IsBlockPatch(patch) {
+		if isProtectedNamespace(namespace) {
+			mylog := log.ComponentLogger(componentName, "patchResult")
+			mylog.Warn().Str("rule", name).Str("namespace", namespace).Msg("a block rule matched an object in a protected namespace, allowing the request instead of blocking it")
+			return &admission.AdmissionResponse{
+				Allowed: true,
+				Result: &metav1.Status{
+					Message: allowedResultMessage("rule didn't match"),
+				},
+			}
+		}
+		message, ok := BlockPatchMessage(patch)
+		if !ok {
+			message = blockReason(name)
+		}
 		return &admission.AdmissionResponse{
 			Allowed: false,
 			Result: &metav1.Status{
 				Reason:  metav1.StatusReasonForbidden,
-				Message: fmt.Sprintf("blocked by kube-graffiti rule: %s", name),
+				Message: message,
 			},
 			Patch: nil,
 		}
@@ -124,13 +511,70 @@ func patchResult(patch []byte, name string) *admission.AdmissionResponse {
 	return &admission.AdmissionResponse{
 		Allowed: true,
 		Result: &metav1.Status{
-			Message: "object painted by kube-graffiti",
+			Message: allowedResultMessage("object painted by kube-graffiti"),
 		},
 		PatchType: &pt,
 		Patch:     patch,
 	}
 }
 
+// budgetExceededResult renders the distinct allowed-unpatched admission response a Budget produces
+// once its rule has hit MaxMutations within the current window: the request goes through unmodified,
+// rather than being treated as an internal error, so a mutation budget fails open.
+func budgetExceededResult(e *BudgetExceededError) *admission.AdmissionResponse {
+	verb := "skipping"
+	if e.Mode == BudgetOnExceededPause {
+		verb = "pausing"
+	}
+	return &admission.AdmissionResponse{
+		Allowed: true,
+		Result: &metav1.Status{
+			Message: fmt.Sprintf("rule '%s' mutation budget exceeded, %s this object until its window resets", e.Rule, verb),
+		},
+	}
+}
+
+// ruleTimeoutResult renders the distinct allowed-unpatched admission response mutateWithTimeout
+// produces once a rule has exceeded PerRuleTimeout: the request goes through unmodified, rather than
+// being treated as an internal error, so a slow rule fails open the same way a Budget does.
+func ruleTimeoutResult(e *RuleTimeoutError) *admission.AdmissionResponse {
+	return &admission.AdmissionResponse{
+		Allowed: true,
+		Result: &metav1.Status{
+			Message: e.Error(),
+		},
+	}
+}
+
+// blockReason renders the message a block payload rejects an admission request with, or records as
+// the reason a quarantine-enforced block instead marked the object with, for rule name.
+func blockReason(name string) string {
+	return fmt.Sprintf("blocked by kube-graffiti rule: %s", name)
+}
+
+// blockPatchPrefix is the sentinel paintObject returns instead of a JSON patch to signal that a Block
+// payload denies the request. It is optionally followed by ":" and a message - see BlockPatchMessage -
+// rendered from the payload's BlockMessage template; when BlockMessage is unset the bare prefix is
+// returned unchanged, exactly as before BlockMessage existed, so existing callers and tests that
+// compare against the literal "BLOCK" keep working.
+const blockPatchPrefix = "BLOCK"
+
+// IsBlockPatch reports whether patch is the sentinel paintObject returns for a denied Block payload,
+// with or without a message attached.
+func IsBlockPatch(patch []byte) bool {
+	return bytes.Equal(patch, []byte(blockPatchPrefix)) || bytes.HasPrefix(patch, []byte(blockPatchPrefix+":"))
+}
+
+// BlockPatchMessage extracts a Block payload's rendered message from patch, reporting ok=false when
+// patch carries no message - a bare "BLOCK" sentinel, or anything that isn't a block patch at all.
+func BlockPatchMessage(patch []byte) (message string, ok bool) {
+	prefix := []byte(blockPatchPrefix + ":")
+	if !bytes.HasPrefix(patch, prefix) {
+		return "", false
+	}
+	return string(patch[len(prefix):]), true
+}
+
 // addMetadata adds/sets a metadata item, creating new metadata map if required.
 func addMetadata(obj map[string]interface{}, k, v string) {
 	if obj == nil {
@@ -151,37 +595,215 @@ func admissionResponseError(err error) *admission.AdmissionResponse {
 	return &admission.AdmissionResponse{
 		Allowed: true,
 		Result: &metav1.Status{
+			Reason:  metav1.StatusReasonInternalError,
 			Message: err.Error(),
 		},
 	}
 }
 
 // Mutate takes a raw object and applies the graffiti rule against it, returning a JSON patch or an error.
-// It performs the logic between selectors and the boolean-operator.
-func (r Rule) Mutate(object []byte) (patch []byte, err error) {
+// It performs the logic between selectors and the boolean-operator. There is no submitting user to
+// test against, e.g. when processing existing objects, so ModifiedByUsers/ModifiedByGroups matchers
+// are skipped. Internally this is treated as the OperationExisting pseudo-operation: the payload's
+// scheduling-gates/node-selector additions - which only ever apply to a Pod CREATE - are always
+// skipped, since an object reached through Mutate is, by definition, not being created right now, and
+// a rule whose EvaluateOn excludes OperationExisting never paints an object reached this way at all.
+func (r Rule) Mutate(ctx context.Context, object []byte) (patch []byte, err error) {
+	patch, _, err = r.MutateExisting(ctx, object)
+	return patch, err
+}
+
+// MutateExisting is Mutate, but also reports whether the rule actually matched the object. Mutate's
+// nil-patch return conflates "didn't match" with "matched but produced no patch" (e.g. every addition
+// it would make is already present) - the existing sweep's unpaint reconciliation (see pkg/existing)
+// needs to tell those two apart, so that a rule which is simply up to date doesn't have its earlier
+// additions removed just because this sweep's patch for it happened to be empty.
+func (r Rule) MutateExisting(ctx context.Context, object []byte) (patch []byte, matched bool, err error) {
+	_, span := tracing.StartSpan(ctx, "Mutate")
+	span.SetAttribute("rule", r.Name)
+	defer span.End()
+
+	if !r.evaluatesOn(OperationExisting) {
+		mylog := log.ComponentLogger(componentName, "Mutate")
+		mylog.Debug().Str("rule", r.Name).Strs("evaluate-on", r.EvaluateOn).Msg("rule's evaluate-on excludes the existing-objects sweep, skipping")
+		span.SetAttribute("matched", "false")
+		return nil, false, nil
+	}
+
+	patch, matched, err = r.mutate(object, nil, OperationExisting, "")
+	var budgetErr *BudgetExceededError
+	if errors.As(err, &budgetErr) {
+		mylog := log.ComponentLogger(componentName, "Mutate")
+		mylog.Debug().Str("rule", r.Name).Msg("rule's mutation budget is exceeded, deferring this object to a later sweep")
+		span.SetAttribute("matched", strconv.FormatBool(matched))
+		return nil, matched, nil
+	}
+	span.SetAttribute("matched", strconv.FormatBool(matched))
+	span.SetAttribute("patch.bytes", strconv.Itoa(len(patch)))
+	return patch, matched, err
+}
+
+// PerRuleTimeout bounds how long a single rule's mutate (matchers plus payload templating) is allowed
+// to run during admission before mutateWithTimeout abandons it, so that one slow rule - e.g. one whose
+// templates or CEL matchers are doing expensive work - cannot hold up the http handler goroutine
+// handling its admission request indefinitely. It defaults to disabled (0, meaning "wait forever"),
+// matching the zero value of a duration that was never configured; set per-rule-timeout to enable it.
+var PerRuleTimeout time.Duration
+
+// RuleTimeoutError is returned by mutateWithTimeout when a rule's mutate call does not complete within
+// PerRuleTimeout, so that MutateAdmission can tell a timeout apart from every other mutate error and
+// render ruleTimeoutResult instead of admissionResponseError.
+type RuleTimeoutError struct {
+	Rule string
+}
+
+func (e *RuleTimeoutError) Error() string {
+	return fmt.Sprintf("rule '%s' mutation exceeded its per-rule-timeout", e.Rule)
+}
+
+// mutateWithTimeout runs mutate on its own goroutine and returns RuleTimeoutError if it hasn't finished
+// within PerRuleTimeout, leaving the abandoned mutate call to finish in the background and be discarded
+// - mirroring the template-level TemplateTimeout in patch.go, but bounding a whole rule's mutation
+// rather than a single template execution. A PerRuleTimeout of zero disables the bound entirely, so the
+// common case of no configured timeout adds no goroutine or select overhead.
+func (r Rule) mutateWithTimeout(object []byte, userInfo *authv1.UserInfo, operation, kind string) (patch []byte, matched bool, err error) {
+	if PerRuleTimeout <= 0 {
+		return r.mutate(object, userInfo, operation, kind)
+	}
+
+	type result struct {
+		patch   []byte
+		matched bool
+		err     error
+	}
+	done := make(chan result, 1)
+	go func() {
+		patch, matched, err := r.mutate(object, userInfo, operation, kind)
+		done <- result{patch, matched, err}
+	}()
+
+	select {
+	case res := <-done:
+		return res.patch, res.matched, res.err
+	case <-time.After(PerRuleTimeout):
+		return nil, false, &RuleTimeoutError{Rule: r.Name}
+	}
+}
+
+// mutate is the shared implementation behind Mutate and MutateAdmission. userInfo is nil when there
+// is no submitting user to test against, e.g. when processing existing objects. operation is the
+// admission operation ("CREATE"/"UPDATE") being performed, or OperationExisting when there isn't one.
+// kind is the object's kind as the admission request itself declares it, or "" when there isn't one -
+// an admission request's raw object JSON does not reliably carry its own "kind" field, so this can't
+// simply be read off the unmarshalled metaObject the way the rest of its fields are.
+func (r Rule) mutate(object []byte, userInfo *authv1.UserInfo, operation, kind string) (patch []byte, matched bool, err error) {
 	mylog := log.ComponentLogger(componentName, "Mutate")
 	mylog = mylog.With().Str("rule", r.Name).Logger()
-	var metaObject metaObject
+	mylog.Debug().Str("object", string(log.RedactObject(object))).Msg("evaluating object against rule")
 
-	if err := json.Unmarshal(object, &metaObject); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal generic object metadata from the admission request: %v", err)
+	// decode the raw object once, then derive both metaObject and the field map from that single
+	// decode rather than re-parsing the same bytes for each.
+	jsonObject, err := decodeRawObject(object)
+	if err != nil {
+		return nil, false, err
 	}
 
-	// create the field map for use with field matchers and addition templating.
-	fieldMap, err := makeFieldMapFromRawObject(object)
+	var metaObject metaObject
+	rawForMeta, err := json.Marshal(jsonObject)
 	if err != nil {
-		return nil, err
+		return nil, false, fmt.Errorf("failed to unmarshal generic object metadata from the admission request: %v", err)
+	}
+	if err := json.Unmarshal(rawForMeta, &metaObject); err != nil {
+		return nil, false, fmt.Errorf("failed to unmarshal generic object metadata from the admission request: %v", err)
+	}
+	if kind != "" {
+		metaObject.Kind = kind
 	}
 
-	match, err := r.Matchers.matches(metaObject, fieldMap, mylog)
+	if metaObject.Kind == "Namespace" && r.SelfNamespaceSelector != "" {
+		selfMatch, err := MatchLabelSelector(r.SelfNamespaceSelector, metaObject.Meta.Labels)
+		if err != nil {
+			return nil, false, err
+		}
+		if !selfMatch {
+			mylog.Debug().Msg("namespace does not match the registration's namespace-selector evaluated against its own labels - not painting")
+			return nil, false, nil
+		}
+	}
+
+	// create the field map for use with field matchers and addition templating.
+	fieldMap := fieldMapFromParsedObject(jsonObject)
+
+	match, err := r.Matchers.matches(r.Name, metaObject, fieldMap, userInfo, mylog)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 	if match {
+		if r.Budget.enabled() {
+			if exceeded, mode := r.checkBudget(metaObject, mylog); exceeded && mode != BudgetOnExceededWarn {
+				return nil, true, &BudgetExceededError{Rule: r.Name, Mode: mode}
+			}
+		}
 		mylog.Info().Msg("rule matched - painting object")
-		return r.Payload.paintObject(metaObject, fieldMap, mylog)
+		patch, err := r.Payload.paintObject(metaObject, fieldMap, object, r.Name, userInfo, operation, mylog)
+		return patch, true, err
 	}
 
 	mylog.Debug().Msg("rule didn't match - not painting object")
+	return nil, false, nil
+}
+
+// checkBudget counts a mutation of metaObject against r.Budget and reports whether doing so exceeded
+// it, along with the OnExceeded mode callers should act on.
+func (r Rule) checkBudget(metaObject metaObject, mylog zerolog.Logger) (exceeded bool, mode string) {
+	window, err := r.Budget.windowDuration()
+	if err != nil {
+		// already rejected by validation at startup; fall back to the default rather than panic.
+		window = defaultBudgetWindow
+	}
+	mode = r.Budget.onExceeded()
+	key := r.Budget.scopeKey(r.Name, metaObject)
+	if !globalBudgetTracker.countAndCheck(key, r.Budget.MaxMutations, window, time.Now()) {
+		return false, mode
+	}
+	metrics.MutationBudgetExceeded.Observe(r.Name, 1)
+	mylog.Warn().Str("on-exceeded", mode).Int("max-mutations", r.Budget.MaxMutations).Str("window", window.String()).Msg("rule's mutation budget is exceeded")
+	return true, mode
+}
+
+// ApplyRules evaluates a set of rules against a single raw object, giving block rules precedence
+// over mutating rules regardless of the order rules appear in: if any block rule matches, its
+// "BLOCK" patch is returned immediately without evaluating the mutating rules at all. Otherwise the
+// first matching mutating rule's patch is returned, or nil if none match.
+func ApplyRules(rules []Rule, object []byte) (patch []byte, err error) {
+	mylog := log.ComponentLogger(componentName, "ApplyRules")
+
+	for _, r := range rules {
+		if !r.Payload.Block {
+			continue
+		}
+		p, err := r.Mutate(context.Background(), object)
+		if err != nil {
+			return nil, err
+		}
+		if p != nil {
+			mylog.Info().Str("rule", r.Name).Msg("a block rule matched, short-circuiting before any mutating rules are evaluated")
+			return p, nil
+		}
+	}
+
+	for _, r := range rules {
+		if r.Payload.Block {
+			continue
+		}
+		p, err := r.Mutate(context.Background(), object)
+		if err != nil {
+			return nil, err
+		}
+		if p != nil {
+			return p, nil
+		}
+	}
+
 	return nil, nil
 }
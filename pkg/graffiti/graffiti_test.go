@@ -14,15 +14,20 @@ limitations under the License.
 package graffiti
 
 import (
+	"context"
 	"encoding/json"
 	"testing"
+	"time"
 
+	"github.com/HotelsDotCom/kube-graffiti/pkg/metrics"
+	"github.com/HotelsDotCom/kube-graffiti/pkg/tracing"
 	jsonpatch "github.com/cameront/go-jsonpatch"
 	"github.com/rs/zerolog/log"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	yaml "gopkg.in/yaml.v2"
 	admission "k8s.io/api/admission/v1beta1"
+	"k8s.io/apimachinery/pkg/runtime"
 )
 
 const testReview = `{
@@ -79,6 +84,31 @@ func TestAddMetadata(t *testing.T) {
 	addMetadata(a, "x", "y")
 }
 
+// TestExtractObjectPreservesIntegerPrecisionBeyondFloat64 confirms that an admission request's raw
+// object round-trips a large int64 (near 2^53, where float64 starts losing precision) byte-for-byte,
+// rather than coming back out in scientific notation or with the last digits zeroed.
+func TestExtractObjectPreservesIntegerPrecisionBeyondFloat64(t *testing.T) {
+	req := &admission.AdmissionRequest{
+		Object: runtime.RawExtension{Raw: []byte(`{"metadata":{"name":"big-id"},"spec":{"counter":9007199254740993}}`)},
+	}
+
+	object, err := extractObject(req)
+	require.NoError(t, err)
+	assert.Contains(t, string(object), `"counter":9007199254740993`)
+}
+
+// TestExtractObjectStillRoundTripsAGenuineFloat confirms the number-preserving decode doesn't turn a
+// genuine fractional value into a string or otherwise mangle it.
+func TestExtractObjectStillRoundTripsAGenuineFloat(t *testing.T) {
+	req := &admission.AdmissionRequest{
+		Object: runtime.RawExtension{Raw: []byte(`{"metadata":{"name":"ratio"},"spec":{"cpuRequest":1.5}}`)},
+	}
+
+	object, err := extractObject(req)
+	require.NoError(t, err)
+	assert.Contains(t, string(object), `"cpuRequest":1.5`)
+}
+
 func TestReviewObjectDoesNotHaveMetaData(t *testing.T) {
 	rule := Rule{Matchers: Matchers{LabelSelectors: []string{"author = stephen"}}}
 
@@ -121,7 +151,7 @@ func TestReviewObjectDoesNotHaveMetaData(t *testing.T) {
 	err := json.Unmarshal([]byte(missingMetaData), &review)
 	require.NoError(t, err, "couldn't marshall a valid admission review object from test json")
 
-	resp := rule.MutateAdmission(review.Request)
+	resp := rule.MutateAdmission(context.Background(), review.Request)
 	assert.NotNil(t, resp)
 	assert.Equal(t, true, resp.Allowed, "failed rules should not block the source api request")
 	assert.Nil(t, resp.Patch, "there shouldn't be patch")
@@ -142,7 +172,7 @@ func TestNoSelectorsMeansMatchEverything(t *testing.T) {
 	require.NoError(t, err, "couldn't marshall a valid admission review object from test json")
 
 	// call Mutate
-	resp := rule.MutateAdmission(review.Request)
+	resp := rule.MutateAdmission(context.Background(), review.Request)
 
 	assert.Equal(t, true, resp.Allowed, "failed rules should not block the source api request")
 	assert.NotNil(t, resp.Patch)
@@ -164,7 +194,7 @@ func TestMatchingSelectorWithoutLablesOrAnnotationsProducesNoPatch(t *testing.T)
 	assert.NoError(t, err, "couldn't marshall a valid admission review object from test json")
 
 	// call Mutate
-	resp := rule.MutateAdmission(review.Request)
+	resp := rule.MutateAdmission(context.Background(), review.Request)
 	assert.Equal(t, true, resp.Allowed, "the request should be successful")
 	assert.Nil(t, resp.Patch)
 }
@@ -227,7 +257,7 @@ func TestHandlesNoSourceObjectLabelsOrAnnotations(t *testing.T) {
 	require.NoError(t, err, "couldn't marshall a valid admission review object from test json")
 
 	// call Mutate
-	resp := rule.MutateAdmission(review.Request)
+	resp := rule.MutateAdmission(context.Background(), review.Request)
 	assert.Equal(t, true, resp.Allowed, "the request should be successful")
 	assert.NotNil(t, resp.Patch)
 	assert.Equal(t, `[ { "op": "add", "path": "/metadata/labels", "value": { "modified-by-graffiti": "abc123" }} ]`, string(resp.Patch))
@@ -245,7 +275,67 @@ matchers:
 	err := yaml.Unmarshal([]byte(source), &rule)
 	assert.NoError(t, err, "couldn't marshall a valid rule object")
 	err = rule.Validate(mylog)
-	assert.EqualError(t, err, "rule 'my-rule' failed validation: a rule payload must specify either additions/deletions, a json-patch, or a block")
+	assert.EqualError(t, err, "rule 'my-rule' failed validation: a rule payload must specify either additions/deletions, a json-patch, a desired-state, a block, a clamp or a delegate")
+}
+
+func TestQuarantineRuleMayNotLabelSelectOnItsOwnQuarantineLabel(t *testing.T) {
+	var source = `---
+name: "quarantine-loop"
+matchers:
+  label-selectors:
+  - "policy.company.com/quarantined=quarantine-loop"
+payload:
+  block: true
+  enforcement: quarantine
+  quarantine-label-key: policy.company.com/quarantined
+  quarantine-reason-annotation-key: policy.company.com/quarantine-reason
+`
+	mylog := log.Logger
+	var rule Rule
+	err := yaml.Unmarshal([]byte(source), &rule)
+	assert.NoError(t, err, "couldn't marshall a valid rule object")
+	err = rule.Validate(mylog)
+	assert.EqualError(t, err, `rule 'quarantine-loop' failed validation: label-selector "policy.company.com/quarantined=quarantine-loop" references the rule's own quarantine-label-key "policy.company.com/quarantined", which would let marking an object retrigger the rule`)
+}
+
+func TestQuarantineRuleMayNotFieldSelectOnItsOwnQuarantineAnnotation(t *testing.T) {
+	var source = `---
+name: "quarantine-loop"
+matchers:
+  field-selectors:
+  - "metadata.annotations.policy.company.com/quarantine-reason=already quarantined"
+payload:
+  block: true
+  enforcement: quarantine
+  quarantine-label-key: policy.company.com/quarantined
+  quarantine-reason-annotation-key: policy.company.com/quarantine-reason
+`
+	mylog := log.Logger
+	var rule Rule
+	err := yaml.Unmarshal([]byte(source), &rule)
+	assert.NoError(t, err, "couldn't marshall a valid rule object")
+	err = rule.Validate(mylog)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "references the rule's own quarantine marker")
+}
+
+func TestQuarantineRuleSelectingOnUnrelatedLabelsIsValid(t *testing.T) {
+	var source = `---
+name: "quarantine-valid"
+matchers:
+  label-selectors:
+  - "fruit=apple"
+payload:
+  block: true
+  enforcement: quarantine
+  quarantine-label-key: policy.company.com/quarantined
+  quarantine-reason-annotation-key: policy.company.com/quarantine-reason
+`
+	mylog := log.Logger
+	var rule Rule
+	err := yaml.Unmarshal([]byte(source), &rule)
+	assert.NoError(t, err, "couldn't marshall a valid rule object")
+	assert.NoError(t, rule.Validate(mylog))
 }
 
 func TestWhenAdditionsAlreadyThereProducesNoPatch(t *testing.T) {
@@ -267,7 +357,652 @@ func TestWhenAdditionsAlreadyThereProducesNoPatch(t *testing.T) {
 	assert.NoError(t, err, "couldn't marshall a valid admission review object from test json")
 
 	// call Mutate
-	resp := rule.MutateAdmission(review.Request)
+	resp := rule.MutateAdmission(context.Background(), review.Request)
 	assert.Equal(t, true, resp.Allowed, "the request should be successful")
 	assert.Nil(t, resp.Patch)
+	assert.Equal(t, "rule matched, no change needed", resp.Result.Message, "the rule matched, so the message shouldn't claim it didn't match")
+}
+
+func TestApplyRulesBlockTakesPrecedenceOverMutation(t *testing.T) {
+	object := `{"metadata":{"name":"test-pod","namespace":"default","labels":{"env":"prod"}}}`
+	mutate := Rule{
+		Name:     "add-label",
+		Matchers: Matchers{LabelSelectors: []string{"env=prod"}},
+		Payload:  Payload{Additions: Additions{Labels: map[string]string{"painted": "true"}}},
+	}
+	block := Rule{
+		Name:     "block-prod",
+		Matchers: Matchers{LabelSelectors: []string{"env=prod"}},
+		Payload:  Payload{Block: true},
+	}
+
+	// mutating rule registered first, block rule second - block should still win
+	patch, err := ApplyRules([]Rule{mutate, block}, []byte(object))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("BLOCK"), patch)
+}
+
+func TestApplyRulesFallsBackToMutationWhenNoBlockMatches(t *testing.T) {
+	object := `{"metadata":{"name":"test-pod","namespace":"default","labels":{"env":"prod"}}}`
+	mutate := Rule{
+		Name:     "add-label",
+		Matchers: Matchers{LabelSelectors: []string{"env=prod"}},
+		Payload:  Payload{Additions: Additions{Labels: map[string]string{"painted": "true"}}},
+	}
+	block := Rule{
+		Name:     "block-dev",
+		Matchers: Matchers{LabelSelectors: []string{"env=dev"}},
+		Payload:  Payload{Block: true},
+	}
+
+	patch, err := ApplyRules([]Rule{block, mutate}, []byte(object))
+	require.NoError(t, err)
+	assert.NotNil(t, patch)
+	assert.NotEqual(t, []byte("BLOCK"), patch)
+}
+
+func TestApplyRulesReturnsNilWhenNothingMatches(t *testing.T) {
+	object := `{"metadata":{"name":"test-pod","namespace":"default"}}`
+	rule := Rule{
+		Name:     "add-label",
+		Matchers: Matchers{LabelSelectors: []string{"env=prod"}},
+		Payload:  Payload{Additions: Additions{Labels: map[string]string{"painted": "true"}}},
+	}
+
+	patch, err := ApplyRules([]Rule{rule}, []byte(object))
+	require.NoError(t, err)
+	assert.Nil(t, patch)
+}
+
+func TestMutateAdmissionNeverBlocksAProtectedNamespace(t *testing.T) {
+	old := ProtectedNamespaces
+	defer func() { ProtectedNamespaces = old }()
+	ProtectedNamespaces = []string{"kube-system"}
+
+	rule := Rule{
+		Name:     "block-everything",
+		Matchers: Matchers{MatchAll: true},
+		Payload:  Payload{Block: true},
+	}
+
+	var review = admission.AdmissionReview{}
+	err := json.Unmarshal([]byte(`{
+		"kind":"AdmissionReview",
+		"apiVersion":"admission.k8s.io/v1beta1",
+		"request":{
+		   "uid":"69f7d25a-963e-11e8-a77c-08002753edac",
+		   "kind":{"group":"","version":"v1","kind":"Pod"},
+		   "resource":{"group":"","version":"v1","resource":"pods"},
+		   "operation":"CREATE",
+		   "namespace":"kube-system",
+		   "userInfo":{"username":"minikube-user"},
+		   "object":{
+			  "metadata":{"name":"coredns","namespace":"kube-system"},
+			  "spec":{},
+			  "status":{}
+		   }
+		}
+	 }`), &review)
+	require.NoError(t, err)
+
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	assert.True(t, resp.Allowed, "a block rule must never block an object in a protected namespace")
+	assert.Nil(t, resp.Patch)
+}
+
+func TestMutateAdmissionNeverBlocksAProtectedNamespaceObjectItself(t *testing.T) {
+	old := ProtectedNamespaces
+	defer func() { ProtectedNamespaces = old }()
+	ProtectedNamespaces = []string{"kube-system"}
+
+	rule := Rule{
+		Name:     "block-everything",
+		Matchers: Matchers{MatchAll: true},
+		Payload:  Payload{Block: true},
+	}
+
+	var review = admission.AdmissionReview{}
+	err := json.Unmarshal([]byte(testReview), &review)
+	require.NoError(t, err)
+	review.Request.Name = "kube-system"
+
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	assert.True(t, resp.Allowed, "a block rule must never block the protected namespace object itself")
+	assert.Nil(t, resp.Patch)
+}
+
+func TestMutateAdmissionHonoursSelfNamespaceSelectorAgainstTheNamespacesOwnLabels(t *testing.T) {
+	rule := Rule{
+		Name:                  "add-a-label",
+		Matchers:              Matchers{MatchAll: true},
+		SelfNamespaceSelector: "group=runtime",
+		Payload:               Payload{Additions: Additions{Labels: map[string]string{"added": "by-graffiti"}}},
+	}
+
+	var review = admission.AdmissionReview{}
+	require.NoError(t, json.Unmarshal([]byte(testReview), &review))
+
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	assert.True(t, resp.Allowed)
+	assert.NotNil(t, resp.Patch, "the namespace's own labels match the self-namespace-selector, so the rule should still paint it")
+}
+
+func TestMutateAdmissionSkipsWhenSelfNamespaceSelectorDoesNotMatchTheNamespacesOwnLabels(t *testing.T) {
+	rule := Rule{
+		Name:                  "add-a-label",
+		Matchers:              Matchers{MatchAll: true},
+		SelfNamespaceSelector: "group=does-not-exist",
+		Payload:               Payload{Additions: Additions{Labels: map[string]string{"added": "by-graffiti"}}},
+	}
+
+	var review = admission.AdmissionReview{}
+	require.NoError(t, json.Unmarshal([]byte(testReview), &review))
+
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	assert.True(t, resp.Allowed)
+	assert.Nil(t, resp.Patch, "the namespace's own labels don't match the self-namespace-selector, so the rule should not paint it")
+}
+
+func TestMutateAdmissionBlocksANamespaceThatIsNotProtected(t *testing.T) {
+	old := ProtectedNamespaces
+	defer func() { ProtectedNamespaces = old }()
+	ProtectedNamespaces = []string{"kube-system"}
+
+	rule := Rule{
+		Name:     "block-everything",
+		Matchers: Matchers{MatchAll: true},
+		Payload:  Payload{Block: true},
+	}
+
+	var review = admission.AdmissionReview{}
+	err := json.Unmarshal([]byte(`{
+		"kind":"AdmissionReview",
+		"apiVersion":"admission.k8s.io/v1beta1",
+		"request":{
+		   "uid":"69f7d25a-963e-11e8-a77c-08002753edac",
+		   "kind":{"group":"","version":"v1","kind":"Pod"},
+		   "resource":{"group":"","version":"v1","resource":"pods"},
+		   "operation":"CREATE",
+		   "namespace":"default",
+		   "userInfo":{"username":"minikube-user"},
+		   "object":{
+			  "metadata":{"name":"my-pod","namespace":"default"},
+			  "spec":{},
+			  "status":{}
+		   }
+		}
+	 }`), &review)
+	require.NoError(t, err)
+
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	assert.False(t, resp.Allowed, "the block rule should still take effect for a namespace that isn't protected")
+}
+
+func TestAdmissionSkipAnnotationSkipsMutateAdmission(t *testing.T) {
+	old := AdmissionSkipAnnotationKey
+	defer func() { AdmissionSkipAnnotationKey = old }()
+
+	rule := Rule{
+		Name:     "add-label",
+		Matchers: Matchers{},
+		Payload:  Payload{Additions: Additions{Labels: map[string]string{"painted": "true"}}},
+	}
+
+	var review = admission.AdmissionReview{}
+	err := json.Unmarshal([]byte(`{
+		"kind":"AdmissionReview",
+		"apiVersion":"admission.k8s.io/v1beta1",
+		"request":{
+		   "uid":"69f7d25a-963e-11e8-a77c-08002753edac",
+		   "kind":{"group":"","version":"v1","kind":"Pod"},
+		   "resource":{"group":"","version":"v1","resource":"pods"},
+		   "operation":"CREATE",
+		   "namespace":"default",
+		   "userInfo":{"username":"minikube-user"},
+		   "object":{
+			  "metadata":{"name":"test-pod","namespace":"default","annotations":{"kube-graffiti.io/admission-skip":"true"}},
+			  "spec":{},
+			  "status":{}
+		   }
+		}
+	 }`), &review)
+	require.NoError(t, err)
+
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	assert.Nil(t, resp.Patch, "object has the admission-skip annotation, so admission shouldn't be mutated")
+	assert.True(t, resp.Allowed)
+}
+
+func admissionReviewForKindVersion(t *testing.T, version string) *admission.AdmissionRequest {
+	var review = admission.AdmissionReview{}
+	err := json.Unmarshal([]byte(`{
+		"kind":"AdmissionReview",
+		"apiVersion":"admission.k8s.io/v1beta1",
+		"request":{
+		   "uid":"69f7d25a-963e-11e8-a77c-08002753edac",
+		   "kind":{"group":"example.com","version":"`+version+`","kind":"Widget"},
+		   "resource":{"group":"example.com","version":"`+version+`","resource":"widgets"},
+		   "operation":"CREATE",
+		   "namespace":"default",
+		   "userInfo":{"username":"minikube-user"},
+		   "object":{
+			  "metadata":{"name":"test-widget","namespace":"default"},
+			  "spec":{},
+			  "status":{}
+		   }
+		}
+	 }`), &review)
+	require.NoError(t, err)
+	return review.Request
+}
+
+func TestAPIVersionSelectorsMatchesTheRequestedAPIVersion(t *testing.T) {
+	rule := Rule{
+		Name:     "v1-only",
+		Matchers: Matchers{APIVersionSelectors: []string{"v1"}},
+		Payload:  Payload{Additions: Additions{Labels: map[string]string{"painted": "true"}}},
+	}
+
+	resp := rule.MutateAdmission(context.Background(), admissionReviewForKindVersion(t, "v1"))
+	assert.NotNil(t, resp.Patch, "the request's api-version is v1, so the rule's api-version-selectors should match")
+}
+
+func TestAPIVersionSelectorsIgnoresARequestForADifferentAPIVersion(t *testing.T) {
+	rule := Rule{
+		Name:     "v1-only",
+		Matchers: Matchers{APIVersionSelectors: []string{"v1"}},
+		Payload:  Payload{Additions: Additions{Labels: map[string]string{"painted": "true"}}},
+	}
+
+	resp := rule.MutateAdmission(context.Background(), admissionReviewForKindVersion(t, "v1beta1"))
+	assert.Nil(t, resp.Patch, "the request's api-version is v1beta1, which isn't in the rule's api-version-selectors, so it shouldn't match")
+	assert.True(t, resp.Allowed)
+}
+
+func TestNoAPIVersionSelectorsMeansEveryAPIVersionMatches(t *testing.T) {
+	rule := Rule{
+		Name:     "any-version",
+		Matchers: Matchers{},
+		Payload:  Payload{Additions: Additions{Labels: map[string]string{"painted": "true"}}},
+	}
+
+	resp := rule.MutateAdmission(context.Background(), admissionReviewForKindVersion(t, "v1beta1"))
+	assert.NotNil(t, resp.Patch, "a rule with no api-version-selectors configured should match every api-version")
+}
+
+// TestOriginalKindSelectorsMatchesTheRequestsKind documents the current, degraded behaviour of
+// OriginalKindSelectors: the vendored admission/v1beta1 API in this tree has no RequestKind field
+// distinct from Kind, so it is matched against req.Kind.Kind - the only kind this test fixture, or any
+// real request on this vendored API, can carry.
+func TestOriginalKindSelectorsMatchesTheRequestsKind(t *testing.T) {
+	rule := Rule{
+		Name:     "widgets-only",
+		Matchers: Matchers{OriginalKindSelectors: []string{"Widget"}},
+		Payload:  Payload{Additions: Additions{Labels: map[string]string{"painted": "true"}}},
+	}
+
+	resp := rule.MutateAdmission(context.Background(), admissionReviewForKindVersion(t, "v1"))
+	assert.NotNil(t, resp.Patch, "the request's kind is Widget, so the rule's original-kind-selectors should match")
+}
+
+func TestOriginalKindSelectorsIgnoresARequestForADifferentKind(t *testing.T) {
+	rule := Rule{
+		Name:     "gadgets-only",
+		Matchers: Matchers{OriginalKindSelectors: []string{"Gadget"}},
+		Payload:  Payload{Additions: Additions{Labels: map[string]string{"painted": "true"}}},
+	}
+
+	resp := rule.MutateAdmission(context.Background(), admissionReviewForKindVersion(t, "v1"))
+	assert.Nil(t, resp.Patch, "the request's kind is Widget, which isn't in the rule's original-kind-selectors, so it shouldn't match")
+	assert.True(t, resp.Allowed)
+}
+
+func TestMutateAdmissionRecordsASpanWithRuleMatchResultAndPatchSize(t *testing.T) {
+	oldEnabled, oldExporter := tracing.Enabled, tracing.CurrentExporter
+	exporter := tracing.NewInMemoryExporter()
+	tracing.Enabled = true
+	tracing.CurrentExporter = exporter
+	defer func() {
+		tracing.Enabled = oldEnabled
+		tracing.CurrentExporter = oldExporter
+	}()
+
+	rule := Rule{
+		Name:     "add-a-label",
+		Matchers: Matchers{},
+		Payload:  Payload{Additions: Additions{Labels: map[string]string{"painted": "true"}}},
+	}
+
+	resp := rule.MutateAdmission(context.Background(), admissionReviewForKindVersion(t, "v1beta1"))
+	require.NotNil(t, resp.Patch)
+
+	require.Len(t, exporter.Spans(), 1)
+	span := exporter.Spans()[0]
+	assert.Equal(t, "MutateAdmission", span.Name)
+	assert.Equal(t, "add-a-label", span.Attributes["rule"])
+	assert.Equal(t, "true", span.Attributes["matched"])
+	assert.NotEqual(t, "0", span.Attributes["patch.bytes"])
+}
+
+func TestMutateRecordsASpanWithRuleMatchResultAndPatchSize(t *testing.T) {
+	oldEnabled, oldExporter := tracing.Enabled, tracing.CurrentExporter
+	exporter := tracing.NewInMemoryExporter()
+	tracing.Enabled = true
+	tracing.CurrentExporter = exporter
+	defer func() {
+		tracing.Enabled = oldEnabled
+		tracing.CurrentExporter = oldExporter
+	}()
+
+	rule := Rule{
+		Name:     "no-match",
+		Matchers: Matchers{LabelSelectors: []string{"never=true"}},
+		Payload:  Payload{Additions: Additions{Labels: map[string]string{"painted": "true"}}},
+	}
+
+	patch, err := rule.Mutate(context.Background(), []byte(`{"metadata":{"name":"test"}}`))
+	require.NoError(t, err)
+	assert.Nil(t, patch)
+
+	require.Len(t, exporter.Spans(), 1)
+	span := exporter.Spans()[0]
+	assert.Equal(t, "Mutate", span.Name)
+	assert.Equal(t, "no-match", span.Attributes["rule"])
+	assert.Equal(t, "false", span.Attributes["matched"])
+	assert.Equal(t, "0", span.Attributes["patch.bytes"])
+}
+
+func TestMutateAdmissionSkipsARuleWhoseEvaluateOnExcludesTheRequestsOperation(t *testing.T) {
+	rule := Rule{
+		Name:       "create-only",
+		EvaluateOn: []string{"CREATE"},
+		Matchers:   Matchers{},
+		Payload:    Payload{Additions: Additions{Labels: map[string]string{"painted": "true"}}},
+	}
+
+	req := admissionReviewForKindVersion(t, "v1")
+	req.Operation = "UPDATE"
+
+	before := metrics.OperationsSkipped.Count(rule.Name)
+	resp := rule.MutateAdmission(context.Background(), req)
+	assert.True(t, resp.Allowed)
+	assert.Nil(t, resp.Patch, "evaluate-on excludes UPDATE, so the request should be skipped before matchers or payload are evaluated")
+	assert.Equal(t, before+1, metrics.OperationsSkipped.Count(rule.Name), "the skip should be recorded against OperationsSkipped")
+}
+
+func TestMutateAdmissionSkipsAScaleSubResourceRequest(t *testing.T) {
+	rule := Rule{
+		Name:     "add-a-label",
+		Matchers: Matchers{},
+		Payload:  Payload{Additions: Additions{Labels: map[string]string{"painted": "true"}}},
+	}
+
+	req := admissionReviewForKindVersion(t, "v1")
+	req.SubResource = "scale"
+
+	resp := rule.MutateAdmission(context.Background(), req)
+	assert.True(t, resp.Allowed)
+	assert.Nil(t, resp.Patch, "a scale subresource request doesn't carry the object's full metadata, so a metadata-patching rule should be skipped rather than attempt to patch it")
+}
+
+func TestMutateAdmissionDoesNotSkipAScaleSubResourceRequestForAClampPayload(t *testing.T) {
+	rule := Rule{
+		Name:     "clamp-replicas",
+		Matchers: Matchers{},
+		Payload:  Payload{Clamp: Clamp{Path: "/spec/replicas", Max: "3"}},
+	}
+
+	req := admissionReviewForKindVersion(t, "v1")
+	req.SubResource = "scale"
+	req.Object.Raw = []byte(`{"spec":{"replicas":5}}`)
+
+	resp := rule.MutateAdmission(context.Background(), req)
+	assert.True(t, resp.Allowed)
+	assert.NotNil(t, resp.Patch, "a clamp payload is specifically designed to target a scale subresource's replicas field, so it must not be skipped")
+}
+
+func TestMutateAdmissionEvaluatesAnOperationListedInEvaluateOn(t *testing.T) {
+	rule := Rule{
+		Name:       "create-only",
+		EvaluateOn: []string{"CREATE"},
+		Matchers:   Matchers{},
+		Payload:    Payload{Additions: Additions{Labels: map[string]string{"painted": "true"}}},
+	}
+
+	req := admissionReviewForKindVersion(t, "v1")
+	req.Operation = "CREATE"
+
+	resp := rule.MutateAdmission(context.Background(), req)
+	assert.True(t, resp.Allowed)
+	assert.NotNil(t, resp.Patch, "CREATE is listed in evaluate-on, so the rule should still be evaluated normally")
+}
+
+func TestMutateSkipsARuleWhoseEvaluateOnExcludesExisting(t *testing.T) {
+	rule := Rule{
+		Name:       "admission-only",
+		EvaluateOn: []string{"CREATE", "UPDATE"},
+		Matchers:   Matchers{},
+		Payload:    Payload{Additions: Additions{Labels: map[string]string{"painted": "true"}}},
+	}
+
+	patch, err := rule.Mutate(context.Background(), []byte(`{"metadata":{"name":"test"}}`))
+	require.NoError(t, err)
+	assert.Nil(t, patch, "evaluate-on excludes EXISTING, so the existing-objects sweep should skip this rule")
+}
+
+func TestMutateStillRunsAgainstExistingByDefault(t *testing.T) {
+	rule := Rule{
+		Name:     "no-evaluate-on-set",
+		Matchers: Matchers{},
+		Payload:  Payload{Additions: Additions{Labels: map[string]string{"painted": "true"}}},
+	}
+
+	patch, err := rule.Mutate(context.Background(), []byte(`{"metadata":{"name":"test"}}`))
+	require.NoError(t, err)
+	assert.NotNil(t, patch, "an unset evaluate-on should still evaluate the existing-objects sweep")
+}
+
+func TestMutateAdmissionPausesOnceTheBudgetIsExceeded(t *testing.T) {
+	rule := Rule{
+		Name:     "budget-pause",
+		Matchers: Matchers{},
+		Payload:  Payload{Additions: Additions{Labels: map[string]string{"painted": "true"}}},
+		Budget:   Budget{MaxMutations: 1, Window: "1m", OnExceeded: BudgetOnExceededPause},
+	}
+
+	before := metrics.MutationBudgetExceeded.Count(rule.Name)
+	first := rule.MutateAdmission(context.Background(), admissionReviewForKindVersion(t, "v1"))
+	assert.True(t, first.Allowed)
+	assert.NotNil(t, first.Patch, "the first object is within budget and should be painted")
+
+	second := rule.MutateAdmission(context.Background(), admissionReviewForKindVersion(t, "v1"))
+	assert.True(t, second.Allowed, "a paused budget fails open rather than denying the request")
+	assert.Nil(t, second.Patch, "the second object exceeds the budget, so it should be left unpatched")
+	assert.Contains(t, second.Result.Message, "pausing")
+	assert.Equal(t, before+1, metrics.MutationBudgetExceeded.Count(rule.Name))
+}
+
+func TestMutateAdmissionSkipsOnceTheBudgetIsExceeded(t *testing.T) {
+	rule := Rule{
+		Name:     "budget-skip",
+		Matchers: Matchers{},
+		Payload:  Payload{Additions: Additions{Labels: map[string]string{"painted": "true"}}},
+		Budget:   Budget{MaxMutations: 1, Window: "1m", OnExceeded: BudgetOnExceededSkip},
+	}
+
+	rule.MutateAdmission(context.Background(), admissionReviewForKindVersion(t, "v1"))
+	resp := rule.MutateAdmission(context.Background(), admissionReviewForKindVersion(t, "v1"))
+	assert.True(t, resp.Allowed)
+	assert.Nil(t, resp.Patch)
+	assert.Contains(t, resp.Result.Message, "skipping")
+}
+
+func TestMutateAdmissionStillPaintsPastTheBudgetWhenOnExceededIsWarn(t *testing.T) {
+	rule := Rule{
+		Name:     "budget-warn",
+		Matchers: Matchers{},
+		Payload:  Payload{Additions: Additions{Labels: map[string]string{"painted": "true"}}},
+		Budget:   Budget{MaxMutations: 1, Window: "1m", OnExceeded: BudgetOnExceededWarn},
+	}
+
+	before := metrics.MutationBudgetExceeded.Count(rule.Name)
+	rule.MutateAdmission(context.Background(), admissionReviewForKindVersion(t, "v1"))
+	resp := rule.MutateAdmission(context.Background(), admissionReviewForKindVersion(t, "v1"))
+	assert.True(t, resp.Allowed)
+	assert.NotNil(t, resp.Patch, "on-exceeded: warn should still paint the object, just noisily")
+	assert.Equal(t, before+1, metrics.MutationBudgetExceeded.Count(rule.Name))
+}
+
+func TestMutateDefersToANextSweepOnceTheBudgetIsExceeded(t *testing.T) {
+	rule := Rule{
+		Name:     "budget-existing",
+		Matchers: Matchers{},
+		Payload:  Payload{Additions: Additions{Labels: map[string]string{"painted": "true"}}},
+		Budget:   Budget{MaxMutations: 1, Window: "1m", OnExceeded: BudgetOnExceededPause},
+	}
+
+	object := []byte(`{"metadata":{"name":"test"}}`)
+	first, err := rule.Mutate(context.Background(), object)
+	require.NoError(t, err)
+	assert.NotNil(t, first)
+
+	second, err := rule.Mutate(context.Background(), object)
+	require.NoError(t, err, "a paused budget should not surface as an error to the existing-objects sweep")
+	assert.Nil(t, second, "the object is deferred to a later sweep rather than patched")
+}
+
+func TestValidateEvaluateOnWarnsWhenNarrowerThanTheRegisteredAdmissionOperations(t *testing.T) {
+	rule := Rule{
+		Name:       "create-only",
+		EvaluateOn: []string{"CREATE"},
+		Payload:    Payload{Additions: Additions{Labels: map[string]string{"painted": "true"}}},
+	}
+
+	assert.NoError(t, rule.Validate(log.Logger), "excluding a registered admission operation is wasteful but not invalid, so it should only warn")
+}
+
+func TestValidateEvaluateOnRejectsASetSharingNoOperationWithTheRegisteredAdmissionOperations(t *testing.T) {
+	rule := Rule{
+		Name:       "existing-only",
+		EvaluateOn: []string{"EXISTING"},
+		Payload:    Payload{Additions: Additions{Labels: map[string]string{"painted": "true"}}},
+	}
+
+	err := rule.Validate(log.Logger)
+	assert.EqualError(t, err, `rule 'existing-only' failed validation: evaluate-on [EXISTING] shares no operation with the registered admission operations [CREATE UPDATE] - this rule would never be evaluated on admission`)
+}
+
+func TestValidateEvaluateOnRejectsAnUnrecognisedOperation(t *testing.T) {
+	rule := Rule{
+		Name:       "bad-operation",
+		EvaluateOn: []string{"DELETE"},
+		Payload:    Payload{Additions: Additions{Labels: map[string]string{"painted": "true"}}},
+	}
+
+	err := rule.Validate(log.Logger)
+	assert.EqualError(t, err, `rule 'bad-operation' failed validation: evaluate-on entry "DELETE" is not one of CREATE, UPDATE or EXISTING`)
+}
+
+// TestMutateDecodesTheRawObjectOnlyOnce confirms that mutate's field map and metaObject both come from
+// a single decode of the raw object, rather than Mutate/matchers/painting each re-parsing the bytes
+// themselves, by counting calls to decodeHook while matching and painting an object that matches on
+// both a label-selector and a field-selector.
+func TestMutateDecodesTheRawObjectOnlyOnce(t *testing.T) {
+	var parseCount int
+	old := decodeHook
+	decodeHook = func() { parseCount++ }
+	defer func() { decodeHook = old }()
+
+	rule := Rule{
+		Name: "add-a-label",
+		Matchers: Matchers{
+			LabelSelectors: []string{"name=test"},
+			FieldSelectors: []string{"metadata.namespace=default"},
+		},
+		Payload: Payload{Additions: Additions{Labels: map[string]string{"painted": "true"}}},
+	}
+
+	patch, err := rule.Mutate(context.Background(), []byte(`{"metadata":{"name":"test","namespace":"default","labels":{"name":"test"}}}`))
+	require.NoError(t, err)
+	assert.NotNil(t, patch, "the rule's label and field selectors should both match")
+	assert.Equal(t, 1, parseCount, "the raw object should only be decoded once, however many consumers need its data")
+}
+
+func TestMutateAdmissionReturnsAControlledResponseOnceAPerRuleTimeoutIsExceeded(t *testing.T) {
+	oldPerRuleTimeout := PerRuleTimeout
+	PerRuleTimeout = time.Millisecond
+	defer func() { PerRuleTimeout = oldPerRuleTimeout }()
+
+	oldTemplateTimeout := TemplateTimeout
+	TemplateTimeout = time.Second
+	defer func() { TemplateTimeout = oldTemplateTimeout }()
+
+	templateFuncs["sleep"] = func() string {
+		time.Sleep(50 * time.Millisecond)
+		return "done"
+	}
+	defer delete(templateFuncs, "sleep")
+
+	slow := Rule{
+		Name:     "slow-rule",
+		Matchers: Matchers{},
+		Payload:  Payload{Additions: Additions{Labels: map[string]string{"painted": `{{ sleep }}`}}},
+	}
+
+	before := metrics.RuleTimeouts.Count(slow.Name)
+	resp := slow.MutateAdmission(context.Background(), admissionReviewForKindVersion(t, "v1"))
+	assert.True(t, resp.Allowed, "a per-rule timeout fails open rather than denying the request")
+	assert.Nil(t, resp.Patch, "the object should be left unpatched once the rule's timeout is exceeded")
+	assert.Contains(t, resp.Result.Message, "per-rule-timeout")
+	assert.Equal(t, before+1, metrics.RuleTimeouts.Count(slow.Name))
+
+	fast := Rule{
+		Name:     "fast-rule",
+		Matchers: Matchers{},
+		Payload:  Payload{Additions: Additions{Labels: map[string]string{"painted": "true"}}},
+	}
+	resp = fast.MutateAdmission(context.Background(), admissionReviewForKindVersion(t, "v1"))
+	assert.True(t, resp.Allowed)
+	assert.NotNil(t, resp.Patch, "a fast rule should be unaffected by another rule's per-rule timeout")
+}
+
+func TestSuppressAllowedResultMessageOmitsTheMessageOnAnAllowedResponse(t *testing.T) {
+	old := SuppressAllowedResultMessage
+	SuppressAllowedResultMessage = true
+	defer func() { SuppressAllowedResultMessage = old }()
+
+	rule := Rule{
+		Name:     "paint-everything",
+		Matchers: Matchers{MatchAll: true},
+		Payload:  Payload{Additions: Additions{Labels: map[string]string{"modified-by-graffiti": "abc123"}}},
+	}
+
+	var review = admission.AdmissionReview{}
+	err := json.Unmarshal([]byte(testReview), &review)
+	require.NoError(t, err, "couldn't marshall a valid admission review object from test json")
+
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	assert.True(t, resp.Allowed)
+	assert.NotNil(t, resp.Patch, "the rule should still paint the object")
+	assert.Empty(t, resp.Result.Message, "an allowed response's informational message should be suppressed")
+}
+
+func TestSuppressAllowedResultMessageStillKeepsABlockReason(t *testing.T) {
+	old := SuppressAllowedResultMessage
+	SuppressAllowedResultMessage = true
+	defer func() { SuppressAllowedResultMessage = old }()
+
+	rule := Rule{
+		Name:     "block-everything",
+		Matchers: Matchers{MatchAll: true},
+		Payload:  Payload{Block: true},
+	}
+
+	var review = admission.AdmissionReview{}
+	err := json.Unmarshal([]byte(testReview), &review)
+	require.NoError(t, err, "couldn't marshall a valid admission review object from test json")
+
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	assert.False(t, resp.Allowed)
+	assert.NotEmpty(t, resp.Result.Message, "a block's reason is never just informational, so it should survive suppress-allowed-result-message")
 }
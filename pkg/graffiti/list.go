@@ -0,0 +1,150 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package graffiti
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	jsonpatch "github.com/cameront/go-jsonpatch"
+	"github.com/rs/zerolog"
+	admission "k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// listItems reports whether object is a Kubernetes List - its kind ends in "List" and it carries an
+// items array - returning the raw items if so. This covers both a typed list such as PodList or
+// NamespaceList, and the bare v1 List kind that server-side apply and `kubectl create -f` of a
+// multi-document manifest submit to admission as a single request.
+func listItems(kind string, object []byte) ([]json.RawMessage, bool) {
+	if !strings.HasSuffix(kind, "List") {
+		return nil, false
+	}
+	var envelope struct {
+		Items []json.RawMessage `json:"items"`
+	}
+	if err := json.Unmarshal(object, &envelope); err != nil || envelope.Items == nil {
+		return nil, false
+	}
+	return envelope.Items, true
+}
+
+// itemKind returns item's own "kind" field when it has one - as a bare v1 List's items usually do,
+// since each can be a different kind - or, failing that, listKind with its "List" suffix trimmed, which
+// is correct for a typed list such as PodList, whose items don't repeat the list's own kind.
+func itemKind(item json.RawMessage, listKind string) string {
+	var mo metaObject
+	if err := json.Unmarshal(item, &mo); err == nil && mo.Kind != "" {
+		return mo.Kind
+	}
+	return strings.TrimSuffix(listKind, "List")
+}
+
+// itemProtectedNamespace mirrors protectedNamespace for a single list item: its own namespace field, or
+// its own name when kind is itself "Namespace".
+func itemProtectedNamespace(item json.RawMessage, kind string) string {
+	var mo metaObject
+	if err := json.Unmarshal(item, &mo); err != nil {
+		return ""
+	}
+	if mo.Meta.Namespace != "" {
+		return mo.Meta.Namespace
+	}
+	if kind == "Namespace" {
+		return mo.Meta.Name
+	}
+	return ""
+}
+
+// describeListItem renders "index N (name)", or just "index N" when item's name can't be read, to
+// identify which list item a block rule matched in the denial message a blocked List admission request
+// is rejected with.
+func describeListItem(index int, item json.RawMessage) string {
+	var mo metaObject
+	if err := json.Unmarshal(item, &mo); err != nil || mo.Meta.Name == "" {
+		return fmt.Sprintf("index %d", index)
+	}
+	return fmt.Sprintf("index %d (%s)", index, mo.Meta.Name)
+}
+
+// mutateListAdmission evaluates rule against every item of a List-typed admission request, since the
+// ordinary MutateAdmission matchers have nothing sensible to evaluate against a List's own, empty,
+// metadata. Each matching item's patch is rebased onto its own /items/<index>/... path and the results
+// combined into a single response patch. A List can't be partially admitted, so an item that a block
+// payload would reject instead causes blocked to be true and blockedItem to identify it, so the caller
+// can deny the whole request.
+func (r Rule) mutateListAdmission(req *admission.AdmissionRequest, items []json.RawMessage, mylog zerolog.Logger) (patch []byte, blocked bool, blockedItem string, err error) {
+	var ops []jsonpatch.PatchOperation
+	for i, item := range items {
+		kind := itemKind(item, req.Kind.Kind)
+		ilog := mylog.With().Int("item", i).Str("item-kind", kind).Logger()
+
+		if hasSkipAnnotation(item, AdmissionSkipAnnotationKey) {
+			ilog.Debug().Str("annotation", AdmissionSkipAnnotationKey).Msg("list item opts out of admission mutation, skipping")
+			continue
+		}
+		if skip, ownerKind := r.Payload.ShouldSkipControllerOwned(kind, ownerReferences(item), false); skip {
+			ilog.Debug().Str("owner-kind", ownerKind).Msg("list item is owned by a controller that would immediately revert this mutation, skipping")
+			continue
+		}
+
+		itemPatch, _, err := r.mutate(item, &req.UserInfo, string(req.Operation), kind)
+		if err != nil {
+			return nil, false, "", fmt.Errorf("failed to mutate list item %d: %v", i, err)
+		}
+		if itemPatch == nil {
+			continue
+		}
+
+		if IsBlockPatch(itemPatch) {
+			if isProtectedNamespace(itemProtectedNamespace(item, kind)) {
+				ilog.Warn().Str("rule", r.Name).Msg("a block rule matched a list item in a protected namespace, allowing it through instead of denying the whole list")
+				continue
+			}
+			return nil, true, describeListItem(i, item), nil
+		}
+
+		parsed, err := jsonpatch.FromString(string(itemPatch))
+		if err != nil {
+			return nil, false, "", fmt.Errorf("failed to parse list item %d's patch for rebasing: %v", i, err)
+		}
+		for _, op := range parsed.Operations {
+			op.Path = fmt.Sprintf("/items/%d%s", i, op.Path)
+			if op.From != "" {
+				op.From = fmt.Sprintf("/items/%d%s", i, op.From)
+			}
+			ops = append(ops, op)
+		}
+	}
+
+	if len(ops) == 0 {
+		return nil, false, "", nil
+	}
+	patch, err = json.Marshal(jsonpatch.Patch{Operations: ops})
+	return patch, false, "", err
+}
+
+// blockListResult builds the denial response for a List admission request where item - the message
+// describeListItem produced - tripped ruleName's block payload: a List can't be partially admitted, so
+// the whole request is rejected rather than just the offending item.
+func blockListResult(ruleName, item string) *admission.AdmissionResponse {
+	return &admission.AdmissionResponse{
+		Allowed: false,
+		Result: &metav1.Status{
+			Reason:  metav1.StatusReasonForbidden,
+			Message: fmt.Sprintf("%s: list item %s", blockReason(ruleName), item),
+		},
+	}
+}
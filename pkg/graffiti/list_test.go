@@ -0,0 +1,95 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package graffiti
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	admission "k8s.io/api/admission/v1beta1"
+)
+
+func TestMutateAdmissionPatchesTheMatchingItemOfAList(t *testing.T) {
+	rule := Rule{
+		Name:     "add-a-label",
+		Matchers: Matchers{LabelSelectors: []string{"fruit=apple"}},
+		Payload:  Payload{Additions: Additions{Labels: map[string]string{"painted": "true"}}},
+	}
+
+	var review = admission.AdmissionReview{}
+	err := json.Unmarshal([]byte(`{
+		"kind":"AdmissionReview",
+		"apiVersion":"admission.k8s.io/v1beta1",
+		"request":{
+		   "uid":"69f7d25a-963e-11e8-a77c-08002753edac",
+		   "kind":{"group":"","version":"v1","kind":"PodList"},
+		   "resource":{"group":"","version":"v1","resource":"pods"},
+		   "operation":"CREATE",
+		   "userInfo":{"username":"minikube-user"},
+		   "object":{
+			  "kind":"PodList",
+			  "items":[
+				 {"metadata":{"name":"pod-one","namespace":"default","labels":{"fruit":"apple"}},"spec":{},"status":{}},
+				 {"metadata":{"name":"pod-two","namespace":"default","labels":{"fruit":"banana"}},"spec":{},"status":{}}
+			  ]
+		   }
+		}
+	 }`), &review)
+	require.NoError(t, err)
+
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	require.True(t, resp.Allowed)
+	require.NotNil(t, resp.Patch, "the first item matches the rule so a patch should be produced")
+
+	var ops []map[string]interface{}
+	require.NoError(t, json.Unmarshal(resp.Patch, &ops))
+	require.Len(t, ops, 1, "only the matching item should produce a patch operation")
+	assert.Equal(t, "/items/0/metadata/labels", ops[0]["path"], "the operation should be rebased onto the matching item's index")
+}
+
+func TestMutateAdmissionDeniesTheWholeListWhenAnItemIsBlocked(t *testing.T) {
+	rule := Rule{
+		Name:     "block-bananas",
+		Matchers: Matchers{LabelSelectors: []string{"fruit=banana"}},
+		Payload:  Payload{Block: true},
+	}
+
+	var review = admission.AdmissionReview{}
+	err := json.Unmarshal([]byte(`{
+		"kind":"AdmissionReview",
+		"apiVersion":"admission.k8s.io/v1beta1",
+		"request":{
+		   "uid":"69f7d25a-963e-11e8-a77c-08002753edac",
+		   "kind":{"group":"","version":"v1","kind":"PodList"},
+		   "resource":{"group":"","version":"v1","resource":"pods"},
+		   "operation":"CREATE",
+		   "userInfo":{"username":"minikube-user"},
+		   "object":{
+			  "kind":"PodList",
+			  "items":[
+				 {"metadata":{"name":"pod-one","namespace":"default","labels":{"fruit":"apple"}},"spec":{},"status":{}},
+				 {"metadata":{"name":"pod-two","namespace":"default","labels":{"fruit":"banana"}},"spec":{},"status":{}}
+			  ]
+		   }
+		}
+	 }`), &review)
+	require.NoError(t, err)
+
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	assert.False(t, resp.Allowed, "a blocked item means the whole list is denied, since it can't be partially admitted")
+	assert.Contains(t, resp.Result.Message, "index 1 (pod-two)", "the denial message should name the offending item")
+}
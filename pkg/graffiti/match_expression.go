@@ -0,0 +1,201 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package graffiti
+
+import (
+	"fmt"
+)
+
+// matchExpr is a boolean AST node parsed from a Matchers.MatchExpression string. It evaluates against
+// the match results of the rule's named MatcherGroups.
+type matchExpr interface {
+	eval(groupResults map[string]bool) bool
+}
+
+type groupRefExpr struct {
+	name string
+}
+
+func (e groupRefExpr) eval(groupResults map[string]bool) bool {
+	return groupResults[e.name]
+}
+
+type notExpr struct {
+	operand matchExpr
+}
+
+func (e notExpr) eval(groupResults map[string]bool) bool {
+	return !e.operand.eval(groupResults)
+}
+
+type andExpr struct {
+	left, right matchExpr
+}
+
+func (e andExpr) eval(groupResults map[string]bool) bool {
+	return e.left.eval(groupResults) && e.right.eval(groupResults)
+}
+
+type orExpr struct {
+	left, right matchExpr
+}
+
+func (e orExpr) eval(groupResults map[string]bool) bool {
+	return e.left.eval(groupResults) || e.right.eval(groupResults)
+}
+
+// matchExpressionTokenizer splits a match expression into identifiers, the keywords AND/OR/NOT and the
+// punctuation "(" and ")".
+type matchExpressionTokenizer struct {
+	tokens []string
+	pos    int
+}
+
+func tokenizeMatchExpression(expression string) []string {
+	var tokens []string
+	var current []rune
+	flush := func() {
+		if len(current) > 0 {
+			tokens = append(tokens, string(current))
+			current = nil
+		}
+	}
+	for _, r := range expression {
+		switch {
+		case r == '(' || r == ')':
+			flush()
+			tokens = append(tokens, string(r))
+		case r == ' ' || r == '\t' || r == '\n':
+			flush()
+		default:
+			current = append(current, r)
+		}
+	}
+	flush()
+	return tokens
+}
+
+func (t *matchExpressionTokenizer) peek() string {
+	if t.pos >= len(t.tokens) {
+		return ""
+	}
+	return t.tokens[t.pos]
+}
+
+func (t *matchExpressionTokenizer) next() string {
+	tok := t.peek()
+	t.pos++
+	return tok
+}
+
+// parseMatchExpression parses a boolean expression of group names combined with AND, OR, NOT and
+// parentheses, e.g. "(labelGroupA OR fieldGroupB) AND labelGroupC". AND binds tighter than OR, matching
+// the usual convention, and both are left-associative.
+func parseMatchExpression(expression string) (matchExpr, error) {
+	t := &matchExpressionTokenizer{tokens: tokenizeMatchExpression(expression)}
+	if len(t.tokens) == 0 {
+		return nil, fmt.Errorf("match expression is empty")
+	}
+	expr, err := parseOrExpr(t)
+	if err != nil {
+		return nil, err
+	}
+	if t.peek() != "" {
+		return nil, fmt.Errorf("unexpected token %q in match expression", t.peek())
+	}
+	return expr, nil
+}
+
+func parseOrExpr(t *matchExpressionTokenizer) (matchExpr, error) {
+	left, err := parseAndExpr(t)
+	if err != nil {
+		return nil, err
+	}
+	for t.peek() == "OR" {
+		t.next()
+		right, err := parseAndExpr(t)
+		if err != nil {
+			return nil, err
+		}
+		left = orExpr{left: left, right: right}
+	}
+	return left, nil
+}
+
+func parseAndExpr(t *matchExpressionTokenizer) (matchExpr, error) {
+	left, err := parseUnaryExpr(t)
+	if err != nil {
+		return nil, err
+	}
+	for t.peek() == "AND" {
+		t.next()
+		right, err := parseUnaryExpr(t)
+		if err != nil {
+			return nil, err
+		}
+		left = andExpr{left: left, right: right}
+	}
+	return left, nil
+}
+
+func parseUnaryExpr(t *matchExpressionTokenizer) (matchExpr, error) {
+	if t.peek() == "NOT" {
+		t.next()
+		operand, err := parseUnaryExpr(t)
+		if err != nil {
+			return nil, err
+		}
+		return notExpr{operand: operand}, nil
+	}
+	return parsePrimaryExpr(t)
+}
+
+func parsePrimaryExpr(t *matchExpressionTokenizer) (matchExpr, error) {
+	tok := t.next()
+	switch tok {
+	case "":
+		return nil, fmt.Errorf("match expression ended unexpectedly")
+	case "(":
+		expr, err := parseOrExpr(t)
+		if err != nil {
+			return nil, err
+		}
+		if t.next() != ")" {
+			return nil, fmt.Errorf("missing closing ')' in match expression")
+		}
+		return expr, nil
+	case "AND", "OR", "NOT", ")":
+		return nil, fmt.Errorf("unexpected token %q in match expression", tok)
+	default:
+		return groupRefExpr{name: tok}, nil
+	}
+}
+
+// matchExpressionGroupNames returns the names of every matcher group referenced by expression.
+func matchExpressionGroupNames(expr matchExpr) []string {
+	var names []string
+	switch e := expr.(type) {
+	case groupRefExpr:
+		names = append(names, e.name)
+	case notExpr:
+		names = append(names, matchExpressionGroupNames(e.operand)...)
+	case andExpr:
+		names = append(names, matchExpressionGroupNames(e.left)...)
+		names = append(names, matchExpressionGroupNames(e.right)...)
+	case orExpr:
+		names = append(names, matchExpressionGroupNames(e.left)...)
+		names = append(names, matchExpressionGroupNames(e.right)...)
+	}
+	return names
+}
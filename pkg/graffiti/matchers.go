@@ -15,19 +15,288 @@ package graffiti
 
 import (
 	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/HotelsDotCom/kube-graffiti/pkg/log"
 	"github.com/rs/zerolog"
+	authv1 "k8s.io/api/authentication/v1"
 	"k8s.io/apimachinery/pkg/fields"
 	labels "k8s.io/apimachinery/pkg/labels"
+	utilvalidation "k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/version"
 )
 
+// AppliedRulesAnnotation is the well known annotation used to record that graffiti has previously
+// mutated an object. It is checked by RequiresPreviousGraffitiMutation matchers.
+const AppliedRulesAnnotation = "graffiti.io/applied-rules"
+
+// RequireExplicitMatchAll makes a Matchers with no selectors configured fail validation unless
+// MatchAll is also set, rather than silently matching every object. It defaults to false so that a
+// config-version 1 configuration keeps its original implicit match-all behaviour; it is set to true
+// for config-version 2 and above by pkg/config.ApplyBehaviour when the configuration is loaded.
+var RequireExplicitMatchAll = false
+
 // Matchers manages the rules of matching an object
 // This type is directly marshalled from config and so has mapstructure tags
 type Matchers struct {
 	LabelSelectors  []string        `mapstructure:"label-selectors" yaml:"label-selectors,omitempty"`
 	FieldSelectors  []string        `mapstructure:"field-selectors" yaml:"field-selectors,omitempty"`
 	BooleanOperator BooleanOperator `mapstructure:"boolean-operator" yaml:"boolean-operator,omitempty"`
+	// VersionSelectors compare a field map value as a number or semantic version rather than as a
+	// plain string, e.g. "metadata.labels.app-version >= 1.2.0". They are evaluated alongside
+	// FieldSelectors: a rule matches its field component if any FieldSelector or VersionSelector matches.
+	VersionSelectors []string `mapstructure:"version-selectors" yaml:"version-selectors,omitempty"`
+	// RequiresPreviousGraffitiMutation restricts the rule to objects that already carry the
+	// AppliedRulesAnnotation, i.e. that a previous graffiti rule has already mutated. This only
+	// makes sense where something upstream of graffiti actually stamps that annotation.
+	RequiresPreviousGraffitiMutation bool `mapstructure:"requires-previous-graffiti-mutation" yaml:"requires-previous-graffiti-mutation,omitempty"`
+	// InvalidLabels restricts the rule to objects that carry at least one label whose key or value
+	// fails Kubernetes' own validity rules, e.g. a value containing spaces - the kind of thing an
+	// object imported from a system that doesn't enforce kubernetes' label constraints ends up with.
+	// It uses the same utilvalidation checks as validateAdditionsLabels, so it matches exactly the
+	// objects a rule's own additions validation would reject if you tried to set that label yourself.
+	// It is intended for cleanup rules, typically paired with a deletions payload to strip the
+	// offending label back off.
+	InvalidLabels bool `mapstructure:"invalid-labels" yaml:"invalid-labels,omitempty"`
+	// Namespaces and NamespaceNamePattern together form an allowlist of namespace names that the rule
+	// applies in, evaluated within graffiti itself (rather than relying solely on the webhook's
+	// label-based namespaceSelector). Namespaces is an exact list, NamespaceNamePattern is a shell
+	// style glob (e.g. "prod-*"). If neither is set the rule isn't restricted by namespace name.
+	Namespaces           []string `mapstructure:"namespaces" yaml:"namespaces,omitempty"`
+	NamespaceNamePattern string   `mapstructure:"namespace-name-pattern" yaml:"namespace-name-pattern,omitempty"`
+	// ModifiedByUsers and ModifiedByGroups restrict the rule to admission requests submitted by a
+	// particular user or by a member of a particular group. They are only meaningful for admission
+	// requests, where the submitter's identity is known, and are skipped when checking existing
+	// objects. When both are set they are combined using BooleanOperator.
+	ModifiedByUsers  []string `mapstructure:"modified-by-users" yaml:"modified-by-users,omitempty"`
+	ModifiedByGroups []string `mapstructure:"modified-by-groups" yaml:"modified-by-groups,omitempty"`
+	// CreatedByUsers restricts the rule to objects whose CreatedByAnnotationKey annotation matches one
+	// of the given usernames. Unlike ModifiedByUsers it reads from the annotation rather than the live
+	// submitting user, so it works identically for admission requests and existing sweeps - as long as
+	// something, typically a payload with Additions.StampCreatedBy, has already stamped the annotation.
+	CreatedByUsers []string `mapstructure:"created-by-users" yaml:"created-by-users,omitempty"`
+	// HasContainer and MissingContainer restrict the rule to Pods that do, or do not, have a
+	// container with the given name among spec.containers or spec.initContainers. They are intended
+	// for sidecar governance, e.g. labelling Pods that are missing a required logging sidecar. They
+	// have no effect on non-Pod objects, which never match either of them.
+	HasContainer     string `mapstructure:"has-container" yaml:"has-container,omitempty"`
+	MissingContainer string `mapstructure:"missing-container" yaml:"missing-container,omitempty"`
+	// HasVolumeType restricts the rule to Pods with at least one spec.volumes[] entry of the given
+	// type, e.g. "hostPath" or "emptyDir" - the key a volume's source is nested under, the same name
+	// Kubernetes itself uses for the field. It is intended for storage governance, e.g. labelling or
+	// blocking Pods that mount a hostPath volume. It has no effect on non-Pod objects, which never
+	// have any volumes to match.
+	HasVolumeType string `mapstructure:"has-volume-type" yaml:"has-volume-type,omitempty"`
+	// APIVersionSelectors restricts the rule to admission requests whose Kind.Version, e.g. "v1" or
+	// "v1beta1", is one of the given literal values. It lets a rule target only one version of a CRD
+	// that is served at multiple versions simultaneously. It is only meaningful for admission
+	// requests - the existing sweep already walks one api-version at a time, so it is skipped there.
+	APIVersionSelectors []string `mapstructure:"api-version-selectors" yaml:"api-version-selectors,omitempty"`
+	// OriginalKindSelectors is intended to restrict the rule to admission requests whose originally
+	// requested kind - AdmissionRequest.RequestKind, which can differ from Kind when a conversion
+	// webhook and matchPolicy: Equivalent are involved - is one of the given literal values. The
+	// vendored k8s.io/api/admission/v1beta1 in this tree predates RequestKind/RequestResource (they
+	// were added in a later Kubernetes release), so there is no separate originally-requested kind to
+	// read yet; until the vendored admission API is updated, this matches against Kind.Kind exactly
+	// like a plain kind check would. It is only meaningful for admission requests, for the same reason
+	// APIVersionSelectors is.
+	OriginalKindSelectors []string `mapstructure:"original-kind-selectors" yaml:"original-kind-selectors,omitempty"`
+	// MatcherGroups are named selector groups that MatchExpression can reference by name. They have no
+	// effect unless MatchExpression is set.
+	MatcherGroups []MatcherGroup `mapstructure:"matcher-groups" yaml:"matcher-groups,omitempty"`
+	// MatchExpression is a boolean expression over MatcherGroups' names, e.g.
+	// "(labelGroupA OR fieldGroupB) AND labelGroupC", using the keywords AND, OR, NOT and parentheses
+	// for grouping. When set, it is evaluated instead of the top-level LabelSelectors/FieldSelectors/
+	// VersionSelectors/BooleanOperator, which should then be left unset.
+	MatchExpression string `mapstructure:"match-expression" yaml:"match-expression,omitempty"`
+	// MatchAll declares that a rule with no selectors is intentionally meant to match every object.
+	// It has no effect on matching itself - a rule with no selectors always matches everything - but
+	// when RequireExplicitMatchAll is set it is required, so that a rule accidentally left without any
+	// selectors fails validation rather than silently matching everything.
+	MatchAll bool `mapstructure:"match-all" yaml:"match-all,omitempty"`
+	// MatchGenerateName opts a rule into matching on metadata.generateName when an object has no name
+	// yet - the normal case for a CREATE admission request of an object using generateName, since the
+	// apiserver only assigns the real name after admission has finished. With this set, the "name"
+	// pseudo-label and the "metadata.name" field both fall back to the object's generateName, so a
+	// selector written against the known generateName prefix (e.g. "name=my-app-") still matches.
+	// It defaults to false so that a rule not expecting name-less objects keeps failing to match them,
+	// rather than suddenly matching on a value the rule author never anticipated.
+	MatchGenerateName bool `mapstructure:"match-generate-name" yaml:"match-generate-name,omitempty"`
+	// Ramp restricts the rule to a stable, growing subset of objects - see its doc comment. The zero
+	// value disables ramping, so a rule not using it is unaffected.
+	Ramp Ramp `mapstructure:"ramp" yaml:"ramp,omitempty"`
+	// SpecChanged names the same field paths as a SpecHash payload elsewhere in the rule and restricts
+	// the rule to objects whose hash over those paths, computed now, differs from the one stamped in
+	// SpecHashAnnotationKey - i.e. the object has drifted since the hash was last recorded. An object
+	// that has never been hashed (no annotation present yet) counts as changed, so a rule combining
+	// this with Additions.SpecHash still fires the first time it sees a given object. It has no effect
+	// when left empty.
+	SpecChanged []string `mapstructure:"spec-changed" yaml:"spec-changed,omitempty"`
+	// KeyCount restricts the rule to objects whose number of label or annotation keys starting with a
+	// given prefix satisfies a comparison - see the KeyCountSelector type. It has no effect unless
+	// KeyCount.Prefix is set.
+	KeyCount KeyCountSelector `mapstructure:"key-count" yaml:"key-count,omitempty"`
+}
+
+// KeyCountSelector counts the keys of an object's labels or annotations (Target) that start with
+// Prefix and compares the count against Count using Operator, e.g. counting every "prometheus.io/"
+// annotation against ">= 1" to find objects that some annotation family has already been applied to.
+// It is intended for governing a family of related keys where the individual key names, or how many
+// of them are present, aren't known up front. It has no effect while Prefix is empty.
+type KeyCountSelector struct {
+	Target   string `mapstructure:"target" yaml:"target,omitempty"`
+	Prefix   string `mapstructure:"prefix" yaml:"prefix,omitempty"`
+	Operator string `mapstructure:"operator" yaml:"operator,omitempty"`
+	Count    int    `mapstructure:"count" yaml:"count,omitempty"`
+}
+
+// validate checks that an enabled KeyCountSelector (one with a non-empty Prefix) names a supported
+// Target and Operator.
+func (k KeyCountSelector) validate() error {
+	if k.Prefix == "" {
+		return nil
+	}
+	switch k.Target {
+	case "labels", "annotations":
+	default:
+		return fmt.Errorf("key-count target %q must be either \"labels\" or \"annotations\"", k.Target)
+	}
+	switch k.Operator {
+	case ">", ">=", "<", "<=", "==", "!=":
+	default:
+		return fmt.Errorf("key-count operator %q is not a supported comparison operator", k.Operator)
+	}
+	return nil
+}
+
+// matches counts obj's label or annotation keys (per Target) starting with Prefix and compares the
+// count against Count using Operator.
+func (k KeyCountSelector) matches(obj metaObject) bool {
+	target := obj.Meta.Labels
+	if k.Target == "annotations" {
+		target = obj.Meta.Annotations
+	}
+
+	var count int
+	for key := range target {
+		if strings.HasPrefix(key, k.Prefix) {
+			count++
+		}
+	}
+
+	switch k.Operator {
+	case ">":
+		return count > k.Count
+	case ">=":
+		return count >= k.Count
+	case "<":
+		return count < k.Count
+	case "<=":
+		return count <= k.Count
+	case "==":
+		return count == k.Count
+	case "!=":
+		return count != k.Count
+	default:
+		return false
+	}
+}
+
+// Summary returns a short, human-readable description of what m matches against, for use in a
+// startup summary of loaded rules - see config.Rule.Summary. "match-all" is returned for a Matchers
+// with nothing configured, since that is what it does.
+func (m Matchers) Summary() string {
+	var parts []string
+	if len(m.LabelSelectors) > 0 {
+		parts = append(parts, fmt.Sprintf("labels=%s", m.LabelSelectors))
+	}
+	if len(m.FieldSelectors) > 0 {
+		parts = append(parts, fmt.Sprintf("fields=%s", m.FieldSelectors))
+	}
+	if len(m.VersionSelectors) > 0 {
+		parts = append(parts, fmt.Sprintf("versions=%s", m.VersionSelectors))
+	}
+	if m.MatchExpression != "" {
+		parts = append(parts, fmt.Sprintf("expression=%q", m.MatchExpression))
+	}
+	if len(m.OriginalKindSelectors) > 0 {
+		parts = append(parts, fmt.Sprintf("original-kinds=%s", m.OriginalKindSelectors))
+	}
+	if len(parts) == 0 {
+		return "match-all"
+	}
+	return strings.Join(parts, " ")
+}
+
+// MatcherGroup is a named set of selectors that Matchers.MatchExpression can reference by name. Within
+// a group, LabelSelectors/FieldSelectors/VersionSelectors combine exactly as they do for the top-level
+// Matchers: label selectors OR together, field and version selectors OR together, and the two results
+// combine using BooleanOperator.
+type MatcherGroup struct {
+	Name             string          `mapstructure:"name" yaml:"name"`
+	LabelSelectors   []string        `mapstructure:"label-selectors" yaml:"label-selectors,omitempty"`
+	FieldSelectors   []string        `mapstructure:"field-selectors" yaml:"field-selectors,omitempty"`
+	VersionSelectors []string        `mapstructure:"version-selectors" yaml:"version-selectors,omitempty"`
+	BooleanOperator  BooleanOperator `mapstructure:"boolean-operator" yaml:"boolean-operator,omitempty"`
+}
+
+// asMatchers returns g's selectors as a Matchers, so that it can reuse Matchers' own selector
+// validation and matching logic rather than duplicating it.
+func (g MatcherGroup) asMatchers() Matchers {
+	return Matchers{
+		LabelSelectors:   g.LabelSelectors,
+		FieldSelectors:   g.FieldSelectors,
+		VersionSelectors: g.VersionSelectors,
+		BooleanOperator:  g.BooleanOperator,
+	}
+}
+
+func (g MatcherGroup) validate(rulelog zerolog.Logger) error {
+	return g.asMatchers().validate(rulelog)
+}
+
+// matches evaluates g's own selectors against obj/fm, combining its label and field/version results
+// with BooleanOperator.
+func (g MatcherGroup) matches(obj metaObject, fm map[string]string) (bool, error) {
+	group := g.asMatchers()
+
+	labelMatches, err := group.matchLabelSelectors(obj)
+	if err != nil {
+		return false, err
+	}
+
+	fieldMatches, err := group.matchFieldSelectors(fm)
+	if err != nil {
+		return false, err
+	}
+	if !fieldMatches && len(g.VersionSelectors) > 0 {
+		fieldMatches, err = group.matchVersionSelectors(fm)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	hasFieldComponent := len(g.FieldSelectors) > 0 || len(g.VersionSelectors) > 0
+	return combineSelectorResults(g.BooleanOperator, len(g.LabelSelectors) > 0, labelMatches, hasFieldComponent, fieldMatches)
+}
+
+// combineSelectorResults applies op to a label-selector match result and a field-selector match
+// result. hasLabels/hasFields record whether any selector of that kind was configured, since AND/OR
+// treat an unconfigured kind as "not applicable" rather than "false".
+func combineSelectorResults(op BooleanOperator, hasLabels, labelMatches, hasFields, fieldMatches bool) (bool, error) {
+	switch op {
+	case AND:
+		return (!hasLabels || labelMatches) && (!hasFields || fieldMatches), nil
+	case OR:
+		return (hasLabels && labelMatches) || (hasFields && fieldMatches), nil
+	case XOR:
+		return labelMatches != fieldMatches, nil
+	default:
+		return false, fmt.Errorf("boolean operator isn't one of AND, OR, XOR")
+	}
 }
 
 func (m Matchers) validate(rulelog zerolog.Logger) error {
@@ -50,6 +319,76 @@ func (m Matchers) validate(rulelog zerolog.Logger) error {
 			}
 		}
 	}
+
+	// all version selectors must also be valid...
+	if len(m.VersionSelectors) > 0 {
+		for _, selector := range m.VersionSelectors {
+			if _, _, _, err := parseVersionSelector(selector); err != nil {
+				rulelog.Error().Str("version-selector", selector).Msg("matcher contains an invalid version selector")
+				return fmt.Errorf("matcher contains an invalid version selector: %v", err)
+			}
+		}
+	}
+
+	if m.HasContainer != "" {
+		if err := validateContainerName(m.HasContainer); err != nil {
+			rulelog.Error().Str("has-container", m.HasContainer).Msg("matcher contains an invalid has-container name")
+			return fmt.Errorf("matcher contains an invalid has-container %v", err)
+		}
+	}
+	if m.MissingContainer != "" {
+		if err := validateContainerName(m.MissingContainer); err != nil {
+			rulelog.Error().Str("missing-container", m.MissingContainer).Msg("matcher contains an invalid missing-container name")
+			return fmt.Errorf("matcher contains an invalid missing-container %v", err)
+		}
+	}
+
+	if err := m.KeyCount.validate(); err != nil {
+		rulelog.Error().Str("key-count-prefix", m.KeyCount.Prefix).Msg("matcher contains an invalid key-count")
+		return fmt.Errorf("matcher contains an invalid key-count: %v", err)
+	}
+
+	if m.NamespaceNamePattern != "" {
+		if _, err := path.Match(m.NamespaceNamePattern, "test"); err != nil {
+			rulelog.Error().Str("namespace-name-pattern", m.NamespaceNamePattern).Msg("matcher contains an invalid namespace-name-pattern")
+			return fmt.Errorf("matcher contains an invalid namespace-name-pattern '%s': %v", m.NamespaceNamePattern, err)
+		}
+	}
+
+	groupNames := make(map[string]bool, len(m.MatcherGroups))
+	for _, g := range m.MatcherGroups {
+		if err := g.validate(rulelog); err != nil {
+			rulelog.Error().Str("matcher-group", g.Name).Msg("matcher group contains an invalid selector")
+			return fmt.Errorf("matcher group '%s' is invalid: %v", g.Name, err)
+		}
+		groupNames[g.Name] = true
+	}
+
+	if m.MatchExpression != "" {
+		expr, err := parseMatchExpression(m.MatchExpression)
+		if err != nil {
+			rulelog.Error().Str("match-expression", m.MatchExpression).Msg("matcher contains an invalid match-expression")
+			return fmt.Errorf("matcher contains an invalid match-expression '%s': %v", m.MatchExpression, err)
+		}
+		for _, name := range matchExpressionGroupNames(expr) {
+			if !groupNames[name] {
+				rulelog.Error().Str("match-expression", m.MatchExpression).Str("matcher-group", name).Msg("match-expression references an undefined matcher group")
+				return fmt.Errorf("match-expression '%s' references undefined matcher group '%s'", m.MatchExpression, name)
+			}
+		}
+	}
+
+	if err := m.Ramp.validate(); err != nil {
+		rulelog.Error().Str("ramp-duration", m.Ramp.Duration).Msg("matcher contains an invalid ramp")
+		return fmt.Errorf("matcher contains an invalid ramp: %v", err)
+	}
+
+	if RequireExplicitMatchAll && m.MatchExpression == "" && !m.MatchAll {
+		if len(m.LabelSelectors) == 0 && len(m.FieldSelectors) == 0 && len(m.VersionSelectors) == 0 {
+			rulelog.Error().Msg("matcher has no selectors and match-all is not set")
+			return fmt.Errorf("matcher has no selectors configured - set 'match-all: true' if the rule is meant to match every object")
+		}
+	}
 	return nil
 }
 
@@ -69,10 +408,116 @@ func validateFieldSelector(selector string) error {
 	return nil
 }
 
-func (m Matchers) matches(obj metaObject, fm map[string]string, mylog zerolog.Logger) (match bool, err error) {
+// withGenerateNameFallback substitutes obj.Meta.GenerateName for obj.Meta.Name, and
+// fm["metadata.name"] with the same value, whenever m.MatchGenerateName is set and the object has no
+// name yet but does have a generateName - i.e. a CREATE admission request for an object using
+// generateName, evaluated before the apiserver has assigned it a real name. obj and fm are returned
+// unchanged, and usedFallback is false, in every other case. Only the returned copies are used for
+// matching; the caller's original obj/fm, used for painting the object itself, are left untouched, so
+// the fallback affects what a rule matches against without affecting what it paints onto the object.
+func (m Matchers) withGenerateNameFallback(obj metaObject, fm map[string]string, mylog zerolog.Logger) (result metaObject, resultFm map[string]string, usedFallback bool) {
+	if !m.MatchGenerateName || obj.Meta.Name != "" || obj.Meta.GenerateName == "" {
+		return obj, fm, false
+	}
+
+	mylog.Debug().Str("generate-name", obj.Meta.GenerateName).Msg("object has no name yet, falling back to matching against metadata.generateName")
+	obj.Meta.Name = obj.Meta.GenerateName
+	adjustedFm := make(map[string]string, len(fm)+1)
+	for k, v := range fm {
+		adjustedFm[k] = v
+	}
+	adjustedFm["metadata.name"] = obj.Meta.GenerateName
+	return obj, adjustedFm, true
+}
+
+func (m Matchers) matches(ruleName string, obj metaObject, fm map[string]string, userInfo *authv1.UserInfo, mylog zerolog.Logger) (match bool, err error) {
 	var labelMatches, fieldMatches bool
-	if len(m.LabelSelectors) == 0 && len(m.FieldSelectors) == 0 {
-		mylog.Debug().Msg("rule does not contain any label or field selectors so it matches ALL")
+
+	obj, fm, _ = m.withGenerateNameFallback(obj, fm, mylog)
+
+	if m.Ramp.enabled() {
+		rampMatches, err := m.Ramp.matches(ruleName, obj, globalRampTracker, time.Now())
+		if err != nil {
+			return false, err
+		}
+		if !rampMatches {
+			mylog.Debug().Msg("object falls outside the rule's current ramp percentage")
+			return false, nil
+		}
+	}
+
+	if m.RequiresPreviousGraffitiMutation {
+		if _, ok := obj.Meta.Annotations[AppliedRulesAnnotation]; !ok {
+			mylog.Debug().Str("annotation", AppliedRulesAnnotation).Msg("rule requires a previous graffiti mutation but the annotation is not present")
+			return false, nil
+		}
+	}
+
+	if m.InvalidLabels && !hasInvalidLabel(obj.Meta.Labels) {
+		mylog.Debug().Msg("rule requires invalid labels but the object's labels are all valid")
+		return false, nil
+	}
+
+	if len(m.Namespaces) > 0 || m.NamespaceNamePattern != "" {
+		if !namespaceAllowed(obj.Meta.Namespace, m.Namespaces, m.NamespaceNamePattern) {
+			mylog.Debug().Str("namespace", obj.Meta.Namespace).Msg("object's namespace is not in the rule's namespace allowlist")
+			return false, nil
+		}
+	}
+
+	// userInfo is only available for admission requests; the existing check has no user context
+	// to test against, so ModifiedByUsers/ModifiedByGroups are skipped there.
+	if userInfo != nil && (len(m.ModifiedByUsers) > 0 || len(m.ModifiedByGroups) > 0) {
+		if !m.matchUserInfo(userInfo) {
+			mylog.Debug().Str("user", userInfo.Username).Msg("submitter doesn't match the rule's modified-by-users/modified-by-groups")
+			return false, nil
+		}
+	}
+
+	// CreatedByUsers reads from an annotation rather than the live submitting user, so unlike
+	// ModifiedByUsers it applies identically to admission requests and existing sweeps.
+	if len(m.CreatedByUsers) > 0 {
+		if !containsString(m.CreatedByUsers, obj.Meta.Annotations[CreatedByAnnotationKey]) {
+			mylog.Debug().Str("annotation", CreatedByAnnotationKey).Msg("object's creator annotation doesn't match the rule's created-by-users")
+			return false, nil
+		}
+	}
+
+	if len(m.SpecChanged) > 0 {
+		stored, ok := obj.Meta.Annotations[SpecHashAnnotationKey(ruleName)]
+		if ok && stored == computeSpecHash(fm, m.SpecChanged) {
+			mylog.Debug().Msg("object's spec-changed field paths match the hash already stamped, no drift detected")
+			return false, nil
+		}
+	}
+
+	if m.HasContainer != "" && !obj.Spec.hasContainerNamed(m.HasContainer) {
+		mylog.Debug().Str("has-container", m.HasContainer).Msg("object does not have the rule's required container")
+		return false, nil
+	}
+	if m.MissingContainer != "" && obj.Spec.hasContainerNamed(m.MissingContainer) {
+		mylog.Debug().Str("missing-container", m.MissingContainer).Msg("object has the container the rule requires to be missing")
+		return false, nil
+	}
+
+	if m.HasVolumeType != "" && !obj.Spec.hasVolumeType(m.HasVolumeType) {
+		mylog.Debug().Str("has-volume-type", m.HasVolumeType).Msg("object does not have a volume of the rule's required type")
+		return false, nil
+	}
+
+	if m.KeyCount.Prefix != "" && !m.KeyCount.matches(obj) {
+		mylog.Debug().Str("key-count-prefix", m.KeyCount.Prefix).Str("key-count-target", m.KeyCount.Target).Msg("object's key-count for the configured prefix does not satisfy the rule's threshold")
+		return false, nil
+	}
+
+	if m.MatchExpression != "" {
+		mylog.Debug().Str("match-expression", m.MatchExpression).Msg("evaluating match-expression against matcher groups")
+		return m.matchesExpression(obj, fm, mylog)
+	}
+
+	hasFieldComponent := len(m.FieldSelectors) > 0 || len(m.VersionSelectors) > 0
+	if len(m.LabelSelectors) == 0 && !hasFieldComponent {
+		mylog.Debug().Msg("rule does not contain any label, field or version selectors so it matches ALL")
 		return true, nil
 	}
 
@@ -89,16 +534,23 @@ func (m Matchers) matches(obj metaObject, fm map[string]string, mylog zerolog.Lo
 	if err != nil {
 		return false, err
 	}
+	if !fieldMatches && len(m.VersionSelectors) > 0 {
+		mylog.Debug().Int("count", len(m.VersionSelectors)).Msg("matching against version selectors")
+		fieldMatches, err = m.matchVersionSelectors(fm)
+		if err != nil {
+			return false, err
+		}
+	}
 
 	// Combine selector booleans and decide to paint object or not
-	descisonLog := mylog.With().Int("label-selectors-length", len(m.LabelSelectors)).Bool("labels-matched", labelMatches).Int("field-selector-length", len(m.FieldSelectors)).Bool("fields-matched", fieldMatches).Logger()
+	descisonLog := mylog.With().Int("label-selectors-length", len(m.LabelSelectors)).Bool("labels-matched", labelMatches).Int("field-selector-length", len(m.FieldSelectors)+len(m.VersionSelectors)).Bool("fields-matched", fieldMatches).Logger()
 	switch m.BooleanOperator {
 	case AND:
 		descisonLog.Debug().Str("boolean-operator", "AND").Msg("performed label-selector AND field-selector")
-		return (len(m.LabelSelectors) == 0 || labelMatches) && (len(m.FieldSelectors) == 0 || fieldMatches), nil
+		return (len(m.LabelSelectors) == 0 || labelMatches) && (!hasFieldComponent || fieldMatches), nil
 	case OR:
 		descisonLog.Debug().Str("boolean-operator", "OR").Msg("performed label-selector OR field-selector")
-		return (len(m.LabelSelectors) != 0 && labelMatches) || (len(m.FieldSelectors) != 0 && fieldMatches), nil
+		return (len(m.LabelSelectors) != 0 && labelMatches) || (hasFieldComponent && fieldMatches), nil
 	case XOR:
 		descisonLog.Debug().Str("boolean-operator", "XOR").Msg("performed label-selector XOR field-selector")
 		return labelMatches != fieldMatches, nil
@@ -108,6 +560,154 @@ func (m Matchers) matches(obj metaObject, fm map[string]string, mylog zerolog.Lo
 	}
 }
 
+// matchesExpression evaluates MatchExpression against the match results of each MatcherGroup it
+// references, and is used instead of the top-level LabelSelectors/FieldSelectors/VersionSelectors/
+// BooleanOperator evaluation whenever MatchExpression is set.
+func (m Matchers) matchesExpression(obj metaObject, fm map[string]string, mylog zerolog.Logger) (bool, error) {
+	expr, err := parseMatchExpression(m.MatchExpression)
+	if err != nil {
+		return false, err
+	}
+
+	groupsByName := make(map[string]MatcherGroup, len(m.MatcherGroups))
+	for _, g := range m.MatcherGroups {
+		groupsByName[g.Name] = g
+	}
+
+	results := make(map[string]bool, len(m.MatcherGroups))
+	for _, name := range matchExpressionGroupNames(expr) {
+		if _, done := results[name]; done {
+			continue
+		}
+		group, ok := groupsByName[name]
+		if !ok {
+			return false, fmt.Errorf("match expression references unknown matcher group '%s'", name)
+		}
+		matched, err := group.matches(obj, fm)
+		if err != nil {
+			return false, err
+		}
+		mylog.Debug().Str("matcher-group", name).Bool("matched", matched).Msg("evaluated matcher group referenced by match-expression")
+		results[name] = matched
+	}
+
+	return expr.eval(results), nil
+}
+
+// hasInvalidLabel reports whether objLabels contains at least one key or value that fails
+// Kubernetes' own validity rules, using the same utilvalidation checks validateAdditionsLabels
+// applies to a rule's own configured label additions.
+func hasInvalidLabel(objLabels map[string]string) bool {
+	for k, v := range objLabels {
+		if errorList := utilvalidation.IsQualifiedName(k); len(errorList) != 0 {
+			return true
+		}
+		if errorList := utilvalidation.IsValidLabelValue(v); len(errorList) != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// namespaceAllowed checks whether a namespace name is permitted by an exact allowlist and/or a glob pattern.
+func namespaceAllowed(namespace string, allowlist []string, pattern string) bool {
+	for _, ns := range allowlist {
+		if ns == namespace {
+			return true
+		}
+	}
+	if pattern != "" {
+		if ok, _ := path.Match(pattern, namespace); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// matchUserInfo checks a submitting user against ModifiedByUsers and ModifiedByGroups, combining
+// the two results with BooleanOperator when both are configured.
+func (m Matchers) matchUserInfo(userInfo *authv1.UserInfo) bool {
+	userMatches := containsString(m.ModifiedByUsers, userInfo.Username)
+	groupMatches := false
+	for _, g := range userInfo.Groups {
+		if containsString(m.ModifiedByGroups, g) {
+			groupMatches = true
+			break
+		}
+	}
+
+	switch m.BooleanOperator {
+	case AND:
+		return (len(m.ModifiedByUsers) == 0 || userMatches) && (len(m.ModifiedByGroups) == 0 || groupMatches)
+	case OR:
+		return (len(m.ModifiedByUsers) != 0 && userMatches) || (len(m.ModifiedByGroups) != 0 && groupMatches)
+	case XOR:
+		return userMatches != groupMatches
+	default:
+		return false
+	}
+}
+
+// selectorCache caches the labels.Selector/fields.Selector parsed from a selector's own source text,
+// keyed by that text. Matchers is constructed fresh at each admission request and each existing-objects
+// sweep - like rampTracker, a selector's parsed form can't live on the Matchers value itself - so
+// without this cache a hot rule's selectors would be re-parsed by labels.Parse/fields.ParseSelector on
+// every single request. Keying by the selector text rather than by rule means two rules sharing the
+// same selector string share the same parse too. It is safe for concurrent use.
+type selectorCache struct {
+	mu     sync.RWMutex
+	labels map[string]labels.Selector
+	fields map[string]fields.Selector
+}
+
+var globalSelectorCache = newSelectorCache()
+
+func newSelectorCache() *selectorCache {
+	return &selectorCache{labels: make(map[string]labels.Selector), fields: make(map[string]fields.Selector)}
+}
+
+// parseLabelSelector returns the labels.Selector parsed from selector, parsing and caching it the
+// first time it's seen and serving every subsequent call from the cache.
+func (c *selectorCache) parseLabelSelector(selector string) (labels.Selector, error) {
+	c.mu.RLock()
+	cached, ok := c.labels[selector]
+	c.mu.RUnlock()
+	if ok {
+		return cached, nil
+	}
+
+	parsed, err := labels.Parse(selector)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.labels[selector] = parsed
+	c.mu.Unlock()
+	return parsed, nil
+}
+
+// parseFieldSelector returns the fields.Selector parsed from selector, parsing and caching it the
+// first time it's seen and serving every subsequent call from the cache.
+func (c *selectorCache) parseFieldSelector(selector string) (fields.Selector, error) {
+	c.mu.RLock()
+	cached, ok := c.fields[selector]
+	c.mu.RUnlock()
+	if ok {
+		return cached, nil
+	}
+
+	parsed, err := fields.ParseSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.fields[selector] = parsed
+	c.mu.Unlock()
+	return parsed, nil
+}
+
 func (m Matchers) matchLabelSelectors(object metaObject) (bool, error) {
 	mylog := log.ComponentLogger(componentName, "matchLabelSelectors")
 	// test if we matched any of the label selectors
@@ -116,6 +716,10 @@ func (m Matchers) matchLabelSelectors(object metaObject) (bool, error) {
 		// make it so we can use name and namespace as label selectors
 		sourceLabels["name"] = object.Meta.Name
 		sourceLabels["namespace"] = object.Meta.Namespace
+		// generate-name is always available, not just when match-generate-name opts "name" into
+		// falling back to it, so a rule can select on it directly (e.g. "generate-name=my-app-")
+		// without having to also accept the fallback's effect on plain "name" selectors.
+		sourceLabels["generate-name"] = object.Meta.GenerateName
 		for k, v := range object.Meta.Labels {
 			sourceLabels[k] = v
 		}
@@ -141,7 +745,7 @@ func MatchLabelSelector(selector string, target map[string]string) (bool, error)
 	mylog := log.ComponentLogger(componentName, "MatchLabelSelector")
 	selLog := mylog.With().Str("selector", selector).Logger()
 
-	realSelector, err := labels.Parse(selector)
+	realSelector, err := globalSelectorCache.parseLabelSelector(selector)
 	if err != nil {
 		selLog.Error().Err(err).Msg("could not parse selector")
 		return false, err
@@ -178,7 +782,7 @@ func (m Matchers) matchFieldSelectors(fm map[string]string) (bool, error) {
 func matchFieldSelector(selector string, target map[string]string) (bool, error) {
 	mylog := log.ComponentLogger(componentName, "matchFieldSelector")
 	selLog := mylog.With().Str("selector", selector).Logger()
-	realSelector, err := fields.ParseSelector(selector)
+	realSelector, err := globalSelectorCache.parseFieldSelector(selector)
 	if err != nil {
 		selLog.Error().Err(err).Msg("could not parse selector")
 		return false, err
@@ -192,3 +796,156 @@ func matchFieldSelector(selector string, target map[string]string) (bool, error)
 	selLog.Debug().Msg("selector matches")
 	return true, nil
 }
+
+// matchesAPIVersion reports whether apiVersion satisfies m.APIVersionSelectors. A rule with no
+// APIVersionSelectors configured is not restricted by api-version and always matches.
+func (m Matchers) matchesAPIVersion(apiVersion string) bool {
+	if len(m.APIVersionSelectors) == 0 {
+		return true
+	}
+	for _, v := range m.APIVersionSelectors {
+		if v == apiVersion {
+			return true
+		}
+	}
+	return false
+}
+
+func (m Matchers) matchVersionSelectors(fm map[string]string) (bool, error) {
+	mylog := log.ComponentLogger(componentName, "matchVersionSelectors")
+	for _, selector := range m.VersionSelectors {
+		mylog.Debug().Str("version-selector", selector).Msg("testing version selector")
+		selectorMatch, err := matchVersionSelector(selector, fm)
+		if err != nil {
+			return false, err
+		}
+		if selectorMatch {
+			mylog.Debug().Str("version-selector", selector).Msg("selector matches, will modify object")
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// parseVersionSelector splits a version selector of the form "path op operand" (e.g.
+// "metadata.labels.app-version >= 1.2.0") into its three parts, validating that op is a
+// recognised comparison operator and operand parses as a number or semantic version.
+func parseVersionSelector(selector string) (path string, op string, operand string, err error) {
+	parts := strings.Fields(selector)
+	if len(parts) != 3 {
+		return "", "", "", fmt.Errorf("version selector %q must have the form '<path> <operator> <version>'", selector)
+	}
+	path, op, operand = parts[0], parts[1], parts[2]
+	switch op {
+	case ">", ">=", "<", "<=", "==", "!=":
+	default:
+		return "", "", "", fmt.Errorf("version selector %q has an unsupported operator %q", selector, op)
+	}
+	if _, err := version.ParseGeneric(operand); err != nil {
+		return "", "", "", fmt.Errorf("version selector %q has an invalid version %q: %v", selector, operand, err)
+	}
+	return path, op, operand, nil
+}
+
+// matchesOriginalKind reports whether kind satisfies m.OriginalKindSelectors. A rule with no
+// OriginalKindSelectors configured is not restricted by original kind and always matches.
+func (m Matchers) matchesOriginalKind(kind string) bool {
+	if len(m.OriginalKindSelectors) == 0 {
+		return true
+	}
+	return containsString(m.OriginalKindSelectors, kind)
+}
+
+// kindsWithPodTemplate are the object kinds whose spec carries a "template" Pod template - the only
+// kinds a field selector rooted at "spec.template." can ever match.
+var kindsWithPodTemplate = map[string]bool{
+	"Deployment":  true,
+	"ReplicaSet":  true,
+	"StatefulSet": true,
+	"DaemonSet":   true,
+	"Job":         true,
+	"CronJob":     true,
+}
+
+// applicableToKind reports whether m's matchers could possibly match an object of the given kind,
+// without evaluating any of them. It is a cheap short-circuit ahead of the work MutateAdmission does
+// before a rule's matchers actually run - flattening the object into a field map and evaluating
+// Matchers.matches - for the common case of a rule whose field-selectors are scoped to a part of the
+// object kind doesn't have, e.g. a "spec.template.metadata.labels.*" field selector intended for a
+// Deployment reviewed against a bare Pod or a Namespace. An empty kind, or one this function doesn't
+// know enough about to rule out, is always applicable - it only ever returns false when it can prove
+// none of m's field selectors could match.
+func (m Matchers) applicableToKind(kind string) bool {
+	if kind == "" || kindsWithPodTemplate[kind] || m.MatchExpression != "" || len(m.VersionSelectors) > 0 || len(m.FieldSelectors) == 0 {
+		return true
+	}
+	if len(m.LabelSelectors) > 0 && m.BooleanOperator != AND {
+		return true
+	}
+	for _, selector := range m.FieldSelectors {
+		realSelector, err := fields.ParseSelector(selector)
+		if err != nil {
+			return true
+		}
+		ruledOut := false
+		for _, requirement := range realSelector.Requirements() {
+			if strings.HasPrefix(requirement.Field, "spec.template.") && requirement.Operator != "!=" {
+				ruledOut = true
+			}
+		}
+		if !ruledOut {
+			return true
+		}
+	}
+	return false
+}
+
+// matchVersionSelector looks up path in target and compares it against operand as a number or
+// semantic version, e.g. "metadata.labels.app-version >= 1.2.0". If the path is absent from target
+// it does not match.
+func matchVersionSelector(selector string, target map[string]string) (bool, error) {
+	mylog := log.ComponentLogger(componentName, "matchVersionSelector")
+	selLog := mylog.With().Str("selector", selector).Logger()
+
+	path, op, operand, err := parseVersionSelector(selector)
+	if err != nil {
+		selLog.Error().Err(err).Msg("could not parse version selector")
+		return false, err
+	}
+
+	actualValue, ok := target[path]
+	if !ok {
+		selLog.Debug().Str("path", path).Msg("path is not present, selector does not match")
+		return false, nil
+	}
+
+	actual, err := version.ParseGeneric(actualValue)
+	if err != nil {
+		selLog.Error().Err(err).Str("path", path).Str("value", actualValue).Msg("value is not a valid number or semantic version")
+		return false, err
+	}
+
+	cmp, err := actual.Compare(operand)
+	if err != nil {
+		selLog.Error().Err(err).Msg("could not compare versions")
+		return false, err
+	}
+
+	var matched bool
+	switch op {
+	case ">":
+		matched = cmp > 0
+	case ">=":
+		matched = cmp >= 0
+	case "<":
+		matched = cmp < 0
+	case "<=":
+		matched = cmp <= 0
+	case "==":
+		matched = cmp == 0
+	case "!=":
+		matched = cmp != 0
+	}
+	selLog.Debug().Bool("matched", matched).Msg("evaluated version selector")
+	return matched, nil
+}
@@ -14,6 +14,7 @@ limitations under the License.
 package graffiti
 
 import (
+	"context"
 	"encoding/json"
 	"testing"
 
@@ -24,6 +25,7 @@ import (
 	"github.com/stretchr/testify/require"
 	yaml "gopkg.in/yaml.v2"
 	admission "k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 func TestRulesContainingInvalidLabelSelectorsFailValidation(t *testing.T) {
@@ -82,6 +84,32 @@ field-selectors:
 	assert.Error(t, err, "this complex label-selector rule is not a valid field selector rule")
 }
 
+func TestASimpleVersionSelectorIsValid(t *testing.T) {
+	var source = `---
+version-selectors:
+-  "metadata.labels.app-version >= 1.2.0"
+`
+	mylog := log.Logger
+	var matchers Matchers
+	err := yaml.Unmarshal([]byte(source), &matchers)
+	require.NoError(t, err, "the test matchers should unmarshal")
+	err = matchers.validate(mylog)
+	assert.NoErrorf(t, err, "this is a valid version selector and so should not fail our validation checks")
+}
+
+func TestRulesContainingInvalidVersionSelectorsFailValidation(t *testing.T) {
+	var source = `---
+version-selectors:
+-  "metadata.labels.app-version is broken"
+`
+	mylog := log.Logger
+	var matchers Matchers
+	err := yaml.Unmarshal([]byte(source), &matchers)
+	require.NoError(t, err, "the test matchers should unmarshal")
+	err = matchers.validate(mylog)
+	assert.Error(t, err, "'is' is not a supported version comparison operator")
+}
+
 func TestUnmarshalBooleanOperatorOR(t *testing.T) {
 	var source = `---
 label-selectors:
@@ -128,7 +156,7 @@ func TestWithoutMatchingLabelSelector(t *testing.T) {
 	assert.NoError(t, err, "couldn't marshall a valid admission review object from test json")
 
 	// call Mutate
-	resp := rule.MutateAdmission(review.Request)
+	resp := rule.MutateAdmission(context.Background(), review.Request)
 	assert.Equal(t, true, resp.Allowed, "failed rules should not block the source api request")
 	assert.Nil(t, resp.Patch)
 }
@@ -151,7 +179,7 @@ func TestMatchingLabelSelector(t *testing.T) {
 	assert.NoError(t, err, "couldn't marshall a valid admission review object from test json")
 
 	// call Mutate
-	resp := rule.MutateAdmission(review.Request)
+	resp := rule.MutateAdmission(context.Background(), review.Request)
 	assert.Equal(t, true, resp.Allowed, "the request should be successful")
 	assert.NotNil(t, resp.Patch)
 
@@ -181,7 +209,7 @@ func TestLabelSelectorMatchesName(t *testing.T) {
 	require.NoError(t, err, "couldn't marshall a valid admission review object from test json")
 
 	// call Mutate
-	resp := rule.MutateAdmission(review.Request)
+	resp := rule.MutateAdmission(context.Background(), review.Request)
 	assert.Equal(t, true, resp.Allowed, "the request should be successful")
 	assert.NotNil(t, resp.Patch)
 
@@ -212,7 +240,7 @@ func TestSuccessfullCombinedFieldSelector(t *testing.T) {
 	assert.NoError(t, err, "couldn't marshall a valid admission review object from test json")
 
 	// call Mutate
-	resp := rule.MutateAdmission(review.Request)
+	resp := rule.MutateAdmission(context.Background(), review.Request)
 	assert.Equal(t, true, resp.Allowed, "the request should be successful")
 	assert.NotNil(t, resp.Patch)
 
@@ -243,7 +271,7 @@ func TestCombinedFieldSelectorShouldANDTheCommaSeparatedSelectors(t *testing.T)
 	assert.NoError(t, err, "couldn't marshall a valid admission review object from test json")
 
 	// call Mutate
-	resp := rule.MutateAdmission(review.Request)
+	resp := rule.MutateAdmission(context.Background(), review.Request)
 	assert.Equal(t, true, resp.Allowed, "the request should be successful")
 	assert.Nil(t, resp.Patch)
 }
@@ -267,7 +295,7 @@ func TestInvalidFieldSelector(t *testing.T) {
 	require.NoError(t, err, "couldn't marshall a valid admission review object from test json")
 
 	// call Mutate
-	resp := rule.MutateAdmission(review.Request)
+	resp := rule.MutateAdmission(context.Background(), review.Request)
 	assert.Equal(t, true, resp.Allowed, "the request should be successful")
 	assert.Nil(t, resp.Patch, "nothing is patched")
 }
@@ -292,7 +320,7 @@ func TestORMultipleFieldSelectors(t *testing.T) {
 	assert.NoError(t, err, "couldn't marshall a valid admission review object from test json")
 
 	// call Mutate
-	resp := rule.MutateAdmission(review.Request)
+	resp := rule.MutateAdmission(context.Background(), review.Request)
 	assert.Equal(t, true, resp.Allowed, "the request should be successful")
 	assert.NotNil(t, resp.Patch)
 
@@ -322,7 +350,7 @@ func TestMultipleLabelSelectorsAreORed(t *testing.T) {
 	require.NoError(t, err, "couldn't marshall a valid admission review object from test json")
 
 	// call Mutate
-	resp := rule.MutateAdmission(review.Request)
+	resp := rule.MutateAdmission(context.Background(), review.Request)
 	assert.Equal(t, true, resp.Allowed, "the request should be successful")
 	assert.NotNil(t, resp.Patch)
 
@@ -353,7 +381,7 @@ func TestMatchingComplexFieldSelectorHit(t *testing.T) {
 	assert.NoError(t, err, "couldn't marshall a valid admission review object from test json")
 
 	// call Mutate
-	resp := rule.MutateAdmission(review.Request)
+	resp := rule.MutateAdmission(context.Background(), review.Request)
 	assert.Equal(t, true, resp.Allowed, "the request should be successful")
 	assert.NotNil(t, resp.Patch)
 
@@ -385,7 +413,7 @@ func TestLabelAndFieldSelectorsANDTogetherByDefault(t *testing.T) {
 	assert.NoError(t, err, "couldn't marshall a valid admission review object from test json")
 
 	// call Mutate
-	resp := rule.MutateAdmission(review.Request)
+	resp := rule.MutateAdmission(context.Background(), review.Request)
 	assert.Equal(t, true, resp.Allowed, "the request should be successful")
 	assert.Nil(t, resp.Patch)
 }
@@ -410,7 +438,7 @@ func TestSimpleFieldSelectorMiss(t *testing.T) {
 	assert.NoError(t, err, "couldn't marshall a valid admission review object from test json")
 
 	// call Mutate
-	resp := rule.MutateAdmission(review.Request)
+	resp := rule.MutateAdmission(context.Background(), review.Request)
 	assert.Equal(t, true, resp.Allowed, "the request should be successful")
 	assert.Nil(t, resp.Patch)
 }
@@ -435,7 +463,7 @@ func TestMatchingSimpleFieldSelectorHit(t *testing.T) {
 	assert.NoError(t, err, "couldn't marshall a valid admission review object from test json")
 
 	// call Mutate
-	resp := rule.MutateAdmission(review.Request)
+	resp := rule.MutateAdmission(context.Background(), review.Request)
 	assert.Equal(t, true, resp.Allowed, "the request should be successful")
 	assert.NotNil(t, resp.Patch)
 
@@ -466,7 +494,7 @@ func TestMatchingNegativeSimpleFieldSelector(t *testing.T) {
 	assert.NoError(t, err, "couldn't marshall a valid admission review object from test json")
 
 	// call Mutate
-	resp := rule.MutateAdmission(review.Request)
+	resp := rule.MutateAdmission(context.Background(), review.Request)
 	assert.Equal(t, true, resp.Allowed, "the request should be successful")
 	assert.NotNil(t, resp.Patch)
 
@@ -499,7 +527,7 @@ func TestLabelAndFieldSelectorsANDSpecified(t *testing.T) {
 	assert.NoError(t, err, "couldn't marshall a valid admission review object from test json")
 
 	// call Mutate
-	resp := rule.MutateAdmission(review.Request)
+	resp := rule.MutateAdmission(context.Background(), review.Request)
 	assert.Equal(t, true, resp.Allowed, "the request should be successful")
 	assert.Nil(t, resp.Patch)
 }
@@ -527,7 +555,7 @@ func TestAnEmptySelectorAlwaysMatchesWithAND(t *testing.T) {
 	assert.NoError(t, err, "couldn't marshall a valid admission review object from test json")
 
 	// call Mutate
-	resp := rule.MutateAdmission(review.Request)
+	resp := rule.MutateAdmission(context.Background(), review.Request)
 	assert.Equal(t, true, resp.Allowed, "the request should be successful")
 	assert.NotNil(t, resp.Patch)
 	// we have to test the patch objects because they have multiple values and can be ordered either way round preventing a simple string match.
@@ -559,7 +587,7 @@ func TestLabelAndFieldSelectorsORSelected(t *testing.T) {
 	assert.NoError(t, err, "couldn't marshall a valid admission review object from test json")
 
 	// call Mutate
-	resp := rule.MutateAdmission(review.Request)
+	resp := rule.MutateAdmission(context.Background(), review.Request)
 	assert.Equal(t, true, resp.Allowed, "the request should be successful")
 	assert.NotNil(t, resp.Patch)
 	// we have to test the patch objects because they have multiple values and can be ordered either way round preventing a simple string match.
@@ -592,7 +620,7 @@ func TestAnEmptySelectorNeverMatchesWithOR(t *testing.T) {
 	assert.NoError(t, err, "couldn't marshall a valid admission review object from test json")
 
 	// call Mutate
-	resp := rule.MutateAdmission(review.Request)
+	resp := rule.MutateAdmission(context.Background(), review.Request)
 	assert.Equal(t, true, resp.Allowed, "the request should be successful")
 	assert.Nil(t, resp.Patch)
 }
@@ -619,7 +647,7 @@ func TestLabelAndFieldSelectorsXORSelectedWithSingleMatch(t *testing.T) {
 	assert.NoError(t, err, "couldn't marshall a valid admission review object from test json")
 
 	// call Mutate
-	resp := rule.MutateAdmission(review.Request)
+	resp := rule.MutateAdmission(context.Background(), review.Request)
 	assert.Equal(t, true, resp.Allowed, "the request should be successful")
 	assert.NotNil(t, resp.Patch)
 	// we have to test the patch objects because they have multiple values and can be ordered either way round preventing a simple string match.
@@ -651,7 +679,7 @@ func TestLabelAndFieldSelectorsXORWithBothMatchedIsFalse(t *testing.T) {
 	assert.NoError(t, err, "couldn't marshall a valid admission review object from test json")
 
 	// call Mutate
-	resp := rule.MutateAdmission(review.Request)
+	resp := rule.MutateAdmission(context.Background(), review.Request)
 	assert.Equal(t, true, resp.Allowed, "the request should be successful")
 	assert.Nil(t, resp.Patch)
 }
@@ -678,7 +706,1252 @@ func TestLabelAndFieldSelectorsXORanEmptySelectorIsNotAMatch(t *testing.T) {
 	assert.NoError(t, err, "couldn't marshall a valid admission review object from test json")
 
 	// call Mutate
-	resp := rule.MutateAdmission(review.Request)
+	resp := rule.MutateAdmission(context.Background(), review.Request)
 	assert.Equal(t, true, resp.Allowed, "the request should be successful")
 	assert.Nil(t, resp.Patch)
 }
+
+func TestRequiresPreviousGraffitiMutationSkipsUnstampedObjects(t *testing.T) {
+	rule := Rule{
+		Matchers: Matchers{
+			RequiresPreviousGraffitiMutation: true,
+		},
+		Payload: Payload{
+			Additions: Additions{
+				Labels: map[string]string{"second-pass": "true"},
+			},
+		},
+	}
+
+	var review = admission.AdmissionReview{}
+	err := json.Unmarshal([]byte(testReview), &review)
+	assert.NoError(t, err, "couldn't marshall a valid admission review object from test json")
+
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	assert.Equal(t, true, resp.Allowed, "the request should be successful")
+	assert.Nil(t, resp.Patch, "the object has no applied-rules annotation so the rule should not match")
+}
+
+func TestRequiresPreviousGraffitiMutationMatchesStampedObjects(t *testing.T) {
+	rule := Rule{
+		Matchers: Matchers{
+			RequiresPreviousGraffitiMutation: true,
+		},
+		Payload: Payload{
+			Additions: Additions{
+				Labels: map[string]string{"second-pass": "true"},
+			},
+		},
+	}
+
+	var review = admission.AdmissionReview{}
+	err := json.Unmarshal([]byte(testReviewWithAppliedRules), &review)
+	assert.NoError(t, err, "couldn't marshall a valid admission review object from test json")
+
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	assert.Equal(t, true, resp.Allowed, "the request should be successful")
+	assert.NotNil(t, resp.Patch, "the object has the applied-rules annotation so the rule should match")
+}
+
+const testReviewWithAppliedRules = `{
+	"kind":"AdmissionReview",
+	"apiVersion":"admission.k8s.io/v1beta1",
+	"request":{
+	   "uid":"69f7d25a-963e-11e8-a77c-08002753edac",
+	   "kind":{
+		  "group":"",
+		  "version":"v1",
+		  "kind":"Namespace"
+	   },
+	   "resource":{
+		  "group":"",
+		  "version":"v1",
+		  "resource":"namespaces"
+	   },
+	   "operation":"UPDATE",
+	   "userInfo":{
+		  "username":"minikube-user",
+		  "groups":[
+			 "system:masters",
+			 "system:authenticated"
+		  ]
+	   },
+	   "object":{
+		  "metadata":{
+			 "name":"test-namespace",
+			 "creationTimestamp":null,
+			 "labels":{
+				 "author": "david",
+				 "group": "runtime"
+			 },
+			 "annotations":{
+				 "graffiti.io/applied-rules": "my-rule"
+			 }
+		  },
+		  "spec":{
+
+		  },
+		  "status":{
+			 "phase":"Active"
+		  }
+	   }
+	}
+ }`
+
+func TestInvalidLabelsMatchesAnObjectWithALabelValueContainingSpaces(t *testing.T) {
+	rule := Rule{
+		Matchers: Matchers{
+			InvalidLabels: true,
+		},
+		Payload: Payload{
+			Deletions: Deletions{
+				Labels: []string{"imported-from"},
+			},
+		},
+	}
+
+	var review = admission.AdmissionReview{}
+	err := json.Unmarshal([]byte(testReviewWithInvalidLabel), &review)
+	assert.NoError(t, err, "couldn't marshall a valid admission review object from test json")
+
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	assert.Equal(t, true, resp.Allowed, "the request should be successful")
+	assert.NotNil(t, resp.Patch, "the object carries a label value containing spaces, so invalid-labels should match")
+}
+
+func TestInvalidLabelsSkipsAnObjectWithOnlyValidLabels(t *testing.T) {
+	rule := Rule{
+		Matchers: Matchers{
+			InvalidLabels: true,
+		},
+		Payload: Payload{
+			Deletions: Deletions{
+				Labels: []string{"imported-from"},
+			},
+		},
+	}
+
+	var review = admission.AdmissionReview{}
+	err := json.Unmarshal([]byte(testReviewWithAppliedRules), &review)
+	assert.NoError(t, err, "couldn't marshall a valid admission review object from test json")
+
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	assert.Equal(t, true, resp.Allowed, "the request should be successful")
+	assert.Nil(t, resp.Patch, "the object's labels are all valid, so invalid-labels should not match")
+}
+
+const testReviewWithInvalidLabel = `{
+	"kind":"AdmissionReview",
+	"apiVersion":"admission.k8s.io/v1beta1",
+	"request":{
+	   "uid":"69f7d25a-963e-11e8-a77c-08002753edac",
+	   "kind":{
+		  "group":"",
+		  "version":"v1",
+		  "kind":"Namespace"
+	   },
+	   "resource":{
+		  "group":"",
+		  "version":"v1",
+		  "resource":"namespaces"
+	   },
+	   "operation":"UPDATE",
+	   "userInfo":{
+		  "username":"minikube-user",
+		  "groups":[
+			 "system:masters",
+			 "system:authenticated"
+		  ]
+	   },
+	   "object":{
+		  "metadata":{
+			 "name":"test-namespace",
+			 "creationTimestamp":null,
+			 "labels":{
+				 "imported-from": "legacy system"
+			 }
+		  },
+		  "spec":{
+
+		  },
+		  "status":{
+			 "phase":"Active"
+		  }
+	   }
+	}
+ }`
+
+func TestNamespaceNamePatternBlocksInMatchingNamespace(t *testing.T) {
+	rule := Rule{
+		Name: "block-prod",
+		Matchers: Matchers{
+			NamespaceNamePattern: "prod-*",
+		},
+		Payload: Payload{
+			Block: true,
+		},
+	}
+
+	var review = admission.AdmissionReview{}
+	err := json.Unmarshal([]byte(testReviewInNamespace("prod-a")), &review)
+	assert.NoError(t, err, "couldn't marshall a valid admission review object from test json")
+
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	assert.Equal(t, false, resp.Allowed, "the request should be blocked as prod-a matches prod-*")
+}
+
+func TestNamespaceNamePatternAllowsInNonMatchingNamespace(t *testing.T) {
+	rule := Rule{
+		Name: "block-prod",
+		Matchers: Matchers{
+			NamespaceNamePattern: "prod-*",
+		},
+		Payload: Payload{
+			Block: true,
+		},
+	}
+
+	var review = admission.AdmissionReview{}
+	err := json.Unmarshal([]byte(testReviewInNamespace("dev-a")), &review)
+	assert.NoError(t, err, "couldn't marshall a valid admission review object from test json")
+
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	assert.Equal(t, true, resp.Allowed, "the request should be allowed as dev-a does not match prod-*")
+}
+
+func TestInvalidNamespaceNamePatternFailsValidation(t *testing.T) {
+	mylog := log.Logger
+	matchers := Matchers{NamespaceNamePattern: "[invalid"}
+	err := matchers.validate(mylog)
+	assert.Error(t, err)
+}
+
+func testReviewInNamespace(namespace string) string {
+	return `{
+	"kind":"AdmissionReview",
+	"apiVersion":"admission.k8s.io/v1beta1",
+	"request":{
+	   "uid":"69f7d25a-963e-11e8-a77c-08002753edac",
+	   "kind":{"group":"","version":"v1","kind":"Pod"},
+	   "resource":{"group":"","version":"v1","resource":"pods"},
+	   "operation":"CREATE",
+	   "namespace": "` + namespace + `",
+	   "userInfo":{"username":"minikube-user","groups":["system:masters"]},
+	   "object":{
+		  "metadata":{
+			 "name":"test-pod",
+			 "namespace":"` + namespace + `",
+			 "creationTimestamp":null
+		  },
+		  "spec":{},
+		  "status":{}
+	   }
+	}
+ }`
+}
+
+func TestModifiedByUsersMatchesUsername(t *testing.T) {
+	rule := Rule{
+		Name: "block-by-user",
+		Matchers: Matchers{
+			ModifiedByUsers: []string{"minikube-user"},
+		},
+		Payload: Payload{
+			Block: true,
+		},
+	}
+
+	var review = admission.AdmissionReview{}
+	err := json.Unmarshal([]byte(testReviewWithUser("minikube-user", nil)), &review)
+	assert.NoError(t, err, "couldn't marshall a valid admission review object from test json")
+
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	assert.Equal(t, false, resp.Allowed, "the request should be blocked as minikube-user is in ModifiedByUsers")
+}
+
+func TestModifiedByGroupsMatchesGroup(t *testing.T) {
+	rule := Rule{
+		Name: "block-by-group",
+		Matchers: Matchers{
+			ModifiedByGroups: []string{"system:masters"},
+		},
+		Payload: Payload{
+			Block: true,
+		},
+	}
+
+	var review = admission.AdmissionReview{}
+	err := json.Unmarshal([]byte(testReviewWithUser("someone-else", []string{"system:masters"})), &review)
+	assert.NoError(t, err, "couldn't marshall a valid admission review object from test json")
+
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	assert.Equal(t, false, resp.Allowed, "the request should be blocked as system:masters is in ModifiedByGroups")
+}
+
+func TestModifiedByUsersGroupsNoMatch(t *testing.T) {
+	rule := Rule{
+		Name: "block-by-user",
+		Matchers: Matchers{
+			ModifiedByUsers:  []string{"minikube-user"},
+			ModifiedByGroups: []string{"system:masters"},
+		},
+		Payload: Payload{
+			Block: true,
+		},
+	}
+
+	var review = admission.AdmissionReview{}
+	err := json.Unmarshal([]byte(testReviewWithUser("someone-else", []string{"developers"})), &review)
+	assert.NoError(t, err, "couldn't marshall a valid admission review object from test json")
+
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	assert.Equal(t, true, resp.Allowed, "the request should be allowed as neither the user nor group match")
+}
+
+func TestModifiedByUsersSkippedOnExistingCheck(t *testing.T) {
+	rule := Rule{
+		Name: "block-by-user",
+		Matchers: Matchers{
+			ModifiedByUsers: []string{"minikube-user"},
+		},
+		Payload: Payload{
+			Block: true,
+		},
+	}
+
+	object := `{"metadata":{"name":"test-pod","namespace":"default"},"spec":{},"status":{}}`
+	patch, err := rule.Mutate(context.Background(), []byte(object))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("BLOCK"), patch, "ModifiedByUsers has no user to test against when checking existing objects, so it is bypassed and the rule matches as if it weren't set")
+}
+
+func TestStampCreatedByAnnotatesObjectWithSubmittingUserOnAdmission(t *testing.T) {
+	rule := Rule{
+		Name: "stamp-creator",
+		Payload: Payload{
+			Additions: Additions{StampCreatedBy: true},
+		},
+	}
+
+	var review = admission.AdmissionReview{}
+	err := json.Unmarshal([]byte(testReviewWithUser("minikube-user", nil)), &review)
+	assert.NoError(t, err, "couldn't marshall a valid admission review object from test json")
+
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	assert.True(t, resp.Allowed)
+	require.NotNil(t, resp.Patch)
+	desired, _ := jsonpatch.FromString(`[ { "op": "add", "path": "/metadata/annotations", "value": { "kube-graffiti.io/created-by": "minikube-user" } } ]`)
+	actual, err := jsonpatch.FromString(string(resp.Patch))
+	require.NoError(t, err)
+	assert.ElementsMatch(t, desired.Operations, actual.Operations)
+}
+
+func TestStampCreatedByDoesNotOverwriteAnExistingCreatorAnnotation(t *testing.T) {
+	rule := Rule{
+		Name: "stamp-creator",
+		Payload: Payload{
+			Additions: Additions{StampCreatedBy: true},
+		},
+	}
+
+	reviewJSON := `{
+	"kind":"AdmissionReview",
+	"apiVersion":"admission.k8s.io/v1beta1",
+	"request":{
+	   "uid":"69f7d25a-963e-11e8-a77c-08002753edac",
+	   "kind":{"group":"","version":"v1","kind":"Pod"},
+	   "resource":{"group":"","version":"v1","resource":"pods"},
+	   "operation":"UPDATE",
+	   "namespace": "default",
+	   "userInfo":{"username":"new-user"},
+	   "object":{
+		  "metadata":{
+			 "name":"test-pod",
+			 "namespace":"default",
+			 "annotations":{"kube-graffiti.io/created-by":"original-user"}
+		  },
+		  "spec":{},
+		  "status":{}
+	   }
+	}
+ }`
+	var review = admission.AdmissionReview{}
+	err := json.Unmarshal([]byte(reviewJSON), &review)
+	assert.NoError(t, err, "couldn't marshall a valid admission review object from test json")
+
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	assert.True(t, resp.Allowed)
+	assert.Nil(t, resp.Patch, "the rule shouldn't repaint an object that already has a created-by annotation")
+}
+
+func TestStampCreatedByIsSkippedOnExistingCheck(t *testing.T) {
+	rule := Rule{
+		Name: "stamp-creator",
+		Payload: Payload{
+			Additions: Additions{StampCreatedBy: true},
+		},
+	}
+
+	object := `{"metadata":{"name":"test-pod","namespace":"default"},"spec":{},"status":{}}`
+	patch, err := rule.Mutate(context.Background(), []byte(object))
+	assert.NoError(t, err)
+	assert.Nil(t, patch, "StampCreatedBy has no submitting user to stamp when checking existing objects")
+}
+
+func TestCreatedByUsersMatchesTheStampedAnnotation(t *testing.T) {
+	rule := Rule{
+		Name: "block-by-creator",
+		Matchers: Matchers{
+			CreatedByUsers: []string{"minikube-user"},
+		},
+		Payload: Payload{
+			Block: true,
+		},
+	}
+
+	object := `{"metadata":{"name":"test-pod","namespace":"default","annotations":{"kube-graffiti.io/created-by":"minikube-user"}},"spec":{},"status":{}}`
+	patch, err := rule.Mutate(context.Background(), []byte(object))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("BLOCK"), patch, "CreatedByUsers reads the annotation, so it works identically for existing objects")
+}
+
+func TestCreatedByUsersDoesNotMatchAnUnstampedObject(t *testing.T) {
+	rule := Rule{
+		Name: "block-by-creator",
+		Matchers: Matchers{
+			CreatedByUsers: []string{"minikube-user"},
+		},
+		Payload: Payload{
+			Block: true,
+		},
+	}
+
+	object := `{"metadata":{"name":"test-pod","namespace":"default"},"spec":{},"status":{}}`
+	patch, err := rule.Mutate(context.Background(), []byte(object))
+	assert.NoError(t, err)
+	assert.Nil(t, patch, "the object has no created-by annotation at all, so it should not match")
+}
+
+func TestMatchVersionSelectorGreaterThanOrEqualHit(t *testing.T) {
+	target := map[string]string{"metadata.labels.app-version": "1.3.0"}
+	matched, err := matchVersionSelector("metadata.labels.app-version >= 1.2.0", target)
+	assert.NoError(t, err)
+	assert.True(t, matched, "1.3.0 is greater than or equal to 1.2.0")
+}
+
+func TestMatchVersionSelectorGreaterThanOrEqualMiss(t *testing.T) {
+	target := map[string]string{"metadata.labels.app-version": "1.1.0"}
+	matched, err := matchVersionSelector("metadata.labels.app-version >= 1.2.0", target)
+	assert.NoError(t, err)
+	assert.False(t, matched, "1.1.0 is not greater than or equal to 1.2.0")
+}
+
+func TestMatchVersionSelectorMissingPathDoesNotMatch(t *testing.T) {
+	target := map[string]string{"metadata.labels.other": "1.3.0"}
+	matched, err := matchVersionSelector("metadata.labels.app-version >= 1.2.0", target)
+	assert.NoError(t, err)
+	assert.False(t, matched, "a path that is absent from the field map cannot match")
+}
+
+func TestMatchVersionSelectorInvalidActualValueErrors(t *testing.T) {
+	target := map[string]string{"metadata.labels.app-version": "not-a-version"}
+	_, err := matchVersionSelector("metadata.labels.app-version >= 1.2.0", target)
+	assert.Error(t, err, "the actual value must parse as a number or semantic version")
+}
+
+func testReviewWithUser(username string, groups []string) string {
+	groupsJSON, _ := json.Marshal(groups)
+	return `{
+	"kind":"AdmissionReview",
+	"apiVersion":"admission.k8s.io/v1beta1",
+	"request":{
+	   "uid":"69f7d25a-963e-11e8-a77c-08002753edac",
+	   "kind":{"group":"","version":"v1","kind":"Pod"},
+	   "resource":{"group":"","version":"v1","resource":"pods"},
+	   "operation":"CREATE",
+	   "namespace": "default",
+	   "userInfo":{"username":"` + username + `","groups":` + string(groupsJSON) + `},
+	   "object":{
+		  "metadata":{
+			 "name":"test-pod",
+			 "namespace":"default",
+			 "creationTimestamp":null
+		  },
+		  "spec":{},
+		  "status":{}
+	   }
+	}
+ }`
+}
+
+func TestParseMatchExpressionPrecedenceAndGrouping(t *testing.T) {
+	expr, err := parseMatchExpression("(groupA OR groupB) AND NOT groupC")
+	require.NoError(t, err)
+	assert.True(t, expr.eval(map[string]bool{"groupA": false, "groupB": true, "groupC": false}))
+	assert.False(t, expr.eval(map[string]bool{"groupA": false, "groupB": true, "groupC": true}))
+}
+
+func TestParseMatchExpressionANDBindsTighterThanOR(t *testing.T) {
+	expr, err := parseMatchExpression("groupA OR groupB AND groupC")
+	require.NoError(t, err)
+	// should parse as "groupA OR (groupB AND groupC)", so groupA alone is enough to match.
+	assert.True(t, expr.eval(map[string]bool{"groupA": true, "groupB": false, "groupC": false}))
+	assert.False(t, expr.eval(map[string]bool{"groupA": false, "groupB": true, "groupC": false}))
+}
+
+func TestParseMatchExpressionRejectsEmptyExpression(t *testing.T) {
+	_, err := parseMatchExpression("")
+	assert.Error(t, err, "an empty match-expression has nothing to evaluate")
+}
+
+func TestParseMatchExpressionRejectsUnbalancedParentheses(t *testing.T) {
+	_, err := parseMatchExpression("(groupA AND groupB")
+	assert.Error(t, err, "the closing ')' is missing")
+}
+
+func TestParseMatchExpressionRejectsTrailingTokens(t *testing.T) {
+	_, err := parseMatchExpression("groupA groupB")
+	assert.Error(t, err, "two bare identifiers with no operator between them is not valid")
+}
+
+func TestMatchExpressionGroupNamesFindsEveryReference(t *testing.T) {
+	expr, err := parseMatchExpression("(groupA OR groupB) AND NOT groupA")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"groupA", "groupB", "groupA"}, matchExpressionGroupNames(expr))
+}
+
+func TestMatchExpressionReferencingUndefinedGroupFailsValidation(t *testing.T) {
+	mylog := log.Logger
+	matchers := Matchers{
+		MatcherGroups: []MatcherGroup{
+			{Name: "groupA", LabelSelectors: []string{"author=david"}},
+		},
+		MatchExpression: "groupA AND groupB",
+	}
+	err := matchers.validate(mylog)
+	assert.EqualError(t, err, "match-expression 'groupA AND groupB' references undefined matcher group 'groupB'")
+}
+
+func TestMatchExpressionWithInvalidSyntaxFailsValidation(t *testing.T) {
+	mylog := log.Logger
+	matchers := Matchers{
+		MatcherGroups: []MatcherGroup{
+			{Name: "groupA", LabelSelectors: []string{"author=david"}},
+		},
+		MatchExpression: "groupA AND",
+	}
+	err := matchers.validate(mylog)
+	assert.Error(t, err, "'groupA AND' is missing its right-hand operand")
+}
+
+func TestMatcherGroupWithInvalidSelectorFailsValidation(t *testing.T) {
+	mylog := log.Logger
+	matchers := Matchers{
+		MatcherGroups: []MatcherGroup{
+			{Name: "groupA", LabelSelectors: []string{"i don't know what you hope this label selector will do?"}},
+		},
+		MatchExpression: "groupA",
+	}
+	err := matchers.validate(mylog)
+	assert.Error(t, err, "an invalid selector inside a matcher group should fail validation just as it would at the top level")
+}
+
+func TestThreeGroupMatchExpressionMatches(t *testing.T) {
+	// groupA matches on a label, groupB matches on a field, groupC does not match - so
+	// "(groupA OR groupB) AND NOT groupC" should match the test object.
+	rule := Rule{
+		Matchers: Matchers{
+			MatcherGroups: []MatcherGroup{
+				{Name: "groupA", LabelSelectors: []string{"author=david"}},
+				{Name: "groupB", FieldSelectors: []string{"metadata.annotations.level=v.special"}},
+				{Name: "groupC", LabelSelectors: []string{"author=nobody"}},
+			},
+			MatchExpression: "(groupA OR groupB) AND NOT groupC",
+		},
+		Payload: Payload{
+			Additions: Additions{
+				Labels: map[string]string{"modified-by-graffiti": "abc123"},
+			},
+		},
+	}
+
+	var review = admission.AdmissionReview{}
+	err := json.Unmarshal([]byte(testReview), &review)
+	assert.NoError(t, err, "couldn't marshall a valid admission review object from test json")
+
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	assert.Equal(t, true, resp.Allowed, "the request should be successful")
+	assert.NotNil(t, resp.Patch, "the match-expression should have matched, so the rule's payload should have been applied")
+}
+
+func TestThreeGroupMatchExpressionDoesNotMatch(t *testing.T) {
+	// groupA and groupB both match, but requiring groupC too means the expression as a whole should not.
+	rule := Rule{
+		Matchers: Matchers{
+			MatcherGroups: []MatcherGroup{
+				{Name: "groupA", LabelSelectors: []string{"author=david"}},
+				{Name: "groupB", FieldSelectors: []string{"metadata.annotations.level=v.special"}},
+				{Name: "groupC", LabelSelectors: []string{"author=nobody"}},
+			},
+			MatchExpression: "(groupA OR groupB) AND groupC",
+		},
+		Payload: Payload{
+			Additions: Additions{
+				Labels: map[string]string{"modified-by-graffiti": "abc123"},
+			},
+		},
+	}
+
+	var review = admission.AdmissionReview{}
+	err := json.Unmarshal([]byte(testReview), &review)
+	assert.NoError(t, err, "couldn't marshall a valid admission review object from test json")
+
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	assert.Equal(t, true, resp.Allowed, "failed rules should not block the source api request")
+	assert.Nil(t, resp.Patch, "groupC did not match, so the AND should fail even though groupA and groupB matched")
+}
+
+func TestMatchExpressionTakesPrecedenceOverTopLevelSelectors(t *testing.T) {
+	// top-level LabelSelectors would match on their own, but MatchExpression is set, so only the
+	// referenced matcher group should be consulted.
+	rule := Rule{
+		Matchers: Matchers{
+			LabelSelectors: []string{"author=david"},
+			MatcherGroups: []MatcherGroup{
+				{Name: "groupA", LabelSelectors: []string{"author=nobody"}},
+			},
+			MatchExpression: "groupA",
+		},
+		Payload: Payload{
+			Additions: Additions{
+				Labels: map[string]string{"modified-by-graffiti": "abc123"},
+			},
+		},
+	}
+
+	var review = admission.AdmissionReview{}
+	err := json.Unmarshal([]byte(testReview), &review)
+	assert.NoError(t, err, "couldn't marshall a valid admission review object from test json")
+
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	assert.Equal(t, true, resp.Allowed, "failed rules should not block the source api request")
+	assert.Nil(t, resp.Patch, "groupA did not match, so the rule should not match even though the top-level LabelSelectors would have")
+}
+
+func TestRequireExplicitMatchAllRejectsAMatcherWithNoSelectors(t *testing.T) {
+	old := RequireExplicitMatchAll
+	RequireExplicitMatchAll = true
+	defer func() { RequireExplicitMatchAll = old }()
+
+	m := Matchers{}
+	err := m.validate(log.Logger)
+	assert.Error(t, err, "a matcher with no selectors should fail validation when RequireExplicitMatchAll is set")
+}
+
+func TestRequireExplicitMatchAllAcceptsAMatcherWithMatchAllSet(t *testing.T) {
+	old := RequireExplicitMatchAll
+	RequireExplicitMatchAll = true
+	defer func() { RequireExplicitMatchAll = old }()
+
+	m := Matchers{MatchAll: true}
+	assert.NoError(t, m.validate(log.Logger))
+}
+
+func TestRequireExplicitMatchAllAcceptsAMatcherWithASelector(t *testing.T) {
+	old := RequireExplicitMatchAll
+	RequireExplicitMatchAll = true
+	defer func() { RequireExplicitMatchAll = old }()
+
+	m := Matchers{LabelSelectors: []string{"author=david"}}
+	assert.NoError(t, m.validate(log.Logger))
+}
+
+func TestMatchesAPIVersionWithNoSelectorsMatchesEverything(t *testing.T) {
+	m := Matchers{}
+	assert.True(t, m.matchesAPIVersion("v1"))
+	assert.True(t, m.matchesAPIVersion("v1beta1"))
+}
+
+func TestMatchesAPIVersionOnlyMatchesConfiguredVersions(t *testing.T) {
+	m := Matchers{APIVersionSelectors: []string{"v1", "v2"}}
+	assert.True(t, m.matchesAPIVersion("v1"))
+	assert.True(t, m.matchesAPIVersion("v2"))
+	assert.False(t, m.matchesAPIVersion("v1beta1"))
+}
+
+func TestMatchesOriginalKindWithNoSelectorsMatchesEverything(t *testing.T) {
+	m := Matchers{}
+	assert.True(t, m.matchesOriginalKind("Widget"))
+	assert.True(t, m.matchesOriginalKind("Deployment"))
+}
+
+func TestMatchesOriginalKindOnlyMatchesConfiguredKinds(t *testing.T) {
+	m := Matchers{OriginalKindSelectors: []string{"Widget", "Gadget"}}
+	assert.True(t, m.matchesOriginalKind("Widget"))
+	assert.False(t, m.matchesOriginalKind("Deployment"))
+}
+
+const testReviewPodWithNginxContainer = `{
+	"kind":"AdmissionReview",
+	"apiVersion":"admission.k8s.io/v1beta1",
+	"request":{
+	   "uid":"69f7d25a-963e-11e8-a77c-08002753edac",
+	   "kind":{"group":"","version":"v1","kind":"Pod"},
+	   "resource":{"group":"","version":"v1","resource":"pods"},
+	   "operation":"CREATE",
+	   "userInfo":{"username":"minikube-user"},
+	   "object":{
+		  "metadata":{"name":"test-pod","namespace":"default","labels":{"author":"david"}},
+		  "spec":{
+			 "containers":[{"name":"nginx","image":"nginx:latest"}]
+		  },
+		  "status":{}
+	   }
+	}
+ }`
+
+func TestHasContainerMatchesAPresentContainer(t *testing.T) {
+	rule := Rule{
+		Matchers: Matchers{HasContainer: "nginx"},
+		Payload: Payload{
+			Additions: Additions{Labels: map[string]string{"modified-by-graffiti": "abc123"}},
+		},
+	}
+
+	var review = admission.AdmissionReview{}
+	err := json.Unmarshal([]byte(testReviewPodWithNginxContainer), &review)
+	require.NoError(t, err, "couldn't marshall a valid admission review object from test json")
+
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	assert.True(t, resp.Allowed, "the request should be successful")
+	assert.NotNil(t, resp.Patch, "has-container should match a Pod with that container")
+}
+
+func TestHasContainerDoesNotMatchAMissingContainer(t *testing.T) {
+	rule := Rule{
+		Matchers: Matchers{HasContainer: "istio-proxy"},
+		Payload: Payload{
+			Additions: Additions{Labels: map[string]string{"modified-by-graffiti": "abc123"}},
+		},
+	}
+
+	var review = admission.AdmissionReview{}
+	err := json.Unmarshal([]byte(testReviewPodWithNginxContainer), &review)
+	require.NoError(t, err, "couldn't marshall a valid admission review object from test json")
+
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	assert.True(t, resp.Allowed, "failed rules should not block the source api request")
+	assert.Nil(t, resp.Patch, "has-container should not match a Pod without that container")
+}
+
+func TestMissingContainerMatchesAnAbsentContainer(t *testing.T) {
+	rule := Rule{
+		Matchers: Matchers{MissingContainer: "istio-proxy"},
+		Payload: Payload{
+			Additions: Additions{Labels: map[string]string{"modified-by-graffiti": "abc123"}},
+		},
+	}
+
+	var review = admission.AdmissionReview{}
+	err := json.Unmarshal([]byte(testReviewPodWithNginxContainer), &review)
+	require.NoError(t, err, "couldn't marshall a valid admission review object from test json")
+
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	assert.True(t, resp.Allowed, "the request should be successful")
+	assert.NotNil(t, resp.Patch, "missing-container should match a Pod that lacks that container")
+}
+
+func TestMissingContainerDoesNotMatchAPresentContainer(t *testing.T) {
+	rule := Rule{
+		Matchers: Matchers{MissingContainer: "nginx"},
+		Payload: Payload{
+			Additions: Additions{Labels: map[string]string{"modified-by-graffiti": "abc123"}},
+		},
+	}
+
+	var review = admission.AdmissionReview{}
+	err := json.Unmarshal([]byte(testReviewPodWithNginxContainer), &review)
+	require.NoError(t, err, "couldn't marshall a valid admission review object from test json")
+
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	assert.True(t, resp.Allowed, "failed rules should not block the source api request")
+	assert.Nil(t, resp.Patch, "missing-container should not match a Pod that has that container")
+}
+
+func TestInvalidHasContainerNameFailsValidation(t *testing.T) {
+	m := Matchers{HasContainer: "Not_Valid"}
+	assert.Error(t, m.validate(log.Logger))
+}
+
+func TestInvalidMissingContainerNameFailsValidation(t *testing.T) {
+	m := Matchers{MissingContainer: "Not_Valid"}
+	assert.Error(t, m.validate(log.Logger))
+}
+
+func TestKeyCountMatchesAnObjectWithEnoughAnnotationsOfThePrefix(t *testing.T) {
+	rule := Rule{
+		Matchers: Matchers{
+			KeyCount: KeyCountSelector{Target: "annotations", Prefix: "prometheus.io/", Operator: ">=", Count: 1},
+		},
+		Payload: Payload{
+			Additions: Additions{Labels: map[string]string{"modified-by-graffiti": "abc123"}},
+		},
+	}
+
+	var review = admission.AdmissionReview{}
+	err := json.Unmarshal([]byte(testReview), &review)
+	require.NoError(t, err, "couldn't marshall a valid admission review object from test json")
+
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	assert.True(t, resp.Allowed, "the request should be successful")
+	assert.NotNil(t, resp.Patch, "key-count should match an object with at least one prometheus.io/ annotation")
+}
+
+func TestKeyCountDoesNotMatchAnObjectWithTooFewAnnotationsOfThePrefix(t *testing.T) {
+	rule := Rule{
+		Matchers: Matchers{
+			KeyCount: KeyCountSelector{Target: "annotations", Prefix: "prometheus.io/", Operator: ">=", Count: 2},
+		},
+		Payload: Payload{
+			Additions: Additions{Labels: map[string]string{"modified-by-graffiti": "abc123"}},
+		},
+	}
+
+	var review = admission.AdmissionReview{}
+	err := json.Unmarshal([]byte(testReview), &review)
+	require.NoError(t, err, "couldn't marshall a valid admission review object from test json")
+
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	assert.True(t, resp.Allowed, "failed rules should not block the source api request")
+	assert.Nil(t, resp.Patch, "key-count should not match an object with fewer prometheus.io/ annotations than required")
+}
+
+func TestInvalidKeyCountTargetFailsValidation(t *testing.T) {
+	m := Matchers{KeyCount: KeyCountSelector{Target: "spec", Prefix: "prometheus.io/", Operator: ">=", Count: 1}}
+	assert.Error(t, m.validate(log.Logger))
+}
+
+func TestInvalidKeyCountOperatorFailsValidation(t *testing.T) {
+	m := Matchers{KeyCount: KeyCountSelector{Target: "annotations", Prefix: "prometheus.io/", Operator: "~=", Count: 1}}
+	assert.Error(t, m.validate(log.Logger))
+}
+
+// testReviewGenerateNamePodCreate is a CREATE admission request for a Pod created via generateName,
+// i.e. the apiserver has not yet assigned it a real name - neither request.name nor the object's own
+// metadata.name are present, exactly as a real apiserver submits them in this case.
+const testReviewGenerateNamePodCreate = `{
+	"kind":"AdmissionReview",
+	"apiVersion":"admission.k8s.io/v1beta1",
+	"request":{
+	   "uid":"69f7d25a-963e-11e8-a77c-08002753edac",
+	   "kind":{"group":"","version":"v1","kind":"Pod"},
+	   "resource":{"group":"","version":"v1","resource":"pods"},
+	   "operation":"CREATE",
+	   "namespace":"default",
+	   "userInfo":{"username":"minikube-user"},
+	   "object":{
+		  "metadata":{"generateName":"my-app-","namespace":"default"},
+		  "spec":{},
+		  "status":{}
+	   }
+	}
+ }`
+
+func TestMatchGenerateNameFallsBackToMatchingTheGenerateNamePrefixViaFieldSelector(t *testing.T) {
+	// "my-app-" is a valid field-selector value but not a valid label value (a label value can't end
+	// in "-"), so the fallback is exercised here via a field-selector against metadata.name.
+	rule := Rule{
+		Name: "add-a-label",
+		Matchers: Matchers{
+			MatchGenerateName: true,
+			FieldSelectors:    []string{"metadata.name=my-app-"},
+		},
+		Payload: Payload{
+			Additions: Additions{Labels: map[string]string{"modified-by-graffiti": "abc123"}},
+		},
+	}
+
+	var review = admission.AdmissionReview{}
+	require.NoError(t, json.Unmarshal([]byte(testReviewGenerateNamePodCreate), &review))
+
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	assert.True(t, resp.Allowed)
+	assert.NotNil(t, resp.Patch, "with match-generate-name set, a selector on the known generateName should match a CREATE that has no name yet")
+}
+
+func TestWithoutMatchGenerateNameANamelessObjectDoesNotMatchOnName(t *testing.T) {
+	rule := Rule{
+		Name: "add-a-label",
+		Matchers: Matchers{
+			FieldSelectors: []string{"metadata.name=my-app-"},
+		},
+		Payload: Payload{
+			Additions: Additions{Labels: map[string]string{"modified-by-graffiti": "abc123"}},
+		},
+	}
+
+	var review = admission.AdmissionReview{}
+	require.NoError(t, json.Unmarshal([]byte(testReviewGenerateNamePodCreate), &review))
+
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	assert.True(t, resp.Allowed)
+	assert.Nil(t, resp.Patch, "without match-generate-name, a field-selector on metadata.name must not match an object that has no name yet")
+}
+
+// testReviewGenerateNamePodCreateWithLabelSafeValue is the same CREATE request as
+// testReviewGenerateNamePodCreate, except the generateName has no trailing "-" so that it is also a
+// valid label-selector value (a label value can't end in "-") - useful for exercising the
+// "generate-name" pseudo-label itself, as distinct from the match-generate-name fallback.
+const testReviewGenerateNamePodCreateWithLabelSafeValue = `{
+	"kind":"AdmissionReview",
+	"apiVersion":"admission.k8s.io/v1beta1",
+	"request":{
+	   "uid":"69f7d25a-963e-11e8-a77c-08002753edac",
+	   "kind":{"group":"","version":"v1","kind":"Pod"},
+	   "resource":{"group":"","version":"v1","resource":"pods"},
+	   "operation":"CREATE",
+	   "namespace":"default",
+	   "userInfo":{"username":"minikube-user"},
+	   "object":{
+		  "metadata":{"generateName":"sample-app","namespace":"default"},
+		  "spec":{},
+		  "status":{}
+	   }
+	}
+ }`
+
+func TestGenerateNamePseudoLabelIsAlwaysAvailable(t *testing.T) {
+	rule := Rule{
+		Name: "add-a-label",
+		Matchers: Matchers{
+			LabelSelectors: []string{"generate-name=sample-app"},
+		},
+		Payload: Payload{
+			Additions: Additions{Labels: map[string]string{"modified-by-graffiti": "abc123"}},
+		},
+	}
+
+	var review = admission.AdmissionReview{}
+	require.NoError(t, json.Unmarshal([]byte(testReviewGenerateNamePodCreateWithLabelSafeValue), &review))
+
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	assert.True(t, resp.Allowed)
+	assert.NotNil(t, resp.Patch, "generate-name should be selectable as its own pseudo-label regardless of match-generate-name")
+}
+
+// testReviewPersistentVolumeClaim is a PVC-like CREATE request whose spec holds single-valued
+// scalar fields directly, the same shape as spec.storageClassName or spec.ingressClassName - no
+// special-casing is needed for MakeFieldMapFromRawObject to reach them, since addFieldRecursive
+// flattens every scalar field at any depth already.
+const testReviewPersistentVolumeClaim = `{
+	"kind":"AdmissionReview",
+	"apiVersion":"admission.k8s.io/v1beta1",
+	"request":{
+	   "uid":"69f7d25a-963e-11e8-a77c-08002753edac",
+	   "kind":{"group":"","version":"v1","kind":"PersistentVolumeClaim"},
+	   "resource":{"group":"","version":"v1","resource":"persistentvolumeclaims"},
+	   "operation":"CREATE",
+	   "namespace":"default",
+	   "userInfo":{"username":"minikube-user"},
+	   "object":{
+		  "metadata":{"name":"test-pvc","namespace":"default"},
+		  "spec":{
+			 "storageClassName":"fast",
+			 "accessModes":["ReadWriteOnce"]
+		  },
+		  "status":{"phase":"Pending"}
+	   }
+	}
+ }`
+
+// TestFieldSelectorMatchesAnExactNonASCIIAnnotationValue confirms that a field selector compares an
+// annotation's CJK value byte-for-byte against the selector's own value, neither side having been
+// normalized or mangled along the way by MakeFieldMapFromRawObject or k8s's fields.ParseSelector/Matches.
+func TestFieldSelectorMatchesAnExactNonASCIIAnnotationValue(t *testing.T) {
+	rule := Rule{
+		Name: "add-a-label",
+		Matchers: Matchers{
+			FieldSelectors: []string{"metadata.annotations.message=日本語"},
+		},
+		Payload: Payload{
+			Additions: Additions{Labels: map[string]string{"modified-by-graffiti": "abc123"}},
+		},
+	}
+
+	var review = admission.AdmissionReview{}
+	require.NoError(t, json.Unmarshal([]byte(testReviewPersistentVolumeClaim), &review))
+	review.Request.Object.Raw = []byte(`{"metadata":{"name":"test-pvc","namespace":"default","annotations":{"message":"日本語"}},"spec":{"storageClassName":"fast"},"status":{}}`)
+
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	assert.True(t, resp.Allowed)
+	assert.NotNil(t, resp.Patch, "the field selector's CJK value should match the annotation's identical CJK value exactly")
+}
+
+func TestFieldSelectorMatchesAWellKnownScalarSpecField(t *testing.T) {
+	rule := Rule{
+		Name: "add-a-label",
+		Matchers: Matchers{
+			FieldSelectors: []string{"spec.storageClassName=fast"},
+		},
+		Payload: Payload{
+			Additions: Additions{Labels: map[string]string{"modified-by-graffiti": "abc123"}},
+		},
+	}
+
+	var review = admission.AdmissionReview{}
+	require.NoError(t, json.Unmarshal([]byte(testReviewPersistentVolumeClaim), &review))
+
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	assert.True(t, resp.Allowed)
+	assert.NotNil(t, resp.Patch, "a single-valued scalar spec field like storageClassName should already be addressable via a field selector, with no special-casing needed")
+}
+
+const testReviewDeployment = `{
+	"kind":"AdmissionReview",
+	"apiVersion":"admission.k8s.io/v1beta1",
+	"request":{
+	   "uid":"69f7d25a-963e-11e8-a77c-08002753edac",
+	   "kind":{"group":"apps","version":"v1","kind":"Deployment"},
+	   "resource":{"group":"apps","version":"v1","resource":"deployments"},
+	   "operation":"CREATE",
+	   "namespace":"default",
+	   "userInfo":{"username":"minikube-user"},
+	   "object":{
+		  "metadata":{"name":"api","namespace":"default"},
+		  "spec":{
+			 "replicas":3,
+			 "template":{
+				"spec":{
+				   "containers":[{"name":"api","image":"nginx"}]
+				}
+			 }
+		  },
+		  "status":{}
+	   }
+	}
+ }`
+
+// TestFieldSelectorMatchesAnArrayElementByItsNumericIndex confirms that MakeFieldMapFromRawObject's
+// index-flattened array entries (e.g. "spec.template.spec.containers.0.image") are reachable by an
+// ordinary field selector, with no special array syntax needed.
+func TestFieldSelectorMatchesAnArrayElementByItsNumericIndex(t *testing.T) {
+	rule := Rule{
+		Name: "add-a-label",
+		Matchers: Matchers{
+			FieldSelectors: []string{"spec.template.spec.containers.0.image=nginx"},
+		},
+		Payload: Payload{
+			Additions: Additions{Labels: map[string]string{"modified-by-graffiti": "abc123"}},
+		},
+	}
+
+	var review = admission.AdmissionReview{}
+	require.NoError(t, json.Unmarshal([]byte(testReviewDeployment), &review))
+
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	assert.True(t, resp.Allowed)
+	assert.NotNil(t, resp.Patch, "a field selector using a numeric array index should match the deployment's first container image")
+}
+
+// TestFieldSelectorDoesNotMatchAWrongArrayIndex confirms that the numeric index in a field selector
+// is significant - a selector for index 1 must not match an array that only has an element at index 0.
+func TestFieldSelectorDoesNotMatchAWrongArrayIndex(t *testing.T) {
+	rule := Rule{
+		Name: "add-a-label",
+		Matchers: Matchers{
+			FieldSelectors: []string{"spec.template.spec.containers.1.image=nginx"},
+		},
+		Payload: Payload{
+			Additions: Additions{Labels: map[string]string{"modified-by-graffiti": "abc123"}},
+		},
+	}
+
+	var review = admission.AdmissionReview{}
+	require.NoError(t, json.Unmarshal([]byte(testReviewDeployment), &review))
+
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	assert.True(t, resp.Allowed)
+	assert.Nil(t, resp.Patch, "the deployment only has a container at index 0, so a selector against index 1 must not match")
+}
+
+const testReviewPodWithHostPathVolume = `{
+	"kind":"AdmissionReview",
+	"apiVersion":"admission.k8s.io/v1beta1",
+	"request":{
+	   "uid":"69f7d25a-963e-11e8-a77c-08002753edac",
+	   "kind":{"group":"","version":"v1","kind":"Pod"},
+	   "resource":{"group":"","version":"v1","resource":"pods"},
+	   "operation":"CREATE",
+	   "userInfo":{"username":"minikube-user"},
+	   "object":{
+		  "metadata":{"name":"test-pod","namespace":"default","labels":{"author":"david"}},
+		  "spec":{
+			 "containers":[{"name":"nginx","image":"nginx:latest"}],
+			 "volumes":[{"name":"host-data","hostPath":{"path":"/data"}}]
+		  },
+		  "status":{}
+	   }
+	}
+}`
+
+func TestHasVolumeTypeMatchesAPodWithThatVolumeType(t *testing.T) {
+	rule := Rule{
+		Matchers: Matchers{HasVolumeType: "hostPath"},
+		Payload: Payload{
+			Additions: Additions{Labels: map[string]string{"has-volume-type": "hostPath"}},
+		},
+	}
+
+	var review = admission.AdmissionReview{}
+	err := json.Unmarshal([]byte(testReviewPodWithHostPathVolume), &review)
+	require.NoError(t, err, "couldn't marshall a valid admission review object from test json")
+
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	assert.True(t, resp.Allowed, "the request should be successful")
+	assert.NotNil(t, resp.Patch, "has-volume-type should match a Pod with a hostPath volume")
+}
+
+func TestHasVolumeTypeDoesNotMatchAPodWithoutThatVolumeType(t *testing.T) {
+	rule := Rule{
+		Matchers: Matchers{HasVolumeType: "hostPath"},
+		Payload: Payload{
+			Additions: Additions{Labels: map[string]string{"has-volume-type": "hostPath"}},
+		},
+	}
+
+	var review = admission.AdmissionReview{}
+	err := json.Unmarshal([]byte(testReviewPodWithNginxContainer), &review)
+	require.NoError(t, err, "couldn't marshall a valid admission review object from test json")
+
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	assert.True(t, resp.Allowed, "failed rules should not block the source api request")
+	assert.Nil(t, resp.Patch, "has-volume-type should not match a Pod without a volumes list")
+}
+
+const testReviewNamespace = `{
+	"kind":"AdmissionReview",
+	"apiVersion":"admission.k8s.io/v1beta1",
+	"request":{
+	   "uid":"69f7d25a-963e-11e8-a77c-08002753edac",
+	   "kind":{"group":"","version":"v1","kind":"Namespace"},
+	   "resource":{"group":"","version":"v1","resource":"namespaces"},
+	   "operation":"CREATE",
+	   "userInfo":{"username":"minikube-user"},
+	   "object":{
+		  "metadata":{"name":"test-namespace"},
+		  "spec":{},
+		  "status":{}
+	   }
+	}
+}`
+
+func TestApplicableToKindRulesOutAPodTemplateFieldSelectorAgainstAKindWithNoTemplate(t *testing.T) {
+	m := Matchers{FieldSelectors: []string{"spec.template.metadata.labels.app=foo"}}
+	assert.False(t, m.applicableToKind("Namespace"))
+	assert.False(t, m.applicableToKind("Pod"))
+}
+
+func TestApplicableToKindAllowsAPodTemplateFieldSelectorAgainstAControllerKind(t *testing.T) {
+	m := Matchers{FieldSelectors: []string{"spec.template.metadata.labels.app=foo"}}
+	assert.True(t, m.applicableToKind("Deployment"))
+}
+
+func TestApplicableToKindAllowsAnythingWithoutAPodTemplateFieldSelector(t *testing.T) {
+	m := Matchers{FieldSelectors: []string{"metadata.labels.app=foo"}}
+	assert.True(t, m.applicableToKind("Namespace"))
+}
+
+// TestPodTemplateFieldSelectorShortCircuitsForANamespaceRequest confirms that a rule whose only
+// field selector is scoped to spec.template.* is skipped by MutateAdmission's kind-applicability
+// check before a Namespace request's object is ever flattened or evaluated.
+func TestPodTemplateFieldSelectorShortCircuitsForANamespaceRequest(t *testing.T) {
+	rule := Rule{
+		Name: "add-a-label",
+		Matchers: Matchers{
+			FieldSelectors: []string{"spec.template.metadata.labels.app=foo"},
+		},
+		Payload: Payload{
+			Additions: Additions{Labels: map[string]string{"modified-by-graffiti": "abc123"}},
+		},
+	}
+
+	var review = admission.AdmissionReview{}
+	require.NoError(t, json.Unmarshal([]byte(testReviewNamespace), &review))
+
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	assert.True(t, resp.Allowed, "failed rules should not block the source api request")
+	assert.Nil(t, resp.Patch, "a pod-template field selector can never match a Namespace, so the rule should be skipped")
+}
+
+// TestPodTemplateFieldSelectorStillEvaluatesForADeployment confirms the same rule is still fully
+// evaluated, and can still match, against a kind that does carry a pod template.
+func TestPodTemplateFieldSelectorStillEvaluatesForADeployment(t *testing.T) {
+	rule := Rule{
+		Name: "add-a-label",
+		Matchers: Matchers{
+			FieldSelectors: []string{"spec.template.spec.containers.0.image=nginx"},
+		},
+		Payload: Payload{
+			Additions: Additions{Labels: map[string]string{"modified-by-graffiti": "abc123"}},
+		},
+	}
+
+	var review = admission.AdmissionReview{}
+	require.NoError(t, json.Unmarshal([]byte(testReviewDeployment), &review))
+
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	assert.True(t, resp.Allowed)
+	assert.NotNil(t, resp.Patch, "the rule's field selector should still be evaluated, and match, against a Deployment")
+}
+
+// TestSelectorCacheParsesALabelSelectorOnlyOnce confirms that asking a selectorCache for the same
+// label selector text repeatedly only ever calls labels.Parse once, caching the result for every
+// later call rather than re-parsing it.
+func TestSelectorCacheParsesALabelSelectorOnlyOnce(t *testing.T) {
+	cache := newSelectorCache()
+
+	for i := 0; i < 5; i++ {
+		_, err := cache.parseLabelSelector("author=david")
+		require.NoError(t, err)
+	}
+
+	assert.Len(t, cache.labels, 1, "the selector should only have been parsed and cached once")
+}
+
+// TestSelectorCacheParsesAFieldSelectorOnlyOnce is the field-selector equivalent of
+// TestSelectorCacheParsesALabelSelectorOnlyOnce.
+func TestSelectorCacheParsesAFieldSelectorOnlyOnce(t *testing.T) {
+	cache := newSelectorCache()
+
+	for i := 0; i < 5; i++ {
+		_, err := cache.parseFieldSelector("metadata.name=my-app")
+		require.NoError(t, err)
+	}
+
+	assert.Len(t, cache.fields, 1, "the selector should only have been parsed and cached once")
+}
+
+// TestSelectorCacheRejectsAnInvalidSelectorWithoutCachingIt confirms that a selector which fails to
+// parse is never cached, and so is retried rather than permanently remembered as broken.
+func TestSelectorCacheRejectsAnInvalidSelectorWithoutCachingIt(t *testing.T) {
+	cache := newSelectorCache()
+
+	_, err := cache.parseLabelSelector("not a valid selector!!!")
+	assert.Error(t, err)
+	assert.Empty(t, cache.labels)
+}
+
+// BenchmarkMatchLabelSelectorsWithACachedSelector exercises the hot path MutateAdmission takes on
+// every matching admission request - matchLabelSelectors, the caller of the cache via
+// MatchLabelSelector - to demonstrate that it no longer re-parses its label selector per call.
+func BenchmarkMatchLabelSelectorsWithACachedSelector(b *testing.B) {
+	m := Matchers{LabelSelectors: []string{"author = david"}}
+	obj := metaObject{Meta: metav1.ObjectMeta{Labels: map[string]string{"author": "david"}}}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := m.matchLabelSelectors(obj); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -15,33 +15,286 @@ package graffiti
 
 import (
 	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"os"
 	"reflect"
+	"regexp"
 	"strings"
 	"text/template"
+	"text/template/parse"
+	"time"
+	"unicode/utf8"
+
+	"github.com/rs/zerolog"
+	utilvalidation "k8s.io/apimachinery/pkg/util/validation"
 )
 
-func createPatchOperand(src, add, fm map[string]string, del []string, path string) (string, error) {
+// runID is generated once per process start, not per template evaluation, so that the "runID"
+// template function is idempotent across repeated Mutate calls within the same run - e.g. when the
+// existing-objects sweep re-paints an object that already matches, or a request is retried.
+var runID = newUUID()
+
+// newUUID returns a random RFC 4122 version-4 UUID. There's no UUID library vendored in this
+// repository, so this generates one directly from crypto/rand rather than adding a dependency.
+func newUUID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(fmt.Sprintf("could not generate a uuid: %v", err))
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// templateFuncs are the functions made available to every addition value template, on top of the
+// builtins and "index" that text/template already provides. now, runID and instance are all stable
+// within a single run, so re-evaluating the same template twice produces an identical value - this is
+// what keeps repeated Mutate calls idempotent.
+var templateFuncs = template.FuncMap{
+	"now":      templateNow,
+	"runID":    func() string { return runID },
+	"instance": templateInstance,
+}
+
+// nonIdempotentTemplateFuncs are only made available to a payload that has explicitly set
+// non-idempotent: true, acknowledging that its rendered values can differ between evaluations of an
+// otherwise-unchanged object. uuid is the motivating example: a fresh value per call defeats no-op
+// patch detection for any caller that re-paints an already-matching object. Without the acknowledgement
+// a template referencing uuid fails to parse with "function \"uuid\" not defined".
+var nonIdempotentTemplateFuncs = template.FuncMap{
+	"uuid": newUUID,
+}
+
+// TemplateTimeout bounds how long a single addition value template is allowed to run before its
+// execution is abandoned, guarding against a pathological template - deeply nested ranges over a huge
+// object, or catastrophic backtracking in a future regex-based function - stalling an admission
+// request until the apiserver itself times out. It may be overridden by configuration.
+var TemplateTimeout = 5 * time.Millisecond
+
+// TemplateMaxOutputBytes bounds how much output a single addition value template may render before
+// its execution is abandoned, guarding against a template that produces an unbounded amount of
+// output. It may be overridden by configuration.
+var TemplateMaxOutputBytes = 4096
+
+// TemplateMaxNodes bounds the number of nodes in an addition value template's parsed syntax tree:
+// validateTemplateComplexity rejects anything above this at configuration load time, rather than
+// discovering how expensive a template is the first time a rule matches. It may be overridden by
+// configuration.
+var TemplateMaxNodes = 200
+
+// errTemplateOutputTooLarge is the sentinel write error used by limitedWriter to abort a template's
+// execution once it has rendered more than TemplateMaxOutputBytes; text/template's Execute returns
+// write errors to its caller unwrapped, so renderStringTemplate can compare against this value directly.
+var errTemplateOutputTooLarge = errors.New("template output exceeds the configured maximum output size")
+
+// limitedWriter is an io.Writer that fails with errTemplateOutputTooLarge once more than limit bytes
+// have been written to it, used to cap a template's rendered output size.
+type limitedWriter struct {
+	buf   bytes.Buffer
+	limit int
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	if w.buf.Len()+len(p) > w.limit {
+		return 0, errTemplateOutputTooLarge
+	}
+	return w.buf.Write(p)
+}
+
+// funcsFor returns the template.FuncMap that should be available to a payload's addition templates:
+// templateFuncs, plus nonIdempotentTemplateFuncs when the payload has acknowledged it is non-idempotent.
+func funcsFor(nonIdempotent bool) template.FuncMap {
+	if !nonIdempotent {
+		return templateFuncs
+	}
+	funcs := make(template.FuncMap, len(templateFuncs)+len(nonIdempotentTemplateFuncs))
+	for name, fn := range templateFuncs {
+		funcs[name] = fn
+	}
+	for name, fn := range nonIdempotentTemplateFuncs {
+		funcs[name] = fn
+	}
+	return funcs
+}
+
+// templateNow renders the current time, in UTC, formatted with layout (a golang reference-time layout,
+// e.g. "2006-01-02"). The same layout is validated at config load time by validateTemplateFunctions so
+// that a bad layout is caught before a rule is ever evaluated.
+func templateNow(layout string) (string, error) {
+	if err := validateTimeLayout(layout); err != nil {
+		return "", fmt.Errorf("now: %v", err)
+	}
+	return time.Now().UTC().Format(layout), nil
+}
+
+// validateTimeLayout checks that layout actually contains golang reference-time tokens (e.g. "2006",
+// "01", "02") rather than being a plain string with none: it formats two different instants and
+// requires different output, then confirms the layout round-trips through Parse. A layout is free to
+// use only some tokens (e.g. a date-only layout), so this deliberately doesn't require every field of
+// the reference time to reappear.
+func validateTimeLayout(layout string) error {
+	a := time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC).Format(layout)
+	b := time.Date(2007, 3, 4, 16, 5, 6, 0, time.UTC).Format(layout)
+	if a == b {
+		return fmt.Errorf("%q is not a valid time layout", layout)
+	}
+	if _, err := time.Parse(layout, a); err != nil {
+		return fmt.Errorf("%q is not a valid time layout: %v", layout, err)
+	}
+	return nil
+}
+
+// templateInstance returns the name of the pod that this instance of kube-graffiti is running as, read
+// from the GRAFFITI_POD_NAME environment variable, which the deployment populates from the downward API.
+func templateInstance() string {
+	return os.Getenv("GRAFFITI_POD_NAME")
+}
+
+// nowCallRegex picks out the layout argument of any now "<layout>" calls within a template string, so
+// that bad layouts can be rejected at config load time rather than the first time a rule matches.
+var nowCallRegex = regexp.MustCompile(`now\s+"([^"]*)"`)
+
+// validateNowCalls checks that every now "<layout>" call in value uses a layout that time.Parse/Format
+// can actually use, returning an error naming the offending layout if not.
+func validateNowCalls(value string) error {
+	for _, match := range nowCallRegex.FindAllStringSubmatch(value, -1) {
+		if _, err := templateNow(match[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolveConditionalAdditions evaluates each conditional addition's Condition field selector against the
+// object's field map and merges the key/value of any that match into a copy of base, leaving base untouched.
+func resolveConditionalAdditions(base map[string]string, conditional []ConditionalAddition, fm map[string]string, mylog zerolog.Logger) (map[string]string, error) {
+	if len(conditional) == 0 {
+		return base, nil
+	}
+
+	result := mergeMaps(base)
+	for _, ca := range conditional {
+		matched, err := matchFieldSelector(ca.Condition, fm)
+		if err != nil {
+			return nil, fmt.Errorf("failed to evaluate conditional addition %q: %v", ca.Key, err)
+		}
+		if !matched {
+			mylog.Debug().Str("key", ca.Key).Str("condition", ca.Condition).Msg("conditional addition's condition did not match, skipping")
+			continue
+		}
+		mylog.Debug().Str("key", ca.Key).Str("condition", ca.Condition).Msg("conditional addition's condition matched")
+		result[ca.Key] = ca.Value
+	}
+	return result, nil
+}
+
+// computeOriginalValueBackups renders add the same way createPatchOperand is about to, and returns the
+// backup annotation entries Additions.BackupOriginalValues records for each key whose rendered value
+// would overwrite a different value already present in src - prefix+key mapped to the value src had
+// before the overwrite. A key already carrying prefix is skipped, so a rule re-run against an object
+// that already carries a backup annotation never backs up the backup itself, and a key whose backup
+// annotation key would be invalid (e.g. too long, or made malformed by a "/" already in the key) is
+// skipped with a logged warning rather than producing a patch the apiserver would reject. prefix empty
+// (BackupOriginalValues not enabled) always returns nil, nil.
+func computeOriginalValueBackups(src, add, fm map[string]string, nonIdempotent bool, ruleName, path, errorPolicy, prefix string, mylog zerolog.Logger) (map[string]string, error) {
+	if prefix == "" || len(add) == 0 {
+		return nil, nil
+	}
+	rendered, err := renderMapValues(add, fm, nonIdempotent, ruleName, path, errorPolicy, mylog)
+	if err != nil {
+		return nil, err
+	}
+
+	var backups map[string]string
+	for k, v := range rendered {
+		if strings.HasPrefix(k, prefix) {
+			continue
+		}
+		old, exists := src[k]
+		if !exists || old == v {
+			continue
+		}
+		backupKey := prefix + strings.Replace(k, "/", "-", -1)
+		if errorList := utilvalidation.IsQualifiedName(backupKey); len(errorList) != 0 {
+			mylog.Warn().Str("key", k).Str("path", path).Msg("backup-original-values: the backup annotation key would be invalid, skipping the backup for this key")
+			continue
+		}
+		if backups == nil {
+			backups = make(map[string]string)
+		}
+		backups[backupKey] = old
+	}
+	return backups, nil
+}
+
+func createPatchOperand(src, add, fm map[string]string, del, setOnce, preserve []string, mylog zerolog.Logger, path string, nonIdempotent bool, ruleName, errorPolicy, duplicateKeyPolicy string, truncateOverlongLabelValues bool) (string, error) {
 	modified := mergeMaps(src)
+	var rendered map[string]string
 
-	// first process any additions into modified map
+	// first process any additions into modified map, skipping any set-once keys that are already present
 	if len(add) > 0 {
-		rendered, err := renderMapValues(add, fm)
+		var err error
+		rendered, err = renderMapValues(add, fm, nonIdempotent, ruleName, path, errorPolicy, mylog)
 		if err != nil {
 			return "", err
 		}
+		if truncateOverlongLabelValues {
+			for k, v := range rendered {
+				truncated := truncateLabelValue(v)
+				if truncated != v {
+					mylog.Debug().Str("key", k).Str("path", path).Msg("templated label value exceeded the 63-character limit, truncated with a hash suffix")
+					rendered[k] = truncated
+				}
+			}
+		}
+		for k := range rendered {
+			if containsString(setOnce, k) {
+				if _, exists := src[k]; exists {
+					mylog.Debug().Str("key", k).Str("path", path).Msg("skipped: set-once and key present")
+					delete(rendered, k)
+				}
+			}
+		}
 		modified = mergeMaps(src, rendered)
 	}
 
-	// then process any deletions into modified map
+	// then process any deletions into modified map. A key that the additions above just rendered and
+	// a deletion both name is a duplicate-key collision, resolved per duplicateKeyPolicy: "error" fails
+	// the rule outright, "skip" leaves the fresh addition in place instead of deleting it, and anything
+	// else (including the default, "") keeps deletion's usual last-applied-wins behavior.
 	if len(del) > 0 {
 		for _, d := range del {
+			if _, addedHere := rendered[d]; addedHere {
+				switch strings.ToLower(duplicateKeyPolicy) {
+				case "error":
+					return "", fmt.Errorf("key %q at %s is both added and deleted by rule %q", d, path, ruleName)
+				case "skip":
+					mylog.Debug().Str("key", d).Str("path", path).Msg("duplicate-key-policy skip: key was also just added, leaving the addition in place instead of deleting it")
+					continue
+				}
+			}
 			if _, ok := modified[d]; ok {
 				delete(modified, d)
 			}
 		}
 	}
 
+	// re-add any preserved key that src carried but the additions/deletions above dropped, using its
+	// original value, before deciding what kind of patch (if any) this leaves us with.
+	for _, key := range preserve {
+		if _, stillPresent := modified[key]; stillPresent {
+			continue
+		}
+		if original, hadIt := src[key]; hadIt {
+			modified[key] = original
+		}
+	}
+
 	// don't produce a patch when there are no changes
 	if reflect.DeepEqual(src, modified) {
 		return "", nil
@@ -58,6 +311,196 @@ func createPatchOperand(src, add, fm map[string]string, del []string, path strin
 	return renderStringMapAsPatch("replace", path, modified), nil
 }
 
+// unmarshalPreservingNumbers decodes data the same way json.Unmarshal would, except that a number
+// decoded into an interface{} (directly, or as a map/slice element) becomes a json.Number rather than
+// a float64 - the same precision-preserving decode MakeFieldMapFromRawObject already uses. Without
+// this, an object round-tripped through map[string]interface{} loses precision on any integer beyond
+// 2^53, which shows up as spurious kubectl diffs or a rejected value on a CRD with int64 fields.
+func unmarshalPreservingNumbers(data []byte, v interface{}) error {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	return d.Decode(v)
+}
+
+// applyMergePatch recursively merges patch onto target following RFC 7396 JSON Merge Patch semantics: a
+// nil value deletes the corresponding key, an object value is merged into the corresponding key
+// (treating a missing or non-object existing value as an empty object), and any other value replaces
+// the corresponding key wholesale. target is mutated and returned, so callers that still need the
+// original should pass deepCopyJSON(original) rather than original itself.
+func applyMergePatch(target map[string]interface{}, patch map[string]interface{}) map[string]interface{} {
+	for k, v := range patch {
+		if v == nil {
+			delete(target, k)
+			continue
+		}
+		patchObj, ok := v.(map[string]interface{})
+		if !ok {
+			target[k] = v
+			continue
+		}
+		targetObj, ok := target[k].(map[string]interface{})
+		if !ok {
+			targetObj = map[string]interface{}{}
+		}
+		target[k] = applyMergePatch(targetObj, patchObj)
+	}
+	return target
+}
+
+// deepCopyJSON recursively copies a value of the kind encoding/json.Unmarshal produces into an
+// interface{} (map[string]interface{}, []interface{}, or a scalar), so that applyMergePatch's mutation
+// of its target doesn't reach back into a document the caller is still holding a reference to.
+func deepCopyJSON(v interface{}) interface{} {
+	switch vv := v.(type) {
+	case map[string]interface{}:
+		cp := make(map[string]interface{}, len(vv))
+		for k, val := range vv {
+			cp[k] = deepCopyJSON(val)
+		}
+		return cp
+	case []interface{}:
+		cp := make([]interface{}, len(vv))
+		for i, val := range vv {
+			cp[i] = deepCopyJSON(val)
+		}
+		return cp
+	default:
+		return vv
+	}
+}
+
+// diffToPatchOperations compares original and merged - merged being the result of applying a JSON
+// Merge Patch to a copy of original - and returns the RFC 6902 JSON Patch operations, rooted at path
+// (the empty string for the document root), needed to turn original into merged. It only recurses into
+// a key that is an object on both sides; any other change, including a change of type, is expressed as
+// a single "replace" of the whole value, and arrays are always compared and replaced wholesale.
+func diffToPatchOperations(original, merged map[string]interface{}, path string) ([]string, error) {
+	var ops []string
+	for k, v := range merged {
+		childPath := path + "/" + escapeJSONPointerToken(k)
+		orig, existed := original[k]
+		if !existed {
+			op, err := renderValueAsPatch("add", childPath, v)
+			if err != nil {
+				return nil, err
+			}
+			ops = append(ops, op)
+			continue
+		}
+		origObj, origIsObj := orig.(map[string]interface{})
+		newObj, newIsObj := v.(map[string]interface{})
+		if origIsObj && newIsObj {
+			childOps, err := diffToPatchOperations(origObj, newObj, childPath)
+			if err != nil {
+				return nil, err
+			}
+			ops = append(ops, childOps...)
+			continue
+		}
+		if !reflect.DeepEqual(orig, v) {
+			op, err := renderValueAsPatch("replace", childPath, v)
+			if err != nil {
+				return nil, err
+			}
+			ops = append(ops, op)
+		}
+	}
+	for k := range original {
+		if _, present := merged[k]; !present {
+			ops = append(ops, fmt.Sprintf(`{ "op": "remove", "path": "%s" }`, path+"/"+escapeJSONPointerToken(k)))
+		}
+	}
+	return ops, nil
+}
+
+// renderValueAsPatch builds a json patch operation string whose value is the JSON encoding of value,
+// which may itself be a nested object, array or scalar.
+func renderValueAsPatch(op, path string, value interface{}) (string, error) {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return "", fmt.Errorf("could not re-encode a desired-state value as json: %v", err)
+	}
+	return fmt.Sprintf(`{ "op": "%s", "path": "%s", "value": %s }`, op, path, encoded), nil
+}
+
+// escapeJSONPointerToken escapes a single path segment per RFC 6901, so that a field name containing
+// "~" or "/" - the JSON Pointer escape character and path separator - can't be mistaken for structure.
+func escapeJSONPointerToken(token string) string {
+	token = strings.Replace(token, "~", "~0", -1)
+	token = strings.Replace(token, "/", "~1", -1)
+	return token
+}
+
+// createFinalizerPatchOperations builds the list of JSON patch operations needed to apply finalizer
+// additions and deletions against path - ordinarily /metadata/finalizers, but see
+// metaObject.existingFinalizers for the one kind where that isn't so. Removals are emitted first,
+// working backwards from the end of the existing list so that earlier indices remain valid, then
+// additions are appended with "add" operations targeting the "-" (end of array) index. When the object
+// has no finalizers yet, a single "add" operation initialises the whole array.
+func createFinalizerPatchOperations(existing, add, del []string, path string) []string {
+	var ops []string
+
+	if len(existing) == 0 {
+		if len(add) == 0 {
+			return ops
+		}
+		return []string{renderStringSliceAsAddPatch(path, dedupeStrings(add))}
+	}
+
+	for i := len(existing) - 1; i >= 0; i-- {
+		if containsString(del, existing[i]) {
+			ops = append(ops, fmt.Sprintf(`{ "op": "remove", "path": "%s/%d" }`, path, i))
+		}
+	}
+
+	present := make(map[string]bool)
+	for _, f := range existing {
+		if !containsString(del, f) {
+			present[f] = true
+		}
+	}
+	for _, f := range add {
+		if present[f] {
+			continue
+		}
+		present[f] = true
+		ops = append(ops, fmt.Sprintf(`{ "op": "add", "path": "%s/-", "value": "%s" }`, path, escapeString(f)))
+	}
+
+	return ops
+}
+
+// renderStringSliceAsAddPatch builds a json patch "add" operation string from a path and a list of values
+func renderStringSliceAsAddPatch(path string, values []string) string {
+	quoted := make([]string, len(values))
+	for i, v := range values {
+		quoted[i] = `"` + escapeString(v) + `"`
+	}
+	return `{ "op": "add", "path": "` + path + `", "value": [` + strings.Join(quoted, ", ") + `] }`
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func dedupeStrings(list []string) []string {
+	var result []string
+	seen := make(map[string]bool)
+	for _, v := range list {
+		if seen[v] {
+			continue
+		}
+		seen[v] = true
+		result = append(result, v)
+	}
+	return result
+}
+
 // renderStringMapAsPatch builds a json patch string from operand, path and a map
 func renderStringMapAsPatch(op, path string, m map[string]string) string {
 	if len(m) == 0 {
@@ -88,31 +531,163 @@ func mergeMaps(sources ...map[string]string) map[string]string {
 	return result
 }
 
-// renderMapValues - treat each map value as a template and render it using the data map as a context
-func renderMapValues(src, data map[string]string) (map[string]string, error) {
+// renderMapValues treats each map value as a template and renders it using the data map as a
+// context. A value whose template execution trips the TemplateTimeout/TemplateMaxOutputBytes safety
+// guard follows errorPolicy, exactly like checkPatchSizeAndRecordMetrics does for an oversized patch:
+// "deny" fails the render so the caller rejects the change, "allow" (the default) drops just that
+// value so the rest of the payload's additions are unaffected. ruleName and path identify the
+// offending rule and patch path in the warning this logs. nonIdempotent controls whether
+// non-idempotent template functions such as uuid are available.
+func renderMapValues(src, data map[string]string, nonIdempotent bool, ruleName, path, errorPolicy string, mylog zerolog.Logger) (map[string]string, error) {
 	result := make(map[string]string)
 	for k, v := range src {
-		if rendered, err := renderStringTemplate(v, data); err != nil {
-			return result, err
-		} else {
+		if templateReferencesMissingName(v, data) {
+			rlog := mylog.With().Str("rule", ruleName).Str("key", path+"/"+k).Logger()
+			if strings.EqualFold(errorPolicy, "deny") {
+				rlog.Error().Msg("template references metadata.name but the object has no name yet, denying the change")
+				return result, fmt.Errorf("template for %q references metadata.name on an object with no name yet", path+"/"+k)
+			}
+			rlog.Warn().Msg("template references metadata.name but the object has no name yet, dropping this value instead of rendering an empty string")
+			continue
+		}
+
+		start := time.Now()
+		rendered, guarded, err := renderStringTemplate(v, data, nonIdempotent)
+		if err == nil {
 			result[k] = rendered
+			continue
+		}
+		if !guarded {
+			return result, err
 		}
+
+		rlog := mylog.With().Str("rule", ruleName).Str("key", path+"/"+k).Dur("elapsed", time.Since(start)).Logger()
+		if strings.EqualFold(errorPolicy, "deny") {
+			rlog.Error().Err(err).Msg("template execution was aborted by a safety guard, denying the change")
+			return result, err
+		}
+		rlog.Error().Err(err).Msg("template execution was aborted by a safety guard, dropping this value")
 	}
 	return result, nil
 }
 
-// renderStringTemplate will treat the input string as a template and render with data as its context
-// useful for allowing dynamically created values.
-func renderStringTemplate(field string, data interface{}) (string, error) {
-	tmpl, err := template.New("field").Parse(field)
+// truncateLabelValue shortens value to fit within utilvalidation.LabelValueMaxLength when it doesn't
+// already, cutting on a rune boundary and replacing the cut portion with a short hash of the full
+// original value so that two values differing only after the cut point don't collide on an identical
+// truncated prefix. The hash is computed over value itself, so truncating the same rendered value
+// twice - e.g. the existing-objects sweep re-painting an object that already matches - always produces
+// the same result, keeping it idempotent like every other template output in this package.
+func truncateLabelValue(value string) string {
+	if len(value) <= utilvalidation.LabelValueMaxLength {
+		return value
+	}
+	sum := sha256.Sum256([]byte(value))
+	suffix := "-" + hex.EncodeToString(sum[:])[:8]
+	return truncateToByteLength(value, utilvalidation.LabelValueMaxLength-len(suffix)) + suffix
+}
+
+// truncateToByteLength trims s to at most limit bytes without splitting a multi-byte rune, which a
+// plain s[:limit] byte slice could do and leave invalid UTF-8 behind.
+func truncateToByteLength(s string, limit int) string {
+	for len(s) > limit {
+		_, size := utf8.DecodeLastRuneInString(s)
+		s = s[:len(s)-size]
+	}
+	return s
+}
+
+// templateReferencesMissingName reports whether tmpl looks like a template indexing "metadata.name"
+// out of fm (the documented `{{ index . "metadata.name" }}` form) while fm itself has no such entry -
+// i.e. the object being painted has no name yet, most commonly a generateName CREATE evaluated before
+// the apiserver has assigned one. Matching on the template's source text, rather than walking its
+// parsed syntax tree, mirrors how validateAdditionsLabels' templateRegex already detects "is this value
+// a template at all", and avoids index - a builtin text/template keeps no record of which lookups missed.
+func templateReferencesMissingName(tmpl string, fm map[string]string) bool {
+	if _, ok := fm["metadata.name"]; ok {
+		return false
+	}
+	return strings.Contains(tmpl, "{{") && strings.Contains(tmpl, `"metadata.name"`)
+}
+
+// renderStringTemplate treats field as a template and renders it with data as its context, useful for
+// allowing dynamically created values. nonIdempotent controls whether non-idempotent template
+// functions such as uuid are available. Execution runs in its own goroutine so that it can be
+// abandoned once TemplateTimeout elapses, and is capped to TemplateMaxOutputBytes of output; guarded
+// reports whether a non-nil err is one of these two safety-guard violations, as opposed to a genuine
+// template parse/execution error, so the caller can apply the rule's error-policy to it specifically.
+// An abandoned execution's goroutine is deliberately left to finish on its own - a pathological
+// template has already proven it can't be trusted to cooperate, so there is nothing safe to cancel it
+// with - but it can never write past limitedWriter's cap, so it cannot grow unbounded in the meantime.
+func renderStringTemplate(field string, data interface{}, nonIdempotent bool) (rendered string, guarded bool, err error) {
+	tmpl, err := template.New("field").Funcs(funcsFor(nonIdempotent)).Parse(field)
 	if err != nil {
-		return "", fmt.Errorf("failed to parse field template: %v", err)
+		return "", false, fmt.Errorf("failed to parse field template: %v", err)
+	}
+
+	w := &limitedWriter{limit: TemplateMaxOutputBytes}
+	done := make(chan error, 1)
+	go func() {
+		done <- tmpl.Execute(w, data)
+	}()
+
+	select {
+	case err := <-done:
+		if err == errTemplateOutputTooLarge {
+			return "", true, fmt.Errorf("template output exceeds the configured maximum of %d bytes", TemplateMaxOutputBytes)
+		}
+		if err != nil {
+			return "", false, fmt.Errorf("error rendering template: %v", err)
+		}
+		return w.buf.String(), false, nil
+	case <-time.After(TemplateTimeout):
+		return "", true, fmt.Errorf("template execution exceeded the %v timeout", TemplateTimeout)
 	}
+}
 
-	var b bytes.Buffer
-	err = tmpl.Execute(&b, data)
+// validateTemplateComplexity rejects a template whose parsed syntax tree has more than
+// TemplateMaxNodes nodes, so that an overly complex template is refused at configuration load time
+// rather than left to run - and be timed out by renderStringTemplate - on every matching object.
+// Some callers pass every value, templated or not; a plain string with no "{{" in it parses as a single
+// text node and so always passes.
+func validateTemplateComplexity(value string, nonIdempotent bool) error {
+	tmpl, err := template.New("field").Funcs(funcsFor(nonIdempotent)).Parse(value)
 	if err != nil {
-		return "", fmt.Errorf("error rendering template: %v", err)
+		return fmt.Errorf("failed to parse field template: %v", err)
+	}
+	if nodes := countTemplateNodes(tmpl); nodes > TemplateMaxNodes {
+		return fmt.Errorf("template is too complex: %d nodes exceeds the configured maximum of %d", nodes, TemplateMaxNodes)
+	}
+	return nil
+}
+
+// countTemplateNodes counts every node in tmpl's parsed syntax tree, recursing into the bodies of
+// control-flow nodes (range/if/with, and their else branches) so that a template which nests several
+// of them is correctly scored as more complex than the sum of their top-level nodes alone.
+func countTemplateNodes(tmpl *template.Template) int {
+	if tmpl.Tree == nil || tmpl.Tree.Root == nil {
+		return 0
+	}
+	return countNodeList(tmpl.Tree.Root)
+}
+
+func countNodeList(list *parse.ListNode) int {
+	if list == nil {
+		return 0
+	}
+	count := 0
+	for _, node := range list.Nodes {
+		count++
+		switch n := node.(type) {
+		case *parse.RangeNode:
+			count += countNodeList(n.List)
+			count += countNodeList(n.ElseList)
+		case *parse.IfNode:
+			count += countNodeList(n.List)
+			count += countNodeList(n.ElseList)
+		case *parse.WithNode:
+			count += countNodeList(n.List)
+			count += countNodeList(n.ElseList)
+		}
 	}
-	return b.String(), nil
+	return count
 }
@@ -0,0 +1,253 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package graffiti
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNowRendersTheCurrentTimeInUTCWithTheGivenLayout(t *testing.T) {
+	const layout = "2006-01-02T15:04:05"
+	rendered, _, err := renderStringTemplate(`{{ now "`+layout+`" }}`, map[string]string{}, false)
+	require.NoError(t, err)
+
+	renderedTime, err := time.Parse(layout, rendered)
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now().UTC(), renderedTime, 2*time.Second)
+}
+
+func TestNowRejectsAnInvalidLayout(t *testing.T) {
+	_, err := templateNow("not a real layout")
+	assert.Error(t, err)
+}
+
+func TestValidateNowCallsAcceptsAGoodLayout(t *testing.T) {
+	err := validateNowCalls(`mutated-at: {{ now "2006-01-02T15:04:05Z07:00" }}`)
+	assert.NoError(t, err)
+}
+
+func TestValidateNowCallsRejectsABadLayout(t *testing.T) {
+	err := validateNowCalls(`mutated-at: {{ now "not a real layout" }}`)
+	assert.Error(t, err)
+}
+
+func TestRunIDIsStableWithinAProcess(t *testing.T) {
+	first, _, err := renderStringTemplate(`{{ runID }}`, map[string]string{}, false)
+	require.NoError(t, err)
+	second, _, err := renderStringTemplate(`{{ runID }}`, map[string]string{}, false)
+	require.NoError(t, err)
+	assert.Equal(t, first, second)
+}
+
+func TestInstanceRendersThePodNameEnvVar(t *testing.T) {
+	orig := os.Getenv("GRAFFITI_POD_NAME")
+	require.NoError(t, os.Setenv("GRAFFITI_POD_NAME", "graffiti-abc123"))
+	defer os.Setenv("GRAFFITI_POD_NAME", orig)
+
+	rendered, _, err := renderStringTemplate(`{{ instance }}`, map[string]string{}, false)
+	require.NoError(t, err)
+	assert.Equal(t, "graffiti-abc123", rendered)
+}
+
+func TestUUIDTemplateFunctionIsNotAvailableWithoutTheNonIdempotentAcknowledgement(t *testing.T) {
+	_, _, err := renderStringTemplate(`{{ uuid }}`, map[string]string{}, false)
+	assert.Error(t, err)
+}
+
+func TestUUIDTemplateFunctionIsAvailableWhenNonIdempotentIsAcknowledged(t *testing.T) {
+	rendered, _, err := renderStringTemplate(`{{ uuid }}`, map[string]string{}, true)
+	require.NoError(t, err)
+	assert.NotEmpty(t, rendered)
+}
+
+func TestUUIDTemplateFunctionProducesADifferentValuePerCallWhenAcknowledged(t *testing.T) {
+	first, _, err := renderStringTemplate(`{{ uuid }}`, map[string]string{}, true)
+	require.NoError(t, err)
+	second, _, err := renderStringTemplate(`{{ uuid }}`, map[string]string{}, true)
+	require.NoError(t, err)
+	assert.NotEqual(t, first, second)
+}
+
+func TestRepeatedPaintsWithNowAndRunIDProduceIdenticalPatchesWithinARun(t *testing.T) {
+	p := Payload{Additions: Additions{Labels: map[string]string{
+		"mutated-at":  `{{ now "2006-01-02" }}`,
+		"mutation-id": `{{ runID }}`,
+	}}}
+
+	first, err := p.paintObject(metaObject{}, map[string]string{}, []byte(`{}`), "stamping-rule", nil, "", log.Logger)
+	require.NoError(t, err)
+	second, err := p.paintObject(metaObject{}, map[string]string{}, []byte(`{}`), "stamping-rule", nil, "", log.Logger)
+	require.NoError(t, err)
+
+	// the json patch's keys aren't rendered in a deterministic order, so compare decoded content
+	// rather than raw bytes.
+	var firstDecoded, secondDecoded interface{}
+	require.NoError(t, json.Unmarshal(first, &firstDecoded))
+	require.NoError(t, json.Unmarshal(second, &secondDecoded))
+	assert.Equal(t, firstDecoded, secondDecoded)
+}
+
+func TestRepeatedPaintsWithUUIDProduceDifferentPatchesWhenNonIdempotentIsAcknowledged(t *testing.T) {
+	p := Payload{NonIdempotent: true, Additions: Additions{Labels: map[string]string{
+		"mutation-id": `{{ uuid }}`,
+	}}}
+
+	first, err := p.paintObject(metaObject{}, map[string]string{}, []byte(`{}`), "non-idempotent-rule", nil, "", log.Logger)
+	require.NoError(t, err)
+	second, err := p.paintObject(metaObject{}, map[string]string{}, []byte(`{}`), "non-idempotent-rule", nil, "", log.Logger)
+	require.NoError(t, err)
+	assert.NotEqual(t, first, second)
+}
+
+func TestRenderStringTemplateAbandonsExecutionThatExceedsTheTimeout(t *testing.T) {
+	oldTimeout := TemplateTimeout
+	TemplateTimeout = time.Millisecond
+	defer func() { TemplateTimeout = oldTimeout }()
+
+	templateFuncs["sleep"] = func() string {
+		time.Sleep(50 * time.Millisecond)
+		return "done"
+	}
+	defer delete(templateFuncs, "sleep")
+
+	_, guarded, err := renderStringTemplate(`{{ sleep }}`, map[string]string{}, false)
+	require.Error(t, err)
+	assert.True(t, guarded)
+	assert.Contains(t, err.Error(), "timeout")
+}
+
+func TestRenderStringTemplateAbandonsExecutionThatExceedsTheMaxOutputSize(t *testing.T) {
+	oldLimit := TemplateMaxOutputBytes
+	TemplateMaxOutputBytes = 10
+	defer func() { TemplateMaxOutputBytes = oldLimit }()
+
+	_, guarded, err := renderStringTemplate(strings.Repeat("x", 100), map[string]string{}, false)
+	require.Error(t, err)
+	assert.True(t, guarded)
+	assert.Contains(t, err.Error(), "exceeds the configured maximum")
+}
+
+func TestRenderMapValuesDropsAGuardedValueAndKeepsOthersWhenErrorPolicyIsAllow(t *testing.T) {
+	oldLimit := TemplateMaxOutputBytes
+	TemplateMaxOutputBytes = 10
+	defer func() { TemplateMaxOutputBytes = oldLimit }()
+
+	rendered, err := renderMapValues(map[string]string{
+		"ok":        "short",
+		"too-large": strings.Repeat("x", 100),
+	}, map[string]string{}, false, "guarded-rule", "/metadata/labels", "allow", log.Logger)
+	require.NoError(t, err)
+	assert.Equal(t, "short", rendered["ok"])
+	_, exists := rendered["too-large"]
+	assert.False(t, exists)
+}
+
+func TestRenderMapValuesFailsWhenErrorPolicyIsDeny(t *testing.T) {
+	oldLimit := TemplateMaxOutputBytes
+	TemplateMaxOutputBytes = 10
+	defer func() { TemplateMaxOutputBytes = oldLimit }()
+
+	_, err := renderMapValues(map[string]string{
+		"too-large": strings.Repeat("x", 100),
+	}, map[string]string{}, false, "guarded-rule", "/metadata/labels", "deny", log.Logger)
+	assert.Error(t, err)
+}
+
+func TestValidateTemplateComplexityAcceptsASimpleTemplate(t *testing.T) {
+	err := validateTemplateComplexity(`{{ now "2006-01-02" }}`, false)
+	assert.NoError(t, err)
+}
+
+func TestValidateTemplateComplexityRejectsATemplateExceedingTheMaxNodes(t *testing.T) {
+	oldMax := TemplateMaxNodes
+	TemplateMaxNodes = 5
+	defer func() { TemplateMaxNodes = oldMax }()
+
+	complex := strings.Repeat(`{{ if true }}x{{ end }}`, 10)
+	err := validateTemplateComplexity(complex, false)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "too complex")
+}
+
+func TestApplyMergePatchMergesNestedObjectsAndReplacesScalars(t *testing.T) {
+	target := map[string]interface{}{
+		"spec": map[string]interface{}{
+			"replicas": float64(1),
+			"template": map[string]interface{}{"keep": "me"},
+		},
+	}
+	patch := map[string]interface{}{
+		"spec": map[string]interface{}{"replicas": float64(3)},
+	}
+
+	result := applyMergePatch(target, patch)
+
+	assert.Equal(t, float64(3), result["spec"].(map[string]interface{})["replicas"])
+	assert.Equal(t, "me", result["spec"].(map[string]interface{})["template"].(map[string]interface{})["keep"])
+}
+
+func TestApplyMergePatchWithANullValueDeletesTheKey(t *testing.T) {
+	target := map[string]interface{}{"keep": "me", "drop": "me"}
+	patch := map[string]interface{}{"drop": nil}
+
+	result := applyMergePatch(target, patch)
+
+	assert.Equal(t, map[string]interface{}{"keep": "me"}, result)
+}
+
+func TestDiffToPatchOperationsDetectsAddsReplacesAndRemoves(t *testing.T) {
+	original := map[string]interface{}{
+		"spec": map[string]interface{}{"replicas": float64(1), "paused": true},
+	}
+	merged := map[string]interface{}{
+		"spec": map[string]interface{}{"replicas": float64(3)},
+	}
+
+	ops, err := diffToPatchOperations(original, merged, "")
+
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{
+		`{ "op": "replace", "path": "/spec/replicas", "value": 3 }`,
+		`{ "op": "remove", "path": "/spec/paused" }`,
+	}, ops)
+}
+
+// TestDiffToPatchOperationsReturnsAnErrorRatherThanPanicking checks that a value which can't be
+// re-encoded as JSON - here a channel, something json.Unmarshal itself could never have produced -
+// surfaces as an error instead of panicking the goroutine handling the admission request.
+func TestDiffToPatchOperationsReturnsAnErrorRatherThanPanicking(t *testing.T) {
+	original := map[string]interface{}{}
+	merged := map[string]interface{}{"bad": make(chan int)}
+
+	_, err := diffToPatchOperations(original, merged, "")
+
+	assert.Error(t, err)
+}
+
+func TestDeepCopyJSONProducesAnIndependentCopy(t *testing.T) {
+	original := map[string]interface{}{"spec": map[string]interface{}{"replicas": float64(1)}}
+
+	copied := deepCopyJSON(original).(map[string]interface{})
+	copied["spec"].(map[string]interface{})["replicas"] = float64(3)
+
+	assert.Equal(t, float64(1), original["spec"].(map[string]interface{})["replicas"])
+}
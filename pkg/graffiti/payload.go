@@ -14,16 +14,27 @@ limitations under the License.
 package graffiti
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/url"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/HotelsDotCom/kube-graffiti/pkg/log"
+	"github.com/HotelsDotCom/kube-graffiti/pkg/metrics"
 	jsonpatch "github.com/cameront/go-jsonpatch"
 	"github.com/rs/zerolog"
+	authv1 "k8s.io/api/authentication/v1"
 	apivalidation "k8s.io/apimachinery/pkg/api/validation"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	utilvalidation "k8s.io/apimachinery/pkg/util/validation"
 	"k8s.io/apimachinery/pkg/util/validation/field"
+	sigsyaml "sigs.k8s.io/yaml"
 )
 
 // Payload contains the actions that we would like to perform when rule matches an object, such as
@@ -33,44 +44,594 @@ type Payload struct {
 	Deletions Deletions `mapstructure:"deletions" yaml:"deletions,omitempty"`
 	Block     bool      `mapstructure:"block" yaml:"block,omitempty"`
 	JSONPatch string    `mapstructure:"json-patch" yaml:"json-patch,omitempty"`
+	// DesiredState is a YAML fragment, rendered as a template and then parsed, describing the fields an
+	// object should end up with, e.g. "spec:\n  replicas: 3". It is turned into a patch by computing an
+	// RFC 7396 JSON Merge Patch of the rendered fragment against the matched object and then expressing
+	// the result as the equivalent JSON Patch operations, the same as every other payload type produces.
+	DesiredState string `mapstructure:"desired-state" yaml:"desired-state,omitempty"`
+	// MaxPatchOperations and MaxPatchBytes guard against a misbehaving rule (e.g. one that templates a
+	// patch operation per element of a large array) generating a patch that is technically valid but
+	// too large to apply safely. A zero value means "use DefaultMaxPatchOperations/DefaultMaxPatchBytes".
+	MaxPatchOperations int `mapstructure:"max-patch-operations" yaml:"max-patch-operations,omitempty"`
+	MaxPatchBytes      int `mapstructure:"max-patch-bytes" yaml:"max-patch-bytes,omitempty"`
+	// ErrorPolicy controls what happens when a computed patch exceeds MaxPatchOperations/MaxPatchBytes:
+	// "allow" (the default) passes the object through unpatched, "deny" fails the admission request or,
+	// for the existing-objects sweep, leaves the object unpatched and logs an error.
+	ErrorPolicy string `mapstructure:"error-policy" yaml:"error-policy,omitempty"`
+	// DuplicateKeyPolicy controls what happens when a key that Additions (after template rendering)
+	// would set for /metadata/labels or /metadata/annotations is also named by the matching Deletions
+	// list: "last-wins" (the default) keeps today's behavior of the deletion winning, since deletions
+	// are always applied after additions; "skip" leaves the fresh addition in place instead of deleting
+	// it; "error" fails the rule outright rather than silently picking a side. It has no effect on a key
+	// that was already on the object before this rule ran - only on one this rule's own Additions just
+	// produced.
+	DuplicateKeyPolicy string `mapstructure:"duplicate-key-policy" yaml:"duplicate-key-policy,omitempty"`
+	// NonIdempotent must be acknowledged before an addition value may use a template function, such as
+	// uuid, whose result differs between evaluations of an otherwise-unchanged object. It is false by
+	// default, which keeps additions idempotent and safe to re-evaluate.
+	NonIdempotent bool `mapstructure:"non-idempotent" yaml:"non-idempotent,omitempty"`
+	// Enforcement selects how a Block payload is enforced. "deny" (the default) rejects the admission
+	// request outright or, for the existing-objects sweep, leaves the object unpatched. "quarantine"
+	// instead allows the object through and stamps QuarantineLabelKey/QuarantineReasonAnnotationKey
+	// onto it, so a separate controller can act on the marked object asynchronously. It only has any
+	// effect when Block is true.
+	Enforcement string `mapstructure:"enforcement" yaml:"enforcement,omitempty"`
+	// QuarantineLabelKey and QuarantineReasonAnnotationKey override the globally configured quarantine
+	// markers (graffiti.QuarantineLabelKey/QuarantineReasonAnnotationKey) for this rule only. A zero
+	// value means "use the global default".
+	QuarantineLabelKey            string `mapstructure:"quarantine-label-key" yaml:"quarantine-label-key,omitempty"`
+	QuarantineReasonAnnotationKey string `mapstructure:"quarantine-reason-annotation-key" yaml:"quarantine-reason-annotation-key,omitempty"`
+	// MetricLabels names flattened object fields (as produced by MakeFieldMapFromRawObject, e.g.
+	// "metadata.namespace") whose values are appended to the rule name when recording this payload's
+	// patch/block metrics, so a dashboard can break a rule's metrics down by e.g. namespace. A field
+	// missing from the matched object contributes an empty value rather than failing the metric. Leave
+	// empty to keep metrics labelled by rule name alone, as before.
+	MetricLabels []string `mapstructure:"metric-labels" yaml:"metric-labels,omitempty"`
+	// SkipControllerOwned opts an admission rule into the same cascading-skip protection the
+	// existing-objects sweep always applies: an object with a controller owner whose Kind is known
+	// (see ControllerOwnedSkipKinds) to immediately revert child mutations is left unpatched. It has no
+	// effect on the existing-objects sweep, which skips these objects unless MutateControllerOwned is set.
+	SkipControllerOwned bool `mapstructure:"skip-controller-owned" yaml:"skip-controller-owned,omitempty"`
+	// MutateControllerOwned overrides the existing-objects sweep's default cascading-skip protection for
+	// rules that genuinely intend to patch controller-owned children directly. It has no effect on
+	// admission, which never skips for this reason unless SkipControllerOwned is also set.
+	MutateControllerOwned bool `mapstructure:"mutate-controller-owned" yaml:"mutate-controller-owned,omitempty"`
+	// TruncateOverlongLabelValues opts a rule into truncating a templated label value that would
+	// otherwise exceed Kubernetes' 63-character label value limit (utilvalidation.LabelValueMaxLength),
+	// rather than letting validate fail the whole rule the first time a long field value gets templated
+	// into a label. Truncation only ever applies to Additions.Labels values that contain a template -
+	// a literal, non-templated value that is already too long still fails validation as before, since
+	// there truncation would just silently hide a config mistake. See truncateLabelValue for how the
+	// cut point and hash suffix are chosen.
+	TruncateOverlongLabelValues bool `mapstructure:"truncate-overlong-label-values" yaml:"truncate-overlong-label-values,omitempty"`
+	// PreserveLabels names label keys that createPatchOperand re-adds, using their original value on the
+	// object, whenever Deletions.Labels or a set-once/additions combination would otherwise have dropped
+	// them from the resulting /metadata/labels patch - including the case where every label is removed
+	// and the path would otherwise be deleted outright. It guards critical labels, e.g.
+	// "app.kubernetes.io/name", against being stripped by a rule whose deletions are broad or templated,
+	// without having to special-case them in every such rule's Deletions. A key named here that the
+	// object never carried in the first place has nothing to preserve and is left alone.
+	PreserveLabels []string `mapstructure:"preserve-labels" yaml:"preserve-labels,omitempty"`
+	// RequiredLabels turns a Block payload into a validating check: an object carrying every key listed
+	// here is allowed through untouched, and only an object missing one or more of them is blocked. It
+	// has no effect unless Block is also true, and an empty list blocks unconditionally, as before.
+	RequiredLabels []string `mapstructure:"require-labels" yaml:"require-labels,omitempty"`
+	// BlockMessage is rendered as a template against the matched object's field map (the same data
+	// Additions label/annotation values template against) and used in place of the default
+	// "blocked by kube-graffiti rule: <name>" message, both as the admission response's rejection reason
+	// and, for enforcement: quarantine, as the quarantine reason annotation's value. It only has any
+	// effect when Block is true. A template that fails to parse or render falls back to the default
+	// message rather than failing the block itself - the request still gets denied either way.
+	BlockMessage string `mapstructure:"block-message" yaml:"block-message,omitempty"`
+	// Clamp replaces the numeric value at a JSON-pointer path, such as a scale subresource's
+	// /spec/replicas, with the nearest of Min/Max when the object's requested value falls outside them,
+	// rather than denying the request the way Block would. See the Clamp type for how Min/Max resolve.
+	Clamp Clamp `mapstructure:"clamp" yaml:"clamp,omitempty"`
+	// Delegate hands the match/patch decision for an object to an external HTTP service instead of
+	// this payload's own additions/deletions/block/clamp/json-patch/desired-state - see the Delegate
+	// type and callDelegate for what graffiti sends and expects back.
+	Delegate Delegate `mapstructure:"delegate" yaml:"delegate,omitempty"`
+	// PatchOrder controls whether processMetadataAdditionsDeletions emits the /metadata/labels or the
+	// /metadata/annotations replace operation first in the combined patch - PatchOrderLabelsFirst (the
+	// default) or PatchOrderAnnotationsFirst. A JSON Patch's operations are still applied in document
+	// order by any conformant apiserver, so this makes no difference to the resulting object; it exists
+	// because some downstream validating webhooks inspect the patch itself and are order-sensitive.
+	PatchOrder string `mapstructure:"patch-order" yaml:"patch-order,omitempty"`
+	// ExplainAnnotation names an annotation key that, when set, is stamped with a short, plain-language
+	// summary of every label/annotation/finalizer addition and deletion this payload makes, e.g. "added
+	// label team=platform; removed annotation legacy" - so a reviewer running `kubectl diff` can see what
+	// kube-graffiti changed without reading the rule's config. It only describes an additions/deletions
+	// payload; the other payload types (block, json-patch, desired-state, clamp) leave it unset. The
+	// explain annotation's own key is always excluded from the summary it describes, so it never ends up
+	// trying to explain itself.
+	ExplainAnnotation string `mapstructure:"explain-annotation" yaml:"explain-annotation,omitempty"`
 }
 
+// PatchOrder values - see Payload.PatchOrder.
+const (
+	PatchOrderLabelsFirst      = "labels-first"
+	PatchOrderAnnotationsFirst = "annotations-first"
+)
+
+// Clamp is a Payload type that keeps a numeric field within [Min, Max] by rewriting it down or up to
+// the nearest bound, rather than rejecting a request outside it the way Block does. Path is a JSON
+// pointer into the admitted object, e.g. "/spec/replicas" - this also works unchanged against a scale
+// subresource's Scale object, whose only meaningful field is spec.replicas at that same path. Min and
+// Max are rendered as templates against the object's own field map before being parsed as integers, so
+// a bound can reference e.g. the object's own quota annotation; a bound left empty, or whose template
+// renders to the empty string because the object doesn't carry the field it references, is treated as
+// not configured and never clamps on that side. At least one of Min or Max must be set.
+type Clamp struct {
+	Path string `mapstructure:"path" yaml:"path,omitempty"`
+	Min  string `mapstructure:"min" yaml:"min,omitempty"`
+	Max  string `mapstructure:"max" yaml:"max,omitempty"`
+}
+
+// Delegate is a Payload type that hands the match/patch decision for an object to an external HTTP
+// service, for integrating with a policy engine (e.g. OPA) that already makes admission decisions for
+// other webhooks in the cluster. graffiti POSTs the raw matched object, as JSON, to URL and expects a
+// DelegateResponse back. Timeout, parsed as a duration (e.g. "2s"), bounds how long to wait for the
+// response; left empty, DefaultDelegateTimeout applies. See callDelegate for the call itself, and
+// Payload.ErrorPolicy for how a failed call is handled.
+type Delegate struct {
+	URL     string `mapstructure:"url" yaml:"url,omitempty"`
+	Timeout string `mapstructure:"timeout" yaml:"timeout,omitempty"`
+}
+
+// DelegateResponse is the JSON body callDelegate expects back from a Delegate.URL call. Block rejects
+// the admission request - or, for the existing-objects sweep, leaves the object unpatched - with
+// Message as the reason, exactly as Payload.Block/BlockMessage would. Otherwise, Patch, if set, is
+// applied as a literal JSON Patch array, exactly as Payload.JSONPatch would be; left empty, the object
+// is left unpatched.
+type DelegateResponse struct {
+	Block   bool   `json:"block"`
+	Message string `json:"message,omitempty"`
+	Patch   string `json:"patch,omitempty"`
+}
+
+// DefaultDelegateTimeout is used by callDelegate when a Delegate doesn't set its own Timeout.
+const DefaultDelegateTimeout = 5 * time.Second
+
+// ActionSummary returns a short, human-readable description of what this payload does, for use in a
+// startup summary of loaded rules - see config.Rule.Summary.
+func (p Payload) ActionSummary() string {
+	switch {
+	case p.Block:
+		if strings.EqualFold(p.Enforcement, "quarantine") {
+			return "quarantine"
+		}
+		return "block"
+	case p.Clamp.Path != "":
+		return fmt.Sprintf("clamp %s", p.Clamp.Path)
+	case p.Delegate.URL != "":
+		return fmt.Sprintf("delegate to %s", p.Delegate.URL)
+	case p.JSONPatch != "":
+		return "json-patch"
+	case p.DesiredState != "":
+		return "desired-state"
+	default:
+		return p.additionsDeletionsSummary()
+	}
+}
+
+// additionsDeletionsSummary describes an additions/deletions payload's keys, e.g.
+// "add labels=[env], delete annotations=[old-key]" - omitting any part that isn't configured.
+func (p Payload) additionsDeletionsSummary() string {
+	var parts []string
+	if len(p.Additions.Labels) > 0 {
+		parts = append(parts, fmt.Sprintf("add labels=%s", sortedKeys(p.Additions.Labels)))
+	}
+	if len(p.Additions.Annotations) > 0 {
+		parts = append(parts, fmt.Sprintf("add annotations=%s", sortedKeys(p.Additions.Annotations)))
+	}
+	if len(p.Additions.Finalizers) > 0 {
+		parts = append(parts, fmt.Sprintf("add finalizers=%s", p.Additions.Finalizers))
+	}
+	if len(p.Deletions.Labels) > 0 {
+		parts = append(parts, fmt.Sprintf("delete labels=%s", p.Deletions.Labels))
+	}
+	if len(p.Deletions.Annotations) > 0 {
+		parts = append(parts, fmt.Sprintf("delete annotations=%s", p.Deletions.Annotations))
+	}
+	if len(p.Deletions.Finalizers) > 0 {
+		parts = append(parts, fmt.Sprintf("delete finalizers=%s", p.Deletions.Finalizers))
+	}
+	if len(parts) == 0 {
+		return "none"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// explainAdditionsDeletions renders the plain-language summary Payload.ExplainAnnotation describes,
+// e.g. "added label team=platform; removed annotation legacy". labelAdditions and annotationAdditions
+// are the already-resolved maps about to be applied - after conditional additions, backups and
+// stamp-created-by have all been folded in, but before createPatchOperand has dropped any set-once
+// keys the object already carries - compared against obj's existing labels/annotations so that an
+// addition which doesn't actually change anything (the object already carries that key/value) isn't
+// described as a change. The explain annotation's own key is always excluded from annotationAdditions
+// before comparing, so the payload never describes its own addition. A set-once key the object already
+// carries is described separately, as "skipped: set-once and key present", rather than as an addition -
+// unless the same key is also explicitly deleted, in which case the deletion takes precedence, matching
+// createPatchOperand's own precedence.
+func (p Payload) explainAdditionsDeletions(obj metaObject, labelAdditions, annotationAdditions map[string]string) string {
+	var parts []string
+	if changed := changedKeyValues(obj.Meta.Labels, omitKeys(labelAdditions, p.Additions.SetOnceLabels)); len(changed) > 0 {
+		parts = append(parts, fmt.Sprintf("added label %s", strings.Join(changed, ", ")))
+	}
+	if len(p.Deletions.Labels) > 0 {
+		parts = append(parts, fmt.Sprintf("removed label %s", strings.Join(p.Deletions.Labels, ", ")))
+	}
+	describableAnnotations := omitKeys(annotationAdditions, p.Additions.SetOnceAnnotations)
+	if p.ExplainAnnotation != "" {
+		describableAnnotations = omitKey(describableAnnotations, p.ExplainAnnotation)
+	}
+	if changed := changedKeyValues(obj.Meta.Annotations, describableAnnotations); len(changed) > 0 {
+		parts = append(parts, fmt.Sprintf("added annotation %s", strings.Join(changed, ", ")))
+	}
+	if len(p.Deletions.Annotations) > 0 {
+		parts = append(parts, fmt.Sprintf("removed annotation %s", strings.Join(p.Deletions.Annotations, ", ")))
+	}
+	if len(p.Additions.Finalizers) > 0 {
+		parts = append(parts, fmt.Sprintf("added finalizer %s", strings.Join(p.Additions.Finalizers, ", ")))
+	}
+	if len(p.Deletions.Finalizers) > 0 {
+		parts = append(parts, fmt.Sprintf("removed finalizer %s", strings.Join(p.Deletions.Finalizers, ", ")))
+	}
+	if skipped := p.setOnceSkippedKeys(obj); len(skipped) > 0 {
+		parts = append(parts, fmt.Sprintf("skipped: set-once and key present %s", strings.Join(skipped, ", ")))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// setOnceSkippedKeys returns, sorted, every set-once label/annotation key obj already carries and that
+// createPatchOperand will therefore skip rather than overwrite - excluding any key this payload also
+// explicitly deletes, since an explicit deletion still removes a set-once key regardless.
+func (p Payload) setOnceSkippedKeys(obj metaObject) []string {
+	var skipped []string
+	for _, k := range p.Additions.SetOnceLabels {
+		if _, ok := obj.Meta.Labels[k]; ok && !containsString(p.Deletions.Labels, k) {
+			skipped = append(skipped, k)
+		}
+	}
+	for _, k := range p.Additions.SetOnceAnnotations {
+		if _, ok := obj.Meta.Annotations[k]; ok && !containsString(p.Deletions.Annotations, k) {
+			skipped = append(skipped, k)
+		}
+	}
+	sort.Strings(skipped)
+	return skipped
+}
+
+// changedKeyValues returns the sorted "key=value" entries of additions whose value differs from - or is
+// absent from - existing, i.e. the entries that would actually change something on the object.
+func changedKeyValues(existing, additions map[string]string) []string {
+	var changed []string
+	for k, v := range additions {
+		if existingValue, ok := existing[k]; ok && existingValue == v {
+			continue
+		}
+		changed = append(changed, fmt.Sprintf("%s=%s", k, v))
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// omitKey returns a copy of m with key removed, leaving m itself untouched.
+func omitKey(m map[string]string, key string) map[string]string {
+	if _, ok := m[key]; !ok {
+		return m
+	}
+	result := make(map[string]string, len(m))
+	for k, v := range m {
+		if k != key {
+			result[k] = v
+		}
+	}
+	return result
+}
+
+// omitKeys returns a copy of m with every key in keys removed, leaving m itself untouched.
+func omitKeys(m map[string]string, keys []string) map[string]string {
+	result := m
+	for _, k := range keys {
+		result = omitKey(result, k)
+	}
+	return result
+}
+
+// sortedKeys returns m's keys in a deterministic order, so ActionSummary's output doesn't vary
+// between runs of the same rule.
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ControllerOwnedSkipKinds maps an owning controller's Kind to the child Kinds it is known to revert
+// mutations on almost immediately, making it pointless (and potentially noisy, if it races the
+// controller) to patch them directly. It may be overridden by configuration.
+var ControllerOwnedSkipKinds = map[string][]string{
+	"ReplicaSet":  {"Pod"},
+	"Deployment":  {"ReplicaSet"},
+	"StatefulSet": {"Pod"},
+	"DaemonSet":   {"Pod"},
+	"Job":         {"Pod"},
+}
+
+// ShouldSkipControllerOwned decides whether an object of kind, owned by ownerReferences, should be left
+// unpatched because a controller is expected to revert the mutation almost immediately. The
+// existing-objects sweep applies this protection by default (existingSweep true), since it has no way to
+// race a controller's own reconciliation; admission only applies it when the rule opts in with
+// SkipControllerOwned, since most admission rules target objects before a controller ever sees them.
+// MutateControllerOwned always wins, letting a rule that genuinely targets controller-owned children
+// disable the protection outright.
+func (p Payload) ShouldSkipControllerOwned(kind string, ownerReferences []metav1.OwnerReference, existingSweep bool) (skip bool, ownerKind string) {
+	if p.MutateControllerOwned || (!existingSweep && !p.SkipControllerOwned) {
+		return false, ""
+	}
+	for _, ref := range ownerReferences {
+		if ref.Controller == nil || !*ref.Controller {
+			continue
+		}
+		if containsString(ControllerOwnedSkipKinds[ref.Kind], kind) {
+			return true, ref.Kind
+		}
+	}
+	return false, ""
+}
+
+// metricLabel returns the label that this payload's metrics should be recorded against: ruleName alone
+// when MetricLabels is empty, or ruleName followed by a "field=value" suffix per configured field
+// otherwise, so dashboards can filter/group by those fields without graffiti needing a real
+// multi-dimensional metrics client.
+func (p Payload) metricLabel(ruleName string, fm map[string]string) string {
+	if len(p.MetricLabels) == 0 {
+		return ruleName
+	}
+	label := ruleName
+	for _, field := range p.MetricLabels {
+		label += fmt.Sprintf(";%s=%s", field, fm[field])
+	}
+	return label
+}
+
+// missingRequiredLabels returns the subset of p.RequiredLabels absent from labels. A key present with
+// an empty value still counts as present - only a missing key means the object never set it at all.
+func (p Payload) missingRequiredLabels(labels map[string]string) []string {
+	var missing []string
+	for _, key := range p.RequiredLabels {
+		if _, ok := labels[key]; !ok {
+			missing = append(missing, key)
+		}
+	}
+	return missing
+}
+
+// renderedBlockMessage renders p.BlockMessage - if set - as a template against fm, the same field map
+// Additions label/annotation values template against, so a block rule can explain exactly what it
+// didn't like about the object. BlockMessage being unset, or failing to parse/render, falls back to
+// the default blockReason(ruleName) message rather than failing the block itself - a broken template
+// must never stop a Block payload from actually blocking.
+func (p Payload) renderedBlockMessage(ruleName string, fm map[string]string, mylog zerolog.Logger) string {
+	if p.BlockMessage == "" {
+		return blockReason(ruleName)
+	}
+	rendered, _, err := renderStringTemplate(p.BlockMessage, fm, p.NonIdempotent)
+	if err != nil {
+		mylog.Warn().Err(err).Str("rule", ruleName).Msg("could not render block-message template, using the default block message instead")
+		return blockReason(ruleName)
+	}
+	return rendered
+}
+
+// quarantineLabelKey returns the label key a quarantine-enforcement block payload stamps onto a
+// matched object, preferring the payload's own QuarantineLabelKey override if set.
+func (p Payload) quarantineLabelKey() string {
+	if p.QuarantineLabelKey != "" {
+		return p.QuarantineLabelKey
+	}
+	return QuarantineLabelKey
+}
+
+// quarantineReasonAnnotationKey returns the annotation key a quarantine-enforcement block payload
+// stamps onto a matched object, preferring the payload's own override if set.
+func (p Payload) quarantineReasonAnnotationKey() string {
+	if p.QuarantineReasonAnnotationKey != "" {
+		return p.QuarantineReasonAnnotationKey
+	}
+	return QuarantineReasonAnnotationKey
+}
+
+// DefaultMaxPatchOperations and DefaultMaxPatchBytes are the global patch-size limits applied to any
+// rule that doesn't set its own MaxPatchOperations/MaxPatchBytes. They may be overridden by configuration.
+var (
+	DefaultMaxPatchOperations = 100
+	DefaultMaxPatchBytes      = 65536
+)
+
 // Additions contains the additional fields that we want to insert into the object
 // This type is directly marshalled from config and so has mapstructure tags
 type Additions struct {
 	Annotations map[string]string `mapstructure:"annotations" yaml:"annotations,omitempty"`
 	Labels      map[string]string `mapstructure:"labels" yaml:"labels,omitempty"`
+	Finalizers  []string          `mapstructure:"finalizers" yaml:"finalizers,omitempty"`
+	// SetOnceLabels/SetOnceAnnotations name keys (which must also appear in Labels/Annotations above) that should
+	// only ever be set once: if the object already has the key, with any value, the addition is skipped for it.
+	SetOnceLabels      []string `mapstructure:"set-once-labels" yaml:"set-once-labels,omitempty"`
+	SetOnceAnnotations []string `mapstructure:"set-once-annotations" yaml:"set-once-annotations,omitempty"`
+	// ConditionalAdditions name labels that are only added when their Condition field selector matches the
+	// object's field map, e.g. add a label only when a particular annotation already has a specific value.
+	ConditionalAdditions []ConditionalAddition `mapstructure:"conditional-additions" yaml:"conditional-additions,omitempty"`
+	// StampCreatedBy, during admission only, adds the CreatedByAnnotationKey annotation with the
+	// submitting user's name, unless the object already carries it. Existing sweeps have no submitting
+	// user to stamp, so this is a no-op there. Combine with Matchers.CreatedByUsers to later target
+	// objects by their original creator.
+	StampCreatedBy bool `mapstructure:"stamp-created-by" yaml:"stamp-created-by,omitempty"`
+	// BackupOriginalValues opts a rule into recording a label or annotation's prior value, under the
+	// OriginalValueAnnotationPrefix-prefixed annotation key, whenever an addition overwrites a key that
+	// the object already carried with a different value. It only ever backs up a value the first time it
+	// is overwritten in a given patch - a key already carrying the backup prefix is never itself backed
+	// up - and a backup whose key would be too long, or otherwise invalid, is skipped with a logged
+	// warning rather than failing the whole payload.
+	BackupOriginalValues bool `mapstructure:"backup-original-values" yaml:"backup-original-values,omitempty"`
+	// SchedulingGates names entries to add to a Pod's spec.schedulingGates, e.g. to hold it unscheduled
+	// until some other controller is ready for it. Like Finalizers, this is a presence-aware array op:
+	// existing gates are left untouched and new ones are appended. It only ever applies to a Pod CREATE
+	// - mutating it afterwards would fight the scheduler - so it is skipped, with a logged reason, for
+	// every other kind or admission operation, including the existing-objects sweep.
+	SchedulingGates []string `mapstructure:"scheduling-gates" yaml:"scheduling-gates,omitempty"`
+	// NodeSelector adds entries to a Pod's spec.nodeSelector, e.g. to hint it towards nodes advertising
+	// some capacity. Like Labels, this is a presence-aware map op: the whole path is created if absent,
+	// or merged into if already present. It is subject to the same Pod-CREATE-only restriction as
+	// SchedulingGates, for the same reason.
+	NodeSelector map[string]string `mapstructure:"node-selector" yaml:"node-selector,omitempty"`
+	// RejectEmptyValues turns an addition label whose value is the empty string, or resolves to it once
+	// templated, into a validation error rather than letting it through - kubernetes itself permits
+	// empty label values, so this is purely a policy to catch templating that produced an empty string
+	// by mistake. It has no effect on annotations, which have no equivalent kubernetes-imposed format
+	// to validate against in the first place.
+	RejectEmptyValues bool `mapstructure:"reject-empty-values" yaml:"reject-empty-values,omitempty"`
+	// RecordAppliedKeys stamps the label/annotation keys this payload added onto the object, under
+	// AppliedKeysAnnotationPrefix, every time it produces a patch. It has no effect on the patch
+	// itself beyond adding those two annotations - it exists so that the existing sweep can later tell
+	// which keys a rule is responsible for and remove exactly those ("unpaint") once the rule stops
+	// matching an object it had previously painted. See pkg/existing's reconciliation of unmatched
+	// objects for the consumer of this.
+	RecordAppliedKeys bool `mapstructure:"record-applied-keys" yaml:"record-applied-keys,omitempty"`
+	// SpecHash stamps SpecHashAnnotationKey with a stable hash of the object's field map at
+	// SpecHash.FieldPaths, every time this payload produces a patch. Pair it with
+	// Matchers.SpecChanged, naming the same field paths, on a rule that should only act again once
+	// one of those fields actually changes since the hash was last stamped - e.g. re-running an
+	// expensive payload only when the spec it depends on has drifted. An unset (empty) FieldPaths
+	// disables it entirely.
+	SpecHash SpecHash `mapstructure:"spec-hash" yaml:"spec-hash,omitempty"`
+}
+
+// SpecHash names the field paths - dotted paths into the object's field map, e.g. "spec.replicas" -
+// that Additions.SpecHash hashes and stamps, and that Matchers.SpecChanged hashes again to compare
+// against what was last stamped.
+type SpecHash struct {
+	FieldPaths []string `mapstructure:"field-paths" yaml:"field-paths,omitempty"`
+}
+
+// ConditionalAddition is a label Key/Value pair which is only added to an object when Condition, a field
+// selector expression, matches the object's field map.
+type ConditionalAddition struct {
+	Key       string `mapstructure:"key" yaml:"key,omitempty"`
+	Value     string `mapstructure:"value" yaml:"value,omitempty"`
+	Condition string `mapstructure:"condition" yaml:"condition,omitempty"`
 }
 
-// Deletions contains the names of labels or annotations which you wish to remove
+// Deletions contains the names of labels, annotations or finalizers which you wish to remove
 type Deletions struct {
 	Annotations []string `mapstructure:"annotations" yaml:"annotations,omitempty"`
 	Labels      []string `mapstructure:"labels" yaml:"labels,omitempty"`
+	Finalizers  []string `mapstructure:"finalizers" yaml:"finalizers,omitempty"`
 }
 
-func (p Payload) paintObject(object metaObject, fm map[string]string, logger zerolog.Logger) (patch []byte, err error) {
+func (p Payload) paintObject(object metaObject, fm map[string]string, rawObject []byte, ruleName string, userInfo *authv1.UserInfo, operation string, logger zerolog.Logger) (patch []byte, err error) {
 	mylog := logger.With().Str("func", "paintObject").Logger()
 
+	// a delegate takes precedence over everything else - it replaces this payload's own decision with
+	// an external service's entirely.
+	if p.Delegate.URL != "" {
+		mylog.Debug().Str("url", p.Delegate.URL).Msg("payload delegates its match/patch decision to an external service")
+		return p.callDelegate(rawObject, ruleName, mylog)
+	}
+
 	// a block takes precedence over JSONPatch, Additions, Deletions...
 	if p.Block {
 		mylog.Debug().Msg("payload contains a block")
-		return []byte("BLOCK"), nil
+		if len(p.RequiredLabels) > 0 {
+			missing := p.missingRequiredLabels(object.Meta.Labels)
+			if len(missing) == 0 {
+				mylog.Debug().Strs("require-labels", p.RequiredLabels).Msg("object carries all of the required labels, allowing it through")
+				return nil, nil
+			}
+			mylog.Debug().Strs("missing", missing).Msg("object is missing one or more required labels, blocking")
+		}
+		if !strings.EqualFold(p.Enforcement, "quarantine") {
+			// a deny never paints, so it is excluded from the patch-size metrics below.
+			metrics.BlocksEnforced.Observe(p.metricLabel(ruleName, fm), 1)
+			if p.BlockMessage == "" {
+				return []byte(blockPatchPrefix), nil
+			}
+			return []byte(blockPatchPrefix + ":" + p.renderedBlockMessage(ruleName, fm, mylog)), nil
+		}
+
+		mylog.Warn().Str("decision", "quarantined").Msg("block is enforced as a quarantine - allowing the object through and marking it instead of denying")
+		patchString, err := p.processQuarantineMarking(object, ruleName, fm, mylog)
+		if err != nil {
+			return nil, fmt.Errorf("could not create quarantine patch: %v", err)
+		}
+		metrics.BlocksQuarantined.Observe(p.metricLabel(ruleName, fm), 1)
+		if patchString == "" {
+			mylog.Info().Msg("quarantine marking resulted in no patch - object is already marked")
+			return nil, nil
+		}
+		return p.checkPatchSizeAndRecordMetrics(ruleName, fm, patchString, mylog)
+	}
+
+	if p.Clamp.Path != "" {
+		mylog.Debug().Msg("payload contains a clamp")
+		patchString, err := p.processClamp(rawObject, fm, ruleName, mylog)
+		if err != nil {
+			return nil, fmt.Errorf("could not create clamp patch: %v", err)
+		}
+		if patchString == "" {
+			mylog.Debug().Msg("clamp resulted in no patch - value is already within bounds, or no bound was configured for it")
+			return nil, nil
+		}
+		return p.checkPatchSizeAndRecordMetrics(ruleName, fm, `[ `+patchString+` ]`, mylog)
 	}
 
 	// if the user provided a patch then just use that...
 	if p.JSONPatch != "" {
 		mylog.Debug().Str("patch", p.JSONPatch).Msg("payload contains user provided patch")
-		return []byte(p.JSONPatch), nil
+		return p.checkPatchSizeAndRecordMetrics(ruleName, fm, p.JSONPatch, mylog)
+	}
+
+	// if the user provided a desired-state fragment then diff it against the object...
+	if p.DesiredState != "" {
+		mylog.Debug().Msg("payload contains a desired-state fragment")
+		patchString, err := p.processDesiredState(rawObject, fm, mylog)
+		if err != nil {
+			return nil, fmt.Errorf("could not create desired-state patch: %v", err)
+		}
+		if patchString == "" {
+			mylog.Info().Msg("desired-state resulted in no patch")
+			return nil, nil
+		}
+		return p.checkPatchSizeAndRecordMetrics(ruleName, fm, `[ `+patchString+` ]`, mylog)
 	}
 
 	// create a patch for additions + deletions
-	var patchString string
+	var patches []string
 	if p.containsAdditions() || p.containsDeletions() {
 		mylog.Debug().Str("patch", p.JSONPatch).Msg("payload contains additions or deletions")
-		patchString, err = p.processMetadataAdditionsDeletions(object, fm)
+		metadataPatch, err := p.processMetadataAdditionsDeletions(object, fm, userInfo, ruleName)
 		if err != nil {
 			return nil, fmt.Errorf("could not create json patch: %v", err)
 		}
+		if metadataPatch != "" {
+			patches = append(patches, metadataPatch)
+		}
+
+		schedulingPatch, err := p.processSchedulingAdditions(object, operation, ruleName, mylog)
+		if err != nil {
+			return nil, fmt.Errorf("could not create json patch: %v", err)
+		}
+		if schedulingPatch != "" {
+			patches = append(patches, schedulingPatch)
+		}
+	}
+
+	patchString := strings.Join(patches, ", ")
+	if patchString != "" {
+		patchString = `[ ` + patchString + ` ]`
 	}
 
 	if patchString == "" {
@@ -79,107 +640,566 @@ func (p Payload) paintObject(object metaObject, fm map[string]string, logger zer
 	}
 
 	mylog.Debug().Str("patch", patchString).Msg("created json patch")
-	return []byte(patchString), nil
+	return p.checkPatchSizeAndRecordMetrics(ruleName, fm, patchString, mylog)
+}
+
+// checkPatchSizeAndRecordMetrics records the operation count and byte size of a computed JSON patch,
+// labelled by the name of the rule that produced it (plus any configured MetricLabels field values), and
+// enforces MaxPatchOperations/MaxPatchBytes. A patch that exceeds either limit follows ErrorPolicy: "deny"
+// fails the paint so the caller can reject the change, "allow" (the default) drops the patch and lets the
+// object through unpatched.
+func (p Payload) checkPatchSizeAndRecordMetrics(ruleName string, fm map[string]string, patchString string, mylog zerolog.Logger) ([]byte, error) {
+	metricLabel := p.metricLabel(ruleName, fm)
+
+	parsed, err := jsonpatch.FromString(patchString)
+	if err != nil {
+		mylog.Warn().Err(err).Msg("could not parse computed patch to check its size or record patch-size metrics")
+		return []byte(patchString), nil
+	}
+
+	operations := len(parsed.Operations)
+	size := len(patchString)
+	metrics.PatchOperations.Observe(metricLabel, int64(operations))
+	metrics.PatchBytes.Observe(metricLabel, int64(size))
+
+	maxOperations := p.MaxPatchOperations
+	if maxOperations == 0 {
+		maxOperations = DefaultMaxPatchOperations
+	}
+	maxBytes := p.MaxPatchBytes
+	if maxBytes == 0 {
+		maxBytes = DefaultMaxPatchBytes
+	}
+
+	if operations <= maxOperations && size <= maxBytes {
+		return []byte(patchString), nil
+	}
+
+	metrics.PatchesRejected.Observe(metricLabel, 1)
+	rlog := mylog.With().Str("rule", ruleName).Int("operations", operations).Int("max-operations", maxOperations).Int("bytes", size).Int("max-bytes", maxBytes).Logger()
+	if strings.EqualFold(p.ErrorPolicy, "deny") {
+		rlog.Error().Msg("computed patch exceeds the configured patch-size limit, denying the change")
+		return nil, fmt.Errorf("computed patch for rule %q has %d operations/%d bytes, which exceeds the configured limit of %d operations/%d bytes", ruleName, operations, size, maxOperations, maxBytes)
+	}
+	rlog.Error().Msg("computed patch exceeds the configured patch-size limit, allowing the object through unpatched")
+	return nil, nil
+}
+
+// CanCoalesce reports whether this payload's patch can be merged into a larger patch alongside
+// other rules' additions/deletions, as the existing-objects sweep's CoalescePatches mode does. A
+// block, a literal json-patch or a desired-state fragment each compute their own patch independently
+// of the additions/deletions machinery, so they can't be safely folded into a combined patch and
+// must always be applied to an object on their own.
+func (p Payload) CanCoalesce() bool {
+	return !p.Block && p.JSONPatch == "" && p.DesiredState == ""
 }
 
 func (p Payload) containsAdditions() bool {
-	if len(p.Additions.Labels) == 0 && len(p.Additions.Annotations) == 0 {
+	if len(p.Additions.Labels) == 0 && len(p.Additions.Annotations) == 0 && len(p.Additions.Finalizers) == 0 && len(p.Additions.ConditionalAdditions) == 0 && !p.Additions.StampCreatedBy && len(p.Additions.SchedulingGates) == 0 && len(p.Additions.NodeSelector) == 0 {
 		return false
 	}
 	return true
 }
 
 func (p Payload) containsDeletions() bool {
-	if len(p.Deletions.Labels) == 0 && len(p.Deletions.Annotations) == 0 {
+	if len(p.Deletions.Labels) == 0 && len(p.Deletions.Annotations) == 0 && len(p.Deletions.Finalizers) == 0 {
 		return false
 	}
 	return true
 }
 
-// processMetadataAdditionsDeletions will generate a JSON patch for replacing an objects labels and/or annotations
-// It is designed to replace the whole path in order to work around a bug in kubernetes that does not correctly
-// unescape ~1 (/) in paths preventing annotation labels with slashes in them.
-func (p Payload) processMetadataAdditionsDeletions(obj metaObject, fm map[string]string) (string, error) {
+// processMetadataAdditionsDeletions generates the JSON patch operations for replacing an object's
+// labels/annotations and for its finalizer additions/deletions, joined by ", " but not wrapped in the
+// enclosing "[ ]" - the caller combines these with any other patch fragments (e.g. scheduling
+// additions) before wrapping the whole thing into one patch document. It is designed to replace the
+// whole labels/annotations path in order to work around a bug in kubernetes that does not correctly
+// unescape ~1 (/) in paths preventing annotation labels with slashes in them. When
+// Additions.BackupOriginalValues is set, any label or annotation addition that overwrites a differing
+// existing value has that prior value folded into the annotation additions, under
+// OriginalValueAnnotationPrefix, before the annotations operand is built - so a label overwrite's
+// backup lands in /metadata/annotations alongside any backup of an overwritten annotation itself.
+func (p Payload) processMetadataAdditionsDeletions(obj metaObject, fm map[string]string, userInfo *authv1.UserInfo, ruleName string) (string, error) {
 	mylog := log.ComponentLogger(componentName, "processMetadataAdditionsDeletions")
 	var patches []string
 
-	op, err := createPatchOperand(obj.Meta.Labels, p.Additions.Labels, fm, p.Deletions.Labels, "/metadata/labels")
+	labelAdditions, err := resolveConditionalAdditions(p.Additions.Labels, p.Additions.ConditionalAdditions, fm, mylog)
 	if err != nil {
 		return "", err
 	}
-	if op != "" {
-		mylog.Debug().Str("operand", op).Msg("created patch operand")
-		patches = append(patches, op)
+
+	labelsOp, err := createPatchOperand(obj.Meta.Labels, labelAdditions, fm, p.Deletions.Labels, p.Additions.SetOnceLabels, p.PreserveLabels, mylog, "/metadata/labels", p.NonIdempotent, ruleName, p.ErrorPolicy, p.DuplicateKeyPolicy, p.TruncateOverlongLabelValues)
+	if err != nil {
+		return "", err
+	}
+
+	backupPrefix := ""
+	if p.Additions.BackupOriginalValues {
+		backupPrefix = OriginalValueAnnotationPrefix
+	}
+	labelBackups, err := computeOriginalValueBackups(obj.Meta.Labels, labelAdditions, fm, p.NonIdempotent, ruleName, "/metadata/labels", p.ErrorPolicy, backupPrefix, mylog)
+	if err != nil {
+		return "", err
+	}
+	annotationBackups, err := computeOriginalValueBackups(obj.Meta.Annotations, p.Additions.Annotations, fm, p.NonIdempotent, ruleName, "/metadata/annotations", p.ErrorPolicy, backupPrefix, mylog)
+	if err != nil {
+		return "", err
 	}
 
-	op, err = createPatchOperand(obj.Meta.Annotations, p.Additions.Annotations, fm, p.Deletions.Annotations, "/metadata/annotations")
+	annotationAdditions := p.stampCreatedBy(obj, mergeMaps(p.Additions.Annotations, labelBackups, annotationBackups), userInfo, mylog)
+	if p.ExplainAnnotation != "" {
+		if explanation := p.explainAdditionsDeletions(obj, labelAdditions, annotationAdditions); explanation != "" {
+			annotationAdditions = mergeMaps(annotationAdditions, map[string]string{p.ExplainAnnotation: explanation})
+		}
+	}
+	if p.Additions.RecordAppliedKeys {
+		annotationAdditions = mergeMaps(annotationAdditions, map[string]string{
+			AppliedLabelKeysAnnotationKey(ruleName):      strings.Join(sortedKeys(labelAdditions), ","),
+			AppliedAnnotationKeysAnnotationKey(ruleName): strings.Join(sortedKeys(annotationAdditions), ","),
+		})
+	}
+	if len(p.Additions.SpecHash.FieldPaths) > 0 {
+		annotationAdditions = mergeMaps(annotationAdditions, map[string]string{
+			SpecHashAnnotationKey(ruleName): computeSpecHash(fm, p.Additions.SpecHash.FieldPaths),
+		})
+	}
+	annotationsOp, err := createPatchOperand(obj.Meta.Annotations, annotationAdditions, fm, p.Deletions.Annotations, p.Additions.SetOnceAnnotations, nil, mylog, "/metadata/annotations", p.NonIdempotent, ruleName, p.ErrorPolicy, p.DuplicateKeyPolicy, false)
 	if err != nil {
 		return "", err
 	}
-	if op != "" {
+
+	for _, op := range p.orderedMetadataOperands(labelsOp, annotationsOp) {
 		mylog.Debug().Str("operand", op).Msg("created patch operand")
 		patches = append(patches, op)
 	}
 
+	existingFinalizers, finalizerPath := obj.existingFinalizers()
+	finalizerOps := createFinalizerPatchOperations(existingFinalizers, p.Additions.Finalizers, p.Deletions.Finalizers, finalizerPath)
+	if len(finalizerOps) > 0 {
+		mylog.Debug().Strs("operands", finalizerOps).Msg("created finalizer patch operands")
+		patches = append(patches, finalizerOps...)
+	}
+
+	if len(patches) == 0 {
+		return "", nil
+	}
+	return strings.Join(patches, ", "), nil
+}
+
+// orderedMetadataOperands returns labelsOp and annotationsOp, whichever of the two are non-empty, in
+// the order PatchOrder configures - labels before annotations by default.
+func (p Payload) orderedMetadataOperands(labelsOp, annotationsOp string) []string {
+	var ops []string
+	if p.PatchOrder == PatchOrderAnnotationsFirst {
+		ops = append(ops, annotationsOp, labelsOp)
+	} else {
+		ops = append(ops, labelsOp, annotationsOp)
+	}
+	result := ops[:0]
+	for _, op := range ops {
+		if op != "" {
+			result = append(result, op)
+		}
+	}
+	return result
+}
+
+// processDesiredState renders DesiredState as a template, parses the rendered text as YAML, and
+// computes the RFC 6902 JSON Patch operations (without the enclosing "[ ]") needed to turn rawObject
+// into the result of applying that parsed fragment to it as an RFC 7396 JSON Merge Patch - i.e. the
+// object ends up with whatever fields the fragment names, left untouched everywhere else. It is named,
+// and shaped, analogously to processMetadataAdditionsDeletions, which performs the same "compute
+// operations, let the caller combine and wrap them" job for additions/deletions.
+func (p Payload) processDesiredState(rawObject []byte, fm map[string]string, mylog zerolog.Logger) (string, error) {
+	if templateReferencesMissingName(p.DesiredState, fm) {
+		if strings.EqualFold(p.ErrorPolicy, "deny") {
+			return "", fmt.Errorf("desired-state template references metadata.name on an object with no name yet")
+		}
+		mylog.Warn().Msg("desired-state template references metadata.name but the object has no name yet, dropping this payload instead of rendering an empty string")
+		return "", nil
+	}
+
+	rendered, guarded, err := renderStringTemplate(p.DesiredState, fm, p.NonIdempotent)
+	if err != nil {
+		if !guarded {
+			return "", fmt.Errorf("could not render desired-state template: %v", err)
+		}
+		if strings.EqualFold(p.ErrorPolicy, "deny") {
+			return "", fmt.Errorf("could not render desired-state template: %v", err)
+		}
+		mylog.Error().Err(err).Msg("desired-state template execution was aborted by a safety guard, dropping this payload")
+		return "", nil
+	}
+
+	var desired map[string]interface{}
+	if err := sigsyaml.Unmarshal([]byte(rendered), &desired, func(d *json.Decoder) *json.Decoder { d.UseNumber(); return d }); err != nil {
+		return "", fmt.Errorf("could not parse rendered desired-state as yaml: %v", err)
+	}
+
+	var current map[string]interface{}
+	if err := unmarshalPreservingNumbers(rawObject, &current); err != nil {
+		return "", fmt.Errorf("could not unmarshal object to compute a desired-state patch: %v", err)
+	}
+
+	merged := applyMergePatch(deepCopyJSON(current).(map[string]interface{}), desired)
+	ops, err := diffToPatchOperations(current, merged, "")
+	if err != nil {
+		return "", fmt.Errorf("could not compute a desired-state patch: %v", err)
+	}
+	if len(ops) == 0 {
+		return "", nil
+	}
+	return strings.Join(ops, ", "), nil
+}
+
+// callDelegate POSTs rawObject to p.Delegate.URL and turns the DelegateResponse it gets back into
+// paintObject's own (patch, error) return shape: a Block response becomes the same blockPatchPrefix
+// sentinel Payload.Block itself returns, and a non-empty Patch is returned as-is, exactly as
+// Payload.JSONPatch would be. A request that fails, times out, or comes back with a bad status or body
+// is handled by handleDelegateFailure rather than returned directly.
+func (p Payload) callDelegate(rawObject []byte, ruleName string, mylog zerolog.Logger) ([]byte, error) {
+	timeout := DefaultDelegateTimeout
+	if p.Delegate.Timeout != "" {
+		parsed, err := time.ParseDuration(p.Delegate.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid delegate timeout %q: %v", p.Delegate.Timeout, err)
+		}
+		timeout = parsed
+	}
+
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Post(p.Delegate.URL, "application/json", bytes.NewReader(rawObject))
+	if err != nil {
+		return p.handleDelegateFailure(ruleName, fmt.Errorf("delegate request to %q failed: %v", p.Delegate.URL, err), mylog)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return p.handleDelegateFailure(ruleName, fmt.Errorf("delegate %q returned status %d", p.Delegate.URL, resp.StatusCode), mylog)
+	}
+
+	var decision DelegateResponse
+	if err := json.NewDecoder(resp.Body).Decode(&decision); err != nil {
+		return p.handleDelegateFailure(ruleName, fmt.Errorf("delegate %q returned an invalid response: %v", p.Delegate.URL, err), mylog)
+	}
+
+	if decision.Block {
+		if decision.Message == "" {
+			return []byte(blockPatchPrefix), nil
+		}
+		return []byte(blockPatchPrefix + ":" + decision.Message), nil
+	}
+	if decision.Patch == "" {
+		return nil, nil
+	}
+	return []byte(decision.Patch), nil
+}
+
+// handleDelegateFailure applies p.ErrorPolicy to a failed delegate call: "deny" fails the rule
+// outright, the same as every other ErrorPolicy check in this package; anything else (the default)
+// allows the object through unpatched, so an unreachable or misbehaving external service doesn't block
+// admission cluster-wide.
+func (p Payload) handleDelegateFailure(ruleName string, err error, mylog zerolog.Logger) ([]byte, error) {
+	if strings.EqualFold(p.ErrorPolicy, "deny") {
+		mylog.Error().Err(err).Str("rule", ruleName).Msg("delegate call failed, denying the change")
+		return nil, err
+	}
+	mylog.Warn().Err(err).Str("rule", ruleName).Msg("delegate call failed, allowing the object through unpatched")
+	return nil, nil
+}
+
+// processClamp builds the single-operation JSON Patch (without the enclosing "[ ]", like
+// processDesiredState) that rewrites the numeric value at p.Clamp.Path back within [Min, Max], or
+// returns "" when the current value is already within bounds or neither bound was configured for it.
+func (p Payload) processClamp(rawObject []byte, fm map[string]string, ruleName string, mylog zerolog.Logger) (string, error) {
+	current, err := numericValueAtClampPath(rawObject, p.Clamp.Path)
+	if err != nil {
+		return "", err
+	}
+
+	clamped := current
+	if p.Clamp.Max != "" {
+		max, ok, err := p.renderClampBound(p.Clamp.Max, fm)
+		if err != nil {
+			return "", fmt.Errorf("could not resolve clamp max: %v", err)
+		}
+		if ok && clamped > max {
+			clamped = max
+		}
+	}
+	if p.Clamp.Min != "" {
+		min, ok, err := p.renderClampBound(p.Clamp.Min, fm)
+		if err != nil {
+			return "", fmt.Errorf("could not resolve clamp min: %v", err)
+		}
+		if ok && clamped < min {
+			clamped = min
+		}
+	}
+	if clamped == current {
+		return "", nil
+	}
+
+	mylog.Warn().Str("rule", ruleName).Str("path", p.Clamp.Path).Int64("requested", current).Int64("clamped", clamped).Msg("clamped a numeric field back within its configured bounds")
+	return fmt.Sprintf(`{"op": "replace", "path": "%s", "value": %d}`, p.Clamp.Path, clamped), nil
+}
+
+// numericValueAtClampPath reads the number at the JSON pointer path within rawObject, e.g.
+// "/spec/replicas" - this works unchanged against a Scale object, whose spec.replicas sits at the same
+// path a whole Deployment's does.
+func numericValueAtClampPath(rawObject []byte, path string) (int64, error) {
+	var generic map[string]interface{}
+	if err := unmarshalPreservingNumbers(rawObject, &generic); err != nil {
+		return 0, fmt.Errorf("could not unmarshal object to read clamp path %q: %v", path, err)
+	}
+
+	var current interface{} = generic
+	for _, segment := range strings.Split(strings.TrimPrefix(path, "/"), "/") {
+		m, ok := current.(map[string]interface{})
+		if !ok {
+			return 0, fmt.Errorf("clamp path %q does not exist on the object", path)
+		}
+		if current, ok = m[segment]; !ok {
+			return 0, fmt.Errorf("clamp path %q does not exist on the object", path)
+		}
+	}
+	value, ok := current.(json.Number)
+	if !ok {
+		return 0, fmt.Errorf("clamp path %q is not a number", path)
+	}
+	result, err := value.Int64()
+	if err != nil {
+		return 0, fmt.Errorf("clamp path %q is not an integer: %v", path, err)
+	}
+	return result, nil
+}
+
+// renderClampBound renders boundTemplate against fm and parses the result as an integer. ok is false -
+// not an error - when the rendered value is empty, which happens when the template references a field
+// (such as a quota annotation) the object doesn't carry; the caller then leaves that bound unapplied
+// rather than clamping to zero.
+func (p Payload) renderClampBound(boundTemplate string, fm map[string]string) (bound int64, ok bool, err error) {
+	rendered, _, err := renderStringTemplate(boundTemplate, fm, p.NonIdempotent)
+	if err != nil {
+		return 0, false, fmt.Errorf("could not render clamp bound %q: %v", boundTemplate, err)
+	}
+	if rendered == "" {
+		return 0, false, nil
+	}
+	bound, err = strconv.ParseInt(rendered, 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("clamp bound %q rendered %q, which is not an integer: %v", boundTemplate, rendered, err)
+	}
+	return bound, true, nil
+}
+
+// processQuarantineMarking builds the JSON patch that marks obj as quarantined by ruleName, instead of
+// denying the admission request that matched it: the quarantine label is set to the rule's name and the
+// quarantine reason annotation is set to the same message enforcement: deny would have rejected the
+// request with. Like processMetadataAdditionsDeletions it replaces the whole labels/annotations path.
+// It is idempotent: re-marking an already-quarantined object produces no patch.
+func (p Payload) processQuarantineMarking(obj metaObject, ruleName string, fm map[string]string, mylog zerolog.Logger) (string, error) {
+	var patches []string
+
+	labelOp, err := createPatchOperand(obj.Meta.Labels, map[string]string{p.quarantineLabelKey(): ruleName}, nil, nil, nil, nil, mylog, "/metadata/labels", false, ruleName, p.ErrorPolicy, "", false)
+	if err != nil {
+		return "", err
+	}
+	if labelOp != "" {
+		patches = append(patches, labelOp)
+	}
+
+	annotationOp, err := createPatchOperand(obj.Meta.Annotations, map[string]string{p.quarantineReasonAnnotationKey(): p.renderedBlockMessage(ruleName, fm, mylog)}, nil, nil, nil, nil, mylog, "/metadata/annotations", false, ruleName, p.ErrorPolicy, "", false)
+	if err != nil {
+		return "", err
+	}
+	if annotationOp != "" {
+		patches = append(patches, annotationOp)
+	}
+
 	if len(patches) == 0 {
 		return "", nil
 	}
 	return `[ ` + strings.Join(patches, ", ") + ` ]`, nil
 }
 
+// stampCreatedBy returns annotations with CreatedByAnnotationKey merged in, set to userInfo's
+// username, when StampCreatedBy is enabled, there is a submitting user to stamp (admission only -
+// userInfo is nil for existing sweeps) and the object doesn't already carry the annotation. It
+// never overwrites an existing value, so an object's recorded creator doesn't change hands on a
+// later admission request, e.g. an update performed by a different user.
+func (p Payload) stampCreatedBy(obj metaObject, annotations map[string]string, userInfo *authv1.UserInfo, mylog zerolog.Logger) map[string]string {
+	if !p.Additions.StampCreatedBy || userInfo == nil {
+		return annotations
+	}
+	if _, exists := obj.Meta.Annotations[CreatedByAnnotationKey]; exists {
+		return annotations
+	}
+	mylog.Debug().Str("annotation", CreatedByAnnotationKey).Str("user", userInfo.Username).Msg("stamping object with its creator")
+	return mergeMaps(annotations, map[string]string{CreatedByAnnotationKey: userInfo.Username})
+}
+
 // Validate can be used by clients of payload to validate that its syntax and contents are correct.
 func (p Payload) validate() error {
 	var payloadTypes = 0
 	var hasJSONPatch bool
+	var hasDesiredState bool
 	var hasAdditionsDeletions bool
+	var hasClamp bool
+	var hasDelegate bool
 
 	if p.Block {
 		payloadTypes++
 	}
+	if p.Clamp.Path != "" {
+		hasClamp = true
+		payloadTypes++
+	}
+	if p.Delegate.URL != "" {
+		hasDelegate = true
+		payloadTypes++
+	}
 	if p.JSONPatch != "" {
 		hasJSONPatch = true
 		payloadTypes++
 	}
-	if len(p.Additions.Labels) != 0 || len(p.Additions.Annotations) != 0 || len(p.Deletions.Labels) != 0 || len(p.Deletions.Annotations) != 0 {
+	if p.DesiredState != "" {
+		hasDesiredState = true
+		payloadTypes++
+	}
+	if len(p.Additions.Labels) != 0 || len(p.Additions.Annotations) != 0 || len(p.Additions.Finalizers) != 0 || len(p.Additions.ConditionalAdditions) != 0 || p.Additions.StampCreatedBy || len(p.Additions.SchedulingGates) != 0 || len(p.Additions.NodeSelector) != 0 || len(p.Deletions.Labels) != 0 || len(p.Deletions.Annotations) != 0 || len(p.Deletions.Finalizers) != 0 {
 		hasAdditionsDeletions = true
 		payloadTypes++
 	}
 	if payloadTypes == 0 {
-		return fmt.Errorf("a rule payload must specify either additions/deletions, a json-patch, or a block")
+		return fmt.Errorf("a rule payload must specify either additions/deletions, a json-patch, a desired-state, a block, a clamp or a delegate")
 	}
 	if payloadTypes > 1 {
-		return fmt.Errorf("a rule payload can only specify additions/deletions, or a json-patch or a block, but not a combination of them")
+		return fmt.Errorf("a rule payload can only specify additions/deletions, or a json-patch, or a desired-state, or a block, or a clamp, or a delegate, but not a combination of them")
 	}
 
+	if p.Block {
+		if err := p.validateEnforcement(); err != nil {
+			return err
+		}
+		if err := validateRequiredLabels(p.RequiredLabels); err != nil {
+			return err
+		}
+		if p.BlockMessage != "" {
+			if err := validateNowCalls(p.BlockMessage); err != nil {
+				return fmt.Errorf("invalid block-message: %v", err)
+			}
+			if err := validateTemplateComplexity(p.BlockMessage, p.NonIdempotent); err != nil {
+				return fmt.Errorf("invalid block-message: %v", err)
+			}
+		}
+	}
+	if hasClamp {
+		return validateClamp(p.Clamp, p.NonIdempotent)
+	}
+	if hasDelegate {
+		return validateDelegate(p.Delegate)
+	}
 	if hasJSONPatch {
 		return validateJSONPatch(p.JSONPatch)
 	}
+	if hasDesiredState {
+		return validateDesiredState(p.DesiredState, p.NonIdempotent)
+	}
 	if hasAdditionsDeletions {
-		return validateAdditionsDeletions(p.Additions, p.Deletions)
+		if err := validateAdditionsDeletions(p.Additions, p.Deletions, p.NonIdempotent); err != nil {
+			return err
+		}
+		if p.ExplainAnnotation != "" {
+			if errorList := utilvalidation.IsQualifiedName(p.ExplainAnnotation); len(errorList) != 0 {
+				return fmt.Errorf("invalid explain-annotation: invalid key \"%s\": %s", p.ExplainAnnotation, strings.Join(errorList, "; "))
+			}
+		}
+		if err := validatePreserveLabels(p.PreserveLabels); err != nil {
+			return err
+		}
+		if err := p.validateDuplicateKeyPolicy(); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
+// validateDuplicateKeyPolicy checks that DuplicateKeyPolicy, if set, names one of the policies
+// createPatchOperand understands.
+func (p Payload) validateDuplicateKeyPolicy() error {
+	switch {
+	case p.DuplicateKeyPolicy == "", strings.EqualFold(p.DuplicateKeyPolicy, "last-wins"), strings.EqualFold(p.DuplicateKeyPolicy, "skip"), strings.EqualFold(p.DuplicateKeyPolicy, "error"):
+		return nil
+	default:
+		return fmt.Errorf("invalid duplicate-key-policy %q: must be \"last-wins\", \"skip\" or \"error\"", p.DuplicateKeyPolicy)
+	}
+}
+
+// validateEnforcement checks that Enforcement, if set, is one of the supported values, and that a
+// quarantine enforcement has a quarantine label/annotation key configured to mark matched objects with
+// - either globally or on the payload itself - so that enforcement: quarantine can never silently no-op.
+func (p Payload) validateEnforcement() error {
+	switch {
+	case p.Enforcement == "" || strings.EqualFold(p.Enforcement, "deny"):
+		return nil
+	case strings.EqualFold(p.Enforcement, "quarantine"):
+		if p.quarantineLabelKey() == "" || p.quarantineReasonAnnotationKey() == "" {
+			return fmt.Errorf("enforcement: quarantine requires quarantine-label-key and quarantine-reason-annotation-key to be configured, either globally or on the rule")
+		}
+		return nil
+	default:
+		return fmt.Errorf("invalid enforcement %q: must be \"deny\" or \"quarantine\"", p.Enforcement)
+	}
+}
+
 // validateJSONPatch uses the jsonpatch go package to parse the user supplied patch
-// and return an error if the patch syntax is invalid.
+// and return an error if the patch syntax is invalid. A patch that touches spec.nodeName is also
+// rejected outright: every registration watches both CREATE and UPDATE, and mutating a Pod's
+// nodeName once it has already been scheduled breaks the scheduler.
 func validateJSONPatch(p string) error {
 	fmt.Printf("validating json patch: %s\n", p)
 	if _, err := jsonpatch.FromString(p); err != nil {
 		return fmt.Errorf("invalid json-patch: %v", err)
 	}
+	if patchTouchesNodeName(p) {
+		return fmt.Errorf("invalid json-patch: a patch may never target /spec/nodeName - mutating it after a Pod has been scheduled breaks the scheduler")
+	}
+	return nil
+}
+
+// validateDesiredState checks that value parses as YAML into a single JSON object - the only shape
+// applyMergePatch knows how to merge onto an object - and, like validateAdditionsLabels, validates any
+// template functions embedded in it before a rule is ever evaluated.
+func validateDesiredState(value string, nonIdempotent bool) error {
+	var parsed map[string]interface{}
+	if err := sigsyaml.Unmarshal([]byte(value), &parsed); err != nil {
+		return fmt.Errorf("invalid desired-state: not valid yaml: %v", err)
+	}
+	if len(parsed) == 0 {
+		return fmt.Errorf("invalid desired-state: must not be empty")
+	}
+
+	if regexp.MustCompile(`\{\{.*\}\}`).MatchString(value) {
+		if err := validateNowCalls(value); err != nil {
+			return fmt.Errorf("invalid desired-state: %v", err)
+		}
+		if err := validateTemplateComplexity(value, nonIdempotent); err != nil {
+			return fmt.Errorf("invalid desired-state: %v", err)
+		}
+	}
 	return nil
 }
 
 // validateAdditionsDeletions validates all additions and deletions fields are valid if they are specified.
-func validateAdditionsDeletions(add Additions, del Deletions) (err error) {
+func validateAdditionsDeletions(add Additions, del Deletions, nonIdempotent bool) (err error) {
 	if len(add.Labels) > 0 {
-		if err = validateAdditionsLabels(add.Labels); err != nil {
+		if err = validateAdditionsLabels(add.Labels, nonIdempotent, add.RejectEmptyValues); err != nil {
 			return err
 		}
 	}
 	if len(add.Annotations) > 0 {
-		if err = validateAdditionsAnnotations(add.Annotations); err != nil {
+		if err = validateAdditionsAnnotations(add.Annotations, nonIdempotent); err != nil {
 			return err
 		}
 	}
@@ -193,11 +1213,83 @@ func validateAdditionsDeletions(add Additions, del Deletions) (err error) {
 			return err
 		}
 	}
+	if len(add.SetOnceLabels) > 0 {
+		if err = validateSetOnceKeys(add.SetOnceLabels, add.Labels); err != nil {
+			return err
+		}
+	}
+	if len(add.SetOnceAnnotations) > 0 {
+		if err = validateSetOnceKeys(add.SetOnceAnnotations, add.Annotations); err != nil {
+			return err
+		}
+	}
+	if len(add.Finalizers) > 0 {
+		if err = validateFinalizerNames(add.Finalizers); err != nil {
+			return err
+		}
+	}
+	if len(del.Finalizers) > 0 {
+		if err = validateFinalizerNames(del.Finalizers); err != nil {
+			return err
+		}
+	}
+	if len(add.ConditionalAdditions) > 0 {
+		if err = validateConditionalAdditions(add.ConditionalAdditions, nonIdempotent, add.RejectEmptyValues); err != nil {
+			return err
+		}
+	}
+	if len(add.SchedulingGates) > 0 {
+		if err = validateSchedulingGateNames(add.SchedulingGates); err != nil {
+			return err
+		}
+	}
+	if len(add.NodeSelector) > 0 {
+		if err = validateNodeSelectorAdditions(add.NodeSelector); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateConditionalAdditions checks that each conditional addition has a valid label key/value and a
+// condition that parses as a field selector. Conditional addition values are rendered as templates just
+// like ordinary label additions, so nonIdempotent is threaded through in the same way.
+func validateConditionalAdditions(conditional []ConditionalAddition, nonIdempotent, rejectEmptyValues bool) error {
+	for _, ca := range conditional {
+		if err := validateAdditionsLabels(map[string]string{ca.Key: ca.Value}, nonIdempotent, rejectEmptyValues); err != nil {
+			return fmt.Errorf("invalid conditional addition: %v", err)
+		}
+		if err := validateFieldSelector(ca.Condition); err != nil {
+			return fmt.Errorf("invalid conditional addition: invalid condition %q: %v", ca.Condition, err)
+		}
+	}
+	return nil
+}
+
+// validateSetOnceKeys checks that every key named as set-once also appears in the corresponding additions map.
+func validateSetOnceKeys(setOnce []string, additions map[string]string) error {
+	for _, k := range setOnce {
+		if _, ok := additions[k]; !ok {
+			return fmt.Errorf("invalid set-once: key \"%s\" is not present in additions", k)
+		}
+	}
+	return nil
+}
+
+// validateFinalizerNames checks that finalizers are valid domain-qualified names
+func validateFinalizerNames(finalizers []string) error {
+	for _, f := range finalizers {
+		if errorList := utilvalidation.IsQualifiedName(f); len(errorList) != 0 {
+			return fmt.Errorf("invalid finalizer name \"%s\": %s", f, strings.Join(errorList, "; "))
+		}
+	}
 	return nil
 }
 
-// validateAdditionsLabels knows how validate kubernetes labels
-func validateAdditionsLabels(labels map[string]string) error {
+// validateAdditionsLabels knows how validate kubernetes labels. rejectEmptyValues additionally rejects
+// a label whose value is the empty string, which kubernetes itself otherwise permits - see
+// Additions.RejectEmptyValues.
+func validateAdditionsLabels(labels map[string]string, nonIdempotent, rejectEmptyValues bool) error {
 	// validate all additions labels using kubernetes validation methods
 	templateRegex := regexp.MustCompile(`\{\{.*\}\}`)
 	for k, v := range labels {
@@ -205,18 +1297,27 @@ func validateAdditionsLabels(labels map[string]string) error {
 			return fmt.Errorf("invalid additions: invalid label key \"%s\": %s", k, strings.Join(errorList, "; "))
 		}
 		if templateRegex.MatchString(v) {
+			if err := validateNowCalls(v); err != nil {
+				return fmt.Errorf("invalid additions: invalid label value \"%s\": %v", v, err)
+			}
+			if err := validateTemplateComplexity(v, nonIdempotent); err != nil {
+				return fmt.Errorf("invalid additions: invalid label value \"%s\": %v", v, err)
+			}
 			continue
 		} else {
 			if errorList := utilvalidation.IsValidLabelValue(v); len(errorList) != 0 {
 				return fmt.Errorf("invalid additions: invalid label value \"%s\": %s", v, strings.Join(errorList, "; "))
 			}
+			if rejectEmptyValues && v == "" {
+				return fmt.Errorf("invalid additions: label \"%s\" has an empty value, which reject-empty-values does not allow", k)
+			}
 		}
 	}
 	return nil
 }
 
 // validateAdditionsAnnotations knows how validate kubernetes annotations
-func validateAdditionsAnnotations(annotations map[string]string) error {
+func validateAdditionsAnnotations(annotations map[string]string, nonIdempotent bool) error {
 	// validate all additions annotations by using kubernetes validation methods
 	path := field.NewPath("metadata.annotations")
 	if errorList := apivalidation.ValidateAnnotations(annotations, path); len(errorList) != 0 {
@@ -226,6 +1327,80 @@ func validateAdditionsAnnotations(annotations map[string]string) error {
 		}
 		return fmt.Errorf("invalid additions: invalid annotations: %s", strings.Join(info, "; "))
 	}
+	for k, v := range annotations {
+		if err := validateNowCalls(v); err != nil {
+			return fmt.Errorf("invalid additions: invalid annotation value for \"%s\": %v", k, err)
+		}
+		if err := validateTemplateComplexity(v, nonIdempotent); err != nil {
+			return fmt.Errorf("invalid additions: invalid annotation value for \"%s\": %v", k, err)
+		}
+	}
+	return nil
+}
+
+// validateRequiredLabels checks that each require-labels entry is a valid label key, the same rule
+// applied to every other label key this package handles.
+func validateRequiredLabels(labels []string) error {
+	for _, v := range labels {
+		if errorList := utilvalidation.IsQualifiedName(v); len(errorList) != 0 {
+			return fmt.Errorf("invalid require-labels: invalid key \"%s\": %s", v, strings.Join(errorList, "; "))
+		}
+	}
+	return nil
+}
+
+// validatePreserveLabels checks that each preserve-labels entry is a valid label key, the same rule
+// applied to every other label key this package handles.
+func validatePreserveLabels(labels []string) error {
+	for _, v := range labels {
+		if errorList := utilvalidation.IsQualifiedName(v); len(errorList) != 0 {
+			return fmt.Errorf("invalid preserve-labels: invalid key \"%s\": %s", v, strings.Join(errorList, "; "))
+		}
+	}
+	return nil
+}
+
+// clampPathRegex matches a JSON pointer made up of one or more non-empty "/segment" parts, e.g.
+// "/spec/replicas" - the same shape processClamp expects to find a number at.
+var clampPathRegex = regexp.MustCompile(`^(/[^/]+)+$`)
+
+// validateClamp checks that a clamp payload has a well-formed path, at least one of min/max
+// configured, and that any templated bound is itself well-formed - the same checks applied to
+// other templated fields such as block-message.
+func validateClamp(c Clamp, nonIdempotent bool) error {
+	if !clampPathRegex.MatchString(c.Path) {
+		return fmt.Errorf("invalid clamp: path %q must be a json pointer, e.g. \"/spec/replicas\"", c.Path)
+	}
+	if c.Min == "" && c.Max == "" {
+		return fmt.Errorf("invalid clamp: at least one of min or max must be set")
+	}
+	for name, bound := range map[string]string{"min": c.Min, "max": c.Max} {
+		if bound == "" {
+			continue
+		}
+		if err := validateNowCalls(bound); err != nil {
+			return fmt.Errorf("invalid clamp %s: %v", name, err)
+		}
+		if err := validateTemplateComplexity(bound, nonIdempotent); err != nil {
+			return fmt.Errorf("invalid clamp %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// validateDelegate checks that a delegate payload's url is a well-formed absolute http(s) URL and
+// that its timeout, if set, parses as a duration - the same two things callDelegate itself needs to
+// have already gone right by the time a rule runs for real.
+func validateDelegate(d Delegate) error {
+	parsed, err := url.ParseRequestURI(d.URL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+		return fmt.Errorf("invalid delegate: url %q must be an absolute http or https URL", d.URL)
+	}
+	if d.Timeout != "" {
+		if _, err := time.ParseDuration(d.Timeout); err != nil {
+			return fmt.Errorf("invalid delegate: timeout %q: %v", d.Timeout, err)
+		}
+	}
 	return nil
 }
 
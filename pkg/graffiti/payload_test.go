@@ -14,16 +14,25 @@ limitations under the License.
 package graffiti
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/HotelsDotCom/kube-graffiti/pkg/metrics"
 	jsonpatch "github.com/cameront/go-jsonpatch"
 	"github.com/davecgh/go-spew/spew"
+	"github.com/rs/zerolog/log"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	yaml "gopkg.in/yaml.v2"
 	admission "k8s.io/api/admission/v1beta1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilvalidation "k8s.io/apimachinery/pkg/util/validation"
 )
 
 func TestValidAdditionalLabel(t *testing.T) {
@@ -130,6 +139,32 @@ additions:
 	assert.EqualError(t, err, "invalid additions: invalid label value \"label values can't contain spaces\": a valid label must be an empty string or consist of alphanumeric characters, '-', '_' or '.', and must start and end with an alphanumeric character (e.g. 'MyValue',  or 'my_value',  or '12345', regex used for validation is '(([A-Za-z0-9][-A-Za-z0-9_.]*)?[A-Za-z0-9])?')")
 }
 
+func TestEmptyAdditionalLabelValueIsAllowedByDefault(t *testing.T) {
+	var source = `---
+additions:
+  labels:
+    add-me: ""
+`
+	var payload Payload
+	err := yaml.Unmarshal([]byte(source), &payload)
+	require.NoError(t, err, "the test payload should unmarshal")
+	assert.NoError(t, payload.validate(), "kubernetes itself permits an empty label value, so it should pass validation by default")
+}
+
+func TestEmptyAdditionalLabelValueFailsValidationWhenRejectEmptyValuesIsSet(t *testing.T) {
+	var source = `---
+additions:
+  reject-empty-values: true
+  labels:
+    add-me: ""
+`
+	var payload Payload
+	err := yaml.Unmarshal([]byte(source), &payload)
+	require.NoError(t, err, "the test payload should unmarshal")
+	err = payload.validate()
+	assert.EqualError(t, err, "invalid additions: label \"add-me\" has an empty value, which reject-empty-values does not allow")
+}
+
 func TestInvalidLongAdditionalLabelValue(t *testing.T) {
 	var source = `---
 additions:
@@ -143,6 +178,24 @@ additions:
 	assert.EqualError(t, err, "invalid additions: invalid label value \"xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx\": must be no more than 63 characters")
 }
 
+func TestValidateRejectsALabelTemplateWhoseParseTreeExceedsTheComplexityBound(t *testing.T) {
+	oldMax := TemplateMaxNodes
+	TemplateMaxNodes = 5
+	defer func() { TemplateMaxNodes = oldMax }()
+
+	var source = `---
+additions:
+  labels:
+    add-me: "{{ if true }}{{ if true }}{{ if true }}{{ if true }}{{ if true }}x{{ end }}{{ end }}{{ end }}{{ end }}{{ end }}"
+`
+	var payload Payload
+	err := yaml.Unmarshal([]byte(source), &payload)
+	require.NoError(t, err, "the test payload should unmarshal")
+	err = payload.validate()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "too complex")
+}
+
 func TestValidAdditionalAnnotation(t *testing.T) {
 	var source = `---
 additions:
@@ -202,6 +255,46 @@ json-patch: "[ { something that isn't valid json } ]"
 	assert.EqualError(t, err, "invalid json-patch: invalid character 's' looking for beginning of object key string")
 }
 
+func TestValidDesiredState(t *testing.T) {
+	var source = `---
+desired-state: |
+  spec:
+    replicas: 3
+`
+	var payload Payload
+	err := yaml.Unmarshal([]byte(source), &payload)
+	require.NoError(t, err, "the test payload should unmarshal")
+	err = payload.validate()
+	assert.NoError(t, err, "a payload with a single valid desired-state fragment should be valid")
+}
+
+func TestInvalidDesiredState(t *testing.T) {
+	var source = `---
+desired-state: "{ not valid yaml"
+`
+	var payload Payload
+	err := yaml.Unmarshal([]byte(source), &payload)
+	require.NoError(t, err, "the test payload should unmarshal")
+	err = payload.validate()
+	assert.Error(t, err)
+}
+
+func TestDesiredStatePlusAdditionsDeletionsNotAllowed(t *testing.T) {
+	var source = `---
+desired-state: |
+  spec:
+    replicas: 3
+additions:
+  labels:
+    added: label
+`
+	var payload Payload
+	err := yaml.Unmarshal([]byte(source), &payload)
+	require.NoError(t, err, "the test payload should unmarshal")
+	err = payload.validate()
+	assert.EqualError(t, err, "a rule payload can only specify additions/deletions, or a json-patch, or a desired-state, or a block, or a clamp, or a delegate, but not a combination of them")
+}
+
 func TestBlockPlusJSONPatchNotAllowed(t *testing.T) {
 	var source = `---
 block: true
@@ -211,7 +304,7 @@ json-patch: "[ { \"op\": \"delete\", \"path\": \"/metadata/labels\" } ]"
 	err := yaml.Unmarshal([]byte(source), &payload)
 	require.NoError(t, err, "the test payload should unmarshal")
 	err = payload.validate()
-	assert.EqualError(t, err, "a rule payload can only specify additions/deletions, or a json-patch or a block, but not a combination of them")
+	assert.EqualError(t, err, "a rule payload can only specify additions/deletions, or a json-patch, or a desired-state, or a block, or a clamp, or a delegate, but not a combination of them")
 }
 
 func TestBlockPlusAdditionsDeletionsNotAllowed(t *testing.T) {
@@ -225,7 +318,7 @@ additions:
 	err := yaml.Unmarshal([]byte(source), &payload)
 	require.NoError(t, err, "the test payload should unmarshal")
 	err = payload.validate()
-	assert.EqualError(t, err, "a rule payload can only specify additions/deletions, or a json-patch or a block, but not a combination of them")
+	assert.EqualError(t, err, "a rule payload can only specify additions/deletions, or a json-patch, or a desired-state, or a block, or a clamp, or a delegate, but not a combination of them")
 }
 
 func TestJSONPatchPlusAdditionsDeletionsNotAllowed(t *testing.T) {
@@ -241,7 +334,7 @@ additions:
 	spew.Dump(payload)
 	require.NoError(t, err, "the test payload should unmarshal")
 	err = payload.validate()
-	assert.EqualError(t, err, "a rule payload can only specify additions/deletions, or a json-patch or a block, but not a combination of them")
+	assert.EqualError(t, err, "a rule payload can only specify additions/deletions, or a json-patch, or a desired-state, or a block, or a clamp, or a delegate, but not a combination of them")
 }
 
 func TestDeleteALabel(t *testing.T) {
@@ -263,7 +356,7 @@ func TestDeleteALabel(t *testing.T) {
 	assert.NoError(t, err, "couldn't marshall a valid admission review object from test json")
 
 	// call Mutate
-	resp := rule.MutateAdmission(review.Request)
+	resp := rule.MutateAdmission(context.Background(), review.Request)
 	assert.Equal(t, true, resp.Allowed, "the request should be successful")
 	assert.NotNil(t, resp.Patch)
 	// we have to test the patch objects because they have multiple values and can be ordered either way round preventing a simple string match.
@@ -292,7 +385,7 @@ func TestDeleteAllLabels(t *testing.T) {
 	assert.NoError(t, err, "couldn't marshall a valid admission review object from test json")
 
 	// call Mutate
-	resp := rule.MutateAdmission(review.Request)
+	resp := rule.MutateAdmission(context.Background(), review.Request)
 	assert.Equal(t, true, resp.Allowed, "the request should be successful")
 	assert.NotNil(t, resp.Patch)
 	// we have to test the patch objects because they have multiple values and can be ordered either way round preventing a simple string match.
@@ -302,6 +395,116 @@ func TestDeleteAllLabels(t *testing.T) {
 	assert.ElementsMatch(t, desired.Operations, actual.Operations, "the whole /metadata/labels path should be removed")
 }
 
+func TestDeleteAllLabelsLeavesAPreservedLabelIntact(t *testing.T) {
+	// create a Rule
+	rule := Rule{
+		Matchers: Matchers{
+			LabelSelectors: []string{"author = david"},
+		},
+		Payload: Payload{
+			Deletions: Deletions{
+				Labels: []string{"author", "group"},
+			},
+			PreserveLabels: []string{"group"},
+		},
+	}
+
+	// create a review request
+	var review = admission.AdmissionReview{}
+	err := json.Unmarshal([]byte(testReview), &review)
+	assert.NoError(t, err, "couldn't marshall a valid admission review object from test json")
+
+	// call Mutate
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	assert.Equal(t, true, resp.Allowed, "the request should be successful")
+	assert.NotNil(t, resp.Patch)
+	// the whole path would otherwise be deleted, but group is preserved with its original value.
+	desired, _ := jsonpatch.FromString(`[ { "op": "replace", "path": "/metadata/labels", "value": { "group": "runtime" }} ]`)
+	actual, err := jsonpatch.FromString(string(resp.Patch))
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, desired.Operations, actual.Operations, "preserve-labels should keep group even though every label was deleted")
+}
+
+func TestDuplicateKeyPolicyDefaultsToTheDeletionWinning(t *testing.T) {
+	rule := Rule{
+		Matchers: Matchers{
+			LabelSelectors: []string{"author = david"},
+		},
+		Payload: Payload{
+			Additions: Additions{Labels: map[string]string{"group": "newval"}},
+			Deletions: Deletions{Labels: []string{"group"}},
+		},
+	}
+
+	var review = admission.AdmissionReview{}
+	err := json.Unmarshal([]byte(testReview), &review)
+	assert.NoError(t, err, "couldn't marshall a valid admission review object from test json")
+
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	assert.Equal(t, true, resp.Allowed, "the request should be successful")
+	assert.NotNil(t, resp.Patch)
+	desired, _ := jsonpatch.FromString(`[ { "op": "replace", "path": "/metadata/labels", "value": { "author": "david" }} ]`)
+	actual, err := jsonpatch.FromString(string(resp.Patch))
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, desired.Operations, actual.Operations, "with no duplicate-key-policy set, a key both added and deleted should end up deleted")
+}
+
+func TestDuplicateKeyPolicySkipKeepsTheFreshAddition(t *testing.T) {
+	rule := Rule{
+		Matchers: Matchers{
+			LabelSelectors: []string{"author = david"},
+		},
+		Payload: Payload{
+			Additions:          Additions{Labels: map[string]string{"group": "newval"}},
+			Deletions:          Deletions{Labels: []string{"group"}},
+			DuplicateKeyPolicy: "skip",
+		},
+	}
+
+	var review = admission.AdmissionReview{}
+	err := json.Unmarshal([]byte(testReview), &review)
+	assert.NoError(t, err, "couldn't marshall a valid admission review object from test json")
+
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	assert.Equal(t, true, resp.Allowed, "the request should be successful")
+	assert.NotNil(t, resp.Patch)
+	desired, _ := jsonpatch.FromString(`[ { "op": "replace", "path": "/metadata/labels", "value": { "author": "david", "group": "newval" }} ]`)
+	actual, err := jsonpatch.FromString(string(resp.Patch))
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, desired.Operations, actual.Operations, "duplicate-key-policy skip should leave the fresh addition in place instead of deleting it")
+}
+
+func TestDuplicateKeyPolicyErrorFailsTheRule(t *testing.T) {
+	rule := Rule{
+		Matchers: Matchers{
+			LabelSelectors: []string{"author = david"},
+		},
+		Payload: Payload{
+			Additions:          Additions{Labels: map[string]string{"group": "newval"}},
+			Deletions:          Deletions{Labels: []string{"group"}},
+			DuplicateKeyPolicy: "error",
+		},
+	}
+
+	var review = admission.AdmissionReview{}
+	err := json.Unmarshal([]byte(testReview), &review)
+	assert.NoError(t, err, "couldn't marshall a valid admission review object from test json")
+
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	assert.Equal(t, true, resp.Allowed, "an internal error does not block the source api request")
+	assert.Nil(t, resp.Patch)
+	assert.Equal(t, metav1.StatusReasonInternalError, resp.Result.Reason)
+	assert.Contains(t, resp.Result.Message, "both added and deleted")
+}
+
+func TestInvalidDuplicateKeyPolicyFailsValidation(t *testing.T) {
+	p := Payload{
+		Additions:          Additions{Labels: map[string]string{"group": "newval"}},
+		DuplicateKeyPolicy: "overwrite",
+	}
+	assert.Error(t, p.validate())
+}
+
 func TestAddingAndDeletingLabelsCancelOut(t *testing.T) {
 	// create a Rule
 	rule := Rule{
@@ -324,20 +527,21 @@ func TestAddingAndDeletingLabelsCancelOut(t *testing.T) {
 	assert.NoError(t, err, "couldn't marshall a valid admission review object from test json")
 
 	// call Mutate
-	resp := rule.MutateAdmission(review.Request)
+	resp := rule.MutateAdmission(context.Background(), review.Request)
 	assert.Equal(t, true, resp.Allowed, "the request should be successful")
 	assert.Nil(t, resp.Patch, "adding and removing a label produces no patch, adds are processed before deletes")
 }
 
-func TestDeleteAnAnnotation(t *testing.T) {
+func TestBackupOriginalValuesRecordsAnOverwrittenLabelUnderABackupAnnotation(t *testing.T) {
 	// create a Rule
 	rule := Rule{
 		Matchers: Matchers{
 			LabelSelectors: []string{"author = david"},
 		},
 		Payload: Payload{
-			Deletions: Deletions{
-				Annotations: []string{"level"},
+			Additions: Additions{
+				Labels:               map[string]string{"author": "x"},
+				BackupOriginalValues: true,
 			},
 		},
 	}
@@ -348,25 +552,28 @@ func TestDeleteAnAnnotation(t *testing.T) {
 	assert.NoError(t, err, "couldn't marshall a valid admission review object from test json")
 
 	// call Mutate
-	resp := rule.MutateAdmission(review.Request)
+	resp := rule.MutateAdmission(context.Background(), review.Request)
 	assert.Equal(t, true, resp.Allowed, "the request should be successful")
 	assert.NotNil(t, resp.Patch)
 	// we have to test the patch objects because they have multiple values and can be ordered either way round preventing a simple string match.
-	desired, _ := jsonpatch.FromString(`[ { "op": "replace", "path": "/metadata/annotations", "value": { "prometheus.io/path": "/metrics" }} ]`)
+	desired, _ := jsonpatch.FromString(`[
+		{ "op": "replace", "path": "/metadata/labels", "value": { "author": "x", "group": "runtime" }},
+		{ "op": "replace", "path": "/metadata/annotations", "value": { "level": "v.special", "prometheus.io/path": "/metrics", "kube-graffiti.io/original-author": "david" }}
+	]`)
 	actual, err := jsonpatch.FromString(string(resp.Patch))
 	assert.NoError(t, err)
-	assert.ElementsMatch(t, desired.Operations, actual.Operations, "the author=david label should have been removed")
+	assert.ElementsMatch(t, desired.Operations, actual.Operations, "overwriting author=david with author=x should back up the prior value under an original-author annotation")
 }
 
-func TestDeleteAllAnnotations(t *testing.T) {
+func TestBackupOriginalValuesIsANoOpWithoutIt(t *testing.T) {
 	// create a Rule
 	rule := Rule{
 		Matchers: Matchers{
 			LabelSelectors: []string{"author = david"},
 		},
 		Payload: Payload{
-			Deletions: Deletions{
-				Annotations: []string{"level", "prometheus.io/path"},
+			Additions: Additions{
+				Labels: map[string]string{"author": "x"},
 			},
 		},
 	}
@@ -377,58 +584,171 @@ func TestDeleteAllAnnotations(t *testing.T) {
 	assert.NoError(t, err, "couldn't marshall a valid admission review object from test json")
 
 	// call Mutate
-	resp := rule.MutateAdmission(review.Request)
+	resp := rule.MutateAdmission(context.Background(), review.Request)
 	assert.Equal(t, true, resp.Allowed, "the request should be successful")
 	assert.NotNil(t, resp.Patch)
 	// we have to test the patch objects because they have multiple values and can be ordered either way round preventing a simple string match.
-	desired, _ := jsonpatch.FromString(`[ { "op": "delete", "path": "/metadata/annotations" } ]`)
+	desired, _ := jsonpatch.FromString(`[ { "op": "replace", "path": "/metadata/labels", "value": { "author": "x", "group": "runtime" }} ]`)
 	actual, err := jsonpatch.FromString(string(resp.Patch))
 	assert.NoError(t, err)
-	assert.ElementsMatch(t, desired.Operations, actual.Operations, "the whole /metadata/annotations path should be removed")
+	assert.ElementsMatch(t, desired.Operations, actual.Operations, "without backup-original-values the overwrite should produce no annotation change")
 }
 
-func TestMultiAddAndDelete(t *testing.T) {
-	// create a Rule
+func TestRecordAppliedKeysStampsTheKeysThisRuleAdded(t *testing.T) {
 	rule := Rule{
 		Matchers: Matchers{
 			LabelSelectors: []string{"author = david"},
 		},
 		Payload: Payload{
 			Additions: Additions{
-				Labels:      map[string]string{"new-label": "attached"},
-				Annotations: map[string]string{"new-annotation": "made"},
+				Labels:            map[string]string{"author": "x"},
+				RecordAppliedKeys: true,
+			},
+		},
+		Name: "relabel-author",
+	}
+
+	var review = admission.AdmissionReview{}
+	err := json.Unmarshal([]byte(testReview), &review)
+	assert.NoError(t, err, "couldn't marshall a valid admission review object from test json")
+
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	assert.Equal(t, true, resp.Allowed, "the request should be successful")
+	assert.NotNil(t, resp.Patch)
+	desired, _ := jsonpatch.FromString(`[
+		{ "op": "replace", "path": "/metadata/labels", "value": { "author": "x", "group": "runtime" }},
+		{ "op": "replace", "path": "/metadata/annotations", "value": { "level": "v.special", "prometheus.io/path": "/metrics", "kube-graffiti.io/applied-keys-relabel-author-labels": "author", "kube-graffiti.io/applied-keys-relabel-author-annotations": "" }}
+	]`)
+	actual, err := jsonpatch.FromString(string(resp.Patch))
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, desired.Operations, actual.Operations, "record-applied-keys should stamp the keys this rule's payload added")
+}
+
+func specDriftRule() Rule {
+	return Rule{
+		Name: "react-to-spec-drift",
+		Matchers: Matchers{
+			SpecChanged: []string{"spec.replicas"},
+		},
+		Payload: Payload{
+			Additions: Additions{
+				Annotations: map[string]string{"reconciled": "true"},
+				SpecHash:    SpecHash{FieldPaths: []string{"spec.replicas"}},
+			},
+		},
+	}
+}
+
+func TestSpecChangedMatchesAnObjectThatHasNeverBeenHashedBefore(t *testing.T) {
+	rule := specDriftRule()
+
+	patch, err := rule.Mutate(context.Background(), []byte(`{"metadata":{"name":"test"},"spec":{"replicas":3}}`))
+	require.NoError(t, err)
+	assert.NotNil(t, patch, "an object with no stamped spec-hash annotation yet has never been compared, so it should count as changed")
+	assert.Contains(t, string(patch), `"kube-graffiti.io/spec-hash-react-to-spec-drift"`)
+}
+
+func TestSpecChangedDoesNotMatchOnceTheStampedHashIsStillUpToDate(t *testing.T) {
+	rule := specDriftRule()
+
+	hash := computeSpecHash(map[string]string{"spec.replicas": "3"}, []string{"spec.replicas"})
+	object := fmt.Sprintf(`{"metadata":{"name":"test","annotations":{"kube-graffiti.io/spec-hash-react-to-spec-drift":%q}},"spec":{"replicas":3}}`, hash)
+
+	patch, err := rule.Mutate(context.Background(), []byte(object))
+	require.NoError(t, err)
+	assert.Nil(t, patch, "an unchanged spec should produce no action")
+}
+
+func TestSpecChangedMatchesOnceTheHashedFieldHasDrifted(t *testing.T) {
+	rule := specDriftRule()
+
+	staleHash := computeSpecHash(map[string]string{"spec.replicas": "3"}, []string{"spec.replicas"})
+	object := fmt.Sprintf(`{"metadata":{"name":"test","annotations":{"kube-graffiti.io/spec-hash-react-to-spec-drift":%q}},"spec":{"replicas":5}}`, staleHash)
+
+	patch, err := rule.Mutate(context.Background(), []byte(object))
+	require.NoError(t, err)
+	assert.NotNil(t, patch, "spec.replicas changed since the hash was stamped, so the rule should match again")
+}
+
+func TestExplainAnnotationDescribesAMixedAddDeletePayload(t *testing.T) {
+	rule := Rule{
+		Matchers: Matchers{
+			LabelSelectors: []string{"author = david"},
+		},
+		Payload: Payload{
+			Additions: Additions{
+				Labels: map[string]string{"team": "x"},
 			},
 			Deletions: Deletions{
-				Labels:      []string{"author"},
 				Annotations: []string{"level"},
 			},
+			ExplainAnnotation: "kube-graffiti.io/explain",
 		},
 	}
 
-	// create a review request
 	var review = admission.AdmissionReview{}
 	err := json.Unmarshal([]byte(testReview), &review)
 	assert.NoError(t, err, "couldn't marshall a valid admission review object from test json")
 
-	// call Mutate
-	resp := rule.MutateAdmission(review.Request)
+	resp := rule.MutateAdmission(context.Background(), review.Request)
 	assert.Equal(t, true, resp.Allowed, "the request should be successful")
-	assert.NotNil(t, resp.Patch)
-	// we have to test the patch objects because they have multiple values and can be ordered either way round preventing a simple string match.
-	desired, _ := jsonpatch.FromString(`[ { "op": "replace", "path": "/metadata/labels", "value": { "group": "runtime", "new-label": "attached" }}, { "op": "replace", "path": "/metadata/annotations", "value": { "new-annotation": "made", "prometheus.io/path": "/metrics" }} ]`)
+	require.NotNil(t, resp.Patch)
+
+	desired, _ := jsonpatch.FromString(`[
+		{ "op": "replace", "path": "/metadata/labels", "value": { "author": "david", "group": "runtime", "team": "x" }},
+		{ "op": "replace", "path": "/metadata/annotations", "value": { "prometheus.io/path": "/metrics", "kube-graffiti.io/explain": "added label team=x; removed annotation level" }}
+	]`)
 	actual, err := jsonpatch.FromString(string(resp.Patch))
 	assert.NoError(t, err)
-	assert.ElementsMatch(t, desired.Operations, actual.Operations, "we should see adds and deletes of both labels and annotations")
+	assert.ElementsMatch(t, desired.Operations, actual.Operations, "the explain annotation should describe both the label addition and the annotation deletion")
 }
 
-func TestUserProvidedPatch(t *testing.T) {
+func TestExplainAnnotationDoesNotDescribeItsOwnAddition(t *testing.T) {
+	rule := Rule{
+		Matchers: Matchers{
+			LabelSelectors: []string{"author = david"},
+		},
+		Payload: Payload{
+			Additions: Additions{
+				Labels:      map[string]string{"team": "x"},
+				Annotations: map[string]string{"kube-graffiti.io/explain": "this should be overwritten, not described"},
+			},
+			ExplainAnnotation: "kube-graffiti.io/explain",
+		},
+	}
+
+	var review = admission.AdmissionReview{}
+	err := json.Unmarshal([]byte(testReview), &review)
+	assert.NoError(t, err, "couldn't marshall a valid admission review object from test json")
+
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	assert.Equal(t, true, resp.Allowed, "the request should be successful")
+	require.NotNil(t, resp.Patch)
+
+	var explanation string
+	ops, err := jsonpatch.FromString(string(resp.Patch))
+	require.NoError(t, err)
+	for _, op := range ops.Operations {
+		if op.Path == "/metadata/annotations" {
+			value, ok := op.Value.(map[string]interface{})
+			require.True(t, ok)
+			explanation, _ = value["kube-graffiti.io/explain"].(string)
+		}
+	}
+	assert.Equal(t, "added label team=x", explanation, "the explain annotation's own addition must never appear in its own summary")
+}
+
+func TestBackupOriginalValuesDoesNotBackUpAValueThatIsNotActuallyChanging(t *testing.T) {
 	// create a Rule
 	rule := Rule{
 		Matchers: Matchers{
 			LabelSelectors: []string{"author = david"},
 		},
 		Payload: Payload{
-			JSONPatch: "[ This is a user supplied patch ]",
+			Additions: Additions{
+				Labels:               map[string]string{"author": "david"},
+				BackupOriginalValues: true,
+			},
 		},
 	}
 
@@ -438,21 +758,26 @@ func TestUserProvidedPatch(t *testing.T) {
 	assert.NoError(t, err, "couldn't marshall a valid admission review object from test json")
 
 	// call Mutate
-	resp := rule.MutateAdmission(review.Request)
+	resp := rule.MutateAdmission(context.Background(), review.Request)
 	assert.Equal(t, true, resp.Allowed, "the request should be successful")
-	assert.NotNil(t, resp.Patch)
-	assert.Equal(t, []byte(rule.Payload.JSONPatch), resp.Patch, "the patch should be the user supplied one")
+	assert.Nil(t, resp.Patch, "re-adding the same value should produce no patch, and therefore no backup")
 }
 
-func TestRuleBlocksObject(t *testing.T) {
+func TestBackupOriginalValuesSkipsAKeyWhoseBackupAnnotationWouldBeInvalid(t *testing.T) {
+	// a 60-character key is itself a valid annotation name, but "original-" plus it exceeds the
+	// 63-character limit on a qualified name's name segment, making the backup key invalid.
+	longKey := strings.Repeat("a", 60)
+
 	// create a Rule
 	rule := Rule{
-		Name: "I-dont-like-david",
 		Matchers: Matchers{
 			LabelSelectors: []string{"author = david"},
 		},
 		Payload: Payload{
-			Block: true,
+			Additions: Additions{
+				Labels:               map[string]string{"author": "x", longKey: "new"},
+				BackupOriginalValues: true,
+			},
 		},
 	}
 
@@ -461,10 +786,1638 @@ func TestRuleBlocksObject(t *testing.T) {
 	err := json.Unmarshal([]byte(testReview), &review)
 	assert.NoError(t, err, "couldn't marshall a valid admission review object from test json")
 
+	var object map[string]interface{}
+	assert.NoError(t, json.Unmarshal(review.Request.Object.Raw, &object))
+	labels := object["metadata"].(map[string]interface{})["labels"].(map[string]interface{})
+	labels[longKey] = "old"
+	review.Request.Object.Raw, err = json.Marshal(object)
+	assert.NoError(t, err)
+
 	// call Mutate
-	resp := rule.MutateAdmission(review.Request)
-	assert.Equal(t, false, resp.Allowed, "the request should not be allowed to proceed")
-	assert.Nil(t, resp.Patch, "the patch should be empty")
-	assert.Equal(t, metav1.StatusReasonForbidden, resp.Result.Reason, "the graffiti rule should forbid the create/update of the object")
-	assert.Equal(t, "blocked by kube-graffiti rule: I-dont-like-david", resp.Result.Message, "we should be able to see why the request has been blocked and by which rule")
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	assert.Equal(t, true, resp.Allowed, "the request should be successful")
+	assert.NotNil(t, resp.Patch)
+	// the long key's own overwrite still applies, and the valid author backup still goes ahead - only
+	// the long key's own backup, whose key would be invalid, is skipped.
+	desired, _ := jsonpatch.FromString(fmt.Sprintf(`[
+		{ "op": "replace", "path": "/metadata/labels", "value": { "author": "x", "group": "runtime", "%s": "new" }},
+		{ "op": "replace", "path": "/metadata/annotations", "value": { "level": "v.special", "prometheus.io/path": "/metrics", "kube-graffiti.io/original-author": "david" }}
+	]`, longKey))
+	actual, err := jsonpatch.FromString(string(resp.Patch))
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, desired.Operations, actual.Operations, "the invalid backup key should be skipped without failing the rest of the payload")
 }
+
+func TestDeleteAnAnnotation(t *testing.T) {
+	// create a Rule
+	rule := Rule{
+		Matchers: Matchers{
+			LabelSelectors: []string{"author = david"},
+		},
+		Payload: Payload{
+			Deletions: Deletions{
+				Annotations: []string{"level"},
+			},
+		},
+	}
+
+	// create a review request
+	var review = admission.AdmissionReview{}
+	err := json.Unmarshal([]byte(testReview), &review)
+	assert.NoError(t, err, "couldn't marshall a valid admission review object from test json")
+
+	// call Mutate
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	assert.Equal(t, true, resp.Allowed, "the request should be successful")
+	assert.NotNil(t, resp.Patch)
+	// we have to test the patch objects because they have multiple values and can be ordered either way round preventing a simple string match.
+	desired, _ := jsonpatch.FromString(`[ { "op": "replace", "path": "/metadata/annotations", "value": { "prometheus.io/path": "/metrics" }} ]`)
+	actual, err := jsonpatch.FromString(string(resp.Patch))
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, desired.Operations, actual.Operations, "the level annotation should have been removed")
+}
+
+func TestDeleteAllAnnotations(t *testing.T) {
+	// create a Rule
+	rule := Rule{
+		Matchers: Matchers{
+			LabelSelectors: []string{"author = david"},
+		},
+		Payload: Payload{
+			Deletions: Deletions{
+				Annotations: []string{"level", "prometheus.io/path"},
+			},
+		},
+	}
+
+	// create a review request
+	var review = admission.AdmissionReview{}
+	err := json.Unmarshal([]byte(testReview), &review)
+	assert.NoError(t, err, "couldn't marshall a valid admission review object from test json")
+
+	// call Mutate
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	assert.Equal(t, true, resp.Allowed, "the request should be successful")
+	assert.NotNil(t, resp.Patch)
+	// we have to test the patch objects because they have multiple values and can be ordered either way round preventing a simple string match.
+	desired, _ := jsonpatch.FromString(`[ { "op": "delete", "path": "/metadata/annotations" } ]`)
+	actual, err := jsonpatch.FromString(string(resp.Patch))
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, desired.Operations, actual.Operations, "the whole /metadata/annotations path should be removed")
+}
+
+func TestPaintObjectWithDesiredStateProducesAMergePatchAgainstTheCurrentObject(t *testing.T) {
+	p := Payload{DesiredState: "spec:\n  replicas: 3\n"}
+	current := []byte(`{ "metadata": { "name": "my-deployment" }, "spec": { "replicas": 1, "template": {} } }`)
+
+	patch, err := p.paintObject(metaObject{}, map[string]string{}, current, "desired-state-rule", nil, "", log.Logger)
+	require.NoError(t, err)
+
+	desired, _ := jsonpatch.FromString(`[ { "op": "replace", "path": "/spec/replicas", "value": 3 } ]`)
+	actual, err := jsonpatch.FromString(string(patch))
+	require.NoError(t, err)
+	assert.ElementsMatch(t, desired.Operations, actual.Operations)
+}
+
+func TestPaintObjectWithDesiredStateAddsAMissingField(t *testing.T) {
+	p := Payload{DesiredState: "spec:\n  replicas: 3\n"}
+	current := []byte(`{ "metadata": { "name": "my-deployment" }, "spec": {} }`)
+
+	patch, err := p.paintObject(metaObject{}, map[string]string{}, current, "desired-state-rule", nil, "", log.Logger)
+	require.NoError(t, err)
+
+	desired, _ := jsonpatch.FromString(`[ { "op": "add", "path": "/spec/replicas", "value": 3 } ]`)
+	actual, err := jsonpatch.FromString(string(patch))
+	require.NoError(t, err)
+	assert.ElementsMatch(t, desired.Operations, actual.Operations)
+}
+
+func TestPaintObjectWithDesiredStateAlreadyMatchingProducesNoPatch(t *testing.T) {
+	p := Payload{DesiredState: "spec:\n  replicas: 3\n"}
+	current := []byte(`{ "metadata": { "name": "my-deployment" }, "spec": { "replicas": 3 } }`)
+
+	patch, err := p.paintObject(metaObject{}, map[string]string{}, current, "desired-state-rule", nil, "", log.Logger)
+	require.NoError(t, err)
+	assert.Nil(t, patch)
+}
+
+func TestPaintObjectAllowsPatchWithinLimits(t *testing.T) {
+	p := Payload{JSONPatch: `[ { "op": "add", "path": "/metadata/labels/a", "value": "1" } ]`}
+	patch, err := p.paintObject(metaObject{}, map[string]string{}, []byte(`{}`), "within-limits-rule", nil, "", log.Logger)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte(p.JSONPatch), patch)
+}
+
+// TestClampOnAScaleSubresourceRewritesReplicasDownToMax confirms that a scale object whose replicas
+// requests more than Clamp.Max is rewritten down to it, the way it would be if someone tried to scale
+// a Deployment's "scale" subresource beyond its namespace's allowed maximum.
+func TestClampOnAScaleSubresourceRewritesReplicasDownToMax(t *testing.T) {
+	p := Payload{Clamp: Clamp{Path: "/spec/replicas", Max: "10"}}
+	current := []byte(`{ "kind": "Scale", "spec": { "replicas": 25 } }`)
+
+	patch, err := p.paintObject(metaObject{}, map[string]string{}, current, "clamp-scale-rule", nil, "", log.Logger)
+	require.NoError(t, err)
+
+	desired, _ := jsonpatch.FromString(`[ { "op": "replace", "path": "/spec/replicas", "value": 10 } ]`)
+	actual, err := jsonpatch.FromString(string(patch))
+	require.NoError(t, err)
+	assert.ElementsMatch(t, desired.Operations, actual.Operations)
+}
+
+// TestClampWithinBoundsProducesNoPatch confirms that a replicas value already inside [Min, Max] is
+// left untouched, the same no-op behaviour DesiredState already has when nothing needs changing.
+func TestClampWithinBoundsProducesNoPatch(t *testing.T) {
+	p := Payload{Clamp: Clamp{Path: "/spec/replicas", Min: "1", Max: "10"}}
+	current := []byte(`{ "kind": "Scale", "spec": { "replicas": 5 } }`)
+
+	patch, err := p.paintObject(metaObject{}, map[string]string{}, current, "clamp-scale-rule", nil, "", log.Logger)
+	require.NoError(t, err)
+	assert.Nil(t, patch)
+}
+
+// TestClampWithAMissingBoundAnnotationSkipsCleanly confirms that, when Max is templated against a
+// field the object doesn't carry (e.g. a quota annotation that was never set), the bound is treated
+// as unconfigured rather than clamping the value down to zero or erroring.
+func TestClampWithAMissingBoundAnnotationSkipsCleanly(t *testing.T) {
+	p := Payload{Clamp: Clamp{Path: "/spec/replicas", Max: `{{ index . "metadata.annotations.quota/max-replicas" }}`}}
+	current := []byte(`{ "kind": "Scale", "spec": { "replicas": 25 } }`)
+
+	patch, err := p.paintObject(metaObject{}, map[string]string{}, current, "clamp-scale-rule", nil, "", log.Logger)
+	require.NoError(t, err)
+	assert.Nil(t, patch)
+}
+
+// TestClampOnAWholeDeploymentRewritesSpecReplicas confirms that Clamp works identically against a
+// whole Deployment's spec.replicas, not only a scale subresource's Scale object, since both shapes
+// carry the value at the same path.
+func TestClampOnAWholeDeploymentRewritesSpecReplicas(t *testing.T) {
+	p := Payload{Clamp: Clamp{Path: "/spec/replicas", Max: "10"}}
+	current := []byte(`{ "kind": "Deployment", "metadata": { "name": "my-deployment" }, "spec": { "replicas": 25, "template": {} } }`)
+
+	patch, err := p.paintObject(metaObject{}, map[string]string{}, current, "clamp-deployment-rule", nil, "", log.Logger)
+	require.NoError(t, err)
+
+	desired, _ := jsonpatch.FromString(`[ { "op": "replace", "path": "/spec/replicas", "value": 10 } ]`)
+	actual, err := jsonpatch.FromString(string(patch))
+	require.NoError(t, err)
+	assert.ElementsMatch(t, desired.Operations, actual.Operations)
+}
+
+// TestClampReadsAnInt64ValueBeyondFloat64PrecisionCorrectly confirms that a value near 2^53, where a
+// naive float64 decode starts losing precision, is still read and compared against its bounds exactly.
+func TestClampReadsAnInt64ValueBeyondFloat64PrecisionCorrectly(t *testing.T) {
+	p := Payload{Clamp: Clamp{Path: "/spec/counter", Max: "9007199254740993"}}
+	current := []byte(`{ "spec": { "counter": 9007199254740993 } }`)
+
+	patch, err := p.paintObject(metaObject{}, map[string]string{}, current, "clamp-precision-rule", nil, "", log.Logger)
+	require.NoError(t, err)
+	assert.Nil(t, patch, "the value already equals max exactly, so no patch should be produced")
+}
+
+// TestPaintObjectWithDesiredStatePreservesIntegerPrecisionBeyondFloat64 confirms that an untouched
+// sibling field holding an int64 near 2^53 survives a desired-state merge byte-for-byte, rather than
+// a naive float64 round-trip silently corrupting its last digits.
+func TestPaintObjectWithDesiredStatePreservesIntegerPrecisionBeyondFloat64(t *testing.T) {
+	p := Payload{DesiredState: "spec:\n  replicas: 3\n"}
+	current := []byte(`{ "metadata": { "name": "my-deployment" }, "spec": { "replicas": 1, "counter": 9007199254740993 } }`)
+
+	patch, err := p.paintObject(metaObject{}, map[string]string{}, current, "desired-state-rule", nil, "", log.Logger)
+	require.NoError(t, err)
+	assert.NotContains(t, string(patch), "counter", "the untouched counter field should not appear in the patch at all")
+
+	desired, _ := jsonpatch.FromString(`[ { "op": "replace", "path": "/spec/replicas", "value": 3 } ]`)
+	actual, err := jsonpatch.FromString(string(patch))
+	require.NoError(t, err)
+	assert.ElementsMatch(t, desired.Operations, actual.Operations)
+}
+
+func TestPaintObjectAllowsUnpatchedWhenTooManyOperations(t *testing.T) {
+	p := Payload{JSONPatch: manyOperationsPatch(5), MaxPatchOperations: 3}
+	patch, err := p.paintObject(metaObject{}, map[string]string{}, []byte(`{}`), "too-many-ops-allow-rule", nil, "", log.Logger)
+	assert.NoError(t, err, "the default error-policy is 'allow', so the object should pass through unpatched rather than erroring")
+	assert.Nil(t, patch)
+}
+
+func TestPaintObjectDeniesWhenTooManyOperationsAndErrorPolicyIsDeny(t *testing.T) {
+	p := Payload{JSONPatch: manyOperationsPatch(5), MaxPatchOperations: 3, ErrorPolicy: "deny"}
+	patch, err := p.paintObject(metaObject{}, map[string]string{}, []byte(`{}`), "too-many-ops-deny-rule", nil, "", log.Logger)
+	assert.Error(t, err, "error-policy 'deny' should fail the paint so the caller rejects the change")
+	assert.Nil(t, patch)
+}
+
+func TestPaintObjectAllowsUnpatchedWhenPatchTooLarge(t *testing.T) {
+	hugeValue := strings.Repeat("x", 1000)
+	p := Payload{JSONPatch: fmt.Sprintf(`[ { "op": "add", "path": "/metadata/labels/a", "value": "%s" } ]`, hugeValue), MaxPatchBytes: 100}
+	patch, err := p.paintObject(metaObject{}, map[string]string{}, []byte(`{}`), "huge-value-allow-rule", nil, "", log.Logger)
+	assert.NoError(t, err)
+	assert.Nil(t, patch)
+}
+
+func TestPaintObjectDeniesWhenPatchTooLargeAndErrorPolicyIsDeny(t *testing.T) {
+	hugeValue := strings.Repeat("x", 1000)
+	p := Payload{JSONPatch: fmt.Sprintf(`[ { "op": "add", "path": "/metadata/labels/a", "value": "%s" } ]`, hugeValue), MaxPatchBytes: 100, ErrorPolicy: "deny"}
+	patch, err := p.paintObject(metaObject{}, map[string]string{}, []byte(`{}`), "huge-value-deny-rule", nil, "", log.Logger)
+	assert.Error(t, err)
+	assert.Nil(t, patch)
+}
+
+// namelessObjectFieldMap is the field map MakeFieldMapFromRawObject produces for a generateName CREATE
+// - metadata.name is absent entirely, since the raw object has no "name" key yet.
+var namelessObjectFieldMap = map[string]string{"metadata.generateName": "my-app-", "metadata.namespace": "default"}
+
+func TestPaintObjectDeniesATemplateReferencingMetadataNameOnANamelessObjectWhenErrorPolicyIsDeny(t *testing.T) {
+	p := Payload{ErrorPolicy: "deny", Additions: Additions{Labels: map[string]string{"owner": `{{ index . "metadata.name" }}`}}}
+	obj := metaObject{Meta: metav1.ObjectMeta{GenerateName: "my-app-", Namespace: "default"}}
+	patch, err := p.paintObject(obj, namelessObjectFieldMap, []byte(`{"metadata":{"generateName":"my-app-","namespace":"default"}}`), "stamp-name-deny-rule", nil, "", log.Logger)
+	assert.Error(t, err, "error-policy 'deny' should fail the paint rather than render metadata.name as an empty string")
+	assert.Nil(t, patch)
+}
+
+func TestPaintObjectDropsATemplateReferencingMetadataNameOnANamelessObjectByDefault(t *testing.T) {
+	p := Payload{Additions: Additions{Labels: map[string]string{
+		"owner":        `{{ index . "metadata.name" }}`,
+		"generated-ok": "true",
+	}}}
+	obj := metaObject{Meta: metav1.ObjectMeta{GenerateName: "my-app-", Namespace: "default"}}
+	patch, err := p.paintObject(obj, namelessObjectFieldMap, []byte(`{"metadata":{"generateName":"my-app-","namespace":"default"}}`), "stamp-name-allow-rule", nil, "", log.Logger)
+	require.NoError(t, err)
+	require.NotNil(t, patch)
+	desired, _ := jsonpatch.FromString(`[ { "op": "add", "path": "/metadata/labels", "value": { "generated-ok": "true" } } ]`)
+	actual, err := jsonpatch.FromString(string(patch))
+	require.NoError(t, err)
+	assert.EqualValues(t, desired.Operations, actual.Operations, "the owner label referencing the missing name should be dropped, not set to an empty string")
+}
+
+// manyOperationsPatch builds a syntactically valid JSON patch with n "add" operations, used to
+// exercise the MaxPatchOperations limit without depending on how any particular payload feature
+// happens to render its operations.
+func manyOperationsPatch(n int) string {
+	var ops []string
+	for i := 0; i < n; i++ {
+		ops = append(ops, fmt.Sprintf(`{ "op": "add", "path": "/metadata/labels/key-%d", "value": "v" }`, i))
+	}
+	return `[ ` + strings.Join(ops, ", ") + ` ]`
+}
+
+func TestMultiAddAndDelete(t *testing.T) {
+	// create a Rule
+	rule := Rule{
+		Matchers: Matchers{
+			LabelSelectors: []string{"author = david"},
+		},
+		Payload: Payload{
+			Additions: Additions{
+				Labels:      map[string]string{"new-label": "attached"},
+				Annotations: map[string]string{"new-annotation": "made"},
+			},
+			Deletions: Deletions{
+				Labels:      []string{"author"},
+				Annotations: []string{"level"},
+			},
+		},
+	}
+
+	// create a review request
+	var review = admission.AdmissionReview{}
+	err := json.Unmarshal([]byte(testReview), &review)
+	assert.NoError(t, err, "couldn't marshall a valid admission review object from test json")
+
+	// call Mutate
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	assert.Equal(t, true, resp.Allowed, "the request should be successful")
+	assert.NotNil(t, resp.Patch)
+	// we have to test the patch objects because they have multiple values and can be ordered either way round preventing a simple string match.
+	desired, _ := jsonpatch.FromString(`[ { "op": "replace", "path": "/metadata/labels", "value": { "group": "runtime", "new-label": "attached" }}, { "op": "replace", "path": "/metadata/annotations", "value": { "new-annotation": "made", "prometheus.io/path": "/metrics" }} ]`)
+	actual, err := jsonpatch.FromString(string(resp.Patch))
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, desired.Operations, actual.Operations, "we should see adds and deletes of both labels and annotations")
+}
+
+func TestPatchOrderDefaultsToLabelsBeforeAnnotations(t *testing.T) {
+	rule := Rule{
+		Matchers: Matchers{LabelSelectors: []string{"author = david"}},
+		Payload: Payload{
+			Additions: Additions{
+				Labels:      map[string]string{"new-label": "attached"},
+				Annotations: map[string]string{"new-annotation": "made"},
+			},
+		},
+	}
+
+	var review = admission.AdmissionReview{}
+	require.NoError(t, json.Unmarshal([]byte(testReview), &review))
+
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	require.NotNil(t, resp.Patch)
+	patch := string(resp.Patch)
+	assert.True(t, strings.Index(patch, `"/metadata/labels"`) < strings.Index(patch, `"/metadata/annotations"`), "labels should come before annotations by default: %s", patch)
+}
+
+func TestPatchOrderAnnotationsFirstEmitsAnnotationsBeforeLabels(t *testing.T) {
+	rule := Rule{
+		Matchers: Matchers{LabelSelectors: []string{"author = david"}},
+		Payload: Payload{
+			PatchOrder: PatchOrderAnnotationsFirst,
+			Additions: Additions{
+				Labels:      map[string]string{"new-label": "attached"},
+				Annotations: map[string]string{"new-annotation": "made"},
+			},
+		},
+	}
+
+	var review = admission.AdmissionReview{}
+	require.NoError(t, json.Unmarshal([]byte(testReview), &review))
+
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	require.NotNil(t, resp.Patch)
+	patch := string(resp.Patch)
+	assert.True(t, strings.Index(patch, `"/metadata/annotations"`) < strings.Index(patch, `"/metadata/labels"`), "patch-order: annotations-first should emit annotations before labels: %s", patch)
+}
+
+func TestPatchOrderSkipsAnEmptyOperandWithoutLeavingAGap(t *testing.T) {
+	rule := Rule{
+		Matchers: Matchers{LabelSelectors: []string{"author = david"}},
+		Payload: Payload{
+			PatchOrder: PatchOrderAnnotationsFirst,
+			Additions:  Additions{Labels: map[string]string{"new-label": "attached"}},
+		},
+	}
+
+	var review = admission.AdmissionReview{}
+	require.NoError(t, json.Unmarshal([]byte(testReview), &review))
+
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	require.NotNil(t, resp.Patch)
+	desired, _ := jsonpatch.FromString(`[ { "op": "replace", "path": "/metadata/labels", "value": { "author": "david", "group": "runtime", "new-label": "attached" }} ]`)
+	actual, err := jsonpatch.FromString(string(resp.Patch))
+	require.NoError(t, err)
+	assert.ElementsMatch(t, desired.Operations, actual.Operations, "with no annotation changes, only the labels operand should appear")
+}
+
+func TestPaintingRecordsPatchSizeMetrics(t *testing.T) {
+	// create a Rule
+	rule := Rule{
+		Name: "multi-add-and-delete-metrics-test",
+		Matchers: Matchers{
+			LabelSelectors: []string{"author = david"},
+		},
+		Payload: Payload{
+			Additions: Additions{
+				Labels:      map[string]string{"new-label": "attached"},
+				Annotations: map[string]string{"new-annotation": "made"},
+			},
+			Deletions: Deletions{
+				Labels:      []string{"author"},
+				Annotations: []string{"level"},
+			},
+		},
+	}
+
+	// create a review request
+	var review = admission.AdmissionReview{}
+	err := json.Unmarshal([]byte(testReview), &review)
+	assert.NoError(t, err, "couldn't marshall a valid admission review object from test json")
+
+	// call Mutate
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	assert.Equal(t, true, resp.Allowed, "the request should be successful")
+	assert.NotNil(t, resp.Patch)
+
+	assert.Equal(t, int64(1), metrics.PatchOperations.Count(rule.Name), "exactly one patch should have been observed for this rule")
+	assert.Equal(t, int64(2), metrics.PatchOperations.Sum(rule.Name), "the two-operation patch should have recorded an operation count of two")
+	assert.True(t, metrics.PatchBytes.Sum(rule.Name) > 0, "the patch bytes observed should be greater than zero")
+}
+
+func TestPaintingRecordsPatchSizeMetricsWithConfiguredMetricLabels(t *testing.T) {
+	rule := Rule{
+		Name: "multi-add-and-delete-metric-labels-test",
+		Matchers: Matchers{
+			LabelSelectors: []string{"author = david"},
+		},
+		Payload: Payload{
+			Additions: Additions{
+				Labels: map[string]string{"new-label": "attached"},
+			},
+			MetricLabels: []string{"metadata.name"},
+		},
+	}
+
+	var review = admission.AdmissionReview{}
+	err := json.Unmarshal([]byte(testReview), &review)
+	assert.NoError(t, err, "couldn't marshall a valid admission review object from test json")
+
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	assert.Equal(t, true, resp.Allowed, "the request should be successful")
+	assert.NotNil(t, resp.Patch)
+
+	expectedLabel := "multi-add-and-delete-metric-labels-test;metadata.name=test-namespace"
+	assert.Equal(t, int64(1), metrics.PatchOperations.Count(expectedLabel), "the metric should be recorded against a label combining the rule name and the configured field's value")
+	assert.Equal(t, int64(0), metrics.PatchOperations.Count(rule.Name), "with metric-labels configured, the bare rule name should no longer receive the observation")
+}
+
+func TestBlockedObjectDoesNotRecordPatchSizeMetrics(t *testing.T) {
+	rule := Rule{
+		Name: "blocked-rule-metrics-test",
+		Matchers: Matchers{
+			LabelSelectors: []string{"author = david"},
+		},
+		Payload: Payload{
+			Block: true,
+		},
+	}
+
+	var review = admission.AdmissionReview{}
+	err := json.Unmarshal([]byte(testReview), &review)
+	assert.NoError(t, err, "couldn't marshall a valid admission review object from test json")
+
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	assert.Equal(t, false, resp.Allowed)
+
+	assert.Equal(t, int64(0), metrics.PatchOperations.Count(rule.Name), "a block should never record patch-size metrics")
+}
+
+// TestAdditionsAnnotationsPreserveCJKAndEmojiValues confirms that a non-ASCII annotation value - CJK
+// characters and an emoji, both multi-byte in UTF-8 - survives patch generation byte-for-byte, rather
+// than being mangled by anything along the way that assumes one rune is one byte.
+func TestAdditionsAnnotationsPreserveCJKAndEmojiValues(t *testing.T) {
+	const value = "日本語のメッセージ 😀 café"
+	rule := Rule{
+		Name: "unicode-annotation",
+		Payload: Payload{
+			Additions: Additions{Annotations: map[string]string{"message": value}},
+		},
+	}
+
+	var review = admission.AdmissionReview{}
+	require.NoError(t, json.Unmarshal([]byte(testReview), &review))
+
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	require.True(t, resp.Allowed)
+	require.NotNil(t, resp.Patch)
+
+	var ops []struct {
+		Op    string            `json:"op"`
+		Path  string            `json:"path"`
+		Value map[string]string `json:"value"`
+	}
+	require.NoError(t, json.Unmarshal(resp.Patch, &ops))
+	require.Len(t, ops, 1)
+	assert.Equal(t, "/metadata/annotations", ops[0].Path)
+	assert.Equal(t, value, ops[0].Value["message"], "the annotation value should reach the patch unchanged")
+}
+
+// TestInvalidAdditionalLabelValueRejectsNonASCIICharacters confirms that a label value containing
+// CJK characters is rejected at validation exactly like any other character outside the restricted
+// label-value charset, rather than being silently accepted or mangled by a unicode-unaware check.
+func TestInvalidAdditionalLabelValueRejectsNonASCIICharacters(t *testing.T) {
+	var payload Payload
+	payload.Additions.Labels = map[string]string{"add-me": "日本語"}
+	err := payload.validate()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `invalid label value "日本語"`)
+}
+
+// TestAdditionsAnnotationsPatchBytesMetricCountsUTF8BytesNotRunes confirms PatchBytes is recorded
+// against the computed patch's actual byte length - as checkPatchSizeAndRecordMetrics's len(patchString)
+// already gives it, since Go's len on a string counts bytes - so a multi-byte annotation value is
+// correctly weighted heavier than an equivalent ASCII one of the same rune count.
+func TestAdditionsAnnotationsPatchBytesMetricCountsUTF8BytesNotRunes(t *testing.T) {
+	asciiRule := Rule{
+		Name:    "ascii-metrics-test",
+		Payload: Payload{Additions: Additions{Annotations: map[string]string{"message": "abc"}}},
+	}
+	cjkRule := Rule{
+		Name:    "cjk-metrics-test",
+		Payload: Payload{Additions: Additions{Annotations: map[string]string{"message": "日本語"}}},
+	}
+
+	var review = admission.AdmissionReview{}
+	require.NoError(t, json.Unmarshal([]byte(testReview), &review))
+
+	respASCII := asciiRule.MutateAdmission(context.Background(), review.Request)
+	require.NotNil(t, respASCII.Patch)
+	respCJK := cjkRule.MutateAdmission(context.Background(), review.Request)
+	require.NotNil(t, respCJK.Patch)
+
+	// "abc" and "日本語" both have 3 runes, but the CJK value is 9 bytes against 3 - the recorded
+	// patch-bytes metric must reflect that, not the rune count the two values share.
+	assert.True(t, metrics.PatchBytes.Sum(cjkRule.Name) > metrics.PatchBytes.Sum(asciiRule.Name),
+		"a multi-byte annotation value should be recorded as more patch bytes than an equal-rune-count ASCII value")
+}
+
+// TestTruncateOverlongLabelValuesShortensAnOverlongTemplatedValue confirms that opting into
+// truncate-overlong-label-values rescues a templated label value that renders longer than
+// Kubernetes' 63-character limit, rather than the rule failing to apply at all.
+func TestTruncateOverlongLabelValuesShortensAnOverlongTemplatedValue(t *testing.T) {
+	rule := Rule{
+		Name: "truncate-overlong-label",
+		Payload: Payload{
+			Additions:                   Additions{Labels: map[string]string{"commit-message": `{{ index . "metadata.annotations.message" }}`}},
+			TruncateOverlongLabelValues: true,
+		},
+	}
+
+	var review = admission.AdmissionReview{}
+	require.NoError(t, json.Unmarshal([]byte(testReview), &review))
+	overlong := strings.Repeat("a", 100)
+	raw := strings.Replace(string(review.Request.Object.Raw), `"level": "v.special"`, fmt.Sprintf(`"level": "v.special", "message": "%s"`, overlong), 1)
+	review.Request.Object.Raw = []byte(raw)
+
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	require.True(t, resp.Allowed)
+	require.NotNil(t, resp.Patch)
+
+	var ops []struct {
+		Op    string            `json:"op"`
+		Path  string            `json:"path"`
+		Value map[string]string `json:"value"`
+	}
+	require.NoError(t, json.Unmarshal(resp.Patch, &ops))
+	require.Len(t, ops, 1)
+
+	value := ops[0].Value["commit-message"]
+	assert.True(t, len(value) <= 63, "truncated value should be within the 63-byte label-value limit")
+	assert.Empty(t, utilvalidation.IsValidLabelValue(value), "the truncated value should still be a valid label value")
+	assert.Equal(t, truncateLabelValue(overlong), value, "truncation should be stable across repeated renders of the same value")
+}
+
+// TestOverlongTemplatedLabelValueFailsValidationWithoutTruncation confirms truncate-overlong-label-values
+// is opt-in: without it, a templated label value that renders too long is passed straight through
+// exactly as before, rather than being silently fixed up.
+func TestOverlongTemplatedLabelValueFailsValidationWithoutTruncation(t *testing.T) {
+	rule := Rule{
+		Name: "no-truncate-overlong-label",
+		Payload: Payload{
+			Additions: Additions{Labels: map[string]string{"commit-message": `{{ index . "metadata.annotations.message" }}`}},
+		},
+	}
+
+	var review = admission.AdmissionReview{}
+	require.NoError(t, json.Unmarshal([]byte(testReview), &review))
+	overlong := strings.Repeat("a", 100)
+	raw := strings.Replace(string(review.Request.Object.Raw), `"level": "v.special"`, fmt.Sprintf(`"level": "v.special", "message": "%s"`, overlong), 1)
+	review.Request.Object.Raw = []byte(raw)
+
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	require.NotNil(t, resp.Patch)
+
+	var ops []struct {
+		Op    string            `json:"op"`
+		Path  string            `json:"path"`
+		Value map[string]string `json:"value"`
+	}
+	require.NoError(t, json.Unmarshal(resp.Patch, &ops))
+	require.Len(t, ops, 1)
+	assert.Equal(t, overlong, ops[0].Value["commit-message"], "without truncation the over-long rendered value should pass through unchanged")
+}
+
+// TestRequiredLabelsBlocksAnObjectMissingOne confirms that a Block payload configured with
+// require-labels denies an object that is missing one of them, using BlockMessage rendered against
+// the object's field map to explain which object was rejected.
+func TestRequiredLabelsBlocksAnObjectMissingOne(t *testing.T) {
+	rule := Rule{
+		Name: "require-owner-label",
+		Payload: Payload{
+			Block:          true,
+			RequiredLabels: []string{"owner"},
+			BlockMessage:   `namespace {{ index . "metadata.name" }} must have label 'owner'`,
+		},
+	}
+
+	var review = admission.AdmissionReview{}
+	require.NoError(t, json.Unmarshal([]byte(testReview), &review))
+
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	require.False(t, resp.Allowed)
+	assert.Equal(t, "namespace test-namespace must have label 'owner'", resp.Result.Message)
+}
+
+// TestRequiredLabelsAllowsAnObjectThatHasThemAll confirms that an object carrying every require-labels
+// key is let through untouched, rather than the mere presence of a Block payload denying it regardless.
+func TestRequiredLabelsAllowsAnObjectThatHasThemAll(t *testing.T) {
+	rule := Rule{
+		Name: "require-author-label",
+		Payload: Payload{
+			Block:          true,
+			RequiredLabels: []string{"author"},
+			BlockMessage:   `namespace {{ index . "metadata.name" }} must have label 'author'`,
+		},
+	}
+
+	var review = admission.AdmissionReview{}
+	require.NoError(t, json.Unmarshal([]byte(testReview), &review))
+
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	assert.True(t, resp.Allowed)
+}
+
+func TestUserProvidedPatch(t *testing.T) {
+	// create a Rule
+	rule := Rule{
+		Matchers: Matchers{
+			LabelSelectors: []string{"author = david"},
+		},
+		Payload: Payload{
+			JSONPatch: "[ This is a user supplied patch ]",
+		},
+	}
+
+	// create a review request
+	var review = admission.AdmissionReview{}
+	err := json.Unmarshal([]byte(testReview), &review)
+	assert.NoError(t, err, "couldn't marshall a valid admission review object from test json")
+
+	// call Mutate
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	assert.Equal(t, true, resp.Allowed, "the request should be successful")
+	assert.NotNil(t, resp.Patch)
+	assert.Equal(t, []byte(rule.Payload.JSONPatch), resp.Patch, "the patch should be the user supplied one")
+}
+
+func TestRuleBlocksObject(t *testing.T) {
+	// create a Rule
+	rule := Rule{
+		Name: "I-dont-like-david",
+		Matchers: Matchers{
+			LabelSelectors: []string{"author = david"},
+		},
+		Payload: Payload{
+			Block: true,
+		},
+	}
+
+	// create a review request
+	var review = admission.AdmissionReview{}
+	err := json.Unmarshal([]byte(testReview), &review)
+	assert.NoError(t, err, "couldn't marshall a valid admission review object from test json")
+
+	// call Mutate
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	assert.Equal(t, false, resp.Allowed, "the request should not be allowed to proceed")
+	assert.Nil(t, resp.Patch, "the patch should be empty")
+	assert.Equal(t, metav1.StatusReasonForbidden, resp.Result.Reason, "the graffiti rule should forbid the create/update of the object")
+	assert.Equal(t, "blocked by kube-graffiti rule: I-dont-like-david", resp.Result.Message, "we should be able to see why the request has been blocked and by which rule")
+}
+
+func TestRuleQuarantinesObjectInsteadOfBlocking(t *testing.T) {
+	// create a Rule
+	rule := Rule{
+		Name: "quarantine-david",
+		Matchers: Matchers{
+			LabelSelectors: []string{"author = david"},
+		},
+		Payload: Payload{
+			Block:                         true,
+			Enforcement:                   "quarantine",
+			QuarantineLabelKey:            "policy.company.com/quarantined",
+			QuarantineReasonAnnotationKey: "policy.company.com/quarantine-reason",
+		},
+	}
+
+	// create a review request
+	var review = admission.AdmissionReview{}
+	err := json.Unmarshal([]byte(testReview), &review)
+	assert.NoError(t, err, "couldn't marshall a valid admission review object from test json")
+
+	// call Mutate
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	assert.Equal(t, true, resp.Allowed, "a quarantine-enforced block should allow the request through")
+	require.NotNil(t, resp.Patch, "the request should carry the quarantine marking as a patch")
+
+	var patch []map[string]interface{}
+	require.NoError(t, json.Unmarshal(resp.Patch, &patch))
+	var sawLabel, sawAnnotation bool
+	for _, op := range patch {
+		if op["path"] == "/metadata/labels" {
+			sawLabel = true
+			assert.Equal(t, rule.Name, op["value"].(map[string]interface{})["policy.company.com/quarantined"])
+		}
+		if op["path"] == "/metadata/annotations" {
+			sawAnnotation = true
+			assert.Equal(t, "blocked by kube-graffiti rule: quarantine-david", op["value"].(map[string]interface{})["policy.company.com/quarantine-reason"])
+		}
+	}
+	assert.True(t, sawLabel, "the patch should mark the object's labels")
+	assert.True(t, sawAnnotation, "the patch should mark the object's annotations with the block reason")
+
+	assert.Equal(t, int64(1), metrics.BlocksQuarantined.Count(rule.Name), "quarantining should be recorded as a quarantined block, not a denied one")
+	assert.Equal(t, int64(0), metrics.BlocksEnforced.Count(rule.Name), "quarantining should not also be recorded as a denied block")
+}
+
+func TestQuarantineEnforcementRequiresMarkerKeysToBeConfigured(t *testing.T) {
+	var source = `---
+block: true
+enforcement: quarantine
+`
+	var payload Payload
+	err := yaml.Unmarshal([]byte(source), &payload)
+	require.NoError(t, err, "the test payload should unmarshal")
+	err = payload.validate()
+	assert.EqualError(t, err, "enforcement: quarantine requires quarantine-label-key and quarantine-reason-annotation-key to be configured, either globally or on the rule")
+}
+
+func TestQuarantineEnforcementIsValidOnceMarkerKeysAreConfiguredOnTheRule(t *testing.T) {
+	var source = `---
+block: true
+enforcement: quarantine
+quarantine-label-key: policy.company.com/quarantined
+quarantine-reason-annotation-key: policy.company.com/quarantine-reason
+`
+	var payload Payload
+	err := yaml.Unmarshal([]byte(source), &payload)
+	require.NoError(t, err, "the test payload should unmarshal")
+	assert.NoError(t, payload.validate())
+}
+
+func TestInvalidEnforcementValueIsRejected(t *testing.T) {
+	var source = `---
+block: true
+enforcement: quietly-ignore
+`
+	var payload Payload
+	err := yaml.Unmarshal([]byte(source), &payload)
+	require.NoError(t, err, "the test payload should unmarshal")
+	err = payload.validate()
+	assert.EqualError(t, err, `invalid enforcement "quietly-ignore": must be "deny" or "quarantine"`)
+}
+
+func TestAddFinalizerWhenNoneExist(t *testing.T) {
+	rule := Rule{
+		Matchers: Matchers{LabelSelectors: []string{"author = david"}},
+		Payload: Payload{
+			Additions: Additions{
+				Finalizers: []string{"cleanup.acme.com"},
+			},
+		},
+	}
+
+	var review = admission.AdmissionReview{}
+	err := json.Unmarshal([]byte(testReview), &review)
+	assert.NoError(t, err, "couldn't marshall a valid admission review object from test json")
+
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	assert.Equal(t, true, resp.Allowed, "the request should be successful")
+	assert.NotNil(t, resp.Patch)
+	desired, _ := jsonpatch.FromString(`[ { "op": "add", "path": "/metadata/finalizers", "value": [ "cleanup.acme.com" ] } ]`)
+	actual, err := jsonpatch.FromString(string(resp.Patch))
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, desired.Operations, actual.Operations, "the finalizer array should be initialised")
+}
+
+func TestAddFinalizerAppendsToExisting(t *testing.T) {
+	rule := Rule{
+		Matchers: Matchers{LabelSelectors: []string{"author = david"}},
+		Payload: Payload{
+			Additions: Additions{
+				Finalizers: []string{"cleanup.acme.com"},
+			},
+		},
+	}
+
+	var review = admission.AdmissionReview{}
+	err := json.Unmarshal([]byte(testReviewWithFinalizers), &review)
+	assert.NoError(t, err, "couldn't marshall a valid admission review object from test json")
+
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	assert.Equal(t, true, resp.Allowed, "the request should be successful")
+	assert.NotNil(t, resp.Patch)
+	desired, _ := jsonpatch.FromString(`[ { "op": "add", "path": "/metadata/finalizers/-", "value": "cleanup.acme.com" } ]`)
+	actual, err := jsonpatch.FromString(string(resp.Patch))
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, desired.Operations, actual.Operations, "the new finalizer should be appended")
+}
+
+func TestDeleteFinalizer(t *testing.T) {
+	rule := Rule{
+		Matchers: Matchers{LabelSelectors: []string{"author = david"}},
+		Payload: Payload{
+			Deletions: Deletions{
+				Finalizers: []string{"existing.acme.com"},
+			},
+		},
+	}
+
+	var review = admission.AdmissionReview{}
+	err := json.Unmarshal([]byte(testReviewWithFinalizers), &review)
+	assert.NoError(t, err, "couldn't marshall a valid admission review object from test json")
+
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	assert.Equal(t, true, resp.Allowed, "the request should be successful")
+	assert.NotNil(t, resp.Patch)
+	desired, _ := jsonpatch.FromString(`[ { "op": "remove", "path": "/metadata/finalizers/0" } ]`)
+	actual, err := jsonpatch.FromString(string(resp.Patch))
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, desired.Operations, actual.Operations, "the existing finalizer should be removed")
+}
+
+func TestAddFinalizerToNamespaceFixture(t *testing.T) {
+	rule := Rule{
+		Matchers: Matchers{LabelSelectors: []string{"author = david"}},
+		Payload: Payload{
+			Additions: Additions{
+				Finalizers: []string{"cleanup.acme.com"},
+			},
+		},
+	}
+
+	var review = admission.AdmissionReview{}
+	err := json.Unmarshal([]byte(testReview), &review)
+	assert.NoError(t, err, "couldn't marshall a valid admission review object from test json")
+
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	assert.Equal(t, true, resp.Allowed, "the request should be successful")
+	assert.NotNil(t, resp.Patch)
+	desired, _ := jsonpatch.FromString(`[ { "op": "add", "path": "/metadata/finalizers", "value": [ "cleanup.acme.com" ] } ]`)
+	actual, err := jsonpatch.FromString(string(resp.Patch))
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, desired.Operations, actual.Operations, "the namespace fixture has no finalizers array yet, so it should be initialised")
+}
+
+const testReviewWithKubernetesFinalizer = `{
+	"kind":"AdmissionReview",
+	"apiVersion":"admission.k8s.io/v1beta1",
+	"request":{
+	   "uid":"69f7d25a-963e-11e8-a77c-08002753edac",
+	   "kind":{
+		  "group":"",
+		  "version":"v1",
+		  "kind":"Namespace"
+	   },
+	   "resource":{
+		  "group":"",
+		  "version":"v1",
+		  "resource":"namespaces"
+	   },
+	   "operation":"CREATE",
+	   "userInfo":{
+		  "username":"minikube-user",
+		  "groups":[
+			 "system:masters",
+			 "system:authenticated"
+		  ]
+	   },
+	   "object":{
+		  "metadata":{
+			 "name":"test-namespace",
+			 "creationTimestamp":null,
+			 "labels":{
+				 "author": "david",
+				 "group": "runtime"
+			 },
+			 "annotations":{
+				 "level": "v.special",
+				 "prometheus.io/path": "/metrics"
+			 },
+			 "finalizers": ["kubernetes"]
+		  },
+		  "spec":{
+
+		  },
+		  "status":{
+			 "phase":"Active"
+		  }
+	   }
+	}
+ }`
+
+func TestRemoveKubernetesFinalizerFromNamespaceFixture(t *testing.T) {
+	rule := Rule{
+		Matchers: Matchers{LabelSelectors: []string{"author = david"}},
+		Payload: Payload{
+			Deletions: Deletions{
+				Finalizers: []string{"kubernetes"},
+			},
+		},
+	}
+
+	var review = admission.AdmissionReview{}
+	err := json.Unmarshal([]byte(testReviewWithKubernetesFinalizer), &review)
+	assert.NoError(t, err, "couldn't marshall a valid admission review object from test json")
+
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	assert.Equal(t, true, resp.Allowed, "the request should be successful")
+	assert.NotNil(t, resp.Patch)
+	desired, _ := jsonpatch.FromString(`[ { "op": "remove", "path": "/metadata/finalizers/0" } ]`)
+	actual, err := jsonpatch.FromString(string(resp.Patch))
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, desired.Operations, actual.Operations, "the kubernetes finalizer should be removed by value, found at its current index")
+}
+
+const testReviewNamespaceWithSpecFinalizers = `{
+	"kind":"AdmissionReview",
+	"apiVersion":"admission.k8s.io/v1beta1",
+	"request":{
+	   "uid":"69f7d25a-963e-11e8-a77c-08002753edac",
+	   "kind":{
+		  "group":"",
+		  "version":"v1",
+		  "kind":"Namespace"
+	   },
+	   "resource":{
+		  "group":"",
+		  "version":"v1",
+		  "resource":"namespaces"
+	   },
+	   "operation":"CREATE",
+	   "userInfo":{
+		  "username":"minikube-user",
+		  "groups":[
+			 "system:masters",
+			 "system:authenticated"
+		  ]
+	   },
+	   "object":{
+		  "metadata":{
+			 "name":"test-namespace",
+			 "creationTimestamp":null,
+			 "labels":{
+				 "author": "david",
+				 "group": "runtime"
+			 }
+		  },
+		  "spec":{
+			 "finalizers": ["kubernetes"]
+		  },
+		  "status":{
+			 "phase":"Active"
+		  }
+	   }
+	}
+ }`
+
+// TestRemoveFinalizerFromNamespaceSpecFinalizers confirms that a Namespace carrying its finalizers
+// under spec.finalizers, rather than the usual metadata.finalizers, still has them matched and
+// removed - targeting spec.finalizers rather than metadata.finalizers in the resulting patch.
+func TestRemoveFinalizerFromNamespaceSpecFinalizers(t *testing.T) {
+	rule := Rule{
+		Matchers: Matchers{LabelSelectors: []string{"author = david"}},
+		Payload: Payload{
+			Deletions: Deletions{
+				Finalizers: []string{"kubernetes"},
+			},
+		},
+	}
+
+	var review = admission.AdmissionReview{}
+	err := json.Unmarshal([]byte(testReviewNamespaceWithSpecFinalizers), &review)
+	assert.NoError(t, err, "couldn't marshall a valid admission review object from test json")
+
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	assert.Equal(t, true, resp.Allowed, "the request should be successful")
+	assert.NotNil(t, resp.Patch)
+	desired, _ := jsonpatch.FromString(`[ { "op": "remove", "path": "/spec/finalizers/0" } ]`)
+	actual, err := jsonpatch.FromString(string(resp.Patch))
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, desired.Operations, actual.Operations, "the finalizer lives under spec.finalizers for this namespace, so it should be removed from there")
+}
+
+const testReviewDeploymentWithFinalizers = `{
+	"kind":"AdmissionReview",
+	"apiVersion":"admission.k8s.io/v1beta1",
+	"request":{
+	   "uid":"69f7d25a-963e-11e8-a77c-08002753edac",
+	   "kind":{"group":"apps","version":"v1","kind":"Deployment"},
+	   "resource":{"group":"apps","version":"v1","resource":"deployments"},
+	   "operation":"CREATE",
+	   "namespace":"default",
+	   "userInfo":{"username":"minikube-user"},
+	   "object":{
+		  "metadata":{"name":"api","namespace":"default","labels":{"author":"david"},"finalizers":["existing.acme.com"]},
+		  "spec":{"replicas":3},
+		  "status":{}
+	   }
+	}
+ }`
+
+// TestRemoveFinalizerFromDeploymentMetadataFinalizers confirms that, for a non-Namespace kind, a
+// finalizer under the usual metadata.finalizers is matched and removed from there exactly as before.
+func TestRemoveFinalizerFromDeploymentMetadataFinalizers(t *testing.T) {
+	rule := Rule{
+		Matchers: Matchers{LabelSelectors: []string{"author = david"}},
+		Payload: Payload{
+			Deletions: Deletions{
+				Finalizers: []string{"existing.acme.com"},
+			},
+		},
+	}
+
+	var review = admission.AdmissionReview{}
+	err := json.Unmarshal([]byte(testReviewDeploymentWithFinalizers), &review)
+	assert.NoError(t, err, "couldn't marshall a valid admission review object from test json")
+
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	assert.Equal(t, true, resp.Allowed, "the request should be successful")
+	assert.NotNil(t, resp.Patch)
+	desired, _ := jsonpatch.FromString(`[ { "op": "remove", "path": "/metadata/finalizers/0" } ]`)
+	actual, err := jsonpatch.FromString(string(resp.Patch))
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, desired.Operations, actual.Operations, "the existing finalizer should be removed from metadata.finalizers")
+}
+
+func TestInvalidFinalizerName(t *testing.T) {
+	var source = `---
+additions:
+  finalizers:
+  - "not a valid name!"
+`
+	var payload Payload
+	err := yaml.Unmarshal([]byte(source), &payload)
+	require.NoError(t, err, "the test payload should unmarshal")
+	err = payload.validate()
+	assert.Error(t, err)
+}
+
+const testReviewPodCreate = `{
+	"kind":"AdmissionReview",
+	"apiVersion":"admission.k8s.io/v1beta1",
+	"request":{
+	   "uid":"69f7d25a-963e-11e8-a77c-08002753edac",
+	   "kind":{"group":"","version":"v1","kind":"Pod"},
+	   "resource":{"group":"","version":"v1","resource":"pods"},
+	   "operation":"CREATE",
+	   "userInfo":{"username":"minikube-user"},
+	   "object":{
+		  "metadata":{"name":"test-pod","namespace":"default","labels":{"author":"david"}},
+		  "spec":{},
+		  "status":{}
+	   }
+	}
+ }`
+
+const testReviewPodUpdate = `{
+	"kind":"AdmissionReview",
+	"apiVersion":"admission.k8s.io/v1beta1",
+	"request":{
+	   "uid":"69f7d25a-963e-11e8-a77c-08002753edac",
+	   "kind":{"group":"","version":"v1","kind":"Pod"},
+	   "resource":{"group":"","version":"v1","resource":"pods"},
+	   "operation":"UPDATE",
+	   "userInfo":{"username":"minikube-user"},
+	   "object":{
+		  "metadata":{"name":"test-pod","namespace":"default","labels":{"author":"david"}},
+		  "spec":{},
+		  "status":{}
+	   }
+	}
+ }`
+
+const testReviewPodCreateWithSchedulingFields = `{
+	"kind":"AdmissionReview",
+	"apiVersion":"admission.k8s.io/v1beta1",
+	"request":{
+	   "uid":"69f7d25a-963e-11e8-a77c-08002753edac",
+	   "kind":{"group":"","version":"v1","kind":"Pod"},
+	   "resource":{"group":"","version":"v1","resource":"pods"},
+	   "operation":"CREATE",
+	   "userInfo":{"username":"minikube-user"},
+	   "object":{
+		  "metadata":{"name":"test-pod","namespace":"default","labels":{"author":"david"}},
+		  "spec":{
+			 "nodeSelector":{"disktype":"ssd"},
+			 "schedulingGates":[{"name":"example.com/vendor-gate"}]
+		  },
+		  "status":{}
+	   }
+	}
+ }`
+
+func TestAddSchedulingGateWhenNoneExist(t *testing.T) {
+	rule := Rule{
+		Matchers: Matchers{LabelSelectors: []string{"author = david"}},
+		Payload: Payload{
+			Additions: Additions{
+				SchedulingGates: []string{"example.com/my-gate"},
+			},
+		},
+	}
+
+	var review = admission.AdmissionReview{}
+	err := json.Unmarshal([]byte(testReviewPodCreate), &review)
+	assert.NoError(t, err, "couldn't marshall a valid admission review object from test json")
+
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	assert.Equal(t, true, resp.Allowed, "the request should be successful")
+	assert.NotNil(t, resp.Patch)
+	desired, _ := jsonpatch.FromString(`[ { "op": "add", "path": "/spec/schedulingGates", "value": [ { "name": "example.com/my-gate" } ] } ]`)
+	actual, err := jsonpatch.FromString(string(resp.Patch))
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, desired.Operations, actual.Operations, "the scheduling gates array should be initialised")
+}
+
+func TestAddSchedulingGateAppendsToExisting(t *testing.T) {
+	rule := Rule{
+		Matchers: Matchers{LabelSelectors: []string{"author = david"}},
+		Payload: Payload{
+			Additions: Additions{
+				SchedulingGates: []string{"example.com/my-gate"},
+			},
+		},
+	}
+
+	var review = admission.AdmissionReview{}
+	err := json.Unmarshal([]byte(testReviewPodCreateWithSchedulingFields), &review)
+	assert.NoError(t, err, "couldn't marshall a valid admission review object from test json")
+
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	assert.Equal(t, true, resp.Allowed, "the request should be successful")
+	assert.NotNil(t, resp.Patch)
+	desired, _ := jsonpatch.FromString(`[ { "op": "add", "path": "/spec/schedulingGates/-", "value": { "name": "example.com/my-gate" } } ]`)
+	actual, err := jsonpatch.FromString(string(resp.Patch))
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, desired.Operations, actual.Operations, "the new gate should be appended")
+}
+
+func TestAddSchedulingGateAlreadyPresentProducesNoPatch(t *testing.T) {
+	rule := Rule{
+		Matchers: Matchers{LabelSelectors: []string{"author = david"}},
+		Payload: Payload{
+			Additions: Additions{
+				SchedulingGates: []string{"example.com/vendor-gate"},
+			},
+		},
+	}
+
+	var review = admission.AdmissionReview{}
+	err := json.Unmarshal([]byte(testReviewPodCreateWithSchedulingFields), &review)
+	assert.NoError(t, err, "couldn't marshall a valid admission review object from test json")
+
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	assert.True(t, resp.Allowed)
+	assert.Nil(t, resp.Patch, "the gate is already present, so nothing should be patched")
+}
+
+func TestAddNodeSelectorWhenNoneExist(t *testing.T) {
+	rule := Rule{
+		Matchers: Matchers{LabelSelectors: []string{"author = david"}},
+		Payload: Payload{
+			Additions: Additions{
+				NodeSelector: map[string]string{"disktype": "ssd"},
+			},
+		},
+	}
+
+	var review = admission.AdmissionReview{}
+	err := json.Unmarshal([]byte(testReviewPodCreate), &review)
+	assert.NoError(t, err, "couldn't marshall a valid admission review object from test json")
+
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	assert.Equal(t, true, resp.Allowed, "the request should be successful")
+	assert.NotNil(t, resp.Patch)
+	desired, _ := jsonpatch.FromString(`[ { "op": "add", "path": "/spec/nodeSelector", "value": { "disktype": "ssd" } } ]`)
+	actual, err := jsonpatch.FromString(string(resp.Patch))
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, desired.Operations, actual.Operations, "the node selector map should be initialised")
+}
+
+func TestAddNodeSelectorMergesWithExisting(t *testing.T) {
+	rule := Rule{
+		Matchers: Matchers{LabelSelectors: []string{"author = david"}},
+		Payload: Payload{
+			Additions: Additions{
+				NodeSelector: map[string]string{"zone": "eu-west-1a"},
+			},
+		},
+	}
+
+	var review = admission.AdmissionReview{}
+	err := json.Unmarshal([]byte(testReviewPodCreateWithSchedulingFields), &review)
+	assert.NoError(t, err, "couldn't marshall a valid admission review object from test json")
+
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	assert.Equal(t, true, resp.Allowed, "the request should be successful")
+	assert.NotNil(t, resp.Patch)
+	desired, _ := jsonpatch.FromString(`[ { "op": "replace", "path": "/spec/nodeSelector", "value": { "disktype": "ssd", "zone": "eu-west-1a" } } ]`)
+	actual, err := jsonpatch.FromString(string(resp.Patch))
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, desired.Operations, actual.Operations, "the existing entry should be kept and the new one merged in")
+}
+
+func TestSchedulingAdditionsAreSkippedOnUpdate(t *testing.T) {
+	rule := Rule{
+		Matchers: Matchers{LabelSelectors: []string{"author = david"}},
+		Payload: Payload{
+			Additions: Additions{
+				SchedulingGates: []string{"example.com/my-gate"},
+				NodeSelector:    map[string]string{"disktype": "ssd"},
+			},
+		},
+	}
+
+	var review = admission.AdmissionReview{}
+	err := json.Unmarshal([]byte(testReviewPodUpdate), &review)
+	assert.NoError(t, err, "couldn't marshall a valid admission review object from test json")
+
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	assert.True(t, resp.Allowed)
+	assert.Nil(t, resp.Patch, "scheduling-gates/node-selector additions only apply on a Pod's own CREATE")
+}
+
+func TestSchedulingAdditionsAreSkippedForNonPodKinds(t *testing.T) {
+	rule := Rule{
+		Matchers: Matchers{LabelSelectors: []string{"author = david"}},
+		Payload: Payload{
+			Additions: Additions{
+				SchedulingGates: []string{"example.com/my-gate"},
+			},
+		},
+	}
+
+	var review = admission.AdmissionReview{}
+	err := json.Unmarshal([]byte(testReview), &review)
+	assert.NoError(t, err, "couldn't marshall a valid admission review object from test json")
+
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	assert.True(t, resp.Allowed)
+	assert.Nil(t, resp.Patch, "scheduling-gates/node-selector additions only ever apply to Pods")
+}
+
+func TestSchedulingAdditionsAreSkippedOnExistingCheck(t *testing.T) {
+	rule := Rule{
+		Payload: Payload{
+			Additions: Additions{
+				SchedulingGates: []string{"example.com/my-gate"},
+			},
+		},
+	}
+
+	object := `{"kind":"Pod","metadata":{"name":"test-pod","namespace":"default"},"spec":{},"status":{}}`
+	patch, err := rule.Mutate(context.Background(), []byte(object))
+	assert.NoError(t, err)
+	assert.Nil(t, patch, "an existing-objects sweep has no admission operation, so it is never treated as a CREATE")
+}
+
+func TestInvalidSchedulingGateName(t *testing.T) {
+	var source = `---
+additions:
+  scheduling-gates:
+  - "not a valid name!"
+`
+	var payload Payload
+	err := yaml.Unmarshal([]byte(source), &payload)
+	require.NoError(t, err, "the test payload should unmarshal")
+	err = payload.validate()
+	assert.Error(t, err)
+}
+
+func TestInvalidNodeSelectorValue(t *testing.T) {
+	var source = `---
+additions:
+  node-selector:
+    disktype: "not a valid value!"
+`
+	var payload Payload
+	err := yaml.Unmarshal([]byte(source), &payload)
+	require.NoError(t, err, "the test payload should unmarshal")
+	err = payload.validate()
+	assert.Error(t, err)
+}
+
+func TestJSONPatchCannotTouchNodeName(t *testing.T) {
+	var source = `---
+json-patch: |
+  [ { "op": "replace", "path": "/spec/nodeName", "value": "node-1" } ]
+`
+	var payload Payload
+	err := yaml.Unmarshal([]byte(source), &payload)
+	require.NoError(t, err, "the test payload should unmarshal")
+	err = payload.validate()
+	assert.Error(t, err)
+}
+
+func TestSetOnceFirstSet(t *testing.T) {
+	rule := Rule{
+		Matchers: Matchers{LabelSelectors: []string{"author = david"}},
+		Payload: Payload{
+			Additions: Additions{
+				Labels:        map[string]string{"creation-cohort": "2024-q3"},
+				SetOnceLabels: []string{"creation-cohort"},
+			},
+		},
+	}
+
+	var review = admission.AdmissionReview{}
+	err := json.Unmarshal([]byte(testReview), &review)
+	assert.NoError(t, err, "couldn't marshall a valid admission review object from test json")
+
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	assert.Equal(t, true, resp.Allowed, "the request should be successful")
+	assert.NotNil(t, resp.Patch, "the label should be set as it is not yet present")
+}
+
+func TestSetOnceSkipsWhenKeyAlreadyPresent(t *testing.T) {
+	rule := Rule{
+		Matchers: Matchers{LabelSelectors: []string{"author = david"}},
+		Payload: Payload{
+			Additions: Additions{
+				Labels:        map[string]string{"author": "someone-else"},
+				SetOnceLabels: []string{"author"},
+			},
+		},
+	}
+
+	var review = admission.AdmissionReview{}
+	err := json.Unmarshal([]byte(testReview), &review)
+	assert.NoError(t, err, "couldn't marshall a valid admission review object from test json")
+
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	assert.Equal(t, true, resp.Allowed, "the request should be successful")
+	assert.Nil(t, resp.Patch, "the existing author label must not be overwritten by a set-once addition")
+}
+
+func TestSetOnceDeletionStillOverrides(t *testing.T) {
+	rule := Rule{
+		Matchers: Matchers{LabelSelectors: []string{"author = david"}},
+		Payload: Payload{
+			Deletions: Deletions{
+				Labels: []string{"author"},
+			},
+		},
+	}
+
+	var review = admission.AdmissionReview{}
+	err := json.Unmarshal([]byte(testReview), &review)
+	assert.NoError(t, err, "couldn't marshall a valid admission review object from test json")
+
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	assert.Equal(t, true, resp.Allowed, "the request should be successful")
+	assert.NotNil(t, resp.Patch, "an explicit deletion should still remove a set-once key")
+}
+
+func TestInvalidSetOnceKeyNotInAdditions(t *testing.T) {
+	var source = `---
+additions:
+  labels:
+    foo: "bar"
+  set-once-labels:
+  - "not-an-addition"
+`
+	var payload Payload
+	err := yaml.Unmarshal([]byte(source), &payload)
+	require.NoError(t, err, "the test payload should unmarshal")
+	err = payload.validate()
+	assert.EqualError(t, err, "invalid set-once: key \"not-an-addition\" is not present in additions")
+}
+
+func TestExplainAnnotationDescribesASetOnceSkip(t *testing.T) {
+	rule := Rule{
+		Matchers: Matchers{
+			LabelSelectors: []string{"author = david"},
+		},
+		Payload: Payload{
+			Additions: Additions{
+				Labels:        map[string]string{"author": "someone-else"},
+				SetOnceLabels: []string{"author"},
+			},
+			ExplainAnnotation: "kube-graffiti.io/explain",
+		},
+	}
+
+	var review = admission.AdmissionReview{}
+	err := json.Unmarshal([]byte(testReview), &review)
+	assert.NoError(t, err, "couldn't marshall a valid admission review object from test json")
+
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	assert.Equal(t, true, resp.Allowed, "the request should be successful")
+	require.NotNil(t, resp.Patch, "the explain annotation should still be added even though the set-once label addition is skipped")
+
+	desired, _ := jsonpatch.FromString(`[
+		{ "op": "replace", "path": "/metadata/annotations", "value": { "level": "v.special", "prometheus.io/path": "/metrics", "kube-graffiti.io/explain": "skipped: set-once and key present author" }}
+	]`)
+	actual, err := jsonpatch.FromString(string(resp.Patch))
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, desired.Operations, actual.Operations, "the explain annotation should describe the set-once skip")
+}
+
+func TestConditionalAdditionAppliedWhenConditionMatches(t *testing.T) {
+	rule := Rule{
+		Payload: Payload{
+			Additions: Additions{
+				ConditionalAdditions: []ConditionalAddition{
+					{Key: "special", Value: "true", Condition: "metadata.annotations.level=v.special"},
+				},
+			},
+		},
+	}
+
+	var review = admission.AdmissionReview{}
+	err := json.Unmarshal([]byte(testReview), &review)
+	assert.NoError(t, err, "couldn't marshall a valid admission review object from test json")
+
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	assert.Equal(t, true, resp.Allowed, "the request should be successful")
+	desired, _ := jsonpatch.FromString(`[ { "op": "replace", "path": "/metadata/labels", "value": { "author": "david", "group": "runtime", "special": "true" }} ]`)
+	actual, _ := jsonpatch.FromString(string(resp.Patch))
+	assert.ElementsMatch(t, desired.Operations, actual.Operations, "the conditional label should be added as the condition matches")
+}
+
+func TestConditionalAdditionSkippedWhenConditionDoesNotMatch(t *testing.T) {
+	rule := Rule{
+		Payload: Payload{
+			Additions: Additions{
+				ConditionalAdditions: []ConditionalAddition{
+					{Key: "special", Value: "true", Condition: "metadata.annotations.level=not-very-special"},
+				},
+			},
+		},
+	}
+
+	var review = admission.AdmissionReview{}
+	err := json.Unmarshal([]byte(testReview), &review)
+	assert.NoError(t, err, "couldn't marshall a valid admission review object from test json")
+
+	resp := rule.MutateAdmission(context.Background(), review.Request)
+	assert.Equal(t, true, resp.Allowed, "the request should be successful")
+	assert.Nil(t, resp.Patch, "the conditional label should be skipped as the condition does not match")
+}
+
+func TestInvalidConditionalAdditionCondition(t *testing.T) {
+	var source = `---
+additions:
+  conditional-additions:
+  - key: "special"
+    value: "true"
+    condition: "this is not a valid selector"
+`
+	var payload Payload
+	err := yaml.Unmarshal([]byte(source), &payload)
+	require.NoError(t, err, "the test payload should unmarshal")
+	err = payload.validate()
+	assert.Error(t, err, "an invalid condition field selector should fail validation")
+}
+
+func controllerRef(kind string) metav1.OwnerReference {
+	isController := true
+	return metav1.OwnerReference{Kind: kind, Controller: &isController}
+}
+
+func TestShouldSkipControllerOwnedSkipsAKnownRevertProneOwnerDuringTheExistingSweep(t *testing.T) {
+	var p Payload
+	skip, ownerKind := p.ShouldSkipControllerOwned("Pod", []metav1.OwnerReference{controllerRef("ReplicaSet")}, true)
+	assert.True(t, skip)
+	assert.Equal(t, "ReplicaSet", ownerKind)
+}
+
+func TestShouldSkipControllerOwnedDoesNotSkipABareObject(t *testing.T) {
+	var p Payload
+	skip, ownerKind := p.ShouldSkipControllerOwned("Pod", nil, true)
+	assert.False(t, skip)
+	assert.Equal(t, "", ownerKind)
+}
+
+func TestShouldSkipControllerOwnedIgnoresAnOwnerThatIsNotTheController(t *testing.T) {
+	var p Payload
+	notController := false
+	refs := []metav1.OwnerReference{{Kind: "ReplicaSet", Controller: &notController}}
+	skip, _ := p.ShouldSkipControllerOwned("Pod", refs, true)
+	assert.False(t, skip)
+}
+
+func TestShouldSkipControllerOwnedDoesNotApplyToAdmissionByDefault(t *testing.T) {
+	var p Payload
+	skip, _ := p.ShouldSkipControllerOwned("Pod", []metav1.OwnerReference{controllerRef("ReplicaSet")}, false)
+	assert.False(t, skip, "admission only applies the skip when the rule opts in with SkipControllerOwned")
+}
+
+func TestShouldSkipControllerOwnedAppliesToAdmissionWhenOptedIn(t *testing.T) {
+	p := Payload{SkipControllerOwned: true}
+	skip, ownerKind := p.ShouldSkipControllerOwned("Pod", []metav1.OwnerReference{controllerRef("ReplicaSet")}, false)
+	assert.True(t, skip)
+	assert.Equal(t, "ReplicaSet", ownerKind)
+}
+
+func TestMutateControllerOwnedOverridesTheExistingSweepDefaultSkip(t *testing.T) {
+	p := Payload{MutateControllerOwned: true}
+	skip, _ := p.ShouldSkipControllerOwned("Pod", []metav1.OwnerReference{controllerRef("ReplicaSet")}, true)
+	assert.False(t, skip)
+}
+
+// TestDelegateAppliesThePatchReturnedByTheExternalService confirms that a delegate payload POSTs the
+// matched object to the configured URL and applies the JSON patch the external service returns.
+func TestDelegateAppliesThePatchReturnedByTheExternalService(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var received map[string]interface{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&received))
+		assert.Equal(t, "my-deployment", received["metadata"].(map[string]interface{})["name"])
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(DelegateResponse{Patch: `[ { "op": "add", "path": "/metadata/labels", "value": { "delegated": "true" } } ]`})
+	}))
+	defer server.Close()
+
+	p := Payload{Delegate: Delegate{URL: server.URL}}
+	current := []byte(`{ "metadata": { "name": "my-deployment" } }`)
+
+	patch, err := p.paintObject(metaObject{}, map[string]string{}, current, "delegate-rule", nil, "", log.Logger)
+	require.NoError(t, err)
+	assert.JSONEq(t, `[ { "op": "add", "path": "/metadata/labels", "value": { "delegated": "true" } } ]`, string(patch))
+}
+
+// TestDelegateBlockProducesTheSameBlockResultAsABlockPayload confirms that a delegate's block decision
+// is surfaced through the same blockPatchPrefix sentinel a native Block payload uses, message included.
+func TestDelegateBlockProducesTheSameBlockResultAsABlockPayload(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(DelegateResponse{Block: true, Message: "denied by policy engine"})
+	}))
+	defer server.Close()
+
+	p := Payload{Delegate: Delegate{URL: server.URL}}
+	patch, err := p.paintObject(metaObject{}, map[string]string{}, []byte(`{}`), "delegate-rule", nil, "", log.Logger)
+	require.NoError(t, err)
+	assert.True(t, IsBlockPatch(patch))
+	message, ok := BlockPatchMessage(patch)
+	require.True(t, ok)
+	assert.Equal(t, "denied by policy engine", message)
+}
+
+// TestDelegateTimeoutIsAllowedThroughByDefault confirms that an external service which never responds
+// within Delegate.Timeout leaves the object unpatched rather than failing the admission request, since
+// the default error-policy is "allow".
+func TestDelegateTimeoutIsAllowedThroughByDefault(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	p := Payload{Delegate: Delegate{URL: server.URL, Timeout: "1ms"}}
+	patch, err := p.paintObject(metaObject{}, map[string]string{}, []byte(`{}`), "delegate-timeout-rule", nil, "", log.Logger)
+	require.NoError(t, err, "the default error-policy should allow the object through rather than fail the rule")
+	assert.Nil(t, patch)
+}
+
+// TestDelegateTimeoutFailsTheRuleUnderDenyErrorPolicy confirms that error-policy: deny turns a timed
+// out delegate call into a rule error, the same way it does for an oversized computed patch.
+func TestDelegateTimeoutFailsTheRuleUnderDenyErrorPolicy(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	p := Payload{Delegate: Delegate{URL: server.URL, Timeout: "1ms"}, ErrorPolicy: "deny"}
+	_, err := p.paintObject(metaObject{}, map[string]string{}, []byte(`{}`), "delegate-timeout-rule", nil, "", log.Logger)
+	assert.Error(t, err)
+}
+
+func TestValidateDelegateRejectsAMalformedURL(t *testing.T) {
+	assert.Error(t, validateDelegate(Delegate{URL: "not-a-url"}))
+}
+
+func TestValidateDelegateRejectsAnUnparseableTimeout(t *testing.T) {
+	assert.Error(t, validateDelegate(Delegate{URL: "http://example.com/decide", Timeout: "not-a-duration"}))
+}
+
+func TestValidateDelegateAcceptsAWellFormedURLAndTimeout(t *testing.T) {
+	assert.NoError(t, validateDelegate(Delegate{URL: "https://example.com/decide", Timeout: "2s"}))
+}
+
+func TestPayloadWithADelegateAndAdditionsFailsValidation(t *testing.T) {
+	p := Payload{Delegate: Delegate{URL: "https://example.com/decide"}, Additions: Additions{Labels: map[string]string{"a": "b"}}}
+	assert.Error(t, p.validate(), "a payload can't combine a delegate with any other payload type")
+}
+
+const testReviewWithFinalizers = `{
+	"kind":"AdmissionReview",
+	"apiVersion":"admission.k8s.io/v1beta1",
+	"request":{
+	   "uid":"69f7d25a-963e-11e8-a77c-08002753edac",
+	   "kind":{
+		  "group":"",
+		  "version":"v1",
+		  "kind":"Namespace"
+	   },
+	   "resource":{
+		  "group":"",
+		  "version":"v1",
+		  "resource":"namespaces"
+	   },
+	   "operation":"CREATE",
+	   "userInfo":{
+		  "username":"minikube-user",
+		  "groups":[
+			 "system:masters",
+			 "system:authenticated"
+		  ]
+	   },
+	   "object":{
+		  "metadata":{
+			 "name":"test-namespace",
+			 "creationTimestamp":null,
+			 "labels":{
+				 "author": "david",
+				 "group": "runtime"
+			 },
+			 "annotations":{
+				 "level": "v.special",
+				 "prometheus.io/path": "/metrics"
+			 },
+			 "finalizers": ["existing.acme.com"]
+		  },
+		  "spec":{
+
+		  },
+		  "status":{
+			 "phase":"Active"
+		  }
+	   }
+	}
+ }`
@@ -0,0 +1,134 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package graffiti
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Ramp matches only a stable, growing subset of objects, for progressively rolling a rule out across
+// repeated reconciles rather than having it take effect on every matching object at once. Duration is
+// how long the ramp takes to climb from 0% to 100% of objects; StartedAt optionally pins when the ramp
+// began (RFC3339) - useful for giving every kube-graffiti replica, and a replica that restarts
+// mid-ramp, the same start time. Left unset, the ramp starts from the first time the rule is evaluated
+// at all, tracked in-process by globalRampTracker - like Budget, that start time is lost on restart,
+// so a restarting pod currently mid-ramp restarts its ramp from 0% too. The zero value disables ramping
+// entirely, so a rule matches every object it otherwise would, same as before this field existed.
+type Ramp struct {
+	Duration  string `mapstructure:"duration" yaml:"duration,omitempty"`
+	StartedAt string `mapstructure:"started-at" yaml:"started-at,omitempty"`
+}
+
+// enabled reports whether r actually configures a ramp - the zero value is a no-op.
+func (r Ramp) enabled() bool {
+	return r.Duration != ""
+}
+
+// duration parses r.Duration.
+func (r Ramp) duration() (time.Duration, error) {
+	return time.ParseDuration(r.Duration)
+}
+
+// validate checks that r's fields, if set, parse.
+func (r Ramp) validate() error {
+	if !r.enabled() {
+		return nil
+	}
+	if _, err := r.duration(); err != nil {
+		return fmt.Errorf("ramp duration %q is invalid: %v", r.Duration, err)
+	}
+	if r.StartedAt != "" {
+		if _, err := time.Parse(time.RFC3339, r.StartedAt); err != nil {
+			return fmt.Errorf("ramp started-at %q is invalid, must be RFC3339: %v", r.StartedAt, err)
+		}
+	}
+	return nil
+}
+
+// startedAt returns when ruleName's ramp began: r.StartedAt when configured, otherwise the time
+// tracker first recorded for ruleName, recording now as that time if this is the first call for it.
+func (r Ramp) startedAt(ruleName string, tracker *rampTracker, now time.Time) time.Time {
+	if r.StartedAt != "" {
+		if t, err := time.Parse(time.RFC3339, r.StartedAt); err == nil {
+			return t
+		}
+	}
+	return tracker.startTime(ruleName, now)
+}
+
+// percentComplete returns how far through duration elapsed is, as a percentage clamped to [0, 100].
+// A non-positive duration is treated as already fully ramped, rather than dividing by zero.
+func percentComplete(elapsed, duration time.Duration) int {
+	if duration <= 0 {
+		return 100
+	}
+	percent := int(elapsed * 100 / duration)
+	switch {
+	case percent < 0:
+		return 0
+	case percent > 100:
+		return 100
+	default:
+		return percent
+	}
+}
+
+// stableBucket deterministically maps key into [0, 100) using the same hash this package already
+// uses for truncateLabelValue, so that the same key always lands in the same bucket - across
+// restarts, replicas and repeated reconciles of the same object - and the set of objects a ramp has
+// turned on only ever grows as its percentage climbs, never churns at a fixed percentage.
+func stableBucket(key string) int {
+	sum := sha256.Sum256([]byte(key))
+	return int(binary.BigEndian.Uint32(sum[:4]) % 100)
+}
+
+// matches reports whether obj falls within ruleName's ramp as of now: its stable bucket must be
+// below the percentage of the ramp duration that has elapsed since the ramp started.
+func (r Ramp) matches(ruleName string, obj metaObject, tracker *rampTracker, now time.Time) (bool, error) {
+	duration, err := r.duration()
+	if err != nil {
+		return false, err
+	}
+	start := r.startedAt(ruleName, tracker, now)
+	percent := percentComplete(now.Sub(start), duration)
+	bucket := stableBucket(ruleName + "|" + obj.Meta.Namespace + "/" + obj.Meta.Name)
+	return bucket < percent, nil
+}
+
+// rampTracker remembers when a rule's ramp first began, shared by every graffiti.Rule value for a
+// given rule name - Rule is constructed fresh at each admission request and each existing-objects
+// sweep, so the start time can't live on the Rule value itself. It follows the same package-level,
+// mutex-guarded map shape as budgetTracker.
+type rampTracker struct {
+	mu        sync.Mutex
+	startedAt map[string]time.Time
+}
+
+var globalRampTracker = &rampTracker{startedAt: make(map[string]time.Time)}
+
+// startTime returns the time ruleName's ramp began, recording now as that time the first time it is
+// asked for a given rule and returning the same time on every subsequent call.
+func (t *rampTracker) startTime(ruleName string, now time.Time) time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if start, ok := t.startedAt[ruleName]; ok {
+		return start
+	}
+	t.startedAt[ruleName] = now
+	return now
+}
@@ -0,0 +1,142 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package graffiti
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPercentCompleteClampsBetweenZeroAndOneHundred(t *testing.T) {
+	assert.Equal(t, 0, percentComplete(-time.Minute, time.Hour), "elapsed before the ramp started should never be negative")
+	assert.Equal(t, 0, percentComplete(0, time.Hour))
+	assert.Equal(t, 50, percentComplete(30*time.Minute, time.Hour))
+	assert.Equal(t, 100, percentComplete(time.Hour, time.Hour))
+	assert.Equal(t, 100, percentComplete(2*time.Hour, time.Hour), "elapsed should never be reported as more than fully ramped")
+}
+
+func TestPercentCompleteTreatsANonPositiveDurationAsFullyRamped(t *testing.T) {
+	assert.Equal(t, 100, percentComplete(time.Minute, 0))
+}
+
+func TestStableBucketIsDeterministic(t *testing.T) {
+	assert.Equal(t, stableBucket("my-rule|default/my-pod"), stableBucket("my-rule|default/my-pod"))
+}
+
+func TestStableBucketIsWithinRange(t *testing.T) {
+	for _, key := range []string{"a", "b", "c", "my-rule|default/my-pod", "my-rule|kube-system/other"} {
+		bucket := stableBucket(key)
+		assert.True(t, bucket >= 0 && bucket < 100, "bucket %d for %q should be in [0, 100)", bucket, key)
+	}
+}
+
+func TestRampTrackerRecordsTheFirstStartTimeAndKeepsIt(t *testing.T) {
+	tracker := &rampTracker{startedAt: make(map[string]time.Time)}
+	first := time.Unix(1000, 0)
+	later := time.Unix(2000, 0)
+
+	assert.Equal(t, first, tracker.startTime("my-rule", first))
+	assert.Equal(t, first, tracker.startTime("my-rule", later), "a later call must still report the first-ever start time for this rule")
+}
+
+func TestRampTrackerTracksRulesSeparately(t *testing.T) {
+	tracker := &rampTracker{startedAt: make(map[string]time.Time)}
+	a := time.Unix(1000, 0)
+	b := time.Unix(2000, 0)
+
+	assert.Equal(t, a, tracker.startTime("rule-a", a))
+	assert.Equal(t, b, tracker.startTime("rule-b", b))
+}
+
+func TestRampValidateAllowsTheZeroValue(t *testing.T) {
+	assert.NoError(t, Ramp{}.validate())
+}
+
+func TestRampValidateRejectsAnUnparseableDuration(t *testing.T) {
+	assert.Error(t, Ramp{Duration: "not-a-duration"}.validate())
+}
+
+func TestRampValidateRejectsAnUnparseableStartedAt(t *testing.T) {
+	assert.Error(t, Ramp{Duration: "1h", StartedAt: "not-a-timestamp"}.validate())
+}
+
+func TestRampValidateAcceptsAValidDurationAndStartedAt(t *testing.T) {
+	assert.NoError(t, Ramp{Duration: "1h", StartedAt: "2020-01-01T00:00:00Z"}.validate())
+}
+
+// TestRampIncludesFewerObjectsEarlyAndAllObjectsOnceComplete confirms the acceptance scenario: a ramp
+// started now, evaluated against a fixed set of objects, includes only some of them shortly after
+// starting and all of them once the configured duration has fully elapsed.
+func TestRampIncludesFewerObjectsEarlyAndAllObjectsOnceComplete(t *testing.T) {
+	tracker := &rampTracker{startedAt: make(map[string]time.Time)}
+	start := time.Unix(1000, 0)
+	ramp := Ramp{Duration: "1h"}
+	tracker.startTime("my-rule", start)
+
+	objects := make([]metaObject, 0, 200)
+	for i := 0; i < 200; i++ {
+		mo := metaObject{}
+		mo.Meta.Namespace = "default"
+		mo.Meta.Name = fmt.Sprintf("object-%d", i)
+		objects = append(objects, mo)
+	}
+
+	countMatches := func(now time.Time) int {
+		count := 0
+		for _, obj := range objects {
+			matched, err := ramp.matches("my-rule", obj, tracker, now)
+			require.NoError(t, err)
+			if matched {
+				count++
+			}
+		}
+		return count
+	}
+
+	early := countMatches(start.Add(6 * time.Minute))     // 10% of the way through
+	mid := countMatches(start.Add(30 * time.Minute))      // 50% of the way through
+	complete := countMatches(start.Add(90 * time.Minute)) // past the end of the ramp
+
+	assert.True(t, early < mid, "fewer objects should match early in the ramp than half way through")
+	assert.True(t, mid < complete, "fewer objects should match half way through than once the ramp has completed")
+	assert.Equal(t, len(objects), complete, "every object should match once the ramp duration has fully elapsed")
+}
+
+func TestRampMatchesTheSameObjectConsistentlyAtAFixedPercentage(t *testing.T) {
+	tracker := &rampTracker{startedAt: make(map[string]time.Time)}
+	start := time.Unix(1000, 0)
+	ramp := Ramp{Duration: "1h"}
+	mo := metaObject{}
+	mo.Meta.Namespace = "default"
+	mo.Meta.Name = "my-pod"
+
+	first, err := ramp.matches("my-rule", mo, tracker, start.Add(10*time.Minute))
+	require.NoError(t, err)
+	second, err := ramp.matches("my-rule", mo, tracker, start.Add(10*time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, first, second, "the same object evaluated at the same point in the ramp should always get the same answer")
+}
+
+func TestRampStartedAtOverridesTheTracker(t *testing.T) {
+	tracker := &rampTracker{startedAt: make(map[string]time.Time)}
+	ramp := Ramp{Duration: "1h", StartedAt: "2020-01-01T00:00:00Z"}
+	configuredStart, _ := time.Parse(time.RFC3339, ramp.StartedAt)
+
+	assert.Equal(t, configuredStart, ramp.startedAt("my-rule", tracker, time.Unix(999999, 0)), "an explicit started-at should be used instead of recording a fresh tracker entry")
+	assert.Empty(t, tracker.startedAt, "the tracker should never be written to when started-at is explicitly configured")
+}
@@ -0,0 +1,205 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package graffiti
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/rs/zerolog"
+	utilvalidation "k8s.io/apimachinery/pkg/util/validation"
+)
+
+// podSpec is the narrow slice of a Pod's spec.* that the scheduling-gate/node-selector addition
+// helpers, the spec.nodeName patch guard and the has-container/missing-container/has-volume-type
+// matchers need. Decoding a non-Pod object into it is harmless - its fields are simply left at their
+// zero values.
+type podSpec struct {
+	NodeName        string              `json:"nodeName,omitempty"`
+	NodeSelector    map[string]string   `json:"nodeSelector,omitempty"`
+	SchedulingGates []podSchedulingGate `json:"schedulingGates,omitempty"`
+	Containers      []podContainer      `json:"containers,omitempty"`
+	InitContainers  []podContainer      `json:"initContainers,omitempty"`
+	Volumes         []podVolume         `json:"volumes,omitempty"`
+	// Finalizers is only ever populated for a Namespace, whose spec.finalizers carries the
+	// kube-controller-manager's own finalizer names - see metaObject.existingFinalizers.
+	Finalizers []string `json:"finalizers,omitempty"`
+}
+
+type podSchedulingGate struct {
+	Name string `json:"name"`
+}
+
+type podContainer struct {
+	Name string `json:"name"`
+}
+
+// podVolume captures a single spec.volumes[] entry loosely enough to tell which volume source type
+// it uses - "hostPath", "emptyDir" and so on are simply the keys a volume's source is nested under,
+// and there's no need for a dedicated field per type just to detect which one is present. "name" is
+// the one key of a volume entry that is never itself a type.
+type podVolume map[string]json.RawMessage
+
+// hasType reports whether this volume's source is of the given type, i.e. whether typeName appears
+// among its keys other than "name".
+func (v podVolume) hasType(typeName string) bool {
+	if typeName == "name" {
+		return false
+	}
+	_, ok := v[typeName]
+	return ok
+}
+
+// hasContainerNamed reports whether name appears among spec's containers or initContainers.
+func (p podSpec) hasContainerNamed(name string) bool {
+	for _, c := range p.Containers {
+		if c.Name == name {
+			return true
+		}
+	}
+	for _, c := range p.InitContainers {
+		if c.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// hasVolumeType reports whether any of spec's volumes is of the given type, e.g. "hostPath".
+func (p podSpec) hasVolumeType(typeName string) bool {
+	for _, v := range p.Volumes {
+		if v.hasType(typeName) {
+			return true
+		}
+	}
+	return false
+}
+
+// processSchedulingAdditions builds the JSON patch operations for a payload's scheduling-gates and
+// node-selector additions. These exist to let a rule gate or steer a Pod's initial scheduling
+// decision, which is only ever safe to do on its own CREATE - changing either field afterwards fights
+// a scheduler that has already acted on the Pod's original spec - so both are skipped, with a logged
+// reason, for any other kind or admission operation (including the existing-objects sweep, which has
+// no admission operation and so is always treated as "not a CREATE").
+func (p Payload) processSchedulingAdditions(object metaObject, operation, ruleName string, mylog zerolog.Logger) (string, error) {
+	if len(p.Additions.SchedulingGates) == 0 && len(p.Additions.NodeSelector) == 0 {
+		return "", nil
+	}
+	if object.Kind != "Pod" {
+		mylog.Debug().Str("rule", ruleName).Str("kind", object.Kind).Msg("scheduling-gates/node-selector additions only apply to Pods, skipping")
+		return "", nil
+	}
+	if operation != "CREATE" {
+		mylog.Info().Str("rule", ruleName).Str("operation", operation).Msg("scheduling-gates/node-selector additions only apply on a Pod's own CREATE, skipping")
+		return "", nil
+	}
+
+	var patches []string
+	if len(p.Additions.SchedulingGates) > 0 {
+		if op := createSchedulingGatePatchOperations(object.Spec.SchedulingGates, p.Additions.SchedulingGates); op != "" {
+			patches = append(patches, op)
+		}
+	}
+	if len(p.Additions.NodeSelector) > 0 {
+		op, err := createPatchOperand(object.Spec.NodeSelector, p.Additions.NodeSelector, nil, nil, nil, nil, mylog, "/spec/nodeSelector", false, ruleName, p.ErrorPolicy, "", false)
+		if err != nil {
+			return "", err
+		}
+		if op != "" {
+			patches = append(patches, op)
+		}
+	}
+
+	return strings.Join(patches, ", "), nil
+}
+
+// createSchedulingGatePatchOperations builds the JSON patch operations needed to add new scheduling
+// gates to a Pod, in the same presence-aware style as createFinalizerPatchOperations: when the Pod has
+// no scheduling gates yet, a single "add" operation initialises the whole array; otherwise each new
+// gate is appended individually via an "add" operation targeting the "-" (end of array) index. A gate
+// already present by name is left untouched.
+func createSchedulingGatePatchOperations(existing []podSchedulingGate, add []string) string {
+	present := make(map[string]bool, len(existing))
+	for _, g := range existing {
+		present[g.Name] = true
+	}
+
+	var fresh []string
+	for _, g := range add {
+		if present[g] {
+			continue
+		}
+		present[g] = true
+		fresh = append(fresh, g)
+	}
+	if len(fresh) == 0 {
+		return ""
+	}
+
+	if len(existing) == 0 {
+		items := make([]string, len(fresh))
+		for i, g := range fresh {
+			items[i] = `{ "name": "` + escapeString(g) + `" }`
+		}
+		return `{ "op": "add", "path": "/spec/schedulingGates", "value": [` + strings.Join(items, ", ") + `] }`
+	}
+
+	ops := make([]string, len(fresh))
+	for i, g := range fresh {
+		ops[i] = fmt.Sprintf(`{ "op": "add", "path": "/spec/schedulingGates/-", "value": { "name": "%s" } }`, escapeString(g))
+	}
+	return strings.Join(ops, ", ")
+}
+
+// validateSchedulingGateNames checks that every scheduling gate name is a valid qualified name, the
+// same rule kubernetes itself applies to spec.schedulingGates[].name.
+func validateSchedulingGateNames(gates []string) error {
+	for _, g := range gates {
+		if errorList := utilvalidation.IsQualifiedName(g); len(errorList) != 0 {
+			return fmt.Errorf("invalid scheduling-gates: invalid name %q: %s", g, strings.Join(errorList, "; "))
+		}
+	}
+	return nil
+}
+
+// validateContainerName checks that a container name is a valid DNS label, the same rule kubernetes
+// itself applies to spec.containers[].name and spec.initContainers[].name.
+func validateContainerName(name string) error {
+	if errorList := utilvalidation.IsDNS1123Label(name); len(errorList) != 0 {
+		return fmt.Errorf("invalid name %q: %s", name, strings.Join(errorList, "; "))
+	}
+	return nil
+}
+
+// validateNodeSelectorAdditions checks that every node-selector key/value pair is a valid kubernetes
+// label key/value, the same rule kubernetes itself applies to spec.nodeSelector.
+func validateNodeSelectorAdditions(selector map[string]string) error {
+	for k, v := range selector {
+		if errorList := utilvalidation.IsQualifiedName(k); len(errorList) != 0 {
+			return fmt.Errorf("invalid node-selector: invalid key %q: %s", k, strings.Join(errorList, "; "))
+		}
+		if errorList := utilvalidation.IsValidLabelValue(v); len(errorList) != 0 {
+			return fmt.Errorf("invalid node-selector: invalid value %q for key %q: %s", v, k, strings.Join(errorList, "; "))
+		}
+	}
+	return nil
+}
+
+// patchTouchesNodeName reports whether a raw JSON patch document contains an operation whose path is
+// /spec/nodeName. Mutating a Pod's nodeName after it has already been scheduled breaks the
+// scheduler's bookkeeping, so a rule's own JSONPatch is never allowed to touch it.
+func patchTouchesNodeName(patchJSON string) bool {
+	return strings.Contains(patchJSON, `"/spec/nodeName"`)
+}
@@ -0,0 +1,38 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package graffiti
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+)
+
+// computeSpecHash returns a stable hex-encoded sha256 hash of fm's values at fieldPaths, used by
+// Additions.SpecHash to stamp a drift-detection annotation and by Matchers.SpecChanged to compare
+// against it. fieldPaths is sorted before hashing so that the hash only depends on the paths' values,
+// not the order they happen to be configured in.
+func computeSpecHash(fm map[string]string, fieldPaths []string) string {
+	sorted := append([]string{}, fieldPaths...)
+	sort.Strings(sorted)
+
+	h := sha256.New()
+	for _, path := range sorted {
+		h.Write([]byte(path))
+		h.Write([]byte{0})
+		h.Write([]byte(fm[path]))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,53 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package graffiti
+
+import (
+	"strings"
+
+	"github.com/HotelsDotCom/kube-graffiti/pkg/log"
+)
+
+// Unpaint returns the JSON patch needed to remove labelKeys and annotationKeys from an object's
+// current labels/annotations, along with ruleName's own AppliedLabelKeysAnnotationKey/
+// AppliedAnnotationKeysAnnotationKey tracking annotations - the existing sweep's counterpart to
+// Mutate, called once a rule stops matching an object it had previously painted (recorded via
+// Additions.RecordAppliedKeys) so that the keys it added can be reversed. It returns (nil, nil) when
+// labels/annotations no longer carry anything to remove.
+func Unpaint(labels, annotations map[string]string, ruleName string, labelKeys, annotationKeys []string) ([]byte, error) {
+	mylog := log.ComponentLogger(componentName, "Unpaint")
+
+	annotationKeys = append(append([]string{}, annotationKeys...), AppliedLabelKeysAnnotationKey(ruleName), AppliedAnnotationKeysAnnotationKey(ruleName))
+
+	var ops []string
+	labelsOp, err := createPatchOperand(labels, nil, nil, labelKeys, nil, nil, mylog, "/metadata/labels", false, ruleName, "", "", false)
+	if err != nil {
+		return nil, err
+	}
+	if labelsOp != "" {
+		ops = append(ops, labelsOp)
+	}
+	annotationsOp, err := createPatchOperand(annotations, nil, nil, annotationKeys, nil, nil, mylog, "/metadata/annotations", false, ruleName, "", "", false)
+	if err != nil {
+		return nil, err
+	}
+	if annotationsOp != "" {
+		ops = append(ops, annotationsOp)
+	}
+
+	if len(ops) == 0 {
+		return nil, nil
+	}
+	return []byte(`[ ` + strings.Join(ops, ", ") + ` ]`), nil
+}
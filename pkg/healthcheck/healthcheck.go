@@ -15,10 +15,13 @@ package healthcheck
 
 import (
 	"fmt"
-	"io"
 	"net/http"
+	"sync"
+	"time"
 
+	"github.com/HotelsDotCom/kube-graffiti/pkg/httpresponse"
 	"github.com/HotelsDotCom/kube-graffiti/pkg/log"
+	"github.com/HotelsDotCom/kube-graffiti/pkg/version"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
@@ -32,6 +35,88 @@ type HealthChecker struct {
 	Path   string `mapstructure:"path"`
 	client kubernetesClient
 	server *http.Server
+	// readinessFunc, when set, must also return true for ServeHTTP to report healthy. It is set via
+	// SetReadinessFunc rather than being an exported field, because HealthChecker is embedded in
+	// config.Configuration and unmarshalled/remarshalled as part of it.
+	readinessFunc func() bool
+	// statusHandlers holds extra routes registered via RegisterStatusHandler, for StartHealthChecker
+	// to add to the mux alongside the built-in health and version routes.
+	statusHandlers map[string]http.HandlerFunc
+	// ExposedPaths, if non-empty, restricts which of the registered statusHandlers routes are actually
+	// mounted onto the mux - everything else registered via RegisterStatusHandler is left off, so a
+	// deployment that wants the health-checker's single address to carry only a chosen subset of debug
+	// endpoints can say so. The mandatory health Path and /version are always mounted regardless, since
+	// they aren't debug endpoints, they're what makes this a health-checker. Leaving it empty (the
+	// default) mounts every registered route, matching behaviour from before ExposedPaths existed.
+	ExposedPaths []string `mapstructure:"exposed-paths" yaml:"exposed-paths,omitempty"`
+	// failureThreshold and failureWindow are set via SetFailureGrace; see its comment for what they
+	// do. failureThreshold defaults to 1 - fail on the very first kubernetes api check failure -
+	// matching the original, unconfigurable behaviour.
+	failureThreshold int
+	failureWindow    time.Duration
+	// failures is a pointer so that state still accumulates correctly across requests even though
+	// ServeHTTP has a value receiver (required because HealthChecker is embedded, and unmarshalled by
+	// value, in config.Configuration).
+	failures *failureTracker
+}
+
+// SetFailureGrace configures a grace window before ServeHTTP reports unhealthy on a failing
+// kubernetes api check, so that a brief apiserver blip doesn't cause an unnecessary restart.
+// threshold is how many consecutive failures are required before reporting unhealthy; it is treated
+// as 1 (fail immediately) if left at its zero value. window, if non-zero, resets the consecutive
+// count once more than it has passed since the streak's first failure, so that occasional unrelated
+// failures spread out over a long time don't eventually add up to threshold.
+func (h *HealthChecker) SetFailureGrace(threshold int, window time.Duration) {
+	h.failureThreshold = threshold
+	h.failureWindow = window
+}
+
+// failureTracker counts consecutive ServeHTTP failures against the kubernetes api check.
+type failureTracker struct {
+	mu             sync.Mutex
+	consecutive    int
+	firstFailureAt time.Time
+}
+
+// recordFailure registers a failure and reports whether threshold consecutive failures have now been
+// seen.
+func (f *failureTracker) recordFailure(threshold int, window time.Duration) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if threshold < 1 {
+		threshold = 1
+	}
+
+	now := time.Now()
+	if f.consecutive > 0 && window > 0 && now.Sub(f.firstFailureAt) > window {
+		f.consecutive = 0
+	}
+	if f.consecutive == 0 {
+		f.firstFailureAt = now
+	}
+	f.consecutive++
+	return f.consecutive >= threshold
+}
+
+// reset clears the failure streak; called after a successful check.
+func (f *failureTracker) reset() {
+	f.mu.Lock()
+	f.consecutive = 0
+	f.mu.Unlock()
+}
+
+// SetReadinessFunc lets other packages (e.g. webhook's path-consistency checker) mark the instance
+// unready, without this package depending on them.
+func (h *HealthChecker) SetReadinessFunc(f func() bool) {
+	h.readinessFunc = f
+}
+
+// RegisterStatusHandler adds an extra route, such as an operator-facing status endpoint, to the
+// health-checker http server. It must be called before StartHealthChecker, which is what actually
+// adds the registered routes to the mux.
+func (h *HealthChecker) RegisterStatusHandler(path string, handler http.HandlerFunc) {
+	h.statusHandlers[path] = handler
 }
 
 // Abstract kubernetes client to cut down amount to mock, we only need to list namespaces.
@@ -69,10 +154,12 @@ func NewHealthChecker(k kubernetesClient, port int, path string) HealthChecker {
 		Handler: mux,
 	}
 	return HealthChecker{
-		Port:   port,
-		Path:   path,
-		client: k,
-		server: server,
+		Port:           port,
+		Path:           path,
+		client:         k,
+		server:         server,
+		statusHandlers: make(map[string]http.HandlerFunc),
+		failures:       &failureTracker{},
 	}
 }
 
@@ -81,11 +168,7 @@ func (h HealthChecker) StartHealthChecker() {
 	mylog := log.ComponentLogger(componentName, "StartHealthChecker")
 	mylog.Info().Msg("starting the health-checker http server...")
 
-	// add ourselves as the handler for http requests
-	// rather than using HandleFunc we use Handle so that the Handler can use the health-checker
-	// object as context and therefore have access to its embedded kubernetesClient.
-	mux := h.server.Handler.(*http.ServeMux)
-	mux.Handle(h.Path, h)
+	h.buildMux()
 
 	// start the health-checker handler http server
 	var err error
@@ -98,6 +181,59 @@ func (h HealthChecker) StartHealthChecker() {
 	return
 }
 
+// buildMux mounts every route the health-checker's single address serves - the mandatory health path,
+// /version, and any RegisterStatusHandler routes ExposedPaths doesn't filter out - onto h.server's mux,
+// and returns it so tests can exercise it directly without binding a real port.
+func (h HealthChecker) buildMux() *http.ServeMux {
+	// add ourselves as the handler for http requests
+	// rather than using HandleFunc we use Handle so that the Handler can use the health-checker
+	// object as context and therefore have access to its embedded kubernetesClient.
+	mux := h.server.Handler.(*http.ServeMux)
+	mux.Handle(h.Path, h)
+	mux.HandleFunc("/version", serveVersion)
+	for path, handler := range h.statusHandlers {
+		if !h.pathExposed(path) {
+			continue
+		}
+		mux.HandleFunc(path, handler)
+	}
+	return mux
+}
+
+// pathExposed reports whether path should be mounted given ExposedPaths: everything is exposed when
+// ExposedPaths is empty, otherwise only an exact match is.
+func (h HealthChecker) pathExposed(path string) bool {
+	if len(h.ExposedPaths) == 0 {
+		return true
+	}
+	for _, p := range h.ExposedPaths {
+		if p == path {
+			return true
+		}
+	}
+	return false
+}
+
+// serveVersion responds with the build version information as JSON.
+func serveVersion(w http.ResponseWriter, r *http.Request) {
+	mylog := log.ComponentLogger(componentName, "serveVersion")
+	j, err := version.Get().JSON()
+	if err != nil {
+		mylog.Error().Err(err).Msg("failed to marshal version info")
+		httpresponse.WriteError(w, http.StatusInternalServerError, "failed to determine version", err)
+		return
+	}
+	httpresponse.SetCommonHeaders(w)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(j))
+}
+
+// healthBody is the well-formed JSON body written by ServeHTTP, whichever outcome it reports.
+type healthBody struct {
+	Healthy bool `json:"healthy"`
+}
+
 // ServeHttp handles a mutating webhook review request
 func (h HealthChecker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	mylog := log.ComponentLogger(componentName, "healthCheckHandler")
@@ -105,15 +241,22 @@ func (h HealthChecker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	reqLog.Debug().Msg("health check triggered, listing namespaces via kubernetes api")
 	_, err := h.client.namespaces().List(metav1.ListOptions{})
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Header().Set("Content-Type", "application/json")
-		io.WriteString(w, `{"healthy": false}`)
-		mylog.Error().Err(err).Int("status", http.StatusInternalServerError).Msg("returning failed")
+		if h.failures.recordFailure(h.failureThreshold, h.failureWindow) {
+			mylog.Error().Err(err).Int("status", http.StatusInternalServerError).Msg("returning failed")
+			httpresponse.WriteJSON(w, http.StatusInternalServerError, healthBody{Healthy: false})
+			return
+		}
+		mylog.Warn().Err(err).Msg("kubernetes api check failed but the failure grace threshold hasn't been reached yet, reporting healthy")
+	} else {
+		h.failures.reset()
+	}
+
+	if h.readinessFunc != nil && !h.readinessFunc() {
+		mylog.Error().Int("status", http.StatusInternalServerError).Msg("returning failed: readiness check failed")
+		httpresponse.WriteJSON(w, http.StatusInternalServerError, healthBody{Healthy: false})
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	w.Header().Set("Content-Type", "application/json")
-	io.WriteString(w, `{"healthy": true}`)
 	reqLog.Debug().Int("status", http.StatusOK).Msg("returning ok")
+	httpresponse.WriteJSON(w, http.StatusOK, healthBody{Healthy: true})
 }
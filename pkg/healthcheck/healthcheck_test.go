@@ -69,8 +69,10 @@ func TestHealthlyCheck(t *testing.T) {
 	lister.AssertExpectations(t)
 
 	// Check the response body is what we expect.
-	expected := `{"healthy": true}`
+	expected := `{"healthy":true}`
 	assert.Equal(t, rr.Body.String(), expected)
+	assert.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+	assert.Empty(t, rr.Header().Get("Server"))
 }
 
 func TestUnHealthlyCheck(t *testing.T) {
@@ -98,6 +100,118 @@ func TestUnHealthlyCheck(t *testing.T) {
 	lister.AssertExpectations(t)
 
 	// Check the response body is what we expect.
-	expected := `{"healthy": false}`
+	expected := `{"healthy":false}`
 	assert.Equal(t, rr.Body.String(), expected)
 }
+
+func TestAFailureBelowTheThresholdStillReportsHealthy(t *testing.T) {
+	lister := new(kubernetesNamespaceAccessorMock)
+	lister.On("List", mock.AnythingOfType("v1.ListOptions")).Return(&corev1.NamespaceList{}, fmt.Errorf("test error"))
+	kclient := new(kubernetesClientMock)
+	kclient.On("namespaces").Return(lister)
+
+	checker := NewHealthChecker(kclient, 80, "/healthz")
+	checker.SetFailureGrace(3, 0)
+
+	req, err := http.NewRequest("GET", "/healthz", nil)
+	assert.Nil(t, err)
+
+	rr := httptest.NewRecorder()
+	checker.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, `{"healthy":true}`, rr.Body.String())
+}
+
+func TestNConsecutiveFailuresReachingTheThresholdReportsUnhealthy(t *testing.T) {
+	lister := new(kubernetesNamespaceAccessorMock)
+	lister.On("List", mock.AnythingOfType("v1.ListOptions")).Return(&corev1.NamespaceList{}, fmt.Errorf("test error"))
+	kclient := new(kubernetesClientMock)
+	kclient.On("namespaces").Return(lister)
+
+	checker := NewHealthChecker(kclient, 80, "/healthz")
+	checker.SetFailureGrace(3, 0)
+
+	req, err := http.NewRequest("GET", "/healthz", nil)
+	assert.Nil(t, err)
+
+	var rr *httptest.ResponseRecorder
+	for i := 0; i < 3; i++ {
+		rr = httptest.NewRecorder()
+		checker.ServeHTTP(rr, req)
+	}
+
+	assert.Equal(t, http.StatusInternalServerError, rr.Code)
+	assert.Equal(t, `{"healthy":false}`, rr.Body.String())
+}
+
+func TestASuccessResetsTheFailureStreak(t *testing.T) {
+	failingLister := new(kubernetesNamespaceAccessorMock)
+	failingLister.On("List", mock.AnythingOfType("v1.ListOptions")).Return(&corev1.NamespaceList{}, fmt.Errorf("test error"))
+	healthyLister := new(kubernetesNamespaceAccessorMock)
+	healthyLister.On("List", mock.AnythingOfType("v1.ListOptions")).Return(&corev1.NamespaceList{}, nil)
+	kclient := new(kubernetesClientMock)
+	kclient.On("namespaces").Return(failingLister).Twice()
+	kclient.On("namespaces").Return(healthyLister).Once()
+	kclient.On("namespaces").Return(failingLister).Twice()
+
+	checker := NewHealthChecker(kclient, 80, "/healthz")
+	checker.SetFailureGrace(3, 0)
+
+	req, err := http.NewRequest("GET", "/healthz", nil)
+	assert.Nil(t, err)
+
+	var rr *httptest.ResponseRecorder
+	for i := 0; i < 5; i++ {
+		rr = httptest.NewRecorder()
+		checker.ServeHTTP(rr, req)
+	}
+
+	// 2 failures, 1 success (resets the streak), then 2 more failures: only 2 consecutive failures
+	// since the reset, still below the threshold of 3.
+	assert.Equal(t, http.StatusOK, rr.Code)
+}
+
+// TestBuildMuxExposesEveryRegisteredRouteByDefault confirms that, with ExposedPaths left unset, every
+// status handler registered via RegisterStatusHandler is served from the health-checker's one mux,
+// alongside the mandatory health path and /version - the default, fully-consolidated behaviour from
+// before ExposedPaths existed.
+func TestBuildMuxExposesEveryRegisteredRouteByDefault(t *testing.T) {
+	checker := NewHealthChecker(new(kubernetesClientMock), 80, "/healthz")
+	checker.RegisterStatusHandler("/existing/status", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) })
+	checker.RegisterStatusHandler("/statusz", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) })
+
+	ts := httptest.NewServer(checker.buildMux())
+	defer ts.Close()
+
+	for _, path := range []string{"/version", "/existing/status", "/statusz"} {
+		resp, err := http.Get(ts.URL + path)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "expected %s to be served from the consolidated address", path)
+	}
+}
+
+// TestBuildMuxOnlyExposesConfiguredPaths confirms that a non-empty ExposedPaths restricts the mux to
+// that subset of registered status handlers, while the mandatory health path and /version are always
+// mounted regardless, since they aren't debug endpoints ExposedPaths is meant to gate.
+func TestBuildMuxOnlyExposesConfiguredPaths(t *testing.T) {
+	checker := NewHealthChecker(new(kubernetesClientMock), 80, "/healthz")
+	checker.RegisterStatusHandler("/existing/status", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) })
+	checker.RegisterStatusHandler("/statusz", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) })
+	checker.ExposedPaths = []string{"/statusz"}
+
+	ts := httptest.NewServer(checker.buildMux())
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/version")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "the mandatory /version route is never filtered by ExposedPaths")
+
+	resp, err = http.Get(ts.URL + "/statusz")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "/statusz was explicitly listed in ExposedPaths")
+
+	resp, err = http.Get(ts.URL + "/existing/status")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode, "/existing/status was left out of ExposedPaths, so it should not be mounted")
+}
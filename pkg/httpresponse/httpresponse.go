@@ -0,0 +1,71 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package httpresponse holds the response hardening shared by the webhook and health-checker http
+// servers, so that every handler in this program writes the same minimal, consistent header set and
+// by default (see VerboseErrors) never leaks internal error detail to anything that can reach the port.
+package httpresponse
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// VerboseErrors includes the internal error detail in WriteError's JSON body, instead of a generic
+// message. It defaults to false, since leaking implementation detail to anything that can reach the
+// port is not a safe default; operators opt in with 'verbose-http-errors: true' for local development.
+// The detail is always logged by the caller regardless of this setting.
+var VerboseErrors = false
+
+// ExtraHeaders are added to every response written through this package, e.g. a cluster identifier
+// header that helps trace which cluster a request was served by when debugging a multi-cluster
+// deployment.
+var ExtraHeaders = map[string]string{}
+
+// SetCommonHeaders applies ExtraHeaders and clears the "Server" header, so that every response written
+// through this package carries the same minimal, consistent header set rather than the Go default.
+func SetCommonHeaders(w http.ResponseWriter) {
+	w.Header().Set("Server", "")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	for name, value := range ExtraHeaders {
+		w.Header().Set(name, value)
+	}
+}
+
+// WriteJSON writes v as a JSON body with the given status code, after applying SetCommonHeaders.
+func WriteJSON(w http.ResponseWriter, status int, v interface{}) {
+	SetCommonHeaders(w)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	body, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	w.Write(body)
+}
+
+// errorBody is the well-formed JSON body written by WriteError.
+type errorBody struct {
+	Error string `json:"error"`
+}
+
+// WriteError writes a JSON error body of {"error": "<public>"}. When VerboseErrors is enabled, detail's
+// message is sent instead of public - detail may be nil, in which case public is always used. Callers
+// should log detail themselves, since it is not logged here.
+func WriteError(w http.ResponseWriter, status int, public string, detail error) {
+	message := public
+	if VerboseErrors && detail != nil {
+		message = detail.Error()
+	}
+	WriteJSON(w, status, errorBody{Error: message})
+}
@@ -0,0 +1,74 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package httpresponse
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteErrorUsesThePublicMessageByDefault(t *testing.T) {
+	rr := httptest.NewRecorder()
+	WriteError(rr, http.StatusBadRequest, "invalid request", errors.New("decode failed: unexpected token at offset 12"))
+
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Equal(t, `{"error":"invalid request"}`, rr.Body.String())
+}
+
+func TestWriteErrorIncludesDetailWhenVerbose(t *testing.T) {
+	defer func() { VerboseErrors = false }()
+	VerboseErrors = true
+
+	rr := httptest.NewRecorder()
+	WriteError(rr, http.StatusBadRequest, "invalid request", errors.New("decode failed"))
+
+	assert.Equal(t, `{"error":"decode failed"}`, rr.Body.String())
+}
+
+func TestWriteErrorFallsBackToPublicMessageWithNilDetail(t *testing.T) {
+	defer func() { VerboseErrors = false }()
+	VerboseErrors = true
+
+	rr := httptest.NewRecorder()
+	WriteError(rr, http.StatusMethodNotAllowed, "method not allowed", nil)
+
+	assert.Equal(t, `{"error":"method not allowed"}`, rr.Body.String())
+}
+
+func TestSetCommonHeadersAppliesExtraHeaders(t *testing.T) {
+	defer func() { ExtraHeaders = map[string]string{} }()
+	ExtraHeaders = map[string]string{"X-Cluster": "prod-eu-west-1"}
+
+	rr := httptest.NewRecorder()
+	SetCommonHeaders(rr)
+
+	assert.Equal(t, "prod-eu-west-1", rr.Header().Get("X-Cluster"))
+	assert.Equal(t, "nosniff", rr.Header().Get("X-Content-Type-Options"))
+	assert.Empty(t, rr.Header().Get("Server"))
+}
+
+func TestWriteJSONSetsContentTypeAndStatus(t *testing.T) {
+	rr := httptest.NewRecorder()
+	WriteJSON(rr, http.StatusOK, struct {
+		Healthy bool `json:"healthy"`
+	}{Healthy: true})
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+	assert.Equal(t, `{"healthy":true}`, rr.Body.String())
+}
@@ -0,0 +1,77 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package log
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// ErrorDedupeCap bounds how many distinct error messages errorDedupe tracks at once, so a component
+// that logs many distinct error strings can't grow the dedup table without limit - once the cap is
+// reached, further previously-unseen messages are simply not tracked.
+var ErrorDedupeCap = 50
+
+// DedupedError is one distinct error message observed at Error level or above, with how many times
+// it has recurred and when it was last seen.
+type DedupedError struct {
+	Message  string    `json:"message"`
+	Count    int       `json:"count"`
+	LastSeen time.Time `json:"last-seen"`
+}
+
+// dedupeHook is installed as a zerolog.Hook on the global logger by InitLogger, so that
+// RecentErrors can report a summary of what's been going wrong without every call site having to
+// report errors through some separate channel as well as logging them.
+type dedupeHook struct {
+	mu     sync.Mutex
+	errors map[string]*DedupedError
+}
+
+var errorDedupe = &dedupeHook{errors: make(map[string]*DedupedError)}
+
+// Run implements zerolog.Hook.
+func (d *dedupeHook) Run(e *zerolog.Event, level zerolog.Level, msg string) {
+	if level < zerolog.ErrorLevel {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if existing, ok := d.errors[msg]; ok {
+		existing.Count++
+		existing.LastSeen = time.Now()
+		return
+	}
+	if len(d.errors) >= ErrorDedupeCap {
+		return
+	}
+	d.errors[msg] = &DedupedError{Message: msg, Count: 1, LastSeen: time.Now()}
+}
+
+// RecentErrors returns every distinct message logged at Error level or above since startup, up to the
+// first ErrorDedupeCap distinct messages seen, most recently seen first, for registering against an
+// operator-facing status endpoint.
+func RecentErrors() []DedupedError {
+	errorDedupe.mu.Lock()
+	out := make([]DedupedError, 0, len(errorDedupe.errors))
+	for _, e := range errorDedupe.errors {
+		out = append(out, *e)
+	}
+	errorDedupe.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].LastSeen.After(out[j].LastSeen) })
+	return out
+}
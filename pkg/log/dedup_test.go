@@ -0,0 +1,65 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package log
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func resetErrorDedupe() {
+	errorDedupe.mu.Lock()
+	defer errorDedupe.mu.Unlock()
+	errorDedupe.errors = make(map[string]*DedupedError)
+}
+
+func TestDedupeHookIgnoresLevelsBelowError(t *testing.T) {
+	defer resetErrorDedupe()
+	resetErrorDedupe()
+
+	errorDedupe.Run(nil, zerolog.WarnLevel, "something worth a warning")
+
+	assert.Empty(t, RecentErrors())
+}
+
+func TestDedupeHookCountsRepeatedErrorMessages(t *testing.T) {
+	defer resetErrorDedupe()
+	resetErrorDedupe()
+
+	errorDedupe.Run(nil, zerolog.ErrorLevel, "failed to list namespaces")
+	errorDedupe.Run(nil, zerolog.ErrorLevel, "failed to list namespaces")
+	errorDedupe.Run(nil, zerolog.FatalLevel, "failed to list namespaces")
+
+	errors := RecentErrors()
+	require.Len(t, errors, 1)
+	assert.Equal(t, "failed to list namespaces", errors[0].Message)
+	assert.Equal(t, 3, errors[0].Count)
+}
+
+func TestDedupeHookStopsTrackingNewMessagesPastErrorDedupeCap(t *testing.T) {
+	defer resetErrorDedupe()
+	defer func() { ErrorDedupeCap = 50 }()
+	resetErrorDedupe()
+	ErrorDedupeCap = 2
+
+	for i := 0; i < 5; i++ {
+		errorDedupe.Run(nil, zerolog.ErrorLevel, fmt.Sprintf("distinct error %d", i))
+	}
+
+	assert.Len(t, RecentErrors(), 2)
+}
@@ -14,7 +14,9 @@ limitations under the License.
 package log
 
 import (
+	"encoding/json"
 	"os"
+	"strings"
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
@@ -34,7 +36,7 @@ var (
 
 // InitLogger sets up our logger with default level and output to console
 func InitLogger(level string) {
-	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr}).Hook(errorDedupe)
 	// set level width if PR https://github.com/rs/zerolog/pull/87 is accepted
 	// zerolog.LevelWidth = 5
 	zerolog.SetGlobalLevel(LogLevels[level])
@@ -54,3 +56,48 @@ func ComponentLogger(component, funcname string) zerolog.Logger {
 	}
 	return logger
 }
+
+// RedactFields lists the dot-separated field paths (e.g. "data.password", "spec.token") whose values
+// RedactObject masks with "***" wherever pkg/graffiti or pkg/existing log a whole object, so that a CRD
+// with sensitive fields at a known path doesn't leak its secrets into the logs. It is empty by default -
+// no redaction happens until an operator configures one or more paths via the log.redact-fields
+// configuration key.
+var RedactFields []string
+
+// RedactObject parses raw as JSON and replaces the value at each of RedactFields' paths with "***",
+// returning the re-marshalled result. raw is returned unchanged if it isn't valid JSON, or if
+// RedactFields is empty - this exists purely to keep sensitive values out of the logs, so it must never
+// itself become a source of errors for the caller that's about to log raw.
+func RedactObject(raw []byte) []byte {
+	if len(RedactFields) == 0 {
+		return raw
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return raw
+	}
+	for _, path := range RedactFields {
+		redactPath(doc, strings.Split(path, "."))
+	}
+	redacted, err := json.Marshal(doc)
+	if err != nil {
+		return raw
+	}
+	return redacted
+}
+
+// redactPath walks segments into doc, replacing the value found at the final segment with "***" if it
+// is present. A path whose intermediate segment is missing, or isn't itself an object, is left alone.
+func redactPath(doc map[string]interface{}, segments []string) {
+	if len(segments) == 1 {
+		if _, ok := doc[segments[0]]; ok {
+			doc[segments[0]] = "***"
+		}
+		return
+	}
+	next, ok := doc[segments[0]].(map[string]interface{})
+	if !ok {
+		return
+	}
+	redactPath(next, segments[1:])
+}
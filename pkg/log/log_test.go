@@ -0,0 +1,57 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package log
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedactObjectMasksConfiguredFieldsAndLeavesOthersAlone(t *testing.T) {
+	old := RedactFields
+	defer func() { RedactFields = old }()
+	RedactFields = []string{"data.password", "spec.token"}
+
+	raw := []byte(`{"metadata":{"name":"my-secret"},"data":{"password":"hunter2","username":"dave"},"spec":{"token":"abc123"}}`)
+
+	redacted := RedactObject(raw)
+
+	var doc map[string]interface{}
+	require.NoError(t, json.Unmarshal(redacted, &doc))
+	assert.Equal(t, "***", doc["data"].(map[string]interface{})["password"])
+	assert.Equal(t, "dave", doc["data"].(map[string]interface{})["username"], "a field not configured for redaction should remain untouched")
+	assert.Equal(t, "***", doc["spec"].(map[string]interface{})["token"])
+	assert.Equal(t, "my-secret", doc["metadata"].(map[string]interface{})["name"])
+}
+
+func TestRedactObjectIsANoOpWithNoConfiguredFields(t *testing.T) {
+	old := RedactFields
+	defer func() { RedactFields = old }()
+	RedactFields = nil
+
+	raw := []byte(`{"data":{"password":"hunter2"}}`)
+	assert.Equal(t, raw, RedactObject(raw))
+}
+
+func TestRedactObjectLeavesInvalidJSONUntouched(t *testing.T) {
+	old := RedactFields
+	defer func() { RedactFields = old }()
+	RedactFields = []string{"data.password"}
+
+	raw := []byte("not json")
+	assert.Equal(t, raw, RedactObject(raw))
+}
@@ -0,0 +1,155 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package metrics records simple, in-process observations for capacity planning, such as the size of the
+// patches that graffiti computes. It is not a Prometheus client - that library is not vendored in this
+// repository - but the naming and per-rule labelling mirror what a graffiti_patch_operations/graffiti_patch_bytes
+// histogram pair would look like, so wiring up a real exporter later only touches this package.
+package metrics
+
+import "sync"
+
+// MaxLabelCardinality bounds how many distinct labels a single Histogram will track. Without a cap, a
+// rule's metric-labels could key a histogram off a high-cardinality field (e.g. pod name) and grow its
+// backing maps without limit; once a Histogram has seen this many distinct labels, every further
+// previously-unseen label is folded into overflowLabel instead of growing the map further.
+var MaxLabelCardinality = 200
+
+// overflowLabel is where observations land once a Histogram has hit MaxLabelCardinality distinct labels.
+const overflowLabel = "<cardinality-cap-exceeded>"
+
+// Histogram accumulates a count and sum of observed values, grouped by an arbitrary label (e.g. rule name).
+type Histogram struct {
+	mu     sync.Mutex
+	counts map[string]int64
+	sums   map[string]int64
+}
+
+// NewHistogram returns an empty Histogram.
+func NewHistogram() *Histogram {
+	return &Histogram{
+		counts: make(map[string]int64),
+		sums:   make(map[string]int64),
+	}
+}
+
+// Observe records a single value against label, folding label into overflowLabel if doing so would grow
+// the Histogram past MaxLabelCardinality distinct labels.
+func (h *Histogram) Observe(label string, value int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, seen := h.counts[label]; !seen && len(h.counts) >= MaxLabelCardinality {
+		label = overflowLabel
+	}
+	h.counts[label]++
+	h.sums[label] += value
+}
+
+// Count returns how many observations have been recorded against label.
+func (h *Histogram) Count(label string) int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.counts[label]
+}
+
+// Sum returns the total of all values observed against label.
+func (h *Histogram) Sum(label string) int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.sums[label]
+}
+
+// Gauge tracks a single value that can be set up or down, e.g. the current size of a cache - unlike
+// Histogram, which only ever accumulates counts and sums, a Gauge's value can also decrease.
+type Gauge struct {
+	mu    sync.Mutex
+	value int64
+}
+
+// NewGauge returns a Gauge starting at zero.
+func NewGauge() *Gauge {
+	return &Gauge{}
+}
+
+// Set overwrites the Gauge's current value.
+func (g *Gauge) Set(value int64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.value = value
+}
+
+// Value returns the Gauge's current value.
+func (g *Gauge) Value() int64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.value
+}
+
+var (
+	// PatchOperations records the number of JSON patch operations graffiti computes for a matched rule.
+	PatchOperations = NewHistogram()
+	// PatchBytes records the size, in bytes, of the JSON patch graffiti computes for a matched rule.
+	PatchBytes = NewHistogram()
+	// PatchesRejected counts patches that exceeded max-patch-operations or max-patch-bytes and were
+	// therefore not applied, grouped by rule name.
+	PatchesRejected = NewHistogram()
+	// PathMismatches counts webhook path-consistency mismatches detected between a rule's registered
+	// configuration and its mounted handler, grouped by rule name.
+	PathMismatches = NewHistogram()
+	// BlocksEnforced counts block payloads that denied an admission request, grouped by rule name.
+	BlocksEnforced = NewHistogram()
+	// BlocksQuarantined counts block payloads enforced as a quarantine: the request was allowed
+	// through but the object was marked with its rule's quarantine label/annotation instead of being
+	// denied, grouped by rule name.
+	BlocksQuarantined = NewHistogram()
+	// NamespaceCacheHits counts namespaceCache.LookupNamespace calls satisfied directly from the cached
+	// store, grouped by namespace name.
+	NamespaceCacheHits = NewHistogram()
+	// NamespaceCacheMisses counts namespaceCache.LookupNamespace calls that didn't find the namespace in
+	// the cached store and fell back to an apiserver call, grouped by namespace name.
+	NamespaceCacheMisses = NewHistogram()
+	// NamespaceCacheFallbackCalls counts the apiserver Get calls the fallback path actually made,
+	// grouped by namespace name - lower than NamespaceCacheMisses whenever
+	// NamespaceCacheSingleflightShared dedupes concurrent misses for the same namespace onto one call.
+	NamespaceCacheFallbackCalls = NewHistogram()
+	// NamespaceCacheSingleflightShared counts fallback lookups that were satisfied by a Get already in
+	// flight for the same namespace rather than making their own, grouped by namespace name.
+	NamespaceCacheSingleflightShared = NewHistogram()
+	// NamespaceCacheFallbackLatencyMillis records how long the fallback apiserver Get took, in
+	// milliseconds, grouped by namespace name.
+	NamespaceCacheFallbackLatencyMillis = NewHistogram()
+	// NamespaceCacheSize reports the current number of namespaces held in the namespace cache's store.
+	NamespaceCacheSize = NewGauge()
+	// NamespaceCacheFallbackErrors counts fallback apiserver Get calls that returned an error, grouped by
+	// namespace name.
+	NamespaceCacheFallbackErrors = NewHistogram()
+	// UnregisteredPathRequests counts webhook requests received for a path with no registered
+	// graffiti rule while webhook.StrictMode is enabled, grouped by the requested path.
+	UnregisteredPathRequests = NewHistogram()
+	// FaultsInjected counts requests a webhook.Fault armed by webhook.ConfigureFaults was actually
+	// injected into, grouped by the requested path.
+	FaultsInjected = NewHistogram()
+	// OperationsSkipped counts admission requests a rule's evaluate-on short-circuited before its
+	// matchers or payload were evaluated at all, grouped by rule name.
+	OperationsSkipped = NewHistogram()
+	// MutationBudgetExceeded counts matched objects a rule's Budget refused (pause/skip) or let
+	// through with a warning (warn) because its mutation count exceeded MaxMutations for the current
+	// window, grouped by rule name.
+	MutationBudgetExceeded = NewHistogram()
+	// MatchedNoChangeNeeded counts admission requests a rule matched but whose payload left nothing
+	// to change, grouped by rule name - distinct from a rule not matching at all.
+	MatchedNoChangeNeeded = NewHistogram()
+	// RuleTimeouts counts admission requests a rule's mutate call did not finish within
+	// graffiti.PerRuleTimeout, grouped by rule name.
+	RuleTimeouts = NewHistogram()
+)
@@ -0,0 +1,49 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHistogramTracksDistinctLabelsBelowTheCardinalityCap(t *testing.T) {
+	defer func() { MaxLabelCardinality = 200 }()
+	MaxLabelCardinality = 3
+
+	h := NewHistogram()
+	h.Observe("a", 1)
+	h.Observe("b", 1)
+	h.Observe("c", 1)
+
+	assert.Equal(t, int64(1), h.Count("a"))
+	assert.Equal(t, int64(1), h.Count("b"))
+	assert.Equal(t, int64(1), h.Count("c"))
+	assert.Equal(t, int64(0), h.Count(overflowLabel))
+}
+
+func TestHistogramFoldsLabelsBeyondTheCardinalityCapIntoOverflow(t *testing.T) {
+	defer func() { MaxLabelCardinality = 200 }()
+	MaxLabelCardinality = 3
+
+	h := NewHistogram()
+	for i := 0; i < 10; i++ {
+		h.Observe(fmt.Sprintf("label-%d", i), 1)
+	}
+
+	assert.Equal(t, int64(3), int64(len(h.counts)-1), "exactly 3 distinct labels plus the overflow label should have been kept")
+	assert.Equal(t, int64(7), h.Count(overflowLabel), "the 7 labels observed once the cap was reached should have been folded into the overflow label")
+}
@@ -0,0 +1,88 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"sync"
+	"time"
+)
+
+// WindowSize bounds how far back a SlidingWindow remembers observations. It is deliberately short -
+// this is for an operator glancing at a live rate, not for capacity planning, which is what the
+// Histogram counters above are for.
+var WindowSize = 5 * time.Minute
+
+// SlidingWindow counts Record calls per second over the trailing WindowSize, so that RatePerSecond
+// can report a recent rate without keeping every individual observation - its size is bounded by
+// WindowSize regardless of how many times Record is called.
+type SlidingWindow struct {
+	mu      sync.Mutex
+	buckets map[int64]int64
+}
+
+// NewSlidingWindow returns an empty SlidingWindow.
+func NewSlidingWindow() *SlidingWindow {
+	return &SlidingWindow{buckets: make(map[int64]int64)}
+}
+
+// Record notes one observation at the current time.
+func (w *SlidingWindow) Record() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buckets[time.Now().Unix()]++
+	w.evict(time.Now())
+}
+
+// RatePerSecond returns the average rate of Record calls per second over the trailing window,
+// which is capped at WindowSize regardless of how large window is asked for.
+func (w *SlidingWindow) RatePerSecond(window time.Duration) float64 {
+	if window > WindowSize {
+		window = WindowSize
+	}
+	now := time.Now()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.evict(now)
+	cutoff := now.Add(-window).Unix()
+	var total int64
+	for second, count := range w.buckets {
+		if second >= cutoff {
+			total += count
+		}
+	}
+	seconds := window.Seconds()
+	if seconds <= 0 {
+		return 0
+	}
+	return float64(total) / seconds
+}
+
+// evict drops buckets older than WindowSize; callers must hold w.mu.
+func (w *SlidingWindow) evict(now time.Time) {
+	cutoff := now.Add(-WindowSize).Unix()
+	for second := range w.buckets {
+		if second < cutoff {
+			delete(w.buckets, second)
+		}
+	}
+}
+
+var (
+	// RequestRateWindow tracks incoming admission requests, recorded by the webhook handler's ServeHTTP.
+	RequestRateWindow = NewSlidingWindow()
+	// ErrorRateWindow tracks admission requests the handler rejected with a non-2xx response.
+	ErrorRateWindow = NewSlidingWindow()
+	// BlockRateWindow tracks admission requests a block payload denied or quarantined.
+	BlockRateWindow = NewSlidingWindow()
+)
@@ -0,0 +1,47 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSlidingWindowRatePerSecondCountsRecentRecords(t *testing.T) {
+	w := NewSlidingWindow()
+	for i := 0; i < 10; i++ {
+		w.Record()
+	}
+
+	assert.Equal(t, float64(10), w.RatePerSecond(time.Second))
+}
+
+func TestSlidingWindowRatePerSecondIsZeroWithNoRecords(t *testing.T) {
+	w := NewSlidingWindow()
+	assert.Equal(t, float64(0), w.RatePerSecond(time.Minute))
+}
+
+func TestSlidingWindowRatePerSecondCapsRequestedWindowAtWindowSize(t *testing.T) {
+	defer func() { WindowSize = 5 * time.Minute }()
+	WindowSize = time.Second
+
+	w := NewSlidingWindow()
+	w.Record()
+
+	// asking for a window far larger than WindowSize must not average the single record away to
+	// near-zero - it should be capped at WindowSize.
+	assert.Equal(t, float64(1), w.RatePerSecond(time.Hour))
+}
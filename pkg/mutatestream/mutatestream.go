@@ -0,0 +1,369 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package mutatestream runs graffiti rules against a stream of kubernetes objects read from a file or
+// pipe instead of a live cluster, so that rules can be dry-run or applied offline against a
+// `kubectl get -o json` export. There is no cluster to query, so namespace-selector evaluation is
+// driven by namespace objects seen earlier in the same stream rather than a cluster lookup.
+package mutatestream
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strings"
+
+	"github.com/HotelsDotCom/kube-graffiti/pkg/config"
+	"github.com/HotelsDotCom/kube-graffiti/pkg/existing"
+	"github.com/HotelsDotCom/kube-graffiti/pkg/graffiti"
+	"github.com/HotelsDotCom/kube-graffiti/pkg/log"
+	"github.com/HotelsDotCom/kube-graffiti/pkg/webhook"
+	jsonpatch "github.com/cameront/go-jsonpatch"
+	"github.com/rs/zerolog"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	sigsyaml "sigs.k8s.io/yaml"
+)
+
+const componentName = "mutatestream"
+
+// Emit selects what Run writes to its output for each object it processes.
+type Emit string
+
+const (
+	// EmitPatches writes one NDJSON record per object, pairing the RFC6902 patch generated for it
+	// (possibly empty, if no rule matched) with the object's apiVersion/kind/namespace/name.
+	EmitPatches Emit = "patches"
+	// EmitObjects writes the object itself, with any matching rules' patches already applied, as NDJSON.
+	EmitObjects Emit = "objects"
+)
+
+// MissingNamespacePolicy controls what happens when a namespace-selector needs an object's
+// namespace, but no namespace of that name has appeared yet in the stream.
+type MissingNamespacePolicy string
+
+const (
+	// MissingNamespaceAllow treats the object as matching the namespace-selector, so that a stream
+	// which doesn't happen to include its namespaces doesn't lose coverage of the objects in them.
+	MissingNamespaceAllow MissingNamespacePolicy = "allow"
+	// MissingNamespaceSkip treats the object as not matching the namespace-selector.
+	MissingNamespaceSkip MissingNamespacePolicy = "skip"
+	// MissingNamespaceError fails that object, which is counted in Run's returned error count.
+	MissingNamespaceError MissingNamespacePolicy = "error"
+)
+
+// Options configures a single Run of the stream mutator.
+type Options struct {
+	Rules            []config.Rule
+	Emit             Emit
+	MissingNamespace MissingNamespacePolicy
+}
+
+// Run decodes a stream of kubernetes objects from r - a List, NDJSON, or a multi-document YAML stream,
+// any of which may be produced by `kubectl get -o json|yaml` - and runs each object through
+// opts.Rules exactly as the existing-object sweep would: the same namespace-selector, matchers and
+// payload evaluation, applied in rule order with each rule seeing the previous rule's patch already
+// applied. It writes one NDJSON record per object to w, in the format selected by opts.Emit, and
+// returns the number of objects that could not be fully processed so the caller can reflect that in
+// its exit code.
+func Run(r io.Reader, w io.Writer, opts Options) (errorCount int, err error) {
+	mylog := log.ComponentLogger(componentName, "Run")
+
+	objects, err := decodeObjects(r)
+	if err != nil {
+		return 0, fmt.Errorf("could not decode input stream: %v", err)
+	}
+
+	nsStore := newNamespaceStore()
+	enc := json.NewEncoder(w)
+
+	for _, object := range objects {
+		apiVersion, _ := object["apiVersion"].(string)
+		kind, _ := object["kind"].(string)
+		meta, _ := object["metadata"].(map[string]interface{})
+		name, _ := meta["name"].(string)
+		namespace, _ := meta["namespace"].(string)
+		rlog := mylog.With().Str("api-version", apiVersion).Str("kind", kind).Str("namespace", namespace).Str("name", name).Logger()
+		rlog.Debug().Msg("processing stream object")
+
+		if kind == "Namespace" {
+			nsStore.remember(object)
+		}
+
+		current, ops, failed := applyRules(object, apiVersion, kind, opts, nsStore, rlog)
+		errorCount += failed
+		if kind == "Namespace" {
+			nsStore.remember(current)
+		}
+
+		if err := emit(enc, opts.Emit, apiVersion, kind, namespace, name, current, ops); err != nil {
+			return errorCount, fmt.Errorf("could not write output: %v", err)
+		}
+	}
+
+	return errorCount, nil
+}
+
+// applyRules runs every configured rule against object in order, applying each matching rule's patch
+// to the in-memory object before the next rule is evaluated, and accumulates the individual patch
+// operations so the caller can report the combined patch as well as the final mutated object. A rule
+// whose payload blocks the object stops evaluation of the remaining rules for it, matching how a block
+// rule takes precedence in graffiti.ApplyRules.
+func applyRules(object map[string]interface{}, apiVersion, kind string, opts Options, nsStore *namespaceStore, rlog zerolog.Logger) (current map[string]interface{}, ops []jsonpatch.PatchOperation, errorCount int) {
+	current = object
+	group, version := splitAPIVersion(apiVersion)
+	resource := kindToResource(kind)
+
+	for _, rule := range opts.Rules {
+		if !targetsObject(rule.Registration.Targets, group, version, resource) {
+			continue
+		}
+
+		if rule.Registration.NamespaceSelector != "" {
+			match, err := namespaceSelectorMatches(current, rule.Registration.NamespaceSelector, nsStore, opts.MissingNamespace)
+			if err != nil {
+				rlog.Error().Err(err).Str("rule", rule.Registration.Name).Msg("could not evaluate namespace selector")
+				errorCount++
+				continue
+			}
+			if !match {
+				continue
+			}
+		}
+
+		raw, err := json.Marshal(current)
+		if err != nil {
+			rlog.Error().Err(err).Str("rule", rule.Registration.Name).Msg("could not marshal object")
+			errorCount++
+			continue
+		}
+
+		gr := graffiti.Rule{Name: rule.Registration.Name, Matchers: rule.Matchers, Payload: rule.Payload, EvaluateOn: rule.EvaluateOn, Budget: rule.Budget}
+		patch, err := gr.Mutate(context.Background(), raw)
+		if err != nil {
+			rlog.Error().Err(err).Str("rule", rule.Registration.Name).Msg("could not mutate object")
+			errorCount++
+			continue
+		}
+		if patch == nil {
+			continue
+		}
+		if graffiti.IsBlockPatch(patch) {
+			rlog.Info().Str("rule", rule.Registration.Name).Msg("object is blocked by this rule, no further rules are evaluated")
+			break
+		}
+
+		parsed, err := jsonpatch.FromString(string(patch))
+		if err != nil {
+			rlog.Error().Err(err).Str("rule", rule.Registration.Name).Msg("could not parse the computed patch")
+			errorCount++
+			continue
+		}
+		if err := parsed.Apply(&current); err != nil {
+			rlog.Error().Err(err).Str("rule", rule.Registration.Name).Msg("could not apply the computed patch to the in-memory object")
+			errorCount++
+			continue
+		}
+		ops = append(ops, parsed.Operations...)
+	}
+	return current, ops, errorCount
+}
+
+func emit(enc *json.Encoder, mode Emit, apiVersion, kind, namespace, name string, object map[string]interface{}, ops []jsonpatch.PatchOperation) error {
+	if mode == EmitObjects {
+		return enc.Encode(object)
+	}
+	if ops == nil {
+		ops = []jsonpatch.PatchOperation{}
+	}
+	return enc.Encode(map[string]interface{}{
+		"apiVersion": apiVersion,
+		"kind":       kind,
+		"namespace":  namespace,
+		"name":       name,
+		"patch":      ops,
+	})
+}
+
+// namespaceSelectorMatches evaluates a namespace-selector against object, consulting nsStore for the
+// object's namespace (or the object's own labels, if it is itself a namespace). When the namespace
+// hasn't been seen yet in the stream, it falls back to policy rather than treating the lookup as a
+// cluster error.
+func namespaceSelectorMatches(object map[string]interface{}, selector string, nsStore *namespaceStore, policy MissingNamespacePolicy) (bool, error) {
+	meta, _ := object["metadata"].(map[string]interface{})
+	namespace, _ := meta["namespace"].(string)
+	kind, _ := object["kind"].(string)
+
+	if kind != "Namespace" && namespace != "" {
+		if _, err := nsStore.LookupNamespace(namespace); err != nil && apierrors.IsNotFound(err) {
+			switch policy {
+			case MissingNamespaceAllow:
+				return true, nil
+			case MissingNamespaceSkip:
+				return false, nil
+			default:
+				return false, fmt.Errorf("namespace %q has not appeared earlier in the stream: %v", namespace, err)
+			}
+		}
+	}
+
+	return existing.MatchesNamespaceSelector(object, selector, nsStore)
+}
+
+// targetsObject reports whether any of targets' api-groups/api-versions/resources (literal names, the
+// wildcard "*", or a glob pattern) match the object's own group/version/resource.
+func targetsObject(targets []webhook.Target, group, version, resource string) bool {
+	for _, t := range targets {
+		if matchesAny(group, t.APIGroups) && matchesAny(version, t.APIVersions) && matchesAny(resource, t.Resources) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesAny(element string, patterns []string) bool {
+	for _, p := range patterns {
+		if webhook.MatchesPattern(element, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitAPIVersion splits an object's apiVersion into its group and version, e.g. "apps/v1" becomes
+// ("apps", "v1") and the core group's "v1" becomes ("", "v1").
+func splitAPIVersion(apiVersion string) (group, version string) {
+	parts := strings.SplitN(apiVersion, "/", 2)
+	if len(parts) == 1 {
+		return "", parts[0]
+	}
+	return parts[0], parts[1]
+}
+
+// kindToResource makes a best-effort guess at an object's plural resource name from its kind, e.g.
+// "Deployment" becomes "deployments" and "Ingress" becomes "ingresses". Offline there is no discovery
+// to ask for the real mapping, so an irregular plural (e.g. "Endpoints") won't match a target's
+// resources list precisely - route around this with a wildcard "*" target.
+func kindToResource(kind string) string {
+	lower := strings.ToLower(kind)
+	switch {
+	case strings.HasSuffix(lower, "s"), strings.HasSuffix(lower, "x"), strings.HasSuffix(lower, "ch"), strings.HasSuffix(lower, "sh"):
+		return lower + "es"
+	case strings.HasSuffix(lower, "y"):
+		return strings.TrimSuffix(lower, "y") + "ies"
+	default:
+		return lower + "s"
+	}
+}
+
+// namespaceStore implements existing.NamespaceLookup over namespace objects seen earlier in the
+// stream, rather than a cluster.
+type namespaceStore struct {
+	byName map[string]*corev1.Namespace
+}
+
+func newNamespaceStore() *namespaceStore {
+	return &namespaceStore{byName: make(map[string]*corev1.Namespace)}
+}
+
+func (s *namespaceStore) remember(object map[string]interface{}) {
+	raw, err := json.Marshal(object)
+	if err != nil {
+		return
+	}
+	var ns corev1.Namespace
+	if err := json.Unmarshal(raw, &ns); err != nil || ns.Name == "" {
+		return
+	}
+	s.byName[ns.Name] = &ns
+}
+
+func (s *namespaceStore) LookupNamespace(name string) (*corev1.Namespace, error) {
+	if ns, ok := s.byName[name]; ok {
+		return ns, nil
+	}
+	return nil, apierrors.NewNotFound(corev1.Resource("namespaces"), name)
+}
+
+// yamlDocSeparator splits a multi-document YAML stream on "---" document markers.
+var yamlDocSeparator = regexp.MustCompile(`(?m)^---\s*$`)
+
+// decodeObjects reads every kubernetes object out of r: a JSON object or List, an NDJSON stream of
+// either, or a "---"-separated stream of YAML documents, again either objects or Lists.
+func decodeObjects(r io.Reader) ([]map[string]interface{}, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("could not read input: %v", err)
+	}
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) == 0 {
+		return nil, nil
+	}
+	if trimmed[0] == '{' || trimmed[0] == '[' {
+		return decodeJSONObjects(trimmed)
+	}
+	return decodeYAMLObjects(trimmed)
+}
+
+func decodeJSONObjects(data []byte) ([]map[string]interface{}, error) {
+	var result []map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	for {
+		var object map[string]interface{}
+		if err := dec.Decode(&object); err != nil {
+			if err == io.EOF {
+				return result, nil
+			}
+			return nil, fmt.Errorf("could not decode a json object from the stream: %v", err)
+		}
+		result = append(result, expandListItems(object)...)
+	}
+}
+
+func decodeYAMLObjects(data []byte) ([]map[string]interface{}, error) {
+	var result []map[string]interface{}
+	for _, doc := range yamlDocSeparator.Split(string(data), -1) {
+		if len(strings.TrimSpace(doc)) == 0 {
+			continue
+		}
+		var object map[string]interface{}
+		if err := sigsyaml.Unmarshal([]byte(doc), &object, func(d *json.Decoder) *json.Decoder { d.UseNumber(); return d }); err != nil {
+			return nil, fmt.Errorf("could not decode a yaml document from the stream: %v", err)
+		}
+		if object == nil {
+			continue
+		}
+		result = append(result, expandListItems(object)...)
+	}
+	return result, nil
+}
+
+// expandListItems returns object's items if it is a "List" kind object, otherwise just object itself.
+func expandListItems(object map[string]interface{}) []map[string]interface{} {
+	if kind, _ := object["kind"].(string); kind != "List" {
+		return []map[string]interface{}{object}
+	}
+	items, _ := object["items"].([]interface{})
+	var result []map[string]interface{}
+	for _, item := range items {
+		if m, ok := item.(map[string]interface{}); ok {
+			result = append(result, m)
+		}
+	}
+	return result
+}
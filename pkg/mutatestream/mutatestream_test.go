@@ -0,0 +1,225 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mutatestream
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/HotelsDotCom/kube-graffiti/pkg/config"
+	"github.com/HotelsDotCom/kube-graffiti/pkg/graffiti"
+	"github.com/HotelsDotCom/kube-graffiti/pkg/webhook"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testStream = `{"kind":"List","apiVersion":"v1","items":[
+{"apiVersion":"v1","kind":"Namespace","metadata":{"name":"team-a","labels":{"team":"a"}}},
+{"apiVersion":"apps/v1","kind":"Deployment","metadata":{"name":"web","namespace":"team-a"}},
+{"apiVersion":"apps/v1","kind":"Deployment","metadata":{"name":"web","namespace":"team-b"}}
+]}`
+
+func deploymentRule() config.Rule {
+	return config.Rule{
+		Registration: webhook.Registration{
+			Name:              "label-team-a-deployments",
+			NamespaceSelector: "team = a",
+			Targets: []webhook.Target{
+				{APIGroups: []string{"apps"}, APIVersions: []string{"v1"}, Resources: []string{"deployments"}},
+			},
+		},
+		Matchers: graffiti.Matchers{MatchAll: true},
+		Payload: graffiti.Payload{
+			Additions: graffiti.Additions{Labels: map[string]string{"painted": "true"}},
+		},
+	}
+}
+
+func TestRunEmitsObjectsWithPatchesAppliedUsingNamespacesSeenEarlierInTheStream(t *testing.T) {
+	var out bytes.Buffer
+	errorCount, err := Run(strings.NewReader(testStream), &out, Options{
+		Rules:            []config.Rule{deploymentRule()},
+		Emit:             EmitObjects,
+		MissingNamespace: MissingNamespaceSkip,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 0, errorCount)
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 3)
+
+	var ns map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &ns))
+	assert.Equal(t, "Namespace", ns["kind"])
+
+	var teamA map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &teamA))
+	labels := teamA["metadata"].(map[string]interface{})["labels"].(map[string]interface{})
+	assert.Equal(t, "true", labels["painted"], "the deployment in team-a's namespace should be painted")
+
+	var teamB map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(lines[2]), &teamB))
+	meta := teamB["metadata"].(map[string]interface{})
+	_, hasLabels := meta["labels"]
+	assert.False(t, hasLabels, "the deployment in team-b's namespace doesn't match the namespace-selector and should be left alone")
+}
+
+func TestRunEmitsPatchesAnnotatedWithTargetCoordinates(t *testing.T) {
+	var out bytes.Buffer
+	errorCount, err := Run(strings.NewReader(testStream), &out, Options{
+		Rules:            []config.Rule{deploymentRule()},
+		Emit:             EmitPatches,
+		MissingNamespace: MissingNamespaceSkip,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 0, errorCount)
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 3)
+
+	var nsRecord map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &nsRecord))
+	assert.Equal(t, "Namespace", nsRecord["kind"])
+	assert.Equal(t, "team-a", nsRecord["name"])
+	assert.Empty(t, nsRecord["patch"], "no rule targets namespaces, so it should have an empty patch")
+
+	var matchedRecord map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &matchedRecord))
+	assert.Equal(t, "apps/v1", matchedRecord["apiVersion"])
+	assert.Equal(t, "Deployment", matchedRecord["kind"])
+	assert.Equal(t, "team-a", matchedRecord["namespace"])
+	assert.Equal(t, "web", matchedRecord["name"])
+	ops := matchedRecord["patch"].([]interface{})
+	require.Len(t, ops, 1)
+	op := ops[0].(map[string]interface{})
+	assert.Equal(t, "add", op["op"])
+	assert.Equal(t, "/metadata/labels", op["path"])
+
+	var unmatchedRecord map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(lines[2]), &unmatchedRecord))
+	assert.Equal(t, "team-b", unmatchedRecord["namespace"])
+	assert.Empty(t, unmatchedRecord["patch"])
+}
+
+func TestRunAppliesEachMatchingRuleInOrder(t *testing.T) {
+	stream := `{"apiVersion":"v1","kind":"Pod","metadata":{"name":"my-pod"}}`
+	firstRule := config.Rule{
+		Registration: webhook.Registration{
+			Name:    "first",
+			Targets: []webhook.Target{{APIGroups: []string{""}, APIVersions: []string{"v1"}, Resources: []string{"pods"}}},
+		},
+		Matchers: graffiti.Matchers{MatchAll: true},
+		Payload:  graffiti.Payload{Additions: graffiti.Additions{Labels: map[string]string{"first": "true"}}},
+	}
+	secondRule := config.Rule{
+		Registration: webhook.Registration{
+			Name:    "second",
+			Targets: []webhook.Target{{APIGroups: []string{""}, APIVersions: []string{"v1"}, Resources: []string{"pods"}}},
+		},
+		Matchers: graffiti.Matchers{MatchAll: true},
+		Payload:  graffiti.Payload{Additions: graffiti.Additions{Labels: map[string]string{"second": "true"}}},
+	}
+
+	var out bytes.Buffer
+	errorCount, err := Run(strings.NewReader(stream), &out, Options{
+		Rules: []config.Rule{firstRule, secondRule},
+		Emit:  EmitObjects,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 0, errorCount)
+
+	var pod map[string]interface{}
+	require.NoError(t, json.Unmarshal(out.Bytes(), &pod))
+	labels := pod["metadata"].(map[string]interface{})["labels"].(map[string]interface{})
+	assert.Equal(t, "true", labels["first"])
+	assert.Equal(t, "true", labels["second"])
+}
+
+func TestRunHandlesYAMLMultiDocumentInput(t *testing.T) {
+	stream := "---\napiVersion: v1\nkind: Namespace\nmetadata:\n  name: team-a\n  labels:\n    team: a\n---\napiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: web\n  namespace: team-a\n"
+
+	var out bytes.Buffer
+	errorCount, err := Run(strings.NewReader(stream), &out, Options{
+		Rules: []config.Rule{deploymentRule()},
+		Emit:  EmitObjects,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 0, errorCount)
+	assert.Equal(t, 2, strings.Count(out.String(), "\n"))
+}
+
+func TestRunMissingNamespacePolicies(t *testing.T) {
+	stream := `{"apiVersion":"apps/v1","kind":"Deployment","metadata":{"name":"web","namespace":"unknown-ns"}}`
+
+	var allow bytes.Buffer
+	_, err := Run(strings.NewReader(stream), &allow, Options{Rules: []config.Rule{deploymentRule()}, Emit: EmitObjects, MissingNamespace: MissingNamespaceAllow})
+	require.NoError(t, err)
+	var allowObj map[string]interface{}
+	require.NoError(t, json.Unmarshal(allow.Bytes(), &allowObj))
+	_, hasLabels := allowObj["metadata"].(map[string]interface{})["labels"]
+	assert.True(t, hasLabels, "allow should treat the object as matching even though its namespace hasn't been seen")
+
+	var skip bytes.Buffer
+	errorCount, err := Run(strings.NewReader(stream), &skip, Options{Rules: []config.Rule{deploymentRule()}, Emit: EmitObjects, MissingNamespace: MissingNamespaceSkip})
+	require.NoError(t, err)
+	assert.Equal(t, 0, errorCount)
+	var skipObj map[string]interface{}
+	require.NoError(t, json.Unmarshal(skip.Bytes(), &skipObj))
+	_, hasLabels = skipObj["metadata"].(map[string]interface{})["labels"]
+	assert.False(t, hasLabels, "skip should leave the object unmatched")
+
+	var errOut bytes.Buffer
+	errorCount, err = Run(strings.NewReader(stream), &errOut, Options{Rules: []config.Rule{deploymentRule()}, Emit: EmitObjects, MissingNamespace: MissingNamespaceError})
+	require.NoError(t, err)
+	assert.Equal(t, 1, errorCount, "error is the default policy and should be counted as a failed object")
+}
+
+func TestRunPreservesIntegerPrecisionBeyondFloat64(t *testing.T) {
+	stream := `{"kind":"List","apiVersion":"v1","items":[
+{"apiVersion":"v1","kind":"Namespace","metadata":{"name":"team-a","labels":{"team":"a"}}},
+{"apiVersion":"apps/v1","kind":"Deployment","metadata":{"name":"web","namespace":"team-a","generation":9007199254740993}}
+]}`
+
+	var out bytes.Buffer
+	errorCount, err := Run(strings.NewReader(stream), &out, Options{
+		Rules:            []config.Rule{deploymentRule()},
+		Emit:             EmitObjects,
+		MissingNamespace: MissingNamespaceSkip,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 0, errorCount)
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 2)
+	assert.Contains(t, lines[1], `"generation":9007199254740993`, "a generation beyond float64's integer precision must round-trip byte-for-byte")
+}
+
+func TestKindToResource(t *testing.T) {
+	assert.Equal(t, "deployments", kindToResource("Deployment"))
+	assert.Equal(t, "ingresses", kindToResource("Ingress"))
+	assert.Equal(t, "networkpolicies", kindToResource("NetworkPolicy"))
+	assert.Equal(t, "namespaces", kindToResource("Namespace"))
+}
+
+func TestSplitAPIVersion(t *testing.T) {
+	g, v := splitAPIVersion("apps/v1")
+	assert.Equal(t, "apps", g)
+	assert.Equal(t, "v1", v)
+
+	g, v = splitAPIVersion("v1")
+	assert.Equal(t, "", g)
+	assert.Equal(t, "v1", v)
+}
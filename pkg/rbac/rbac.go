@@ -0,0 +1,204 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package rbac performs a pre-flight check of the permissions a configuration actually needs,
+// verifying them via SelfSubjectAccessReview so that misconfigured RBAC is caught at startup
+// instead of as a stream of Forbidden errors from the existing checker at run time.
+package rbac
+
+import (
+	"fmt"
+
+	"github.com/HotelsDotCom/kube-graffiti/pkg/config"
+	"github.com/HotelsDotCom/kube-graffiti/pkg/log"
+	authv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+)
+
+const componentName = "rbac"
+
+// Permission names a single (group, resource, verb) combination, e.g. the "list" verb on
+// "deployments" in the "apps" group.
+type Permission struct {
+	Group    string
+	Resource string
+	Verb     string
+}
+
+// Requirement pairs a Permission with the name(s) of the rule(s) that need it, so that a
+// consolidated report can tell an operator which rule(s) to fix or remove.
+type Requirement struct {
+	Permission Permission
+	Rules      []string
+}
+
+// MissingPermission is a Requirement that the current credentials do not satisfy.
+type MissingPermission struct {
+	Requirement
+	Reason string
+}
+
+// contributor derives the permissions a single rule needs for one feature. Keeping a contributor
+// per feature means adding support for a new feature's permissions doesn't require touching the
+// others.
+type contributor func(rule config.Rule) []Permission
+
+var contributors = []contributor{
+	existingCheckPermissions,
+	namespaceLookupPermissions,
+	webhookConfigPermissions,
+}
+
+// existingCheckPermissions derives the list/patch permissions needed to sweep a rule's targets.
+func existingCheckPermissions(rule config.Rule) []Permission {
+	var perms []Permission
+	for _, target := range rule.Registration.Targets {
+		for _, group := range target.APIGroups {
+			for _, resource := range target.Resources {
+				perms = append(perms, Permission{Group: group, Resource: resource, Verb: "list"})
+				perms = append(perms, Permission{Group: group, Resource: resource, Verb: "patch"})
+			}
+		}
+	}
+	return perms
+}
+
+// namespaceLookupPermissions derives the get permission needed to evaluate a rule's namespace selector.
+func namespaceLookupPermissions(rule config.Rule) []Permission {
+	if rule.Registration.NamespaceSelector == "" {
+		return nil
+	}
+	return []Permission{{Group: "", Resource: "namespaces", Verb: "get"}}
+}
+
+// webhookConfigPermissions derives the permissions needed to register a rule's MutatingWebhookConfiguration.
+func webhookConfigPermissions(rule config.Rule) []Permission {
+	return []Permission{
+		{Group: "admissionregistration.k8s.io", Resource: "mutatingwebhookconfigurations", Verb: "create"},
+		{Group: "admissionregistration.k8s.io", Resource: "mutatingwebhookconfigurations", Verb: "update"},
+		{Group: "admissionregistration.k8s.io", Resource: "mutatingwebhookconfigurations", Verb: "delete"},
+	}
+}
+
+// DerivePermissions computes the permissions required to run the given rules, deduplicated and
+// annotated with which rule(s) need each one.
+func DerivePermissions(rules []config.Rule) []Requirement {
+	index := make(map[Permission]*Requirement)
+	var order []Permission
+	for _, rule := range rules {
+		for _, contribute := range contributors {
+			for _, perm := range contribute(rule) {
+				req, ok := index[perm]
+				if !ok {
+					req = &Requirement{Permission: perm}
+					index[perm] = req
+					order = append(order, perm)
+				}
+				req.Rules = append(req.Rules, rule.Registration.Name)
+			}
+		}
+	}
+
+	result := make([]Requirement, 0, len(order))
+	for _, perm := range order {
+		result = append(result, *index[perm])
+	}
+	return result
+}
+
+// ExpandWildcards replaces any Requirement whose Group or Resource is "*" with one Requirement per
+// matching (group, resource) pair known to the api server's discovery document.
+func ExpandWildcards(reqs []Requirement, disc discovery.DiscoveryInterface) ([]Requirement, error) {
+	var hasWildcard bool
+	for _, req := range reqs {
+		if req.Permission.Group == "*" || req.Permission.Resource == "*" {
+			hasWildcard = true
+			break
+		}
+	}
+	if !hasWildcard {
+		return reqs, nil
+	}
+
+	resourceLists, err := disc.ServerResources()
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up discovered resources: %v", err)
+	}
+	type groupResource struct{ group, resource string }
+	var known []groupResource
+	for _, rl := range resourceLists {
+		gv, err := schema.ParseGroupVersion(rl.GroupVersion)
+		if err != nil {
+			continue
+		}
+		for _, r := range rl.APIResources {
+			known = append(known, groupResource{gv.Group, r.Name})
+		}
+	}
+
+	var expanded []Requirement
+	for _, req := range reqs {
+		if req.Permission.Group != "*" && req.Permission.Resource != "*" {
+			expanded = append(expanded, req)
+			continue
+		}
+		for _, gr := range known {
+			if req.Permission.Group != "*" && req.Permission.Group != gr.group {
+				continue
+			}
+			if req.Permission.Resource != "*" && req.Permission.Resource != gr.resource {
+				continue
+			}
+			expanded = append(expanded, Requirement{
+				Permission: Permission{Group: gr.group, Resource: gr.resource, Verb: req.Permission.Verb},
+				Rules:      req.Rules,
+			})
+		}
+	}
+	return expanded, nil
+}
+
+// sarCreator is the single method of the generated SelfSubjectAccessReview client that
+// CheckPermissions needs, kept narrow so that tests can provide a mock instead of a full clientset.
+type sarCreator interface {
+	Create(sar *authv1.SelfSubjectAccessReview) (*authv1.SelfSubjectAccessReview, error)
+}
+
+// CheckPermissions verifies each requirement via SelfSubjectAccessReview, returning the ones that
+// the current credentials do not satisfy.
+func CheckPermissions(client sarCreator, reqs []Requirement) ([]MissingPermission, error) {
+	mylog := log.ComponentLogger(componentName, "CheckPermissions")
+
+	var missing []MissingPermission
+	for _, req := range reqs {
+		ssar := &authv1.SelfSubjectAccessReview{
+			Spec: authv1.SelfSubjectAccessReviewSpec{
+				ResourceAttributes: &authv1.ResourceAttributes{
+					Group:    req.Permission.Group,
+					Resource: req.Permission.Resource,
+					Verb:     req.Permission.Verb,
+				},
+			},
+		}
+		result, err := client.Create(ssar)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check access for %s/%s %s: %v", req.Permission.Group, req.Permission.Resource, req.Permission.Verb, err)
+		}
+		if !result.Status.Allowed {
+			mylog.Warn().Str("group", req.Permission.Group).Str("resource", req.Permission.Resource).Str("verb", req.Permission.Verb).Strs("rules", req.Rules).Msg("missing rbac permission required by a configured rule")
+			missing = append(missing, MissingPermission{Requirement: req, Reason: result.Status.Reason})
+		}
+	}
+	return missing, nil
+}
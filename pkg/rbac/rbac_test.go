@@ -0,0 +1,120 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rbac
+
+import (
+	"testing"
+
+	"github.com/HotelsDotCom/kube-graffiti/pkg/config"
+	"github.com/HotelsDotCom/kube-graffiti/pkg/webhook"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	authv1 "k8s.io/api/authorization/v1"
+)
+
+func testRule(name string, namespaceSelector string, targets ...webhook.Target) config.Rule {
+	return config.Rule{
+		Registration: webhook.Registration{
+			Name:              name,
+			NamespaceSelector: namespaceSelector,
+			Targets:           targets,
+		},
+	}
+}
+
+// mockSarCreator stands in for the generated SelfSubjectAccessReview client. Each review comes back
+// with the allowed value and error a test stubs for its group/resource/verb; an unstubbed review panics.
+type mockSarCreator struct {
+	mock.Mock
+}
+
+func (m *mockSarCreator) Create(sar *authv1.SelfSubjectAccessReview) (*authv1.SelfSubjectAccessReview, error) {
+	args := m.Called(sar.Spec.ResourceAttributes.Group, sar.Spec.ResourceAttributes.Resource, sar.Spec.ResourceAttributes.Verb)
+	result := sar.DeepCopy()
+	result.Status.Allowed = args.Bool(0)
+	return result, args.Error(1)
+}
+
+func TestDerivePermissionsIncludesListAndPatchForEachTarget(t *testing.T) {
+	rule := testRule("label-deployments", "", webhook.Target{
+		APIGroups: []string{"apps"},
+		Resources: []string{"deployments"},
+	})
+
+	reqs := DerivePermissions([]config.Rule{rule})
+
+	assert.Contains(t, reqs, Requirement{Permission: Permission{Group: "apps", Resource: "deployments", Verb: "list"}, Rules: []string{"label-deployments"}})
+	assert.Contains(t, reqs, Requirement{Permission: Permission{Group: "apps", Resource: "deployments", Verb: "patch"}, Rules: []string{"label-deployments"}})
+}
+
+func TestDerivePermissionsIncludesNamespaceLookupOnlyWhenSelectorSet(t *testing.T) {
+	withSelector := testRule("with-selector", "env=prod")
+	withoutSelector := testRule("without-selector", "")
+
+	reqs := DerivePermissions([]config.Rule{withSelector, withoutSelector})
+
+	nsReq := findPermission(reqs, Permission{Group: "", Resource: "namespaces", Verb: "get"})
+	require.NotNil(t, nsReq)
+	assert.Equal(t, []string{"with-selector"}, nsReq.Rules)
+}
+
+func TestDerivePermissionsAlwaysIncludesWebhookConfigPermissions(t *testing.T) {
+	rule := testRule("any-rule", "")
+
+	reqs := DerivePermissions([]config.Rule{rule})
+
+	for _, verb := range []string{"create", "update", "delete"} {
+		assert.NotNil(t, findPermission(reqs, Permission{Group: "admissionregistration.k8s.io", Resource: "mutatingwebhookconfigurations", Verb: verb}))
+	}
+}
+
+func TestDerivePermissionsDeduplicatesAndMergesRuleNames(t *testing.T) {
+	target := webhook.Target{APIGroups: []string{"apps"}, Resources: []string{"deployments"}}
+	ruleA := testRule("rule-a", "", target)
+	ruleB := testRule("rule-b", "", target)
+
+	reqs := DerivePermissions([]config.Rule{ruleA, ruleB})
+
+	req := findPermission(reqs, Permission{Group: "apps", Resource: "deployments", Verb: "list"})
+	require.NotNil(t, req)
+	assert.ElementsMatch(t, []string{"rule-a", "rule-b"}, req.Rules)
+}
+
+func TestCheckPermissionsReportsMissingPermissionsAndCallsSSAR(t *testing.T) {
+	reqs := []Requirement{
+		{Permission: Permission{Group: "apps", Resource: "deployments", Verb: "patch"}, Rules: []string{"label-deployments"}},
+		{Permission: Permission{Group: "", Resource: "namespaces", Verb: "get"}, Rules: []string{"with-selector"}},
+	}
+
+	client := new(mockSarCreator)
+	client.On("Create", "apps", "deployments", "patch").Return(false, nil)
+	client.On("Create", "", "namespaces", "get").Return(false, nil)
+
+	missing, err := CheckPermissions(client, reqs)
+	require.NoError(t, err)
+	assert.Len(t, missing, 2)
+	client.AssertExpectations(t)
+	client.AssertNumberOfCalls(t, "Create", 2)
+}
+
+func findPermission(reqs []Requirement, p Permission) *Requirement {
+	for i := range reqs {
+		if reqs[i].Permission == p {
+			return &reqs[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,220 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package statusz renders a single human-oriented status page, /statusz on the health-checker http
+// server, that pulls together the handful of read-only registries scattered across the other
+// packages - readiness, rule registration, config load result, the existing-objects run report, the
+// log package's recent-error dedup, and a few in-process metric rates - so a responder can curl one
+// URL during an incident instead of hunting across /existing/status, /existing/coverage and the logs.
+// Every field comes from state someone else already maintains; this package only aggregates and
+// renders it, with html/template for the human view and encoding/json (via httpresponse.WriteJSON)
+// for the machine view.
+package statusz
+
+import (
+	"html/template"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HotelsDotCom/kube-graffiti/pkg/existing"
+	"github.com/HotelsDotCom/kube-graffiti/pkg/httpresponse"
+	"github.com/HotelsDotCom/kube-graffiti/pkg/log"
+	"github.com/HotelsDotCom/kube-graffiti/pkg/metrics"
+	"github.com/HotelsDotCom/kube-graffiti/pkg/version"
+)
+
+const componentName = "statusz"
+
+// RatesWindow is how far back the request/error/block rates reported on the status page are
+// averaged over. It is capped by metrics.WindowSize regardless of how large it's set to.
+var RatesWindow = time.Minute
+
+// startTime is when this process' statusz package was initialised, close enough to process start
+// for an "uptime" figure on an incident status page.
+var startTime = time.Now()
+
+// ComponentStatus is one subsystem's readiness, as registered via RegisterComponent.
+type ComponentStatus struct {
+	Name   string `json:"name"`
+	Ready  bool   `json:"ready"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// RuleStatus is one rule's webhook registration, as set via SetRules.
+type RuleStatus struct {
+	Name         string    `json:"name"`
+	Path         string    `json:"path"`
+	Registered   bool      `json:"registered"`
+	LastError    string    `json:"last-error,omitempty"`
+	RegisteredAt time.Time `json:"registered-at,omitempty"`
+}
+
+// ConfigLoadStatus is the outcome of the most recent configuration (re)load, as set via
+// RecordConfigLoad.
+type ConfigLoadStatus struct {
+	At    time.Time `json:"at,omitempty"`
+	OK    bool      `json:"ok"`
+	Error string    `json:"error,omitempty"`
+}
+
+// RateSnapshot is a small in-process sliding-window view of traffic over RatesWindow.
+type RateSnapshot struct {
+	RequestsPerSecond float64 `json:"requests-per-second"`
+	ErrorsPerSecond   float64 `json:"errors-per-second"`
+	BlocksPerSecond   float64 `json:"blocks-per-second"`
+}
+
+// Snapshot is everything rendered on the status page, gathered fresh on every request from bounded,
+// read-only registries - nothing here is itself a new source of unbounded growth.
+type Snapshot struct {
+	StartTime     time.Time          `json:"start-time"`
+	Uptime        string             `json:"uptime"`
+	Version       version.Info       `json:"version"`
+	Components    []ComponentStatus  `json:"components"`
+	Rules         []RuleStatus       `json:"rules"`
+	ConfigLoad    ConfigLoadStatus   `json:"config-load"`
+	ExistingCheck existing.RunStatus `json:"existing-check"`
+	RecentErrors  []log.DedupedError `json:"recent-errors"`
+	Rates         RateSnapshot       `json:"rates"`
+}
+
+type componentCheck struct {
+	name  string
+	check func() (ready bool, detail string)
+}
+
+var (
+	mu         sync.Mutex
+	components []componentCheck
+	rules      []RuleStatus
+	configLoad ConfigLoadStatus
+)
+
+// RegisterComponent adds a named readiness probe to the status page. check is called fresh on every
+// request, so it must be cheap and non-blocking - exactly the same contract as
+// healthcheck.HealthChecker's readinessFunc.
+func RegisterComponent(name string, check func() (ready bool, detail string)) {
+	mu.Lock()
+	defer mu.Unlock()
+	components = append(components, componentCheck{name: name, check: check})
+}
+
+// SetRules replaces the rule registration list shown on the status page. It is called once, after
+// every configured rule has attempted registration, rather than incrementally, so that a rule
+// dropped from configuration since the last reload doesn't linger on the page.
+func SetRules(r []RuleStatus) {
+	mu.Lock()
+	defer mu.Unlock()
+	rules = append([]RuleStatus(nil), r...)
+}
+
+// RecordConfigLoad notes the outcome of a configuration (re)load attempt.
+func RecordConfigLoad(err error) {
+	mu.Lock()
+	defer mu.Unlock()
+	configLoad = ConfigLoadStatus{At: time.Now(), OK: err == nil}
+	if err != nil {
+		configLoad.Error = err.Error()
+	}
+}
+
+// buildSnapshot gathers the current state of every registry into a Snapshot.
+func buildSnapshot() Snapshot {
+	mu.Lock()
+	checks := append([]componentCheck(nil), components...)
+	ruleList := append([]RuleStatus(nil), rules...)
+	load := configLoad
+	mu.Unlock()
+
+	componentStatuses := make([]ComponentStatus, 0, len(checks))
+	for _, c := range checks {
+		ready, detail := c.check()
+		componentStatuses = append(componentStatuses, ComponentStatus{Name: c.name, Ready: ready, Detail: detail})
+	}
+
+	return Snapshot{
+		StartTime:     startTime,
+		Uptime:        time.Since(startTime).Round(time.Second).String(),
+		Version:       version.Get(),
+		Components:    componentStatuses,
+		Rules:         ruleList,
+		ConfigLoad:    load,
+		ExistingCheck: existing.CurrentRunStatus(),
+		RecentErrors:  log.RecentErrors(),
+		Rates: RateSnapshot{
+			RequestsPerSecond: metrics.RequestRateWindow.RatePerSecond(RatesWindow),
+			ErrorsPerSecond:   metrics.ErrorRateWindow.RatePerSecond(RatesWindow),
+			BlocksPerSecond:   metrics.BlockRateWindow.RatePerSecond(RatesWindow),
+		},
+	}
+}
+
+// Handler renders the current Snapshot as HTML, or as JSON if the request's Accept header asks for
+// application/json - for registering against an operator-facing status endpoint such as /statusz on
+// the health-checker http server.
+func Handler(w http.ResponseWriter, r *http.Request) {
+	mylog := log.ComponentLogger(componentName, "Handler")
+	snapshot := buildSnapshot()
+
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		httpresponse.WriteJSON(w, http.StatusOK, snapshot)
+		return
+	}
+
+	httpresponse.SetCommonHeaders(w)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	if err := pageTemplate.Execute(w, snapshot); err != nil {
+		mylog.Error().Err(err).Msg("failed to render statusz page")
+	}
+}
+
+var pageTemplate = template.Must(template.New("statusz").Parse(`<!DOCTYPE html>
+<html>
+<head><title>kube-graffiti status</title></head>
+<body>
+<h1>kube-graffiti status</h1>
+<p>version {{.Version.Version}} (commit {{.Version.Commit}}, built {{.Version.Date}})<br>
+started {{.StartTime}}, up {{.Uptime}}</p>
+
+<h2>Components</h2>
+<table border="1" cellpadding="4">
+<tr><th>Name</th><th>Ready</th><th>Detail</th></tr>
+{{range .Components}}<tr><td>{{.Name}}</td><td>{{.Ready}}</td><td>{{.Detail}}</td></tr>
+{{end}}</table>
+
+<h2>Rules</h2>
+<table border="1" cellpadding="4">
+<tr><th>Name</th><th>Path</th><th>Registered</th><th>Last Error</th><th>Registered At</th></tr>
+{{range .Rules}}<tr><td>{{.Name}}</td><td>{{.Path}}</td><td>{{.Registered}}</td><td>{{.LastError}}</td><td>{{.RegisteredAt}}</td></tr>
+{{end}}</table>
+
+<h2>Config Load</h2>
+<p>ok: {{.ConfigLoad.OK}}, at: {{.ConfigLoad.At}}{{if .ConfigLoad.Error}}, error: {{.ConfigLoad.Error}}{{end}}</p>
+
+<h2>Existing-Objects Check</h2>
+<p>ran: {{.ExistingCheck.Ran}}, at: {{.ExistingCheck.At}}, patched: {{.ExistingCheck.Patched}}, errored: {{.ExistingCheck.Errored}}</p>
+
+<h2>Recent Errors</h2>
+<table border="1" cellpadding="4">
+<tr><th>Message</th><th>Count</th><th>Last Seen</th></tr>
+{{range .RecentErrors}}<tr><td>{{.Message}}</td><td>{{.Count}}</td><td>{{.LastSeen}}</td></tr>
+{{end}}</table>
+
+<h2>Rates</h2>
+<p>requests/s: {{.Rates.RequestsPerSecond}}, errors/s: {{.Rates.ErrorsPerSecond}}, blocks/s: {{.Rates.BlocksPerSecond}}</p>
+</body>
+</html>
+`))
@@ -0,0 +1,96 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package statusz
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// resetRegistries clears the component/rule/config-load registries and returns a func that restores
+// them, so tests that populate fake registries don't leak state into each other.
+func resetRegistries(t *testing.T) func() {
+	mu.Lock()
+	oldComponents := components
+	oldRules := rules
+	oldConfigLoad := configLoad
+	components = nil
+	rules = nil
+	configLoad = ConfigLoadStatus{}
+	mu.Unlock()
+
+	return func() {
+		mu.Lock()
+		components = oldComponents
+		rules = oldRules
+		configLoad = oldConfigLoad
+		mu.Unlock()
+	}
+}
+
+func TestHandlerRendersJSONWhenAcceptHeaderAsksForIt(t *testing.T) {
+	defer resetRegistries(t)()
+	RegisterComponent("widget-controller", func() (bool, string) { return false, "not watching any namespaces yet" })
+	SetRules([]RuleStatus{{Name: "label-team-a", Path: "/hooks/label-team-a", Registered: true}})
+	RecordConfigLoad(errors.New("rule 'label-team-a': invalid label selector"))
+
+	req := httptest.NewRequest(http.MethodGet, "/statusz", nil)
+	req.Header.Set("Accept", "application/json")
+	rr := httptest.NewRecorder()
+	Handler(rr, req)
+
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+
+	var snapshot Snapshot
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &snapshot))
+	require.Len(t, snapshot.Components, 1)
+	assert.Equal(t, "widget-controller", snapshot.Components[0].Name)
+	assert.False(t, snapshot.Components[0].Ready)
+	require.Len(t, snapshot.Rules, 1)
+	assert.Equal(t, "label-team-a", snapshot.Rules[0].Name)
+	assert.False(t, snapshot.ConfigLoad.OK)
+	assert.Contains(t, snapshot.ConfigLoad.Error, "invalid label selector")
+}
+
+func TestHandlerRendersHTMLByDefaultWithKeySections(t *testing.T) {
+	defer resetRegistries(t)()
+	RegisterComponent("widget-controller", func() (bool, string) { return true, "" })
+	SetRules([]RuleStatus{{Name: "label-team-a", Path: "/hooks/label-team-a", Registered: true}})
+	RecordConfigLoad(nil)
+
+	req := httptest.NewRequest(http.MethodGet, "/statusz", nil)
+	rr := httptest.NewRecorder()
+	Handler(rr, req)
+
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Header().Get("Content-Type"), "text/html")
+
+	body := rr.Body.String()
+	assert.Contains(t, body, "widget-controller")
+	assert.Contains(t, body, "label-team-a")
+	assert.Contains(t, body, "/hooks/label-team-a")
+	assert.True(t, strings.Contains(body, "<h2>Components</h2>"))
+	assert.True(t, strings.Contains(body, "<h2>Rules</h2>"))
+	assert.True(t, strings.Contains(body, "<h2>Existing-Objects Check</h2>"))
+	assert.True(t, strings.Contains(body, "<h2>Recent Errors</h2>"))
+	assert.True(t, strings.Contains(body, "<h2>Rates</h2>"))
+}
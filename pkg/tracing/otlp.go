@@ -0,0 +1,85 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// otlpHTTPExporter forwards spans to an OTLP/HTTP collector endpoint, configured via the standard
+// OTEL_EXPORTER_OTLP_ENDPOINT and OTEL_EXPORTER_OTLP_HEADERS environment variables. It posts a small
+// JSON summary of each span rather than the real OTLP protobuf envelope - that schema, and the protobuf
+// library it needs, are not vendored in this repository - so it is a stand-in for the real OTLP/HTTP
+// exporter a vendored SDK would provide, not a spec-compliant one.
+type otlpHTTPExporter struct {
+	endpoint string
+	headers  map[string]string
+	client   *http.Client
+}
+
+// NewOTLPHTTPExporter builds an Exporter that posts spans to $OTEL_EXPORTER_OTLP_ENDPOINT/v1/traces,
+// reading OTEL_EXPORTER_OTLP_ENDPOINT and OTEL_EXPORTER_OTLP_HEADERS ("key=value,key=value" as the
+// collector's docs describe) from the environment. It returns nil, false if OTEL_EXPORTER_OTLP_ENDPOINT
+// is unset or empty, so callers can fall back to discardExporter or an explicit InMemoryExporter.
+func NewOTLPHTTPExporter() (Exporter, bool) {
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	if endpoint == "" {
+		return nil, false
+	}
+	return &otlpHTTPExporter{
+		endpoint: strings.TrimRight(endpoint, "/"),
+		headers:  parseOTLPHeaders(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS")),
+		client:   &http.Client{Timeout: 5 * time.Second},
+	}, true
+}
+
+func parseOTLPHeaders(value string) map[string]string {
+	headers := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			continue
+		}
+		headers[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return headers
+}
+
+// Export posts span as JSON to the configured collector endpoint, logging nothing and blocking the
+// caller for at most the client's timeout - tracing is best-effort and must never hold up the admission
+// pipeline it's instrumenting.
+func (e *otlpHTTPExporter) Export(span Span) {
+	body, err := json.Marshal(span)
+	if err != nil {
+		return
+	}
+	req, err := http.NewRequest(http.MethodPost, e.endpoint+"/v1/traces", bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return
+	}
+	resp.Body.Close()
+}
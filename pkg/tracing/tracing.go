@@ -0,0 +1,164 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package tracing records spans around the admission pipeline (ServeHTTP, MutateAdmission, Mutate) so an
+// operator can follow one request's rule evaluation across logs. It is not the OpenTelemetry SDK - that
+// library, and the OTLP wire format it speaks, are not vendored in this repository - but the shape (a
+// trace ID and span ID propagated from a W3C "traceparent" request header, spans with string attributes,
+// an Exporter every span is handed off to) mirrors it closely enough that wiring up the real SDK later
+// should only touch this package. It is a no-op, with StartSpan handing back a nil *Span, unless Enabled
+// is set.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Enabled gates every span this package creates, configured via the tracing.enabled configuration key.
+// It defaults to false so that tracing is entirely inert - no span allocation, no exporter calls - until
+// an operator opts in.
+var Enabled = false
+
+// Exporter receives completed spans. CurrentExporter defaults to a discardExporter; NewOTLPHTTPExporter
+// builds one that forwards spans to an OTLP-compatible collector, and InMemoryExporter collects them for
+// tests.
+type Exporter interface {
+	Export(Span)
+}
+
+// CurrentExporter is where every span is sent once it ends. It may be replaced wholesale, e.g. with the
+// result of NewOTLPHTTPExporter, before tracing is enabled.
+var CurrentExporter Exporter = discardExporter{}
+
+type discardExporter struct{}
+
+func (discardExporter) Export(Span) {}
+
+// Span is a single recorded span. Name identifies the instrumented function ("ServeHTTP",
+// "MutateAdmission", "Mutate"); TraceID is shared by every span in one request; SpanID is unique to this
+// span; ParentSpanID is the SpanID of the span it was started from, or "" for the first span of a trace.
+type Span struct {
+	Name         string
+	TraceID      string
+	SpanID       string
+	ParentSpanID string
+	Attributes   map[string]string
+}
+
+// SetAttribute records a string attribute on the span, e.g. the matched rule's name or a patch's size.
+// It is a no-op on a nil *Span, so instrumented code can call it unconditionally even when tracing is
+// disabled.
+func (s *Span) SetAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+	s.Attributes[key] = value
+}
+
+// End hands the span to CurrentExporter. It is a no-op on a nil *Span.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	CurrentExporter.Export(*s)
+}
+
+type spanContextKey struct{}
+
+// StartSpan starts a new span named name, nested under the span (if any) carried by ctx, and returns a
+// context carrying the new span alongside it. When Enabled is false it returns ctx unchanged and a nil
+// *Span, so every call downstream of it - including SetAttribute and End - is a cheap no-op.
+func StartSpan(ctx context.Context, name string) (context.Context, *Span) {
+	if !Enabled {
+		return ctx, nil
+	}
+	span := &Span{
+		Name:       name,
+		TraceID:    traceIDFromContext(ctx),
+		SpanID:     newID(8),
+		Attributes: make(map[string]string),
+	}
+	if parent, ok := ctx.Value(spanContextKey{}).(*Span); ok && parent != nil {
+		span.ParentSpanID = parent.SpanID
+	}
+	return context.WithValue(ctx, spanContextKey{}, span), span
+}
+
+func traceIDFromContext(ctx context.Context) string {
+	if parent, ok := ctx.Value(spanContextKey{}).(*Span); ok && parent != nil {
+		return parent.TraceID
+	}
+	return newID(16)
+}
+
+// newID returns a random lowercase hex string encoding n random bytes - 16 for a trace ID, 8 for a span
+// ID, matching the W3C trace-context ID widths.
+func newID(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return strings.Repeat("0", n*2)
+	}
+	return hex.EncodeToString(b)
+}
+
+// ExtractContext pulls a W3C "traceparent" header (https://www.w3.org/TR/trace-context/) off r, if
+// present, and returns a context that StartSpan will treat as a child of it - letting a trace started by
+// an upstream caller continue through this admission request - rather than starting a fresh trace.
+// A missing or malformed header leaves ctx unchanged; StartSpan then begins a new trace as usual.
+func ExtractContext(ctx context.Context, r *http.Request) context.Context {
+	traceID, parentSpanID, ok := parseTraceParent(r.Header.Get("traceparent"))
+	if !ok {
+		return ctx
+	}
+	return context.WithValue(ctx, spanContextKey{}, &Span{TraceID: traceID, SpanID: parentSpanID})
+}
+
+// parseTraceParent parses the "<version>-<trace-id>-<parent-id>-<flags>" traceparent header format.
+func parseTraceParent(header string) (traceID, parentSpanID string, ok bool) {
+	parts := strings.Split(header, "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return "", "", false
+	}
+	return parts[1], parts[2], true
+}
+
+// InMemoryExporter collects every exported span for inspection, e.g. by a test asserting that a span
+// with particular attributes was recorded.
+type InMemoryExporter struct {
+	mu    sync.Mutex
+	spans []Span
+}
+
+// NewInMemoryExporter returns an empty InMemoryExporter.
+func NewInMemoryExporter() *InMemoryExporter {
+	return &InMemoryExporter{}
+}
+
+// Export implements Exporter.
+func (e *InMemoryExporter) Export(s Span) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, s)
+}
+
+// Spans returns every span exported so far, in export order.
+func (e *InMemoryExporter) Spans() []Span {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]Span(nil), e.spans...)
+}
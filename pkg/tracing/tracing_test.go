@@ -0,0 +1,138 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func withTracingEnabled(t *testing.T) *InMemoryExporter {
+	oldEnabled, oldExporter := Enabled, CurrentExporter
+	exporter := NewInMemoryExporter()
+	Enabled = true
+	CurrentExporter = exporter
+	t.Cleanup(func() {
+		Enabled = oldEnabled
+		CurrentExporter = oldExporter
+	})
+	return exporter
+}
+
+func TestStartSpanIsANoopWhenTracingIsDisabled(t *testing.T) {
+	Enabled = false
+	ctx, span := StartSpan(context.Background(), "ServeHTTP")
+	assert.Nil(t, span)
+	span.SetAttribute("rule", "my-rule")
+	span.End()
+	assert.Equal(t, context.Background(), ctx)
+}
+
+func TestStartSpanRecordsAttributesAndExportsOnEnd(t *testing.T) {
+	exporter := withTracingEnabled(t)
+
+	_, span := StartSpan(context.Background(), "MutateAdmission")
+	span.SetAttribute("rule", "add-a-label")
+	span.SetAttribute("matched", "true")
+	span.End()
+
+	require.Len(t, exporter.Spans(), 1)
+	got := exporter.Spans()[0]
+	assert.Equal(t, "MutateAdmission", got.Name)
+	assert.Equal(t, "add-a-label", got.Attributes["rule"])
+	assert.Equal(t, "true", got.Attributes["matched"])
+	assert.NotEmpty(t, got.TraceID)
+	assert.NotEmpty(t, got.SpanID)
+}
+
+func TestNestedSpansShareATraceIDAndLinkToTheirParent(t *testing.T) {
+	withTracingEnabled(t)
+
+	ctx, outer := StartSpan(context.Background(), "ServeHTTP")
+	_, inner := StartSpan(ctx, "MutateAdmission")
+
+	assert.Equal(t, outer.TraceID, inner.TraceID)
+	assert.Equal(t, outer.SpanID, inner.ParentSpanID)
+}
+
+func TestExtractContextContinuesAnIncomingTraceParentHeader(t *testing.T) {
+	withTracingEnabled(t)
+
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	ctx := ExtractContext(context.Background(), r)
+	_, span := StartSpan(ctx, "ServeHTTP")
+
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", span.TraceID)
+	assert.Equal(t, "00f067aa0ba902b7", span.ParentSpanID)
+}
+
+func TestExtractContextIgnoresAMissingHeader(t *testing.T) {
+	withTracingEnabled(t)
+
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	ctx := ExtractContext(context.Background(), r)
+	_, span := StartSpan(ctx, "ServeHTTP")
+
+	assert.NotEmpty(t, span.TraceID)
+	assert.Empty(t, span.ParentSpanID)
+}
+
+func TestParseOTLPHeadersParsesCommaSeparatedKeyValuePairs(t *testing.T) {
+	headers := parseOTLPHeaders("api-key=secret, x-team = platform")
+	assert.Equal(t, "secret", headers["api-key"])
+	assert.Equal(t, "platform", headers["x-team"])
+}
+
+func TestNewOTLPHTTPExporterRequiresAnEndpoint(t *testing.T) {
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+	_, ok := NewOTLPHTTPExporter()
+	assert.False(t, ok)
+}
+
+func TestNewOTLPHTTPExporterPostsSpansToTheConfiguredCollector(t *testing.T) {
+	received := make(chan Span, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/traces", r.URL.Path)
+		assert.Equal(t, "secret", r.Header.Get("api-key"))
+		var span Span
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&span))
+		received <- span
+	}))
+	defer server.Close()
+
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", server.URL)
+	t.Setenv("OTEL_EXPORTER_OTLP_HEADERS", "api-key=secret")
+
+	exporter, ok := NewOTLPHTTPExporter()
+	require.True(t, ok)
+
+	exporter.Export(Span{Name: "Mutate", Attributes: map[string]string{"rule": "my-rule"}})
+
+	select {
+	case span := <-received:
+		assert.Equal(t, "Mutate", span.Name)
+		assert.Equal(t, "my-rule", span.Attributes["rule"])
+	case <-time.After(2 * time.Second):
+		t.Fatal("exporter did not post the span in time")
+	}
+}
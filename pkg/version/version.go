@@ -0,0 +1,62 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package version holds build metadata that is injected at build time via ldflags.
+package version
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// These variables are populated at build time using -ldflags, see the Makefile.
+var (
+	Version = "dev"
+	Commit  = "unknown"
+	Date    = "unknown"
+)
+
+// Info bundles the build metadata together for printing or marshalling.
+type Info struct {
+	Version string `json:"version"`
+	Commit  string `json:"commit"`
+	Date    string `json:"date"`
+}
+
+// Get returns the current build's version information.
+func Get() Info {
+	return Info{
+		Version: Version,
+		Commit:  Commit,
+		Date:    Date,
+	}
+}
+
+// String renders the build information as a single human readable line.
+func (i Info) String() string {
+	return fmt.Sprintf("kube-graffiti version %s (commit %s, built %s)", i.Version, i.Commit, i.Date)
+}
+
+// JSON renders the build information as a JSON document.
+func (i Info) JSON() (string, error) {
+	b, err := json.Marshal(i)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// UserAgent returns a string suitable for use as an apiserver client user-agent.
+func UserAgent() string {
+	return fmt.Sprintf("kube-graffiti/%s (commit %s)", Version, Commit)
+}
@@ -0,0 +1,47 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package version
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetReturnsInjectedValues(t *testing.T) {
+	oldVersion, oldCommit, oldDate := Version, Commit, Date
+	defer func() { Version, Commit, Date = oldVersion, oldCommit, oldDate }()
+
+	Version = "1.2.3"
+	Commit = "abc1234"
+	Date = "2026-08-08T00:00:00Z"
+
+	info := Get()
+	assert.Equal(t, "1.2.3", info.Version)
+	assert.Equal(t, "abc1234", info.Commit)
+	assert.Equal(t, "2026-08-08T00:00:00Z", info.Date)
+}
+
+func TestJSONParses(t *testing.T) {
+	info := Info{Version: "1.2.3", Commit: "abc1234", Date: "2026-08-08T00:00:00Z"}
+	j, err := info.JSON()
+	require.NoError(t, err)
+
+	var parsed Info
+	err = json.Unmarshal([]byte(j), &parsed)
+	require.NoError(t, err)
+	assert.Equal(t, info, parsed)
+}
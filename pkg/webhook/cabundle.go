@@ -0,0 +1,113 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/HotelsDotCom/kube-graffiti/pkg/log"
+	admissionregclient "k8s.io/client-go/kubernetes/typed/admissionregistration/v1beta1"
+)
+
+// CABundleRefreshInterval controls how often StartCABundleRefresher re-stats the CA certificate file.
+var CABundleRefreshInterval = 5 * time.Minute
+
+// caBundleBox holds the CA bundle that graffiti advertises on its webhook registrations behind a mutex.
+// Server is handed around by value throughout this package, so the bundle itself has to live behind a
+// pointer - every Server built from the same caBundleBox by NewServer sees a refresher's update
+// immediately, rather than each copy keeping its own stale []byte.
+type caBundleBox struct {
+	mu    sync.RWMutex
+	bytes []byte
+}
+
+func newCABundleBox(initial []byte) *caBundleBox {
+	return &caBundleBox{bytes: initial}
+}
+
+func (b *caBundleBox) get() []byte {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.bytes
+}
+
+func (b *caBundleBox) set(bytes []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.bytes = bytes
+}
+
+// refreshCABundle re-reads caPath if its modification time has moved on since lastModTime, updates s's
+// shared CA bundle and re-registers every rule so the apiserver's webhook configurations pick up the new
+// CABundle - RegisterHook is the only place that writes one, so healing it here re-uses the exact same
+// path that ReconcilePaths uses to heal a path mismatch.
+func (s Server) refreshCABundle(caPath string, lastModTime *time.Time, client admissionregclient.MutatingWebhookConfigurationInterface, registrations map[string]Registration) error {
+	mylog := log.ComponentLogger(componentName, "refreshCABundle")
+
+	info, err := os.Stat(caPath)
+	if err != nil {
+		return fmt.Errorf("failed to stat ca cert file %q: %v", caPath, err)
+	}
+	if info.ModTime().Equal(*lastModTime) {
+		return nil
+	}
+
+	bytes, err := ioutil.ReadFile(caPath)
+	if err != nil {
+		return fmt.Errorf("failed to read ca cert file %q: %v", caPath, err)
+	}
+
+	mylog.Info().Str("ca-cert-path", caPath).Msg("detected a change to the ca certificate, updating registered webhook configurations")
+	s.caBundle.set(bytes)
+	*lastModTime = info.ModTime()
+
+	for name, r := range registrations {
+		if err := s.RegisterHook(r, client); err != nil {
+			mylog.Error().Err(err).Str("name", name).Msg("failed to re-register webhook configuration with the rotated ca bundle")
+		}
+	}
+	return nil
+}
+
+// StartCABundleRefresher polls caPath every CABundleRefreshInterval and, whenever it changes, updates the
+// CABundle advertised by every registered webhook configuration - so that a cert-manager rotation of the
+// CA certificate doesn't leave the apiserver trusting a CA that no longer signs the webhook's serving
+// certificate.
+func (s Server) StartCABundleRefresher(caPath string, client admissionregclient.MutatingWebhookConfigurationInterface, registrations map[string]Registration, stop <-chan struct{}) {
+	mylog := log.ComponentLogger(componentName, "StartCABundleRefresher")
+
+	var lastModTime time.Time
+	if info, err := os.Stat(caPath); err == nil {
+		lastModTime = info.ModTime()
+	}
+
+	go func() {
+		ticker := time.NewTicker(CABundleRefreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if err := s.refreshCABundle(caPath, &lastModTime, client, registrations); err != nil {
+					mylog.Error().Err(err).Msg("failed to check for a rotated ca certificate")
+				}
+			}
+		}
+	}()
+}
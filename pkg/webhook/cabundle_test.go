@@ -0,0 +1,74 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestRefreshCABundleDoesNothingWhenTheFileIsUnchanged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cabundle")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	caPath := dir + "/ca.crt"
+	require.NoError(t, ioutil.WriteFile(caPath, []byte("original-ca"), 0644))
+	info, err := os.Stat(caPath)
+	require.NoError(t, err)
+	lastModTime := info.ModTime()
+
+	s := consistencyTestServer()
+	client := newFakeConfigClient()
+
+	require.NoError(t, s.refreshCABundle(caPath, &lastModTime, client, map[string]Registration{}))
+	assert.Equal(t, []byte("test-ca-bundle"), s.caBundle.get())
+}
+
+func TestRefreshCABundleUpdatesTheBundleAndReregistersWhenTheFileChanges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cabundle")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	caPath := dir + "/ca.crt"
+	require.NoError(t, ioutil.WriteFile(caPath, []byte("original-ca"), 0644))
+	info, err := os.Stat(caPath)
+	require.NoError(t, err)
+	lastModTime := info.ModTime()
+
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, ioutil.WriteFile(caPath, []byte("rotated-ca"), 0644))
+	rotatedInfo, err := os.Stat(caPath)
+	require.NoError(t, err)
+
+	s := consistencyTestServer()
+	client := newFakeConfigClient()
+	registrations := map[string]Registration{"my-rule": {Name: "my-rule", FailurePolicy: "ignore"}}
+
+	require.NoError(t, s.refreshCABundle(caPath, &lastModTime, client, registrations))
+
+	assert.Equal(t, []byte("rotated-ca"), s.caBundle.get())
+	assert.True(t, lastModTime.Equal(rotatedInfo.ModTime()), "lastModTime should have been advanced to the rotated file's modification time")
+
+	updated, err := client.Get("my-rule", metav1.GetOptions{})
+	require.NoError(t, err)
+	require.Len(t, updated.Webhooks, 1)
+	assert.Equal(t, []byte("rotated-ca"), updated.Webhooks[0].ClientConfig.CABundle)
+}
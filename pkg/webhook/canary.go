@@ -0,0 +1,100 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/HotelsDotCom/kube-graffiti/pkg/log"
+	"github.com/rs/zerolog"
+	admission "k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// CanaryConfig controls the canary guard that AddGraffitiRule wraps each newly registered rule in.
+// Rules are added one at a time and there is no previous version to roll back to, so "rollback"
+// here means automatically disabling a rule that errors too often shortly after being loaded,
+// rather than restoring an older rule. A zero value disables the guard.
+type CanaryConfig struct {
+	Window    time.Duration
+	MaxErrors int
+}
+
+// canaryGuard wraps a graffitiMutator and quarantines it - failing open on every future admission
+// request rather than invoking it - if it produces more than cfg.MaxErrors admission errors within
+// cfg.Window of being registered.
+type canaryGuard struct {
+	rule     graffitiMutator
+	ruleName string
+	cfg      CanaryConfig
+	deadline time.Time
+
+	mu          sync.Mutex
+	errCount    int
+	quarantined bool
+}
+
+func newCanaryGuard(rule graffitiMutator, ruleName string, cfg CanaryConfig) *canaryGuard {
+	return &canaryGuard{
+		rule:     rule,
+		ruleName: ruleName,
+		cfg:      cfg,
+		deadline: time.Now().Add(cfg.Window),
+	}
+}
+
+// MutateAdmission implements the graffitiMutator interface.
+func (g *canaryGuard) MutateAdmission(ctx context.Context, req *admission.AdmissionRequest) *admission.AdmissionResponse {
+	mylog := log.ComponentLogger(componentName, "canaryGuard-MutateAdmission")
+
+	if g.isQuarantined() {
+		return &admission.AdmissionResponse{
+			Allowed: true,
+			Result: &metav1.Status{
+				Message: fmt.Sprintf("rule '%s' is quarantined after exceeding its post-registration error threshold, skipping", g.ruleName),
+			},
+		}
+	}
+
+	resp := g.rule.MutateAdmission(ctx, req)
+	if resp != nil && resp.Result != nil && resp.Result.Reason == metav1.StatusReasonInternalError {
+		g.recordError(mylog)
+	}
+	return resp
+}
+
+func (g *canaryGuard) isQuarantined() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.quarantined
+}
+
+// recordError counts an admission error against the rule. Once cfg.MaxErrors is reached within
+// cfg.Window of registration, the rule is quarantined; errors occurring after the window closes are
+// no longer counted, since the rule has already proven itself stable.
+func (g *canaryGuard) recordError(mylog zerolog.Logger) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.quarantined || time.Now().After(g.deadline) {
+		return
+	}
+	g.errCount++
+	if g.errCount >= g.cfg.MaxErrors {
+		g.quarantined = true
+		mylog.Error().Str("rule", g.ruleName).Int("errors", g.errCount).Int("threshold", g.cfg.MaxErrors).Msg("rule exceeded its post-registration error threshold and has been automatically quarantined")
+	}
+}
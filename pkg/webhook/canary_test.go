@@ -0,0 +1,84 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	admission "k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func erroringResponse() *admission.AdmissionResponse {
+	return &admission.AdmissionResponse{
+		Allowed: true,
+		Result:  &metav1.Status{Reason: metav1.StatusReasonInternalError, Message: "failed to mutate object: boom"},
+	}
+}
+
+func okResponse() *admission.AdmissionResponse {
+	return &admission.AdmissionResponse{Allowed: true, Result: &metav1.Status{Message: "object painted by kube-graffiti"}}
+}
+
+func TestCanaryGuardQuarantinesAfterErrorThreshold(t *testing.T) {
+	mock := &mockMutator{}
+	mock.On("MutateAdmission", (*admission.AdmissionRequest)(nil)).Return(erroringResponse())
+	guard := newCanaryGuard(mock, "bad-rule", CanaryConfig{Window: time.Minute, MaxErrors: 3})
+
+	for i := 0; i < 3; i++ {
+		resp := guard.MutateAdmission(context.Background(), nil)
+		assert.True(t, resp.Allowed)
+	}
+	assert.True(t, guard.isQuarantined(), "rule should be quarantined after hitting the error threshold")
+
+	// a quarantined rule stops delegating to the wrapped rule
+	mock.AssertNumberOfCalls(t, "MutateAdmission", 3)
+	resp := guard.MutateAdmission(context.Background(), nil)
+	assert.True(t, resp.Allowed)
+	mock.AssertNumberOfCalls(t, "MutateAdmission", 3)
+}
+
+func TestCanaryGuardStaysActiveBelowThreshold(t *testing.T) {
+	mock := &mockMutator{}
+	mock.On("MutateAdmission", (*admission.AdmissionRequest)(nil)).Return(erroringResponse())
+	guard := newCanaryGuard(mock, "flaky-rule", CanaryConfig{Window: time.Minute, MaxErrors: 3})
+
+	guard.MutateAdmission(context.Background(), nil)
+	guard.MutateAdmission(context.Background(), nil)
+	assert.False(t, guard.isQuarantined(), "rule shouldn't be quarantined until it reaches the threshold")
+}
+
+func TestCanaryGuardIgnoresSuccessfulResponses(t *testing.T) {
+	mock := &mockMutator{}
+	mock.On("MutateAdmission", (*admission.AdmissionRequest)(nil)).Return(okResponse())
+	guard := newCanaryGuard(mock, "good-rule", CanaryConfig{Window: time.Minute, MaxErrors: 1})
+
+	for i := 0; i < 10; i++ {
+		guard.MutateAdmission(context.Background(), nil)
+	}
+	assert.False(t, guard.isQuarantined(), "only errors should count towards the threshold")
+}
+
+func TestCanaryGuardIgnoresErrorsOutsideWindow(t *testing.T) {
+	mock := &mockMutator{}
+	mock.On("MutateAdmission", (*admission.AdmissionRequest)(nil)).Return(erroringResponse())
+	guard := newCanaryGuard(mock, "slow-to-fail-rule", CanaryConfig{Window: time.Millisecond, MaxErrors: 1})
+
+	time.Sleep(5 * time.Millisecond)
+	guard.MutateAdmission(context.Background(), nil)
+	assert.False(t, guard.isQuarantined(), "errors occurring after the canary window has closed shouldn't trigger quarantine")
+}
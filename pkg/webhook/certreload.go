@@ -0,0 +1,112 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/HotelsDotCom/kube-graffiti/pkg/log"
+)
+
+// CertReloadCheckInterval controls how often a certReloader re-stats its certificate and key files to
+// detect a cert-manager style rotation.
+var CertReloadCheckInterval = 30 * time.Second
+
+// certReloader keeps an in-memory copy of a TLS certificate/key pair up to date with what is on disk, so
+// that a Secret mounted into the pod can be rotated by cert-manager without the webhook server being
+// restarted. It is wired into a tls.Config as GetCertificate rather than the config's static Certificates
+// field, which is populated once at startup and never consulted again.
+type certReloader struct {
+	certPath, keyPath string
+
+	mu                      sync.RWMutex
+	cert                    *tls.Certificate
+	certModTime, keyModTime time.Time
+}
+
+// newCertReloader loads certPath/keyPath once and returns a certReloader ready to be started watching
+// them for changes.
+func newCertReloader(certPath, keyPath string) (*certReloader, error) {
+	r := &certReloader{certPath: certPath, keyPath: keyPath}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate satisfies tls.Config.GetCertificate, returning whichever certificate was most recently
+// loaded from disk.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// reload reloads the certificate/key pair from disk if either file's modification time has moved on
+// since the last load, so that a cert-manager rotation which replaces both files is picked up as a
+// matching pair rather than mid-write.
+func (r *certReloader) reload() error {
+	certInfo, err := os.Stat(r.certPath)
+	if err != nil {
+		return fmt.Errorf("failed to stat certificate file %q: %v", r.certPath, err)
+	}
+	keyInfo, err := os.Stat(r.keyPath)
+	if err != nil {
+		return fmt.Errorf("failed to stat key file %q: %v", r.keyPath, err)
+	}
+
+	r.mu.RLock()
+	unchanged := r.cert != nil && certInfo.ModTime().Equal(r.certModTime) && keyInfo.ModTime().Equal(r.keyModTime)
+	r.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certPath, r.keyPath)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate/key pair: %v", err)
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.certModTime = certInfo.ModTime()
+	r.keyModTime = keyInfo.ModTime()
+	r.mu.Unlock()
+	return nil
+}
+
+// startWatching polls the certificate/key files every CertReloadCheckInterval until stop is closed,
+// reloading them whenever cert-manager has rotated them.
+func (r *certReloader) startWatching(stop <-chan struct{}) {
+	mylog := log.ComponentLogger(componentName, "certReloader.startWatching")
+
+	go func() {
+		ticker := time.NewTicker(CertReloadCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if err := r.reload(); err != nil {
+					mylog.Error().Err(err).Msg("failed to reload rotated webhook serving certificate")
+				}
+			}
+		}
+	}()
+}
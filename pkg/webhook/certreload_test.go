@@ -0,0 +1,107 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// writeSelfSignedCert writes a fresh self-signed certificate/key pair naming commonName to certPath and
+// keyPath, for tests that need something tls.LoadX509KeyPair will accept.
+func writeSelfSignedCert(t *testing.T, certPath, keyPath, commonName string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Unix(0, 0),
+		NotAfter:     time.Unix(0, 0).Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	require.NoError(t, ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644))
+	require.NoError(t, ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0644))
+}
+
+func TestCertReloaderLoadsTheInitialCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certreload")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	certPath, keyPath := dir+"/tls.crt", dir+"/tls.key"
+	writeSelfSignedCert(t, certPath, keyPath, "original")
+
+	r, err := newCertReloader(certPath, keyPath)
+	require.NoError(t, err)
+
+	cert, err := r.GetCertificate(nil)
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	require.NoError(t, err)
+	require.Equal(t, "original", leaf.Subject.CommonName)
+}
+
+func TestCertReloaderReturnsTheNewCertAfterTheFilesAreReplaced(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certreload")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	certPath, keyPath := dir+"/tls.crt", dir+"/tls.key"
+	writeSelfSignedCert(t, certPath, keyPath, "original")
+
+	r, err := newCertReloader(certPath, keyPath)
+	require.NoError(t, err)
+
+	// make sure the replacement files get a distinguishably later modification time.
+	time.Sleep(10 * time.Millisecond)
+	writeSelfSignedCert(t, certPath, keyPath, "rotated")
+
+	require.NoError(t, r.reload())
+
+	cert, err := r.GetCertificate(nil)
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	require.NoError(t, err)
+	require.Equal(t, "rotated", leaf.Subject.CommonName)
+}
+
+func TestCertReloaderSkipsReloadingWhenTheFilesAreUnchanged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certreload")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	certPath, keyPath := dir+"/tls.crt", dir+"/tls.key"
+	writeSelfSignedCert(t, certPath, keyPath, "original")
+
+	r, err := newCertReloader(certPath, keyPath)
+	require.NoError(t, err)
+	loadedCert := r.cert
+
+	require.NoError(t, r.reload())
+	require.True(t, loadedCert == r.cert, "reload should not have replaced the cached certificate when the files hadn't changed")
+}
@@ -0,0 +1,198 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/HotelsDotCom/kube-graffiti/pkg/httpresponse"
+	"github.com/HotelsDotCom/kube-graffiti/pkg/log"
+	"github.com/HotelsDotCom/kube-graffiti/pkg/metrics"
+)
+
+// Fault mode constants for Fault.Mode.
+const (
+	FaultLatency = "latency"
+	FaultError   = "error"
+	FaultDrop    = "drop"
+)
+
+// Fault describes a single chaos-testing fault to inject into a fraction of the requests received for
+// Path, for rehearsing what the cluster experiences when graffiti misbehaves - slow responses, 500s,
+// connection drops - without actually breaking the binary. See ConfigureFaults for how faults are
+// armed and FaultInjectionEnvironment for the guard against accidental production activation.
+type Fault struct {
+	// Path is the webhook path the fault applies to, e.g. "/graffiti/add-team".
+	Path string `mapstructure:"path" yaml:"path"`
+	// Mode is one of FaultLatency, FaultError or FaultDrop.
+	Mode string `mapstructure:"mode" yaml:"mode"`
+	// Value is the delay injected by FaultLatency; it has no effect for the other modes.
+	Value time.Duration `mapstructure:"value" yaml:"value,omitempty"`
+	// Ratio is the fraction of requests to Path, between 0 and 1, that the fault is injected into.
+	Ratio float64 `mapstructure:"ratio" yaml:"ratio"`
+	// Duration is how long the fault stays armed for once configured, after which it expires and
+	// requests to Path are handled normally again.
+	Duration time.Duration `mapstructure:"duration" yaml:"duration"`
+}
+
+// validate checks that f is a fault ConfigureFaults can safely arm.
+func (f Fault) validate() error {
+	if f.Path == "" {
+		return fmt.Errorf("path must not be empty")
+	}
+	switch f.Mode {
+	case FaultLatency, FaultError, FaultDrop:
+	default:
+		return fmt.Errorf("mode %q must be one of '%s', '%s' or '%s'", f.Mode, FaultLatency, FaultError, FaultDrop)
+	}
+	if f.Ratio < 0 || f.Ratio > 1 {
+		return fmt.Errorf("ratio %v must be between 0 and 1", f.Ratio)
+	}
+	if f.Duration <= 0 {
+		return fmt.Errorf("duration must be greater than zero")
+	}
+	return nil
+}
+
+// FaultInjectionEnvironment gates ConfigureFaults: faults are only ever armed when this is "staging",
+// or when FaultInjectionUnsafe is explicitly set. It is wired from config's top-level `environment`
+// setting, so a config file not meant for chaos testing simply can't arm one by accident.
+var FaultInjectionEnvironment string
+
+// FaultInjectionUnsafe bypasses the staging-only guard on ConfigureFaults. It exists for chaos testing
+// run against a team's own disposable cluster that isn't labelled "staging"; it defaults to false, the
+// safe choice everywhere else, including production.
+var FaultInjectionUnsafe = false
+
+type activeFault struct {
+	fault  Fault
+	expiry time.Time
+}
+
+var faults = struct {
+	mu sync.Mutex
+	m  map[string]activeFault
+}{m: make(map[string]activeFault)}
+
+// ConfigureFaults arms the given faults, replacing any previously armed fault for the same path. It
+// refuses to arm anything - leaving whatever was previously armed untouched - unless
+// FaultInjectionEnvironment is "staging" or FaultInjectionUnsafe is set, and unless every fault is
+// individually valid, so that a config mistake is visible rather than silently degrading or silently
+// doing nothing.
+func ConfigureFaults(newFaults []Fault) error {
+	if len(newFaults) == 0 {
+		return nil
+	}
+	if FaultInjectionEnvironment != "staging" && !FaultInjectionUnsafe {
+		return fmt.Errorf("refusing to activate fault injection: environment %q is not 'staging' and fault-injection-unsafe is not set", FaultInjectionEnvironment)
+	}
+	for _, f := range newFaults {
+		if err := f.validate(); err != nil {
+			return fmt.Errorf("invalid fault for path %q: %v", f.Path, err)
+		}
+	}
+
+	mylog := log.ComponentLogger(componentName, "ConfigureFaults")
+	now := time.Now()
+	faults.mu.Lock()
+	defer faults.mu.Unlock()
+	for _, f := range newFaults {
+		faults.m[f.Path] = activeFault{fault: f, expiry: now.Add(f.Duration)}
+		mylog.Warn().Str("path", f.Path).Str("mode", f.Mode).Float64("ratio", f.Ratio).Dur("duration", f.Duration).Msg("armed a chaos-testing fault - requests to this path will be deliberately degraded until it expires")
+	}
+	return nil
+}
+
+// CurrentFaults returns the faults that are currently armed and not yet expired, for the admin GET
+// endpoint and for tests. Expired faults are pruned as a side effect, same as interceptFault does.
+func CurrentFaults() []Fault {
+	now := time.Now()
+	faults.mu.Lock()
+	defer faults.mu.Unlock()
+	var current []Fault
+	for path, af := range faults.m {
+		if now.After(af.expiry) {
+			delete(faults.m, path)
+			continue
+		}
+		current = append(current, af.fault)
+	}
+	return current
+}
+
+// interceptFault applies the fault currently armed for r's path, if any, to the given fraction of
+// requests. It returns true when it has already written a response (FaultError, FaultDrop, or a
+// FaultDrop that couldn't hijack the connection) and ServeHTTP must not process the request further.
+func interceptFault(w http.ResponseWriter, r *http.Request) bool {
+	faults.mu.Lock()
+	af, ok := faults.m[r.URL.Path]
+	if ok && time.Now().After(af.expiry) {
+		delete(faults.m, r.URL.Path)
+		ok = false
+	}
+	faults.mu.Unlock()
+	if !ok || rand.Float64() >= af.fault.Ratio {
+		return false
+	}
+
+	mylog := log.ComponentLogger(componentName, "interceptFault")
+	mylog.Warn().Str("path", r.URL.Path).Str("mode", af.fault.Mode).Msg("injecting a chaos-testing fault into this request")
+	metrics.FaultsInjected.Observe(r.URL.Path, 1)
+
+	switch af.fault.Mode {
+	case FaultLatency:
+		time.Sleep(af.fault.Value)
+		return false
+	case FaultDrop:
+		if hj, ok := w.(http.Hijacker); ok {
+			if conn, _, err := hj.Hijack(); err == nil {
+				conn.Close()
+				return true
+			}
+		}
+		fallthrough
+	default: // FaultError, and FaultDrop's fallback when the connection can't be hijacked
+		httpresponse.WriteError(w, http.StatusInternalServerError, "fault injected for chaos testing", nil)
+		return true
+	}
+}
+
+// ServeFaultsAdmin implements the admin API for configuring chaos-testing faults at runtime: GET
+// returns the faults currently armed, POST arms the JSON array of Fault in the request body via
+// ConfigureFaults.
+func ServeFaultsAdmin(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		httpresponse.WriteJSON(w, http.StatusOK, CurrentFaults())
+	case http.MethodPost:
+		var newFaults []Fault
+		if err := json.NewDecoder(r.Body).Decode(&newFaults); err != nil {
+			httpresponse.WriteError(w, http.StatusBadRequest, "invalid faults payload", err)
+			return
+		}
+		if err := ConfigureFaults(newFaults); err != nil {
+			httpresponse.WriteError(w, http.StatusForbidden, err.Error(), nil)
+			return
+		}
+		httpresponse.WriteJSON(w, http.StatusOK, CurrentFaults())
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		httpresponse.WriteError(w, http.StatusMethodNotAllowed, "method not allowed", nil)
+	}
+}
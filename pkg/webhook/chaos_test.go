@@ -0,0 +1,193 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func resetFaults() {
+	faults.mu.Lock()
+	faults.m = make(map[string]activeFault)
+	faults.mu.Unlock()
+	FaultInjectionEnvironment = ""
+	FaultInjectionUnsafe = false
+}
+
+func TestConfigureFaultsRefusesToArmOutsideStaging(t *testing.T) {
+	defer resetFaults()
+	FaultInjectionEnvironment = "production"
+
+	err := ConfigureFaults([]Fault{{Path: "/graffiti/my-rule", Mode: FaultError, Ratio: 1, Duration: time.Minute}})
+	require.Error(t, err)
+	assert.Empty(t, CurrentFaults(), "a refused fault must not be armed")
+}
+
+func TestConfigureFaultsAllowsStagingEnvironment(t *testing.T) {
+	defer resetFaults()
+	FaultInjectionEnvironment = "staging"
+
+	require.NoError(t, ConfigureFaults([]Fault{{Path: "/graffiti/my-rule", Mode: FaultError, Ratio: 1, Duration: time.Minute}}))
+	assert.Len(t, CurrentFaults(), 1)
+}
+
+func TestConfigureFaultsAllowsUnsafeOverrideOutsideStaging(t *testing.T) {
+	defer resetFaults()
+	FaultInjectionUnsafe = true
+
+	require.NoError(t, ConfigureFaults([]Fault{{Path: "/graffiti/my-rule", Mode: FaultError, Ratio: 1, Duration: time.Minute}}))
+	assert.Len(t, CurrentFaults(), 1)
+}
+
+func TestConfigureFaultsRejectsAnInvalidFault(t *testing.T) {
+	defer resetFaults()
+	FaultInjectionEnvironment = "staging"
+
+	err := ConfigureFaults([]Fault{{Path: "/graffiti/my-rule", Mode: "explode", Ratio: 1, Duration: time.Minute}})
+	assert.Error(t, err)
+	assert.Empty(t, CurrentFaults())
+}
+
+func TestCurrentFaultsPrunesExpiredFaults(t *testing.T) {
+	defer resetFaults()
+	FaultInjectionEnvironment = "staging"
+	require.NoError(t, ConfigureFaults([]Fault{{Path: "/graffiti/my-rule", Mode: FaultError, Ratio: 1, Duration: time.Millisecond}}))
+
+	time.Sleep(5 * time.Millisecond)
+	assert.Empty(t, CurrentFaults(), "an expired fault should no longer be reported as armed")
+}
+
+func TestInterceptFaultInjectsLatency(t *testing.T) {
+	defer resetFaults()
+	FaultInjectionEnvironment = "staging"
+	require.NoError(t, ConfigureFaults([]Fault{{Path: "/graffiti/my-rule", Mode: FaultLatency, Value: 20 * time.Millisecond, Ratio: 1, Duration: time.Minute}}))
+
+	req := httptest.NewRequest("POST", "/graffiti/my-rule", nil)
+	rr := httptest.NewRecorder()
+
+	start := time.Now()
+	handled := interceptFault(rr, req)
+	elapsed := time.Since(start)
+
+	assert.False(t, handled, "latency faults delay the request but don't write a response themselves")
+	assert.True(t, elapsed >= 20*time.Millisecond, "expected interceptFault to sleep for at least the configured latency")
+}
+
+func TestInterceptFaultReturnsAnError(t *testing.T) {
+	defer resetFaults()
+	FaultInjectionEnvironment = "staging"
+	require.NoError(t, ConfigureFaults([]Fault{{Path: "/graffiti/my-rule", Mode: FaultError, Ratio: 1, Duration: time.Minute}}))
+
+	req := httptest.NewRequest("POST", "/graffiti/my-rule", nil)
+	rr := httptest.NewRecorder()
+
+	assert.True(t, interceptFault(rr, req))
+	assert.Equal(t, http.StatusInternalServerError, rr.Result().StatusCode)
+}
+
+func TestInterceptFaultIgnoresUnarmedPaths(t *testing.T) {
+	defer resetFaults()
+	FaultInjectionEnvironment = "staging"
+	require.NoError(t, ConfigureFaults([]Fault{{Path: "/graffiti/my-rule", Mode: FaultError, Ratio: 1, Duration: time.Minute}}))
+
+	req := httptest.NewRequest("POST", "/graffiti/some-other-rule", nil)
+	rr := httptest.NewRecorder()
+
+	assert.False(t, interceptFault(rr, req))
+	assert.Equal(t, http.StatusOK, rr.Result().StatusCode)
+}
+
+func TestInterceptFaultHonoursRatioOfZero(t *testing.T) {
+	defer resetFaults()
+	FaultInjectionEnvironment = "staging"
+	require.NoError(t, ConfigureFaults([]Fault{{Path: "/graffiti/my-rule", Mode: FaultError, Ratio: 0, Duration: time.Minute}}))
+
+	req := httptest.NewRequest("POST", "/graffiti/my-rule", nil)
+	rr := httptest.NewRecorder()
+
+	assert.False(t, interceptFault(rr, req), "a zero ratio should never inject the fault")
+}
+
+func TestInterceptFaultDropsTheConnectionByHijacking(t *testing.T) {
+	defer resetFaults()
+	FaultInjectionEnvironment = "staging"
+	require.NoError(t, ConfigureFaults([]Fault{{Path: "/drop-me", Mode: FaultDrop, Ratio: 1, Duration: time.Minute}}))
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if interceptFault(w, r) {
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("GET /drop-me HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+
+	reader := bufio.NewReader(conn)
+	_, err = reader.ReadString('\n')
+	assert.Error(t, err, "a dropped connection should be closed before any response is written")
+}
+
+func TestServeFaultsAdminGetReturnsCurrentlyArmedFaults(t *testing.T) {
+	defer resetFaults()
+	FaultInjectionEnvironment = "staging"
+	require.NoError(t, ConfigureFaults([]Fault{{Path: "/graffiti/my-rule", Mode: FaultError, Ratio: 1, Duration: time.Minute}}))
+
+	req := httptest.NewRequest("GET", "/webhook/faults", nil)
+	rr := httptest.NewRecorder()
+	ServeFaultsAdmin(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Result().StatusCode)
+	assert.Contains(t, rr.Body.String(), "/graffiti/my-rule")
+}
+
+func TestServeFaultsAdminPostArmsFaults(t *testing.T) {
+	defer resetFaults()
+	FaultInjectionEnvironment = "staging"
+
+	body := `[{"path":"/graffiti/my-rule","mode":"error","ratio":1,"duration":60000000000}]`
+	req := httptest.NewRequest("POST", "/webhook/faults", strings.NewReader(body))
+	rr := httptest.NewRecorder()
+	ServeFaultsAdmin(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Result().StatusCode)
+	assert.Len(t, CurrentFaults(), 1)
+}
+
+func TestServeFaultsAdminPostRejectsArmingOutsideStaging(t *testing.T) {
+	defer resetFaults()
+	FaultInjectionEnvironment = "production"
+
+	body := `[{"path":"/graffiti/my-rule","mode":"error","ratio":1,"duration":60000000000}]`
+	req := httptest.NewRequest("POST", "/webhook/faults", strings.NewReader(body))
+	rr := httptest.NewRecorder()
+	ServeFaultsAdmin(rr, req)
+
+	assert.Equal(t, http.StatusForbidden, rr.Result().StatusCode)
+	assert.Empty(t, CurrentFaults())
+}
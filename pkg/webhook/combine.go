@@ -0,0 +1,127 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	jsonpatch "github.com/cameront/go-jsonpatch"
+	"github.com/rs/zerolog"
+
+	"github.com/HotelsDotCom/kube-graffiti/pkg/log"
+)
+
+// CombineJSONPatches merges the JSON Patch operations of patches - given in priority order, i.e. the
+// earliest is the highest priority - into the single patch a webhook admission response can carry, for
+// when more than one rule is registered against the same path and each produces its own patch.
+//
+// An "add" or "replace" whose value is a JSON object - createPatchOperand's whole-/metadata/labels or
+// whole-/metadata/annotations patches are exactly this - is merged key-by-key with any earlier patch
+// that already claimed the same path, rather than arbitrated as a single atomic unit: per RFC 6902,
+// "add"/"replace" of an object member replaces the whole member, so two rules each producing their own
+// whole-map patch for the same path would otherwise have the second rule's map silently replace the
+// first's in its entirety, rather than the two maps' keys combining as the rules' authors intended.
+//
+// Everything else - a "remove", or an "add"/"replace" whose value isn't an object, e.g. a
+// whole-/metadata/finalizers array - is a genuine conflict when two rules target exactly the same path:
+// the apiserver applies a JSON Patch's operations strictly in array order, so whichever one ends up last
+// would silently overwrite the other. CombineJSONPatches resolves that by priority, keeping only the
+// highest-priority rule's operation and dropping the rest - except an "add" appending a single element
+// to the end of an array (path ending "/-", as createFinalizerPatchOperations and
+// createSchedulingGatePatchOperations use), which every rule sharing the path can do independently without conflicting.
+//
+// Every conflict it resolves, at the whole-operation or the individual-key level, is logged so an
+// operator can see which rule lost.
+func CombineJSONPatches(patches [][]byte) ([]byte, error) {
+	mylog := log.ComponentLogger(componentName, "CombineJSONPatches")
+
+	var combined jsonpatch.Patch
+	mergedObjects := make(map[string]map[string]interface{})
+	claimed := make(map[string]bool)
+
+	for _, raw := range patches {
+		parsed, err := jsonpatch.FromString(string(raw))
+		if err != nil {
+			return nil, fmt.Errorf("could not parse json-patch to combine: %v", err)
+		}
+		for _, op := range parsed.Operations {
+			if value, ok := mergeableObjectValue(op); ok {
+				if claimed[op.Path] {
+					mylog.Warn().Str("path", op.Path).Str("op", string(op.Op)).Msg("two rules' json-patches conflict on this path, keeping the higher-priority rule's operation and dropping this one")
+					continue
+				}
+				if existing, seen := mergedObjects[op.Path]; seen {
+					mergeObjectValues(existing, value, op.Path, mylog)
+					continue
+				}
+				mergedObjects[op.Path] = value
+				combined.Operations = append(combined.Operations, op)
+				continue
+			}
+
+			if isAtomicOp(op) {
+				if claimed[op.Path] || mergedObjects[op.Path] != nil {
+					mylog.Warn().Str("path", op.Path).Str("op", string(op.Op)).Msg("two rules' json-patches conflict on this path, keeping the higher-priority rule's operation and dropping this one")
+					continue
+				}
+				claimed[op.Path] = true
+			}
+			combined.Operations = append(combined.Operations, op)
+		}
+	}
+	return json.Marshal(combined)
+}
+
+// mergeableObjectValue reports whether op is an "add" or "replace" whose value decoded as a JSON
+// object, returning that object so the caller can merge it key-by-key with any other rule's patch at
+// the same path instead of treating the two whole-object patches as conflicting atomic units.
+func mergeableObjectValue(op jsonpatch.PatchOperation) (map[string]interface{}, bool) {
+	if op.Op != jsonpatch.Add && op.Op != jsonpatch.Replace {
+		return nil, false
+	}
+	value, ok := op.Value.(map[string]interface{})
+	return value, ok
+}
+
+// mergeObjectValues folds src's entries into dst, keeping dst's existing value - the higher-priority
+// rule's, since dst always belongs to whichever patch claimed path first - for any key both define with
+// differing values, logging that as the same kind of conflict an atomic op loses.
+func mergeObjectValues(dst, src map[string]interface{}, path string, mylog zerolog.Logger) {
+	for k, v := range src {
+		if existing, taken := dst[k]; taken {
+			if !reflect.DeepEqual(existing, v) {
+				mylog.Warn().Str("path", path).Str("key", k).Msg("two rules' json-patches set this key to different values, keeping the higher-priority rule's value and dropping this one")
+			}
+			continue
+		}
+		dst[k] = v
+	}
+}
+
+// isAtomicOp reports whether op must be arbitrated as a single, indivisible unit when another rule's
+// patch targets the same path - true for "remove", and for an "add"/"replace" of anything other than a
+// JSON object (mergeableObjectValue already claims those), except appending a single element to the end
+// of an array, which never conflicts no matter how many rules do it.
+func isAtomicOp(op jsonpatch.PatchOperation) bool {
+	if op.Op == jsonpatch.Remove {
+		return true
+	}
+	if op.Op != jsonpatch.Add && op.Op != jsonpatch.Replace {
+		return false
+	}
+	return !strings.HasSuffix(op.Path, "/-")
+}
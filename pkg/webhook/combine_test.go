@@ -0,0 +1,192 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/HotelsDotCom/kube-graffiti/pkg/audit"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	admission "k8s.io/api/admission/v1beta1"
+)
+
+// unmarshalCombined decodes combined (a CombineJSONPatches result) into its operations; valueAtPath
+// then returns the value of the first operation found at a path - which createPatchOperand always emits
+// as a whole-map "add"/"replace", the shape this codebase actually produces for labels/annotations.
+func unmarshalCombined(t *testing.T, combined []byte) []map[string]interface{} {
+	t.Helper()
+	var ops []map[string]interface{}
+	require.NoError(t, json.Unmarshal(combined, &ops))
+	return ops
+}
+
+func valueAtPath(ops []map[string]interface{}, path string) map[string]interface{} {
+	for _, op := range ops {
+		if op["path"] == path {
+			return op["value"].(map[string]interface{})
+		}
+	}
+	return nil
+}
+
+func TestCombineJSONPatchesMergesWholeMapAdditionsFromDifferentRules(t *testing.T) {
+	// the shape createPatchOperand actually produces: a whole-map "add" to /metadata/labels, one per
+	// rule, each naming a different key - reproducing the reviewer's foo=1/bar=2 scenario directly.
+	a := []byte(`[{"op":"add","path":"/metadata/labels","value":{"foo":"1"}}]`)
+	b := []byte(`[{"op":"add","path":"/metadata/labels","value":{"bar":"2"}}]`)
+
+	combined, err := CombineJSONPatches([][]byte{a, b})
+	require.NoError(t, err)
+
+	ops := unmarshalCombined(t, combined)
+	require.Len(t, ops, 1, "both rules' whole-map patches target the same path, so they should merge into a single operation")
+	value := valueAtPath(ops, "/metadata/labels")
+	assert.Equal(t, map[string]interface{}{"foo": "1", "bar": "2"}, value, "both rules' keys should survive the merge - neither should silently overwrite the other")
+}
+
+func TestCombineJSONPatchesResolvesAKeyConflictInWholeMapAdditionsByPriority(t *testing.T) {
+	highPriority := []byte(`[{"op":"add","path":"/metadata/labels","value":{"painted":"high-priority","foo":"1"}}]`)
+	lowPriority := []byte(`[{"op":"add","path":"/metadata/labels","value":{"painted":"low-priority","bar":"2"}}]`)
+
+	combined, err := CombineJSONPatches([][]byte{highPriority, lowPriority})
+	require.NoError(t, err)
+
+	ops := unmarshalCombined(t, combined)
+	require.Len(t, ops, 1)
+	value := valueAtPath(ops, "/metadata/labels")
+	assert.Equal(t, map[string]interface{}{"painted": "high-priority", "foo": "1", "bar": "2"}, value, "the higher-priority rule's value should win the conflicting key, but the non-conflicting keys from both rules should still be present")
+}
+
+func TestCombineJSONPatchesMergesAWholeMapReplaceWithAWholeMapAdd(t *testing.T) {
+	// one rule's patch "add"s the path (the object had no labels yet) while another's "replace"s it
+	// (it saw labels already present) - RFC 6902 treats add/replace of an object member identically, so
+	// these must still merge rather than being treated as different, non-mergeable operation types.
+	add := []byte(`[{"op":"add","path":"/metadata/labels","value":{"foo":"1"}}]`)
+	replace := []byte(`[{"op":"replace","path":"/metadata/labels","value":{"bar":"2"}}]`)
+
+	combined, err := CombineJSONPatches([][]byte{add, replace})
+	require.NoError(t, err)
+
+	ops := unmarshalCombined(t, combined)
+	require.Len(t, ops, 1)
+	assert.Equal(t, map[string]interface{}{"foo": "1", "bar": "2"}, valueAtPath(ops, "/metadata/labels"))
+}
+
+func TestCombineJSONPatchesResolvesAWholeMapRemoveConflictByPriority(t *testing.T) {
+	// a rule that deleted every label emits a "remove" of the whole path rather than a map patch - a
+	// genuine, non-mergeable conflict against any other rule's patch for the same path.
+	highPriority := []byte(`[{"op":"remove","path":"/metadata/labels"}]`)
+	lowPriority := []byte(`[{"op":"add","path":"/metadata/labels","value":{"bar":"2"}}]`)
+
+	combined, err := CombineJSONPatches([][]byte{highPriority, lowPriority})
+	require.NoError(t, err)
+
+	ops := unmarshalCombined(t, combined)
+	require.Len(t, ops, 1)
+	assert.Equal(t, "remove", ops[0]["op"])
+}
+
+func TestCombineJSONPatchesNeverTreatsArrayAppendsAsConflicting(t *testing.T) {
+	// createFinalizerPatchOperations and scheduling.go both append to an existing array via "/-" - any
+	// number of rules can do this to the same array without conflicting.
+	a := []byte(`[{"op":"add","path":"/metadata/finalizers/-","value":"rule-a-finalizer"}]`)
+	b := []byte(`[{"op":"add","path":"/metadata/finalizers/-","value":"rule-b-finalizer"}]`)
+
+	combined, err := CombineJSONPatches([][]byte{a, b})
+	require.NoError(t, err)
+
+	ops := unmarshalCombined(t, combined)
+	require.Len(t, ops, 2, "both rules' array appends should be kept, not arbitrated as a conflict")
+}
+
+func TestCombineJSONPatchesRejectsAnUnparseablePatch(t *testing.T) {
+	_, err := CombineJSONPatches([][]byte{[]byte("not json")})
+	assert.Error(t, err)
+}
+
+func TestMutateWithAllRulesMergesPatchesFromRulesSharingAPath(t *testing.T) {
+	first := new(mockMutator)
+	first.On("MutateAdmission", mock.AnythingOfType("*v1beta1.AdmissionRequest")).Return(&admission.AdmissionResponse{
+		Allowed: true,
+		Patch:   []byte(`[{"op":"add","path":"/metadata/labels","value":{"foo":"1"}}]`),
+	})
+	second := new(mockMutator)
+	second.On("MutateAdmission", mock.AnythingOfType("*v1beta1.AdmissionRequest")).Return(&admission.AdmissionResponse{
+		Allowed: true,
+		Patch:   []byte(`[{"op":"add","path":"/metadata/labels","value":{"bar":"2"}}]`),
+	})
+
+	response := mutateWithAllRules(context.Background(), &admission.AdmissionRequest{}, []graffitiMutator{first, second}, zerolog.Nop())
+
+	require.True(t, response.Allowed)
+	ops := unmarshalCombined(t, response.Patch)
+	require.Len(t, ops, 1)
+	assert.Equal(t, map[string]interface{}{"foo": "1", "bar": "2"}, valueAtPath(ops, "/metadata/labels"), "neither rule's label addition should be silently dropped")
+}
+
+func TestMutateWithAllRulesLetsABlockFromAnyRuleWin(t *testing.T) {
+	allows := new(mockMutator)
+	allows.On("MutateAdmission", mock.AnythingOfType("*v1beta1.AdmissionRequest")).Return(&admission.AdmissionResponse{
+		Allowed: true,
+		Patch:   []byte(`[{"op":"add","path":"/metadata/labels","value":{"foo":"1"}}]`),
+	})
+	blocks := new(mockMutator)
+	blocks.On("MutateAdmission", mock.AnythingOfType("*v1beta1.AdmissionRequest")).Return(&admission.AdmissionResponse{
+		Allowed: false,
+	})
+
+	response := mutateWithAllRules(context.Background(), &admission.AdmissionRequest{}, []graffitiMutator{allows, blocks}, zerolog.Nop())
+
+	assert.False(t, response.Allowed, "a block from any rule sharing the path should deny the whole request")
+}
+
+func TestRecordAuditDecisionPersistsThePathAndOutcome(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webhook-audit-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	w, err := audit.NewWriter(audit.Config{Directory: dir, Detail: audit.DetailDecisionOnly})
+	require.NoError(t, err)
+	audit.ActiveWriter = w
+	defer func() { audit.ActiveWriter = nil }()
+
+	req := &admission.AdmissionRequest{Name: "my-pod", Namespace: "default", Operation: admission.Create}
+	req.Kind.Kind = "Pod"
+	response := &admission.AdmissionResponse{Allowed: true, Patch: []byte(`[{"op":"add","path":"/metadata/labels/fruit","value":"apple"}]`)}
+
+	recordAuditDecision("/graffiti/some-rule", req, response)
+	require.NoError(t, w.Close())
+
+	f, err := os.Open(filepath.Join(dir, "audit.log"))
+	require.NoError(t, err)
+	defer f.Close()
+	var rec audit.Record
+	require.NoError(t, json.NewDecoder(f).Decode(&rec))
+	assert.Equal(t, "/graffiti/some-rule", rec.Rule)
+	assert.Equal(t, "Pod", rec.Kind)
+	assert.Equal(t, "my-pod", rec.Name)
+	assert.Equal(t, audit.DecisionPatched, rec.Decision)
+}
+
+func TestRecordAuditDecisionIsANoOpForANilResponse(t *testing.T) {
+	recordAuditDecision("/graffiti/some-rule", &admission.AdmissionRequest{}, nil)
+}
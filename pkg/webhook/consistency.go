@@ -0,0 +1,173 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/HotelsDotCom/kube-graffiti/pkg/log"
+	"github.com/HotelsDotCom/kube-graffiti/pkg/metrics"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	admissionregclient "k8s.io/client-go/kubernetes/typed/admissionregistration/v1beta1"
+)
+
+// AutoReregisterOnMismatch controls whether ReconcilePaths heals a detected path mismatch by
+// re-running RegisterHook for the affected rule, rather than only reporting it. It defaults to false
+// because re-registering a webhook configuration is itself a disruptive action that operators should
+// opt into once they trust the check in their cluster.
+var AutoReregisterOnMismatch = false
+
+// PathConsistencyCheckInterval controls how often StartPathConsistencyChecker re-runs the check.
+var PathConsistencyCheckInterval = 5 * time.Minute
+
+// Ready reflects the result of the most recently completed path-consistency check: false whenever a
+// registered webhook configuration's path and the handler's mounted rules have drifted apart, which is
+// exactly what happened in the incident that motivated this check - a pathFromName change shipped
+// without the configurations being re-registered, so every admission request fell through the
+// handler's unknown-path case and was silently allowed. It starts true so that an instance which has
+// never run the check isn't reported unready forever.
+var Ready = true
+
+// PathMismatch describes one way a rule's configured webhook path and its mounted handler path have
+// drifted apart.
+type PathMismatch struct {
+	RuleName string
+	Reason   string
+}
+
+// mountedPaths returns the set of paths that the handler currently has a rule mounted at.
+func (s Server) mountedPaths() map[string]bool {
+	mounted := make(map[string]bool, len(s.handler.tagmap))
+	for path := range s.handler.tagmap {
+		mounted[path] = true
+	}
+	return mounted
+}
+
+// CheckPathConsistency compares the paths of our own webhook configurations against the paths the
+// handler actually has rules mounted at. It does not merely check that a configuration and a rule both
+// exist for a given name - as happened in the incident that motivated this check, the configuration can
+// exist and still point at the wrong path - so every comparison is path-for-path, not name-for-name.
+// registrations must contain every rule that is expected to be both mounted and registered, keyed by
+// rule name. There is no "reconciler" in this codebase for the check to share machinery with, so it
+// stands alone, built out of the same Server methods that mount and register rules.
+func (s Server) CheckPathConsistency(client admissionregclient.MutatingWebhookConfigurationInterface, registrations map[string]Registration) ([]PathMismatch, error) {
+	mylog := log.ComponentLogger(componentName, "CheckPathConsistency")
+
+	list, err := client.List(metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list webhook configurations: %v", err)
+	}
+
+	configuredPaths := make(map[string]string)
+	for _, cfg := range list.Items {
+		for _, hook := range cfg.Webhooks {
+			if hook.ClientConfig.Service == nil || hook.ClientConfig.Service.Namespace != s.Namespace || hook.ClientConfig.Service.Name != s.Service {
+				continue
+			}
+			if hook.ClientConfig.Service.Path != nil {
+				configuredPaths[cfg.Name] = *hook.ClientConfig.Service.Path
+			} else {
+				configuredPaths[cfg.Name] = ""
+			}
+		}
+	}
+
+	mounted := s.mountedPaths()
+
+	var mismatches []PathMismatch
+	for name := range registrations {
+		expected := pathFromName(name)
+		configured, isRegistered := configuredPaths[name]
+		switch {
+		case !isRegistered:
+			mismatches = append(mismatches, PathMismatch{RuleName: name, Reason: "rule is mounted but has no matching webhook configuration"})
+		case configured != expected:
+			mismatches = append(mismatches, PathMismatch{RuleName: name, Reason: fmt.Sprintf("webhook configuration points at path %q but the handler expects %q", configured, expected)})
+		case !mounted[expected]:
+			mismatches = append(mismatches, PathMismatch{RuleName: name, Reason: fmt.Sprintf("webhook configuration points at path %q but no rule is mounted there", expected)})
+		}
+	}
+	for name, configured := range configuredPaths {
+		if _, expected := registrations[name]; !expected {
+			mismatches = append(mismatches, PathMismatch{RuleName: name, Reason: fmt.Sprintf("webhook configuration at path %q has no corresponding configured rule", configured)})
+		}
+	}
+
+	for _, m := range mismatches {
+		mylog.Warn().Str("rule", m.RuleName).Str("reason", m.Reason).Msg("detected a webhook path mismatch between the registered configuration and the mounted handler")
+		metrics.PathMismatches.Observe(m.RuleName, 1)
+	}
+	Ready = len(mismatches) == 0
+
+	return mismatches, nil
+}
+
+// ReconcilePaths runs CheckPathConsistency and, when AutoReregisterOnMismatch is enabled, heals any
+// rule that has both a configuration and a registration by re-running RegisterHook for it. A
+// configuration with no corresponding registration can't be healed this way, since we no longer have
+// anything to register it with, so it is only reported.
+func (s Server) ReconcilePaths(client admissionregclient.MutatingWebhookConfigurationInterface, registrations map[string]Registration) ([]PathMismatch, error) {
+	mylog := log.ComponentLogger(componentName, "ReconcilePaths")
+
+	mismatches, err := s.CheckPathConsistency(client, registrations)
+	if err != nil {
+		return nil, err
+	}
+	if len(mismatches) == 0 || !AutoReregisterOnMismatch {
+		return mismatches, nil
+	}
+
+	for _, m := range mismatches {
+		r, ok := registrations[m.RuleName]
+		if !ok {
+			continue
+		}
+		mylog.Warn().Str("rule", m.RuleName).Msg("auto-reregister-on-mismatch is enabled, re-registering the webhook configuration to heal the detected mismatch")
+		if err := s.RegisterHook(r, client); err != nil {
+			mylog.Error().Err(err).Str("rule", m.RuleName).Msg("failed to heal webhook configuration mismatch")
+		}
+	}
+
+	return mismatches, nil
+}
+
+// StartPathConsistencyChecker runs ReconcilePaths once immediately and then every
+// PathConsistencyCheckInterval until stop is closed, so that a drift between webhook configurations and
+// the mounted handler is caught - and, if configured, healed - long before it is noticed as requests
+// silently sailing through unmodified.
+func (s Server) StartPathConsistencyChecker(client admissionregclient.MutatingWebhookConfigurationInterface, registrations map[string]Registration, stop <-chan struct{}) {
+	mylog := log.ComponentLogger(componentName, "StartPathConsistencyChecker")
+
+	check := func() {
+		if _, err := s.ReconcilePaths(client, registrations); err != nil {
+			mylog.Error().Err(err).Msg("failed to check webhook path consistency")
+		}
+	}
+
+	go func() {
+		check()
+		ticker := time.NewTicker(PathConsistencyCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				check()
+			}
+		}
+	}()
+}
@@ -0,0 +1,218 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/HotelsDotCom/kube-graffiti/pkg/graffiti"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	admissionreg "k8s.io/api/admissionregistration/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// fakeConfigClient is a minimal, in-memory stand-in for the generated
+// MutatingWebhookConfigurationInterface. The fake clientset that client-go ships can't be vendored into
+// this repository (it pulls in github.com/evanphx/json-patch, which isn't vendored), so tests that need
+// a MutatingWebhookConfigurationInterface use this instead.
+type fakeConfigClient struct {
+	configs map[string]*admissionreg.MutatingWebhookConfiguration
+}
+
+func newFakeConfigClient() *fakeConfigClient {
+	return &fakeConfigClient{configs: make(map[string]*admissionreg.MutatingWebhookConfiguration)}
+}
+
+func (f *fakeConfigClient) Create(cfg *admissionreg.MutatingWebhookConfiguration) (*admissionreg.MutatingWebhookConfiguration, error) {
+	f.configs[cfg.Name] = cfg
+	return cfg, nil
+}
+
+func (f *fakeConfigClient) Update(cfg *admissionreg.MutatingWebhookConfiguration) (*admissionreg.MutatingWebhookConfiguration, error) {
+	f.configs[cfg.Name] = cfg
+	return cfg, nil
+}
+
+func (f *fakeConfigClient) Delete(name string, options *metav1.DeleteOptions) error {
+	delete(f.configs, name)
+	return nil
+}
+
+func (f *fakeConfigClient) DeleteCollection(options *metav1.DeleteOptions, listOptions metav1.ListOptions) error {
+	f.configs = make(map[string]*admissionreg.MutatingWebhookConfiguration)
+	return nil
+}
+
+func (f *fakeConfigClient) Get(name string, options metav1.GetOptions) (*admissionreg.MutatingWebhookConfiguration, error) {
+	cfg, ok := f.configs[name]
+	if !ok {
+		return nil, apierrors.NewNotFound(schema.GroupResource{Resource: "mutatingwebhookconfigurations"}, name)
+	}
+	return cfg, nil
+}
+
+func (f *fakeConfigClient) List(opts metav1.ListOptions) (*admissionreg.MutatingWebhookConfigurationList, error) {
+	list := &admissionreg.MutatingWebhookConfigurationList{}
+	for _, cfg := range f.configs {
+		list.Items = append(list.Items, *cfg)
+	}
+	return list, nil
+}
+
+func (f *fakeConfigClient) Watch(opts metav1.ListOptions) (watch.Interface, error) {
+	panic("not implemented by fakeConfigClient")
+}
+
+func (f *fakeConfigClient) Patch(name string, pt types.PatchType, data []byte, subresources ...string) (*admissionreg.MutatingWebhookConfiguration, error) {
+	panic("not implemented by fakeConfigClient")
+}
+
+// consistencyTestServer builds a Server without going through NewServer, so that the tests in this file
+// never need a real or fake TLS-config-fetching kubernetes call.
+func consistencyTestServer() Server {
+	return Server{
+		CompanyDomain: "acme.com",
+		Namespace:     "kube-graffiti",
+		Service:       "kube-graffiti",
+		caBundle:      newCABundleBox([]byte("test-ca-bundle")),
+		httpServer:    &http.Server{Handler: http.NewServeMux()},
+		handler:       newGraffitiHandler(),
+	}
+}
+
+// registerFakeWebhookConfig creates a MutatingWebhookConfiguration in client that points at path, as if
+// some earlier run of RegisterHook had registered it for us.
+func registerFakeWebhookConfig(t *testing.T, s Server, client *fakeConfigClient, name, path string) {
+	_, err := client.Create(&admissionreg.MutatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Webhooks: []admissionreg.Webhook{
+			{
+				Name: name + "." + s.CompanyDomain,
+				ClientConfig: admissionreg.WebhookClientConfig{
+					Service: &admissionreg.ServiceReference{
+						Namespace: s.Namespace,
+						Name:      s.Service,
+						Path:      &path,
+					},
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+}
+
+func TestCheckPathConsistencyPassesWhenPathsAgree(t *testing.T) {
+	s := consistencyTestServer()
+	s.AddGraffitiRule(graffiti.Rule{Name: "my-rule"})
+
+	client := newFakeConfigClient()
+	registerFakeWebhookConfig(t, s, client, "my-rule", pathFromName("my-rule"))
+	registrations := map[string]Registration{"my-rule": {Name: "my-rule"}}
+
+	mismatches, err := s.CheckPathConsistency(client, registrations)
+	require.NoError(t, err)
+	assert.Empty(t, mismatches)
+	assert.True(t, Ready)
+}
+
+func TestCheckPathConsistencyDetectsAPathGenerationChange(t *testing.T) {
+	s := consistencyTestServer()
+	// the handler is mounted at the path the *current* pathFromName computes...
+	s.AddGraffitiRule(graffiti.Rule{Name: "my-rule"})
+
+	// ...but the registered configuration still points at a path generated the old way.
+	client := newFakeConfigClient()
+	registerFakeWebhookConfig(t, s, client, "my-rule", "/old-prefix/my-rule")
+	registrations := map[string]Registration{"my-rule": {Name: "my-rule"}}
+
+	mismatches, err := s.CheckPathConsistency(client, registrations)
+	require.NoError(t, err)
+	require.Len(t, mismatches, 1)
+	assert.Equal(t, "my-rule", mismatches[0].RuleName)
+	assert.False(t, Ready)
+}
+
+func TestCheckPathConsistencyDetectsAMountedRuleWithNoConfiguration(t *testing.T) {
+	s := consistencyTestServer()
+	s.AddGraffitiRule(graffiti.Rule{Name: "orphan-rule"})
+
+	client := newFakeConfigClient()
+	registrations := map[string]Registration{"orphan-rule": {Name: "orphan-rule"}}
+
+	mismatches, err := s.CheckPathConsistency(client, registrations)
+	require.NoError(t, err)
+	require.Len(t, mismatches, 1)
+	assert.Equal(t, "orphan-rule", mismatches[0].RuleName)
+}
+
+func TestCheckPathConsistencyDetectsAConfigurationWithNoMountedRule(t *testing.T) {
+	s := consistencyTestServer()
+
+	client := newFakeConfigClient()
+	registerFakeWebhookConfig(t, s, client, "stale-rule", pathFromName("stale-rule"))
+
+	mismatches, err := s.CheckPathConsistency(client, map[string]Registration{})
+	require.NoError(t, err)
+	require.Len(t, mismatches, 1)
+	assert.Equal(t, "stale-rule", mismatches[0].RuleName)
+}
+
+func TestReconcilePathsDoesNotReregisterByDefault(t *testing.T) {
+	defer func() { AutoReregisterOnMismatch = false }()
+	AutoReregisterOnMismatch = false
+
+	s := consistencyTestServer()
+	s.AddGraffitiRule(graffiti.Rule{Name: "my-rule"})
+
+	client := newFakeConfigClient()
+	registerFakeWebhookConfig(t, s, client, "my-rule", "/old-prefix/my-rule")
+	registrations := map[string]Registration{"my-rule": {Name: "my-rule", FailurePolicy: "ignore"}}
+
+	mismatches, err := s.ReconcilePaths(client, registrations)
+	require.NoError(t, err)
+	require.Len(t, mismatches, 1)
+
+	unhealed, err := client.Get("my-rule", metav1.GetOptions{})
+	require.NoError(t, err)
+	require.NotNil(t, unhealed.Webhooks[0].ClientConfig.Service.Path)
+	assert.Equal(t, "/old-prefix/my-rule", *unhealed.Webhooks[0].ClientConfig.Service.Path, "RegisterHook should not have been called, so the stale path should remain")
+}
+
+func TestReconcilePathsHealsTheMismatchWhenEnabled(t *testing.T) {
+	defer func() { AutoReregisterOnMismatch = false }()
+	AutoReregisterOnMismatch = true
+
+	s := consistencyTestServer()
+	s.AddGraffitiRule(graffiti.Rule{Name: "my-rule"})
+
+	client := newFakeConfigClient()
+	registerFakeWebhookConfig(t, s, client, "my-rule", "/old-prefix/my-rule")
+	registrations := map[string]Registration{"my-rule": {Name: "my-rule", FailurePolicy: "ignore"}}
+
+	mismatches, err := s.ReconcilePaths(client, registrations)
+	require.NoError(t, err)
+	require.Len(t, mismatches, 1)
+
+	healed, err := client.Get("my-rule", metav1.GetOptions{})
+	require.NoError(t, err, "RegisterHook should have re-created the configuration at the expected path")
+	require.Len(t, healed.Webhooks, 1)
+	require.NotNil(t, healed.Webhooks[0].ClientConfig.Service.Path)
+	assert.Equal(t, pathFromName("my-rule"), *healed.Webhooks[0].ClientConfig.Service.Path)
+}
@@ -15,36 +15,75 @@ package webhook
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
-	"io"
+	"fmt"
 	"io/ioutil"
+	"mime"
 	"net/http"
 
+	"github.com/HotelsDotCom/kube-graffiti/pkg/audit"
+	"github.com/HotelsDotCom/kube-graffiti/pkg/httpresponse"
 	"github.com/HotelsDotCom/kube-graffiti/pkg/log"
+	"github.com/HotelsDotCom/kube-graffiti/pkg/metrics"
+	"github.com/HotelsDotCom/kube-graffiti/pkg/tracing"
+	"github.com/rs/zerolog"
 	admission "k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 )
 
+// StrictMode controls how ServeHTTP treats a request for a path with no registered graffiti rule. A
+// missing rule usually means a webhook configuration points at a path kube-graffiti never mounted - a
+// misconfiguration rather than a deliberate no-op - but we still can't deny the request without risking
+// blocking creates on a badly configured cluster. When StrictMode is enabled, such a request is still
+// allowed through, but it is logged at warn, stamped with an audit annotation and counted against
+// metrics.UnregisteredPathRequests so operators notice the misrouting. It is off by default.
+var StrictMode = false
+
+// unregisteredPathAnnotationKey is the AuditAnnotations key stamped onto a StrictMode response for a
+// path with no registered graffiti rule.
+const unregisteredPathAnnotationKey = "kube-graffiti.expedia.com/unregistered-path"
+
 // graffitHandler contains the context needed within our http handler without using global variables
 // It satisfies the http.Handler interface
 type graffitiHandler struct {
-	tagmap map[string]graffitiMutator
+	// tagmap is keyed by webhook path, and holds every rule registered against that path in
+	// registration (i.e. priority) order. It is almost always a single rule - pathFromName derives a
+	// path from the rule's own name, so two rules only ever share a path when they are deliberately
+	// grouped together - but when it isn't, ServeHTTP combines their responses with CombineJSONPatches
+	// rather than letting the last one registered silently shadow the rest.
+	tagmap map[string][]graffitiMutator
 }
 
 // graffitiMutator interface allows us to mock out for testing.
 type graffitiMutator interface {
-	MutateAdmission(req *admission.AdmissionRequest) *admission.AdmissionResponse
+	MutateAdmission(ctx context.Context, req *admission.AdmissionRequest) *admission.AdmissionResponse
 }
 
 func newGraffitiHandler() graffitiHandler {
 	return graffitiHandler{
-		tagmap: make(map[string]graffitiMutator),
+		tagmap: make(map[string][]graffitiMutator),
 	}
 }
 
-// addRule allows us to add rules to a handler without relying on its implementation
+// addRule allows us to add rules to a handler without relying on its implementation. Rules added
+// against the same path are appended, earliest first, so that a path carrying more than one rule is
+// grouped rather than each addRule call overwriting the last.
 func (h graffitiHandler) addRule(path string, rule graffitiMutator) {
-	h.tagmap[path] = rule
+	h.tagmap[path] = append(h.tagmap[path], rule)
+}
+
+// isJSONContentType reports whether contentType's media type is application/json, ignoring any
+// parameters such as "charset=utf-8" - accepting them is what mime.ParseMediaType gives us for free,
+// rather than exact-matching the whole header and rejecting callers that add a parameter we don't
+// care about. An unparseable header (e.g. completely empty, or malformed) is rejected.
+func isJSONContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json"
 }
 
 // ServeHTTP performs the basic validation that we received a valid AdmissionReview request.
@@ -55,6 +94,17 @@ func (h graffitiHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	reqLog := mylog.With().Str("url", url).Str("host", r.Host).Str("method", r.Method).Str("ua", r.UserAgent()).Str("remote", r.RemoteAddr).Logger()
 	reqLog.Debug().Msg("webhook triggered, performing the mutating admission review")
 
+	ctx, span := tracing.StartSpan(tracing.ExtractContext(r.Context(), r), "ServeHTTP")
+	span.SetAttribute("http.path", url)
+	defer span.End()
+
+	// chaos-testing faults are deliberately checked before any other processing, so that a 'drop' fault
+	// can hijack the connection before we've read or written anything.
+	if interceptFault(w, r) {
+		return
+	}
+	metrics.RequestRateWindow.Record()
+
 	var body []byte
 	if r.Body != nil {
 		if data, err := ioutil.ReadAll(r.Body); err == nil {
@@ -65,19 +115,19 @@ func (h graffitiHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// verify the http method is a POST
 	if r.Method != "POST" {
 		reqLog.Error().Str("method", r.Method).Msg("received invalid method, expecting POST")
-		w.Header().Set("Content-Type", "text/plain")
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		io.WriteString(w, `invalid http method`)
+		w.Header().Set("Allow", "POST")
+		httpresponse.WriteError(w, http.StatusMethodNotAllowed, "method not allowed", nil)
+		metrics.ErrorRateWindow.Record()
 		return
 	}
 
-	// verify the content type is accurate
+	// verify the content type is accurate, tolerating parameters such as "; charset=utf-8" that the
+	// apiserver (and some test tooling) appends - we only care that the media type itself is json.
 	contentType := r.Header.Get("Content-Type")
-	if contentType != "application/json" {
+	if !isJSONContentType(contentType) {
 		reqLog.Error().Str("content-type", contentType).Msg("bad content-type - not application/json")
-		w.Header().Set("Content-Type", "text/plain")
-		w.WriteHeader(http.StatusBadRequest)
-		io.WriteString(w, `invalid request - payload is not json`)
+		httpresponse.WriteError(w, http.StatusBadRequest, "invalid request - payload is not json", nil)
+		metrics.ErrorRateWindow.Record()
 		return
 	}
 
@@ -87,23 +137,30 @@ func (h graffitiHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	d := json.NewDecoder(bytes.NewReader(body))
 	d.DisallowUnknownFields()
 	if err := d.Decode(&ar); err != nil {
-		w.Header().Set("Content-Type", "text/plain")
-		w.WriteHeader(http.StatusBadRequest)
-		io.WriteString(w, `The request does not contain a valid AdmissionReview object`)
 		reqLog.Error().Err(err).Msg("failed to decode AdmissionReview request")
+		httpresponse.WriteError(w, http.StatusBadRequest, "the request does not contain a valid AdmissionReview object", err)
+		metrics.ErrorRateWindow.Record()
 		return
 	}
 	reqLog.Debug().Msg("unmarshalled request")
 
 	reviewResponse := &admission.AdmissionResponse{}
 	// check that we have a Graffiti matching this URL path...
-	if mutator, ok := h.tagmap[url]; !ok {
+	if mutators, ok := h.tagmap[url]; !ok {
 		reqLog.Warn().Str("path", url).Msg("can't find a grafitti rule for path")
 		reviewResponse.Allowed = true
+		if StrictMode {
+			reqLog.Warn().Str("path", url).Msg("strict mode: request received for a path with no registered graffiti rule, allowing it through but flagging the misconfiguration")
+			reviewResponse.AuditAnnotations = map[string]string{unregisteredPathAnnotationKey: url}
+			metrics.UnregisteredPathRequests.Observe(url, 1)
+		}
 	} else {
-		reqLog.Debug().Str("path", url).Msg("found a graffiti rule for path")
-		// call the Mutate method associated with this rule
-		reviewResponse = mutator.MutateAdmission(ar.Request)
+		reqLog.Debug().Str("path", url).Int("rules", len(mutators)).Msg("found a graffiti rule for path")
+		reviewResponse = mutateWithAllRules(ctx, ar.Request, mutators, reqLog)
+		recordAuditDecision(url, ar.Request, reviewResponse)
+	}
+	if reviewResponse != nil && !reviewResponse.Allowed {
+		metrics.BlockRateWindow.Record()
 	}
 
 	response := admission.AdmissionReview{}
@@ -116,14 +173,93 @@ func (h graffitiHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ar.Request.OldObject = runtime.RawExtension{}
 
 	reqLog.Debug().Msg("writing AdmissionReview response")
-	resp, err := json.Marshal(response)
+	httpresponse.WriteJSON(w, http.StatusOK, response)
+	reqLog.Debug().Interface("response", response).Msg("webhook response")
+}
+
+// mutateWithAllRules calls every rule registered against the request's path and returns a single
+// admission response for them. The overwhelmingly common case is a single rule, whose response is
+// returned unchanged; when a path carries more than one rule, any rule that blocks wins outright
+// (deny-first, since letting a later-registered rule's patch proceed after an earlier one refused the
+// object would contradict it), and otherwise every rule's json-patch is merged with CombineJSONPatches,
+// in registration order, so each rule's mutation lands in the response rather than only the last
+// rule's patch being applied.
+func mutateWithAllRules(ctx context.Context, req *admission.AdmissionRequest, mutators []graffitiMutator, reqLog zerolog.Logger) *admission.AdmissionResponse {
+	responses := make([]*admission.AdmissionResponse, len(mutators))
+	for i, mutator := range mutators {
+		responses[i] = mutator.MutateAdmission(ctx, req)
+	}
+	if len(responses) == 1 {
+		return responses[0]
+	}
+
+	var patches [][]byte
+	for _, response := range responses {
+		if !response.Allowed {
+			reqLog.Info().Msg("a rule on this path blocked the request, so the other rules sharing the path are not applied")
+			return response
+		}
+		if len(response.Patch) > 0 {
+			patches = append(patches, response.Patch)
+		}
+	}
+	if len(patches) == 0 {
+		return responses[0]
+	}
+	if len(patches) == 1 {
+		return patchResultFromCombinedPatch(patches[0])
+	}
+
+	combined, err := CombineJSONPatches(patches)
 	if err != nil {
-		mylog.Error().Err(err).Msg("failed to marshal AdmissionReview response")
+		reqLog.Error().Err(err).Msg("failed to combine json-patches from rules sharing this path")
+		return &admission.AdmissionResponse{
+			Allowed: false,
+			Result: &metav1.Status{
+				Reason:  metav1.StatusReasonInternalError,
+				Message: fmt.Sprintf("kube-graffiti failed to combine patches from multiple rules: %v", err),
+			},
+		}
 	}
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	if _, err := w.Write(resp); err != nil {
-		reqLog.Error().Err(err).Msg("failed to write the http response")
+	return patchResultFromCombinedPatch(combined)
+}
+
+// recordAuditDecision persists an audit record for the outcome mutateWithAllRules reached against req,
+// if auditing is enabled - audit.RecordDecision no-ops otherwise. path, rather than an individual rule's
+// name, is used as the Record's Rule identifier: response can be the merged result of several rules
+// sharing path, so there is no single rule to attribute it to.
+func recordAuditDecision(path string, req *admission.AdmissionRequest, response *admission.AdmissionResponse) {
+	if response == nil {
+		return
+	}
+	decision := audit.DecisionAllowed
+	switch {
+	case !response.Allowed:
+		decision = audit.DecisionBlocked
+	case len(response.Patch) > 0:
+		decision = audit.DecisionPatched
+	}
+	audit.RecordDecision(audit.Record{
+		Rule:      path,
+		Kind:      req.Kind.Kind,
+		Name:      req.Name,
+		Namespace: req.Namespace,
+		Operation: string(req.Operation),
+		Decision:  decision,
+		Patch:     string(response.Patch),
+	})
+}
+
+// patchResultFromCombinedPatch renders the admission response for a json-patch that CombineJSONPatches
+// has already produced (or passed through unchanged, for the one-patch case).
+func patchResultFromCombinedPatch(patch []byte) *admission.AdmissionResponse {
+	pt := admission.PatchTypeJSONPatch
+	return &admission.AdmissionResponse{
+		Allowed: true,
+		Result: &metav1.Status{
+			Message: "object painted by kube-graffiti",
+		},
+		PatchType: &pt,
+		Patch:     patch,
 	}
-	reqLog.Debug().Str("json", string(resp)).Msg("webhook response")
 }
@@ -14,12 +14,16 @@ limitations under the License.
 package webhook
 
 import (
+	"context"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
 
+	"github.com/HotelsDotCom/kube-graffiti/pkg/httpresponse"
+	"github.com/HotelsDotCom/kube-graffiti/pkg/metrics"
+	"github.com/HotelsDotCom/kube-graffiti/pkg/tracing"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
@@ -30,7 +34,7 @@ type mockMutator struct {
 	mock.Mock
 }
 
-func (m *mockMutator) MutateAdmission(req *admission.AdmissionRequest) *admission.AdmissionResponse {
+func (m *mockMutator) MutateAdmission(ctx context.Context, req *admission.AdmissionRequest) *admission.AdmissionResponse {
 	args := m.Called(req)
 	return args.Get(0).(*admission.AdmissionResponse)
 }
@@ -44,10 +48,11 @@ func TestMethodNotPost(t *testing.T) {
 	handler.ServeHTTP(rr, req)
 
 	resp := rr.Result()
-	assert.NotEqual(t, http.StatusOK, resp.StatusCode)
-	assert.Equal(t, "text/plain", resp.Header.Get("Content-Type"))
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	assert.Equal(t, "POST", resp.Header.Get("Allow"))
+	assertSecurityHeaders(t, resp)
 	respBody, _ := ioutil.ReadAll(resp.Body)
-	assert.Equal(t, "invalid http method", string(respBody))
+	assert.Equal(t, `{"error":"method not allowed"}`, string(respBody))
 }
 
 func TestWithNonJsonRequest(t *testing.T) {
@@ -59,10 +64,46 @@ func TestWithNonJsonRequest(t *testing.T) {
 	handler.ServeHTTP(rr, req)
 
 	resp := rr.Result()
-	assert.NotEqual(t, http.StatusOK, resp.StatusCode)
-	assert.Equal(t, "text/plain", resp.Header.Get("Content-Type"))
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assertSecurityHeaders(t, resp)
 	respBody, _ := ioutil.ReadAll(resp.Body)
-	assert.Equal(t, "invalid request - payload is not json", string(respBody))
+	assert.Equal(t, `{"error":"invalid request - payload is not json"}`, string(respBody))
+}
+
+// TestContentTypeWithCharsetParameterIsAccepted confirms that "application/json; charset=utf-8" -
+// what the apiserver (and some test tooling) actually sends - is accepted rather than rejected by an
+// exact string match against "application/json".
+func TestContentTypeWithCharsetParameterIsAccepted(t *testing.T) {
+	reqBody := strings.NewReader(`{"message": "this is not a valid admission review object"}`)
+	req, err := http.NewRequest("POST", "/", reqBody)
+	require.NoError(t, err, "We created a valid http request")
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	rr := httptest.NewRecorder()
+	handler := newGraffitiHandler()
+	handler.ServeHTTP(rr, req)
+
+	resp := rr.Result()
+	// the request body isn't an AdmissionReview, but crucially it got past the content-type check -
+	// a rejected content-type would have produced "payload is not json" instead.
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, `{"error":"the request does not contain a valid AdmissionReview object"}`, string(respBody))
+}
+
+// TestBogusContentTypeIsRejected confirms that a genuinely different media type is still rejected -
+// accepting parameters on "application/json" must not widen the check into accepting anything.
+func TestBogusContentTypeIsRejected(t *testing.T) {
+	reqBody := strings.NewReader(`{}`)
+	req, err := http.NewRequest("POST", "/", reqBody)
+	require.NoError(t, err, "We created a valid http request")
+	req.Header.Set("Content-Type", "text/plain")
+	rr := httptest.NewRecorder()
+	handler := newGraffitiHandler()
+	handler.ServeHTTP(rr, req)
+
+	resp := rr.Result()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, `{"error":"invalid request - payload is not json"}`, string(respBody))
 }
 
 func TestRequestIsNotAnAdmissionReviewObject(t *testing.T) {
@@ -75,10 +116,36 @@ func TestRequestIsNotAnAdmissionReviewObject(t *testing.T) {
 	handler.ServeHTTP(rr, req)
 
 	resp := rr.Result()
-	assert.NotEqual(t, http.StatusOK, resp.StatusCode)
-	assert.Equal(t, "text/plain", resp.Header.Get("Content-Type"))
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assertSecurityHeaders(t, resp)
 	respBody, _ := ioutil.ReadAll(resp.Body)
-	assert.Equal(t, "The request does not contain a valid AdmissionReview object", string(respBody))
+	assert.Equal(t, `{"error":"the request does not contain a valid AdmissionReview object"}`, string(respBody))
+}
+
+func TestRequestIsNotAnAdmissionReviewObjectIncludesDetailWhenVerbose(t *testing.T) {
+	defer func() { httpresponse.VerboseErrors = false }()
+	httpresponse.VerboseErrors = true
+
+	reqBody := strings.NewReader(`{"message": "this is not a valid admission review object"}`)
+	req, err := http.NewRequest("POST", "/", reqBody)
+	req.Header.Set("Content-Type", "application/json")
+	assert.NoError(t, err, "We created a valid http request")
+	rr := httptest.NewRecorder()
+	handler := newGraffitiHandler()
+	handler.ServeHTTP(rr, req)
+
+	resp := rr.Result()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	assert.NotEqual(t, `{"error":"the request does not contain a valid AdmissionReview object"}`, string(respBody), "verbose mode should surface the underlying decode error instead of the generic message")
+}
+
+// assertSecurityHeaders checks the minimal, consistent header set that every response written through
+// httpresponse should carry, regardless of which error path produced it.
+func assertSecurityHeaders(t *testing.T, resp *http.Response) {
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "nosniff", resp.Header.Get("X-Content-Type-Options"))
+	assert.Empty(t, resp.Header.Get("Server"))
 }
 
 func TestCallsMutateWhenPathIsHandled(t *testing.T) {
@@ -104,6 +171,31 @@ func TestCallsMutateWhenPathIsHandled(t *testing.T) {
 	assert.Equal(t, "{\"response\":{\"uid\":\"69f7d25a-963e-11e8-a77c-08002753edac\",\"allowed\":false}}", string(respBody))
 }
 
+func TestServeHTTPRecordsASpanPerRequestWhenTracingIsEnabled(t *testing.T) {
+	oldEnabled, oldExporter := tracing.Enabled, tracing.CurrentExporter
+	exporter := tracing.NewInMemoryExporter()
+	tracing.Enabled = true
+	tracing.CurrentExporter = exporter
+	defer func() {
+		tracing.Enabled = oldEnabled
+		tracing.CurrentExporter = oldExporter
+	}()
+
+	rr := httptest.NewRecorder()
+	handler := newGraffitiHandler()
+
+	reqBody := strings.NewReader("{\"kind\":\"AdmissionReview\",\"apiVersion\":\"admission.k8s.io/v1beta1\",\"request\":{\"uid\":\"69f7d25a-963e-11e8-a77c-08002753edac\",\"kind\":{\"group\":\"\",\"version\":\"v1\",\"kind\":\"Namespace\"},\"resource\":{\"group\":\"\",\"version\":\"v1\",\"resource\":\"namespaces\"},\"operation\":\"CREATE\",\"userInfo\":{\"username\":\"minikube-user\",\"groups\":[\"system:masters\",\"system:authenticated\"]},\"object\":{\"metadata\":{\"name\":\"test-namespace\",\"creationTimestamp\":null},\"spec\":{},\"status\":{\"phase\":\"Active\"}},\"oldObject\":null}}\n")
+	req, err := http.NewRequest("POST", "/graffiti/missing-rule", reqBody)
+	req.Header.Set("Content-Type", "application/json")
+	require.NoError(t, err, "We created a valid http request")
+	handler.ServeHTTP(rr, req)
+
+	require.Len(t, exporter.Spans(), 1)
+	span := exporter.Spans()[0]
+	assert.Equal(t, "ServeHTTP", span.Name)
+	assert.Equal(t, "/graffiti/missing-rule", span.Attributes["http.path"])
+}
+
 func TestHandlerAllowsRequestWithMissingHandler(t *testing.T) {
 	rr := httptest.NewRecorder()
 	handler := newGraffitiHandler()
@@ -120,3 +212,26 @@ func TestHandlerAllowsRequestWithMissingHandler(t *testing.T) {
 	respBody, _ := ioutil.ReadAll(resp.Body)
 	assert.Equal(t, "{\"response\":{\"uid\":\"69f7d25a-963e-11e8-a77c-08002753edac\",\"allowed\":true}}", string(respBody))
 }
+
+func TestHandlerStillAllowsRequestWithMissingHandlerInStrictModeButCountsAMetric(t *testing.T) {
+	old := StrictMode
+	defer func() { StrictMode = old }()
+	StrictMode = true
+
+	before := metrics.UnregisteredPathRequests.Count("/graffiti/missing-rule")
+
+	rr := httptest.NewRecorder()
+	handler := newGraffitiHandler()
+
+	reqBody := strings.NewReader("{\"kind\":\"AdmissionReview\",\"apiVersion\":\"admission.k8s.io/v1beta1\",\"request\":{\"uid\":\"69f7d25a-963e-11e8-a77c-08002753edac\",\"kind\":{\"group\":\"\",\"version\":\"v1\",\"kind\":\"Namespace\"},\"resource\":{\"group\":\"\",\"version\":\"v1\",\"resource\":\"namespaces\"},\"operation\":\"CREATE\",\"userInfo\":{\"username\":\"minikube-user\",\"groups\":[\"system:masters\",\"system:authenticated\"]},\"object\":{\"metadata\":{\"name\":\"test-namespace\",\"creationTimestamp\":null},\"spec\":{},\"status\":{\"phase\":\"Active\"}},\"oldObject\":null}}\n")
+	req, err := http.NewRequest("POST", "/graffiti/missing-rule", reqBody)
+	req.Header.Set("Content-Type", "application/json")
+	require.NoError(t, err, "We created a valid http request")
+	handler.ServeHTTP(rr, req)
+
+	resp := rr.Result()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, "{\"response\":{\"uid\":\"69f7d25a-963e-11e8-a77c-08002753edac\",\"allowed\":true,\"auditAnnotations\":{\"kube-graffiti.expedia.com/unregistered-path\":\"/graffiti/missing-rule\"}}}", string(respBody), "the request should still be allowed, but flagged with an audit annotation")
+	assert.Equal(t, before+1, metrics.UnregisteredPathRequests.Count("/graffiti/missing-rule"), "strict mode should count the unregistered-path request against the dedicated metric")
+}
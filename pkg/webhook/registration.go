@@ -17,11 +17,13 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/HotelsDotCom/kube-graffiti/pkg/log"
 	admissionreg "k8s.io/api/admissionregistration/v1beta1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/client-go/kubernetes"
+	admissionregclient "k8s.io/client-go/kubernetes/typed/admissionregistration/v1beta1"
 )
 
 type Registration struct {
@@ -29,25 +31,229 @@ type Registration struct {
 	Targets           []Target `mapstructure:"targets" yaml:"targets"`
 	NamespaceSelector string   `mapstructure:"namespace-selector" yaml:"namespace-selector,omitempty"`
 	FailurePolicy     string   `mapstructure:"failure-policy" yaml:"failure-policy"`
+	// NamespaceSelectorAppliesToNamespaces resolves a trap in a registration that both targets
+	// Namespace objects and sets NamespaceSelector: whether the apiserver evaluates that selector
+	// against an incoming Namespace's own labels, or not at all, is version-dependent - a CREATE of a
+	// namespace that this very rule is about to label may or may not reach the webhook depending on
+	// the cluster. "self" makes this deterministic by dropping NamespaceSelector from the registered
+	// configuration for the namespaces target specifically and enforcing it in-process against the
+	// namespace's own labels instead, matching the existing-object checker's behaviour. "skip"
+	// excludes namespaces from the rule entirely. Left empty, Validate only warns about the trap.
+	NamespaceSelectorAppliesToNamespaces string `mapstructure:"namespace-selector-applies-to-namespaces" yaml:"namespace-selector-applies-to-namespaces,omitempty"`
+	// SkipDefaultNamespaceSelector opts this registration out of Configuration.DefaultNamespaceSelector,
+	// which is otherwise AND-combined into every rule's NamespaceSelector - see its doc comment.
+	SkipDefaultNamespaceSelector bool `mapstructure:"skip-default-namespace-selector" yaml:"skip-default-namespace-selector,omitempty"`
+	// SkipOwnNamespaceExclusion opts this registration out of RegisterHook's default behaviour of
+	// excluding graffiti's own namespace (Server.Namespace) from every registration's NamespaceSelector,
+	// to guard against graffiti recursively mutating or blocking its own objects. It has no effect when
+	// Server.Namespace is empty.
+	SkipOwnNamespaceExclusion bool `mapstructure:"skip-own-namespace-exclusion" yaml:"skip-own-namespace-exclusion,omitempty"`
+}
+
+const (
+	NamespaceSelectorAppliesToNamespacesSelf = "self"
+	NamespaceSelectorAppliesToNamespacesSkip = "skip"
+)
+
+// namespaceNameLabelKey is the label every namespace carries since Kubernetes 1.21, automatically
+// set by the apiserver to the namespace's own name - the standard way to select or exclude a
+// namespace by name in a namespaceSelector.
+const namespaceNameLabelKey = "kubernetes.io/metadata.name"
+
+// excludeOwnNamespace returns a copy of selector with an extra matchExpressions entry excluding
+// namespace, AND-combined with whatever the registration's own NamespaceSelector already requires.
+// namespace being empty leaves selector untouched, since RegisterHook has nothing to exclude.
+func excludeOwnNamespace(selector *metav1.LabelSelector, namespace string) *metav1.LabelSelector {
+	if namespace == "" {
+		return selector
+	}
+	result := selector.DeepCopy()
+	result.MatchExpressions = append(result.MatchExpressions, metav1.LabelSelectorRequirement{
+		Key:      namespaceNameLabelKey,
+		Operator: metav1.LabelSelectorOpNotIn,
+		Values:   []string{namespace},
+	})
+	return result
+}
+
+// targetsNamespaces reports whether t's api-groups/api-versions/resources could match the core v1
+// Namespace resource - used by Registration.Validate to detect the namespace-selector trap described
+// on NamespaceSelectorAppliesToNamespaces. It is evaluated against the literal target patterns, before
+// ExpandTargets resolves any globs against discovery, since "namespaces" is never itself a glob.
+func (t Target) targetsNamespaces() bool {
+	return matchesAnyPattern(t.APIGroups, "") && matchesAnyPattern(t.APIVersions, "v1") && matchesAnyPattern(t.Resources, "namespaces")
+}
+
+// matchesAnyPattern reports whether element matches any one of patterns, using the same matching
+// MatchesPattern gives a registered target - a missing patterns list never matches anything.
+func matchesAnyPattern(patterns []string, element string) bool {
+	for _, p := range patterns {
+		if MatchesPattern(element, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// targetsNamespaces reports whether any of r's targets could match the core v1 Namespace resource.
+func (r Registration) targetsNamespaces() bool {
+	for _, t := range r.Targets {
+		if t.targetsNamespaces() {
+			return true
+		}
+	}
+	return false
+}
+
+// SplitNamespaceTargets divides r's targets into the targets that should keep using r's configured
+// NamespaceSelector and the targets that match the namespaces resource specifically. namespaces is
+// only non-empty when r both targets namespaces and sets NamespaceSelectorAppliesToNamespaces - only
+// then does RegisterHook need to treat the namespaces target differently from r's other targets. See
+// Registration.Validate for the trap this resolves.
+func (r Registration) SplitNamespaceTargets() (rest, namespaces []Target) {
+	if r.NamespaceSelector == "" || r.NamespaceSelectorAppliesToNamespaces == "" {
+		return r.Targets, nil
+	}
+	for _, t := range r.Targets {
+		if t.targetsNamespaces() {
+			namespaces = append(namespaces, t)
+		} else {
+			rest = append(rest, t)
+		}
+	}
+	return rest, namespaces
 }
 
 // Target defines a kubernetes compatible admissionreg.Rule but with mapstructure tags so that we can
-// unmarshal it as part of a Viper structured configuration.
+// unmarshal it as part of a Viper structured configuration. As well as literal names and the wildcard
+// "*", api-groups/api-versions/resources entries may be a glob pattern such as "*.company.com", which
+// ExpandTargets resolves against discovery before the target is registered with the apiserver.
 type Target struct {
 	APIGroups   []string `mapstructure:"api-groups" yaml:"api-groups"`
 	APIVersions []string `mapstructure:"api-versions" yaml:"api-versions"`
 	Resources   []string `mapstructure:"resources" yaml:"resources"`
 }
 
-// RegisterHook registers our webhook as MutatingWebhook with the kubernetes api.
-func (s Server) RegisterHook(r Registration, clientset *kubernetes.Clientset) error {
+// Validate checks that every api-groups/api-versions/resources entry is either a literal name, the
+// wildcard "*", or a syntactically valid, non-empty glob pattern.
+func (t Target) Validate() error {
+	for _, g := range t.APIGroups {
+		if err := validateTargetPattern(g); err != nil {
+			return fmt.Errorf("invalid api-groups entry %q: %v", g, err)
+		}
+	}
+	for _, v := range t.APIVersions {
+		if v == "" {
+			return fmt.Errorf("invalid api-versions entry: empty string can never match a version")
+		}
+		if err := validateTargetPattern(v); err != nil {
+			return fmt.Errorf("invalid api-versions entry %q: %v", v, err)
+		}
+	}
+	for _, r := range t.Resources {
+		if r == "" {
+			return fmt.Errorf("invalid resources entry: empty string can never match a resource")
+		}
+		if err := validateTargetPattern(r); err != nil {
+			return fmt.Errorf("invalid resources entry %q: %v", r, err)
+		}
+		if strings.EqualFold(r, "pods/binding") {
+			return fmt.Errorf("invalid resources entry %q: a rule can never safely target pods/binding - it would be evaluated against the ephemeral Binding object the scheduler posts, not the Pod it describes", r)
+		}
+	}
+	return nil
+}
+
+// Validate checks every one of r's targets, that a configured NamespaceSelector parses as a valid
+// label selector - which matters as much for a selector merged in from
+// config.Configuration.DefaultNamespaceSelector as for one set directly on the rule - and, when r
+// both targets namespaces and sets a NamespaceSelector, that NamespaceSelectorAppliesToNamespaces
+// resolves the trap described on its doc comment deterministically - warning if it is unset, rejecting
+// any value other than "self"/"skip".
+func (r Registration) Validate() error {
+	for i, t := range r.Targets {
+		if err := t.Validate(); err != nil {
+			return fmt.Errorf("registration '%s' target %d is invalid: %v", r.Name, i, err)
+		}
+	}
+
+	if r.NamespaceSelector != "" {
+		if _, err := metav1.ParseToLabelSelector(r.NamespaceSelector); err != nil {
+			return fmt.Errorf("registration '%s' has an invalid namespace-selector %q: %v", r.Name, r.NamespaceSelector, err)
+		}
+	}
+
+	if r.NamespaceSelector != "" && r.targetsNamespaces() {
+		mylog := log.ComponentLogger(componentName, "Validate")
+		switch r.NamespaceSelectorAppliesToNamespaces {
+		case "":
+			mylog.Warn().Str("rule", r.Name).Msg("registration targets namespaces and also sets a namespace-selector - whether the apiserver evaluates that selector against an incoming namespace's own labels is version-dependent; set namespace-selector-applies-to-namespaces to 'self' or 'skip' to make this deterministic")
+		case NamespaceSelectorAppliesToNamespacesSelf, NamespaceSelectorAppliesToNamespacesSkip:
+			// deterministic - handled by SplitNamespaceTargets and, for "self", the in-process check
+			// graffiti.Rule.SelfNamespaceSelector performs against a Namespace object's own labels.
+		default:
+			return fmt.Errorf("registration '%s' has an invalid namespace-selector-applies-to-namespaces %q: must be 'self' or 'skip'", r.Name, r.NamespaceSelectorAppliesToNamespaces)
+		}
+	}
+	return nil
+}
+
+// RegistrationStatus is a point-in-time snapshot of one rule's webhook registration, exposed by
+// CurrentRegistrations for an operator-facing status page.
+type RegistrationStatus struct {
+	Name         string    `json:"name"`
+	Path         string    `json:"path"`
+	Registered   bool      `json:"registered"`
+	LastError    string    `json:"last-error,omitempty"`
+	RegisteredAt time.Time `json:"registered-at,omitempty"`
+}
+
+var (
+	registrationsMu sync.Mutex
+	registrations   = make(map[string]RegistrationStatus)
+)
+
+// recordRegistration notes the outcome of a RegisterHook call against name/path, so that
+// CurrentRegistrations always reflects the most recently attempted registration even if it failed.
+func recordRegistration(name, path string, err error) {
+	registrationsMu.Lock()
+	defer registrationsMu.Unlock()
+	status := RegistrationStatus{Name: name, Path: path, Registered: err == nil}
+	if err != nil {
+		status.LastError = err.Error()
+	} else {
+		status.RegisteredAt = time.Now()
+	}
+	registrations[name] = status
+}
+
+// CurrentRegistrations reports the most recently attempted webhook registration for every rule
+// RegisterHook has been called for, for registering against an operator-facing status endpoint.
+func CurrentRegistrations() []RegistrationStatus {
+	registrationsMu.Lock()
+	defer registrationsMu.Unlock()
+	statuses := make([]RegistrationStatus, 0, len(registrations))
+	for _, status := range registrations {
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// RegisterHook registers our webhook as MutatingWebhook with the kubernetes api. It accepts the
+// generated MutatingWebhookConfigurationInterface rather than a full clientset, so tests can supply a
+// fake clientset's implementation of it without needing a real kubernetes.Clientset.
+func (s Server) RegisterHook(r Registration, client admissionregclient.MutatingWebhookConfigurationInterface) (err error) {
 	mylog := log.ComponentLogger(componentName, "RegisterHook")
+	defer func() { recordRegistration(r.Name, pathFromName(r.Name), err) }()
 
 	selector, err := metav1.ParseToLabelSelector(r.NamespaceSelector)
 	if err != nil {
 		mylog.Error().Err(err).Str("namespace-selector", r.NamespaceSelector).Msg("could not parse the namespace selector")
 		return fmt.Errorf("could not parse the namespace selector: %v", err)
 	}
+	if !r.SkipOwnNamespaceExclusion {
+		selector = excludeOwnNamespace(selector, s.Namespace)
+	}
 
 	var failurePolicy admissionreg.FailurePolicyType
 	failurePolicy = admissionreg.FailurePolicyType(strings.Title(r.FailurePolicy))
@@ -56,7 +262,6 @@ func (s Server) RegisterHook(r Registration, clientset *kubernetes.Clientset) er
 		return fmt.Errorf("invalid admission registration failure policy type")
 	}
 
-	client := clientset.AdmissionregistrationV1beta1().MutatingWebhookConfigurations()
 	_, err = client.Get(r.Name, metav1.GetOptions{})
 	if err == nil {
 		if err := client.Delete(r.Name, nil); err != nil {
@@ -65,39 +270,32 @@ func (s Server) RegisterHook(r Registration, clientset *kubernetes.Clientset) er
 		}
 	}
 
-	var rules []admissionreg.RuleWithOperations
-	for _, target := range r.Targets {
-		rules = append(rules, admissionreg.RuleWithOperations{
-			Operations: []admissionreg.OperationType{admissionreg.Create, admissionreg.Update},
-			Rule: admissionreg.Rule{
-				APIGroups:   target.APIGroups,
-				APIVersions: target.APIVersions,
-				Resources:   target.Resources,
-			},
-		})
+	path := pathFromName(r.Name)
+	clientConfig := admissionreg.WebhookClientConfig{
+		Service: &admissionreg.ServiceReference{
+			Namespace: s.Namespace,
+			Name:      s.Service,
+			Path:      &path,
+		},
+		CABundle: s.caBundle.get(),
 	}
 
-	path := pathFromName(r.Name)
+	rest, namespaces := r.SplitNamespaceTargets()
+	webhooks := []admissionreg.Webhook{*buildWebhook(r.Name, s.CompanyDomain, rest, selector, failurePolicy, clientConfig)}
+	if r.NamespaceSelectorAppliesToNamespaces == NamespaceSelectorAppliesToNamespacesSelf && len(namespaces) > 0 {
+		// the namespaces-target webhook carries no NamespaceSelector - RegisterHook can't know a
+		// namespace's own labels any sooner than our own handler can, so the selector is instead
+		// enforced in-process by graffiti.Rule.SelfNamespaceSelector once the request arrives.
+		webhooks = append(webhooks, *buildWebhook(r.Name+"-namespaces", s.CompanyDomain, namespaces, nil, failurePolicy, clientConfig))
+	}
+	// NamespaceSelectorAppliesToNamespacesSkip simply drops the namespaces targets - they appear in
+	// neither webhook entry, so the apiserver never sends us a Namespace admission request at all.
+
 	webhookConfig := &admissionreg.MutatingWebhookConfiguration{
 		ObjectMeta: metav1.ObjectMeta{
 			Name: r.Name,
 		},
-		Webhooks: []admissionreg.Webhook{
-			{
-				Name:              r.Name + "." + s.CompanyDomain,
-				FailurePolicy:     &failurePolicy,
-				NamespaceSelector: selector,
-				Rules:             rules,
-				ClientConfig: admissionreg.WebhookClientConfig{
-					Service: &admissionreg.ServiceReference{
-						Namespace: s.Namespace,
-						Name:      s.Service,
-						Path:      &path,
-					},
-					CABundle: s.CACert,
-				},
-			},
-		},
+		Webhooks: webhooks,
 	}
 	if _, err := client.Create(webhookConfig); err != nil {
 		mylog.Error().Err(err).Str("name", r.Name).Msg("webhook registration failed")
@@ -106,3 +304,26 @@ func (s Server) RegisterHook(r Registration, clientset *kubernetes.Clientset) er
 
 	return nil
 }
+
+// buildWebhook builds a single admissionreg.Webhook entry covering targets - possibly none, which
+// produces a Webhook that matches nothing, same as a Registration with no targets always has.
+func buildWebhook(name, companyDomain string, targets []Target, selector *metav1.LabelSelector, failurePolicy admissionreg.FailurePolicyType, clientConfig admissionreg.WebhookClientConfig) *admissionreg.Webhook {
+	var rules []admissionreg.RuleWithOperations
+	for _, target := range targets {
+		rules = append(rules, admissionreg.RuleWithOperations{
+			Operations: []admissionreg.OperationType{admissionreg.Create, admissionreg.Update},
+			Rule: admissionreg.Rule{
+				APIGroups:   target.APIGroups,
+				APIVersions: target.APIVersions,
+				Resources:   target.Resources,
+			},
+		})
+	}
+	return &admissionreg.Webhook{
+		Name:              name + "." + companyDomain,
+		FailurePolicy:     &failurePolicy,
+		NamespaceSelector: selector,
+		Rules:             rules,
+		ClientConfig:      clientConfig,
+	}
+}
@@ -0,0 +1,70 @@
+//go:build envtest
+// +build envtest
+
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// This file is gated behind the "envtest" build tag and is not part of the default
+// `go build ./... && go vet ./... && go test ./...` loop - it exercises RegisterHook against a real
+// control plane started by sigs.k8s.io/controller-runtime/pkg/envtest, which this repository's
+// dep-managed vendor tree does not currently include, and which needs the kubebuilder etcd/kube-apiserver
+// test binaries (KUBEBUILDER_ASSETS) present on the machine running it. To run it: `dep ensure -add
+// sigs.k8s.io/controller-runtime`, install the kubebuilder test binaries, then
+// `go test -tags envtest ./pkg/webhook/...`. TestRegisterHookSplitsIntoTwoWebhooksInSelfMode and its
+// neighbours in registration_test.go already cover RegisterHook's config-building against a fake
+// clientset on every normal test run; this file additionally proves the resulting
+// MutatingWebhookConfiguration round-trips through a real apiserver unchanged.
+package webhook
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/controller-runtime/pkg/envtest"
+)
+
+func TestRegisterHookAgainstARealControlPlane(t *testing.T) {
+	env := &envtest.Environment{}
+	cfg, err := env.Start()
+	require.NoError(t, err, "envtest requires KUBEBUILDER_ASSETS to point at the kube-apiserver/etcd test binaries")
+	defer env.Stop()
+
+	clientset, err := kubernetes.NewForConfig(cfg)
+	require.NoError(t, err)
+	client := clientset.AdmissionregistrationV1beta1().MutatingWebhookConfigurations()
+
+	s := consistencyTestServer()
+	r := namespacesAndDeploymentsRegistration("self")
+	require.NoError(t, s.RegisterHook(r, client))
+
+	created, err := client.Get(r.Name, metav1.GetOptions{})
+	require.NoError(t, err, "the webhook configuration should be readable back from the real apiserver")
+	require.Len(t, created.Webhooks, 2, "the namespaces target should still be split into its own webhook entry")
+
+	main := created.Webhooks[0]
+	assert.Equal(t, "my-rule.acme.com", main.Name)
+	assert.NotNil(t, main.NamespaceSelector, "the main webhook should carry the registration's namespace-selector")
+	require.Len(t, main.Rules, 1)
+	assert.Equal(t, []string{"deployments"}, main.Rules[0].Resources)
+	assert.Equal(t, s.Service, main.ClientConfig.Service.Name)
+	assert.Equal(t, s.Namespace, main.ClientConfig.Service.Namespace)
+
+	namespaces := created.Webhooks[1]
+	assert.Equal(t, "my-rule-namespaces.acme.com", namespaces.Name)
+	assert.Nil(t, namespaces.NamespaceSelector)
+	require.Len(t, namespaces.Rules, 1)
+	assert.Equal(t, []string{"namespaces"}, namespaces.Rules[0].Resources)
+}
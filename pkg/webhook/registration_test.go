@@ -0,0 +1,196 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func namespacesAndDeploymentsRegistration(mode string) Registration {
+	return Registration{
+		Name: "my-rule",
+		Targets: []Target{
+			{APIGroups: []string{""}, APIVersions: []string{"v1"}, Resources: []string{"namespaces"}},
+			{APIGroups: []string{"apps"}, APIVersions: []string{"v1"}, Resources: []string{"deployments"}},
+		},
+		NamespaceSelector:                    "team=payments",
+		NamespaceSelectorAppliesToNamespaces: mode,
+		FailurePolicy:                        "ignore",
+	}
+}
+
+func TestRegistrationValidateWarnsAboutTheNamespaceSelectorTrapWhenUnresolved(t *testing.T) {
+	r := namespacesAndDeploymentsRegistration("")
+	assert.NoError(t, r.Validate(), "the trap is only ever a warning, never a validation failure")
+}
+
+func TestRegistrationValidateAcceptsSelfAndSkip(t *testing.T) {
+	assert.NoError(t, namespacesAndDeploymentsRegistration("self").Validate())
+	assert.NoError(t, namespacesAndDeploymentsRegistration("skip").Validate())
+}
+
+func TestRegistrationValidateRejectsAnUnknownNamespaceSelectorAppliesToNamespacesValue(t *testing.T) {
+	r := namespacesAndDeploymentsRegistration("explode")
+	assert.EqualError(t, r.Validate(), `registration 'my-rule' has an invalid namespace-selector-applies-to-namespaces "explode": must be 'self' or 'skip'`)
+}
+
+func TestRegistrationValidateIgnoresTheTrapWhenThereIsNoNamespaceSelector(t *testing.T) {
+	r := namespacesAndDeploymentsRegistration("")
+	r.NamespaceSelector = ""
+	assert.NoError(t, r.Validate())
+}
+
+func TestRegistrationValidateRejectsANamespaceSelectorThatDoesNotParse(t *testing.T) {
+	r := namespacesAndDeploymentsRegistration("self")
+	r.NamespaceSelector = "this is not a valid selector$$"
+	assert.Error(t, r.Validate(), "an unparseable namespace-selector - however it got there, including merged in from a default - must fail validation")
+}
+
+func TestSplitNamespaceTargetsLeavesTargetsUntouchedWhenModeIsUnset(t *testing.T) {
+	r := namespacesAndDeploymentsRegistration("")
+	rest, namespaces := r.SplitNamespaceTargets()
+	assert.Equal(t, r.Targets, rest)
+	assert.Nil(t, namespaces)
+}
+
+func TestSplitNamespaceTargetsSeparatesTheNamespacesTargetInSelfMode(t *testing.T) {
+	r := namespacesAndDeploymentsRegistration("self")
+	rest, namespaces := r.SplitNamespaceTargets()
+	require.Len(t, rest, 1)
+	assert.Equal(t, "deployments", rest[0].Resources[0])
+	require.Len(t, namespaces, 1)
+	assert.Equal(t, "namespaces", namespaces[0].Resources[0])
+}
+
+func TestRegisterHookSplitsIntoTwoWebhooksInSelfMode(t *testing.T) {
+	s := consistencyTestServer()
+	client := newFakeConfigClient()
+
+	require.NoError(t, s.RegisterHook(namespacesAndDeploymentsRegistration("self"), client))
+
+	cfg, err := client.Get("my-rule", metav1.GetOptions{})
+	require.NoError(t, err)
+	require.Len(t, cfg.Webhooks, 2, "the namespaces target should be split into its own webhook entry")
+
+	main := cfg.Webhooks[0]
+	assert.Equal(t, "my-rule.acme.com", main.Name)
+	assert.NotNil(t, main.NamespaceSelector, "the main webhook should keep the configured namespace-selector")
+	require.Len(t, main.Rules, 1)
+	assert.Equal(t, []string{"deployments"}, main.Rules[0].Resources)
+
+	namespaces := cfg.Webhooks[1]
+	assert.Equal(t, "my-rule-namespaces.acme.com", namespaces.Name)
+	assert.Nil(t, namespaces.NamespaceSelector, "the namespaces webhook must not filter by namespace-selector - that's enforced in-process instead")
+	require.Len(t, namespaces.Rules, 1)
+	assert.Equal(t, []string{"namespaces"}, namespaces.Rules[0].Resources)
+	assert.Equal(t, main.ClientConfig.Service.Path, namespaces.ClientConfig.Service.Path, "both webhooks must route to the same handler path")
+}
+
+func TestRegisterHookDropsNamespacesEntirelyInSkipMode(t *testing.T) {
+	s := consistencyTestServer()
+	client := newFakeConfigClient()
+
+	require.NoError(t, s.RegisterHook(namespacesAndDeploymentsRegistration("skip"), client))
+
+	cfg, err := client.Get("my-rule", metav1.GetOptions{})
+	require.NoError(t, err)
+	require.Len(t, cfg.Webhooks, 1, "skip mode should never register a separate namespaces webhook")
+	require.Len(t, cfg.Webhooks[0].Rules, 1)
+	assert.Equal(t, []string{"deployments"}, cfg.Webhooks[0].Rules[0].Resources)
+}
+
+func TestRegisterHookStillRegistersASingleWebhookWhenNoSplitIsNeeded(t *testing.T) {
+	s := consistencyTestServer()
+	client := newFakeConfigClient()
+
+	require.NoError(t, s.RegisterHook(Registration{Name: "my-rule", FailurePolicy: "ignore"}, client))
+
+	cfg, err := client.Get("my-rule", metav1.GetOptions{})
+	require.NoError(t, err)
+	require.Len(t, cfg.Webhooks, 1)
+}
+
+func TestRegisterHookExcludesItsOwnNamespaceFromTheSelector(t *testing.T) {
+	s := consistencyTestServer()
+	client := newFakeConfigClient()
+
+	require.NoError(t, s.RegisterHook(Registration{Name: "my-rule", FailurePolicy: "ignore", NamespaceSelector: "team=payments"}, client))
+
+	cfg, err := client.Get("my-rule", metav1.GetOptions{})
+	require.NoError(t, err)
+	require.Len(t, cfg.Webhooks, 1)
+
+	selector := cfg.Webhooks[0].NamespaceSelector
+	require.NotNil(t, selector)
+	assert.Contains(t, selector.MatchExpressions, metav1.LabelSelectorRequirement{
+		Key:      "kubernetes.io/metadata.name",
+		Operator: metav1.LabelSelectorOpNotIn,
+		Values:   []string{s.Namespace},
+	}, "the generated namespaceSelector should exclude graffiti's own namespace")
+}
+
+func TestRegisterHookSkipOwnNamespaceExclusionOmitsTheExclusion(t *testing.T) {
+	s := consistencyTestServer()
+	client := newFakeConfigClient()
+
+	require.NoError(t, s.RegisterHook(Registration{Name: "my-rule", FailurePolicy: "ignore", NamespaceSelector: "team=payments", SkipOwnNamespaceExclusion: true}, client))
+
+	cfg, err := client.Get("my-rule", metav1.GetOptions{})
+	require.NoError(t, err)
+	require.Len(t, cfg.Webhooks, 1)
+
+	selector := cfg.Webhooks[0].NamespaceSelector
+	require.NotNil(t, selector)
+	for _, req := range selector.MatchExpressions {
+		assert.NotEqual(t, "kubernetes.io/metadata.name", req.Key, "skip-own-namespace-exclusion should leave the selector untouched")
+	}
+}
+
+func TestCurrentRegistrationsReportsASuccessfulRegistration(t *testing.T) {
+	s := consistencyTestServer()
+	client := newFakeConfigClient()
+
+	require.NoError(t, s.RegisterHook(Registration{Name: "my-rule", FailurePolicy: "ignore"}, client))
+
+	var status RegistrationStatus
+	for _, r := range CurrentRegistrations() {
+		if r.Name == "my-rule" {
+			status = r
+		}
+	}
+	assert.True(t, status.Registered)
+	assert.Empty(t, status.LastError)
+	assert.Equal(t, pathFromName("my-rule"), status.Path)
+	assert.False(t, status.RegisteredAt.IsZero())
+}
+
+func TestCurrentRegistrationsReportsAFailedRegistration(t *testing.T) {
+	s := consistencyTestServer()
+	client := newFakeConfigClient()
+
+	require.Error(t, s.RegisterHook(Registration{Name: "my-rule", FailurePolicy: "not-a-policy"}, client))
+
+	var status RegistrationStatus
+	for _, r := range CurrentRegistrations() {
+		if r.Name == "my-rule" {
+			status = r
+		}
+	}
+	assert.False(t, status.Registered)
+	assert.NotEmpty(t, status.LastError)
+}
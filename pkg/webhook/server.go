@@ -35,7 +35,8 @@ type Server struct {
 	CompanyDomain string
 	Namespace     string
 	Service       string
-	CACert        []byte
+	Canary        CanaryConfig
+	caBundle      *caBundleBox
 	httpServer    *http.Server
 	handler       graffitiHandler
 }
@@ -59,33 +60,49 @@ func NewServer(cd, ns, svc string, ca []byte, k *kubernetes.Clientset, port int)
 		CompanyDomain: cd,
 		Namespace:     ns,
 		Service:       svc,
-		CACert:        ca,
+		caBundle:      newCABundleBox(ca),
 		httpServer:    server,
 		handler:       newGraffitiHandler(),
 	}
 }
 
-// AddGraffitiRule provides a way of adding new rules into the http mux and corresponding handler context map
+// AddGraffitiRule provides a way of adding new rules into the http mux and corresponding handler context map.
+// If Canary is configured, the rule is wrapped in a canaryGuard that automatically quarantines it should it
+// produce too many admission errors shortly after being added.
 func (s Server) AddGraffitiRule(rule graffiti.Rule) {
 	path := pathFromName(rule.Name)
 	mux := s.httpServer.Handler.(*http.ServeMux)
 	mux.Handle(path, s.handler)
-	s.handler.addRule(path, rule)
+
+	var mutator graffitiMutator = rule
+	if s.Canary.MaxErrors > 0 {
+		mutator = newCanaryGuard(rule, rule.Name, s.Canary)
+	}
+	s.handler.addRule(path, mutator)
 }
 
-// StartWebhookServer starts the webhook server with TLS encryption
+// StartWebhookServer starts the webhook server with TLS encryption. The serving certificate and key are
+// watched for changes for the life of the process, so that a cert-manager style rotation of the mounted
+// Secret is picked up live rather than requiring the pod to be restarted.
 func (s Server) StartWebhookServer(certPath, keyPath string) {
 	mylog := log.ComponentLogger(componentName, "StartWebhookSecureServer")
 	mylog.Debug().Str("certPath", certPath).Str("keyPath", keyPath).Msg("starting the secure webhook http server...")
 
-	// start the webhook server in a new routine
+	reloader, err := newCertReloader(certPath, keyPath)
+	if err != nil {
+		mylog.Fatal().Err(err).Msg("failed to load the webhook serving certificate")
+	}
+	reloader.startWatching(make(chan struct{}))
+	s.httpServer.TLSConfig.GetCertificate = reloader.GetCertificate
+
+	// start the webhook server in a new routine - certPath/keyPath are no longer passed to
+	// ListenAndServeTLS, since an empty pair tells it to rely on TLSConfig.GetCertificate instead of
+	// loading the files itself once at startup.
 	go func() {
-		if err := s.httpServer.ListenAndServeTLS(certPath, keyPath); err != nil {
+		if err := s.httpServer.ListenAndServeTLS("", ""); err != nil {
 			mylog.Fatal().Err(err).Msg("failed to start the webhook server")
 		}
 	}()
-
-	return
 }
 
 func configTLS(clientset *kubernetes.Clientset) *tls.Config {
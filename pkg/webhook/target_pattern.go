@@ -0,0 +1,158 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+)
+
+// isGlobPattern reports whether s should be treated as a glob pattern rather than a literal name. The
+// bare "*" and "*/*" keep their existing, distinct meanings - "match every main resource" and "match
+// every main resource and its subresources" respectively - and are not themselves treated as globs,
+// since the kubernetes apiserver already understands them natively.
+func isGlobPattern(s string) bool {
+	if s == "*" || s == "*/*" {
+		return false
+	}
+	return strings.ContainsAny(s, "*?[")
+}
+
+// validateTargetPattern checks that a single api-groups/api-versions/resources entry is either a
+// literal name, the wildcard "*", or a syntactically valid glob pattern. The empty string is not
+// rejected here, since it is the literal name of the core api-groups entry - callers that can't
+// legitimately see an empty entry (api-versions, resources) reject it themselves.
+func validateTargetPattern(s string) error {
+	if !isGlobPattern(s) {
+		return nil
+	}
+	if _, err := path.Match(s, ""); err != nil {
+		return fmt.Errorf("not a valid glob pattern: %v", err)
+	}
+	return nil
+}
+
+// MatchesPattern reports whether element matches pattern, which may be a literal name, the wildcard "*",
+// or a shell glob such as "*.company.com" or "*policies". An invalid pattern never matches anything -
+// Target.Validate should have already rejected it at config load.
+func MatchesPattern(element, pattern string) bool {
+	if pattern == "*" || element == pattern {
+		return true
+	}
+	matched, err := path.Match(pattern, element)
+	return err == nil && matched
+}
+
+// ExpandTargets replaces every glob pattern in targets' api-groups/api-versions/resources with the
+// explicit, deterministically sorted list of discovered names it matches, since a
+// MutatingWebhookConfiguration rule only understands literal names and the bare "*" wildcard - not glob
+// patterns - so registering a target containing one verbatim would silently match nothing. Targets with
+// no glob patterns are returned unchanged. It reports whether anything was expanded, so that a caller can
+// warn that a CRD created after this runs - and therefore missing from the discovery snapshot used here
+// - will need the rule re-registered before it matches.
+func ExpandTargets(targets []Target, disc discovery.DiscoveryInterface) ([]Target, bool, error) {
+	var hasGlob bool
+	for _, t := range targets {
+		for _, p := range concat(t.APIGroups, t.APIVersions, t.Resources) {
+			if isGlobPattern(p) {
+				hasGlob = true
+			}
+		}
+	}
+	if !hasGlob {
+		return targets, false, nil
+	}
+
+	groupList, err := disc.ServerGroups()
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to look up discovered api groups: %v", err)
+	}
+	var knownGroups []string
+	for _, g := range groupList.Groups {
+		knownGroups = append(knownGroups, g.Name)
+	}
+
+	resourceLists, err := disc.ServerResources()
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to look up discovered resources: %v", err)
+	}
+	seenVersions := make(map[string]bool)
+	seenResources := make(map[string]bool)
+	var knownVersions, knownResources []string
+	for _, rl := range resourceLists {
+		gv, err := schema.ParseGroupVersion(rl.GroupVersion)
+		if err != nil {
+			continue
+		}
+		if !seenVersions[gv.Version] {
+			seenVersions[gv.Version] = true
+			knownVersions = append(knownVersions, gv.Version)
+		}
+		for _, r := range rl.APIResources {
+			if !seenResources[r.Name] {
+				seenResources[r.Name] = true
+				knownResources = append(knownResources, r.Name)
+			}
+		}
+	}
+
+	expanded := make([]Target, len(targets))
+	for i, t := range targets {
+		expanded[i] = Target{
+			APIGroups:   expandPatterns(t.APIGroups, knownGroups),
+			APIVersions: expandPatterns(t.APIVersions, knownVersions),
+			Resources:   expandPatterns(t.Resources, knownResources),
+		}
+	}
+	return expanded, true, nil
+}
+
+// expandPatterns replaces every glob pattern in patterns with the subset of known it matches, leaving
+// literal names (including the bare "*") untouched, then returns the deduplicated result sorted.
+func expandPatterns(patterns, known []string) []string {
+	seen := make(map[string]bool)
+	var result []string
+	add := func(s string) {
+		if !seen[s] {
+			seen[s] = true
+			result = append(result, s)
+		}
+	}
+	for _, p := range patterns {
+		if !isGlobPattern(p) {
+			add(p)
+			continue
+		}
+		for _, k := range known {
+			if matched, err := path.Match(p, k); err == nil && matched {
+				add(k)
+			}
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+func concat(lists ...[]string) []string {
+	var all []string
+	for _, l := range lists {
+		all = append(all, l...)
+	}
+	return all
+}
@@ -0,0 +1,149 @@
+/*
+Copyright (C) 2018 Expedia Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchesPatternExactWildcardMatchesAnything(t *testing.T) {
+	assert.True(t, MatchesPattern("anything.company.com", "*"))
+}
+
+func TestMatchesPatternLiteralMustMatchExactly(t *testing.T) {
+	assert.True(t, MatchesPattern("apps", "apps"))
+	assert.False(t, MatchesPattern("apps", "extensions"))
+}
+
+func TestMatchesPatternSuffixGroupGlob(t *testing.T) {
+	assert.True(t, MatchesPattern("widgets.company.com", "*.company.com"))
+	assert.True(t, MatchesPattern("gadgets.company.com", "*.company.com"))
+	assert.False(t, MatchesPattern("widgets.other.com", "*.company.com"))
+}
+
+func TestMatchesPatternResourceSuffixGlob(t *testing.T) {
+	assert.True(t, MatchesPattern("networkpolicies", "*policies"))
+	assert.True(t, MatchesPattern("podsecuritypolicies", "*policies"))
+	assert.False(t, MatchesPattern("deployments", "*policies"))
+}
+
+func TestMatchesPatternInvalidGlobNeverMatches(t *testing.T) {
+	assert.False(t, MatchesPattern("anything", "[unterminated"))
+}
+
+func TestMatchesPatternSlashWildcardMatchesAnySubresource(t *testing.T) {
+	assert.True(t, MatchesPattern("*/*", "*/*"))
+	assert.True(t, MatchesPattern("deployments/scale", "*/*"))
+	assert.False(t, MatchesPattern("deployments", "*/*"), "*/* only matches names with a subresource part")
+}
+
+func TestExpandPatternsDoesNotTreatSlashWildcardAsAGlob(t *testing.T) {
+	result := expandPatterns([]string{"*/*"}, []string{"deployments", "deployments/scale"})
+	assert.Equal(t, []string{"*/*"}, result, "*/* is the kubernetes native wildcard for main resources and subresources, and must pass through untouched")
+}
+
+func TestTargetValidateAcceptsLiteralsWildcardAndGlobs(t *testing.T) {
+	target := Target{
+		APIGroups:   []string{"", "*.company.com"},
+		APIVersions: []string{"v1", "*"},
+		Resources:   []string{"deployments", "*policies"},
+	}
+	assert.NoError(t, target.Validate())
+}
+
+func TestTargetValidateRejectsAMalformedGlob(t *testing.T) {
+	target := Target{
+		APIGroups: []string{"[unterminated"},
+	}
+	assert.Error(t, target.Validate())
+}
+
+func TestTargetValidateRejectsAnEmptyAPIVersion(t *testing.T) {
+	target := Target{
+		APIVersions: []string{""},
+	}
+	assert.EqualError(t, target.Validate(), "invalid api-versions entry: empty string can never match a version")
+}
+
+func TestTargetValidateRejectsAnEmptyResource(t *testing.T) {
+	target := Target{
+		Resources: []string{""},
+	}
+	assert.EqualError(t, target.Validate(), "invalid resources entry: empty string can never match a resource")
+}
+
+func TestTargetValidateAllowsTheEmptyCoreAPIGroup(t *testing.T) {
+	target := Target{
+		APIGroups: []string{""},
+	}
+	assert.NoError(t, target.Validate(), "an empty api-groups entry is the literal name of the core api group")
+}
+
+func TestTargetValidateRejectsPodsBinding(t *testing.T) {
+	target := Target{
+		APIGroups:   []string{""},
+		APIVersions: []string{"v1"},
+		Resources:   []string{"pods/binding"},
+	}
+	assert.EqualError(t, target.Validate(), `invalid resources entry "pods/binding": a rule can never safely target pods/binding - it would be evaluated against the ephemeral Binding object the scheduler posts, not the Pod it describes`)
+}
+
+func TestTargetValidateRejectsPodsBindingCaseInsensitively(t *testing.T) {
+	target := Target{
+		Resources: []string{"Pods/Binding"},
+	}
+	assert.Error(t, target.Validate())
+}
+
+func TestRegistrationValidateReportsWhichTargetFailed(t *testing.T) {
+	r := Registration{
+		Name: "my-rule",
+		Targets: []Target{
+			{APIGroups: []string{"apps"}},
+			{Resources: []string{""}},
+		},
+	}
+	err := r.Validate()
+	assert.EqualError(t, err, "registration 'my-rule' target 1 is invalid: invalid resources entry: empty string can never match a resource")
+}
+
+func TestExpandPatternsLeavesLiteralsAndWildcardUntouched(t *testing.T) {
+	result := expandPatterns([]string{"apps", "*"}, []string{"apps", "extensions", "batch"})
+	assert.ElementsMatch(t, []string{"apps", "*"}, result)
+}
+
+func TestExpandPatternsResolvesASuffixGlobAgainstKnownNames(t *testing.T) {
+	known := []string{"widgets.company.com", "gadgets.company.com", "widgets.other.com", "apps"}
+	result := expandPatterns([]string{"*.company.com"}, known)
+	assert.Equal(t, []string{"gadgets.company.com", "widgets.company.com"}, result, "expansion output should be deterministically sorted")
+}
+
+func TestExpandPatternsResourceSuffixGlob(t *testing.T) {
+	known := []string{"networkpolicies", "podsecuritypolicies", "deployments"}
+	result := expandPatterns([]string{"*policies"}, known)
+	assert.Equal(t, []string{"networkpolicies", "podsecuritypolicies"}, result)
+}
+
+func TestExpandPatternsNonMatchingPatternExpandsToNothing(t *testing.T) {
+	result := expandPatterns([]string{"*.nonexistent.example"}, []string{"apps", "extensions"})
+	assert.Empty(t, result)
+}
+
+func TestExpandPatternsDeduplicatesAcrossMultiplePatterns(t *testing.T) {
+	known := []string{"widgets.company.com", "gadgets.company.com"}
+	result := expandPatterns([]string{"*.company.com", "widgets.company.com"}, known)
+	assert.Equal(t, []string{"gadgets.company.com", "widgets.company.com"}, result)
+}